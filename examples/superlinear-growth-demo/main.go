@@ -1,26 +1,33 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"math"
 	"math/rand"
 	"os"
 	"strings"
-	"time"
 
 	"github.com/TheEntropyCollective/randomfs-core/pkg/randomfs"
 )
 
 func main() {
+	dataDir := flag.String("data-dir", "", "data directory to keep block popularity in across runs (default: a temporary one)")
+	flag.Parse()
+
 	fmt.Println("🚀 RandomFS Superlinear Growth Demonstration")
 	fmt.Println(strings.Repeat("=", 60))
 
-	// Create test directory
-	testDir := "/tmp/randomfs_superlinear_test"
-	os.RemoveAll(testDir)
-	os.MkdirAll(testDir, 0755)
-	defer os.RemoveAll(testDir)
+	// Without a data directory every run starts from nothing
+	testDir := *dataDir
+	if testDir == "" {
+		var err error
+		if testDir, err = os.MkdirTemp("", "randomfs_superlinear"); err != nil {
+			log.Fatalf("Failed to create data directory: %v", err)
+		}
+		defer os.RemoveAll(testDir)
+	}
 
 	// Initialize RandomFS
 	rfs, err := randomfs.NewRandomFSWithoutIPFS(testDir, 1024*1024) // 1MB cache
@@ -29,21 +36,30 @@ func main() {
 	}
 	defer rfs.Close()
 
-	// Initialize superlinear growth manager
+	// Initialize superlinear growth manager, resuming earlier runs
 	sgm := randomfs.NewSuperlinearGrowthManager(rfs)
+	defer func() {
+		if err := sgm.Save(); err != nil {
+			log.Printf("Failed to save block popularity: %v", err)
+		}
+	}()
+	if metrics := sgm.GetSuperlinearMetrics(); metrics["total_selections"].(int64) > 0 {
+		fmt.Printf("Resuming %d selections over %d tracked blocks (%.1f%% reused)\n",
+			metrics["total_selections"], metrics["tracked_blocks"], metrics["reuse_rate"].(float64)*100)
+	}
 
 	// Simulate network growth and measure efficiency
 	networkSizes := []int{1, 5, 10, 25, 50, 100, 250, 500, 1000}
 
 	fmt.Println("\n📊 Superlinear Growth Analysis")
-	fmt.Println("Network Size | Efficiency | Multiplier | Community Effect | Growth Type")
+	fmt.Println("Network Size | Reuse Rate | Multiplier | Reuse Multiplier | Growth Type")
 	fmt.Println(strings.Repeat("-", 75))
 
-	var previousEfficiency float64 = 0.15 // Starting baseline
+	var previousEfficiency float64
 
 	for _, size := range networkSizes {
 		// Simulate network of this size
-		efficiency := simulateNetworkSize(sgm, size, 50) // 50 files per node
+		efficiency := simulateNetworkSize(sgm, size, 2) // 2 files per node
 
 		// Calculate growth multiplier
 		var growthMultiplier float64
@@ -90,9 +106,9 @@ func main() {
 	fmt.Println("\n✅ Superlinear growth demonstration complete!")
 }
 
+// simulateNetworkSize stores filesPerNode files on each node and returns
+// the fraction of their randomizers that reused stored blocks
 func simulateNetworkSize(sgm *randomfs.SuperlinearGrowthManager, networkSize int, filesPerNode int) float64 {
-	rand.Seed(time.Now().UnixNano())
-
 	totalBlocks := 0
 	reusedBlocks := 0
 
@@ -116,20 +132,10 @@ func simulateNetworkSize(sgm *randomfs.SuperlinearGrowthManager, networkSize int
 		}
 	}
 
-	// Calculate efficiency
 	if totalBlocks == 0 {
-		return 0.15 // Baseline
+		return 0
 	}
-
-	reuseRate := float64(reusedBlocks) / float64(totalBlocks)
-
-	// Apply superlinear formula
-	networkFactor := math.Log1p(float64(networkSize)) / 5.0
-	communityFactor := math.Sqrt(float64(networkSize)) / 20.0
-
-	efficiency := 0.15 + reuseRate*0.5 + networkFactor*0.2 + communityFactor*0.3
-
-	return math.Min(efficiency, 0.85) // Cap at 85% for realism
+	return float64(reusedBlocks) / float64(totalBlocks)
 }
 
 func demonstrateCommunityEffects(sgm *randomfs.SuperlinearGrowthManager) {
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/TheEntropyCollective/randomfs-core/pkg/randomfs"
+)
+
+const usage = `Usage: randomfs <command> [flags]
+
+Commands:
+  store <file>            Store a file, or stdin for -, and print its rd:// URL
+  get <rd-url-or-hash>    Write a stored file to stdout, or to -o
+  store-dir <dir>         Store a directory tree and print the URL of its manifest
+  get-dir <hash> <dest>   Recreate a stored directory tree in dest
+  info <hash>             Print the representation of a stored file as JSON
+  verify <hash>           Check every block of a stored file
+  stats                   Print the statistics of the instance as JSON
+  webdav                  Serve the stored files over WebDAV on -addr
+  diagnostics             Write a JSON snapshot of the instance for bug reports
+
+Every command takes -data, -ipfs, -no-ipfs and -cache to select the instance,
+and -gateway to read through an IPFS gateway when the API is unreachable.
+`
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintf(os.Stderr, "randomfs: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run executes the command named by args[0]
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return fmt.Errorf("no command given")
+	}
+
+	switch args[0] {
+	case "store":
+		return runStore(args[1:], stdin, stdout, stderr)
+	case "get":
+		return runGet(args[1:], stdout, stderr)
+	case "store-dir":
+		return runStoreDir(args[1:], stdout, stderr)
+	case "get-dir":
+		return runGetDir(args[1:], stderr)
+	case "info":
+		return runInfo(args[1:], stdout, stderr)
+	case "verify":
+		return runVerify(args[1:], stdout, stderr)
+	case "stats":
+		return runStats(args[1:], stdout, stderr)
+	case "webdav":
+		return runWebDAV(args[1:], stdout, stderr)
+	case "diagnostics":
+		return runDiagnostics(args[1:], stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return nil
+	}
+	fmt.Fprint(stderr, usage)
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+// instanceFlags are the flags selecting the instance a command opens
+type instanceFlags struct {
+	dataDir   string
+	ipfsAPI   string
+	noIPFS    bool
+	gateway   string
+	cacheSize int64
+}
+
+// register adds the instance flags to fs
+func (f *instanceFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.dataDir, "data", randomfs.DefaultDataDir, "Data directory")
+	fs.StringVar(&f.ipfsAPI, "ipfs", randomfs.DefaultIPFSAPI, "IPFS API endpoint")
+	fs.BoolVar(&f.noIPFS, "no-ipfs", false, "Run without IPFS, storing blocks locally")
+	fs.StringVar(&f.gateway, "gateway", "", "IPFS gateway to read from when the API is unreachable, such as https://ipfs.io")
+	fs.Int64Var(&f.cacheSize, "cache", randomfs.DefaultCacheSize, "Block cache size in bytes")
+}
+
+// open opens the instance the flags select
+func (f *instanceFlags) open() (*randomfs.RandomFS, error) {
+	rfs, err := randomfs.NewRandomFSWithConfig(randomfs.Config{
+		EnableIPFS: !f.noIPFS,
+		IPFSAPI:    f.ipfsAPI,
+		GatewayURL: f.gateway,
+		DataDir:    f.dataDir,
+		CacheSize:  f.cacheSize,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize RandomFS: %v", err)
+	}
+	return rfs, nil
+}
+
+// parseArgs parses args into fs, allowing flags after the positional
+// arguments, and checks that exactly want positional arguments are given
+func parseArgs(fs *flag.FlagSet, args []string, want int) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	if len(positional) != want {
+		return nil, fmt.Errorf("%s takes %d argument(s), got %d", fs.Name(), want, len(positional))
+	}
+	return positional, nil
+}
+
+// newFlagSet returns a flag set for command with the instance flags
+func newFlagSet(command string, stderr io.Writer, instance *instanceFlags) *flag.FlagSet {
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	instance.register(fs)
+	return fs
+}
+
+// repHashOf returns the representation hash of ref, which is an rd:// URL,
+// a compact RD: URL or a bare representation hash
+func repHashOf(ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, "rd://"):
+		rdURL, err := randomfs.ParseRandomURL(ref)
+		if err != nil {
+			return "", err
+		}
+		return rdURL.RepHash, nil
+	case len(ref) >= 3 && strings.EqualFold(ref[:3], "rd:"):
+		rdURL, err := randomfs.ParseCompactRandomURL(ref)
+		if err != nil {
+			return "", err
+		}
+		return rdURL.RepHash, nil
+	}
+	return ref, nil
+}
+
+// writeJSONTo writes v to w as indented JSON
+func writeJSONTo(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// runStore stores a file, or stdin when the file is -, and prints its URL
+func runStore(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	var instance instanceFlags
+	fs := newFlagSet("store", stderr, &instance)
+	name := fs.String("name", "", "File name to store under (default: the base name of the file, or stdin)")
+	contentType := fs.String("type", "", "Content type (default: detected from the name and data)")
+	positional, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	path := positional[0]
+	if *name == "" {
+		*name = filepath.Base(path)
+		if path == "-" {
+			*name = "stdin"
+		}
+	}
+
+	var data []byte
+	if path != "-" {
+		if data, err = os.ReadFile(path); err != nil {
+			return fmt.Errorf("failed to read %s: %v", path, err)
+		}
+	}
+
+	rfs, err := instance.open()
+	if err != nil {
+		return err
+	}
+	defer rfs.Close()
+
+	// Stdin is streamed, so piped data is never held in memory as a whole
+	var rdURL *randomfs.RandomURL
+	if path == "-" {
+		rdURL, err = rfs.StoreReader(*name, stdin, randomfs.UnknownSize, *contentType)
+	} else {
+		rdURL, err = rfs.StoreFile(*name, data, *contentType)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store %s: %v", path, err)
+	}
+	fmt.Fprintln(stdout, rdURL.String())
+	return nil
+}
+
+// runGet writes a stored file to stdout or the file named by -o
+func runGet(args []string, stdout, stderr io.Writer) (err error) {
+	var instance instanceFlags
+	fs := newFlagSet("get", stderr, &instance)
+	output := fs.String("o", "-", "File to write to, - for stdout")
+	positional, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	repHash, err := repHashOf(positional[0])
+	if err != nil {
+		return err
+	}
+
+	rfs, err := instance.open()
+	if err != nil {
+		return err
+	}
+	defer rfs.Close()
+
+	w := stdout
+	if *output != "-" {
+		f, createErr := os.Create(*output)
+		if createErr != nil {
+			return fmt.Errorf("failed to create %s: %v", *output, createErr)
+		}
+		// Don't leave a partial file behind a failed retrieval
+		defer func() {
+			if closeErr := f.Close(); err == nil && closeErr != nil {
+				err = fmt.Errorf("failed to write %s: %v", *output, closeErr)
+			}
+			if err != nil {
+				os.Remove(*output)
+			}
+		}()
+		w = f
+	}
+
+	if _, err := rfs.RetrieveFileTo(repHash, w); err != nil {
+		return fmt.Errorf("failed to retrieve %s: %v", repHash, err)
+	}
+	return nil
+}
+
+// runStoreDir stores a directory tree and prints the URL of its manifest
+func runStoreDir(args []string, stdout, stderr io.Writer) error {
+	var instance instanceFlags
+	fs := newFlagSet("store-dir", stderr, &instance)
+	positional, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	rfs, err := instance.open()
+	if err != nil {
+		return err
+	}
+	defer rfs.Close()
+
+	rdURL, err := rfs.StoreDirectory(positional[0])
+	if err != nil {
+		return fmt.Errorf("failed to store %s: %v", positional[0], err)
+	}
+	fmt.Fprintln(stdout, rdURL.String())
+	return nil
+}
+
+// runGetDir recreates a stored directory tree
+func runGetDir(args []string, stderr io.Writer) error {
+	var instance instanceFlags
+	fs := newFlagSet("get-dir", stderr, &instance)
+	positional, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	repHash, err := repHashOf(positional[0])
+	if err != nil {
+		return err
+	}
+
+	rfs, err := instance.open()
+	if err != nil {
+		return err
+	}
+	defer rfs.Close()
+
+	if err := rfs.RetrieveDirectory(repHash, positional[1]); err != nil {
+		return fmt.Errorf("failed to retrieve %s: %v", repHash, err)
+	}
+	return nil
+}
+
+// runInfo prints the representation of a stored file
+func runInfo(args []string, stdout, stderr io.Writer) error {
+	var instance instanceFlags
+	fs := newFlagSet("info", stderr, &instance)
+	positional, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	repHash, err := repHashOf(positional[0])
+	if err != nil {
+		return err
+	}
+
+	rfs, err := instance.open()
+	if err != nil {
+		return err
+	}
+	defer rfs.Close()
+
+	rep, err := rfs.GetRepresentation(repHash)
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %v", repHash, err)
+	}
+	return writeJSONTo(stdout, rep)
+}
+
+// runVerify checks every block of a stored file, failing unless all are
+// present and intact
+func runVerify(args []string, stdout, stderr io.Writer) error {
+	var instance instanceFlags
+	fs := newFlagSet("verify", stderr, &instance)
+	verbose := fs.Bool("v", false, "Print the status of every block as JSON")
+	positional, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	repHash, err := repHashOf(positional[0])
+	if err != nil {
+		return err
+	}
+
+	rfs, err := instance.open()
+	if err != nil {
+		return err
+	}
+	defer rfs.Close()
+
+	report, err := rfs.VerifyFileBlocks(repHash)
+	if err != nil {
+		return fmt.Errorf("failed to verify %s: %v", repHash, err)
+	}
+	if *verbose {
+		if err := writeJSONTo(stdout, report); err != nil {
+			return err
+		}
+	} else {
+		fmt.Fprintf(stdout, "%s: %d of %d blocks ok, %d missing, %d corrupt\n",
+			repHash, report.OK, report.Checked, report.Missing, report.Corrupt)
+	}
+	if !report.Healthy() {
+		return fmt.Errorf("%s is damaged", repHash)
+	}
+	return nil
+}
+
+// runStats prints the statistics of an instance
+func runStats(args []string, stdout, stderr io.Writer) error {
+	var instance instanceFlags
+	fs := newFlagSet("stats", stderr, &instance)
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+
+	rfs, err := instance.open()
+	if err != nil {
+		return err
+	}
+	defer rfs.Close()
+
+	return writeJSONTo(stdout, rfs.GetStats())
+}
+
+// runDiagnostics writes the diagnostics of an instance to stdout
+func runDiagnostics(args []string, stdout, stderr io.Writer) error {
+	var instance instanceFlags
+	fs := newFlagSet("diagnostics", stderr, &instance)
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+
+	rfs, err := instance.open()
+	if err != nil {
+		return err
+	}
+	defer rfs.Close()
+
+	return rfs.DumpDiagnostics(stdout)
+}
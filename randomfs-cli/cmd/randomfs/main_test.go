@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/TheEntropyCollective/randomfs-core/pkg/randomfs"
+)
+
+func TestDiagnosticsCommand(t *testing.T) {
+	dataDir := t.TempDir()
+	rfs, err := randomfs.NewRandomFSWithoutIPFS(dataDir, 1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFSWithoutIPFS: %v", err)
+	}
+	if _, err := rfs.StoreFile("hello.txt", []byte("hello"), "text/plain"); err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	rfs.Close()
+
+	var stdout, stderr bytes.Buffer
+	if err := run([]string{"diagnostics", "-no-ipfs", "-data", dataDir}, nil, &stdout, &stderr); err != nil {
+		t.Fatalf("diagnostics: %v\n%s", err, stderr.String())
+	}
+	var dump struct {
+		Config struct {
+			Backend string `json:"backend"`
+			DataDir string `json:"data_dir"`
+		} `json:"config"`
+		Files int `json:"files"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &dump); err != nil {
+		t.Fatalf("diagnostics are not valid JSON: %v\n%s", err, stdout.String())
+	}
+	if dump.Config.Backend != "local" || dump.Config.DataDir != dataDir || dump.Files != 1 {
+		t.Errorf("unexpected diagnostics %+v", dump)
+	}
+}
+
+func TestUnknownCommand(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if err := run([]string{"frobnicate"}, nil, &stdout, &stderr); err == nil {
+		t.Fatal("unknown command succeeded")
+	}
+	if err := run(nil, nil, &stdout, &stderr); err == nil {
+		t.Fatal("missing command succeeded")
+	}
+}
+
+// runCommand runs a command against the local instance in dataDir and
+// returns its output
+func runCommand(t *testing.T, dataDir string, stdin []byte, args ...string) (string, error) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	args = append(args, "-no-ipfs", "-data", dataDir)
+	err := run(args, bytes.NewReader(stdin), &stdout, &stderr)
+	return stdout.String(), err
+}
+
+func TestStoreAndGetCommands(t *testing.T) {
+	dataDir := t.TempDir()
+	data := bytes.Repeat([]byte("piped through the shell\n"), 200)
+
+	out, err := runCommand(t, dataDir, data, "store", "-name", "log.txt", "-")
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	rdURL, err := randomfs.ParseRandomURL(strings.TrimSpace(out))
+	if err != nil {
+		t.Fatalf("store printed %q: %v", out, err)
+	}
+	if rdURL.FileName != "log.txt" || rdURL.FileSize != int64(len(data)) {
+		t.Errorf("stored as %+v", rdURL)
+	}
+
+	// Files are read from disk too, and -o may follow the URL
+	path := filepath.Join(t.TempDir(), "report.json")
+	if err := os.WriteFile(path, []byte(`{"ok":true}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err = runCommand(t, dataDir, nil, "store", path)
+	if err != nil {
+		t.Fatalf("store %s: %v", path, err)
+	}
+	stored, err := randomfs.ParseRandomURL(strings.TrimSpace(out))
+	if err != nil || stored.FileName != "report.json" {
+		t.Fatalf("store printed %q: %v", out, err)
+	}
+
+	got, err := runCommand(t, dataDir, nil, "get", rdURL.String())
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if got != string(data) {
+		t.Error("get by URL wrote different content")
+	}
+	output := filepath.Join(t.TempDir(), "out.txt")
+	if _, err := runCommand(t, dataDir, nil, "get", rdURL.Compact(), "-o", output); err != nil {
+		t.Fatalf("get -o: %v", err)
+	}
+	if written, _ := os.ReadFile(output); !bytes.Equal(written, data) {
+		t.Error("get -o wrote different content")
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing.txt")
+	if _, err := runCommand(t, dataDir, nil, "get", strings.Repeat("0", 64), "-o", missing); err == nil {
+		t.Fatal("get of an unknown hash succeeded")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Error("failed get left its output file behind")
+	}
+}
+
+func TestStoreDirAndGetDirCommands(t *testing.T) {
+	dataDir := t.TempDir()
+	root := filepath.Join(t.TempDir(), "project")
+	os.MkdirAll(filepath.Join(root, "src"), 0755)
+	os.MkdirAll(filepath.Join(root, "build"), 0755)
+	os.WriteFile(filepath.Join(root, "README"), []byte("read me"), 0644)
+	os.WriteFile(filepath.Join(root, "src", "main.go"), []byte("package main"), 0644)
+
+	out, err := runCommand(t, dataDir, nil, "store-dir", root)
+	if err != nil {
+		t.Fatalf("store-dir: %v", err)
+	}
+	rdURL, err := randomfs.ParseRandomURL(strings.TrimSpace(out))
+	if err != nil || rdURL.FileName != "project" {
+		t.Fatalf("store-dir printed %q: %v", out, err)
+	}
+
+	dest := filepath.Join(t.TempDir(), "restored")
+	if _, err := runCommand(t, dataDir, nil, "get-dir", rdURL.String(), dest); err != nil {
+		t.Fatalf("get-dir: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dest, "src", "main.go")); string(got) != "package main" {
+		t.Errorf("get-dir restored src/main.go as %q", got)
+	}
+	if info, err := os.Stat(filepath.Join(dest, "build")); err != nil || !info.IsDir() {
+		t.Errorf("get-dir did not restore the empty build directory: %v", err)
+	}
+}
+
+func TestInfoVerifyAndStatsCommands(t *testing.T) {
+	dataDir := t.TempDir()
+	out, err := runCommand(t, dataDir, []byte("hello"), "store", "-name", "hello.txt", "-")
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	rdURL, err := randomfs.ParseRandomURL(strings.TrimSpace(out))
+	if err != nil {
+		t.Fatalf("store printed %q: %v", out, err)
+	}
+
+	out, err = runCommand(t, dataDir, nil, "info", rdURL.RepHash)
+	if err != nil {
+		t.Fatalf("info: %v", err)
+	}
+	var rep randomfs.FileRepresentation
+	if err := json.Unmarshal([]byte(out), &rep); err != nil {
+		t.Fatalf("info is not a representation: %v\n%s", err, out)
+	}
+	if rep.FileName != "hello.txt" || rep.FileSize != 5 || rep.ContentType != "text/plain; charset=utf-8" {
+		t.Errorf("info printed %+v", rep)
+	}
+
+	out, err = runCommand(t, dataDir, nil, "verify", rdURL.String())
+	if err != nil {
+		t.Fatalf("verify: %v\n%s", err, out)
+	}
+	if !strings.Contains(out, "0 missing, 0 corrupt") {
+		t.Errorf("verify printed %q", out)
+	}
+	if _, err := runCommand(t, dataDir, nil, "verify", strings.Repeat("0", 64)); err == nil {
+		t.Error("verify of an unknown hash succeeded")
+	}
+
+	out, err = runCommand(t, dataDir, nil, "stats")
+	if err != nil {
+		t.Fatalf("stats: %v", err)
+	}
+	var stats map[string]interface{}
+	if err := json.Unmarshal([]byte(out), &stats); err != nil {
+		t.Fatalf("stats are not valid JSON: %v\n%s", err, out)
+	}
+	if _, ok := stats["files_stored"]; !ok {
+		t.Errorf("stats lack files_stored: %s", out)
+	}
+	if _, err := runCommand(t, dataDir, nil, "stats", "extra"); err == nil {
+		t.Error("stats accepted an argument")
+	}
+}
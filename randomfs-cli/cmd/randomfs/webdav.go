@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/TheEntropyCollective/randomfs-core/pkg/randomfs"
+	"golang.org/x/net/webdav"
+)
+
+// runWebDAV serves an instance over WebDAV until interrupted
+func runWebDAV(args []string, stdout, stderr io.Writer) error {
+	var instance instanceFlags
+	fs := newFlagSet("webdav", stderr, &instance)
+	addr := fs.String("addr", "localhost:8081", "Address to serve WebDAV on")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+
+	rfs, err := instance.open()
+	if err != nil {
+		return err
+	}
+	defer rfs.Close()
+
+	server := &http.Server{Addr: *addr, Handler: newWebDAVHandler(rfs)}
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	fmt.Fprintf(stdout, "Serving RandomFS over WebDAV on http://%s/\n", *addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("failed to serve WebDAV: %v", err)
+	}
+	return nil
+}
+
+// newWebDAVHandler serves the files of rfs as a single WebDAV directory
+func newWebDAVHandler(rfs *randomfs.RandomFS) http.Handler {
+	dav := &webdav.Handler{
+		FileSystem: &davFS{rfs: rfs},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				slog.Error("WebDAV request failed", "method", r.Method, "path", r.URL.Path, "error", err)
+			}
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Serve the stored content type rather than one sniffed from the
+		// first blocks
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			if name, ok := davName(r.URL.Path); ok && name != "" {
+				if info, exists := lookupFile(rfs, name); exists && info.ContentType != "" {
+					w.Header().Set("Content-Type", info.ContentType)
+				}
+			}
+		}
+		dav.ServeHTTP(w, r)
+	})
+}
+
+// davFS implements webdav.FileSystem over the file index. The index is
+// flat, so the root is the only directory and each name maps to the most
+// recently stored file of that name.
+type davFS struct {
+	rfs *randomfs.RandomFS
+}
+
+// davName returns the file name a WebDAV path refers to, "" for the root.
+// ok is false for paths below the root, which cannot exist.
+func davName(path string) (string, bool) {
+	name := strings.Trim(path, "/")
+	return name, !strings.Contains(name, "/")
+}
+
+// lookupFile returns the most recently stored file named name
+func lookupFile(rfs *randomfs.RandomFS, name string) (randomfs.FileInfo, bool) {
+	var latest randomfs.FileInfo
+	found := false
+	for _, info := range rfs.ListFiles() {
+		if info.FileName == name && (!found || !info.StoredAt.Before(latest.StoredAt)) {
+			latest, found = info, true
+		}
+	}
+	return latest, found
+}
+
+func (d *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: errors.New("RandomFS has no subdirectories")}
+}
+
+func (d *davFS) OpenFile(ctx context.Context, path string, flag int, perm os.FileMode) (webdav.File, error) {
+	name, ok := davName(path)
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	writing := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if name == "" {
+		if writing {
+			return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrPermission}
+		}
+		return &davDir{rfs: d.rfs}, nil
+	}
+
+	info, exists := lookupFile(d.rfs, name)
+	if writing {
+		if !exists && flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+		}
+		return newDAVUpload(d.rfs, name)
+	}
+	if !exists {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	stream, err := d.rfs.OpenFileStream(info.RepHash)
+	if err != nil {
+		return nil, err
+	}
+	return &davFile{FileStream: stream, info: info}, nil
+}
+
+// RemoveAll deletes every stored file with the name
+func (d *davFS) RemoveAll(ctx context.Context, path string) error {
+	name, ok := davName(path)
+	if !ok {
+		return &os.PathError{Op: "remove", Path: path, Err: os.ErrNotExist}
+	}
+	if name == "" {
+		return &os.PathError{Op: "remove", Path: path, Err: os.ErrPermission}
+	}
+	return removeFiles(d.rfs, name, "")
+}
+
+// removeFiles deletes the files named name other than keep
+func removeFiles(rfs *randomfs.RandomFS, name, keep string) error {
+	removed := false
+	for _, info := range rfs.ListFiles() {
+		if info.FileName != name || info.RepHash == keep {
+			continue
+		}
+		if err := rfs.DeleteFile(info.RepHash); err != nil {
+			return err
+		}
+		removed = true
+	}
+	if !removed && keep == "" {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	return nil
+}
+
+func (d *davFS) Rename(ctx context.Context, oldPath, newPath string) error {
+	oldName, ok := davName(oldPath)
+	if !ok || oldName == "" {
+		return &os.PathError{Op: "rename", Path: oldPath, Err: os.ErrNotExist}
+	}
+	newName, ok := davName(newPath)
+	if !ok || newName == "" {
+		return &os.PathError{Op: "rename", Path: newPath, Err: os.ErrPermission}
+	}
+	info, exists := lookupFile(d.rfs, oldName)
+	if !exists {
+		return &os.PathError{Op: "rename", Path: oldPath, Err: os.ErrNotExist}
+	}
+	return d.rfs.RenameFile(info.RepHash, newName)
+}
+
+func (d *davFS) Stat(ctx context.Context, path string) (os.FileInfo, error) {
+	name, ok := davName(path)
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	}
+	if name == "" {
+		return davDirInfo{}, nil
+	}
+	info, exists := lookupFile(d.rfs, name)
+	if !exists {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	}
+	return davFileInfo{info}, nil
+}
+
+// davFileInfo describes a stored file. Its ETag and content type come from
+// the index, so listings never fetch blocks.
+type davFileInfo struct {
+	info randomfs.FileInfo
+}
+
+func (fi davFileInfo) Name() string       { return fi.info.FileName }
+func (fi davFileInfo) Size() int64        { return fi.info.FileSize }
+func (fi davFileInfo) Mode() os.FileMode  { return 0444 }
+func (fi davFileInfo) ModTime() time.Time { return fi.info.StoredAt }
+func (fi davFileInfo) IsDir() bool        { return false }
+func (fi davFileInfo) Sys() interface{}   { return nil }
+
+// ETag implements webdav.ETager; a representation hash names its content
+func (fi davFileInfo) ETag(ctx context.Context) (string, error) {
+	if fi.info.RepHash == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + fi.info.RepHash + `"`, nil
+}
+
+// ContentType implements webdav.ContentTyper
+func (fi davFileInfo) ContentType(ctx context.Context) (string, error) {
+	if fi.info.ContentType == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return fi.info.ContentType, nil
+}
+
+// davDirInfo describes the root directory
+type davDirInfo struct{}
+
+func (davDirInfo) Name() string       { return "/" }
+func (davDirInfo) Size() int64        { return 0 }
+func (davDirInfo) Mode() os.FileMode  { return os.ModeDir | 0755 }
+func (davDirInfo) ModTime() time.Time { return time.Time{} }
+func (davDirInfo) IsDir() bool        { return true }
+func (davDirInfo) Sys() interface{}   { return nil }
+
+// davDir is the open root directory
+type davDir struct {
+	rfs     *randomfs.RandomFS
+	entries []fs.FileInfo
+	listed  bool
+}
+
+func (d *davDir) Readdir(count int) ([]fs.FileInfo, error) {
+	if !d.listed {
+		latest := make(map[string]randomfs.FileInfo)
+		for _, info := range d.rfs.ListFiles() {
+			if current, seen := latest[info.FileName]; !seen || !info.StoredAt.Before(current.StoredAt) {
+				latest[info.FileName] = info
+			}
+		}
+		for _, info := range latest {
+			d.entries = append(d.entries, davFileInfo{info})
+		}
+		d.listed = true
+	}
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+func (d *davDir) Stat() (fs.FileInfo, error)     { return davDirInfo{}, nil }
+func (d *davDir) Read([]byte) (int, error)       { return 0, errors.New("is a directory") }
+func (d *davDir) Seek(int64, int) (int64, error) { return 0, errors.New("is a directory") }
+func (d *davDir) Write([]byte) (int, error)      { return 0, errors.New("is a directory") }
+func (d *davDir) Close() error                   { return nil }
+
+// davFile is a stored file opened for reading. Reads and seeks go to a
+// FileStream, which fetches only the blocks covering what is read.
+type davFile struct {
+	*randomfs.FileStream
+	info randomfs.FileInfo
+}
+
+func (f *davFile) Readdir(int) ([]fs.FileInfo, error) { return nil, errors.New("not a directory") }
+func (f *davFile) Stat() (fs.FileInfo, error)         { return davFileInfo{f.info}, nil }
+func (f *davFile) Write([]byte) (int, error)          { return 0, os.ErrPermission }
+
+// davUpload is a file being written. Clients always send whole files, so
+// the data is spooled to a temporary file and stored on Close, replacing
+// the files stored under the name before.
+type davUpload struct {
+	rfs  *randomfs.RandomFS
+	name string
+	tmp  *os.File
+}
+
+func newDAVUpload(rfs *randomfs.RandomFS, name string) (*davUpload, error) {
+	tmp, err := os.CreateTemp("", "randomfs-webdav-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to spool upload: %v", err)
+	}
+	return &davUpload{rfs: rfs, name: name, tmp: tmp}, nil
+}
+
+func (u *davUpload) Write(p []byte) (int, error)                  { return u.tmp.Write(p) }
+func (u *davUpload) Read([]byte) (int, error)                     { return 0, os.ErrPermission }
+func (u *davUpload) Seek(offset int64, whence int) (int64, error) { return u.tmp.Seek(offset, whence) }
+func (u *davUpload) Readdir(int) ([]fs.FileInfo, error)           { return nil, errors.New("not a directory") }
+
+func (u *davUpload) Stat() (fs.FileInfo, error) {
+	size, err := u.tmp.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	return davFileInfo{randomfs.FileInfo{FileName: u.name, FileSize: size, StoredAt: time.Now()}}, nil
+}
+
+// Close stores the spooled data and deletes the files it replaces
+func (u *davUpload) Close() error {
+	defer os.Remove(u.tmp.Name())
+	defer u.tmp.Close()
+
+	size, err := u.tmp.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	rdURL, err := u.rfs.StoreReaderAt(u.name, u.tmp, size, "")
+	if err != nil {
+		return err
+	}
+	return removeFiles(u.rfs, u.name, rdURL.RepHash)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/TheEntropyCollective/randomfs-core/pkg/randomfs"
+)
+
+// davRequest sends a WebDAV request and returns the response
+func davRequest(t *testing.T, server *httptest.Server, method, path, body string, headers map[string]string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp, string(data)
+}
+
+func TestWebDAVServesFileIndex(t *testing.T) {
+	rfs, err := randomfs.NewRandomFSWithoutIPFS(t.TempDir(), 1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFSWithoutIPFS: %v", err)
+	}
+	defer rfs.Close()
+	server := httptest.NewServer(newWebDAVHandler(rfs))
+	defer server.Close()
+
+	content := strings.Repeat("mapped drive ", 300)
+	if resp, _ := davRequest(t, server, "PUT", "/notes.txt", content, nil); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT returned %d", resp.StatusCode)
+	}
+	files := rfs.ListFiles()
+	if len(files) != 1 || files[0].FileName != "notes.txt" || files[0].FileSize != int64(len(content)) {
+		t.Fatalf("PUT indexed %+v", files)
+	}
+
+	resp, body := davRequest(t, server, "PROPFIND", "/", "", map[string]string{"Depth": "1"})
+	if resp.StatusCode != http.StatusMultiStatus || !strings.Contains(body, "/notes.txt") || !strings.Contains(body, files[0].RepHash) {
+		t.Fatalf("PROPFIND returned %d: %s", resp.StatusCode, body)
+	}
+
+	resp, body = davRequest(t, server, "GET", "/notes.txt", "", nil)
+	if resp.StatusCode != http.StatusOK || body != content {
+		t.Fatalf("GET returned %d with %d bytes", resp.StatusCode, len(body))
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Errorf("GET served content type %q", got)
+	}
+	resp, body = davRequest(t, server, "GET", "/notes.txt", "", map[string]string{"Range": "bytes=13-24"})
+	if resp.StatusCode != http.StatusPartialContent || body != "mapped drive" {
+		t.Fatalf("range GET returned %d: %q", resp.StatusCode, body)
+	}
+
+	// Writing a name again replaces the file stored under it
+	davRequest(t, server, "PUT", "/notes.txt", "replaced", nil)
+	if files := rfs.ListFiles(); len(files) != 1 || files[0].FileSize != 8 {
+		t.Fatalf("overwrite left %+v", files)
+	}
+
+	if resp, _ := davRequest(t, server, "MOVE", "/notes.txt", "", map[string]string{"Destination": server.URL + "/renamed.txt"}); resp.StatusCode >= 300 {
+		t.Fatalf("MOVE returned %d", resp.StatusCode)
+	}
+	if resp, body := davRequest(t, server, "GET", "/renamed.txt", "", nil); resp.StatusCode != http.StatusOK || body != "replaced" {
+		t.Fatalf("GET after MOVE returned %d: %q", resp.StatusCode, body)
+	}
+
+	if resp, _ := davRequest(t, server, "MKCOL", "/folder", "", nil); resp.StatusCode < 400 {
+		t.Errorf("MKCOL returned %d for a flat index", resp.StatusCode)
+	}
+	if resp, _ := davRequest(t, server, "DELETE", "/renamed.txt", "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE returned %d", resp.StatusCode)
+	}
+	if files := rfs.ListFiles(); len(files) != 0 {
+		t.Fatalf("DELETE left %+v", files)
+	}
+	if resp, _ := davRequest(t, server, "GET", "/renamed.txt", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET of a deleted file returned %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,132 @@
+package ipfstest
+
+import (
+	"encoding/binary"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+const (
+	// defaultChunkSize is the chunk size of adds without a chunker
+	defaultChunkSize = 256 * 1024
+	// maxLinks is the most children a daemon gives one DAG node
+	maxLinks = 174
+	// unixfsFile is the UnixFS node type of file content
+	unixfsFile = 2
+)
+
+// dagNode is a node of a UnixFS file DAG under construction
+type dagNode struct {
+	cid cid.Cid
+	// size is the encoded size of the node and its descendants, and
+	// fileSize the length of the content it holds
+	size     uint64
+	fileSize uint64
+}
+
+// buildDAG chunks data into a balanced UnixFS DAG the way an add does,
+// returning the root CID and every node by CID. Nodes are hashed with the
+// multihash hashCode. rawLeaves stores chunks as raw CIDv1 blocks under
+// CIDv1 nodes; otherwise every node is a dag-pb node, with a CIDv0 if
+// hashCode is sha2-256 as CIDv0 allows no other.
+func buildDAG(data []byte, chunkSize int, rawLeaves bool, hashCode uint64) (string, map[string][]byte, error) {
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	nodes := make(map[string][]byte)
+	put := func(codec uint64, block []byte) (cid.Cid, error) {
+		digest, err := mh.Sum(block, hashCode, -1)
+		if err != nil {
+			return cid.Undef, err
+		}
+		var c cid.Cid
+		if rawLeaves || hashCode != mh.SHA2_256 {
+			c = cid.NewCidV1(codec, digest)
+		} else {
+			c = cid.NewCidV0(digest)
+		}
+		nodes[c.String()] = block
+		return c, nil
+	}
+
+	var level []dagNode
+	for offset := 0; offset == 0 || offset < len(data); offset += chunkSize {
+		chunk := data[offset:min(offset+chunkSize, len(data))]
+		block, codec := chunk, uint64(cid.Raw)
+		if !rawLeaves {
+			block, codec = encodePBNode(nil, encodeUnixFS(chunk, uint64(len(chunk)), nil)), cid.DagProtobuf
+		}
+		c, err := put(codec, block)
+		if err != nil {
+			return "", nil, err
+		}
+		level = append(level, dagNode{cid: c, size: uint64(len(block)), fileSize: uint64(len(chunk))})
+	}
+
+	for len(level) > 1 {
+		var parents []dagNode
+		for start := 0; start < len(level); start += maxLinks {
+			children := level[start:min(start+maxLinks, len(level))]
+			parent := dagNode{}
+			var blockSizes []uint64
+			for _, child := range children {
+				parent.fileSize += child.fileSize
+				blockSizes = append(blockSizes, child.fileSize)
+			}
+			block := encodePBNode(children, encodeUnixFS(nil, parent.fileSize, blockSizes))
+			c, err := put(cid.DagProtobuf, block)
+			if err != nil {
+				return "", nil, err
+			}
+			parent.cid = c
+			parent.size = uint64(len(block))
+			for _, child := range children {
+				parent.size += child.size
+			}
+			parents = append(parents, parent)
+		}
+		level = parents
+	}
+	return level[0].cid.String(), nodes, nil
+}
+
+// encodePBNode encodes a dag-pb node, links first as the canonical form
+// requires
+func encodePBNode(links []dagNode, data []byte) []byte {
+	var node []byte
+	for _, child := range links {
+		var link []byte
+		link = appendBytes(link, 1, child.cid.Bytes())
+		link = appendBytes(link, 2, nil)
+		link = appendVarint(link, 3, child.size)
+		node = appendBytes(node, 2, link)
+	}
+	return appendBytes(node, 1, data)
+}
+
+// encodeUnixFS encodes the UnixFS data of a file node
+func encodeUnixFS(content []byte, fileSize uint64, blockSizes []uint64) []byte {
+	data := appendVarint(nil, 1, unixfsFile)
+	if len(content) > 0 {
+		data = appendBytes(data, 2, content)
+	}
+	data = appendVarint(data, 3, fileSize)
+	for _, size := range blockSizes {
+		data = appendVarint(data, 4, size)
+	}
+	return data
+}
+
+// appendVarint appends a varint protobuf field
+func appendVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+// appendBytes appends a length-delimited protobuf field
+func appendBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
@@ -0,0 +1,370 @@
+// Package ipfstest provides an in-memory IPFS HTTP API for tests. It
+// implements the add, cat, block/stat, pin/add, pin/rm and version
+// endpoints RandomFS uses, addressing content the way a real daemon does:
+// raw adds of a single chunk get a CIDv1 raw CID, everything else the CID
+// of a UnixFS DAG. The DAG nodes are served by a trustless gateway under
+// /ipfs/.
+package ipfstest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mh "github.com/multiformats/go-multihash"
+	mhcore "github.com/multiformats/go-multihash/core"
+)
+
+// hashCodes maps the names an add accepts for its hash option to their
+// multihash codes
+var hashCodes = map[string]uint64{
+	"sha2-256":     mh.SHA2_256,
+	"sha2-512-256": mhcore.SHA2_512_256,
+	"blake3":       mh.BLAKE3,
+}
+
+// Server is a mock IPFS API backed by a map. Its zero value is not usable;
+// create one with NewServer.
+type Server struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	blocks   map[string][]byte
+	nodes    map[string][]byte
+	pinned   map[string]bool
+	adds     int
+	cats     map[string]int
+	pinCalls int
+
+	addDelay time.Duration
+	catDelay time.Duration
+	failAdd  bool
+	failCat  bool
+	corrupt  bool
+}
+
+// NewServer starts a mock IPFS API that is closed when the test ends
+func NewServer(tb testing.TB) *Server {
+	tb.Helper()
+	s := &Server{
+		blocks: make(map[string][]byte),
+		nodes:  make(map[string][]byte),
+		pinned: make(map[string]bool),
+		cats:   make(map[string]int),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v0/version", s.handleVersion)
+	mux.HandleFunc("/api/v0/add", s.handleAdd)
+	mux.HandleFunc("/api/v0/cat", s.handleCat)
+	mux.HandleFunc("/api/v0/block/stat", s.handleBlockStat)
+	mux.HandleFunc("/api/v0/pin/add", s.handlePin)
+	mux.HandleFunc("/api/v0/pin/rm", s.handlePin)
+	mux.HandleFunc("/ipfs/", s.handleGateway)
+
+	s.Server = httptest.NewServer(mux)
+	tb.Cleanup(s.Close)
+	return s
+}
+
+// APIURL returns the base URL to pass to RandomFS as the IPFS API
+func (s *Server) APIURL() string {
+	return s.URL
+}
+
+// Block returns the content stored under hash
+func (s *Server) Block(hash string) ([]byte, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data, ok := s.blocks[hash]
+	return data, ok
+}
+
+// GatewayURL returns the base URL to pass to RandomFS as an IPFS gateway
+func (s *Server) GatewayURL() string {
+	return s.URL
+}
+
+// Remove forgets the content stored under hash and its pin, as if the
+// daemon had garbage collected it
+func (s *Server) Remove(hash string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.blocks, hash)
+	delete(s.nodes, hash)
+	delete(s.pinned, hash)
+}
+
+// BlockCount returns the number of objects stored
+func (s *Server) BlockCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.blocks)
+}
+
+// Pinned reports whether hash is pinned
+func (s *Server) Pinned(hash string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.pinned[hash]
+}
+
+// Adds returns the number of add calls received
+func (s *Server) Adds() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.adds
+}
+
+// Cats returns the number of cat calls received for hash
+func (s *Server) Cats(hash string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.cats[hash]
+}
+
+// TotalCats returns the number of cat calls received
+func (s *Server) TotalCats() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	total := 0
+	for _, count := range s.cats {
+		total += count
+	}
+	return total
+}
+
+// PinCalls returns the number of pin/add and pin/rm calls received
+func (s *Server) PinCalls() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.pinCalls
+}
+
+// SetAddDelay delays every add response by delay
+func (s *Server) SetAddDelay(delay time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.addDelay = delay
+}
+
+// SetCatDelay delays every cat response by delay
+func (s *Server) SetCatDelay(delay time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.catDelay = delay
+}
+
+// FailAdds makes add calls fail with a server error while fail is set
+func (s *Server) FailAdds(fail bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.failAdd = fail
+}
+
+// FailCats makes cat calls fail with a server error while fail is set
+func (s *Server) FailCats(fail bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.failCat = fail
+}
+
+// Corrupt makes cat and the gateway flip the first byte of the content
+// they return while corrupt is set
+func (s *Server) Corrupt(corrupt bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.corrupt = corrupt
+}
+
+// wait sleeps for delay, like a slow daemon, and reports whether the
+// client is still waiting for the response
+func wait(r *http.Request, delay time.Duration) bool {
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{"Version": "ipfstest"})
+}
+
+func (s *Server) handleAdd(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	s.adds++
+	delay, fail := s.addDelay, s.failAdd
+	s.mutex.Unlock()
+
+	// The upload is read before the delay, as a daemon would, so that the
+	// server notices a client that gives up while it waits
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !wait(r, delay) {
+		return
+	}
+	if fail {
+		http.Error(w, "add failed", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	chunkSize := defaultChunkSize
+	fmt.Sscanf(query.Get("chunker"), "size-%d", &chunkSize)
+	hashCode := uint64(mh.SHA2_256)
+	if name := query.Get("hash"); name != "" {
+		var ok bool
+		if hashCode, ok = hashCodes[name]; !ok {
+			http.Error(w, "unknown hash function "+name, http.StatusBadRequest)
+			return
+		}
+	}
+	hash, nodes, err := buildDAG(data, chunkSize, query.Get("raw-leaves") == "true", hashCode)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.mutex.Lock()
+	s.blocks[hash] = data
+	for nodeHash, node := range nodes {
+		s.nodes[nodeHash] = node
+	}
+	if query.Get("pin") != "false" {
+		s.pinned[hash] = true
+	}
+	s.mutex.Unlock()
+
+	json.NewEncoder(w).Encode(map[string]string{"Hash": hash, "Size": fmt.Sprint(len(data))})
+}
+
+func (s *Server) handleCat(w http.ResponseWriter, r *http.Request) {
+	hash := r.URL.Query().Get("arg")
+
+	s.mutex.Lock()
+	s.cats[hash]++
+	data, ok := s.blocks[hash]
+	delay, fail, corrupt := s.catDelay, s.failCat, s.corrupt
+	s.mutex.Unlock()
+
+	if !wait(r, delay) {
+		return
+	}
+	if fail {
+		http.Error(w, "cat failed", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "block not found: "+hash, http.StatusInternalServerError)
+		return
+	}
+	if corrupt && len(data) > 0 {
+		data = append([]byte{data[0] ^ 0xff}, data[1:]...)
+	}
+	w.Write(data)
+}
+
+func (s *Server) handleBlockStat(w http.ResponseWriter, r *http.Request) {
+	hash := r.URL.Query().Get("arg")
+
+	s.mutex.Lock()
+	data, ok := s.blocks[hash]
+	s.mutex.Unlock()
+
+	if !ok {
+		http.Error(w, "block not found: "+hash, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"Key": hash, "Size": len(data)})
+}
+
+func (s *Server) handlePin(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pinCalls++
+
+	hashes := r.URL.Query()["arg"]
+	add := strings.HasSuffix(r.URL.Path, "/add")
+	for _, hash := range hashes {
+		if add {
+			if _, ok := s.blocks[hash]; !ok {
+				http.Error(w, "block not found: "+hash, http.StatusInternalServerError)
+				return
+			}
+		} else if !s.pinned[hash] {
+			http.Error(w, hash+" is not pinned", http.StatusInternalServerError)
+			return
+		}
+	}
+	for _, hash := range hashes {
+		if add {
+			s.pinned[hash] = true
+		} else {
+			delete(s.pinned, hash)
+		}
+	}
+	json.NewEncoder(w).Encode(map[string][]string{"Pins": hashes})
+}
+
+// handleGateway serves /ipfs/{cid} as a trustless gateway: the DAG node
+// itself with ?format=raw, otherwise the content it roots
+func (s *Server) handleGateway(w http.ResponseWriter, r *http.Request) {
+	hash := strings.TrimPrefix(r.URL.Path, "/ipfs/")
+	raw := r.URL.Query().Get("format") == "raw" || r.Header.Get("Accept") == "application/vnd.ipld.raw"
+
+	s.mutex.Lock()
+	data, ok := s.blocks[hash]
+	if raw {
+		data, ok = s.nodes[hash]
+	}
+	corrupt := s.corrupt
+	s.mutex.Unlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if corrupt && len(data) > 0 {
+		data = append([]byte{data[0] ^ 0xff}, data[1:]...)
+	}
+	if raw {
+		w.Header().Set("Content-Type", "application/vnd.ipld.raw")
+	}
+	w.Write(data)
+}
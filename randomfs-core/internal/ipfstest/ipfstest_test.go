@@ -0,0 +1,166 @@
+package ipfstest
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// add posts data to the mock's add endpoint and returns the response body
+func add(t *testing.T, s *Server, data []byte, query string) string {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, _ := writer.CreateFormFile("file", "block")
+	part.Write(data)
+	writer.Close()
+
+	resp, err := http.Post(s.APIURL()+"/api/v0/add?"+query, writer.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	defer resp.Body.Close()
+	out, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("add returned %d: %s", resp.StatusCode, out)
+	}
+	return string(out)
+}
+
+func post(t *testing.T, s *Server, path string) (int, string) {
+	t.Helper()
+	resp, err := http.Post(s.APIURL()+path, "", nil)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	out, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(out)
+}
+
+func TestAddCatAndPin(t *testing.T) {
+	s := NewServer(t)
+
+	// A raw single-chunk add is addressed by a CIDv1 raw CID
+	const rawCID = "bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e"
+	if out := add(t, s, []byte("hello world"), "pin=false&raw-leaves=true&chunker=size-1024"); !strings.Contains(out, rawCID) {
+		t.Fatalf("expected %s, got %s", rawCID, out)
+	}
+	if s.Pinned(rawCID) {
+		t.Fatal("pin=false add was pinned")
+	}
+
+	status, body := post(t, s, "/api/v0/cat?arg="+rawCID)
+	if status != http.StatusOK || body != "hello world" {
+		t.Fatalf("cat returned %d: %q", status, body)
+	}
+	if s.Cats(rawCID) != 1 {
+		t.Fatalf("expected one cat, got %d", s.Cats(rawCID))
+	}
+
+	if status, _ := post(t, s, "/api/v0/pin/add?arg="+rawCID); status != http.StatusOK || !s.Pinned(rawCID) {
+		t.Fatalf("pin/add returned %d", status)
+	}
+	if status, _ := post(t, s, "/api/v0/pin/rm?arg="+rawCID); status != http.StatusOK || s.Pinned(rawCID) {
+		t.Fatalf("pin/rm returned %d", status)
+	}
+	if _, body := post(t, s, "/api/v0/pin/rm?arg="+rawCID); !strings.Contains(body, "not pinned") {
+		t.Fatalf("expected a not pinned error, got %q", body)
+	}
+}
+
+func TestAddWithHashFunction(t *testing.T) {
+	s := NewServer(t)
+
+	// A raw add with another hash function gets a CIDv1 over its multihash
+	const blake3CID = "bafkr4igxjga67jykbseaxdmmdgc5a5o3zp3htom2l6mrjznk7fvyggu6eq"
+	if out := add(t, s, []byte("hello world"), "pin=false&raw-leaves=true&chunker=size-1024&hash=blake3"); !strings.Contains(out, blake3CID) {
+		t.Fatalf("expected %s, got %s", blake3CID, out)
+	}
+	if status, body := post(t, s, "/api/v0/block/stat?arg="+blake3CID); status != http.StatusOK || !strings.Contains(body, blake3CID) {
+		t.Fatalf("block/stat returned %d: %q", status, body)
+	}
+	if status, _ := post(t, s, "/api/v0/block/stat?arg=bafkreiabsent"); status == http.StatusOK {
+		t.Fatal("block/stat found a block that was never added")
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, _ := writer.CreateFormFile("file", "block")
+	part.Write([]byte("data"))
+	writer.Close()
+	resp, err := http.Post(s.APIURL()+"/api/v0/add?hash=md5", writer.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("add with an unknown hash function returned %d", resp.StatusCode)
+	}
+}
+
+func TestFailuresAndCorruption(t *testing.T) {
+	s := NewServer(t)
+	out := add(t, s, []byte("data"), "")
+	hash := out[strings.Index(out, "Qm") : strings.Index(out, "Qm")+46]
+
+	s.Corrupt(true)
+	if _, body := post(t, s, "/api/v0/cat?arg="+hash); body == "data" {
+		t.Fatal("expected corrupted content")
+	}
+	s.Corrupt(false)
+
+	s.FailCats(true)
+	if status, _ := post(t, s, "/api/v0/cat?arg="+hash); status != http.StatusInternalServerError {
+		t.Fatalf("expected a failed cat, got %d", status)
+	}
+	s.FailCats(false)
+
+	s.Remove(hash)
+	if status, _ := post(t, s, "/api/v0/cat?arg="+hash); status != http.StatusInternalServerError {
+		t.Fatalf("expected a removed block to be missing, got %d", status)
+	}
+	if s.BlockCount() != 0 {
+		t.Fatalf("expected no blocks, got %d", s.BlockCount())
+	}
+}
+
+func TestAddressesUnixFSAndServesGateway(t *testing.T) {
+	s := NewServer(t)
+
+	// A non-raw add is a dag-pb UnixFS node, as with "ipfs add"
+	const fileCID = "Qmf412jQZiuVUtdgnB36FXFX7xg5V6KEbSJ4dpQuhkLyfD"
+	if out := add(t, s, []byte("hello world"), ""); !strings.Contains(out, fileCID) {
+		t.Fatalf("expected %s, got %s", fileCID, out)
+	}
+
+	get := func(path string) string {
+		t.Helper()
+		resp, err := http.Get(s.GatewayURL() + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s returned %d", path, resp.StatusCode)
+		}
+		return string(body)
+	}
+	if body := get("/ipfs/" + fileCID); body != "hello world" {
+		t.Errorf("gateway served %q", body)
+	}
+	if node := get("/ipfs/" + fileCID + "?format=raw"); node != "\x0a\x11\x08\x02\x12\x0bhello world\x18\x0b" {
+		t.Errorf("gateway served node %q", node)
+	}
+
+	// Content of several chunks gets a root linking to the chunk nodes
+	out := add(t, s, bytes.Repeat([]byte("x"), 2500), "chunker=size-1024")
+	root := out[strings.Index(out, "Qm") : strings.Index(out, "Qm")+46]
+	if s.BlockCount() != 2 || strings.Count(get("/ipfs/"+root+"?format=raw"), "\x12\x00\x18") != 3 {
+		t.Errorf("expected a root with three links, got %q", get("/ipfs/"+root+"?format=raw"))
+	}
+}
@@ -0,0 +1,202 @@
+package randomfs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// AsyncState is the progress of a store queued with StoreAsync
+type AsyncState string
+
+// Async store states
+const (
+	// AsyncQueued stores wait for a free worker
+	AsyncQueued AsyncState = "queued"
+	// AsyncRunning stores are being stored by a worker
+	AsyncRunning AsyncState = "running"
+	// AsyncRetrying stores failed and wait for their next attempt
+	AsyncRetrying AsyncState = "retrying"
+	// AsyncDone stores succeeded; their status carries the URL
+	AsyncDone AsyncState = "done"
+	// AsyncFailed stores used up their attempts and are dead letters
+	AsyncFailed AsyncState = "failed"
+)
+
+// StoreStatus reports the progress of a store queued with StoreAsync
+type StoreStatus struct {
+	ID          string     `json:"id"`
+	FileName    string     `json:"filename"`
+	State       AsyncState `json:"state"`
+	Attempts    int        `json:"attempts"`
+	URL         *RandomURL `json:"url,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	NextAttempt time.Time  `json:"next_attempt,omitempty"`
+}
+
+// asyncJob is one queued store. Its data is kept until the store succeeds
+// so a failed store can be retried.
+type asyncJob struct {
+	status      StoreStatus
+	data        []byte
+	contentType string
+}
+
+// asyncStores tracks the stores queued with StoreAsync
+type asyncStores struct {
+	start       sync.Once
+	queue       chan *asyncJob
+	mutex       sync.Mutex
+	jobs        map[string]*asyncJob
+	deadLetters []string
+}
+
+// StoreAsync queues a file to be stored in the background and returns the
+// ID StoreStatus reports its progress under. Failed stores are retried with
+// exponential backoff up to AsyncMaxAttempts times before they are moved to
+// the dead-letter list, where they keep their data until retried.
+func (rfs *RandomFS) StoreAsync(filename string, data []byte, contentType string) (string, error) {
+	if rfs.readOnly {
+		return "", ErrReadOnly
+	}
+
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate store id: %v", err)
+	}
+	job := &asyncJob{
+		status:      StoreStatus{ID: hex.EncodeToString(raw), FileName: filename, State: AsyncQueued},
+		data:        data,
+		contentType: contentType,
+	}
+
+	rfs.startAsyncWorkers()
+	rfs.async.mutex.Lock()
+	rfs.async.jobs[job.status.ID] = job
+	rfs.async.mutex.Unlock()
+
+	go rfs.enqueueAsync(job)
+	return job.status.ID, nil
+}
+
+// StoreStatus returns the progress of the async store with the given ID
+func (rfs *RandomFS) StoreStatus(id string) (StoreStatus, bool) {
+	rfs.async.mutex.Lock()
+	defer rfs.async.mutex.Unlock()
+
+	job, exists := rfs.async.jobs[id]
+	if !exists {
+		return StoreStatus{}, false
+	}
+	return job.status, true
+}
+
+// DeadLetters returns the async stores that failed every attempt, oldest
+// first
+func (rfs *RandomFS) DeadLetters() []StoreStatus {
+	rfs.async.mutex.Lock()
+	defer rfs.async.mutex.Unlock()
+
+	statuses := make([]StoreStatus, 0, len(rfs.async.deadLetters))
+	for _, id := range rfs.async.deadLetters {
+		statuses = append(statuses, rfs.async.jobs[id].status)
+	}
+	return statuses
+}
+
+// RetryDeadLetter takes a failed async store off the dead-letter list and
+// queues it again with a fresh set of attempts
+func (rfs *RandomFS) RetryDeadLetter(id string) error {
+	rfs.async.mutex.Lock()
+	job, exists := rfs.async.jobs[id]
+	if !exists || job.status.State != AsyncFailed {
+		rfs.async.mutex.Unlock()
+		return fmt.Errorf("%w: no dead letter %s", ErrFileNotFound, id)
+	}
+	for i, deadID := range rfs.async.deadLetters {
+		if deadID == id {
+			rfs.async.deadLetters = append(rfs.async.deadLetters[:i], rfs.async.deadLetters[i+1:]...)
+			break
+		}
+	}
+	job.status.State = AsyncQueued
+	job.status.Attempts = 0
+	job.status.Error = ""
+	rfs.async.mutex.Unlock()
+
+	go rfs.enqueueAsync(job)
+	return nil
+}
+
+// startAsyncWorkers starts the async store workers the first time it is
+// called. They run until Close.
+func (rfs *RandomFS) startAsyncWorkers() {
+	rfs.async.start.Do(func() {
+		rfs.async.mutex.Lock()
+		rfs.async.jobs = make(map[string]*asyncJob)
+		rfs.async.mutex.Unlock()
+		rfs.async.queue = make(chan *asyncJob)
+
+		for i := 0; i < max(rfs.AsyncWorkers, 1); i++ {
+			rfs.background.Add(1)
+			go func() {
+				defer rfs.background.Done()
+				for {
+					select {
+					case <-rfs.done:
+						return
+					case job := <-rfs.async.queue:
+						rfs.runAsyncJob(job)
+					}
+				}
+			}()
+		}
+	})
+}
+
+// enqueueAsync hands job to a worker, giving up if rfs is closed first
+func (rfs *RandomFS) enqueueAsync(job *asyncJob) {
+	select {
+	case <-rfs.done:
+	case rfs.async.queue <- job:
+	}
+}
+
+// runAsyncJob makes one attempt at an async store and schedules a retry
+// or moves it to the dead-letter list if it fails
+func (rfs *RandomFS) runAsyncJob(job *asyncJob) {
+	rfs.async.mutex.Lock()
+	job.status.State = AsyncRunning
+	job.status.Attempts++
+	job.status.NextAttempt = time.Time{}
+	rfs.async.mutex.Unlock()
+
+	rdURL, err := rfs.StoreFile(job.status.FileName, job.data, job.contentType)
+
+	rfs.async.mutex.Lock()
+	defer rfs.async.mutex.Unlock()
+
+	if err == nil {
+		job.status.State = AsyncDone
+		job.status.URL = rdURL
+		job.status.Error = ""
+		job.data = nil
+		return
+	}
+
+	job.status.Error = err.Error()
+	if job.status.Attempts >= max(rfs.AsyncMaxAttempts, 1) {
+		job.status.State = AsyncFailed
+		rfs.async.deadLetters = append(rfs.async.deadLetters, job.status.ID)
+		rfs.log().Error("Async store failed", "id", job.status.ID, "file", job.status.FileName, "attempts", job.status.Attempts, "error", err)
+		return
+	}
+
+	delay := rfs.AsyncRetryBackoff << (job.status.Attempts - 1)
+	job.status.State = AsyncRetrying
+	job.status.NextAttempt = time.Now().Add(delay)
+	rfs.log().Warn("Async store failed, retrying", "id", job.status.ID, "file", job.status.FileName, "attempt", job.status.Attempts, "delay", delay, "error", err)
+	time.AfterFunc(delay, func() { rfs.enqueueAsync(job) })
+}
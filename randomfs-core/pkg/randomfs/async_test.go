@@ -0,0 +1,133 @@
+package randomfs
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TheEntropyCollective/randomfs-core/internal/ipfstest"
+)
+
+// newFlakyIPFSRandomFS returns an instance whose IPFS API rejects the first
+// failures add calls and then behaves normally
+func newFlakyIPFSRandomFS(t *testing.T, failures int64) (*ipfstest.Server, *RandomFS) {
+	t.Helper()
+	ipfs := ipfstest.NewServer(t)
+	var adds atomic.Int64
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v0/add" && adds.Add(1) <= failures {
+			http.Error(w, "transient failure", http.StatusServiceUnavailable)
+			return
+		}
+		ipfs.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(flaky.Close)
+
+	rfs, err := NewRandomFS(flaky.URL, t.TempDir(), 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFS: %v", err)
+	}
+	rfs.AsyncRetryBackoff = time.Millisecond
+	// Each failure should cost an async attempt, not an IPFS retry
+	rfs.IPFSRetry = RetryPolicy{}
+	rfs.StoreWorkers = 1
+	t.Cleanup(func() { rfs.Close() })
+	return ipfs, rfs
+}
+
+// waitForAsync polls the status of an async store until it is done or
+// failed
+func waitForAsync(t *testing.T, rfs *RandomFS, id string) StoreStatus {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		status, exists := rfs.StoreStatus(id)
+		if !exists {
+			t.Fatalf("no status for async store %s", id)
+		}
+		if status.State == AsyncDone || status.State == AsyncFailed {
+			return status
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("async store %s did not finish", id)
+	return StoreStatus{}
+}
+
+func TestStoreAsyncRetriesTransientFailures(t *testing.T) {
+	_, rfs := newFlakyIPFSRandomFS(t, 2)
+	data := bytes.Repeat([]byte("async retry "), 1000)
+
+	id, err := rfs.StoreAsync("retry.txt", data, "text/plain")
+	if err != nil {
+		t.Fatalf("StoreAsync: %v", err)
+	}
+	status := waitForAsync(t, rfs, id)
+	if status.State != AsyncDone {
+		t.Fatalf("async store ended %s: %s", status.State, status.Error)
+	}
+	if status.Attempts != 3 {
+		t.Errorf("async store took %d attempts, want 3", status.Attempts)
+	}
+	if status.URL == nil || status.Error != "" {
+		t.Fatalf("done status %+v lacks a URL or kept an error", status)
+	}
+	if len(rfs.DeadLetters()) != 0 {
+		t.Errorf("successful store left dead letters: %+v", rfs.DeadLetters())
+	}
+
+	got, _, err := rfs.RetrieveFile(status.URL.RepHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("retried store returned different data")
+	}
+}
+
+func TestStoreAsyncDeadLetters(t *testing.T) {
+	ipfs, rfs := newFlakyIPFSRandomFS(t, 0)
+	rfs.AsyncMaxAttempts = 2
+	ipfs.FailAdds(true)
+	data := []byte("permanently failing store")
+
+	id, err := rfs.StoreAsync("dead.txt", data, "text/plain")
+	if err != nil {
+		t.Fatalf("StoreAsync: %v", err)
+	}
+	status := waitForAsync(t, rfs, id)
+	if status.State != AsyncFailed || status.Attempts != 2 || status.Error == "" {
+		t.Fatalf("status %+v, want failed after 2 attempts with an error", status)
+	}
+	dead := rfs.DeadLetters()
+	if len(dead) != 1 || dead[0].ID != id {
+		t.Fatalf("dead letters %+v, want only %s", dead, id)
+	}
+
+	ipfs.FailAdds(false)
+	if err := rfs.RetryDeadLetter(id); err != nil {
+		t.Fatalf("RetryDeadLetter: %v", err)
+	}
+	status = waitForAsync(t, rfs, id)
+	if status.State != AsyncDone || status.Attempts != 1 {
+		t.Fatalf("retried dead letter ended %+v", status)
+	}
+	if len(rfs.DeadLetters()) != 0 {
+		t.Errorf("retried store still listed as a dead letter")
+	}
+	if err := rfs.RetryDeadLetter(id); err == nil {
+		t.Error("RetryDeadLetter of a finished store succeeded")
+	}
+}
+
+func TestStoreAsyncReadOnly(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	rfs.readOnly = true
+	if _, err := rfs.StoreAsync("ro.txt", []byte("x"), "text/plain"); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("StoreAsync on read-only instance: %v, want ErrReadOnly", err)
+	}
+}
@@ -0,0 +1,146 @@
+package randomfs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// NamedData is a file stored with StoreFiles. An empty ContentType is
+// detected as with StoreFile.
+type NamedData struct {
+	Name        string
+	Data        []byte
+	ContentType string
+}
+
+// BatchStats sums up the blocks written by one StoreFiles call
+type BatchStats struct {
+	Files int `json:"files"`
+	// FilesDeduplicated are files whose content was already stored
+	FilesDeduplicated int64 `json:"files_deduplicated"`
+	// BlocksGenerated counts the data blocks and fresh randomizers
+	// written, and RandomizersReused the blocks randomized with a block
+	// that was already stored instead
+	BlocksGenerated   int64 `json:"blocks_generated"`
+	RandomizersReused int64 `json:"randomizers_reused"`
+	Bytes             int64 `json:"bytes"`
+}
+
+// StoreFiles stores several files in one pass. Randomizers generated for
+// earlier files are pooled for the later ones, so a batch of similar
+// small files writes little more than one block per file instead of two.
+// Names are checked before any file is stored, the blocks of all files
+// are pinned together once they are stored, and if any file fails the
+// files already stored are deleted.
+func (rfs *RandomFS) StoreFiles(files []NamedData) ([]*RandomURL, error) {
+	urls, _, err := rfs.StoreFilesWithStats(files)
+	return urls, err
+}
+
+// StoreFilesWithStats stores files like StoreFiles and also returns what
+// the batch wrote
+func (rfs *RandomFS) StoreFilesWithStats(files []NamedData) (urls []*RandomURL, stats BatchStats, err error) {
+	ctx, span := rfs.startSpan(context.Background(), "randomfs.StoreFiles",
+		attribute.Int("randomfs.batch.files", len(files)))
+	defer func() { endSpan(span, err) }()
+
+	if rfs.readOnly {
+		return nil, stats, ErrReadOnly
+	}
+
+	paths := make([]string, len(files))
+	for i, file := range files {
+		paths[i] = file.Name
+	}
+
+	rfs.mutex.Lock()
+	defer rfs.mutex.Unlock()
+
+	names, err := rfs.directoryNames(paths)
+	if err != nil {
+		return nil, stats, err
+	}
+
+	before := rfs.GetStats()
+	urls = make([]*RandomURL, 0, len(files))
+	repHashes := make([]string, 0, len(files))
+	for i, file := range files {
+		rdURL, err := rfs.storeBatchFile(ctx, names[i], file)
+		if err != nil {
+			rfs.deleteBatchFiles(repHashes)
+			return nil, stats, fmt.Errorf("failed to store %s: %w", file.Name, err)
+		}
+		urls = append(urls, rdURL)
+		repHashes = append(repHashes, rdURL.RepHash)
+		stats.Bytes += rdURL.FileSize
+	}
+	if err := rfs.pinStoredFiles(repHashes); err != nil {
+		rfs.deleteBatchFiles(repHashes)
+		return nil, stats, fmt.Errorf("failed to pin files: %v", err)
+	}
+
+	after := rfs.GetStats()
+	stats.Files = len(files)
+	stats.FilesDeduplicated = after.FilesDeduplicated - before.FilesDeduplicated
+	stats.BlocksGenerated = after.BlocksGenerated - before.BlocksGenerated
+	stats.RandomizersReused = after.RandomizersReused - before.RandomizersReused
+	rfs.log().Info("Stored files", "files", stats.Files, "bytes", stats.Bytes,
+		"blocks_generated", stats.BlocksGenerated, "randomizers_reused", stats.RandomizersReused)
+	return urls, stats, nil
+}
+
+// storeBatchFile stores one file of a batch under name with its pins
+// deferred; callers hold the write lock
+func (rfs *RandomFS) storeBatchFile(ctx context.Context, name string, file NamedData) (*RandomURL, error) {
+	opts := storeOptions{deferPins: true}
+	contentType := file.ContentType
+	if contentType == "" {
+		contentType = DetectContentType(name, file.Data)
+	}
+	// A configured policy is respected; otherwise the batch reuses what
+	// the pool holds
+	strategy, ok := rfs.contentStrategy(contentType)
+	if (!ok || strategy.Policy == nil) && rfs.RandomizerPolicy == nil {
+		opts.policy = distinctReusePolicy()
+	}
+
+	src, size, contentType, opts, err := rfs.prepareBytes(name, file.Data, contentType, opts)
+	if err != nil {
+		return nil, err
+	}
+	return rfs.storeJournaled(ctx, name, src, size, contentType, opts)
+}
+
+// deleteBatchFiles deletes the files of a batch that failed; callers hold
+// the write lock
+func (rfs *RandomFS) deleteBatchFiles(repHashes []string) {
+	for _, repHash := range repHashes {
+		if err := rfs.deleteFile(repHash); err != nil {
+			rfs.log().Error("Failed to delete file after failed batch store", "rep_hash", repHash, "error", err)
+		}
+	}
+}
+
+// distinctReusePolicy returns a policy for one file that reuses the most
+// used pooled randomizer the file has not used yet, so that no two blocks
+// of the file share a randomizer, and generates a fresh one when every
+// candidate is taken
+func distinctReusePolicy() RandomizerPolicy {
+	var mutex sync.Mutex
+	used := make(map[string]bool)
+	return func(ctx RandomizerContext, candidates []string) (string, bool) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		for _, hash := range candidates {
+			if !used[hash] {
+				used[hash] = true
+				return hash, true
+			}
+		}
+		return "", false
+	}
+}
@@ -0,0 +1,97 @@
+package randomfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// configFiles returns count similar small config files
+func configFiles(count int) []NamedData {
+	files := make([]NamedData, count)
+	for i := range files {
+		files[i] = NamedData{
+			Name: fmt.Sprintf("service%03d.conf", i),
+			Data: []byte(fmt.Sprintf("listen = 0.0.0.0:%d\nworkers = 4\nlog = /var/log/service%03d.log\n", 8000+i, i)),
+		}
+	}
+	return files
+}
+
+func TestStoreFilesReusesBatchRandomizers(t *testing.T) {
+	files := configFiles(100)
+
+	single := newTestRandomFS(t)
+	defer single.Close()
+	for _, file := range files {
+		if _, err := single.StoreFile(file.Name, file.Data, ""); err != nil {
+			t.Fatalf("StoreFile: %v", err)
+		}
+	}
+
+	batch := newTestRandomFS(t)
+	defer batch.Close()
+	urls, stats, err := batch.StoreFilesWithStats(files)
+	if err != nil {
+		t.Fatalf("StoreFilesWithStats: %v", err)
+	}
+	if len(urls) != len(files) || stats.Files != len(files) {
+		t.Fatalf("stored %d URLs, stats %+v", len(urls), stats)
+	}
+
+	// Only the first file needs a fresh randomizer
+	if generated := single.GetStats().BlocksGenerated; generated != 200 {
+		t.Errorf("storing one at a time generated %d blocks, expected 200", generated)
+	}
+	if stats.BlocksGenerated != 101 || stats.RandomizersReused != 99 {
+		t.Errorf("batch generated %d blocks and reused %d randomizers, expected 101 and 99", stats.BlocksGenerated, stats.RandomizersReused)
+	}
+	for i, rdURL := range urls {
+		data, _, err := batch.RetrieveFile(rdURL.RepHash)
+		if err != nil || !bytes.Equal(data, files[i].Data) {
+			t.Fatalf("retrieving %s returned %q: %v", files[i].Name, data, err)
+		}
+	}
+
+	// A batch with a duplicate name stores nothing
+	batch.NamePolicy = NamesRejectDuplicates
+	before := len(batch.ListFiles())
+	_, err = batch.StoreFiles([]NamedData{{Name: "new.conf", Data: []byte("a")}, {Name: "new.conf", Data: []byte("b")}})
+	if !errors.Is(err, ErrDuplicateName) || len(batch.ListFiles()) != before {
+		t.Errorf("batch with a duplicate name returned %v and indexed %d files", err, len(batch.ListFiles())-before)
+	}
+}
+
+func TestStoreFilesNeverSharesRandomizersWithinFile(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	defer rfs.Close()
+
+	files := make([]NamedData, 3)
+	for i := range files {
+		files[i] = NamedData{Name: fmt.Sprintf("part%d.bin", i), Data: make([]byte, 5*BlockSize)}
+		rand.Read(files[i].Data)
+	}
+	urls, stats, err := rfs.StoreFilesWithStats(files)
+	if err != nil {
+		t.Fatalf("StoreFilesWithStats: %v", err)
+	}
+	for i, rdURL := range urls {
+		rep, err := rfs.GetRepresentation(rdURL.RepHash)
+		if err != nil {
+			t.Fatalf("GetRepresentation: %v", err)
+		}
+		// The later files reuse the randomizers of the first
+		if i == 0 && stats.RandomizersReused != int64(2*len(rep.BlockHashes)) {
+			t.Errorf("reused %d randomizers for files of %d blocks", stats.RandomizersReused, len(rep.BlockHashes))
+		}
+		seen := make(map[string]bool)
+		for _, hash := range rep.RandomizerHashes {
+			if seen[hash] {
+				t.Fatalf("%s uses randomizer %s for two blocks", rep.FileName, hash)
+			}
+			seen[hash] = true
+		}
+	}
+}
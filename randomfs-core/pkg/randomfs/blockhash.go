@@ -0,0 +1,108 @@
+package randomfs
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+	mhcore "github.com/multiformats/go-multihash/core"
+)
+
+// Hash functions available for block addresses, by multihash name
+const (
+	BlockHashSHA256    = "sha2-256"
+	BlockHashSHA512256 = "sha2-512-256"
+	BlockHashBLAKE3    = "blake3"
+)
+
+// ErrUnknownHashFunc is returned for a block hash function RandomFS does
+// not implement
+var ErrUnknownHashFunc = errors.New("unknown block hash function")
+
+// blockHashCodes maps the block hash functions to their multihash codes
+var blockHashCodes = map[string]uint64{
+	BlockHashSHA256:    mh.SHA2_256,
+	BlockHashSHA512256: mhcore.SHA2_512_256,
+	BlockHashBLAKE3:    mh.BLAKE3,
+}
+
+// blockHashCode returns the multihash code of a block hash function; the
+// empty name is SHA-256, the function of representations that record none
+func blockHashCode(name string) (uint64, error) {
+	if name == "" {
+		name = BlockHashSHA256
+	}
+	code, ok := blockHashCodes[name]
+	if !ok {
+		return 0, fmt.Errorf("%w %q", ErrUnknownHashFunc, name)
+	}
+	return code, nil
+}
+
+// blockHashName returns the block hash function with multihash code, or
+// "" if it is not one
+func blockHashName(code uint64) string {
+	for name, known := range blockHashCodes {
+		if known == code {
+			return name
+		}
+	}
+	return ""
+}
+
+// blockKey returns the key a block is stored under locally when hashed
+// with the function code: its hex digest for SHA-256, which keeps the
+// keys of existing data directories, and otherwise its raw CID
+func blockKey(code uint64, data []byte) string {
+	if code == mh.SHA2_256 {
+		return blockDigest(data)
+	}
+	sum, _ := mh.Sum(data, code, -1)
+	return cid.NewCidV1(cid.Raw, sum).String()
+}
+
+// refBlockKey returns the local key of data under the hash function ref
+// was made with, SHA-256 if it names none, so that a block is stored
+// again under the address it is referenced by whatever function is
+// configured
+func refBlockKey(ref string, data []byte) string {
+	code, _ := blockHashCode(refHashFunc(ref))
+	return blockKey(code, data)
+}
+
+// refHashFunc returns the hash function a block reference was made with,
+// or "" if the reference names no function RandomFS implements
+func refHashFunc(ref string) string {
+	if classifyRef(ref) == RefFormSHA256Hex {
+		return BlockHashSHA256
+	}
+	c, err := cid.Decode(ref)
+	if err != nil {
+		return ""
+	}
+	return blockHashName(c.Prefix().MhType)
+}
+
+// checkBlockHashFunc rejects a representation whose data blocks are not
+// addressed with the hash function it records. Randomizers may be shared
+// with files stored under another function; like every reference, they
+// are verified with the function they name.
+func checkBlockHashFunc(rep *FileRepresentation) error {
+	if _, err := blockHashCode(rep.BlockHashFunc); err != nil {
+		return err
+	}
+	want := rep.BlockHashFunc
+	if want == "" {
+		want = BlockHashSHA256
+	}
+	for i, ref := range rep.BlockHashes {
+		if isSparseRef(ref) {
+			continue
+		}
+		if got := refHashFunc(ref); got != want {
+			return fmt.Errorf("%w: block %d of a %s representation is addressed as %q", ErrBlockMismatch, i, want, ref)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package randomfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/TheEntropyCollective/randomfs-core/internal/ipfstest"
+	"github.com/ipfs/go-cid"
+)
+
+// checkBlockRefs fails unless every block and randomizer of the file at
+// repHash is a raw CID over the hash function name
+func checkBlockRefs(t *testing.T, rfs *RandomFS, repHash, name string) *FileRepresentation {
+	t.Helper()
+	rep, err := rfs.GetRepresentation(repHash)
+	if err != nil {
+		t.Fatalf("GetRepresentation: %v", err)
+	}
+	if rep.BlockHashFunc != name {
+		t.Fatalf("representation records %q, expected %q", rep.BlockHashFunc, name)
+	}
+	for i, ref := range slices.Concat(rep.BlockHashes, rep.RandomizerHashes) {
+		c, err := cid.Decode(ref)
+		if err != nil || c.Prefix().Codec != cid.Raw || blockHashName(c.Prefix().MhType) != name {
+			t.Fatalf("reference %d is %q, not a raw %s CID", i, ref, name)
+		}
+	}
+	return rep
+}
+
+func TestHashFuncAddressesBlocks(t *testing.T) {
+	ipfs := ipfstest.NewServer(t)
+	for _, name := range []string{BlockHashSHA512256, BlockHashBLAKE3} {
+		for _, backend := range []string{"local", "ipfs"} {
+			t.Run(name+"/"+backend, func(t *testing.T) {
+				cfg := Config{HashFunc: name, DataDir: t.TempDir()}
+				if backend == "ipfs" {
+					cfg.EnableIPFS, cfg.IPFSAPI = true, ipfs.APIURL()
+				}
+				rfs, err := NewRandomFSWithConfig(cfg)
+				if err != nil {
+					t.Fatalf("NewRandomFSWithConfig: %v", err)
+				}
+				defer rfs.Close()
+
+				data := make([]byte, 3*NanoBlockSize+17)
+				rand.Read(data)
+				rdURL, err := rfs.StoreFile("hashed.bin", data, "application/octet-stream")
+				if err != nil {
+					t.Fatalf("StoreFile: %v", err)
+				}
+				checkBlockRefs(t, rfs, rdURL.RepHash, name)
+
+				rfs.Cache().Clear()
+				if got, _, err := rfs.RetrieveFile(rdURL.RepHash); err != nil || !bytes.Equal(got, data) {
+					t.Fatalf("RetrieveFile returned %d bytes: %v", len(got), err)
+				}
+			})
+		}
+	}
+
+	if _, err := NewRandomFSWithConfig(Config{HashFunc: "md5", DataDir: t.TempDir()}); !errors.Is(err, ErrUnknownHashFunc) {
+		t.Errorf("opening with an unknown hash function returned %v", err)
+	}
+	store := renamingBlockStore{NewMemoryBlockStore()}
+	if _, err := NewRandomFSWithConfig(Config{HashFunc: BlockHashBLAKE3, BlockStore: store, DataDir: t.TempDir()}); err == nil {
+		t.Error("accepted a hash function a plugged-in block store cannot address")
+	}
+}
+
+func TestMixedHashFuncsShareCache(t *testing.T) {
+	store := NewMemoryBlockStore()
+	cache := NewBlockCache(16 * 1024 * 1024)
+	open := func(name string) *RandomFS {
+		rfs, err := NewRandomFSWithConfig(Config{HashFunc: name, BlockStore: store, DataDir: t.TempDir()})
+		if err != nil {
+			t.Fatalf("NewRandomFSWithConfig: %v", err)
+		}
+		t.Cleanup(func() { rfs.Close() })
+		rfs.UseBlockCache(cache)
+		return rfs
+	}
+	sha := open(BlockHashSHA256)
+	blake := open(BlockHashBLAKE3)
+
+	// The same file under both functions gets distinct cache keys
+	data := make([]byte, 2*NanoBlockSize)
+	rand.Read(data)
+	shaURL, err := sha.StoreFile("same.bin", data, "")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	blakeURL, err := blake.StoreFile("same.bin", data, "")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	shaRep, _ := sha.GetRepresentation(shaURL.RepHash)
+	blakeRep := checkBlockRefs(t, blake, blakeURL.RepHash, BlockHashBLAKE3)
+	if shaRep.BlockHashFunc != "" || refHashFunc(shaRep.BlockHashes[0]) != BlockHashSHA256 {
+		t.Fatalf("SHA-256 representation records %q and refers to %q", shaRep.BlockHashFunc, shaRep.BlockHashes[0])
+	}
+
+	// Each instance reads the other's file through the shared cache
+	for _, tc := range []struct {
+		rfs     *RandomFS
+		repHash string
+	}{
+		{sha, blakeURL.RepHash},
+		{blake, shaURL.RepHash},
+		{sha, shaURL.RepHash},
+		{blake, blakeURL.RepHash},
+	} {
+		if got, _, err := tc.rfs.RetrieveFile(tc.repHash); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("RetrieveFile(%s) returned %d bytes: %v", tc.repHash, len(got), err)
+		}
+	}
+	for _, ref := range slices.Concat(shaRep.BlockHashes, blakeRep.BlockHashes) {
+		if _, ok := cache.Get(ref); !ok {
+			t.Errorf("block %s is not cached under its own reference", ref)
+		}
+	}
+}
+
+func TestRepresentationMustMatchBlockHashFunc(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	data := []byte("addressed with SHA-256")
+	rdURL, err := rfs.StoreFile("sha.txt", data, "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	rep, err := rfs.GetRepresentation(rdURL.RepHash)
+	if err != nil {
+		t.Fatalf("GetRepresentation: %v", err)
+	}
+
+	rep.BlockHashFunc = BlockHashBLAKE3
+	if _, _, err := rfs.RetrieveFile(storeCraftedRepresentation(t, rfs, rep)); !errors.Is(err, ErrBlockMismatch) {
+		t.Errorf("representation claiming blake3 for SHA-256 blocks returned %v", err)
+	}
+	rep.BlockHashFunc = "md5"
+	if _, _, err := rfs.RetrieveFile(storeCraftedRepresentation(t, rfs, rep)); !errors.Is(err, ErrUnknownHashFunc) {
+		t.Errorf("representation with an unknown hash function returned %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package randomfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// ErrUnsupportedRef is returned for a block reference the backend cannot
+// resolve
+var ErrUnsupportedRef = errors.New("unsupported block reference")
+
+// RefForm names a syntax a representation can use to refer to a block
+type RefForm string
+
+// Block reference forms. A representation may mix forms; each reference
+// is classified on its own.
+const (
+	// RefFormSHA256Hex is the hex SHA-256 of the block, the native form of
+	// local storage
+	RefFormSHA256Hex RefForm = "sha256-hex"
+	// RefFormRawCID is a self-describing reference: a CIDv1 carrying the
+	// raw codec and a sha2-256 multihash of the block. Every backend
+	// resolves it.
+	RefFormRawCID RefForm = "raw-cid"
+	// RefFormRawMultihash is a raw CIDv1 over one of the other block hash
+	// functions Config.HashFunc offers. Every backend resolves it.
+	RefFormRawMultihash RefForm = "raw-multihash"
+	// RefFormCID is any other CID, which only IPFS can resolve
+	RefFormCID RefForm = "cid"
+)
+
+// classifyRef returns the form of a block reference, or "" if it has none
+func classifyRef(ref string) RefForm {
+	if len(ref) == 2*sha256.Size {
+		if _, err := hex.DecodeString(ref); err == nil {
+			return RefFormSHA256Hex
+		}
+	}
+
+	c, err := cid.Decode(ref)
+	if err != nil {
+		return ""
+	}
+	prefix := c.Prefix()
+	if prefix.Codec == cid.Raw {
+		switch {
+		case prefix.MhType == mh.SHA2_256:
+			return RefFormRawCID
+		case blockHashName(prefix.MhType) != "":
+			return RefFormRawMultihash
+		}
+	}
+	return RefFormCID
+}
+
+// SupportedRefForms returns the block reference forms the backend resolves
+func (rfs *RandomFS) SupportedRefForms() []RefForm {
+	if rfs.useIPFS {
+		return []RefForm{RefFormRawCID, RefFormSHA256Hex, RefFormRawMultihash, RefFormCID}
+	}
+	return []RefForm{RefFormRawCID, RefFormSHA256Hex, RefFormRawMultihash}
+}
+
+// supportsRef reports whether the backend resolves ref
+func (rfs *RandomFS) supportsRef(ref string) bool {
+	form := classifyRef(ref)
+	for _, supported := range rfs.SupportedRefForms() {
+		if form == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// SelfDescribingRef converts a SHA-256 block reference to the raw CID
+// form. Raw CIDs are returned unchanged; other forms cannot be converted.
+func SelfDescribingRef(ref string) (string, error) {
+	switch classifyRef(ref) {
+	case RefFormRawCID:
+		return ref, nil
+	case RefFormSHA256Hex:
+		digest, _ := hex.DecodeString(ref)
+		encoded, err := mh.Encode(digest, mh.SHA2_256)
+		if err != nil {
+			return "", fmt.Errorf("failed to encode multihash: %v", err)
+		}
+		return cid.NewCidV1(cid.Raw, encoded).String(), nil
+	}
+	return "", fmt.Errorf("%w: %q has no self-describing form", ErrUnsupportedRef, ref)
+}
+
+// BlockAddress returns the content address of a block: a raw CIDv1 over
+// its SHA-256, which is also the CID IPFS gives a block added raw. A block
+// has the same address whether it is stored with IPFS or without.
+func BlockAddress(block []byte) string {
+	address, _ := SelfDescribingRef(blockDigest(block))
+	return address
+}
+
+// canonicalRef returns the address a block reference names, so that the
+// hex and raw CID forms of a block compare equal. References without a
+// SHA-256 form are returned unchanged.
+func canonicalRef(ref string) string {
+	if address, err := SelfDescribingRef(ref); err == nil {
+		return address
+	}
+	return ref
+}
+
+// backendKey translates a block reference to the key the backend stores
+// the block under: locally a hex digest, or the raw CID of a block hashed
+// with another function; a CID in IPFS
+func (rfs *RandomFS) backendKey(ref string) (string, error) {
+	form := classifyRef(ref)
+	if rfs.useIPFS {
+		switch form {
+		case RefFormSHA256Hex:
+			return SelfDescribingRef(ref)
+		case RefFormRawCID, RefFormRawMultihash, RefFormCID:
+			return ref, nil
+		}
+	} else {
+		switch form {
+		case RefFormSHA256Hex, RefFormRawCID:
+			return sha256HexRef(ref)
+		case RefFormRawMultihash:
+			return ref, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %q", ErrUnsupportedRef, ref)
+}
+
+// sha256HexRef converts a raw CID block reference to the SHA-256 hex form.
+// Hex references are returned unchanged; other forms cannot be converted.
+func sha256HexRef(ref string) (string, error) {
+	switch classifyRef(ref) {
+	case RefFormSHA256Hex:
+		return ref, nil
+	case RefFormRawCID:
+		c, _ := cid.Decode(ref)
+		decoded, err := mh.Decode(c.Hash())
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrUnsupportedRef, err)
+		}
+		return hex.EncodeToString(decoded.Digest), nil
+	}
+	return "", fmt.Errorf("%w: %q has no SHA-256 hex form", ErrUnsupportedRef, ref)
+}
@@ -0,0 +1,281 @@
+package randomfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// storePortableFile stores random data on src and returns the data and its
+// representation
+func storePortableFile(t *testing.T, src *RandomFS) ([]byte, *FileRepresentation) {
+	t.Helper()
+	data := make([]byte, 5*NanoBlockSize+11)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("rand: %v", err)
+	}
+	rdURL, err := src.StoreFile("portable.bin", data, "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	rep, err := src.loadRepresentation(rdURL.RepHash)
+	if err != nil {
+		t.Fatalf("loadRepresentation: %v", err)
+	}
+	return data, rep
+}
+
+// newMockIPFSRandomFS creates a RandomFS against a fresh IPFS mock
+func newMockIPFSRandomFS(t *testing.T) (*countingIPFS, *RandomFS) {
+	t.Helper()
+	mock, server := newCountingIPFS(t)
+	rfs, err := NewRandomFS(server.URL, t.TempDir(), 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFS: %v", err)
+	}
+	t.Cleanup(func() { rfs.Close() })
+	return mock, rfs
+}
+
+// checkRetrieval resolves rep on dst and compares the result with data
+func checkRetrieval(t *testing.T, dst *RandomFS, rep *FileRepresentation, data []byte) {
+	t.Helper()
+	repHash := storeCraftedRepresentation(t, dst, rep)
+	retrieved, _, err := dst.RetrieveFile(repHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+	if !bytes.Equal(retrieved, data) {
+		t.Fatal("retrieved data differs")
+	}
+}
+
+func TestSelfDescribingRefsResolveOnIPFS(t *testing.T) {
+	local := newTestRandomFS(t)
+	local.SelfDescribingRefs = true
+	data, rep := storePortableFile(t, local)
+
+	// Copy the blocks into IPFS under their references
+	mock, ipfs := newMockIPFSRandomFS(t)
+	for _, ref := range representationBlocks(rep) {
+		if form := classifyRef(ref); form != RefFormRawCID {
+			t.Fatalf("%s has form %q, expected %q", ref, form, RefFormRawCID)
+		}
+		block, err := local.fetchBlock(context.Background(), ref)
+		if err != nil {
+			t.Fatalf("fetchBlock: %v", err)
+		}
+		mock.blocks[ref] = block
+	}
+
+	checkRetrieval(t, local, rep, data)
+	checkRetrieval(t, ipfs, rep, data)
+}
+
+func TestIPFSRefsResolveLocally(t *testing.T) {
+	_, ipfs := newMockIPFSRandomFS(t)
+	data, rep := storePortableFile(t, ipfs)
+
+	local := newTestRandomFS(t)
+	for _, ref := range representationBlocks(rep) {
+		block, err := ipfs.fetchBlock(context.Background(), ref)
+		if err != nil {
+			t.Fatalf("fetchBlock: %v", err)
+		}
+		key, err := local.backendKey(ref)
+		if err != nil {
+			t.Fatalf("backendKey: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(local.dataDir, "blocks", key), block, 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	checkRetrieval(t, local, rep, data)
+}
+
+func TestLegacyHexRefsResolveOnIPFS(t *testing.T) {
+	local := newTestRandomFS(t)
+	data, rep := storePortableFile(t, local)
+
+	mock, ipfs := newMockIPFSRandomFS(t)
+	for _, ref := range representationBlocks(rep) {
+		if form := classifyRef(ref); form != RefFormSHA256Hex {
+			t.Fatalf("%s has form %q, expected %q", ref, form, RefFormSHA256Hex)
+		}
+		block, _ := local.fetchBlock(context.Background(), ref)
+		key, err := SelfDescribingRef(ref)
+		if err != nil {
+			t.Fatalf("SelfDescribingRef: %v", err)
+		}
+		mock.blocks[key] = block
+	}
+
+	checkRetrieval(t, ipfs, rep, data)
+}
+
+func TestLocalBackendRejectsIPFSOnlyRefs(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	for _, form := range rfs.SupportedRefForms() {
+		if form == RefFormCID {
+			t.Fatal("local storage should not advertise arbitrary CIDs")
+		}
+	}
+
+	digest, _ := mh.Sum([]byte("chunked"), mh.SHA2_256, -1)
+	dagRef := cid.NewCidV0(digest).String()
+	rep := &FileRepresentation{
+		FileName:         "chunked.bin",
+		FileSize:         7,
+		BlockSize:        NanoBlockSize,
+		Version:          RepresentationVersion,
+		BlockHashes:      []string{dagRef},
+		RandomizerHashes: []string{dagRef},
+	}
+	repHash := storeCraftedRepresentation(t, rfs, rep)
+
+	if _, _, err := rfs.RetrieveFile(repHash); !errors.Is(err, ErrUnsupportedRef) {
+		t.Fatalf("expected ErrUnsupportedRef, got %v", err)
+	}
+	if misses := rfs.GetStats().CacheMisses; misses != 0 {
+		t.Fatalf("expected no block fetches, got %d cache misses", misses)
+	}
+}
+
+func TestSelfDescribingRefsSurviveGarbageCollection(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	rfs.SelfDescribingRefs = true
+	data, repHash := storeRandomFile(t, rfs, 3*NanoBlockSize)
+
+	result, err := rfs.CollectGarbage()
+	if err != nil {
+		t.Fatalf("CollectGarbage: %v", err)
+	}
+	if result.Removed != 0 {
+		t.Fatalf("garbage collection removed %d referenced blocks", result.Removed)
+	}
+	rfs.cache.Clear()
+	retrieved, _, err := rfs.RetrieveFile(repHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+	if !bytes.Equal(retrieved, data) {
+		t.Fatal("retrieved data differs")
+	}
+
+	if err := rfs.DeleteFile(repHash); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	if blocks := blockFiles(t, rfs.dataDir); len(blocks) != 0 {
+		t.Fatalf("expected delete to remove every block, %d left", len(blocks))
+	}
+}
+
+func TestBlockAddressIsBackendIndependent(t *testing.T) {
+	block := make([]byte, NanoBlockSize)
+	rand.Read(block)
+	address := BlockAddress(block)
+	if classifyRef(address) != RefFormRawCID {
+		t.Fatalf("address %s is not a raw CID", address)
+	}
+
+	_, ipfs := newMockIPFSRandomFS(t)
+	viaIPFS, err := ipfs.storeBlock(block)
+	if err != nil {
+		t.Fatalf("storeBlock with IPFS: %v", err)
+	}
+	local := newTestRandomFS(t)
+	local.SelfDescribingRefs = true
+	viaLocal, err := local.storeBlock(block)
+	if err != nil {
+		t.Fatalf("storeBlock locally: %v", err)
+	}
+	if viaIPFS != address || viaLocal != address {
+		t.Fatalf("IPFS stored %s and local storage %s, want %s", viaIPFS, viaLocal, address)
+	}
+
+	// The legacy hex form names the same block
+	legacy, err := newTestRandomFS(t).storeBlock(block)
+	if err != nil {
+		t.Fatalf("storeBlock: %v", err)
+	}
+	if canonicalRef(legacy) != address {
+		t.Fatalf("hex reference %s canonicalizes to %s", legacy, canonicalRef(legacy))
+	}
+}
+
+func TestStoreBlockRejectsForeignIPFSAddress(t *testing.T) {
+	// A daemon hashing blocks as dag-pb files instead of raw blocks
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v0/version", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Version":"foreign"}`))
+	})
+	mux.HandleFunc("/api/v0/add", func(w http.ResponseWriter, r *http.Request) {
+		file, _, _ := r.FormFile("file")
+		data, _ := io.ReadAll(file)
+		digest, _ := mh.Sum(data, mh.SHA2_256, -1)
+		fmt.Fprintf(w, `{"Hash":%q}`, cid.NewCidV0(digest).String())
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	rfs, err := NewRandomFS(server.URL, t.TempDir(), 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFS: %v", err)
+	}
+	defer rfs.Close()
+	if _, err := rfs.storeBlock([]byte("block")); !errors.Is(err, ErrBlockMismatch) {
+		t.Fatalf("storeBlock returned %v, want ErrBlockMismatch", err)
+	}
+}
+
+func TestBlockRefCountSpansRefForms(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	defer rfs.Close()
+	_, rep := storePortableFile(t, rfs)
+	hexRefs := representationBlocks(rep)
+
+	// Another file refers to the same blocks by raw CID
+	cidRefs := make([]string, len(hexRefs))
+	for i, ref := range hexRefs {
+		var err error
+		if cidRefs[i], err = SelfDescribingRef(ref); err != nil {
+			t.Fatalf("SelfDescribingRef: %v", err)
+		}
+	}
+	if err := rfs.index.put(&IndexEntry{RepHash: "other", FileName: "other.bin", Blocks: cidRefs}); err != nil {
+		t.Fatalf("index put: %v", err)
+	}
+	if got := rfs.BlockRefCount(hexRefs[0]); got != 2 {
+		t.Fatalf("hex form counts %d references, want 2", got)
+	}
+	if got := rfs.BlockRefCount(cidRefs[0]); got != 2 {
+		t.Fatalf("CID form counts %d references, want 2", got)
+	}
+
+	var repHash string
+	for _, file := range rfs.ListFiles() {
+		if file.FileName == "portable.bin" {
+			repHash = file.RepHash
+		}
+	}
+	if err := rfs.DeleteFile(repHash); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	for _, ref := range cidRefs {
+		if _, err := rfs.retrieveLocal(ref); err != nil {
+			t.Fatalf("block %s of the other file was released: %v", ref, err)
+		}
+	}
+}
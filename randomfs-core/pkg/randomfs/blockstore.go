@@ -0,0 +1,331 @@
+package randomfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrBlockNotFound is returned by block stores for blocks they do not hold
+var ErrBlockNotFound = errors.New("block not found")
+
+// BlockStore is the backend blocks and representations are kept in.
+// Outside IPFS, blocks are addressed by the hex SHA-256 of their content:
+// Put must return that address, and Get, Has and Delete are passed it.
+// Blocks hashed with another Config.HashFunc are addressed by their raw
+// CID instead, which only the stores of this package can be told.
+// Implementations must be safe for concurrent use.
+type BlockStore interface {
+	// Put stores data and returns its address
+	Put(data []byte) (hash string, err error)
+	// Get returns the block stored under hash, or an error wrapping
+	// ErrBlockNotFound if there is none
+	Get(hash string) ([]byte, error)
+	// Has reports whether a block is stored under hash
+	Has(hash string) (bool, error)
+	// Delete removes the block stored under hash. Deleting a block that
+	// is not stored is not an error.
+	Delete(hash string) error
+}
+
+// keyedBlockStore is implemented by block stores that store a block under
+// a key computed by the caller
+type keyedBlockStore interface {
+	putKey(key string, data []byte) error
+}
+
+// blockLister is implemented by block stores that can list what they
+// hold, which CollectGarbage needs
+type blockLister interface {
+	// blockSizes returns the size of every stored block by address
+	blockSizes() (map[string]int64, error)
+}
+
+// LocalBlockStore keeps blocks as files in a directory, named by their
+// hex SHA-256. It is the store of instances opened without IPFS.
+type LocalBlockStore struct {
+	dir string
+}
+
+// NewLocalBlockStore returns a store for the blocks in dir, creating the
+// directory if needed
+func NewLocalBlockStore(dir string) (*LocalBlockStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create block directory: %v", err)
+	}
+	return &LocalBlockStore{dir: dir}, nil
+}
+
+// Dir returns the directory the blocks are kept in
+func (s *LocalBlockStore) Dir() string {
+	return s.dir
+}
+
+// Put writes data under its hex SHA-256
+func (s *LocalBlockStore) Put(data []byte) (string, error) {
+	hash := blockDigest(data)
+	if err := s.putKey(hash, data); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+// putKey writes data under key
+func (s *LocalBlockStore) putKey(key string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write block: %v", err)
+	}
+	return nil
+}
+
+// Get reads the block stored under hash
+func (s *LocalBlockStore) Get(hash string) ([]byte, error) {
+	path, err := s.path(hash)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrBlockNotFound, hash)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read block %s: %v", hash, err)
+	}
+	return data, nil
+}
+
+// Has reports whether a file holds the block stored under hash
+func (s *LocalBlockStore) Has(hash string) (bool, error) {
+	path, err := s.path(hash)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to stat block %s: %v", hash, err)
+	}
+	return true, nil
+}
+
+// Delete removes the file holding the block stored under hash
+func (s *LocalBlockStore) Delete(hash string) error {
+	path, err := s.path(hash)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete block %s: %v", hash, err)
+	}
+	return nil
+}
+
+// blockSizes returns the size of every block file
+func (s *LocalBlockStore) blockSizes() (map[string]int64, error) {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64, len(files))
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat block %s: %v", file.Name(), err)
+		}
+		sizes[file.Name()] = info.Size()
+	}
+	return sizes, nil
+}
+
+// path returns the file holding hash. Addresses that are not plain file
+// names are refused so that they cannot reach outside the directory.
+func (s *LocalBlockStore) path(hash string) (string, error) {
+	if !diskCacheKey(hash) {
+		return "", fmt.Errorf("%w: %q", ErrUnsupportedRef, hash)
+	}
+	return filepath.Join(s.dir, hash), nil
+}
+
+// MemoryBlockStore keeps blocks in a map, addressed by their hex SHA-256
+// like LocalBlockStore. Nothing outlives the process, which makes it
+// suited to tests: an instance opened with
+//
+//	NewRandomFSWithConfig(Config{BlockStore: NewMemoryBlockStore(), DataDir: dir})
+//
+// needs no IPFS daemon and writes only its index to dir.
+type MemoryBlockStore struct {
+	mutex  sync.RWMutex
+	blocks map[string][]byte
+}
+
+// NewMemoryBlockStore returns an empty in-memory block store
+func NewMemoryBlockStore() *MemoryBlockStore {
+	return &MemoryBlockStore{blocks: make(map[string][]byte)}
+}
+
+// Put stores a copy of data under its hex SHA-256
+func (s *MemoryBlockStore) Put(data []byte) (string, error) {
+	hash := blockDigest(data)
+	s.putKey(hash, data)
+	return hash, nil
+}
+
+// putKey stores a copy of data under key
+func (s *MemoryBlockStore) putKey(key string, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.blocks[key] = bytes.Clone(data)
+	return nil
+}
+
+// Get returns a copy of the block stored under hash
+func (s *MemoryBlockStore) Get(hash string) ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	data, ok := s.blocks[hash]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrBlockNotFound, hash)
+	}
+	return bytes.Clone(data), nil
+}
+
+// Has reports whether a block is stored under hash
+func (s *MemoryBlockStore) Has(hash string) (bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	_, ok := s.blocks[hash]
+	return ok, nil
+}
+
+// Delete forgets the block stored under hash
+func (s *MemoryBlockStore) Delete(hash string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.blocks, hash)
+	return nil
+}
+
+// Len returns the number of blocks stored
+func (s *MemoryBlockStore) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return len(s.blocks)
+}
+
+// blockSizes returns the size of every stored block
+func (s *MemoryBlockStore) blockSizes() (map[string]int64, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	sizes := make(map[string]int64, len(s.blocks))
+	for hash, data := range s.blocks {
+		sizes[hash] = int64(len(data))
+	}
+	return sizes, nil
+}
+
+// IPFSBlockStore keeps blocks in IPFS through the HTTP API of a daemon,
+// with the retries and statistics of the instance it belongs to. Blocks
+// are added as single raw blocks addressed by their CID, and Delete only
+// unpins a block so that the daemon can garbage collect it.
+type IPFSBlockStore struct {
+	rfs *RandomFS
+	api string
+}
+
+// API returns the URL of the IPFS HTTP API
+func (s *IPFSBlockStore) API() string {
+	return s.api
+}
+
+// Put adds data to IPFS as a raw block
+func (s *IPFSBlockStore) Put(data []byte) (string, error) {
+	return s.rfs.addToIPFS(context.Background(), data, true)
+}
+
+// Get reads the content hash addresses from IPFS
+func (s *IPFSBlockStore) Get(hash string) ([]byte, error) {
+	return s.rfs.catFromIPFS(context.Background(), hash)
+}
+
+// Has reports whether the daemon holds hash, without searching the network
+func (s *IPFSBlockStore) Has(hash string) (bool, error) {
+	return s.rfs.statFromIPFS(context.Background(), hash)
+}
+
+// Delete removes the pin on hash
+func (s *IPFSBlockStore) Delete(hash string) error {
+	return s.rfs.unpinFromIPFS(context.Background(), hash)
+}
+
+// BlockStore returns the store the instance keeps its blocks in
+func (rfs *RandomFS) BlockStore() BlockStore {
+	return rfs.blocks
+}
+
+// putBlock adds data to the block store under key, its local key. An
+// empty key is computed with the configured block hash function; a given
+// one also selects the function IPFS hashes the block with.
+func (rfs *RandomFS) putBlock(ctx context.Context, data []byte, key string) (string, error) {
+	code := rfs.blockHash
+	if key == "" {
+		key = blockKey(code, data)
+	} else if name := refHashFunc(key); name != "" {
+		code = blockHashCodes[name]
+	}
+
+	switch store := rfs.blocks.(type) {
+	case *IPFSBlockStore:
+		return rfs.addBlockToIPFS(ctx, data, code)
+	case keyedBlockStore:
+		if err := store.putKey(key, data); err != nil {
+			return "", err
+		}
+		return key, nil
+	default:
+		return store.Put(data)
+	}
+}
+
+// statFromIPFS reports whether the daemon holds hash locally
+func (rfs *RandomFS) statFromIPFS(ctx context.Context, hash string) (bool, error) {
+	key, err := rfs.backendKey(hash)
+	if err != nil {
+		return false, err
+	}
+	resp, err := rfs.ipfsPost(ctx, "/api/v0/block/stat?offline=true&arg="+key, "", nil)
+	if err != nil {
+		return false, fmt.Errorf("IPFS block stat failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return true, nil
+	}
+	msg, _ := io.ReadAll(resp.Body)
+	if strings.Contains(string(msg), "not found") {
+		return false, nil
+	}
+	return false, &ipfsStatusError{op: "block/stat", status: resp.StatusCode, msg: string(msg)}
+}
@@ -0,0 +1,212 @@
+package randomfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/TheEntropyCollective/randomfs-core/internal/ipfstest"
+)
+
+// renamingBlockStore is a BlockStore whose Put returns the wrong address
+type renamingBlockStore struct {
+	BlockStore
+}
+
+func (s renamingBlockStore) Put(data []byte) (string, error) {
+	if _, err := s.BlockStore.Put(data); err != nil {
+		return "", err
+	}
+	return "elsewhere", nil
+}
+
+func TestLocalBlockStore(t *testing.T) {
+	store, err := NewLocalBlockStore(filepath.Join(t.TempDir(), "blocks"))
+	if err != nil {
+		t.Fatalf("NewLocalBlockStore: %v", err)
+	}
+	data := []byte("a block on disk")
+	hash, err := store.Put(data)
+	if err != nil || hash != blockDigest(data) {
+		t.Fatalf("Put returned %s: %v", hash, err)
+	}
+	if got, err := store.Get(hash); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Get returned %q: %v", got, err)
+	}
+	if ok, err := store.Has(hash); err != nil || !ok {
+		t.Fatalf("Has of a stored block returned %v, %v", ok, err)
+	}
+
+	if err := store.Delete(hash); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if ok, err := store.Has(hash); err != nil || ok {
+		t.Errorf("Has of a deleted block returned %v, %v", ok, err)
+	}
+	if _, err := store.Get(hash); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("Get of a deleted block returned %v", err)
+	}
+	if err := store.Delete(hash); err != nil {
+		t.Errorf("deleting a missing block returned %v", err)
+	}
+
+	// Addresses cannot name files outside the directory
+	for _, hash := range []string{"", "..", "../escape", "a/b"} {
+		if _, err := store.Get(hash); !errors.Is(err, ErrUnsupportedRef) {
+			t.Errorf("Get(%q) returned %v", hash, err)
+		}
+	}
+}
+
+func TestRandomFSUsesConfiguredBlockStore(t *testing.T) {
+	store := NewMemoryBlockStore()
+	rfs, err := NewRandomFSWithConfig(Config{BlockStore: store, DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewRandomFSWithConfig: %v", err)
+	}
+	defer rfs.Close()
+	if rfs.BlockStore() != store {
+		t.Fatalf("BlockStore returned %T", rfs.BlockStore())
+	}
+
+	data := make([]byte, 3*NanoBlockSize)
+	rand.Read(data)
+	rdURL, err := rfs.StoreFile("plugged.bin", data, "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	// Three blocks, their randomizers and the representation
+	if store.Len() != 7 {
+		t.Fatalf("store holds %d blocks, expected 7", store.Len())
+	}
+	rfs.cache.Clear()
+	rfs.parsedReps.remove(rdURL.RepHash)
+	if got, _, err := rfs.RetrieveFile(rdURL.RepHash); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("RetrieveFile returned %d bytes: %v", len(got), err)
+	}
+
+	if err := rfs.DeleteFile(rdURL.RepHash); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	if store.Len() != 0 {
+		t.Errorf("store holds %d blocks after the file was deleted", store.Len())
+	}
+
+	if _, err := NewRandomFSWithConfig(Config{BlockStore: store, EnableIPFS: true, DataDir: t.TempDir()}); err == nil {
+		t.Error("accepted a block store combined with IPFS")
+	}
+}
+
+func TestBlockStoreMustAddressBlocksBySHA256(t *testing.T) {
+	rfs, err := NewRandomFSWithConfig(Config{BlockStore: renamingBlockStore{NewMemoryBlockStore()}, DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewRandomFSWithConfig: %v", err)
+	}
+	defer rfs.Close()
+	if _, err := rfs.StoreFile("renamed.txt", []byte("renamed"), ""); !errors.Is(err, ErrBlockMismatch) {
+		t.Errorf("storing into a store that renames blocks returned %v", err)
+	}
+}
+
+func TestMemoryBlockStoreHoldsAnonymizedBlocks(t *testing.T) {
+	store := NewMemoryBlockStore()
+	rfs, err := NewRandomFSWithConfig(Config{BlockStore: store, DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewRandomFSWithConfig: %v", err)
+	}
+	defer rfs.Close()
+
+	data := make([]byte, 4*NanoBlockSize)
+	rand.Read(data)
+	rdURL, err := rfs.StoreFile("exact.bin", data, "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	rep, err := rfs.GetRepresentation(rdURL.RepHash)
+	if err != nil {
+		t.Fatalf("GetRepresentation: %v", err)
+	}
+
+	// Each stored block is the file data XORed with its randomizer
+	for i, hash := range rep.BlockHashes {
+		block, err := store.Get(hash)
+		if err != nil {
+			t.Fatalf("Get block %d: %v", i, err)
+		}
+		randomizer, err := store.Get(rep.RandomizerHashes[i])
+		if err != nil {
+			t.Fatalf("Get randomizer %d: %v", i, err)
+		}
+		plain := data[i*rep.BlockSize : (i+1)*rep.BlockSize]
+		if bytes.Equal(block, plain) {
+			t.Fatalf("block %d is stored in the clear", i)
+		}
+		for j := range block {
+			block[j] ^= randomizer[j]
+		}
+		if !bytes.Equal(block, plain) {
+			t.Fatalf("block %d XOR its randomizer is not the file data", i)
+		}
+	}
+
+	// Blocks are copied in and out of the store
+	block, _ := store.Get(rep.BlockHashes[0])
+	block[0] ^= 0xff
+	if again, _ := store.Get(rep.BlockHashes[0]); again[0] == block[0] {
+		t.Error("modifying a returned block changed the stored one")
+	}
+
+	// Garbage collection lists the store
+	orphan, err := store.Put([]byte("orphan"))
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	result, err := rfs.CollectGarbage()
+	if err != nil {
+		t.Fatalf("CollectGarbage: %v", err)
+	}
+	if result.Removed != 1 || result.FreedBytes != int64(len("orphan")) {
+		t.Errorf("expected the orphan collected, got %+v", result)
+	}
+	if ok, _ := store.Has(orphan); ok {
+		t.Error("orphaned block still stored")
+	}
+}
+
+func TestIPFSBlockStore(t *testing.T) {
+	ipfs := ipfstest.NewServer(t)
+	rfs, err := NewRandomFSWithConfig(Config{EnableIPFS: true, IPFSAPI: ipfs.APIURL(), DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewRandomFSWithConfig: %v", err)
+	}
+	defer rfs.Close()
+	store, ok := rfs.BlockStore().(*IPFSBlockStore)
+	if !ok || store.API() != ipfs.APIURL() {
+		t.Fatalf("BlockStore returned %T", rfs.BlockStore())
+	}
+
+	data := []byte("a raw block in IPFS")
+	hash, err := store.Put(data)
+	if err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if address, _ := SelfDescribingRef(blockDigest(data)); hash != address {
+		t.Errorf("Put returned %s, expected the raw CID %s", hash, address)
+	}
+	if got, err := store.Get(hash); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Get returned %q: %v", got, err)
+	}
+	if ok, err := store.Has(hash); err != nil || !ok {
+		t.Errorf("Has of an added block returned %v, %v", ok, err)
+	}
+
+	if err := store.Delete(hash); err != nil || ipfs.Pinned(hash) {
+		t.Errorf("Delete returned %v, pinned %v", err, ipfs.Pinned(hash))
+	}
+	ipfs.Remove(hash)
+	if ok, err := store.Has(hash); err != nil || ok {
+		t.Errorf("Has of a collected block returned %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,518 @@
+package randomfs
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultCacheLowWater is the fraction of its capacity a full cache, or a
+// full tier of a partitioned one, is evicted down to
+const DefaultCacheLowWater = 0.9
+
+// CacheTier is a block size tier of a BlockCache
+type CacheTier int
+
+// Cache tiers, by block length
+const (
+	// CacheTierNano holds blocks up to NanoBlockSize
+	CacheTierNano CacheTier = iota
+	// CacheTierMini holds blocks up to MiniBlockSize
+	CacheTierMini
+	// CacheTierLarge holds larger blocks
+	CacheTierLarge
+
+	numCacheTiers
+)
+
+// String returns the name of the tier
+func (t CacheTier) String() string {
+	switch t {
+	case CacheTierNano:
+		return "nano"
+	case CacheTierMini:
+		return "mini"
+	case CacheTierLarge:
+		return "large"
+	}
+	return fmt.Sprintf("tier%d", int(t))
+}
+
+// cacheTierOf returns the tier a block of size bytes is cached in
+func cacheTierOf(size int) CacheTier {
+	switch {
+	case size <= NanoBlockSize:
+		return CacheTierNano
+	case size <= MiniBlockSize:
+		return CacheTierMini
+	}
+	return CacheTierLarge
+}
+
+// CachePartitions is the byte budget of each tier of a partitioned cache
+type CachePartitions struct {
+	Nano  int64 `json:"nano"`
+	Mini  int64 `json:"mini"`
+	Large int64 `json:"large"`
+}
+
+// DefaultCachePartitions splits maxSize between the tiers: a tenth for
+// nano blocks, three tenths for mini blocks and the rest for large ones
+func DefaultCachePartitions(maxSize int64) CachePartitions {
+	nano, mini := maxSize/10, maxSize*3/10
+	return CachePartitions{Nano: nano, Mini: mini, Large: maxSize - nano - mini}
+}
+
+// budgets returns the partitions indexed by tier
+func (p CachePartitions) budgets() [numCacheTiers]int64 {
+	return [numCacheTiers]int64{p.Nano, p.Mini, p.Large}
+}
+
+// CacheTierUsage reports the occupancy of one cache tier
+type CacheTierUsage struct {
+	Tier   string `json:"tier"`
+	Blocks int    `json:"blocks"`
+	Size   int64  `json:"size"`
+	// MaxSize is the budget of the tier, zero if the cache is not
+	// partitioned
+	MaxSize int64 `json:"max_size"`
+}
+
+// BlockCache is an in-memory cache of blocks keyed by hash. When full it
+// evicts the least recently used blocks. A partitioned cache gives each
+// block size tier its own budget, so churn in one tier never evicts blocks
+// of another. Persist backs the cache with a directory that survives
+// restarts.
+type BlockCache struct {
+	blocks      map[string]*list.Element
+	maxSize     int64
+	currentSize int64
+	lowWater    float64
+	mutex       sync.RWMutex
+
+	// lru orders the cached blocks from most to least recently used
+	lru *list.List
+
+	// Occupancy by tier, and budgets by tier once partitioned
+	partitioned bool
+	tierMax     [numCacheTiers]int64
+	tierSize    [numCacheTiers]int64
+	tierBlocks  [numCacheTiers]int
+
+	// disk is the persistent tier, if any
+	disk *diskCache
+
+	// access counters used by CacheTuner
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+// cacheEntry is a cached block, the value of its element in the LRU list
+type cacheEntry struct {
+	hash string
+	data []byte
+}
+
+// NewBlockCache creates a block cache holding up to maxSize bytes
+func NewBlockCache(maxSize int64) *BlockCache {
+	return &BlockCache{
+		blocks:   make(map[string]*list.Element),
+		maxSize:  maxSize,
+		lowWater: DefaultCacheLowWater,
+		lru:      list.New(),
+	}
+}
+
+// NewPartitionedBlockCache creates a block cache whose tiers hold up to
+// their partition each; its capacity is the sum
+func NewPartitionedBlockCache(partitions CachePartitions) *BlockCache {
+	bc := NewBlockCache(0)
+	bc.SetPartitions(partitions)
+	return bc
+}
+
+// Get returns a cached block, marking it most recently used. A block only
+// in the persistent tier is read back into memory.
+func (bc *BlockCache) Get(hash string) ([]byte, bool) {
+	bc.mutex.Lock()
+	element, exists := bc.blocks[hash]
+	if exists {
+		bc.lru.MoveToFront(element)
+	}
+	disk := bc.disk
+	bc.mutex.Unlock()
+
+	if exists {
+		bc.hits.Add(1)
+		if disk != nil {
+			disk.touch(hash)
+		}
+		return element.Value.(*cacheEntry).data, true
+	}
+	if disk != nil {
+		if data, ok := disk.get(hash); ok {
+			bc.hits.Add(1)
+			bc.putMemory(hash, data)
+			return data, true
+		}
+	}
+	bc.misses.Add(1)
+	return nil, false
+}
+
+// Contains reports whether a block is cached, in memory or on disk,
+// without counting an access
+func (bc *BlockCache) Contains(hash string) bool {
+	bc.mutex.RLock()
+	_, exists := bc.blocks[hash]
+	disk := bc.disk
+	bc.mutex.RUnlock()
+
+	return exists || disk != nil && disk.contains(hash)
+}
+
+// Put adds a block to the cache as the most recently used, evicting the
+// least recently used blocks when full. A partitioned cache only evicts
+// blocks of the tier that is full. A persistent cache also writes the
+// block to disk.
+func (bc *BlockCache) Put(hash string, data []byte) {
+	bc.putMemory(hash, data)
+
+	bc.mutex.RLock()
+	disk := bc.disk
+	bc.mutex.RUnlock()
+	if disk != nil {
+		disk.put(hash, data)
+	}
+}
+
+// putMemory adds a block to the in-memory tier like Put
+func (bc *BlockCache) putMemory(hash string, data []byte) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	if element, exists := bc.blocks[hash]; exists {
+		entry := element.Value.(*cacheEntry)
+		bc.forget(entry.data)
+		entry.data = data
+		bc.lru.MoveToFront(element)
+	} else {
+		bc.blocks[hash] = bc.lru.PushFront(&cacheEntry{hash: hash, data: data})
+	}
+
+	tier := cacheTierOf(len(data))
+	bc.currentSize += int64(len(data))
+	bc.tierSize[tier] += int64(len(data))
+	bc.tierBlocks[tier]++
+
+	if bc.partitioned {
+		if bc.tierSize[tier] > bc.tierMax[tier] {
+			bc.evictTier(tier)
+		}
+	} else if bc.currentSize > bc.maxSize {
+		bc.evictLeastRecentlyUsed()
+	}
+}
+
+// forget removes the accounting of a block leaving the cache
+func (bc *BlockCache) forget(data []byte) {
+	tier := cacheTierOf(len(data))
+	bc.currentSize -= int64(len(data))
+	bc.tierSize[tier] -= int64(len(data))
+	bc.tierBlocks[tier]--
+}
+
+// Delete removes a block from the cache, on disk too
+func (bc *BlockCache) Delete(hash string) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	if element, exists := bc.blocks[hash]; exists {
+		bc.remove(element)
+		bc.evictions.Add(1)
+	}
+	if bc.disk != nil {
+		bc.disk.delete(hash)
+	}
+}
+
+// remove drops the block of element from the cache
+func (bc *BlockCache) remove(element *list.Element) {
+	entry := bc.lru.Remove(element).(*cacheEntry)
+	delete(bc.blocks, entry.hash)
+	bc.forget(entry.data)
+}
+
+// Clear removes all blocks from the cache, on disk too
+func (bc *BlockCache) Clear() {
+	bc.clearMemory()
+
+	bc.mutex.RLock()
+	disk := bc.disk
+	bc.mutex.RUnlock()
+	if disk != nil {
+		disk.clear()
+	}
+}
+
+// clearMemory removes all blocks from the in-memory tier, leaving the
+// persistent tier for the next run
+func (bc *BlockCache) clearMemory() {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	bc.blocks = make(map[string]*list.Element)
+	bc.lru.Init()
+	bc.currentSize = 0
+	bc.tierSize = [numCacheTiers]int64{}
+	bc.tierBlocks = [numCacheTiers]int{}
+}
+
+// MaxSize returns the configured capacity in bytes
+func (bc *BlockCache) MaxSize() int64 {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+
+	return bc.maxSize
+}
+
+// SetMaxSize changes the capacity, evicting blocks if the cache is now
+// over it. The budgets of a partitioned cache are scaled in proportion.
+func (bc *BlockCache) SetMaxSize(maxSize int64) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	if bc.partitioned {
+		var partitions [numCacheTiers]int64
+		for tier, budget := range bc.tierMax {
+			if bc.maxSize > 0 {
+				partitions[tier] = int64(float64(budget) / float64(bc.maxSize) * float64(maxSize))
+			} else {
+				partitions[tier] = maxSize / int64(numCacheTiers)
+			}
+		}
+		bc.partition(partitions)
+		return
+	}
+
+	bc.maxSize = maxSize
+	if bc.currentSize > bc.maxSize {
+		bc.evictLeastRecentlyUsed()
+	}
+}
+
+// LowWater returns the fraction of its capacity a full cache is evicted
+// down to
+func (bc *BlockCache) LowWater() float64 {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+
+	return bc.lowWater
+}
+
+// SetLowWater sets the fraction of its capacity, or of a tier's budget, a
+// full cache is evicted down to. Lower marks evict more at once, so fewer
+// puts pay for an eviction, but leave the cache emptier. Fractions outside
+// (0, 1] are rejected.
+func (bc *BlockCache) SetLowWater(fraction float64) error {
+	if fraction <= 0 || fraction > 1 {
+		return fmt.Errorf("invalid low-water mark %v, expected a fraction in (0, 1]", fraction)
+	}
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	bc.lowWater = fraction
+	return nil
+}
+
+// SetPartitions gives each tier of the cache its own budget, evicting
+// blocks of tiers now over theirs. The capacity becomes the sum.
+func (bc *BlockCache) SetPartitions(partitions CachePartitions) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	bc.partitioned = true
+	bc.partition(partitions.budgets())
+}
+
+// Partitions returns the tier budgets of a partitioned cache; ok is false
+// if the cache is not partitioned
+func (bc *BlockCache) Partitions() (partitions CachePartitions, ok bool) {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+
+	if !bc.partitioned {
+		return CachePartitions{}, false
+	}
+	return CachePartitions{Nano: bc.tierMax[CacheTierNano], Mini: bc.tierMax[CacheTierMini], Large: bc.tierMax[CacheTierLarge]}, true
+}
+
+// TierUsage returns the occupancy of each tier of the cache
+func (bc *BlockCache) TierUsage() []CacheTierUsage {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+
+	usage := make([]CacheTierUsage, numCacheTiers)
+	for tier := CacheTier(0); tier < numCacheTiers; tier++ {
+		usage[tier] = CacheTierUsage{
+			Tier:    tier.String(),
+			Blocks:  bc.tierBlocks[tier],
+			Size:    bc.tierSize[tier],
+			MaxSize: bc.tierMax[tier],
+		}
+	}
+	return usage
+}
+
+// persistMemory writes the blocks of the in-memory tier to the persistent
+// tier, if there is one, least recently used first so that the order of
+// use survives a restart
+func (bc *BlockCache) persistMemory() {
+	bc.mutex.RLock()
+	disk := bc.disk
+	var entries []*cacheEntry
+	if disk != nil {
+		for element := bc.lru.Back(); element != nil; element = element.Prev() {
+			entries = append(entries, element.Value.(*cacheEntry))
+		}
+	}
+	bc.mutex.RUnlock()
+
+	for _, entry := range entries {
+		disk.put(entry.hash, entry.data)
+	}
+}
+
+// hashes returns the hashes of every cached block, in memory or on disk,
+// sorted
+func (bc *BlockCache) hashes() []string {
+	bc.mutex.RLock()
+	cached := make(map[string]bool, len(bc.blocks))
+	for hash := range bc.blocks {
+		cached[hash] = true
+	}
+	disk := bc.disk
+	bc.mutex.RUnlock()
+
+	if disk != nil {
+		for _, hash := range disk.hashes() {
+			cached[hash] = true
+		}
+	}
+	hashes := make([]string, 0, len(cached))
+	for hash := range cached {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+// hashesOfSize returns the hashes of the cached blocks of exactly size
+// bytes, sorted
+func (bc *BlockCache) hashesOfSize(size int) []string {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+
+	var hashes []string
+	for hash, element := range bc.blocks {
+		if len(element.Value.(*cacheEntry).data) == size {
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+// partition sets the tier budgets and evicts blocks over them
+func (bc *BlockCache) partition(budgets [numCacheTiers]int64) {
+	bc.tierMax = budgets
+	bc.maxSize = 0
+	for tier, budget := range budgets {
+		bc.maxSize += budget
+		if bc.tierSize[tier] > budget {
+			bc.evictTier(CacheTier(tier))
+		}
+	}
+}
+
+// Size returns the number of bytes currently cached
+func (bc *BlockCache) Size() int64 {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+
+	return bc.currentSize
+}
+
+// evictLeastRecentlyUsed evicts the least recently used blocks until the
+// cache is down to its low-water mark
+func (bc *BlockCache) evictLeastRecentlyUsed() {
+	target := int64(float64(bc.maxSize) * bc.lowWater)
+	for bc.currentSize > target && bc.lru.Len() > 0 {
+		bc.remove(bc.lru.Back())
+		bc.evictions.Add(1)
+	}
+}
+
+// evictTier evicts the least recently used blocks of one tier until it is
+// down to the low-water mark of its budget
+func (bc *BlockCache) evictTier(tier CacheTier) {
+	target := int64(float64(bc.tierMax[tier]) * bc.lowWater)
+	for element := bc.lru.Back(); element != nil && bc.tierSize[tier] > target; {
+		prev := element.Prev()
+		if cacheTierOf(len(element.Value.(*cacheEntry).data)) == tier {
+			bc.remove(element)
+			bc.evictions.Add(1)
+		}
+		element = prev
+	}
+}
+
+// Cache returns the block cache of rfs, which can be passed to
+// UseBlockCache to share it with another instance
+func (rfs *RandomFS) Cache() *BlockCache {
+	rfs.mutex.RLock()
+	defer rfs.mutex.RUnlock()
+
+	return rfs.cache
+}
+
+// UseBlockCache replaces the block cache of rfs with cache, which may be
+// shared by several instances in one process so blocks stored or fetched
+// through any of them are served to all from memory. Blocks are keyed by
+// content address, so instances may share a cache whatever their backend.
+// Close leaves a shared cache intact. Call it before rfs is in use; a
+// cache tuner already running keeps tuning the previous cache.
+func (rfs *RandomFS) UseBlockCache(cache *BlockCache) {
+	if cache == nil {
+		return
+	}
+
+	rfs.mutex.Lock()
+	defer rfs.mutex.Unlock()
+
+	rfs.cache = cache
+	rfs.sharedCache = true
+}
+
+// RepresentationCache returns the representation cache of rfs, or nil if
+// representations are not cached
+func (rfs *RandomFS) RepresentationCache() *BlockCache {
+	rfs.mutex.RLock()
+	defer rfs.mutex.RUnlock()
+
+	return rfs.repCache
+}
+
+// UseRepresentationCache caches representations stored or fetched by rfs
+// in cache, which may be shared like a block cache. Nil disables caching,
+// the default.
+func (rfs *RandomFS) UseRepresentationCache(cache *BlockCache) {
+	rfs.mutex.Lock()
+	defer rfs.mutex.Unlock()
+
+	rfs.repCache = cache
+}
@@ -0,0 +1,301 @@
+package randomfs
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheDirName is the directory in the data directory holding the
+// persistent tier of the block cache
+const cacheDirName = "cache"
+
+// diskCacheTempPrefix marks blocks still being written to a disk cache
+const diskCacheTempPrefix = ".tmp-"
+
+// diskCache is the persistent tier of a BlockCache: one file per block,
+// named by its hash, evicted least recently used once the files exceed
+// maxSize. Files are read and written outside the lock, so a block removed
+// meanwhile simply reads as a miss.
+type diskCache struct {
+	dir      string
+	maxSize  int64
+	size     int64
+	lowWater float64
+	mutex    sync.Mutex
+
+	// blocks maps hashes to their element in lru, which orders them from
+	// most to least recently used
+	blocks map[string]*list.Element
+	lru    *list.List
+}
+
+// diskEntry is a block on disk, the value of its element in the LRU list
+type diskEntry struct {
+	hash string
+	size int64
+}
+
+// openDiskCache opens the disk cache in dir, creating it if needed. Blocks
+// already there are ordered by modification time, so the blocks used last
+// before a restart are the last evicted after it.
+func openDiskCache(dir string, maxSize int64, lowWater float64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %v", err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache directory: %v", err)
+	}
+
+	type cachedFile struct {
+		hash    string
+		size    int64
+		modTime time.Time
+	}
+	var cached []cachedFile
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		// Blocks interrupted while being written are never complete
+		if strings.HasPrefix(file.Name(), diskCacheTempPrefix) {
+			os.Remove(filepath.Join(dir, file.Name()))
+			continue
+		}
+		info, err := file.Info()
+		if err != nil || !diskCacheKey(file.Name()) {
+			continue
+		}
+		cached = append(cached, cachedFile{file.Name(), info.Size(), info.ModTime()})
+	}
+	sort.Slice(cached, func(i, j int) bool { return cached[i].modTime.Before(cached[j].modTime) })
+
+	dc := &diskCache{
+		dir:      dir,
+		maxSize:  maxSize,
+		lowWater: lowWater,
+		blocks:   make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+	for _, file := range cached {
+		dc.blocks[file.hash] = dc.lru.PushFront(&diskEntry{hash: file.hash, size: file.size})
+		dc.size += file.size
+	}
+	if dc.size > dc.maxSize {
+		dc.evict()
+	}
+	return dc, nil
+}
+
+// diskCacheKey reports whether hash can name a file in a disk cache;
+// blocks under other keys are only cached in memory
+func diskCacheKey(hash string) bool {
+	if hash == "" || len(hash) > 255 {
+		return false
+	}
+	for _, c := range hash {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// path returns the file holding hash
+func (dc *diskCache) path(hash string) string {
+	return filepath.Join(dc.dir, hash)
+}
+
+// get reads a block from disk, marking it most recently used
+func (dc *diskCache) get(hash string) ([]byte, bool) {
+	dc.mutex.Lock()
+	element, exists := dc.blocks[hash]
+	if exists {
+		dc.lru.MoveToFront(element)
+	}
+	dc.mutex.Unlock()
+	if !exists {
+		return nil, false
+	}
+
+	path := dc.path(hash)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		dc.delete(hash)
+		return nil, false
+	}
+	// The modification time records the use across restarts
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return data, true
+}
+
+// contains reports whether a block is on disk
+func (dc *diskCache) contains(hash string) bool {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+
+	_, exists := dc.blocks[hash]
+	return exists
+}
+
+// touch marks a block served from memory as most recently used
+func (dc *diskCache) touch(hash string) {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+
+	if element, exists := dc.blocks[hash]; exists {
+		dc.lru.MoveToFront(element)
+	}
+}
+
+// put writes a block to disk unless it is already there, evicting the
+// least recently used blocks when over maxSize. Blocks are content
+// addressed, so a block on disk never needs rewriting.
+func (dc *diskCache) put(hash string, data []byte) {
+	if !diskCacheKey(hash) || int64(len(data)) > dc.maxSize {
+		return
+	}
+	dc.mutex.Lock()
+	element, exists := dc.blocks[hash]
+	if exists {
+		dc.lru.MoveToFront(element)
+	}
+	dc.mutex.Unlock()
+	if exists {
+		return
+	}
+
+	if err := dc.write(hash, data); err != nil {
+		return
+	}
+
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+	if _, exists := dc.blocks[hash]; exists {
+		return
+	}
+	dc.blocks[hash] = dc.lru.PushFront(&diskEntry{hash: hash, size: int64(len(data))})
+	dc.size += int64(len(data))
+	if dc.size > dc.maxSize {
+		dc.evict()
+	}
+}
+
+// write writes a block to a temporary file and renames it into place, so
+// a crash never leaves a partial block under its hash
+func (dc *diskCache) write(hash string, data []byte) error {
+	file, err := os.CreateTemp(dc.dir, diskCacheTempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), dc.path(hash))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// delete removes a block from disk
+func (dc *diskCache) delete(hash string) {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+
+	if element, exists := dc.blocks[hash]; exists {
+		dc.remove(element)
+	}
+}
+
+// hashes returns the hashes of the blocks on disk
+func (dc *diskCache) hashes() []string {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+
+	hashes := make([]string, 0, len(dc.blocks))
+	for hash := range dc.blocks {
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
+// clear removes every block from disk
+func (dc *diskCache) clear() {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+
+	for dc.lru.Len() > 0 {
+		dc.remove(dc.lru.Back())
+	}
+}
+
+// remove drops the block of element; callers hold the lock
+func (dc *diskCache) remove(element *list.Element) {
+	entry := dc.lru.Remove(element).(*diskEntry)
+	delete(dc.blocks, entry.hash)
+	dc.size -= entry.size
+	os.Remove(dc.path(entry.hash))
+}
+
+// evict removes the least recently used blocks until the disk cache is
+// down to its low-water mark; callers hold the lock
+func (dc *diskCache) evict() {
+	target := int64(float64(dc.maxSize) * dc.lowWater)
+	for dc.size > target && dc.lru.Len() > 0 {
+		dc.remove(dc.lru.Back())
+	}
+}
+
+// usage returns the occupancy of the disk cache
+func (dc *diskCache) usage() CacheTierUsage {
+	dc.mutex.Lock()
+	defer dc.mutex.Unlock()
+
+	return CacheTierUsage{Tier: "disk", Blocks: dc.lru.Len(), Size: dc.size, MaxSize: dc.maxSize}
+}
+
+// Persist adds a persistent tier in dir holding up to maxSize bytes of
+// blocks, so the cache survives restarts. Blocks put in the cache are also
+// written to disk, and blocks missing from memory are read back from it
+// and kept in memory again; memory stays the hot tier. Blocks already in
+// dir from an earlier run are served at once. Call it before the cache is
+// in use.
+func (bc *BlockCache) Persist(dir string, maxSize int64) error {
+	if maxSize <= 0 {
+		return fmt.Errorf("invalid persistent cache size %d", maxSize)
+	}
+	disk, err := openDiskCache(dir, maxSize, bc.LowWater())
+	if err != nil {
+		return err
+	}
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	bc.disk = disk
+	return nil
+}
+
+// DiskUsage returns the occupancy of the persistent tier; ok is false if
+// the cache is not persistent
+func (bc *BlockCache) DiskUsage() (usage CacheTierUsage, ok bool) {
+	bc.mutex.RLock()
+	disk := bc.disk
+	bc.mutex.RUnlock()
+
+	if disk == nil {
+		return CacheTierUsage{}, false
+	}
+	return disk.usage(), true
+}
@@ -0,0 +1,177 @@
+package randomfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TheEntropyCollective/randomfs-core/internal/ipfstest"
+)
+
+func TestPersistentCacheSurvivesRestart(t *testing.T) {
+	ipfs := ipfstest.NewServer(t)
+	cfg := Config{EnableIPFS: true, IPFSAPI: ipfs.APIURL(), DataDir: t.TempDir(), PersistentCache: true}
+	rfs, err := NewRandomFSWithConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewRandomFSWithConfig: %v", err)
+	}
+	data, repHash := storeRandomFile(t, rfs, 5*NanoBlockSize)
+	if usage, ok := rfs.Cache().DiskUsage(); !ok || usage.Blocks != 10 || usage.MaxSize != DefaultCacheSize {
+		t.Fatalf("disk tier holds %+v after storing 10 blocks", usage)
+	}
+	rfs.Close()
+
+	// The restarted instance must not need the daemon for any block, only
+	// for the representation
+	restarted, err := NewRandomFSWithConfig(cfg)
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	defer restarted.Close()
+	if restarted.Cache().Size() != 0 {
+		t.Fatal("memory tier was not empty after the restart")
+	}
+	got, _, err := restarted.RetrieveFile(repHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile after restart: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("file served from the disk cache differs")
+	}
+	if stats := restarted.GetStats(); stats.CacheHits != 10 || stats.IPFSCatTotal != 1 {
+		t.Errorf("restart made %d cache hits and %d cats, want 10 and one", stats.CacheHits, stats.IPFSCatTotal)
+	}
+	if restarted.Cache().Size() == 0 {
+		t.Error("blocks read from disk were not kept in memory")
+	}
+
+	// Flushing drops the disk tier as well
+	if _, err := restarted.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if usage, _ := restarted.Cache().DiskUsage(); usage.Blocks != 0 {
+		t.Errorf("%d blocks left on disk after Flush", usage.Blocks)
+	}
+	if files, _ := os.ReadDir(filepath.Join(cfg.DataDir, cacheDirName)); len(files) != 0 {
+		t.Errorf("%d files left in the cache directory after Flush", len(files))
+	}
+}
+
+func TestPersistentCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	dir := t.TempDir()
+	cache := NewBlockCache(100)
+	if err := cache.Persist(dir, 3500); err != nil {
+		t.Fatalf("Persist: %v", err)
+	}
+	block := func(i int) []byte { return bytes.Repeat([]byte{byte(i)}, 1000) }
+	for i := 0; i < 3; i++ {
+		cache.Put(fmt.Sprintf("block%d", i), block(i))
+		time.Sleep(10 * time.Millisecond)
+	}
+	// block0 is too old to be in memory, so this reads it from disk and
+	// makes block1 the least recently used there
+	if data, ok := cache.Get("block0"); !ok || !bytes.Equal(data, block(0)) {
+		t.Fatal("block0 was not served from disk")
+	}
+	time.Sleep(10 * time.Millisecond)
+	cache.Put("block3", block(3))
+
+	usage, _ := cache.DiskUsage()
+	if usage.Size > 3500 {
+		t.Errorf("disk tier holds %d bytes, over its 3500", usage.Size)
+	}
+	if cache.Contains("block1") {
+		t.Error("least recently used block1 survived eviction")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "block1")); !os.IsNotExist(err) {
+		t.Errorf("evicted block1 is still on disk: %v", err)
+	}
+
+	// A new cache over the directory keeps the recency of the blocks:
+	// block2 was used least recently, so it goes first
+	time.Sleep(10 * time.Millisecond)
+	cache.Get("block0")
+	cache.clearMemory()
+	reopened := NewBlockCache(100)
+	if err := reopened.Persist(dir, 3500); err != nil {
+		t.Fatalf("Persist: %v", err)
+	}
+	for _, hash := range []string{"block0", "block2", "block3"} {
+		if !reopened.Contains(hash) {
+			t.Fatalf("%s was lost across the restart", hash)
+		}
+	}
+	reopened.Put("block4", block(4))
+	if reopened.Contains("block2") || !reopened.Contains("block0") {
+		t.Error("the restarted cache evicted the wrong block")
+	}
+}
+
+func TestPersistentCacheIgnoresPartialWrites(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, diskCacheTempPrefix+"123"), []byte("torn"), 0644)
+	os.WriteFile(filepath.Join(dir, "complete"), []byte("whole block"), 0644)
+
+	cache := NewBlockCache(1024)
+	if err := cache.Persist(dir, 1024); err != nil {
+		t.Fatalf("Persist: %v", err)
+	}
+	if data, ok := cache.Get("complete"); !ok || string(data) != "whole block" {
+		t.Errorf("complete block read as %q, %v", data, ok)
+	}
+	if usage, _ := cache.DiskUsage(); usage.Blocks != 1 {
+		t.Errorf("disk tier holds %d blocks, want the complete one", usage.Blocks)
+	}
+	if _, err := os.Stat(filepath.Join(dir, diskCacheTempPrefix+"123")); !os.IsNotExist(err) {
+		t.Error("partial write was not removed")
+	}
+	// Keys that cannot name a file stay in memory only
+	cache.Put("../escape", []byte("x"))
+	if data, ok := cache.Get("../escape"); !ok || string(data) != "x" {
+		t.Error("unsafe key was not cached in memory")
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "escape")); !os.IsNotExist(err) {
+		t.Error("unsafe key was written outside the cache directory")
+	}
+}
+
+func TestPersistentCacheNeedsWritableDataDir(t *testing.T) {
+	if _, err := NewRandomFSWithConfig(Config{DataDir: t.TempDir(), ReadOnly: true, PersistentCache: true}); err == nil {
+		t.Fatal("read-only instance accepted a persistent cache")
+	}
+}
+
+func TestCloseContextWritesMemoryTierToDisk(t *testing.T) {
+	cfg := Config{DataDir: t.TempDir(), PersistentCache: true}
+	rfs, err := NewRandomFSWithConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewRandomFSWithConfig: %v", err)
+	}
+	// A block cached only in memory, as when the disk tier evicted it
+	block := bytes.Repeat([]byte("m"), NanoBlockSize)
+	hash := blockDigest(block)
+	rfs.cache.putMemory(hash, block)
+
+	// Workers still running when the context is done are abandoned
+	rfs.background.Add(1)
+	defer rfs.background.Done()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := rfs.CloseContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("CloseContext with a stuck worker returned %v", err)
+	}
+
+	restarted, err := NewRandomFSWithConfig(cfg)
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	defer restarted.Close()
+	if got, ok := restarted.Cache().Get(hash); !ok || !bytes.Equal(got, block) {
+		t.Error("block cached in memory was not written to disk on close")
+	}
+}
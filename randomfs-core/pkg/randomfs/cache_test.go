@@ -0,0 +1,268 @@
+package randomfs
+
+import (
+	"bytes"
+	"fmt"
+	mrand "math/rand"
+	"strconv"
+	"testing"
+)
+
+// newSharingPair returns two local instances with separate data
+// directories sharing one block cache and one representation cache
+func newSharingPair(t *testing.T) (*RandomFS, *RandomFS) {
+	t.Helper()
+	first := newTestRandomFS(t)
+	second := newTestRandomFS(t)
+
+	repCache := NewBlockCache(1024 * 1024)
+	first.UseRepresentationCache(repCache)
+	second.UseBlockCache(first.Cache())
+	second.UseRepresentationCache(first.RepresentationCache())
+	return first, second
+}
+
+func TestInstancesSharingCacheServeEachOthersBlocks(t *testing.T) {
+	first, second := newSharingPair(t)
+	data, repHash := storeRandomFile(t, first, 3*NanoBlockSize)
+
+	// The second instance's backend has none of these blocks, so the file
+	// can only come from the shared caches
+	got, _, err := second.RetrieveFile(repHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile through the sharing instance: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("retrieved data differs")
+	}
+
+	stats := second.GetStats()
+	if stats.CacheHits != 6 || stats.CacheMisses != 0 {
+		t.Fatalf("expected 6 cache hits and no misses, got %d and %d", stats.CacheHits, stats.CacheMisses)
+	}
+}
+
+func TestUnsharedInstanceCannotServeOtherInstancesFiles(t *testing.T) {
+	first := newTestRandomFS(t)
+	second := newTestRandomFS(t)
+	_, repHash := storeRandomFile(t, first, NanoBlockSize)
+
+	if _, _, err := second.RetrieveFile(repHash); err == nil {
+		t.Fatal("expected retrieval through an unrelated instance to fail")
+	}
+}
+
+func TestClosingInstanceLeavesSharedCacheIntact(t *testing.T) {
+	first, second := newSharingPair(t)
+	_, repHash := storeRandomFile(t, first, 2*NanoBlockSize)
+
+	size := first.Cache().Size()
+	if err := second.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if first.Cache().Size() != size {
+		t.Fatalf("closing a sharing instance changed the cache size from %d to %d", size, first.Cache().Size())
+	}
+	if _, _, err := first.RetrieveFile(repHash); err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+}
+
+func TestDeleteDropsBlocksFromSharedCache(t *testing.T) {
+	first, second := newSharingPair(t)
+	_, repHash := storeRandomFile(t, first, NanoBlockSize)
+
+	if err := first.DeleteFile(repHash); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	if _, _, err := second.RetrieveFile(repHash); err == nil {
+		t.Fatal("expected a deleted file to be gone from the shared caches")
+	}
+}
+
+// churnCache fills cache with a hot set of nano blocks, then streams many
+// large blocks through it, and returns how many hot blocks survived
+func churnCache(cache *BlockCache) int {
+	const hot = 200
+	for i := 0; i < hot; i++ {
+		cache.Put(fmt.Sprintf("hot-%d", i), make([]byte, NanoBlockSize))
+	}
+	for i := 0; i < 64; i++ {
+		cache.Put(fmt.Sprintf("large-%d", i), make([]byte, BlockSize))
+	}
+
+	survived := 0
+	for i := 0; i < hot; i++ {
+		if cache.Contains(fmt.Sprintf("hot-%d", i)) {
+			survived++
+		}
+	}
+	return survived
+}
+
+func TestPartitionedCacheKeepsSmallBlocksThroughLargeChurn(t *testing.T) {
+	partitions := CachePartitions{Nano: 512 * 1024, Mini: 1024 * 1024, Large: 4 * BlockSize}
+	total := partitions.Nano + partitions.Mini + partitions.Large
+
+	if survived := churnCache(NewBlockCache(total)); survived == 200 {
+		t.Fatal("large blocks evicted no small ones from an unpartitioned cache; the test proves nothing")
+	}
+
+	cache := NewPartitionedBlockCache(partitions)
+	if cache.MaxSize() != total {
+		t.Fatalf("partitioned cache holds %d bytes, want the sum %d", cache.MaxSize(), total)
+	}
+	if survived := churnCache(cache); survived != 200 {
+		t.Fatalf("large-block churn evicted %d of 200 hot small blocks", 200-survived)
+	}
+
+	usage := cache.TierUsage()
+	if usage[CacheTierNano].Blocks != 200 || usage[CacheTierNano].Size != 200*NanoBlockSize {
+		t.Errorf("nano tier usage %+v", usage[CacheTierNano])
+	}
+	if large := usage[CacheTierLarge]; large.Size > large.MaxSize || large.Tier != "large" {
+		t.Errorf("large tier usage %+v exceeds its budget", large)
+	}
+	if cache.Size() != usage[CacheTierNano].Size+usage[CacheTierMini].Size+usage[CacheTierLarge].Size {
+		t.Errorf("cache size %d is not the sum of its tiers %+v", cache.Size(), usage)
+	}
+}
+
+func TestPartitionedCacheScalesWithMaxSize(t *testing.T) {
+	cache := NewBlockCache(1000 * NanoBlockSize)
+	for i := 0; i < 100; i++ {
+		cache.Put(fmt.Sprintf("nano-%d", i), make([]byte, NanoBlockSize))
+	}
+	if _, ok := cache.Partitions(); ok {
+		t.Fatal("new cache reports partitions")
+	}
+
+	// Partitioning an existing cache evicts tiers over their new budget
+	cache.SetPartitions(CachePartitions{Nano: 50 * NanoBlockSize, Mini: 100 * NanoBlockSize, Large: 850 * NanoBlockSize})
+	if size := cache.TierUsage()[CacheTierNano].Size; size > 50*NanoBlockSize {
+		t.Fatalf("nano tier holds %d bytes over its budget", size)
+	}
+
+	// Resizing, as the cache tuner does, keeps the proportions
+	cache.SetMaxSize(2000 * NanoBlockSize)
+	partitions, ok := cache.Partitions()
+	if !ok || partitions != (CachePartitions{Nano: 100 * NanoBlockSize, Mini: 200 * NanoBlockSize, Large: 1700 * NanoBlockSize}) {
+		t.Fatalf("scaled partitions %+v", partitions)
+	}
+	if cache.MaxSize() != 2000*NanoBlockSize {
+		t.Fatalf("max size %d after scaling", cache.MaxSize())
+	}
+
+	cache.Clear()
+	for _, usage := range cache.TierUsage() {
+		if usage.Blocks != 0 || usage.Size != 0 {
+			t.Errorf("tier %+v not empty after Clear", usage)
+		}
+	}
+}
+
+func TestDefaultCachePartitionsSumToMaxSize(t *testing.T) {
+	for _, maxSize := range []int64{0, 7, 1024, 500 * 1024 * 1024} {
+		p := DefaultCachePartitions(maxSize)
+		if p.Nano+p.Mini+p.Large != maxSize {
+			t.Errorf("partitions of %d sum to %d", maxSize, p.Nano+p.Mini+p.Large)
+		}
+	}
+}
+
+func TestBlockCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewBlockCache(4 * NanoBlockSize)
+	if err := cache.SetLowWater(0.75); err != nil {
+		t.Fatalf("SetLowWater: %v", err)
+	}
+	for _, hash := range []string{"a", "b", "c", "d"} {
+		cache.Put(hash, make([]byte, NanoBlockSize))
+	}
+
+	// Touching a makes b the least recently used; putting e overflows the
+	// cache, which evicts down to three blocks
+	cache.Get("a")
+	cache.Put("e", make([]byte, NanoBlockSize))
+	for hash, want := range map[string]bool{"a": true, "b": false, "c": false, "d": true, "e": true} {
+		if got := cache.Contains(hash); got != want {
+			t.Errorf("Contains(%q) = %v, want %v", hash, got, want)
+		}
+	}
+	if cache.Size() != 3*NanoBlockSize {
+		t.Errorf("cache holds %d bytes, want the low-water mark %d", cache.Size(), 3*NanoBlockSize)
+	}
+
+	// The block just inserted is never the one evicted
+	cache.Put("f", make([]byte, 2*NanoBlockSize))
+	if !cache.Contains("f") {
+		t.Error("evicted the block just inserted")
+	}
+
+	for _, fraction := range []float64{0, -1, 1.5} {
+		if err := cache.SetLowWater(fraction); err == nil {
+			t.Errorf("accepted low-water mark %v", fraction)
+		}
+	}
+}
+
+func TestPartitionedCacheEvictsLeastRecentlyUsedInTier(t *testing.T) {
+	cache := NewPartitionedBlockCache(CachePartitions{Nano: 4 * NanoBlockSize, Mini: MiniBlockSize, Large: BlockSize})
+	cache.SetLowWater(0.5)
+	cache.Put("mini", make([]byte, MiniBlockSize))
+	for _, hash := range []string{"a", "b", "c", "d"} {
+		cache.Put(hash, make([]byte, NanoBlockSize))
+	}
+	cache.Get("a")
+	cache.Get("b")
+
+	// Evicting the nano tier down to two blocks keeps the one just
+	// inserted and the one touched last, and never the mini block
+	cache.Put("e", make([]byte, NanoBlockSize))
+	for hash, want := range map[string]bool{"mini": true, "a": false, "b": true, "c": false, "d": false, "e": true} {
+		if got := cache.Contains(hash); got != want {
+			t.Errorf("Contains(%q) = %v, want %v", hash, got, want)
+		}
+	}
+}
+
+// cacheHitRatio reads blocks from a working set of workingSet nano blocks
+// through a cache of capacity nano blocks, fetching and caching misses,
+// and returns the fraction of reads served by the cache. A tenth of the
+// working set is hot and takes half the reads.
+func cacheHitRatio(capacity, workingSet, reads int, rng *mrand.Rand) float64 {
+	cache := NewBlockCache(int64(capacity) * NanoBlockSize)
+	block := make([]byte, NanoBlockSize)
+	hits := 0
+	for i := 0; i < reads; i++ {
+		n := rng.Intn(workingSet)
+		if rng.Intn(2) == 0 {
+			n = rng.Intn(workingSet / 10)
+		}
+		hash := strconv.Itoa(n)
+		if _, ok := cache.Get(hash); ok {
+			hits++
+		} else {
+			cache.Put(hash, block)
+		}
+	}
+	return float64(hits) / float64(reads)
+}
+
+func TestCacheDoesNotThrashSlightlyOverCapacity(t *testing.T) {
+	// The working set exceeds the cache by a tenth; evicting half the
+	// cache at random, as before, served about 85% of reads
+	ratio := cacheHitRatio(1000, 1100, 50000, mrand.New(mrand.NewSource(1)))
+	if ratio < 0.9 {
+		t.Fatalf("hit ratio %.2f with a working set slightly over capacity", ratio)
+	}
+}
+
+func BenchmarkCacheWorkingSetOverCapacity(b *testing.B) {
+	for _, overshoot := range []int{0, 5, 10, 25} {
+		b.Run(fmt.Sprintf("over=%d%%", overshoot), func(b *testing.B) {
+			rng := mrand.New(mrand.NewSource(1))
+			ratio := cacheHitRatio(1000, 1000+overshoot*10, b.N, rng)
+			b.ReportMetric(ratio, "hits/op")
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package randomfs
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// CacheTunerConfig bounds and tunes the cache auto-tuner
+type CacheTunerConfig struct {
+	// MinSize and MaxSize bound the cache capacity in bytes
+	MinSize int64
+	MaxSize int64
+	// Window is how often the tuner evaluates the access pattern
+	Window time.Duration
+	// GrowthFactor multiplies or divides the capacity on each adjustment
+	GrowthFactor float64
+	// GrowEvictionRate is the fraction of accesses that must have caused an
+	// eviction for the cache to grow
+	GrowEvictionRate float64
+	// GrowMaxHitRate is the hit rate at or above which the cache never grows
+	GrowMaxHitRate float64
+	// ShrinkUtilization is the fill fraction below which the cache shrinks
+	ShrinkUtilization float64
+	// Now returns the current time; it defaults to time.Now
+	Now func() time.Time
+}
+
+// DefaultCacheTunerConfig returns a conservative tuner configuration
+// between minSize and maxSize
+func DefaultCacheTunerConfig(minSize, maxSize int64) CacheTunerConfig {
+	return CacheTunerConfig{
+		MinSize:           minSize,
+		MaxSize:           maxSize,
+		Window:            time.Minute,
+		GrowthFactor:      1.5,
+		GrowEvictionRate:  0.05,
+		GrowMaxHitRate:    0.9,
+		ShrinkUtilization: 0.25,
+		Now:               time.Now,
+	}
+}
+
+// CacheTuner adjusts a BlockCache capacity from its observed hit and
+// eviction rates
+type CacheTuner struct {
+	cache  *BlockCache
+	config CacheTunerConfig
+
+	mutex         sync.Mutex
+	windowStart   time.Time
+	lastHits      int64
+	lastMisses    int64
+	lastEvictions int64
+}
+
+// NewCacheTuner creates a tuner for cache; the first window starts now
+func NewCacheTuner(cache *BlockCache, config CacheTunerConfig) *CacheTuner {
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+	if config.Window <= 0 {
+		config.Window = time.Minute
+	}
+	if config.GrowthFactor <= 1 {
+		config.GrowthFactor = 1.5
+	}
+
+	return &CacheTuner{
+		cache:         cache,
+		config:        config,
+		windowStart:   config.Now(),
+		lastHits:      cache.hits.Load(),
+		lastMisses:    cache.misses.Load(),
+		lastEvictions: cache.evictions.Load(),
+	}
+}
+
+// Tick evaluates the current window if it has elapsed and resizes the
+// cache when warranted. It returns the capacity and whether it changed.
+func (ct *CacheTuner) Tick() (int64, bool) {
+	ct.mutex.Lock()
+	defer ct.mutex.Unlock()
+
+	size := ct.cache.MaxSize()
+	now := ct.config.Now()
+	if now.Sub(ct.windowStart) < ct.config.Window {
+		return size, false
+	}
+
+	hits := ct.cache.hits.Load()
+	misses := ct.cache.misses.Load()
+	evictions := ct.cache.evictions.Load()
+
+	windowHits := hits - ct.lastHits
+	accesses := windowHits + misses - ct.lastMisses
+	windowEvictions := evictions - ct.lastEvictions
+
+	ct.windowStart = now
+	ct.lastHits, ct.lastMisses, ct.lastEvictions = hits, misses, evictions
+
+	if accesses == 0 {
+		return size, false
+	}
+
+	hitRate := float64(windowHits) / float64(accesses)
+	evictionRate := float64(windowEvictions) / float64(accesses)
+	utilization := float64(ct.cache.Size()) / float64(size)
+
+	newSize := size
+	switch {
+	case evictionRate >= ct.config.GrowEvictionRate && hitRate < ct.config.GrowMaxHitRate:
+		newSize = int64(float64(size) * ct.config.GrowthFactor)
+	case windowEvictions == 0 && utilization < ct.config.ShrinkUtilization:
+		newSize = int64(float64(size) / ct.config.GrowthFactor)
+	}
+
+	if ct.config.MaxSize > 0 && newSize > ct.config.MaxSize {
+		newSize = ct.config.MaxSize
+	}
+	if newSize < ct.config.MinSize {
+		newSize = ct.config.MinSize
+	}
+	if newSize == size {
+		return size, false
+	}
+
+	ct.cache.SetMaxSize(newSize)
+	slog.Info("Cache auto-tuner resized cache", "from", size, "to", newSize, "hit_rate", hitRate, "eviction_rate", evictionRate)
+	return newSize, true
+}
+
+// EnableCacheAutoTuning starts a tuner that resizes the block cache every
+// config.Window until Close is called
+func (rfs *RandomFS) EnableCacheAutoTuning(config CacheTunerConfig) *CacheTuner {
+	tuner := NewCacheTuner(rfs.cache, config)
+
+	rfs.background.Add(1)
+	go func() {
+		defer rfs.background.Done()
+		ticker := time.NewTicker(tuner.config.Window)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-rfs.done:
+				return
+			case <-ticker.C:
+				tuner.Tick()
+			}
+		}
+	}()
+
+	return tuner
+}
@@ -0,0 +1,81 @@
+package randomfs
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually advanced clock for deterministic tuner tests
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+// accessWorkingSet reads every block of a working set, filling misses
+func accessWorkingSet(cache *BlockCache, blocks, blockSize int) {
+	for i := 0; i < blocks; i++ {
+		hash := fmt.Sprintf("block-%d", i)
+		if _, exists := cache.Get(hash); !exists {
+			cache.Put(hash, make([]byte, blockSize))
+		}
+	}
+}
+
+func TestCacheTunerGrowsUnderLargeWorkingSet(t *testing.T) {
+	const blockSize = 1024
+	cache := NewBlockCache(8 * blockSize)
+	clock := &fakeClock{now: time.Unix(0, 0)}
+
+	config := DefaultCacheTunerConfig(4*blockSize, 64*blockSize)
+	config.Window = time.Minute
+	config.Now = clock.Now
+	tuner := NewCacheTuner(cache, config)
+
+	for window := 0; window < 10; window++ {
+		for pass := 0; pass < 5; pass++ {
+			accessWorkingSet(cache, 32, blockSize)
+		}
+
+		if _, changed := tuner.Tick(); changed {
+			t.Fatal("tuner resized the cache before the window elapsed")
+		}
+		clock.now = clock.now.Add(time.Minute)
+		tuner.Tick()
+	}
+
+	if size := cache.MaxSize(); size < 32*blockSize {
+		t.Fatalf("expected cache to grow to hold the 32KB working set, got %d bytes", size)
+	}
+	if size := cache.MaxSize(); size > 64*blockSize {
+		t.Fatalf("cache grew past the configured maximum: %d bytes", size)
+	}
+
+	hitsBefore := cache.hits.Load()
+	accessWorkingSet(cache, 32, blockSize)
+	accessWorkingSet(cache, 32, blockSize)
+	if hits := cache.hits.Load() - hitsBefore; hits < 32 {
+		t.Fatalf("expected the grown cache to serve the working set, got %d hits", hits)
+	}
+}
+
+func TestCacheTunerShrinksWhenUnderused(t *testing.T) {
+	const blockSize = 1024
+	cache := NewBlockCache(64 * blockSize)
+	clock := &fakeClock{now: time.Unix(0, 0)}
+
+	config := DefaultCacheTunerConfig(16*blockSize, 128*blockSize)
+	config.Now = clock.Now
+	tuner := NewCacheTuner(cache, config)
+
+	for window := 0; window < 10; window++ {
+		accessWorkingSet(cache, 2, blockSize)
+		clock.now = clock.now.Add(config.Window)
+		tuner.Tick()
+	}
+
+	if size := cache.MaxSize(); size != 16*blockSize {
+		t.Fatalf("expected cache to shrink to the 16KB minimum, got %d bytes", size)
+	}
+}
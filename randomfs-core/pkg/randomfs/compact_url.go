@@ -0,0 +1,228 @@
+package randomfs
+
+import (
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// compactURLPrefix starts a compact rd:// URL. The prefix and the base32
+// payload are all upper case, which QR codes encode in their denser
+// alphanumeric mode.
+const compactURLPrefix = "RD:"
+
+// CompactFileNameLimit is the most bytes of the filename a compact URL
+// keeps; longer names are truncated
+const CompactFileNameLimit = 24
+
+// compactFormat is the version of the compact payload layout, the high
+// nibble of its first byte
+const compactFormat = 1
+
+// Flags of a compact payload, the low nibble of its first byte
+const (
+	compactEncrypted = 1 << iota
+	compactHexHash
+	compactTextHash
+	compactCIDv0
+)
+
+// compactEncoding is unpadded base32, the alphabet of QR alphanumeric mode
+var compactEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Compact returns a short form of the URL for QR codes and chat messages:
+// RD: followed by base32 of the version, size, timestamp and binary
+// representation hash, and of the filename cut to CompactFileNameLimit
+// bytes; an empty filename leaves it out. ParseCompactRandomURL reverses it, up to the truncated name and
+// the host. String remains the readable form. A representation hash that
+// is neither a CID nor a SHA-256 hash is kept as text, and rejected by
+// ParseCompactRandomURL as ParseRandomURL rejects it.
+func (ru *RandomURL) Compact() string {
+	var hash []byte
+	var flags byte
+	switch classifyRef(ru.RepHash) {
+	case RefFormSHA256Hex:
+		hash, _ = hex.DecodeString(ru.RepHash)
+		flags |= compactHexHash
+	case RefFormRawCID, RefFormRawMultihash, RefFormCID:
+		c, _ := cid.Decode(ru.RepHash)
+		hash = c.Bytes()
+		// A CIDv0 is always a sha2-256 multihash, so its digest is enough
+		if c.Version() == 0 {
+			hash = hash[len(hash)-32:]
+			flags |= compactCIDv0
+		}
+	default:
+		hash = []byte(ru.RepHash)
+		flags |= compactTextHash
+	}
+	if ru.Encrypted {
+		flags |= compactEncrypted
+	}
+
+	payload := []byte{compactFormat<<4 | flags}
+	payload = appendCompactVersion(payload, ru.Version)
+	payload = binary.AppendUvarint(payload, uint64(ru.FileSize))
+	payload = binary.AppendUvarint(payload, uint64(ru.Timestamp))
+	payload = appendCompactBytes(payload, hash)
+	// The filename runs to the end of the payload
+	payload = append(payload, truncateFileName(ru.FileName, CompactFileNameLimit)...)
+	return compactURLPrefix + compactEncoding.EncodeToString(payload)
+}
+
+// truncateFileName cuts name to at most limit bytes without splitting a
+// UTF-8 sequence
+func truncateFileName(name string, limit int) string {
+	if len(name) <= limit {
+		return name
+	}
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(name[cut]) {
+		cut--
+	}
+	return name[:cut]
+}
+
+// appendCompactBytes appends data prefixed with its length
+func appendCompactBytes(payload, data []byte) []byte {
+	payload = binary.AppendUvarint(payload, uint64(len(data)))
+	return append(payload, data...)
+}
+
+// appendCompactVersion appends a version of the form vN as N+1 in one
+// varint, and any other version as 0 followed by its text
+func appendCompactVersion(payload []byte, version string) []byte {
+	if n, ok := numberedVersion(version); ok {
+		return binary.AppendUvarint(payload, n+1)
+	}
+	payload = binary.AppendUvarint(payload, 0)
+	return appendCompactBytes(payload, []byte(version))
+}
+
+// numberedVersion returns N for a version vN written without leading zeros
+func numberedVersion(version string) (uint64, bool) {
+	digits, ok := strings.CutPrefix(version, "v")
+	if !ok || digits == "" || (digits[0] == '0' && digits != "0") {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(digits, 10, 63)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// compactReader reads the fields of a compact payload, remembering the
+// first failure
+type compactReader struct {
+	data []byte
+	err  error
+}
+
+// uvarint reads a varint field
+func (r *compactReader) uvarint(field string) uint64 {
+	if r.err != nil {
+		return 0
+	}
+	value, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = fmt.Errorf("%w: truncated %s", ErrInvalidURL, field)
+		return 0
+	}
+	r.data = r.data[n:]
+	return value
+}
+
+// bytes reads a length-prefixed field
+func (r *compactReader) bytes(field string) []byte {
+	length := r.uvarint(field)
+	if r.err != nil {
+		return nil
+	}
+	if length > uint64(len(r.data)) {
+		r.err = fmt.Errorf("%w: truncated %s", ErrInvalidURL, field)
+		return nil
+	}
+	value := r.data[:length]
+	r.data = r.data[length:]
+	return value
+}
+
+// ParseCompactRandomURL parses a URL produced by Compact. The prefix and
+// payload are accepted in either case. The host is not carried, so the
+// result names the default randomfs host.
+func ParseCompactRandomURL(compact string) (*RandomURL, error) {
+	if len(compact) < len(compactURLPrefix) || !strings.EqualFold(compact[:len(compactURLPrefix)], compactURLPrefix) {
+		return nil, fmt.Errorf("%w: expected a compact URL starting with %s", ErrInvalidURL, compactURLPrefix)
+	}
+	payload, err := compactEncoding.DecodeString(strings.ToUpper(compact[len(compactURLPrefix):]))
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid compact encoding: %v", ErrInvalidURL, err)
+	}
+	if len(payload) == 0 || payload[0]>>4 != compactFormat {
+		return nil, fmt.Errorf("%w: unsupported compact format", ErrInvalidURL)
+	}
+	flags := payload[0] & 0x0f
+
+	r := &compactReader{data: payload[1:]}
+	var version string
+	if n := r.uvarint("version"); n > 0 {
+		version = "v" + strconv.FormatUint(n-1, 10)
+	} else {
+		version = string(r.bytes("version"))
+	}
+	fileSize := r.uvarint("file size")
+	timestamp := r.uvarint("timestamp")
+	hash := r.bytes("representation hash")
+	if r.err != nil {
+		return nil, r.err
+	}
+	fileName := r.data
+	if len(version) == 0 {
+		return nil, fmt.Errorf("%w: missing version", ErrInvalidURL)
+	}
+	if fileSize > 1<<63-1 || timestamp > 1<<63-1 {
+		return nil, fmt.Errorf("%w: size or timestamp out of range", ErrInvalidURL)
+	}
+
+	var repHash string
+	switch {
+	case flags&compactTextHash != 0:
+		return nil, fmt.Errorf("%w: representation hash %q is not a CID or SHA-256 hash", ErrInvalidURL, hash)
+	case flags&compactHexHash != 0:
+		if len(hash) != 32 {
+			return nil, fmt.Errorf("%w: SHA-256 representation hash is %d bytes", ErrInvalidURL, len(hash))
+		}
+		repHash = hex.EncodeToString(hash)
+	case flags&compactCIDv0 != 0:
+		digest, err := mh.Encode(hash, mh.SHA2_256)
+		if err != nil || len(hash) != 32 {
+			return nil, fmt.Errorf("%w: CIDv0 representation hash is %d bytes", ErrInvalidURL, len(hash))
+		}
+		repHash = cid.NewCidV0(digest).String()
+	default:
+		c, err := cid.Cast(hash)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid representation hash: %v", ErrInvalidURL, err)
+		}
+		repHash = c.String()
+	}
+
+	return &RandomURL{
+		Scheme:    "rd",
+		Host:      "randomfs",
+		Version:   version,
+		FileSize:  int64(fileSize),
+		FileName:  string(fileName),
+		Timestamp: int64(timestamp),
+		RepHash:   repHash,
+		Encrypted: flags&compactEncrypted != 0,
+	}, nil
+}
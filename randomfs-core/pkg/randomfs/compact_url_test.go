@@ -0,0 +1,82 @@
+package randomfs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCompactRandomURLRoundTrip(t *testing.T) {
+	for _, ru := range []RandomURL{
+		{Version: RepresentationVersion, FileName: "report.pdf", FileSize: 12345, Timestamp: 1700000000,
+			RepHash: "QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG"},
+		{Version: RepresentationVersion, FileName: "a b/c.txt", FileSize: 0, Timestamp: 0,
+			RepHash: strings.Repeat("ab", 32)},
+		{Version: "beta", FileName: "", FileSize: 7, Timestamp: 1,
+			RepHash: "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku"},
+		{Version: RepresentationVersion, FileName: "secret", FileSize: 1 << 40, Timestamp: 1700000000,
+			RepHash: "QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG", Encrypted: true},
+	} {
+		ru.Scheme, ru.Host = "rd", "randomfs"
+		compact := ru.Compact()
+		if !strings.HasPrefix(compact, compactURLPrefix) {
+			t.Errorf("%q does not start with %s", compact, compactURLPrefix)
+		}
+		// QR alphanumeric mode covers upper case letters, digits and ':'
+		if strings.Trim(compact, "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789:") != "" {
+			t.Errorf("%q has characters outside the QR alphanumeric set", compact)
+		}
+		// Alphanumeric mode spends 5.5 bits a character, byte mode, which the
+		// lower case verbose form needs, 8
+		if len(compact)*11 >= len(ru.String())*16 || len(compact) > len(ru.String()) {
+			t.Errorf("compact %q is no smaller in a QR code than %q", compact, ru.String())
+		}
+		for _, form := range []string{compact, strings.ToLower(compact)} {
+			parsed, err := ParseCompactRandomURL(form)
+			if err != nil {
+				t.Errorf("ParseCompactRandomURL(%q): %v", form, err)
+				continue
+			}
+			if *parsed != ru {
+				t.Errorf("%q parsed as %+v, want %+v", form, *parsed, ru)
+			}
+		}
+	}
+}
+
+func TestCompactRandomURLTruncatesFileName(t *testing.T) {
+	ru := RandomURL{Scheme: "rd", Host: "randomfs", Version: RepresentationVersion, FileSize: 1,
+		FileName: strings.Repeat("é", CompactFileNameLimit), RepHash: strings.Repeat("0", 64)}
+	parsed, err := ParseCompactRandomURL(ru.Compact())
+	if err != nil {
+		t.Fatalf("ParseCompactRandomURL: %v", err)
+	}
+	// Each é is two bytes, so half of them fit
+	if want := strings.Repeat("é", CompactFileNameLimit/2); parsed.FileName != want {
+		t.Errorf("filename truncated to %q, want %q", parsed.FileName, want)
+	}
+}
+
+func TestParseCompactRandomURLRejectsMalformed(t *testing.T) {
+	valid := (&RandomURL{Version: RepresentationVersion, FileName: "f", FileSize: 1,
+		RepHash: "QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG"}).Compact()
+	payload, _ := compactEncoding.DecodeString(valid[len(compactURLPrefix):])
+	encode := func(payload []byte) string { return compactURLPrefix + compactEncoding.EncodeToString(payload) }
+
+	wrongFormat := append([]byte{}, payload...)
+	wrongFormat[0] = (compactFormat + 1) << 4
+	for name, compact := range map[string]string{
+		"verbose URL":   "rd://randomfs/v1/1/f/0/" + strings.Repeat("0", 64),
+		"bad encoding":  "RD:1!",
+		"empty payload": "RD:",
+		"truncated":     encode(payload[:len(payload)-len("f")-3]),
+		"wrong format":  encode(wrongFormat),
+		"text hash":     (&RandomURL{Version: RepresentationVersion, FileName: "f", RepHash: "not-a-hash"}).Compact(),
+		"missing version": (&RandomURL{FileName: "f",
+			RepHash: "QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG"}).Compact(),
+	} {
+		if _, err := ParseCompactRandomURL(compact); !errors.Is(err, ErrInvalidURL) {
+			t.Errorf("%s: ParseCompactRandomURL(%q) returned %v, want ErrInvalidURL", name, compact, err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package randomfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codecs for the Compression option
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// ErrUnknownCompression is returned for a codec other than the Compression
+// constants, whether configured or named by a representation
+var ErrUnknownCompression = errors.New("unknown compression codec")
+
+// compressed reports whether the blocks of rep hold compressed data
+func (rep *FileRepresentation) compressed() bool {
+	return rep.Compression != "" && rep.Compression != CompressionNone
+}
+
+// dataSize returns the number of bytes the blocks of rep hold: the stored
+// size for compressed or encrypted files, the file size otherwise
+func (rep *FileRepresentation) dataSize() int64 {
+	if rep.compressed() || rep.encrypted() {
+		return rep.StoredSize
+	}
+	return rep.FileSize
+}
+
+// compressData compresses data with codec
+func compressData(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionZstd:
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer encoder.Close()
+		return encoder.EncodeAll(data, nil), nil
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownCompression, codec)
+}
+
+// newDecompressor returns a reader decompressing r with codec
+func newDecompressor(codec string, r io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownCompression, codec)
+}
+
+// decompressFile decompresses the reconstructed data of rep, checking it
+// inflates to exactly the recorded file size so a corrupt or hostile
+// stream cannot expand without bound
+func decompressFile(rep *FileRepresentation, r io.Reader, w io.Writer) error {
+	decompressor, err := newDecompressor(rep.Compression, r)
+	if err != nil {
+		return fmt.Errorf("failed to decompress %s: %w", rep.FileName, err)
+	}
+	defer decompressor.Close()
+
+	n, err := io.Copy(w, io.LimitReader(decompressor, rep.FileSize+1))
+	if err != nil {
+		return fmt.Errorf("failed to decompress %s: %w", rep.FileName, err)
+	}
+	if n != rep.FileSize {
+		return fmt.Errorf("failed to decompress %s: got %d bytes, expected %d", rep.FileName, n, rep.FileSize)
+	}
+	return nil
+}
+
+// compressForStore compresses data with the configured Compression. It
+// returns data unchanged and no codec when compression is off or would not
+// make the file smaller.
+func (rfs *RandomFS) compressForStore(data []byte) ([]byte, string, error) {
+	if rfs.Compression == "" || rfs.Compression == CompressionNone {
+		return data, "", nil
+	}
+	compressed, err := compressData(rfs.Compression, data)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(compressed) >= len(data) {
+		return data, "", nil
+	}
+	return compressed, rfs.Compression, nil
+}
+
+// writeDecompressed reconstructs the stored data of a compressed file,
+// hashing it into hasher if set, and writes the decompressed file to w.
+// The stored data is always read to the end so the hash can be checked,
+// and a decompression failure is returned separately for the caller to
+// report once the hash has been checked.
+func (rfs *RandomFS) writeDecompressed(ctx context.Context, rep *FileRepresentation, hasher hash.Hash, w io.Writer) (decompressErr, err error) {
+	reader, writer := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := decompressFile(rep, reader, w)
+		io.Copy(io.Discard, reader)
+		done <- err
+	}()
+
+	var stored io.Writer = writer
+	if hasher != nil {
+		stored = io.MultiWriter(writer, hasher)
+	}
+	err = rfs.writeBlocks(ctx, rep, 0, stored)
+	writer.CloseWithError(err)
+	decompressErr = <-done
+	if err != nil {
+		return nil, err
+	}
+	return decompressErr, nil
+}
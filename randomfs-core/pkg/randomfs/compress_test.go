@@ -0,0 +1,148 @@
+package randomfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// logLines returns size bytes of repetitive log output
+func logLines(size int) []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < size; i++ {
+		fmt.Fprintf(&buf, "2024-01-01T00:00:%02d INFO request %d served in %dms\n", i%60, i, i%250)
+	}
+	return buf.Bytes()[:size]
+}
+
+func TestCompressedStoreRoundTrip(t *testing.T) {
+	data := logLines(300 * 1024)
+	for _, codec := range []string{CompressionGzip, CompressionZstd} {
+		t.Run(codec, func(t *testing.T) {
+			rfs := newTestRandomFS(t)
+			uncompressed, err := rfs.StoreFile("plain.log", data, "text/plain")
+			if err != nil {
+				t.Fatalf("StoreFile: %v", err)
+			}
+			_, plainRep, err := rfs.RetrieveFile(uncompressed.RepHash)
+			if err != nil {
+				t.Fatalf("RetrieveFile: %v", err)
+			}
+
+			rfs.Compression = codec
+			rdURL, err := rfs.StoreFile("app.log", data, "text/plain")
+			if err != nil {
+				t.Fatalf("StoreFile: %v", err)
+			}
+			if rdURL.FileSize != int64(len(data)) {
+				t.Errorf("URL reports %d bytes, want the original %d", rdURL.FileSize, len(data))
+			}
+
+			got, rep, err := rfs.RetrieveFile(rdURL.RepHash)
+			if err != nil {
+				t.Fatalf("RetrieveFile: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("retrieved file differs")
+			}
+			if rep.Compression != codec || rep.FileSize != int64(len(data)) || rep.StoredSize >= rep.FileSize {
+				t.Fatalf("representation records %s, %d bytes stored as %d", rep.Compression, rep.FileSize, rep.StoredSize)
+			}
+			// Smaller files may fall into a smaller block size tier, so
+			// compare the bytes stored rather than the block count
+			compressedBytes := len(rep.BlockHashes) * rep.BlockSize
+			if plainBytes := len(plainRep.BlockHashes) * plainRep.BlockSize; compressedBytes >= plainBytes {
+				t.Errorf("compressed file takes %d bytes of blocks, uncompressed %d", compressedBytes, plainBytes)
+			}
+
+			var out bytes.Buffer
+			if _, err := rfs.RetrieveFileTo(rdURL.RepHash, &out); err != nil {
+				t.Fatalf("RetrieveFileTo: %v", err)
+			}
+			if !bytes.Equal(out.Bytes(), data) {
+				t.Error("RetrieveFileTo wrote a different file")
+			}
+
+			stream, _, err := rfs.RetrieveFileStream(rdURL.RepHash)
+			if err != nil {
+				t.Fatalf("RetrieveFileStream: %v", err)
+			}
+			streamed, err := io.ReadAll(stream)
+			stream.Close()
+			if err != nil || !bytes.Equal(streamed, data) {
+				t.Errorf("streamed file differs: %v", err)
+			}
+
+			// Ranges count original bytes, forwards and backwards
+			for _, r := range [][2]int64{{200000, 200100}, {10, 5000}, {int64(len(data)) - 7, int64(len(data))}} {
+				reader, _, err := rfs.RetrieveFileRange(rdURL.RepHash, r[0], r[1])
+				if err != nil {
+					t.Fatalf("RetrieveFileRange(%d, %d): %v", r[0], r[1], err)
+				}
+				part, err := io.ReadAll(reader)
+				reader.Close()
+				if err != nil || !bytes.Equal(part, data[r[0]:r[1]]) {
+					t.Errorf("range %d-%d differs: %v", r[0], r[1], err)
+				}
+			}
+			fileStream, err := rfs.OpenFileStream(rdURL.RepHash)
+			if err != nil {
+				t.Fatalf("OpenFileStream: %v", err)
+			}
+			defer fileStream.Close()
+			buf := make([]byte, 100)
+			for _, off := range []int64{250000, 1000, 1000, 299000} {
+				if _, err := fileStream.Seek(off, io.SeekStart); err != nil {
+					t.Fatalf("Seek: %v", err)
+				}
+				if _, err := io.ReadFull(fileStream, buf); err != nil || !bytes.Equal(buf, data[off:off+100]) {
+					t.Errorf("read at %d differs: %v", off, err)
+				}
+			}
+
+			if err := rfs.VerifyFile(rdURL.RepHash); err != nil {
+				t.Errorf("VerifyFile: %v", err)
+			}
+			stats := rfs.GetStats()
+			if stats.UncompressedBytes != int64(len(data)) || stats.CompressedBytes != rep.StoredSize {
+				t.Errorf("stats report %d bytes compressed to %d, want %d to %d", stats.UncompressedBytes, stats.CompressedBytes, len(data), rep.StoredSize)
+			}
+		})
+	}
+}
+
+func TestCompressionSkipsIncompressibleFiles(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	rfs.Compression = CompressionZstd
+	data := make([]byte, 50*1024)
+	rand.Read(data)
+
+	rdURL, err := rfs.StoreFile("random.bin", data, "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	got, rep, err := rfs.RetrieveFile(rdURL.RepHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("retrieved file differs")
+	}
+	if rep.Compression != "" || rep.StoredSize != 0 {
+		t.Errorf("incompressible file was stored compressed with %q", rep.Compression)
+	}
+	if stats := rfs.GetStats(); stats.UncompressedBytes != 0 {
+		t.Errorf("stats count %d compressed bytes", stats.UncompressedBytes)
+	}
+}
+
+func TestUnknownCompressionIsRejected(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	rfs.Compression = "lzma"
+	if _, err := rfs.StoreFile("a.txt", logLines(4096), "text/plain"); !errors.Is(err, ErrUnknownCompression) {
+		t.Fatalf("StoreFile returned %v, want ErrUnknownCompression", err)
+	}
+}
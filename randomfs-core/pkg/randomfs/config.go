@@ -0,0 +1,295 @@
+package randomfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Defaults filled in for zero Config fields
+const (
+	DefaultIPFSAPI   = "http://localhost:5001"
+	DefaultDataDir   = "./data"
+	DefaultCacheSize = 500 * 1024 * 1024
+	DefaultHTTPPort  = 8080
+)
+
+// Config holds the settings of a RandomFS instance opened with
+// NewRandomFSWithConfig. Zero fields take the Default values; the zero
+// Config stores blocks locally in DefaultDataDir.
+type Config struct {
+	// EnableIPFS stores blocks through the IPFS HTTP API at IPFSAPI rather
+	// than in the data directory
+	EnableIPFS bool
+	IPFSAPI    string
+	// GatewayURL, if set, is an IPFS HTTP gateway, such as
+	// https://ipfs.io, that reads fall back to when the IPFS API fails.
+	// If the API is unreachable when the instance opens, it opens
+	// read-only and reads only from the gateway; storing always needs
+	// the API.
+	GatewayURL string
+	// DataDir holds the index, journals and, without IPFS, the blocks
+	DataDir string
+	// CacheSize is the size in bytes of the block cache
+	CacheSize int64
+	// PersistentCache keeps cached blocks in the cache directory of
+	// DataDir as well as in memory, so a restarted instance starts with a
+	// warm cache instead of fetching every block from IPFS again. The
+	// directory holds up to PersistentCacheSize bytes, CacheSize if zero.
+	PersistentCache     bool
+	PersistentCacheSize int64
+	// HTTPPort is the port front ends such as randomfs-http serve the
+	// instance on. RandomFS itself does not listen.
+	HTTPPort int
+	// APIKeys, if set, are the bearer tokens front ends require to store,
+	// delete and list files, and to retrieve them unless PublicRetrieval
+	// is set
+	APIKeys         []string
+	PublicRetrieval bool
+	// RateLimit, if positive, is the number of requests per second front
+	// ends accept from each client address, with bursts of up to
+	// RateBurst requests, the rate rounded up if zero
+	RateLimit float64
+	RateBurst int
+	// ReadOnly opens an existing data directory for serving files only,
+	// as NewReadOnlyRandomFS does
+	ReadOnly bool
+	// EncryptionKey, if set, becomes the RepresentationKey
+	EncryptionKey []byte
+	// BlockSizeOverride, if set, becomes the FixedBlockSize
+	BlockSizeOverride int
+	// StoreWorkers is the number of blocks of a file stored at once,
+	// DefaultStoreWorkers if zero
+	StoreWorkers int
+	// RetrieveWorkers is the number of blocks of a file fetched at once,
+	// DefaultRetrieveWorkers if zero
+	RetrieveWorkers int
+	// PrivacyEpsilon, if positive, becomes the PrivacyEpsilon of the
+	// instance
+	PrivacyEpsilon float64
+	// ParsedRepresentationCacheSize is the number of decoded
+	// representations kept in memory, DefaultParsedRepresentationCacheSize
+	// if zero. A negative size disables the cache.
+	ParsedRepresentationCacheSize int
+	// PinPolicy becomes the PinPolicy of the instance
+	PinPolicy PinPolicy
+	// MaxFileSize, if positive, becomes the MaxFileSize of the instance
+	MaxFileSize int64
+	// PopularityHalfLife becomes the PopularityHalfLife of the instance
+	PopularityHalfLife time.Duration
+	// BlockStore, if set, keeps the blocks instead of the blocks
+	// directory of DataDir. It cannot be combined with EnableIPFS.
+	BlockStore BlockStore
+	// HashFunc is the function new blocks are addressed with, one of the
+	// BlockHash names, BlockHashSHA256 if empty. Blocks hashed with
+	// another function are referred to by raw CIDs carrying its
+	// multihash; files stored under different functions can share an
+	// instance, as every reference names its own.
+	HashFunc string
+	// Logger becomes the Logger of the instance
+	Logger *slog.Logger
+}
+
+// WithDefaults returns cfg with its zero fields set to the defaults
+func (cfg Config) WithDefaults() Config {
+	if cfg.EnableIPFS && cfg.IPFSAPI == "" {
+		cfg.IPFSAPI = DefaultIPFSAPI
+	}
+	if cfg.DataDir == "" {
+		cfg.DataDir = DefaultDataDir
+	}
+	if cfg.CacheSize == 0 {
+		cfg.CacheSize = DefaultCacheSize
+	}
+	if cfg.HTTPPort == 0 {
+		cfg.HTTPPort = DefaultHTTPPort
+	}
+	if cfg.RateLimit > 0 && cfg.RateBurst == 0 {
+		cfg.RateBurst = int(math.Ceil(cfg.RateLimit))
+	}
+	if cfg.PersistentCache && cfg.PersistentCacheSize == 0 {
+		cfg.PersistentCacheSize = cfg.CacheSize
+	}
+	if cfg.StoreWorkers == 0 {
+		cfg.StoreWorkers = DefaultStoreWorkers
+	}
+	if cfg.RetrieveWorkers == 0 {
+		cfg.RetrieveWorkers = DefaultRetrieveWorkers
+	}
+	if cfg.ParsedRepresentationCacheSize == 0 {
+		cfg.ParsedRepresentationCacheSize = DefaultParsedRepresentationCacheSize
+	}
+	if cfg.HashFunc == "" {
+		cfg.HashFunc = BlockHashSHA256
+	}
+	return cfg
+}
+
+// validate checks the settings that cannot be defaulted
+func (cfg Config) validate() error {
+	if cfg.CacheSize < 0 {
+		return fmt.Errorf("invalid cache size %d", cfg.CacheSize)
+	}
+	if cfg.PersistentCache && cfg.ReadOnly {
+		return errors.New("a persistent cache needs a writable data directory")
+	}
+	if cfg.PersistentCacheSize < 0 {
+		return fmt.Errorf("invalid persistent cache size %d", cfg.PersistentCacheSize)
+	}
+	if cfg.StoreWorkers < 0 {
+		return fmt.Errorf("invalid store worker count %d", cfg.StoreWorkers)
+	}
+	if cfg.RetrieveWorkers < 0 {
+		return fmt.Errorf("invalid retrieve worker count %d", cfg.RetrieveWorkers)
+	}
+	if !(cfg.RateLimit >= 0) || cfg.RateBurst < 0 {
+		return fmt.Errorf("invalid rate limit %v with burst %d", cfg.RateLimit, cfg.RateBurst)
+	}
+	if cfg.MaxFileSize < 0 {
+		return fmt.Errorf("invalid maximum file size %d", cfg.MaxFileSize)
+	}
+	if cfg.PopularityHalfLife < 0 {
+		return fmt.Errorf("invalid popularity half-life %v", cfg.PopularityHalfLife)
+	}
+	if !(cfg.PrivacyEpsilon >= 0) {
+		return fmt.Errorf("invalid privacy epsilon %v", cfg.PrivacyEpsilon)
+	}
+	if cfg.BlockStore != nil && cfg.EnableIPFS {
+		return errors.New("a block store cannot be combined with IPFS")
+	}
+	if cfg.GatewayURL != "" && !cfg.EnableIPFS {
+		return errors.New("a gateway needs IPFS enabled")
+	}
+	if cfg.PinPolicy < PinAll || cfg.PinPolicy > PinNone {
+		return fmt.Errorf("invalid pin policy %v", cfg.PinPolicy)
+	}
+	if cfg.EncryptionKey != nil && len(cfg.EncryptionKey) != RepresentationKeySize {
+		return fmt.Errorf("encryption key must be %d bytes, got %d", RepresentationKeySize, len(cfg.EncryptionKey))
+	}
+	if _, err := blockHashCode(cfg.HashFunc); err != nil {
+		return err
+	}
+	if _, keyed := cfg.BlockStore.(keyedBlockStore); cfg.BlockStore != nil && !keyed && cfg.HashFunc != BlockHashSHA256 {
+		return fmt.Errorf("block store %T only addresses blocks by %s", cfg.BlockStore, BlockHashSHA256)
+	}
+	if cfg.BlockSizeOverride != 0 {
+		return checkBlockSize(cfg.BlockSizeOverride)
+	}
+	return nil
+}
+
+// NewRandomFSWithConfig creates a RandomFS instance configured by cfg
+func NewRandomFSWithConfig(cfg Config) (*RandomFS, error) {
+	cfg = cfg.WithDefaults()
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case cfg.ReadOnly:
+		if _, err := os.Stat(cfg.DataDir); err != nil {
+			return nil, fmt.Errorf("failed to open data directory: %v", err)
+		}
+	case cfg.EnableIPFS || cfg.BlockStore != nil:
+		if err := os.MkdirAll(cfg.DataDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create data directory: %v", err)
+		}
+	default:
+		if err := os.MkdirAll(filepath.Join(cfg.DataDir, "blocks"), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create data directory: %v", err)
+		}
+	}
+
+	rfs := &RandomFS{
+		MaxRepresentationSize:   DefaultMaxRepresentationSize,
+		MaxRepresentationBlocks: DefaultMaxRepresentationBlocks,
+		OutputBufferSize:        DefaultOutputBufferSize,
+		FileHashAlgorithm:       HashSHA256,
+		VerifyBlocks:            true,
+		VerifyFileHash:          true,
+		PinPolicy:               cfg.PinPolicy,
+		PinBatchSize:            DefaultPinBatchSize,
+		PinConcurrency:          DefaultPinConcurrency,
+		MaxInFlightBlocks:       DefaultMaxInFlightBlocks,
+		HashWorkers:             DefaultHashWorkers,
+		StoreWorkers:            cfg.StoreWorkers,
+		RetrieveWorkers:         cfg.RetrieveWorkers,
+		AsyncWorkers:            DefaultAsyncWorkers,
+		AsyncMaxAttempts:        DefaultAsyncMaxAttempts,
+		AsyncRetryBackoff:       DefaultAsyncRetryBackoff,
+		IPFSRetry:               DefaultRetryPolicy,
+		Transactional:           true,
+		RepresentationKey:       cfg.EncryptionKey,
+		FixedBlockSize:          cfg.BlockSizeOverride,
+		PrivacyEpsilon:          cfg.PrivacyEpsilon,
+		MaxFileSize:             cfg.MaxFileSize,
+		PopularityHalfLife:      cfg.PopularityHalfLife,
+		Logger:                  cfg.Logger,
+		blockHash:               blockHashCodes[cfg.HashFunc],
+		dataDir:                 cfg.DataDir,
+		useIPFS:                 cfg.EnableIPFS,
+		readOnly:                cfg.ReadOnly,
+		cache:                   NewBlockCache(cfg.CacheSize),
+		randomizers:             newRandomizerPool(),
+		parsedReps:              newParsedRepCache(max(cfg.ParsedRepresentationCacheSize, 0)),
+		done:                    make(chan struct{}),
+	}
+	rfs.popular = newPopularBlockPool(rfs, DefaultPopularPoolSize, DefaultPopularPoolRefresh)
+	switch {
+	case cfg.EnableIPFS:
+		rfs.blocks = &IPFSBlockStore{rfs: rfs, api: cfg.IPFSAPI}
+	case cfg.BlockStore != nil:
+		rfs.blocks = cfg.BlockStore
+	default:
+		rfs.blocks = &LocalBlockStore{dir: filepath.Join(cfg.DataDir, "blocks")}
+	}
+	if cfg.GatewayURL != "" {
+		rfs.gateway = NewGatewaySource(cfg.GatewayURL)
+	}
+
+	if err := rfs.openDataDir(); err != nil {
+		return nil, err
+	}
+
+	if cfg.PersistentCache {
+		if err := rfs.cache.Persist(filepath.Join(cfg.DataDir, cacheDirName), cfg.PersistentCacheSize); err != nil {
+			rfs.Close()
+			return nil, err
+		}
+	}
+
+	if rfs.useIPFS {
+		if err := rfs.testIPFSConnection(context.Background()); err != nil {
+			if rfs.gateway == nil {
+				rfs.Close()
+				return nil, fmt.Errorf("failed to connect to IPFS at %s: %v", cfg.IPFSAPI, err)
+			}
+			rfs.log().Warn("Failed to connect to IPFS, reading from the gateway", "api", cfg.IPFSAPI, "gateway", rfs.gateway.URL, "error", err)
+			rfs.readOnly = true
+			rfs.gatewayOnly = true
+		}
+	}
+
+	if !rfs.readOnly {
+		if err := rfs.recoverJournals(); err != nil {
+			rfs.log().Error("Failed to roll back interrupted stores", "error", err)
+		}
+	}
+
+	switch {
+	case rfs.gatewayOnly:
+		rfs.log().Info("RandomFS initialized read-only", "gateway", rfs.gateway.URL)
+	case rfs.readOnly:
+		rfs.log().Info("RandomFS initialized read-only", "data_dir", cfg.DataDir)
+	case rfs.useIPFS:
+		rfs.log().Info("RandomFS initialized with IPFS", "api", cfg.IPFSAPI)
+	default:
+		rfs.log().Info("RandomFS initialized without IPFS", "data_dir", cfg.DataDir)
+	}
+	return rfs, nil
+}
@@ -0,0 +1,124 @@
+package randomfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/TheEntropyCollective/randomfs-core/internal/ipfstest"
+)
+
+func TestConfigDefaults(t *testing.T) {
+	cfg := Config{}.WithDefaults()
+	if cfg.EnableIPFS || cfg.IPFSAPI != "" {
+		t.Errorf("zero config enabled IPFS: %+v", cfg)
+	}
+	if cfg.DataDir != DefaultDataDir || cfg.CacheSize != DefaultCacheSize || cfg.HTTPPort != DefaultHTTPPort ||
+		cfg.StoreWorkers != DefaultStoreWorkers || cfg.RetrieveWorkers != DefaultRetrieveWorkers {
+		t.Errorf("zero config defaulted to %+v", cfg)
+	}
+	if cfg := (Config{EnableIPFS: true}).WithDefaults(); cfg.IPFSAPI != DefaultIPFSAPI {
+		t.Errorf("IPFS config defaulted its API to %q", cfg.IPFSAPI)
+	}
+	if cfg := (Config{DataDir: "d", CacheSize: 1, HTTPPort: 9}).WithDefaults(); cfg.DataDir != "d" || cfg.CacheSize != 1 || cfg.HTTPPort != 9 {
+		t.Errorf("set fields were replaced: %+v", cfg)
+	}
+	if cfg := (Config{RateLimit: 2.5}).WithDefaults(); cfg.RateBurst != 3 {
+		t.Errorf("rate limit of 2.5 defaulted its burst to %d", cfg.RateBurst)
+	}
+}
+
+func TestNewRandomFSWithConfig(t *testing.T) {
+	key := bytes.Repeat([]byte{3}, RepresentationKeySize)
+	rfs, err := NewRandomFSWithConfig(Config{
+		DataDir:           t.TempDir(),
+		CacheSize:         16 * 1024 * 1024,
+		EncryptionKey:     key,
+		BlockSizeOverride: MiniBlockSize,
+		PrivacyEpsilon:    0.5,
+	})
+	if err != nil {
+		t.Fatalf("NewRandomFSWithConfig: %v", err)
+	}
+	defer rfs.Close()
+	if rfs.useIPFS || !bytes.Equal(rfs.RepresentationKey, key) || rfs.FixedBlockSize != MiniBlockSize || rfs.PrivacyEpsilon != 0.5 {
+		t.Fatalf("instance does not reflect its config: useIPFS=%v FixedBlockSize=%d PrivacyEpsilon=%v", rfs.useIPFS, rfs.FixedBlockSize, rfs.PrivacyEpsilon)
+	}
+
+	// A small file would use nano blocks without the override
+	data := make([]byte, 3*NanoBlockSize)
+	rand.Read(data)
+	rdURL, err := rfs.StoreFile("small.bin", data, "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	got, rep, err := rfs.RetrieveFile(rdURL.RepHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("retrieved file differs")
+	}
+	if rep.BlockSize != MiniBlockSize || len(rep.BlockHashes) != 1 {
+		t.Errorf("stored with %d blocks of %d bytes, want one of %d", len(rep.BlockHashes), rep.BlockSize, MiniBlockSize)
+	}
+	if entry, _ := rfs.index.get(rdURL.RepHash); entry.blockSize() != MiniBlockSize {
+		t.Errorf("index recorded block size %d", entry.blockSize())
+	}
+	if !rdURL.Encrypted {
+		t.Error("representation was not encrypted with the configured key")
+	}
+}
+
+func TestNewRandomFSWithConfigIPFSAndReadOnly(t *testing.T) {
+	ipfs := ipfstest.NewServer(t)
+	dataDir := t.TempDir()
+	rfs, err := NewRandomFSWithConfig(Config{EnableIPFS: true, IPFSAPI: ipfs.APIURL(), DataDir: dataDir})
+	if err != nil {
+		t.Fatalf("NewRandomFSWithConfig: %v", err)
+	}
+	rdURL, err := rfs.StoreFile("shared.txt", []byte("served by replicas"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	if ipfs.BlockCount() == 0 {
+		t.Fatal("IPFS config stored nothing through IPFS")
+	}
+	rfs.Close()
+
+	replica, err := NewRandomFSWithConfig(Config{EnableIPFS: true, IPFSAPI: ipfs.APIURL(), DataDir: dataDir, ReadOnly: true})
+	if err != nil {
+		t.Fatalf("read-only NewRandomFSWithConfig: %v", err)
+	}
+	defer replica.Close()
+	if got, _, err := replica.RetrieveFile(rdURL.RepHash); err != nil || string(got) != "served by replicas" {
+		t.Fatalf("read-only RetrieveFile = %q, %v", got, err)
+	}
+	if _, err := replica.StoreFile("new.txt", []byte("refused"), "text/plain"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("read-only StoreFile returned %v, want ErrReadOnly", err)
+	}
+}
+
+func TestNewRandomFSWithConfigRejectsInvalidSettings(t *testing.T) {
+	dataDir := t.TempDir()
+	for name, cfg := range map[string]Config{
+		"short key":          {DataDir: dataDir, EncryptionKey: []byte("short")},
+		"odd block size":     {DataDir: dataDir, BlockSizeOverride: 3000},
+		"negative cache":     {DataDir: dataDir, CacheSize: -1},
+		"negative epsilon":   {DataDir: dataDir, PrivacyEpsilon: -1},
+		"NaN epsilon":        {DataDir: dataDir, PrivacyEpsilon: math.NaN()},
+		"negative max size":  {DataDir: dataDir, MaxFileSize: -1},
+		"negative half-life": {DataDir: dataDir, PopularityHalfLife: -time.Hour},
+		"negative rate":      {DataDir: dataDir, RateLimit: -1},
+		"missing data dir":   {DataDir: filepath.Join(dataDir, "missing"), ReadOnly: true},
+	} {
+		if rfs, err := NewRandomFSWithConfig(cfg); err == nil {
+			rfs.Close()
+			t.Errorf("%s: NewRandomFSWithConfig succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package randomfs
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// sniffLength is the number of leading bytes DetectContentType considers
+const sniffLength = 512
+
+// DetectContentType returns the content type of a file from its first
+// bytes, as http.DetectContentType does. When those only show generic text
+// or binary data, the type registered for the filename extension is used
+// instead, so JSON, CSS and other text formats keep their own types.
+func DetectContentType(filename string, head []byte) string {
+	sniffed := http.DetectContentType(head[:min(len(head), sniffLength)])
+	if sniffed != "application/octet-stream" && !strings.HasPrefix(sniffed, "text/plain") {
+		return sniffed
+	}
+	if byExtension := mime.TypeByExtension(filepath.Ext(filename)); byExtension != "" {
+		return byExtension
+	}
+	return sniffed
+}
+
+// detectReaderAtContentType detects the content type of the size bytes of
+// r; read errors are left to the store to report
+func detectReaderAtContentType(filename string, r io.ReaderAt, size int64) string {
+	head := make([]byte, min(size, sniffLength))
+	n, _ := r.ReadAt(head, 0)
+	return DetectContentType(filename, head[:n])
+}
+
+// detectReaderContentType detects the content type of the data read from
+// r, returning a reader that still yields all of it
+func detectReaderContentType(filename string, r io.Reader) (string, io.Reader) {
+	buffered := bufio.NewReaderSize(r, sniffLength)
+	head, _ := buffered.Peek(sniffLength)
+	return DetectContentType(filename, head), buffered
+}
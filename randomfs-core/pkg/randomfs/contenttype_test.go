@@ -0,0 +1,70 @@
+package randomfs
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestDetectContentType(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	tests := []struct {
+		name     string
+		filename string
+		head     []byte
+		want     string
+	}{
+		{"sniffed", "photo", png, "image/png"},
+		{"sniffed over extension", "photo.txt", png, "image/png"},
+		{"extension refines text", "data.json", []byte(`{"a": 1}`), "application/json"},
+		{"plain text", "notes", []byte("hello"), "text/plain; charset=utf-8"},
+		{"extension refines binary", "clip.mp4", []byte{0, 1, 2, 3}, "video/mp4"},
+		{"unknown binary", "blob", []byte{0, 1, 2, 3}, "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectContentType(tt.filename, tt.head); got != tt.want {
+				t.Errorf("DetectContentType(%q) = %q, want %q", tt.filename, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStoresDetectMissingContentType(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	defer rfs.Close()
+	html := []byte("<!DOCTYPE html><html><body>hi</body></html>")
+	stores := map[string]func() (*RandomURL, error){
+		"StoreFile": func() (*RandomURL, error) {
+			return rfs.StoreFile("page", html, "")
+		},
+		"StoreReader": func() (*RandomURL, error) {
+			return rfs.StoreReader("page", io.MultiReader(bytes.NewReader(html)), UnknownSize, "")
+		},
+		"StoreReaderAt": func() (*RandomURL, error) {
+			return rfs.StoreReaderAt("page", bytes.NewReader(html), int64(len(html)), "")
+		},
+	}
+	for name, store := range stores {
+		rdURL, err := store()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got, rep, err := rfs.RetrieveFile(rdURL.RepHash)
+		if err != nil || !bytes.Equal(got, html) {
+			t.Fatalf("%s: retrieval failed: %v", name, err)
+		}
+		if rep.ContentType != "text/html; charset=utf-8" {
+			t.Errorf("%s recorded content type %q", name, rep.ContentType)
+		}
+	}
+
+	// A given content type is kept as is
+	rdURL, err := rfs.StoreFile("page.bin", html, "application/x-custom")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	if rep, _ := rfs.GetRepresentation(rdURL.RepHash); rep.ContentType != "application/x-custom" {
+		t.Errorf("explicit content type replaced by %q", rep.ContentType)
+	}
+}
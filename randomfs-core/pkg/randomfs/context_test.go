@@ -0,0 +1,121 @@
+package randomfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/TheEntropyCollective/randomfs-core/internal/ipfstest"
+)
+
+// goroutinesSettle waits for the goroutine count to fall back to baseline
+func goroutinesSettle(t *testing.T, baseline int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		http.DefaultClient.CloseIdleConnections()
+		n := runtime.NumGoroutine()
+		if n <= baseline {
+			return
+		}
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines remain, started with %d\n%s", n, baseline, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStoreFileContextCancelsTransfers(t *testing.T) {
+	ipfs := ipfstest.NewServer(t)
+	rfs, err := NewRandomFS(ipfs.APIURL(), t.TempDir(), 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFS: %v", err)
+	}
+	defer rfs.Close()
+
+	data := make([]byte, 20*MiniBlockSize)
+	rand.Read(data)
+	http.DefaultClient.CloseIdleConnections()
+	baseline := runtime.NumGoroutine()
+
+	ipfs.SetAddDelay(time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = rfs.StoreFileContext(ctx, "slow.bin", data, "application/octet-stream")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("StoreFileContext returned %v, want a deadline error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("StoreFileContext took %v to give up", elapsed)
+	}
+	if len(rfs.ListFiles()) != 0 {
+		t.Error("cancelled store was indexed")
+	}
+	goroutinesSettle(t, baseline)
+
+	// The instance stays usable once the backend recovers
+	ipfs.SetAddDelay(0)
+	if _, err := rfs.StoreFileContext(context.Background(), "fast.bin", data[:MiniBlockSize], "application/octet-stream"); err != nil {
+		t.Fatalf("StoreFileContext after cancellation: %v", err)
+	}
+}
+
+func TestRetrieveFileContextCancelsTransfers(t *testing.T) {
+	ipfs := ipfstest.NewServer(t)
+	rfs, err := NewRandomFS(ipfs.APIURL(), t.TempDir(), 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFS: %v", err)
+	}
+	defer rfs.Close()
+
+	data := make([]byte, 10*MiniBlockSize)
+	rand.Read(data)
+	rdURL, err := rfs.StoreFile("slow.bin", data, "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	rfs.Cache().Clear()
+	http.DefaultClient.CloseIdleConnections()
+	baseline := runtime.NumGoroutine()
+
+	ipfs.SetCatDelay(time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, _, err := rfs.RetrieveFileContext(ctx, rdURL.RepHash); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("RetrieveFileContext returned %v, want a deadline error", err)
+	}
+	goroutinesSettle(t, baseline)
+
+	// A fetch abandoned by a cancelled caller does not fail the next one
+	ipfs.SetCatDelay(0)
+	got, _, err := rfs.RetrieveFileContext(context.Background(), rdURL.RepHash)
+	if err != nil {
+		t.Fatalf("RetrieveFileContext after cancellation: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("file retrieved after cancellation differs")
+	}
+}
+
+func TestStoreFileContextAlreadyCancelled(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := rfs.StoreFileContext(ctx, "never.txt", []byte("never stored"), "text/plain"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("StoreFileContext returned %v, want context.Canceled", err)
+	}
+	if blocks := blockFiles(t, rfs.dataDir); len(blocks) != 0 {
+		t.Errorf("cancelled store left %d blocks", len(blocks))
+	}
+	if _, _, err := rfs.RetrieveFileContext(ctx, "0000000000000000000000000000000000000000000000000000000000000000"); err == nil {
+		t.Error("RetrieveFileContext with a cancelled context succeeded")
+	}
+}
@@ -0,0 +1,244 @@
+package randomfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// manifestRegistryFileName is the file in the data directory mapping the
+// content of stored files to their representations
+const manifestRegistryFileName = "manifests.json"
+
+// manifestRegistry maps the SHA-256 of the content of files stored from
+// byte slices to the representation storing it, so storing the same bytes
+// again needs no new blocks
+type manifestRegistry struct {
+	path    string
+	entries map[string]string
+	mutex   sync.RWMutex
+}
+
+// loadManifestRegistry reads the registry from dataDir, starting empty if
+// none exists
+func loadManifestRegistry(dataDir string) (*manifestRegistry, error) {
+	mr := &manifestRegistry{
+		path:    filepath.Join(dataDir, manifestRegistryFileName),
+		entries: make(map[string]string),
+	}
+
+	data, err := os.ReadFile(mr.path)
+	if os.IsNotExist(err) {
+		return mr, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest registry: %v", err)
+	}
+	if err := json.Unmarshal(data, &mr.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest registry: %v", err)
+	}
+	return mr, nil
+}
+
+// lookup returns the representation registered for contentHash
+func (mr *manifestRegistry) lookup(contentHash string) (string, bool) {
+	mr.mutex.RLock()
+	defer mr.mutex.RUnlock()
+
+	repHash, exists := mr.entries[contentHash]
+	return repHash, exists
+}
+
+// put registers repHash for contentHash and persists the registry
+func (mr *manifestRegistry) put(contentHash, repHash string) error {
+	mr.mutex.Lock()
+	defer mr.mutex.Unlock()
+
+	if mr.entries[contentHash] == repHash {
+		return nil
+	}
+	mr.entries[contentHash] = repHash
+	data, err := mr.marshal()
+	if err != nil {
+		return err
+	}
+	tmp := mr.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest registry: %v", err)
+	}
+	if err := os.Rename(tmp, mr.path); err != nil {
+		return fmt.Errorf("failed to write manifest registry: %v", err)
+	}
+	return nil
+}
+
+// marshal encodes the registry; callers hold the lock
+func (mr *manifestRegistry) marshal() ([]byte, error) {
+	data, err := json.MarshalIndent(mr.entries, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal manifest registry: %v", err)
+	}
+	return data, nil
+}
+
+// registerContent records that repHash stores the content hashed to
+// contentHash. The registry only saves work, so failing to persist it is
+// logged rather than failing the store.
+func (rfs *RandomFS) registerContent(contentHash, repHash string) {
+	if contentHash == "" {
+		return
+	}
+	if err := rfs.manifests.put(contentHash, repHash); err != nil {
+		rfs.log().Error("Failed to register content", "rep_hash", repHash, "error", err)
+	}
+}
+
+// duplicate is a stored file whose blocks a store of the same content
+// can reuse
+type duplicate struct {
+	repHash   string
+	entry     *IndexEntry
+	rep       *FileRepresentation
+	encrypted bool
+}
+
+// findDuplicate returns the stored file whose blocks a store of the
+// content opts.contentHash can reuse. It returns false when the content
+// must be stored afresh: it is not registered, its file is gone or
+// deleted, or was stored with another block size, compression or key.
+// Stores choosing their randomizers by an explicit or content strategy
+// policy are never deduplicated, since reusing the blocks of another file
+// would bypass that choice. Callers hold the lock.
+func (rfs *RandomFS) findDuplicate(ctx context.Context, contentType string, opts storeOptions) (duplicate, bool) {
+	if opts.contentHash == "" || opts.policy != nil {
+		return duplicate{}, false
+	}
+	if strategy, ok := rfs.contentStrategy(contentType); ok && strategy.Policy != nil {
+		return duplicate{}, false
+	}
+	repHash, exists := rfs.manifests.lookup(opts.contentHash)
+	if !exists {
+		return duplicate{}, false
+	}
+	entry, exists := rfs.index.get(repHash)
+	if !exists || entry.Deleted() {
+		return duplicate{}, false
+	}
+	repData, err := rfs.retrieveRepresentation(ctx, repHash)
+	if err != nil {
+		return duplicate{}, false
+	}
+	// Only a representation readable with the current key is reused, and
+	// only one sealed with it is returned as is
+	encrypted := isEncryptedRepresentation(repData)
+	if encrypted != (rfs.RepresentationKey != nil) {
+		return duplicate{}, false
+	}
+	rep, err := rfs.parseRepresentation(repData)
+	if err != nil {
+		return duplicate{}, false
+	}
+	if rep.Compression != opts.compression || (opts.blockSize != 0 && rep.BlockSize != opts.blockSize) {
+		return duplicate{}, false
+	}
+	return duplicate{repHash: repHash, entry: entry, rep: rep, encrypted: encrypted}, true
+}
+
+// writeDuplicate stores a file whose content opts.contentHash is already
+// registered without storing any block. The registered file is returned
+// as is if it matches the name, content type, disposition and expiry of
+// the store, and otherwise a new representation of its blocks is written
+// under the new name, so both names stay retrievable. It returns false
+// when findDuplicate finds no file to reuse. Callers hold the write lock.
+func (rfs *RandomFS) writeDuplicate(ctx context.Context, journal *storeJournal, filename, contentType string, opts storeOptions) (*RandomURL, bool, error) {
+	dup, ok := rfs.findDuplicate(ctx, contentType, opts)
+	if !ok {
+		return nil, false, nil
+	}
+	repHash, entry, rep, encrypted := dup.repHash, dup.entry, dup.rep, dup.encrypted
+
+	fileName := filepath.Base(filename)
+	if entry.FileName == fileName && rep.ContentType == contentType && rep.Disposition == opts.disposition &&
+		entry.ExpiresAt.IsZero() && opts.expiresAt.IsZero() {
+		rfs.updateStats(func(s *Stats) { s.FilesDeduplicated++ })
+		rfs.log().Info("Deduplicated file", "file", fileName, "rep_hash", repHash)
+		noteReusedBlocks(rep, opts)
+		return &RandomURL{
+			Scheme:       "rd",
+			Host:         "randomfs",
+			Version:      RepresentationVersion,
+			FileName:     entry.FileName,
+			FileSize:     rep.FileSize,
+			Timestamp:    rep.Timestamp,
+			RepHash:      repHash,
+			Encrypted:    encrypted,
+			Deduplicated: true,
+		}, true, nil
+	}
+
+	storedAt := time.Now()
+	rep.FileName = fileName
+	rep.ContentType = contentType
+	rep.Disposition = opts.disposition
+	rep.Timestamp = storedAt.Unix()
+	newHash, encrypted, err := rfs.commitRepresentation(ctx, journal, rep, storedAt, opts)
+	if err != nil {
+		return nil, true, err
+	}
+
+	rfs.updateStats(func(s *Stats) {
+		s.FilesStored++
+		s.FilesDeduplicated++
+		s.TotalSize += rep.FileSize
+	})
+	rfs.log().Info("Deduplicated file", "file", fileName, "source", repHash, "rep_hash", newHash)
+	noteReusedBlocks(rep, opts)
+
+	return &RandomURL{
+		Scheme:       "rd",
+		Host:         "randomfs",
+		Version:      RepresentationVersion,
+		FileName:     rep.FileName,
+		FileSize:     rep.FileSize,
+		Timestamp:    rep.Timestamp,
+		RepHash:      newHash,
+		Encrypted:    encrypted,
+		Deduplicated: true,
+	}, true, nil
+}
+
+// noteReusedBlocks records in opts.result that a store reused every block
+// of rep
+func noteReusedBlocks(rep *FileRepresentation, opts storeOptions) {
+	if opts.result != nil {
+		blocks := int64(len(representationBlocks(rep)))
+		*opts.result = StoreResult{BlocksTotal: blocks, BlocksReused: blocks}
+	}
+}
+
+// PublishManifestRegistry adds the manifest registry to IPFS and returns
+// its CID, so other instances can find the representations of content
+// they are about to store. Anyone holding the CID can tell whether a
+// given file was stored, so publish it only to peers trusted with that.
+func (rfs *RandomFS) PublishManifestRegistry(ctx context.Context) (string, error) {
+	if !rfs.useIPFS {
+		return "", fmt.Errorf("publishing the manifest registry needs IPFS")
+	}
+
+	rfs.manifests.mutex.RLock()
+	data, err := rfs.manifests.marshal()
+	rfs.manifests.mutex.RUnlock()
+	if err != nil {
+		return "", err
+	}
+
+	cid, err := rfs.addToIPFS(ctx, data, false)
+	if err != nil {
+		return "", fmt.Errorf("failed to publish manifest registry: %w", err)
+	}
+	return cid, nil
+}
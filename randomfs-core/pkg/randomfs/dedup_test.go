@@ -0,0 +1,162 @@
+package randomfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"slices"
+	"testing"
+
+	"github.com/TheEntropyCollective/randomfs-core/internal/ipfstest"
+)
+
+func TestStoreFileDeduplicatesIdenticalContent(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	defer rfs.Close()
+	data := make([]byte, 3*NanoBlockSize)
+	rand.Read(data)
+
+	first, err := rfs.StoreFile("a.bin", data, "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	if first.Deduplicated {
+		t.Fatal("first store of the content was deduplicated")
+	}
+	before := rfs.GetStats()
+
+	again, err := rfs.StoreFile("a.bin", data, "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	if !again.Deduplicated || again.RepHash != first.RepHash {
+		t.Fatalf("storing the same file again returned %+v, want the deduplicated %s", again, first.RepHash)
+	}
+	if again.String() != first.String() {
+		t.Errorf("deduplicated URL %s differs from %s", again, first)
+	}
+
+	// Another name gets its own representation over the same blocks
+	renamed, err := rfs.StoreFile("b.bin", data, "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	if !renamed.Deduplicated || renamed.RepHash == first.RepHash {
+		t.Fatalf("storing under another name returned %+v", renamed)
+	}
+	stats := rfs.GetStats()
+	if generated := stats.BlocksGenerated - before.BlocksGenerated; generated != 0 {
+		t.Errorf("deduplicated stores generated %d blocks", generated)
+	}
+	if deduplicated := stats.FilesDeduplicated - before.FilesDeduplicated; deduplicated != 2 {
+		t.Errorf("%d stores counted as deduplicated, want 2", deduplicated)
+	}
+
+	for _, name := range []string{"a.bin", "b.bin"} {
+		got, rep, err := rfs.RetrieveByName(name)
+		if err != nil {
+			t.Fatalf("RetrieveByName(%s): %v", name, err)
+		}
+		if !bytes.Equal(got, data) || rep.FileName != name {
+			t.Errorf("%s retrieved as %s with different content", name, rep.FileName)
+		}
+	}
+	firstRep, _ := rfs.GetRepresentation(first.RepHash)
+	renamedRep, _ := rfs.GetRepresentation(renamed.RepHash)
+	if !slices.Equal(firstRep.BlockHashes, renamedRep.BlockHashes) {
+		t.Error("deduplicated file does not share the blocks of the original")
+	}
+}
+
+func TestDeduplicationFallsBackToFreshStore(t *testing.T) {
+	dataDir := t.TempDir()
+	rfs, err := NewRandomFSWithoutIPFS(dataDir, 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFSWithoutIPFS: %v", err)
+	}
+	data := make([]byte, 2*NanoBlockSize)
+	rand.Read(data)
+	first, err := rfs.StoreFile("a.bin", data, "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	rfs.Close()
+
+	// The registry survives a restart
+	rfs, err = NewRandomFSWithoutIPFS(dataDir, 16*1024*1024)
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	defer rfs.Close()
+	again, err := rfs.StoreFile("a.bin", data, "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	if !again.Deduplicated || again.RepHash != first.RepHash {
+		t.Fatalf("store after a restart was not deduplicated: %+v", again)
+	}
+
+	// Content whose file is deleted is stored afresh
+	if err := rfs.DeleteFile(first.RepHash); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	before := rfs.GetStats()
+	fresh, err := rfs.StoreFile("a.bin", data, "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	if fresh.Deduplicated {
+		t.Fatal("content of a deleted file was deduplicated")
+	}
+	if rfs.GetStats().BlocksGenerated == before.BlocksGenerated {
+		t.Error("fresh store generated no blocks")
+	}
+	got, _, err := rfs.RetrieveFile(fresh.RepHash)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+
+	// Explicit randomizer policies choose their own blocks
+	policy, err := rfs.StoreFileWithPolicy("a.bin", data, "application/octet-stream", AlwaysFreshPolicy)
+	if err != nil {
+		t.Fatalf("StoreFileWithPolicy: %v", err)
+	}
+	if policy.Deduplicated {
+		t.Error("store with an explicit policy was deduplicated")
+	}
+}
+
+func TestPublishManifestRegistry(t *testing.T) {
+	ipfs := ipfstest.NewServer(t)
+	rfs, err := NewRandomFS(ipfs.URL, t.TempDir(), 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFS: %v", err)
+	}
+	defer rfs.Close()
+	data := make([]byte, 100)
+	rand.Read(data)
+	if _, err := rfs.StoreFile("file.bin", data, "application/octet-stream"); err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	again, err := rfs.StoreFile("copy.bin", data, "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	if !again.Deduplicated {
+		t.Error("store over IPFS was not deduplicated")
+	}
+
+	cid, err := rfs.PublishManifestRegistry(context.Background())
+	if err != nil {
+		t.Fatalf("PublishManifestRegistry: %v", err)
+	}
+	if cid == "" {
+		t.Error("no CID returned for the published registry")
+	}
+
+	local := newTestRandomFS(t)
+	defer local.Close()
+	if _, err := local.PublishManifestRegistry(context.Background()); err == nil {
+		t.Error("published the registry without IPFS")
+	}
+}
@@ -0,0 +1,320 @@
+package randomfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Limits of the state kept for diagnostics
+const (
+	maxRecentErrors     = 32
+	diagnosticsTopFiles = 10
+)
+
+// RecentError is a failure kept for DumpDiagnostics
+type RecentError struct {
+	Time  time.Time `json:"time"`
+	Op    string    `json:"op"`
+	Error string    `json:"error"`
+}
+
+// FilePopularity counts the retrievals of one file through this instance
+type FilePopularity struct {
+	RepHash    string `json:"rep_hash"`
+	FileName   string `json:"filename,omitempty"`
+	Retrievals int64  `json:"retrievals"`
+}
+
+// BackendHealth summarizes recent calls to the IPFS API
+type BackendHealth struct {
+	// ConsecutiveFailures counts the calls that failed since the last one
+	// that succeeded
+	ConsecutiveFailures int64     `json:"consecutive_failures"`
+	LastSuccess         time.Time `json:"last_success,omitempty"`
+	LastFailure         time.Time `json:"last_failure,omitempty"`
+}
+
+// diagnostics records the state DumpDiagnostics reports beyond Stats
+type diagnostics struct {
+	mutex      sync.Mutex
+	errors     []RecentError
+	retrievals map[string]int64
+	backend    BackendHealth
+}
+
+// log returns the logger of the instance
+func (rfs *RandomFS) log() *slog.Logger {
+	if rfs.Logger != nil {
+		return rfs.Logger
+	}
+	return slog.Default()
+}
+
+// noteError records a failed operation
+func (rfs *RandomFS) noteError(op string, err error) {
+	if err == nil {
+		return
+	}
+	d := &rfs.diagnostics
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.errors = append(d.errors, RecentError{Time: time.Now(), Op: op, Error: err.Error()})
+	if len(d.errors) > maxRecentErrors {
+		d.errors = d.errors[len(d.errors)-maxRecentErrors:]
+	}
+}
+
+// noteRetrieval records a retrieval of repHash, or its failure
+func (rfs *RandomFS) noteRetrieval(repHash string, err error) {
+	if err != nil {
+		rfs.noteError("retrieve "+repHash, err)
+		return
+	}
+	d := &rfs.diagnostics
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.retrievals == nil {
+		d.retrievals = make(map[string]int64)
+	}
+	d.retrievals[repHash]++
+}
+
+// noteBackendCall records the outcome of an IPFS API call
+func (rfs *RandomFS) noteBackendCall(op string, err error) {
+	d := &rfs.diagnostics
+	d.mutex.Lock()
+	if err == nil {
+		d.backend.ConsecutiveFailures = 0
+		d.backend.LastSuccess = time.Now()
+		d.mutex.Unlock()
+		return
+	}
+	d.backend.ConsecutiveFailures++
+	d.backend.LastFailure = time.Now()
+	d.mutex.Unlock()
+
+	rfs.noteError(op, err)
+}
+
+// RecentErrors returns the last failures of this instance, oldest first
+func (rfs *RandomFS) RecentErrors() []RecentError {
+	d := &rfs.diagnostics
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return append([]RecentError{}, d.errors...)
+}
+
+// PopularFiles returns the n files retrieved most often through this
+// instance, most popular first
+func (rfs *RandomFS) PopularFiles(n int) []FilePopularity {
+	d := &rfs.diagnostics
+	d.mutex.Lock()
+	files := make([]FilePopularity, 0, len(d.retrievals))
+	for repHash, count := range d.retrievals {
+		files = append(files, FilePopularity{RepHash: repHash, Retrievals: count})
+	}
+	d.mutex.Unlock()
+
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Retrievals != files[j].Retrievals {
+			return files[i].Retrievals > files[j].Retrievals
+		}
+		return files[i].RepHash < files[j].RepHash
+	})
+	if len(files) > n {
+		files = files[:n]
+	}
+	for i := range files {
+		if entry, exists := rfs.index.get(files[i].RepHash); exists {
+			files[i].FileName = entry.FileName
+		}
+	}
+	return files
+}
+
+// BackendHealth returns the health of the IPFS backend as seen by this
+// instance
+func (rfs *RandomFS) BackendHealth() BackendHealth {
+	d := &rfs.diagnostics
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.backend
+}
+
+// diagnosticsConfig is the configuration reported by DumpDiagnostics
+type diagnosticsConfig struct {
+	Backend                 string   `json:"backend"`
+	IPFSAPI                 string   `json:"ipfs_api,omitempty"`
+	Gateway                 string   `json:"gateway,omitempty"`
+	GatewayOnly             bool     `json:"gateway_only,omitempty"`
+	DataDir                 string   `json:"data_dir"`
+	ReadOnly                bool     `json:"read_only"`
+	MaxRepresentationSize   int64    `json:"max_representation_size"`
+	MaxRepresentationBlocks int      `json:"max_representation_blocks"`
+	MaxFileSize             int64    `json:"max_file_size"`
+	StrictRepresentations   bool     `json:"strict_representations"`
+	OutputBufferSize        int      `json:"output_buffer_size"`
+	NamePolicy              string   `json:"name_policy"`
+	PinPolicy               string   `json:"pin_policy"`
+	DeleteGracePeriod       string   `json:"delete_grace_period"`
+	RandomizerPolicy        string   `json:"randomizer_policy"`
+	TwoRandomizers          bool     `json:"two_randomizers"`
+	ContentStrategies       []string `json:"content_strategies"`
+	FileHashAlgorithm       string   `json:"file_hash_algorithm"`
+	BlockHashFunc           string   `json:"block_hash_func"`
+	VerifyBlocks            bool     `json:"verify_blocks"`
+	VerifyFileHash          bool     `json:"verify_file_hash"`
+	FallbackSources         int      `json:"fallback_sources"`
+	SparseBlocks            bool     `json:"sparse_blocks"`
+	ReadRepair              bool     `json:"read_repair"`
+	SelfDescribingRefs      bool     `json:"self_describing_refs"`
+	EncryptRepresentations  bool     `json:"encrypt_representations"`
+	Transactional           bool     `json:"transactional"`
+	PinBatchSize            int      `json:"pin_batch_size"`
+	PinConcurrency          int      `json:"pin_concurrency"`
+	MaxInFlightBlocks       int      `json:"max_in_flight_blocks"`
+	HashWorkers             int      `json:"hash_workers"`
+	StoreWorkers            int      `json:"store_workers"`
+	RetrieveWorkers         int      `json:"retrieve_workers"`
+	AsyncWorkers            int      `json:"async_workers"`
+	AsyncMaxAttempts        int      `json:"async_max_attempts"`
+	AsyncRetryBackoff       string   `json:"async_retry_backoff"`
+	IPFSRetryAttempts       int      `json:"ipfs_retry_attempts"`
+	Compression             string   `json:"compression"`
+	Tracing                 bool     `json:"tracing"`
+}
+
+// diagnosticsCache is the cache occupancy reported by DumpDiagnostics
+type diagnosticsCache struct {
+	Size        int64            `json:"size"`
+	MaxSize     int64            `json:"max_size"`
+	Partitioned bool             `json:"partitioned"`
+	Tiers       []CacheTierUsage `json:"tiers"`
+	// Representations is the occupancy of the representation cache, if any
+	Representations *CacheTierUsage `json:"representations,omitempty"`
+	// Disk is the occupancy of the persistent tier, if any
+	Disk *CacheTierUsage `json:"disk,omitempty"`
+}
+
+// diagnosticsReport is the snapshot written by DumpDiagnostics
+type diagnosticsReport struct {
+	GeneratedAt  time.Time         `json:"generated_at"`
+	Version      string            `json:"version"`
+	Config       diagnosticsConfig `json:"config"`
+	Stats        Stats             `json:"stats"`
+	Files        int               `json:"files"`
+	Cache        diagnosticsCache  `json:"cache"`
+	PopularFiles []FilePopularity  `json:"popular_files"`
+	Backend      BackendHealth     `json:"backend"`
+	RecentErrors []RecentError     `json:"recent_errors"`
+}
+
+// DumpDiagnostics writes a JSON snapshot of the configuration, statistics,
+// cache occupancy, most retrieved files, backend health and recent errors
+// of rfs to w, for attaching to bug reports. Block contents are never
+// included.
+func (rfs *RandomFS) DumpDiagnostics(w io.Writer) error {
+	snapshot := rfs.diagnosticsSnapshot()
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(snapshot); err != nil {
+		return fmt.Errorf("failed to write diagnostics: %v", err)
+	}
+	return nil
+}
+
+// diagnosticsSnapshot collects the state DumpDiagnostics writes
+func (rfs *RandomFS) diagnosticsSnapshot() *diagnosticsReport {
+	config := diagnosticsConfig{
+		Backend:                 "local",
+		DataDir:                 rfs.dataDir,
+		ReadOnly:                rfs.readOnly,
+		MaxRepresentationSize:   rfs.MaxRepresentationSize,
+		MaxRepresentationBlocks: rfs.MaxRepresentationBlocks,
+		MaxFileSize:             rfs.MaxFileSize,
+		StrictRepresentations:   rfs.StrictRepresentations,
+		OutputBufferSize:        rfs.OutputBufferSize,
+		NamePolicy:              rfs.NamePolicy.String(),
+		PinPolicy:               rfs.PinPolicy.String(),
+		DeleteGracePeriod:       rfs.DeleteGracePeriod.String(),
+		RandomizerPolicy:        fmt.Sprintf("%T", rfs.RandomizerPolicy),
+		TwoRandomizers:          rfs.TwoRandomizers,
+		ContentStrategies:       []string{},
+		FileHashAlgorithm:       rfs.FileHashAlgorithm,
+		BlockHashFunc:           blockHashName(rfs.blockHash),
+		VerifyBlocks:            rfs.VerifyBlocks,
+		VerifyFileHash:          rfs.VerifyFileHash,
+		FallbackSources:         len(rfs.FallbackSources),
+		SparseBlocks:            rfs.SparseBlocks,
+		ReadRepair:              rfs.ReadRepair,
+		SelfDescribingRefs:      rfs.SelfDescribingRefs,
+		EncryptRepresentations:  rfs.RepresentationKey != nil,
+		Transactional:           rfs.Transactional,
+		PinBatchSize:            rfs.PinBatchSize,
+		PinConcurrency:          rfs.PinConcurrency,
+		MaxInFlightBlocks:       rfs.MaxInFlightBlocks,
+		HashWorkers:             rfs.HashWorkers,
+		StoreWorkers:            rfs.StoreWorkers,
+		RetrieveWorkers:         rfs.RetrieveWorkers,
+		AsyncWorkers:            rfs.AsyncWorkers,
+		AsyncMaxAttempts:        rfs.AsyncMaxAttempts,
+		AsyncRetryBackoff:       rfs.AsyncRetryBackoff.String(),
+		IPFSRetryAttempts:       rfs.IPFSRetry.MaxAttempts,
+		Compression:             rfs.Compression,
+		Tracing:                 rfs.TracerProvider != nil,
+	}
+	switch store := rfs.blocks.(type) {
+	case *IPFSBlockStore:
+		config.Backend = "ipfs"
+		config.IPFSAPI = store.api
+	case *LocalBlockStore:
+	default:
+		config.Backend = fmt.Sprintf("%T", store)
+	}
+	if rfs.gateway != nil {
+		config.Gateway = rfs.gateway.URL
+		config.GatewayOnly = rfs.gatewayOnly
+	}
+	for _, rule := range rfs.ContentStrategies {
+		config.ContentStrategies = append(config.ContentStrategies, rule.Pattern+" => "+rule.Strategy.Name)
+	}
+
+	blockCache := rfs.Cache()
+	_, partitioned := blockCache.Partitions()
+	cache := diagnosticsCache{
+		Size:        blockCache.Size(),
+		MaxSize:     blockCache.MaxSize(),
+		Partitioned: partitioned,
+		Tiers:       blockCache.TierUsage(),
+	}
+	if disk, ok := blockCache.DiskUsage(); ok {
+		cache.Disk = &disk
+	}
+	if repCache := rfs.RepresentationCache(); repCache != nil {
+		cache.Representations = &CacheTierUsage{Tier: "representations", Size: repCache.Size(), MaxSize: repCache.MaxSize()}
+		for _, tier := range repCache.TierUsage() {
+			cache.Representations.Blocks += tier.Blocks
+		}
+	}
+
+	return &diagnosticsReport{
+		GeneratedAt:  time.Now(),
+		Version:      RepresentationVersion,
+		Config:       config,
+		Stats:        rfs.GetStats(),
+		Files:        len(rfs.ListFiles()),
+		Cache:        cache,
+		PopularFiles: rfs.PopularFiles(diagnosticsTopFiles),
+		Backend:      rfs.BackendHealth(),
+		RecentErrors: rfs.RecentErrors(),
+	}
+}
@@ -0,0 +1,144 @@
+package randomfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/TheEntropyCollective/randomfs-core/internal/ipfstest"
+)
+
+func TestDumpDiagnosticsAfterActivity(t *testing.T) {
+	ipfs := ipfstest.NewServer(t)
+	rfs, err := NewRandomFS(ipfs.APIURL(), t.TempDir(), 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFS: %v", err)
+	}
+	defer rfs.Close()
+	rfs.Cache().SetPartitions(DefaultCachePartitions(16 * 1024 * 1024))
+
+	hot, err := rfs.StoreFile("hot.txt", []byte("retrieved twice"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	cold, err := rfs.StoreFile("cold.txt", []byte("retrieved once"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	for _, repHash := range []string{hot.RepHash, hot.RepHash, cold.RepHash} {
+		if _, _, err := rfs.RetrieveFile(repHash); err != nil {
+			t.Fatalf("RetrieveFile: %v", err)
+		}
+	}
+
+	// A retrieval the backend fails
+	ipfs.FailCats(true)
+	rfs.Cache().Clear()
+	if _, _, err := rfs.RetrieveFile("QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG"); err == nil {
+		t.Fatal("retrieval with failing cats succeeded")
+	}
+
+	var buf bytes.Buffer
+	if err := rfs.DumpDiagnostics(&buf); err != nil {
+		t.Fatalf("DumpDiagnostics: %v", err)
+	}
+	var dump map[string]json.RawMessage
+	if err := json.Unmarshal(buf.Bytes(), &dump); err != nil {
+		t.Fatalf("diagnostics are not valid JSON: %v\n%s", err, buf.String())
+	}
+	for _, key := range []string{"generated_at", "version", "config", "stats", "files", "cache", "popular_files", "backend", "recent_errors"} {
+		if _, ok := dump[key]; !ok {
+			t.Errorf("diagnostics lack %q", key)
+		}
+	}
+
+	var report diagnosticsReport
+	if err := json.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatalf("decode diagnostics: %v", err)
+	}
+	if report.Config.Backend != "ipfs" || report.Config.IPFSAPI != ipfs.APIURL() {
+		t.Errorf("config reports backend %q at %q", report.Config.Backend, report.Config.IPFSAPI)
+	}
+	if report.Files != 2 || report.Stats.FilesStored != 2 {
+		t.Errorf("report has %d files, %d stored", report.Files, report.Stats.FilesStored)
+	}
+	if !report.Cache.Partitioned || len(report.Cache.Tiers) != 3 {
+		t.Errorf("cache report %+v", report.Cache)
+	}
+	if len(report.PopularFiles) != 2 || report.PopularFiles[0].RepHash != hot.RepHash ||
+		report.PopularFiles[0].Retrievals != 2 || report.PopularFiles[0].FileName != "hot.txt" {
+		t.Errorf("popular files %+v", report.PopularFiles)
+	}
+	if report.Backend.ConsecutiveFailures == 0 || report.Backend.LastFailure.IsZero() || report.Backend.LastSuccess.IsZero() {
+		t.Errorf("backend health %+v", report.Backend)
+	}
+	var sawCat, sawRetrieve bool
+	for _, recent := range report.RecentErrors {
+		sawCat = sawCat || strings.HasPrefix(recent.Op, "ipfs cat")
+		sawRetrieve = sawRetrieve || strings.HasPrefix(recent.Op, "retrieve ")
+	}
+	if !sawCat || !sawRetrieve {
+		t.Errorf("recent errors %+v lack the failed cat and retrieval", report.RecentErrors)
+	}
+}
+
+func TestRecentErrorsAreBounded(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	for i := 0; i < 2*maxRecentErrors; i++ {
+		rfs.RetrieveFile("0000000000000000000000000000000000000000000000000000000000000000")
+	}
+	if got := len(rfs.RecentErrors()); got != maxRecentErrors {
+		t.Fatalf("kept %d recent errors, want %d", got, maxRecentErrors)
+	}
+	if popular := rfs.PopularFiles(5); len(popular) != 0 {
+		t.Fatalf("failed retrievals counted as popular: %+v", popular)
+	}
+}
+
+// logRecords stores a file through an instance logging at level and
+// returns the messages of its log records with their attributes
+func logRecords(t *testing.T, level slog.Level) map[string]map[string]any {
+	t.Helper()
+	ipfs := ipfstest.NewServer(t)
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: level}))
+	rfs, err := NewRandomFSWithConfig(Config{EnableIPFS: true, IPFSAPI: ipfs.APIURL(), DataDir: t.TempDir(), Logger: logger})
+	if err != nil {
+		t.Fatalf("NewRandomFSWithConfig: %v", err)
+	}
+	defer rfs.Close()
+	if _, err := rfs.StoreFile("logged.txt", []byte("logged"), "text/plain"); err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+
+	records := make(map[string]map[string]any)
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var record map[string]any
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatalf("decode log record: %v", err)
+		}
+		records[record["msg"].(string)] = record
+	}
+	return records
+}
+
+func TestLoggerLevels(t *testing.T) {
+	records := logRecords(t, slog.LevelInfo)
+	stored, ok := records["Stored file"]
+	if !ok {
+		t.Fatalf("no store record among %v", records)
+	}
+	if stored["file"] != "logged.txt" || stored["rep_hash"] == "" || stored["blocks"] == nil || stored["duration"] == nil {
+		t.Errorf("store record lacks its fields: %v", stored)
+	}
+	if _, ok := records["Stored block via IPFS"]; ok {
+		t.Error("per-block record logged at the info level")
+	}
+
+	if _, ok := logRecords(t, slog.LevelDebug)["Stored block via IPFS"]; !ok {
+		t.Error("no per-block record at the debug level")
+	}
+}
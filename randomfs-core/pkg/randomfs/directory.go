@@ -0,0 +1,413 @@
+package randomfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/errgroup"
+)
+
+// DirectoryContentType is the content type of a stored directory manifest
+const DirectoryContentType = "application/x-randomfs-directory"
+
+// DefaultDirectoryConcurrency is the number of files StoreDirectory stores
+// at once
+const DefaultDirectoryConcurrency = 4
+
+// DirectoryManifest lists the files of a stored directory tree
+type DirectoryManifest struct {
+	Type    string           `json:"type"`
+	Name    string           `json:"name"`
+	Entries []DirectoryEntry `json:"entries"`
+	// EmptyDirectories are the slash-separated paths of directories
+	// holding no files, which the entries alone would not recreate
+	EmptyDirectories []string `json:"empty_directories,omitempty"`
+	Version          string   `json:"version"`
+}
+
+// DirectoryEntry is one file of a DirectoryManifest
+type DirectoryEntry struct {
+	// Path is slash separated and relative to the directory root
+	Path    string `json:"path"`
+	RepHash string `json:"rep_hash"`
+	Size    int64  `json:"size"`
+}
+
+// DirectoryOptions tunes StoreDirectoryWithOptions
+type DirectoryOptions struct {
+	// Concurrency is the number of files stored at once; values below one
+	// store files one at a time
+	Concurrency int
+	// Progress, if set, is called after each file is stored with the
+	// number of files done so far and the total. Calls are serialized.
+	Progress func(done, total int)
+}
+
+// StoreDirectory stores every regular file under root and a manifest
+// listing them, returning the URL of the manifest
+func (rfs *RandomFS) StoreDirectory(root string) (*RandomURL, error) {
+	return rfs.StoreDirectoryWithOptions(root, DirectoryOptions{Concurrency: DefaultDirectoryConcurrency})
+}
+
+// StoreDirectoryWithOptions stores a directory tree like StoreDirectory,
+// storing up to opts.Concurrency files at once. Files share the randomizer
+// pool, their blocks are pinned together in batches once all are stored,
+// and the manifest lists them in path order whatever order they finish in.
+// If any file fails, the files already stored are deleted.
+func (rfs *RandomFS) StoreDirectoryWithOptions(root string, opts DirectoryOptions) (rdURL *RandomURL, err error) {
+	ctx, span := rfs.startSpan(context.Background(), "randomfs.StoreDirectory",
+		attribute.String("randomfs.directory.root", root))
+	defer func() { endSpan(span, err) }()
+
+	if rfs.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	paths, emptyDirs, err := rfs.directoryFiles(root)
+	if err != nil {
+		return nil, err
+	}
+
+	rfs.mutex.Lock()
+	defer rfs.mutex.Unlock()
+
+	names, err := rfs.directoryNames(paths)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]DirectoryEntry, len(paths))
+	var done int
+	var progressMutex sync.Mutex
+	var failed atomic.Bool
+
+	var group errgroup.Group
+	group.SetLimit(max(opts.Concurrency, 1))
+	for i, relPath := range paths {
+		group.Go(func() error {
+			if failed.Load() {
+				return nil
+			}
+			rdURL, err := rfs.storeDirectoryFile(ctx, root, relPath, names[i])
+			if err != nil {
+				failed.Store(true)
+				return fmt.Errorf("failed to store %s: %v", relPath, err)
+			}
+			entries[i] = DirectoryEntry{Path: relPath, RepHash: rdURL.RepHash, Size: rdURL.FileSize}
+
+			if opts.Progress != nil {
+				progressMutex.Lock()
+				done++
+				opts.Progress(done, len(paths))
+				progressMutex.Unlock()
+			}
+			return nil
+		})
+	}
+
+	err = group.Wait()
+	if err == nil {
+		repHashes := make([]string, len(entries))
+		for i, entry := range entries {
+			repHashes[i] = entry.RepHash
+		}
+		if err = rfs.pinStoredFiles(repHashes); err != nil {
+			err = fmt.Errorf("failed to pin directory: %v", err)
+		}
+	}
+	if err == nil {
+		rdURL, err = rfs.storeDirectoryManifest(filepath.Base(filepath.Clean(root)), entries, emptyDirs)
+	}
+	if err != nil {
+		rfs.deleteDirectoryFiles(entries)
+		return nil, err
+	}
+
+	rfs.log().Info("Stored directory", "path", root, "files", len(entries), "rep_hash", rdURL.RepHash)
+	return rdURL, nil
+}
+
+// GetDirectoryManifest loads the manifest of a directory stored with
+// StoreDirectory
+func (rfs *RandomFS) GetDirectoryManifest(repHash string) (*DirectoryManifest, error) {
+	rfs.mutex.RLock()
+	defer rfs.mutex.RUnlock()
+
+	data, err := rfs.retrieveRepresentation(context.Background(), repHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve directory manifest: %v", err)
+	}
+
+	var manifest DirectoryManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse directory manifest: %v", err)
+	}
+	if manifest.Type != "directory" {
+		return nil, fmt.Errorf("%s is not a directory manifest", repHash)
+	}
+	return &manifest, nil
+}
+
+// RetrieveDirectory recreates a directory stored with StoreDirectory in
+// destDir, creating destDir if needed. Existing files are never
+// overwritten, and a manifest with a path leading outside destDir is
+// rejected before anything is written.
+func (rfs *RandomFS) RetrieveDirectory(repHash, destDir string) error {
+	manifest, err := rfs.GetDirectoryManifest(repHash)
+	if err != nil {
+		return err
+	}
+
+	dirs := make([]string, len(manifest.EmptyDirectories))
+	for i, dir := range manifest.EmptyDirectories {
+		if dirs[i], err = directoryTarget(destDir, dir); err != nil {
+			return err
+		}
+	}
+	files := make([]string, len(manifest.Entries))
+	for i, entry := range manifest.Entries {
+		if files[i], err = directoryTarget(destDir, entry.Path); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create directory: %v", err)
+		}
+	}
+	for i, entry := range manifest.Entries {
+		if err := rfs.retrieveDirectoryFile(entry.RepHash, files[i]); err != nil {
+			return fmt.Errorf("failed to retrieve %s: %w", entry.Path, err)
+		}
+	}
+
+	rfs.log().Info("Retrieved directory", "rep_hash", repHash, "files", len(files), "path", destDir)
+	return nil
+}
+
+// directoryTarget returns where the manifest path p is written under
+// destDir, rejecting paths that are not local to it
+func directoryTarget(destDir, p string) (string, error) {
+	local := filepath.FromSlash(p)
+	if path.Clean(p) != p || !filepath.IsLocal(local) {
+		return "", fmt.Errorf("directory manifest has invalid path %q", p)
+	}
+	return filepath.Join(destDir, local), nil
+}
+
+// retrieveDirectoryFile writes the file stored as repHash to a new file
+// at target, removing it again if the retrieval fails
+func (rfs *RandomFS) retrieveDirectoryFile(repHash, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	stream, _, err := rfs.RetrieveFileStream(repHash)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, stream)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(target)
+	}
+	return err
+}
+
+// directoryFiles returns the slash-separated paths of the regular files
+// under root and of the directories under it that hold no file, with no
+// subdirectory either, in lexical order. Symlinks and other special files
+// are skipped with a warning.
+func (rfs *RandomFS) directoryFiles(root string) ([]string, []string, error) {
+	var paths, dirs []string
+	// filled holds the directories with a file or directory below them
+	filled := make(map[string]bool)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			rfs.log().Warn("Skipping file that is not regular", "path", p)
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		filled[path.Dir(rel)] = true
+		if d.IsDir() {
+			dirs = append(dirs, rel)
+		} else {
+			paths = append(paths, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to walk directory: %v", err)
+	}
+
+	var emptyDirs []string
+	for _, dir := range dirs {
+		if !filled[dir] {
+			emptyDirs = append(emptyDirs, dir)
+		}
+	}
+	sort.Strings(paths)
+	sort.Strings(emptyDirs)
+	return paths, emptyDirs, nil
+}
+
+// directoryNames returns the names the files of a directory are stored
+// under, applying the filename and name policies, including to duplicates
+// among the files themselves, before any is stored
+func (rfs *RandomFS) directoryNames(paths []string) ([]string, error) {
+	names := make([]string, len(paths))
+	seen := make(map[string]bool, len(paths))
+	for i, relPath := range paths {
+		rewritten, err := rfs.applyFilenamePolicy(relPath)
+		if err != nil {
+			return nil, err
+		}
+		name := path.Base(filepath.ToSlash(rewritten))
+		if rfs.NamePolicy == NamesRejectDuplicates && seen[name] {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateName, name)
+		}
+		seen[name] = true
+		if err := rfs.checkNameAvailable(name, ""); err != nil {
+			return nil, err
+		}
+		names[i] = name
+	}
+	return names, nil
+}
+
+// storeDirectoryFile stores one file of a directory under name with its
+// pins deferred; callers hold the write lock
+func (rfs *RandomFS) storeDirectoryFile(ctx context.Context, root, relPath, name string) (rdURL *RandomURL, err error) {
+	ctx, span := rfs.startSpan(ctx, "randomfs.StoreFile",
+		attribute.String("randomfs.file.name", relPath))
+	defer func() { endSpan(span, err) }()
+
+	file, err := os.Open(filepath.Join(root, filepath.FromSlash(relPath)))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	contentType := detectReaderAtContentType(relPath, file, info.Size())
+	span.SetAttributes(attribute.Int64("randomfs.file.size", info.Size()))
+	return rfs.storeJournaled(ctx, name, &readerAtSource{r: file}, info.Size(), contentType, storeOptions{deferPins: true})
+}
+
+// pinStoredFiles pins the representations and blocks of files stored
+// with deferred pins in batches, as far as the PinPolicy asks
+func (rfs *RandomFS) pinStoredFiles(repHashes []string) error {
+	if !rfs.pinsRepresentations() {
+		return nil
+	}
+
+	var hashes []string
+	for _, repHash := range repHashes {
+		hashes = append(hashes, repHash)
+		if indexed, exists := rfs.index.get(repHash); exists && rfs.pinsBlocks() {
+			hashes = append(hashes, indexed.Blocks...)
+		}
+	}
+	return rfs.pinBatches(context.Background(), "add", uniqueHashes(hashes))
+}
+
+// storeDirectoryManifest stores, pins and indexes the manifest of a
+// directory whose files have been stored
+func (rfs *RandomFS) storeDirectoryManifest(name string, entries []DirectoryEntry, emptyDirs []string) (*RandomURL, error) {
+	manifest := &DirectoryManifest{
+		Type:             "directory",
+		Name:             name,
+		Entries:          entries,
+		EmptyDirectories: emptyDirs,
+		Version:          RepresentationVersion,
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal directory manifest: %v", err)
+	}
+
+	repHash, err := rfs.storeRepresentation(context.Background(), data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store directory manifest: %v", err)
+	}
+	if rfs.pinsRepresentations() {
+		if err := rfs.ipfsPin(context.Background(), "add", []string{repHash}); err != nil {
+			return nil, fmt.Errorf("failed to pin directory manifest: %v", err)
+		}
+	}
+
+	var size int64
+	for _, entry := range entries {
+		size += entry.Size
+	}
+
+	storedAt := time.Now()
+	if err := rfs.index.put(&IndexEntry{
+		RepHash:     repHash,
+		FileName:    name,
+		FileSize:    size,
+		ContentType: DirectoryContentType,
+		StoredAt:    storedAt,
+	}); err != nil {
+		return nil, fmt.Errorf("failed to index directory: %v", err)
+	}
+
+	return &RandomURL{
+		Scheme:    "rd",
+		Host:      "randomfs",
+		Version:   RepresentationVersion,
+		FileName:  name,
+		FileSize:  size,
+		Timestamp: storedAt.Unix(),
+		RepHash:   repHash,
+	}, nil
+}
+
+// deleteDirectoryFiles deletes the files of a directory store that failed;
+// callers hold the write lock
+func (rfs *RandomFS) deleteDirectoryFiles(entries []DirectoryEntry) {
+	for _, entry := range entries {
+		if entry.RepHash == "" {
+			continue
+		}
+		if err := rfs.deleteFile(entry.RepHash); err != nil {
+			rfs.log().Error("Failed to delete file after failed directory store", "path", entry.Path, "error", err)
+		}
+	}
+}
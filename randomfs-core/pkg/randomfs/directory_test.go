@@ -0,0 +1,271 @@
+package randomfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTree creates count small files spread over nested directories
+func writeTree(t *testing.T, count int) string {
+	t.Helper()
+	root := filepath.Join(t.TempDir(), "project")
+	for i := 0; i < count; i++ {
+		dir := filepath.Join(root, fmt.Sprintf("dir%d", i%4), fmt.Sprintf("sub%d", i%3))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		data := []byte(fmt.Sprintf("setting-%d = %d\n", i, i*i))
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file%02d.conf", i)), data, 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	return root
+}
+
+// storeTree stores root against a fresh slow IPFS mock and returns the
+// manifest, the elapsed time and the mock
+func storeTree(t *testing.T, root string, concurrency int) (*DirectoryManifest, time.Duration, *countingIPFS) {
+	t.Helper()
+	mock, server := newCountingIPFS(t)
+	rfs, err := NewRandomFS(server.URL, t.TempDir(), 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFS: %v", err)
+	}
+	t.Cleanup(func() { rfs.Close() })
+
+	mock.mutex.Lock()
+	mock.addDelay = 2 * time.Millisecond
+	mock.mutex.Unlock()
+
+	var progress []int
+	start := time.Now()
+	rdURL, err := rfs.StoreDirectoryWithOptions(root, DirectoryOptions{
+		Concurrency: concurrency,
+		Progress:    func(done, total int) { progress = append(progress, done) },
+	})
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatalf("StoreDirectoryWithOptions: %v", err)
+	}
+
+	manifest, err := rfs.GetDirectoryManifest(rdURL.RepHash)
+	if err != nil {
+		t.Fatalf("GetDirectoryManifest: %v", err)
+	}
+	if len(progress) != len(manifest.Entries) {
+		t.Fatalf("expected %d progress calls, got %d", len(manifest.Entries), len(progress))
+	}
+	for i, done := range progress {
+		if done != i+1 {
+			t.Fatalf("progress reported %v", progress)
+		}
+	}
+
+	for _, entry := range manifest.Entries {
+		data, _, err := rfs.RetrieveFile(entry.RepHash)
+		if err != nil {
+			t.Fatalf("RetrieveFile %s: %v", entry.Path, err)
+		}
+		want, _ := os.ReadFile(filepath.Join(root, filepath.FromSlash(entry.Path)))
+		if string(data) != string(want) {
+			t.Fatalf("%s: retrieved %q, want %q", entry.Path, data, want)
+		}
+	}
+	return manifest, elapsed, mock
+}
+
+func TestStoreDirectoryConcurrentMatchesSerial(t *testing.T) {
+	root := writeTree(t, 40)
+
+	serial, serialTime, _ := storeTree(t, root, 1)
+	concurrent, concurrentTime, mock := storeTree(t, root, 8)
+
+	if len(serial.Entries) != 40 || len(concurrent.Entries) != 40 {
+		t.Fatalf("expected 40 entries, got %d and %d", len(serial.Entries), len(concurrent.Entries))
+	}
+	// Randomizers differ between stores, so compare everything but the
+	// representation hashes
+	for i := range serial.Entries {
+		s, c := serial.Entries[i], concurrent.Entries[i]
+		if s.Path != c.Path || s.Size != c.Size {
+			t.Fatalf("entry %d differs: %+v vs %+v", i, s, c)
+		}
+		if i > 0 && serial.Entries[i-1].Path >= s.Path {
+			t.Fatalf("entries are not in path order: %s before %s", serial.Entries[i-1].Path, s.Path)
+		}
+	}
+	if serial.Name != "project" || concurrent.Name != "project" {
+		t.Fatalf("unexpected manifest names %q and %q", serial.Name, concurrent.Name)
+	}
+
+	if concurrentTime >= serialTime/2 {
+		t.Fatalf("concurrent store took %v, serial %v", concurrentTime, serialTime)
+	}
+
+	// Each file's representation, block and randomizer are pinned together
+	// in one batch of 100 and one of 20, plus the manifest
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	if mock.pinCalls != 3 {
+		t.Fatalf("expected 3 pin calls, got %d", mock.pinCalls)
+	}
+	for hash := range mock.blocks {
+		if !mock.pinned[hash] {
+			t.Fatalf("%s was not pinned", hash)
+		}
+	}
+}
+
+func TestStoreDirectoryRollsBackOnFailure(t *testing.T) {
+	root := writeTree(t, 10)
+	mock, server := newCountingIPFS(t)
+	rfs, err := NewRandomFS(server.URL, t.TempDir(), 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFS: %v", err)
+	}
+	defer rfs.Close()
+
+	// Each file adds a randomizer, a block and a representation; fail the
+	// representation of the last file so the other nine must be deleted
+	mock.mutex.Lock()
+	mock.failAddAfter = 9*3 + 2
+	mock.mutex.Unlock()
+
+	if _, err := rfs.StoreDirectoryWithOptions(root, DirectoryOptions{Concurrency: 1}); err == nil {
+		t.Fatal("expected the directory store to fail")
+	}
+	if files := rfs.ListFiles(); len(files) != 0 {
+		t.Fatalf("expected nothing indexed, got %d files", len(files))
+	}
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+	if len(mock.pinned) != 0 {
+		t.Fatalf("expected nothing pinned, got %d", len(mock.pinned))
+	}
+}
+
+func TestStoreDirectorySkipsSymlinks(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	root := writeTree(t, 3)
+	if err := os.Symlink("/etc/passwd", filepath.Join(root, "link")); err != nil {
+		t.Skipf("symlinks unsupported: %v", err)
+	}
+
+	rdURL, err := rfs.StoreDirectory(root)
+	if err != nil {
+		t.Fatalf("StoreDirectory: %v", err)
+	}
+	manifest, err := rfs.GetDirectoryManifest(rdURL.RepHash)
+	if err != nil {
+		t.Fatalf("GetDirectoryManifest: %v", err)
+	}
+	if len(manifest.Entries) != 3 {
+		t.Fatalf("expected 3 entries, got %+v", manifest.Entries)
+	}
+	if rdURL.FileName != "project" {
+		t.Fatalf("unexpected name %q", rdURL.FileName)
+	}
+}
+
+func TestStoreDirectoryRejectsDuplicateNames(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	rfs.NamePolicy = NamesRejectDuplicates
+
+	root := t.TempDir()
+	for _, dir := range []string{"a", "b"} {
+		os.MkdirAll(filepath.Join(root, dir), 0755)
+		os.WriteFile(filepath.Join(root, dir, "config.yaml"), []byte(dir), 0644)
+	}
+	if _, err := rfs.StoreDirectory(root); err == nil {
+		t.Fatal("expected duplicate names to be rejected")
+	}
+	if files := rfs.ListFiles(); len(files) != 0 {
+		t.Fatalf("expected nothing stored, got %d files", len(files))
+	}
+}
+
+func TestRetrieveDirectoryRecreatesTree(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	defer rfs.Close()
+	root := writeTree(t, 12)
+	large := make([]byte, 3*BlockSize+17)
+	rand.Read(large)
+	os.WriteFile(filepath.Join(root, "dir0", "large.bin"), large, 0644)
+	os.MkdirAll(filepath.Join(root, "empty", "nested"), 0755)
+	os.MkdirAll(filepath.Join(root, "links"), 0755)
+	os.Symlink("/etc/passwd", filepath.Join(root, "links", "passwd"))
+
+	rdURL, err := rfs.StoreDirectory(root)
+	if err != nil {
+		t.Fatalf("StoreDirectory: %v", err)
+	}
+	manifest, err := rfs.GetDirectoryManifest(rdURL.RepHash)
+	if err != nil {
+		t.Fatalf("GetDirectoryManifest: %v", err)
+	}
+	if got := strings.Join(manifest.EmptyDirectories, " "); got != "empty/nested links" {
+		t.Errorf("recorded empty directories %q", got)
+	}
+
+	dest := filepath.Join(t.TempDir(), "restored")
+	if err := rfs.RetrieveDirectory(rdURL.RepHash, dest); err != nil {
+		t.Fatalf("RetrieveDirectory: %v", err)
+	}
+	for _, entry := range manifest.Entries {
+		want, _ := os.ReadFile(filepath.Join(root, filepath.FromSlash(entry.Path)))
+		got, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(entry.Path)))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("%s restored with %d bytes, want %d: %v", entry.Path, len(got), len(want), err)
+		}
+	}
+	for _, dir := range []string{"empty/nested", "links"} {
+		if info, err := os.Stat(filepath.Join(dest, dir)); err != nil || !info.IsDir() {
+			t.Errorf("empty directory %s not restored: %v", dir, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(dest, "links", "passwd")); !os.IsNotExist(err) {
+		t.Errorf("symlink restored: %v", err)
+	}
+
+	// Files already present are not overwritten
+	if err := rfs.RetrieveDirectory(rdURL.RepHash, dest); err == nil {
+		t.Error("retrieved over existing files")
+	}
+}
+
+func TestRetrieveDirectoryRejectsEscapingPaths(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	defer rfs.Close()
+	file, err := rfs.StoreFile("payload", []byte("payload"), "")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+
+	for _, bad := range []string{"../escape", "/etc/cron.d/job", "a/../../escape", ""} {
+		data, _ := json.Marshal(&DirectoryManifest{
+			Type:    "directory",
+			Name:    "crafted",
+			Entries: []DirectoryEntry{{Path: bad, RepHash: file.RepHash, Size: 7}},
+			Version: RepresentationVersion,
+		})
+		repHash, err := rfs.storeRepresentation(context.Background(), data)
+		if err != nil {
+			t.Fatalf("storeRepresentation: %v", err)
+		}
+		dest := filepath.Join(t.TempDir(), "dest")
+		if err := rfs.RetrieveDirectory(repHash, dest); err == nil {
+			t.Errorf("retrieved a manifest with path %q", bad)
+		}
+		if _, err := os.Stat(dest); !os.IsNotExist(err) {
+			t.Errorf("path %q: destination created before the manifest was checked", bad)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package randomfs_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/TheEntropyCollective/randomfs-core/internal/ipfstest"
+	"github.com/TheEntropyCollective/randomfs-core/pkg/randomfs"
+)
+
+// newE2E returns an instance backed by the mock IPFS server ipfs
+func newE2E(t *testing.T, ipfs *ipfstest.Server) *randomfs.RandomFS {
+	t.Helper()
+	rfs, err := randomfs.NewRandomFS(ipfs.APIURL(), t.TempDir(), 64*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFS: %v", err)
+	}
+	t.Cleanup(func() { rfs.Close() })
+	return rfs
+}
+
+func randomData(t *testing.T, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("rand: %v", err)
+	}
+	return data
+}
+
+func TestEndToEndRoundTrip(t *testing.T) {
+	ipfs := ipfstest.NewServer(t)
+	rfs := newE2E(t, ipfs)
+
+	sizes := []int{
+		0,
+		1,
+		randomfs.NanoBlockSize - 1,
+		randomfs.NanoBlockSize,
+		3*randomfs.NanoBlockSize + 5,
+		100*1024 + 1, // first size stored in mini blocks
+		2*randomfs.MiniBlockSize + 7,
+	}
+	for _, size := range sizes {
+		data := randomData(t, size)
+		rdURL, err := rfs.StoreFile("file.bin", data, "application/octet-stream")
+		if err != nil {
+			t.Fatalf("StoreFile(%d bytes): %v", size, err)
+		}
+
+		// The URL handed to users must lead back to the same file
+		parsed, err := randomfs.ParseRandomURL(rdURL.String())
+		if err != nil {
+			t.Fatalf("ParseRandomURL(%s): %v", rdURL, err)
+		}
+		if *parsed != *rdURL {
+			t.Fatalf("URL did not round-trip: %+v != %+v", parsed, rdURL)
+		}
+
+		got, rep, err := rfs.RetrieveFile(parsed.RepHash)
+		if err != nil {
+			t.Fatalf("RetrieveFile(%d bytes): %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%d byte file did not round-trip", size)
+		}
+		if rep.FileSize != int64(size) {
+			t.Fatalf("expected size %d, got %d", size, rep.FileSize)
+		}
+		if !ipfs.Pinned(rdURL.RepHash) {
+			t.Fatalf("representation of the %d byte file is not pinned", size)
+		}
+		for _, hash := range append(rep.BlockHashes, rep.RandomizerHashes...) {
+			if !ipfs.Pinned(hash) {
+				t.Fatalf("block %s of the %d byte file is not pinned", hash, size)
+			}
+		}
+	}
+}
+
+func TestEndToEndRetrieveThroughAnotherInstance(t *testing.T) {
+	ipfs := ipfstest.NewServer(t)
+	writer := newE2E(t, ipfs)
+	data := randomData(t, 5*randomfs.NanoBlockSize)
+	rdURL, err := writer.StoreFile("shared.bin", data, "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+
+	// A second node with an empty cache and data directory resolves the
+	// URL from IPFS alone
+	reader := newE2E(t, ipfs)
+	got, _, err := reader.RetrieveFile(rdURL.RepHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("retrieved data differs")
+	}
+	if cats := ipfs.TotalCats(); cats != 11 {
+		t.Fatalf("expected 11 cats (representation and 10 blocks), got %d", cats)
+	}
+}
+
+func TestEndToEndCacheHitsAndMisses(t *testing.T) {
+	ipfs := ipfstest.NewServer(t)
+	writer := newE2E(t, ipfs)
+	rdURL, err := writer.StoreFile("cached.bin", randomData(t, 2*randomfs.NanoBlockSize), "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+
+	reader := newE2E(t, ipfs)
+	if _, _, err := reader.RetrieveFile(rdURL.RepHash); err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+	first := reader.GetStats()
+	if first.CacheHits != 0 || first.CacheMisses != 4 {
+		t.Fatalf("expected 4 misses on a cold cache, got %d hits and %d misses", first.CacheHits, first.CacheMisses)
+	}
+
+	cats := ipfs.TotalCats()
+	if _, _, err := reader.RetrieveFile(rdURL.RepHash); err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+	second := reader.GetStats()
+	if second.CacheHits-first.CacheHits != 4 || second.CacheMisses != first.CacheMisses {
+		t.Fatalf("expected 4 hits on a warm cache, got %+v", second)
+	}
+	// The representation comes from the parsed representation cache
+	if extra := ipfs.TotalCats() - cats; extra != 0 {
+		t.Fatalf("expected no backend fetch on a warm cache, got %d", extra)
+	}
+	if second.ParsedRepresentationHits != 1 || second.ParsedRepresentationMisses != 1 {
+		t.Fatalf("expected 1 parsed representation hit and miss, got %+v", second)
+	}
+}
+
+func TestEndToEndErrorPaths(t *testing.T) {
+	t.Run("unknown representation", func(t *testing.T) {
+		rfs := newE2E(t, ipfstest.NewServer(t))
+		if _, _, err := rfs.RetrieveFile("QmUnknownRepresentationHashUnknownRepresent"); err == nil {
+			t.Fatal("expected an error for an unknown representation")
+		}
+	})
+
+	t.Run("daemon unreachable", func(t *testing.T) {
+		ipfs := ipfstest.NewServer(t)
+		ipfs.Close()
+		if _, err := randomfs.NewRandomFS(ipfs.APIURL(), t.TempDir(), 1024); err == nil {
+			t.Fatal("expected an error when IPFS is unreachable")
+		}
+	})
+
+	t.Run("add fails", func(t *testing.T) {
+		ipfs := ipfstest.NewServer(t)
+		rfs := newE2E(t, ipfs)
+		ipfs.FailAdds(true)
+		if _, err := rfs.StoreFile("lost.bin", randomData(t, 100), "application/octet-stream"); err == nil {
+			t.Fatal("expected the store to fail")
+		}
+		if files := rfs.ListFiles(); len(files) != 0 {
+			t.Fatalf("failed store was indexed: %+v", files)
+		}
+	})
+
+	t.Run("corrupted block", func(t *testing.T) {
+		ipfs := ipfstest.NewServer(t)
+		rdURL, err := newE2E(t, ipfs).StoreFile("file.bin", randomData(t, 100), "application/octet-stream")
+		if err != nil {
+			t.Fatalf("StoreFile: %v", err)
+		}
+		reader := newE2E(t, ipfs)
+		estimate, err := reader.EstimateRetrieval(rdURL.RepHash)
+		if err != nil || estimate.Blocks != 2 {
+			t.Fatalf("EstimateRetrieval: %+v, %v", estimate, err)
+		}
+
+		ipfs.Corrupt(true)
+		if _, _, err := reader.RetrieveFile(rdURL.RepHash); err == nil {
+			t.Fatal("expected corrupted content to be rejected")
+		}
+	})
+
+	t.Run("block garbage collected", func(t *testing.T) {
+		ipfs := ipfstest.NewServer(t)
+		writer := newE2E(t, ipfs)
+		rdURL, err := writer.StoreFile("file.bin", randomData(t, 100), "application/octet-stream")
+		if err != nil {
+			t.Fatalf("StoreFile: %v", err)
+		}
+		_, rep, err := writer.RetrieveFile(rdURL.RepHash)
+		if err != nil {
+			t.Fatalf("RetrieveFile: %v", err)
+		}
+
+		ipfs.Remove(rep.BlockHashes[0])
+		if _, _, err := newE2E(t, ipfs).RetrieveFile(rdURL.RepHash); err == nil {
+			t.Fatal("expected retrieval to fail once a block is gone")
+		}
+	})
+
+	t.Run("backend unavailable", func(t *testing.T) {
+		ipfs := ipfstest.NewServer(t)
+		data := randomData(t, 100)
+		rdURL, err := newE2E(t, ipfs).StoreFile("file.bin", data, "application/octet-stream")
+		if err != nil {
+			t.Fatalf("StoreFile: %v", err)
+		}
+		reader := newE2E(t, ipfs)
+		estimate, _ := reader.EstimateRetrieval(rdURL.RepHash)
+		if estimate.BackendFetches != 2 {
+			t.Fatalf("unexpected estimate %+v", estimate)
+		}
+
+		ipfs.FailCats(true)
+		_, _, err = reader.RetrieveFile(rdURL.RepHash)
+		if err == nil {
+			t.Fatal("expected retrieval to fail while IPFS cannot serve blocks")
+		}
+		ipfs.FailCats(false)
+		if got, _, err := reader.RetrieveFile(rdURL.RepHash); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("expected retrieval to recover, got %v", err)
+		}
+	})
+
+	t.Run("read-only store", func(t *testing.T) {
+		ipfs := ipfstest.NewServer(t)
+		dataDir := t.TempDir()
+		writer, err := randomfs.NewRandomFS(ipfs.APIURL(), dataDir, 1024)
+		if err != nil {
+			t.Fatalf("NewRandomFS: %v", err)
+		}
+		writer.Close()
+
+		reader, err := randomfs.NewReadOnlyRandomFS(ipfs.APIURL(), dataDir, 1024)
+		if err != nil {
+			t.Fatalf("NewReadOnlyRandomFS: %v", err)
+		}
+		defer reader.Close()
+		if _, err := reader.StoreFile("x", []byte("x"), "text/plain"); !errors.Is(err, randomfs.ErrReadOnly) {
+			t.Fatalf("expected ErrReadOnly, got %v", err)
+		}
+	})
+}
+
+func TestParseRandomURL(t *testing.T) {
+	const repHash = "QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG"
+	const hexHash = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	valid := []struct {
+		name string
+		raw  string
+		want randomfs.RandomURL
+	}{
+		{"plain", "rd://randomfs/v4/1234/report.pdf/1700000000/" + repHash,
+			randomfs.RandomURL{Scheme: "rd", Host: "randomfs", Version: "v4", FileSize: 1234, FileName: "report.pdf", Timestamp: 1700000000, RepHash: repHash}},
+		{"spaces", "rd://randomfs/v4/10/annual%20report%202024.pdf/1/" + repHash,
+			randomfs.RandomURL{Scheme: "rd", Host: "randomfs", Version: "v4", FileSize: 10, FileName: "annual report 2024.pdf", Timestamp: 1, RepHash: repHash}},
+		{"unicode", "rd://randomfs/v4/10/%E6%97%A5%E8%A8%98%20%C3%A9t%C3%A9.txt/1/" + repHash,
+			randomfs.RandomURL{Scheme: "rd", Host: "randomfs", Version: "v4", FileSize: 10, FileName: "日記 été.txt", Timestamp: 1, RepHash: repHash}},
+		{"escaped slash", "rd://randomfs/v4/10/a%2Fb.txt/1/" + repHash,
+			randomfs.RandomURL{Scheme: "rd", Host: "randomfs", Version: "v4", FileSize: 10, FileName: "a/b.txt", Timestamp: 1, RepHash: repHash}},
+		{"hex hash", "rd://randomfs/v4/0/empty.txt/0/" + hexHash,
+			randomfs.RandomURL{Scheme: "rd", Host: "randomfs", Version: "v4", FileSize: 0, FileName: "empty.txt", Timestamp: 0, RepHash: hexHash}},
+		{"encrypted", "rd://randomfs/v4/5/a.txt/42/" + repHash + "/encrypted",
+			randomfs.RandomURL{Scheme: "rd", Host: "randomfs", Version: "v4", FileSize: 5, FileName: "a.txt", Timestamp: 42, RepHash: repHash, Encrypted: true}},
+	}
+	for _, tc := range valid {
+		t.Run(tc.name, func(t *testing.T) {
+			rdURL, err := randomfs.ParseRandomURL(tc.raw)
+			if err != nil {
+				t.Fatalf("ParseRandomURL(%q): %v", tc.raw, err)
+			}
+			if *rdURL != tc.want {
+				t.Fatalf("expected %+v, got %+v", tc.want, *rdURL)
+			}
+			// Formatting escapes the filename again
+			if again, err := randomfs.ParseRandomURL(rdURL.String()); err != nil || *again != tc.want {
+				t.Fatalf("round trip through %q gave %+v, %v", rdURL.String(), again, err)
+			}
+		})
+	}
+
+	invalid := []struct {
+		name string
+		raw  string
+		// field is a word the error must contain
+		field string
+	}{
+		{"empty", "", "scheme"},
+		{"wrong scheme", "http://randomfs/v4/1234/report.pdf/1700000000/" + repHash, "scheme"},
+		{"scheme only", "rd://", "host"},
+		{"missing host", "rd:///v4/1234/report.pdf/1700000000/" + repHash, "host"},
+		{"no path", "rd://randomfs", "segments"},
+		{"too few segments", "rd://randomfs/v4/1234", "segments"},
+		{"four segments", "rd://randomfs/v4/1234/report.pdf/1700000000", "segments"},
+		{"too many segments", "rd://randomfs/v4/1234/report.pdf/1700000000/" + repHash + "/encrypted/x", "segments"},
+		{"unknown suffix", "rd://randomfs/v4/1234/report.pdf/1700000000/" + repHash + "/signed", "segment"},
+		{"missing version", "rd://randomfs//1234/report.pdf/1700000000/" + repHash, "version"},
+		{"bad size", "rd://randomfs/v4/big/report.pdf/1700000000/" + repHash, "size"},
+		{"negative size", "rd://randomfs/v4/-1/report.pdf/1700000000/" + repHash, "size"},
+		{"missing filename", "rd://randomfs/v4/1234//1700000000/" + repHash, "filename"},
+		{"bad filename escape", "rd://randomfs/v4/1234/report%zz.pdf/1700000000/" + repHash, "filename"},
+		{"bad timestamp", "rd://randomfs/v4/1234/report.pdf/yesterday/" + repHash, "timestamp"},
+		{"missing hash", "rd://randomfs/v4/1234/report.pdf/1700000000/", "representation hash"},
+		{"hash not a CID", "rd://randomfs/v4/1234/report.pdf/1700000000/QmRepHash", "representation hash"},
+		{"hash path traversal", "rd://randomfs/v4/1234/report.pdf/1700000000/..", "representation hash"},
+	}
+	for _, tc := range invalid {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := randomfs.ParseRandomURL(tc.raw)
+			if !errors.Is(err, randomfs.ErrInvalidURL) {
+				t.Fatalf("ParseRandomURL(%q) returned %v, want ErrInvalidURL", tc.raw, err)
+			}
+			if !strings.Contains(err.Error(), tc.field) {
+				t.Errorf("error %q does not mention the %s", err, tc.field)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package randomfs
+
+import (
+	"context"
+	"path/filepath"
+)
+
+// RetrievalEstimate describes how much of a file would come from the cache
+// and how much from the backend if it were retrieved now
+type RetrievalEstimate struct {
+	// Blocks is the number of distinct blocks, data and randomizers,
+	// needed to reconstruct the file
+	Blocks int `json:"blocks"`
+	// Cached is the number of those blocks currently in the cache
+	Cached int `json:"cached"`
+	// BackendFetches is the number of blocks that would be fetched
+	BackendFetches int `json:"backend_fetches"`
+	// BackendBytes is the amount of block data those fetches transfer
+	BackendBytes int64 `json:"backend_bytes"`
+}
+
+// EstimateRetrieval reads the representation of repHash and probes the
+// cache for its blocks without fetching any block data or counting cache
+// accesses
+func (rfs *RandomFS) EstimateRetrieval(repHash string) (*RetrievalEstimate, error) {
+	rfs.mutex.RLock()
+	defer rfs.mutex.RUnlock()
+
+	rep, err := rfs.loadRepresentation(repHash)
+	if err != nil {
+		return nil, err
+	}
+
+	estimate := &RetrievalEstimate{}
+	for _, hash := range uniqueHashes(representationBlocks(rep)) {
+		estimate.Blocks++
+		if rfs.cache.Contains(hash) {
+			estimate.Cached++
+		}
+	}
+	estimate.BackendFetches = estimate.Blocks - estimate.Cached
+	estimate.BackendBytes = int64(estimate.BackendFetches) * int64(rep.BlockSize)
+	return estimate, nil
+}
+
+// StoreEstimate is the projected cost of storing a file, as returned by
+// EstimateStore. The embedded StoreResult counts what the store would
+// write, in the same terms as StoreFileWithResult.
+type StoreEstimate struct {
+	StoreResult
+	// BlockSize is the size of the blocks the file would be split into
+	BlockSize int `json:"block_size"`
+	// BlocksSparse counts the constant blocks that would be recorded as
+	// sparse markers instead of being stored
+	BlocksSparse int64 `json:"blocks_sparse"`
+	// BytesReused is the size of the existing blocks the file would refer
+	// to instead of storing new ones
+	BytesReused int64 `json:"bytes_reused"`
+	// Deduplicated is set when the content is already stored and the
+	// store would reuse every block of that file
+	Deduplicated bool `json:"deduplicated"`
+}
+
+// EstimateStore reports what StoreFile would write for a file without
+// storing anything. It compresses and splits the file, looks it up among
+// the stored content and asks the randomizer policy for every block as a
+// store would, against the current randomizer pool, but writes no block,
+// representation or index entry and leaves the pool as it is. Fresh
+// randomizers count as new blocks; pooled ones the policy picks count as
+// reused, assuming they are still stored.
+func (rfs *RandomFS) EstimateStore(filename string, data []byte, contentType string) (StoreEstimate, error) {
+	var estimate StoreEstimate
+	if rfs.readOnly {
+		return estimate, ErrReadOnly
+	}
+	filename, err := rfs.applyFilenamePolicy(filename)
+	if err != nil {
+		return estimate, err
+	}
+	src, size, contentType, opts, err := rfs.prepareBytes(filename, data, contentType, storeOptions{})
+	if err != nil {
+		return estimate, err
+	}
+
+	rfs.mutex.RLock()
+	defer rfs.mutex.RUnlock()
+
+	if err := rfs.checkNameAvailable(filepath.Base(filename), ""); err != nil {
+		return estimate, err
+	}
+	if dup, ok := rfs.findDuplicate(context.Background(), contentType, opts); ok {
+		blocks := int64(len(representationBlocks(dup.rep)))
+		estimate.StoreResult = StoreResult{BlocksTotal: blocks, BlocksReused: blocks}
+		estimate.BlockSize = dup.rep.BlockSize
+		estimate.BytesReused = blocks * int64(dup.rep.BlockSize)
+		estimate.Deduplicated = true
+		return estimate, nil
+	}
+
+	hasher, err := newFileHasher(rfs.FileHashAlgorithm)
+	if err != nil {
+		return estimate, err
+	}
+	blockSize := rfs.selectBlockSize(size)
+	if err := src.open(hasher, size, blockSize); err != nil {
+		return estimate, err
+	}
+	defer src.close()
+
+	policy := rfs.storePolicy(contentType, opts)
+	rctx := RandomizerContext{
+		FileName:  filepath.Base(filename),
+		FileSize:  size,
+		BlockSize: blockSize,
+		dryRun:    true,
+	}
+	estimate.BlockSize = blockSize
+
+	batchSize := max(src.batch(max(rfs.StoreWorkers, 1)), 1)
+	for index := 0; ; {
+		batch, err := rfs.randomizeBatch(src, policy, rctx, index, batchSize)
+		if err != nil {
+			return estimate, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		index += len(batch)
+		for _, pending := range batch {
+			estimate.countPending(pending, rfs.TwoRandomizers)
+		}
+	}
+
+	estimate.BytesStored = estimate.BlocksNew * int64(blockSize)
+	estimate.BytesReused = estimate.BlocksReused * int64(blockSize)
+	return estimate, nil
+}
+
+// countPending adds a randomized block and its randomizers to the estimate
+func (e *StoreEstimate) countPending(pending *pendingBlock, twoRandomizers bool) {
+	if pending.sparse != "" {
+		e.BlocksSparse++
+		return
+	}
+	hashes := []string{pending.randomizerHash}
+	if twoRandomizers {
+		hashes = append(hashes, pending.secondHash)
+	}
+	e.BlocksTotal += int64(1 + len(hashes))
+	e.BlocksNew++
+	for _, hash := range hashes {
+		if hash != "" {
+			e.BlocksReused++
+		} else {
+			e.BlocksNew++
+		}
+	}
+}
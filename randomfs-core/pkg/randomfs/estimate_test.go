@@ -0,0 +1,123 @@
+package randomfs
+
+import (
+	"crypto/rand"
+	"io"
+	"slices"
+	"testing"
+)
+
+func TestEstimateRetrievalCountsCachedBlocks(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	_, repHash := storeRandomFile(t, rfs, 10*NanoBlockSize)
+	rfs.cache.Clear()
+
+	estimate, err := rfs.EstimateRetrieval(repHash)
+	if err != nil {
+		t.Fatalf("EstimateRetrieval: %v", err)
+	}
+	if estimate.Blocks != 20 || estimate.Cached != 0 || estimate.BackendFetches != 20 {
+		t.Fatalf("unexpected cold estimate %+v", estimate)
+	}
+	if estimate.BackendBytes != 20*NanoBlockSize {
+		t.Fatalf("expected %d backend bytes, got %d", 20*NanoBlockSize, estimate.BackendBytes)
+	}
+
+	// Warm the first three data blocks and their randomizers
+	stream, err := rfs.OpenFileStream(repHash)
+	if err != nil {
+		t.Fatalf("OpenFileStream: %v", err)
+	}
+	if _, err := io.CopyN(io.Discard, stream, 3*NanoBlockSize); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	before := rfs.GetStats()
+	hits, misses := rfs.cache.hits.Load(), rfs.cache.misses.Load()
+	estimate, err = rfs.EstimateRetrieval(repHash)
+	if err != nil {
+		t.Fatalf("EstimateRetrieval: %v", err)
+	}
+	if estimate.Cached != 6 || estimate.BackendFetches != 14 {
+		t.Fatalf("expected 6 cached and 14 to fetch, got %+v", estimate)
+	}
+
+	after := rfs.GetStats()
+	if after.CacheHits != before.CacheHits || after.CacheMisses != before.CacheMisses {
+		t.Fatal("estimating counted cache accesses")
+	}
+	if rfs.cache.hits.Load() != hits || rfs.cache.misses.Load() != misses {
+		t.Fatal("estimating touched the cache tuner counters")
+	}
+}
+
+// checkEstimate estimates a store of data, checks it wrote nothing, then
+// stores data and checks the estimate matched
+func checkEstimate(t *testing.T, rfs *RandomFS, store *MemoryBlockStore, name string, data []byte) StoreEstimate {
+	t.Helper()
+	blocks := store.Len()
+	pool := rfs.randomizers.candidates(rfs.selectBlockSize(int64(len(data))))
+	estimate, err := rfs.EstimateStore(name, data, "application/octet-stream")
+	if err != nil {
+		t.Fatalf("EstimateStore: %v", err)
+	}
+	if store.Len() != blocks {
+		t.Fatalf("estimate wrote %d blocks", store.Len()-blocks)
+	}
+	if after := rfs.randomizers.candidates(rfs.selectBlockSize(int64(len(data)))); !slices.Equal(after, pool) {
+		t.Fatalf("estimate changed the randomizer pool from %v to %v", pool, after)
+	}
+
+	_, result, err := rfs.StoreFileWithResult(name, data, "application/octet-stream", "")
+	if err != nil {
+		t.Fatalf("StoreFileWithResult: %v", err)
+	}
+	if estimate.StoreResult != result {
+		t.Fatalf("estimated %+v, stored %+v", estimate.StoreResult, result)
+	}
+	return estimate
+}
+
+func TestEstimateStoreMatchesStore(t *testing.T) {
+	store := NewMemoryBlockStore()
+	rfs, err := NewRandomFSWithConfig(Config{BlockStore: store, DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewRandomFSWithConfig: %v", err)
+	}
+	defer rfs.Close()
+	rfs.SparseBlocks = true
+	rfs.TwoRandomizers = true
+
+	// Fresh randomizers, with one zero block stored sparse
+	data := make([]byte, 4*NanoBlockSize)
+	rand.Read(data[:3*NanoBlockSize])
+	estimate := checkEstimate(t, rfs, store, "first.bin", data)
+	if estimate.BlocksSparse != 1 || estimate.BlocksNew != 9 || estimate.BlocksReused != 0 || estimate.Deduplicated {
+		t.Fatalf("first store estimated as %+v", estimate)
+	}
+
+	// The pool now holds the randomizers of the first file
+	other := make([]byte, 2*NanoBlockSize)
+	rand.Read(other)
+	estimate = checkEstimate(t, rfs, store, "second.bin", other)
+	if estimate.BlocksNew != 2 || estimate.BlocksReused != 4 || estimate.BytesReused != 4*NanoBlockSize {
+		t.Fatalf("second store estimated as %+v", estimate)
+	}
+
+	// Content already stored reuses every block
+	estimate = checkEstimate(t, rfs, store, "first.bin", data)
+	if !estimate.Deduplicated || estimate.BlocksNew != 0 || estimate.BlocksReused != 9 {
+		t.Fatalf("duplicate store estimated as %+v", estimate)
+	}
+}
+
+func TestEstimateStoreReadOnly(t *testing.T) {
+	rfs, err := NewRandomFSWithConfig(Config{DataDir: t.TempDir(), ReadOnly: true})
+	if err != nil {
+		t.Fatalf("NewRandomFSWithConfig: %v", err)
+	}
+	defer rfs.Close()
+	if _, err := rfs.EstimateStore("file.txt", []byte("data"), ""); err != ErrReadOnly {
+		t.Errorf("EstimateStore on a read-only instance returned %v", err)
+	}
+}
@@ -0,0 +1,421 @@
+package randomfs
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Names of the fixed entries of an export archive
+const (
+	archiveIndexName    = "index.json"
+	archiveManifestName = "manifest.json"
+	archiveObjectPrefix = "objects/"
+)
+
+// ErrCorruptArchive is returned by Import for an archive whose contents do
+// not match its manifest
+var ErrCorruptArchive = errors.New("export archive is corrupt")
+
+// ExportOptions tunes Export
+type ExportOptions struct {
+	// CheckpointInterval is the number of objects written between
+	// checkpoints; values below one checkpoint after every object
+	CheckpointInterval int
+	// Progress, if set, is called after each object is written with the
+	// number of objects written so far and the total
+	Progress func(done, total int)
+}
+
+// ExportResult reports what Export wrote
+type ExportResult struct {
+	Files   int   `json:"files"`
+	Objects int   `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+	// ResumedFrom is the number of objects an interrupted export had
+	// already written
+	ResumedFrom int `json:"resumed_from"`
+}
+
+// ImportResult reports what Import added
+type ImportResult struct {
+	Files   int `json:"files"`
+	Objects int `json:"objects"`
+}
+
+// archiveManifest lists every entry of an export archive but itself
+type archiveManifest struct {
+	Version string         `json:"version"`
+	Entries []archiveEntry `json:"entries"`
+}
+
+// archiveEntry records the size and SHA-256 of one archive entry
+type archiveEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// exportCheckpoint records how far an export got. Plan identifies the
+// dataset being exported, so a checkpoint is only resumed for the same one.
+type exportCheckpoint struct {
+	Plan    string         `json:"plan"`
+	Written int            `json:"written"`
+	Offset  int64          `json:"offset"`
+	Entries []archiveEntry `json:"entries"`
+}
+
+// Export writes every indexed file, its representation and its blocks to
+// a tar archive at path, followed by a manifest of checksums that Import
+// verifies. Progress is checkpointed next to the archive, so an export that
+// fails or is interrupted resumes where it stopped when run again for an
+// unchanged dataset; the result is byte-identical to an uninterrupted run.
+func (rfs *RandomFS) Export(path string, opts ExportOptions) (*ExportResult, error) {
+	rfs.mutex.RLock()
+	defer rfs.mutex.RUnlock()
+
+	var entries []*IndexEntry
+	for _, entry := range rfs.index.list() {
+		if !entry.Deleted() {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].RepHash < entries[j].RepHash })
+
+	indexData, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal index: %v", err)
+	}
+	plan := sha256.Sum256(indexData)
+
+	reps := make(map[string]bool, len(entries))
+	var objects []string
+	for _, entry := range entries {
+		reps[entry.RepHash] = true
+		objects = append(objects, entry.RepHash)
+		objects = append(objects, entry.Blocks...)
+	}
+	objects = uniqueHashes(objects)
+	sort.Strings(objects)
+
+	checkpointPath := path + ".checkpoint"
+	checkpoint := &exportCheckpoint{Plan: hex.EncodeToString(plan[:])}
+	if previous, err := readExportCheckpoint(checkpointPath); err != nil {
+		rfs.log().Warn("Ignoring export checkpoint", "error", err)
+	} else if previous != nil && previous.Plan == checkpoint.Plan {
+		checkpoint = previous
+	}
+	result := &ExportResult{Files: len(entries), Objects: len(objects), ResumedFrom: checkpoint.Written}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %v", err)
+	}
+	defer file.Close()
+	if err := file.Truncate(checkpoint.Offset); err != nil {
+		return nil, fmt.Errorf("failed to resume archive: %v", err)
+	}
+	if _, err := file.Seek(checkpoint.Offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to resume archive: %v", err)
+	}
+
+	counter := &countingWriter{w: file, n: checkpoint.Offset}
+	archive := tar.NewWriter(counter)
+	// writeEntry adds one entry and records it for the manifest
+	writeEntry := func(name string, data []byte) error {
+		sum := sha256.Sum256(data)
+		if err := writeArchiveEntry(archive, name, data); err != nil {
+			return err
+		}
+		checkpoint.Entries = append(checkpoint.Entries, archiveEntry{Path: name, Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])})
+		checkpoint.Offset = counter.n
+		return nil
+	}
+
+	if checkpoint.Offset == 0 {
+		if err := writeEntry(archiveIndexName, indexData); err != nil {
+			return nil, err
+		}
+	}
+
+	interval := max(opts.CheckpointInterval, 1)
+	for checkpoint.Written < len(objects) {
+		ref := objects[checkpoint.Written]
+		var data []byte
+		if reps[ref] {
+			data, err = rfs.retrieveRepresentation(context.Background(), ref)
+		} else {
+			data, err = rfs.retrieveBlock(ref, 0)
+		}
+		if err == nil {
+			err = writeEntry(archiveObjectPrefix+ref, data)
+		}
+		if err != nil {
+			// Keep what was written so the next run resumes after it
+			if saveErr := writeExportCheckpoint(checkpointPath, checkpoint); saveErr != nil {
+				rfs.log().Error("Failed to save export checkpoint", "error", saveErr)
+			}
+			return nil, fmt.Errorf("failed to export %s: %v", ref, err)
+		}
+
+		checkpoint.Written++
+		if checkpoint.Written%interval == 0 {
+			if err := writeExportCheckpoint(checkpointPath, checkpoint); err != nil {
+				return nil, err
+			}
+		}
+		if opts.Progress != nil {
+			opts.Progress(checkpoint.Written, len(objects))
+		}
+	}
+
+	manifestData, err := json.MarshalIndent(archiveManifest{Version: RepresentationVersion, Entries: checkpoint.Entries}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal archive manifest: %v", err)
+	}
+	if err := writeArchiveEntry(archive, archiveManifestName, manifestData); err != nil {
+		return nil, err
+	}
+	if err := archive.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish archive: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		return nil, fmt.Errorf("failed to finish archive: %v", err)
+	}
+	if err := os.Remove(checkpointPath); err != nil && !os.IsNotExist(err) {
+		rfs.log().Error("Failed to remove export checkpoint", "error", err)
+	}
+
+	result.Bytes = counter.n
+	rfs.log().Info("Exported files", "files", result.Files, "objects", result.Objects, "bytes", result.Bytes, "path", path)
+	return result, nil
+}
+
+// Import verifies the archive at path against its manifest and then adds
+// its objects to the backend and its files to the index. Nothing is added
+// from an archive that fails verification. Files already indexed are kept.
+func (rfs *RandomFS) Import(path string) (*ImportResult, error) {
+	if rfs.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	entries, err := verifyArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	reps := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		reps[entry.RepHash] = true
+	}
+
+	rfs.mutex.Lock()
+	defer rfs.mutex.Unlock()
+
+	result := &ImportResult{}
+	var stored []string
+	err = readArchive(path, func(name string, data []byte) error {
+		ref, isObject := strings.CutPrefix(name, archiveObjectPrefix)
+		if !isObject {
+			return nil
+		}
+		if err := rfs.importObject(ref, data, reps[ref]); err != nil {
+			return err
+		}
+		stored = append(stored, ref)
+		result.Objects++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if rfs.useIPFS {
+		if err := rfs.pinBatches(context.Background(), "add", stored); err != nil {
+			return nil, fmt.Errorf("failed to pin imported objects: %v", err)
+		}
+	}
+
+	for _, entry := range entries {
+		if _, exists := rfs.index.get(entry.RepHash); exists {
+			continue
+		}
+		if err := rfs.index.put(entry); err != nil {
+			return nil, fmt.Errorf("failed to index %s: %v", entry.RepHash, err)
+		}
+		result.Files++
+	}
+
+	rfs.log().Info("Imported files", "files", result.Files, "objects", result.Objects, "path", path)
+	return result, nil
+}
+
+// importObject stores one archived object and checks the backend gave it
+// the address it was exported under
+func (rfs *RandomFS) importObject(ref string, data []byte, isRep bool) error {
+	key, err := rfs.backendKey(ref)
+	if err != nil {
+		return err
+	}
+
+	var stored string
+	if isRep {
+		stored, err = rfs.storeRepresentation(context.Background(), data)
+	} else {
+		stored, err = rfs.putBlock(context.Background(), data, refBlockKey(key, data))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to import %s: %v", ref, err)
+	}
+	if stored != key && stored != ref {
+		return fmt.Errorf("failed to import %s: backend stored it as %s", ref, stored)
+	}
+	return nil
+}
+
+// verifyArchive checks every entry of the archive at path against its
+// manifest and returns the archived index
+func verifyArchive(path string) ([]*IndexEntry, error) {
+	seen := make(map[string]archiveEntry)
+	var manifest *archiveManifest
+	var indexData []byte
+
+	err := readArchive(path, func(name string, data []byte) error {
+		if name == archiveManifestName {
+			manifest = &archiveManifest{}
+			if err := json.Unmarshal(data, manifest); err != nil {
+				return fmt.Errorf("%w: unreadable manifest: %v", ErrCorruptArchive, err)
+			}
+			return nil
+		}
+		if _, duplicate := seen[name]; duplicate {
+			return fmt.Errorf("%w: duplicate entry %s", ErrCorruptArchive, name)
+		}
+		sum := sha256.Sum256(data)
+		seen[name] = archiveEntry{Path: name, Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])}
+		if name == archiveIndexName {
+			indexData = data
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, ErrCorruptArchive) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %v", ErrCorruptArchive, err)
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("%w: no manifest", ErrCorruptArchive)
+	}
+
+	for _, want := range manifest.Entries {
+		got, exists := seen[want.Path]
+		if !exists {
+			return nil, fmt.Errorf("%w: %s is missing", ErrCorruptArchive, want.Path)
+		}
+		if got != want {
+			return nil, fmt.Errorf("%w: %s does not match its checksum", ErrCorruptArchive, want.Path)
+		}
+		delete(seen, want.Path)
+	}
+	for name := range seen {
+		return nil, fmt.Errorf("%w: %s is not in the manifest", ErrCorruptArchive, name)
+	}
+
+	var entries []*IndexEntry
+	if err := json.Unmarshal(indexData, &entries); err != nil {
+		return nil, fmt.Errorf("%w: unreadable index: %v", ErrCorruptArchive, err)
+	}
+	return entries, nil
+}
+
+// readArchive calls fn with the name and contents of each entry of the
+// archive at path, in order
+func readArchive(path string, fn func(name string, data []byte) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %v", err)
+	}
+	defer file.Close()
+
+	archive := tar.NewReader(file)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %v", err)
+		}
+		data, err := io.ReadAll(archive)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", header.Name, err)
+		}
+		if err := fn(header.Name, data); err != nil {
+			return err
+		}
+	}
+}
+
+// writeArchiveEntry writes one archive entry with fixed metadata, so the
+// same data always produces the same bytes, and flushes its padding
+func writeArchiveEntry(archive *tar.Writer, name string, data []byte) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(data)),
+		Mode:     0644,
+		ModTime:  time.Unix(0, 0),
+		Format:   tar.FormatUSTAR,
+	}
+	if err := archive.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	if _, err := archive.Write(data); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	if err := archive.Flush(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	return nil
+}
+
+// readExportCheckpoint loads the checkpoint at path, or nil if none exists
+func readExportCheckpoint(path string) (*exportCheckpoint, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read export checkpoint: %v", err)
+	}
+	var checkpoint exportCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("failed to parse export checkpoint: %v", err)
+	}
+	return &checkpoint, nil
+}
+
+// writeExportCheckpoint saves checkpoint to path atomically
+func writeExportCheckpoint(path string, checkpoint *exportCheckpoint) error {
+	data, err := json.Marshal(checkpoint)
+	if err != nil {
+		return fmt.Errorf("failed to marshal export checkpoint: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write export checkpoint: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write export checkpoint: %v", err)
+	}
+	return nil
+}
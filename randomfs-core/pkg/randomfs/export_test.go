@@ -0,0 +1,168 @@
+package randomfs
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// storeExportFiles stores a few multi-block files and returns their
+// contents by representation hash
+func storeExportFiles(t *testing.T, rfs *RandomFS) map[string][]byte {
+	t.Helper()
+	files := make(map[string][]byte)
+	for _, size := range []int{10_000, 25_000, 40_000} {
+		data, repHash := storeRandomFile(t, rfs, size)
+		files[repHash] = data
+	}
+	return files
+}
+
+func TestExportResumesToIdenticalArchive(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	storeExportFiles(t, rfs)
+	dir := t.TempDir()
+
+	want := filepath.Join(dir, "full.tar")
+	full, err := rfs.Export(want, ExportOptions{})
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if full.ResumedFrom != 0 {
+		t.Fatalf("fresh export resumed from %d", full.ResumedFrom)
+	}
+
+	// Hide a block half way through the export order so the first run
+	// fails after writing the objects before it
+	entries, err := verifyArchive(want)
+	if err != nil {
+		t.Fatalf("verifyArchive: %v", err)
+	}
+	var blocks []string
+	for _, entry := range entries {
+		blocks = append(blocks, entry.Blocks...)
+	}
+	blocks = uniqueHashes(blocks)
+	sort.Strings(blocks)
+	hidden := blocks[len(blocks)/2]
+	blockPath := filepath.Join(rfs.dataDir, "blocks", hidden)
+	if err := os.Rename(blockPath, blockPath+".hidden"); err != nil {
+		t.Fatalf("hide block: %v", err)
+	}
+	rfs.Cache().Clear()
+
+	got := filepath.Join(dir, "resumed.tar")
+	if _, err := rfs.Export(got, ExportOptions{}); err == nil {
+		t.Fatal("export with a missing block succeeded")
+	}
+	if _, err := os.Stat(got + ".checkpoint"); err != nil {
+		t.Fatalf("interrupted export left no checkpoint: %v", err)
+	}
+
+	if err := os.Rename(blockPath+".hidden", blockPath); err != nil {
+		t.Fatalf("restore block: %v", err)
+	}
+	var progress []int
+	resumed, err := rfs.Export(got, ExportOptions{Progress: func(done, total int) {
+		if total != full.Objects {
+			t.Errorf("progress total %d, want %d", total, full.Objects)
+		}
+		progress = append(progress, done)
+	}})
+	if err != nil {
+		t.Fatalf("resumed Export: %v", err)
+	}
+	if resumed.ResumedFrom == 0 {
+		t.Fatal("export did not resume from its checkpoint")
+	}
+	if len(progress) != full.Objects-resumed.ResumedFrom || progress[0] != resumed.ResumedFrom+1 {
+		t.Errorf("progress %v after resuming from %d of %d", progress, resumed.ResumedFrom, full.Objects)
+	}
+	if _, err := os.Stat(got + ".checkpoint"); !os.IsNotExist(err) {
+		t.Errorf("checkpoint not removed after export finished: %v", err)
+	}
+
+	wantData, _ := os.ReadFile(want)
+	gotData, _ := os.ReadFile(got)
+	if !bytes.Equal(wantData, gotData) {
+		t.Fatalf("resumed archive (%d bytes) differs from uninterrupted archive (%d bytes)", len(gotData), len(wantData))
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	src := newTestRandomFS(t)
+	files := storeExportFiles(t, src)
+	archive := filepath.Join(t.TempDir(), "export.tar")
+	if _, err := src.Export(archive, ExportOptions{CheckpointInterval: 2}); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+
+	dst := newTestRandomFS(t)
+	result, err := dst.Import(archive)
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	if result.Files != len(files) {
+		t.Errorf("imported %d files, want %d", result.Files, len(files))
+	}
+	for repHash, want := range files {
+		got, _, err := dst.RetrieveFile(repHash)
+		if err != nil {
+			t.Fatalf("RetrieveFile %s: %v", repHash, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("imported file %s differs", repHash)
+		}
+	}
+
+	// Importing again adds nothing new to the index
+	again, err := dst.Import(archive)
+	if err != nil {
+		t.Fatalf("second Import: %v", err)
+	}
+	if again.Files != 0 {
+		t.Errorf("second import indexed %d files", again.Files)
+	}
+}
+
+func TestImportRejectsCorruptArchive(t *testing.T) {
+	src := newTestRandomFS(t)
+	storeExportFiles(t, src)
+	archive := filepath.Join(t.TempDir(), "export.tar")
+	if _, err := src.Export(archive, ExportOptions{}); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+
+	data, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatalf("read archive: %v", err)
+	}
+	entry := src.index.list()[0]
+	block, err := src.retrieveBlock(entry.Blocks[0], 0)
+	if err != nil {
+		t.Fatalf("retrieveBlock: %v", err)
+	}
+	offset := bytes.Index(data, block[:64])
+	if offset < 0 {
+		t.Fatal("block not found in archive")
+	}
+	data[offset+10] ^= 0xff
+	if err := os.WriteFile(archive, data, 0644); err != nil {
+		t.Fatalf("write archive: %v", err)
+	}
+
+	dst := newTestRandomFS(t)
+	if _, err := dst.Import(archive); !errors.Is(err, ErrCorruptArchive) {
+		t.Fatalf("Import of corrupt archive: %v, want ErrCorruptArchive", err)
+	}
+	if listed := dst.ListFiles(); len(listed) != 0 {
+		t.Errorf("corrupt import indexed %d files", len(listed))
+	}
+	stored, _ := os.ReadDir(filepath.Join(dst.dataDir, "blocks"))
+	if len(stored) != 0 {
+		t.Errorf("corrupt import stored %d blocks", len(stored))
+	}
+}
@@ -0,0 +1,55 @@
+package randomfs
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+
+	"lukechampine.com/blake3"
+)
+
+// Algorithms available for whole-file integrity hashes
+const (
+	HashSHA256 = "sha256"
+	HashSHA512 = "sha512"
+	HashBLAKE3 = "blake3"
+)
+
+// ErrFileHashMismatch is returned when a reconstructed file does not match
+// the hash recorded in its representation
+var ErrFileHashMismatch = errors.New("file hash mismatch")
+
+// newFileHasher returns a hash.Hash for the named algorithm
+func newFileHasher(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case HashSHA256:
+		return sha256.New(), nil
+	case HashSHA512:
+		return sha512.New(), nil
+	case HashBLAKE3:
+		return blake3.New(32, nil), nil
+	}
+	return nil, fmt.Errorf("unsupported file hash algorithm %q", algorithm)
+}
+
+// fileHash returns the hex digest of data under algorithm
+func fileHash(algorithm string, data []byte) (string, error) {
+	hasher, err := newFileHasher(algorithm)
+	if err != nil {
+		return "", err
+	}
+	hasher.Write(data)
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// verifyFileHash checks a digest computed with the algorithm recorded in
+// rep, so files keep verifying after the configured algorithm changes
+func verifyFileHash(rep *FileRepresentation, digest string) error {
+	if digest != rep.FileHash {
+		return fmt.Errorf("%w: %s digest %s, expected %s", ErrFileHashMismatch, rep.HashAlgorithm, digest, rep.FileHash)
+	}
+	return nil
+}
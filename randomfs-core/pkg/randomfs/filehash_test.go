@@ -0,0 +1,91 @@
+package randomfs
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestFileHashVerifiesWithRecordedAlgorithm(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	rfs.FileHashAlgorithm = HashBLAKE3
+
+	url, err := rfs.StoreFile("doc.txt", []byte("hashed with blake3"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+
+	rfs.FileHashAlgorithm = HashSHA256
+	data, rep, err := rfs.RetrieveFile(url.RepHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile after switching algorithm: %v", err)
+	}
+	if string(data) != "hashed with blake3" {
+		t.Fatalf("unexpected data %q", data)
+	}
+	if rep.HashAlgorithm != HashBLAKE3 {
+		t.Fatalf("expected recorded algorithm blake3, got %q", rep.HashAlgorithm)
+	}
+	want, _ := fileHash(HashBLAKE3, data)
+	if rep.FileHash != want {
+		t.Fatalf("recorded hash %s, expected %s", rep.FileHash, want)
+	}
+
+	if _, err := rfs.RetrieveFileTo(url.RepHash, io.Discard); err != nil {
+		t.Fatalf("RetrieveFileTo: %v", err)
+	}
+}
+
+func TestFileHashAlgorithms(t *testing.T) {
+	for _, algorithm := range []string{HashSHA256, HashSHA512, HashBLAKE3} {
+		rfs := newTestRandomFS(t)
+		rfs.FileHashAlgorithm = algorithm
+		url, err := rfs.StoreFile("f.bin", []byte(algorithm), "application/octet-stream")
+		if err != nil {
+			t.Fatalf("%s: StoreFile: %v", algorithm, err)
+		}
+		if _, _, err := rfs.RetrieveFile(url.RepHash); err != nil {
+			t.Fatalf("%s: RetrieveFile: %v", algorithm, err)
+		}
+	}
+
+	rfs := newTestRandomFS(t)
+	rfs.FileHashAlgorithm = "md4"
+	if _, err := rfs.StoreFile("f.bin", []byte("x"), "application/octet-stream"); err == nil {
+		t.Fatal("expected an unsupported algorithm to be rejected")
+	}
+}
+
+func TestFileHashMismatchIsRejected(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	url, err := rfs.StoreFile("a.txt", []byte("original"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	_, rep, err := rfs.RetrieveFile(url.RepHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+
+	rep.FileHash, _ = fileHash(rep.HashAlgorithm, []byte("something else"))
+	tampered := storeCraftedRepresentation(t, rfs, rep)
+	if _, _, err := rfs.RetrieveFile(tampered); !errors.Is(err, ErrFileHashMismatch) {
+		t.Fatalf("expected ErrFileHashMismatch, got %v", err)
+	}
+	if _, err := rfs.RetrieveFileTo(tampered, io.Discard); !errors.Is(err, ErrFileHashMismatch) {
+		t.Fatalf("expected ErrFileHashMismatch from RetrieveFileTo, got %v", err)
+	}
+
+	// Without verification the tampered hash goes unnoticed on retrieval,
+	// but not by VerifyFile
+	rfs.VerifyFileHash = false
+	if got, _, err := rfs.RetrieveFile(tampered); err != nil || string(got) != "original" {
+		t.Fatalf("RetrieveFile without verification: %q, %v", got, err)
+	}
+	if _, err := rfs.RetrieveFileTo(tampered, io.Discard); err != nil {
+		t.Fatalf("RetrieveFileTo without verification: %v", err)
+	}
+	if err := rfs.VerifyFile(tampered); !errors.Is(err, ErrFileHashMismatch) {
+		t.Fatalf("expected VerifyFile to report ErrFileHashMismatch, got %v", err)
+	}
+}
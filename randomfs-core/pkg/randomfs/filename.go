@@ -0,0 +1,59 @@
+package randomfs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrFilenameRejected is returned when the FilenamePolicy refuses a name
+var ErrFilenameRejected = errors.New("filename rejected")
+
+// FilenamePolicy rewrites or validates a filename before it is stored. It
+// sees the name as given by the caller, before any directory components
+// are stripped, and returns the name to use or an error to reject it.
+type FilenamePolicy func(name string) (string, error)
+
+// RejectTraversalPolicy rejects names containing ".." path elements
+func RejectTraversalPolicy(name string) (string, error) {
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part == ".." {
+			return "", fmt.Errorf("path traversal in %q", name)
+		}
+	}
+	return name, nil
+}
+
+// NamespacePolicy prefixes every name with prefix, for example to keep the
+// files of one tenant apart from another's
+func NamespacePolicy(prefix string) FilenamePolicy {
+	return func(name string) (string, error) {
+		return prefix + name, nil
+	}
+}
+
+// ChainFilenamePolicies applies policies in order, stopping at the first
+// rejection
+func ChainFilenamePolicies(policies ...FilenamePolicy) FilenamePolicy {
+	return func(name string) (string, error) {
+		for _, policy := range policies {
+			var err error
+			if name, err = policy(name); err != nil {
+				return "", err
+			}
+		}
+		return name, nil
+	}
+}
+
+// applyFilenamePolicy runs the configured FilenamePolicy on name
+func (rfs *RandomFS) applyFilenamePolicy(name string) (string, error) {
+	if rfs.FilenamePolicy == nil {
+		return name, nil
+	}
+	rewritten, err := rfs.FilenamePolicy(name)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrFilenameRejected, err)
+	}
+	return rewritten, nil
+}
@@ -0,0 +1,79 @@
+package randomfs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRejectTraversalPolicyBlocksMaliciousName(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	rfs.FilenamePolicy = RejectTraversalPolicy
+
+	for _, name := range []string{"../../etc/passwd", `..\windows\system.ini`, "a/../b"} {
+		if _, err := rfs.StoreFile(name, []byte("x"), "text/plain"); !errors.Is(err, ErrFilenameRejected) {
+			t.Fatalf("%q: expected ErrFilenameRejected, got %v", name, err)
+		}
+	}
+	if files := rfs.ListFiles(); len(files) != 0 {
+		t.Fatalf("expected nothing stored, got %d files", len(files))
+	}
+
+	// Dots inside a name are not traversal
+	if _, err := rfs.StoreFile("notes..txt", []byte("x"), "text/plain"); err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+}
+
+func TestNamespacePolicyPrefixesStoredNames(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	rfs.FilenamePolicy = ChainFilenamePolicies(RejectTraversalPolicy, NamespacePolicy("acme-"))
+
+	rdURL, err := rfs.StoreFile("report.pdf", []byte("%PDF"), "application/pdf")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	if rdURL.FileName != "acme-report.pdf" {
+		t.Fatalf("expected namespaced URL name, got %q", rdURL.FileName)
+	}
+	_, rep, err := rfs.RetrieveFile(rdURL.RepHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+	if rep.FileName != "acme-report.pdf" {
+		t.Fatalf("expected namespaced representation name, got %q", rep.FileName)
+	}
+	if _, _, err := rfs.RetrieveByName("acme-report.pdf"); err != nil {
+		t.Fatalf("RetrieveByName: %v", err)
+	}
+
+	if err := rfs.RenameFile(rdURL.RepHash, "summary.pdf"); err != nil {
+		t.Fatalf("RenameFile: %v", err)
+	}
+	if files := rfs.ListFiles(); files[0].FileName != "acme-summary.pdf" {
+		t.Fatalf("expected namespaced rename, got %q", files[0].FileName)
+	}
+	if err := rfs.RenameFile(rdURL.RepHash, "../escape"); !errors.Is(err, ErrFilenameRejected) {
+		t.Fatalf("expected ErrFilenameRejected on rename, got %v", err)
+	}
+}
+
+func TestFilenamePolicyAppliesToDirectoryFiles(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	rfs.FilenamePolicy = NamespacePolicy("acme-")
+
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644)
+	if _, err := rfs.StoreDirectory(root); err != nil {
+		t.Fatalf("StoreDirectory: %v", err)
+	}
+
+	names := make(map[string]bool)
+	for _, file := range rfs.ListFiles() {
+		names[file.FileName] = true
+	}
+	if !names["acme-a.txt"] {
+		t.Fatalf("expected the directory file to be namespaced, got %v", names)
+	}
+}
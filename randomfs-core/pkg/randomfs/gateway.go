@@ -0,0 +1,172 @@
+package randomfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// UnixFS node types that hold file content
+const (
+	unixfsRaw  = 0
+	unixfsFile = 2
+)
+
+// errMalformedNode is returned for dag-pb nodes that cannot be decoded
+var errMalformedNode = errors.New("malformed dag-pb node")
+
+// catFromGateway fetches the content hash addresses from the gateway. The
+// gateway is untrusted, so the DAG is fetched node by node in raw form and
+// every node is checked against its CID before its content is used.
+func (rfs *RandomFS) catFromGateway(ctx context.Context, hash string) ([]byte, error) {
+	key, err := rfs.backendKey(hash)
+	if err != nil {
+		return nil, err
+	}
+	root, err := cid.Decode(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s from gateway: %v", hash, err)
+	}
+
+	var content bytes.Buffer
+	if err := rfs.gateway.catNode(ctx, root, &content); err != nil {
+		return nil, err
+	}
+	rfs.updateStats(func(s *Stats) { s.GatewayFetches++ })
+	return content.Bytes(), nil
+}
+
+// catNode appends the file content of the DAG rooted at c to content
+func (g *GatewaySource) catNode(ctx context.Context, c cid.Cid, content *bytes.Buffer) error {
+	node, err := g.fetchRaw(ctx, c.String())
+	if err != nil {
+		return err
+	}
+	prefix := c.Prefix()
+	sum, err := mh.Sum(node, prefix.MhType, prefix.MhLength)
+	if err != nil {
+		return fmt.Errorf("%w: cannot hash node %s: %v", ErrBlockMismatch, c, err)
+	}
+	if !bytes.Equal(sum, c.Hash()) {
+		return fmt.Errorf("%w: gateway returned a node that is not %s", ErrBlockMismatch, c)
+	}
+
+	switch prefix.Codec {
+	case cid.Raw:
+		content.Write(node)
+		return nil
+	case cid.DagProtobuf:
+	default:
+		return fmt.Errorf("cannot read %s node %s", codecName(prefix.Codec), c)
+	}
+
+	links, data, err := decodePBNode(node)
+	if err != nil {
+		return fmt.Errorf("failed to decode node %s: %v", c, err)
+	}
+	fileData, err := decodeUnixFSData(data)
+	if err != nil {
+		return fmt.Errorf("failed to decode node %s: %v", c, err)
+	}
+	content.Write(fileData)
+	for _, link := range links {
+		if err := g.catNode(ctx, link, content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodePBNode returns the links and data of a dag-pb node
+func decodePBNode(node []byte) ([]cid.Cid, []byte, error) {
+	var links []cid.Cid
+	var data []byte
+	err := walkProtobuf(node, func(field int, value []byte, _ uint64) error {
+		switch field {
+		case 1:
+			data = value
+		case 2:
+			var link cid.Cid
+			err := walkProtobuf(value, func(field int, value []byte, _ uint64) error {
+				if field != 1 {
+					return nil
+				}
+				var err error
+				link, err = cid.Cast(value)
+				return err
+			})
+			if err != nil || !link.Defined() {
+				return fmt.Errorf("%w: invalid link", errMalformedNode)
+			}
+			links = append(links, link)
+		}
+		return nil
+	})
+	return links, data, err
+}
+
+// decodeUnixFSData returns the content held by the UnixFS data of a file
+// node
+func decodeUnixFSData(data []byte) ([]byte, error) {
+	nodeType := uint64(1<<64 - 1)
+	var content []byte
+	err := walkProtobuf(data, func(field int, value []byte, number uint64) error {
+		switch field {
+		case 1:
+			nodeType = number
+		case 2:
+			content = value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if nodeType != unixfsFile && nodeType != unixfsRaw {
+		return nil, fmt.Errorf("UnixFS node of type %d is not a file", nodeType)
+	}
+	return content, nil
+}
+
+// walkProtobuf calls fn for each field of a protobuf message with its
+// value, the bytes of a length-delimited field or the number of a varint
+func walkProtobuf(msg []byte, fn func(field int, value []byte, number uint64) error) error {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errMalformedNode
+		}
+		msg = msg[n:]
+		field := int(key >> 3)
+
+		switch key & 7 {
+		case 0:
+			number, n := binary.Uvarint(msg)
+			if n <= 0 {
+				return errMalformedNode
+			}
+			msg = msg[n:]
+			if err := fn(field, nil, number); err != nil {
+				return err
+			}
+		case 2:
+			length, n := binary.Uvarint(msg)
+			if n <= 0 || length > uint64(len(msg)-n) {
+				return errMalformedNode
+			}
+			value := msg[n : n+int(length)]
+			msg = msg[n+int(length):]
+			if err := fn(field, value, 0); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: unexpected wire type %d", errMalformedNode, key&7)
+		}
+	}
+	return nil
+}
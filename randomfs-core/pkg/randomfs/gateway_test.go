@@ -0,0 +1,124 @@
+package randomfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/TheEntropyCollective/randomfs-core/internal/ipfstest"
+)
+
+// unreachableAPI returns the URL of an IPFS API that refuses connections
+func unreachableAPI() string {
+	server := httptest.NewServer(nil)
+	server.Close()
+	return server.URL
+}
+
+func TestGatewayServesReadsWithoutAPI(t *testing.T) {
+	ipfs := ipfstest.NewServer(t)
+	writer, err := NewRandomFSWithConfig(Config{EnableIPFS: true, IPFSAPI: ipfs.APIURL(), DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewRandomFSWithConfig: %v", err)
+	}
+	defer writer.Close()
+	data := make([]byte, 3*BlockSize+100)
+	rand.Read(data)
+	rdURL, err := writer.StoreFile("gateway.bin", data, "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+
+	// Without a gateway an unreachable API cannot be opened
+	if _, err := NewRandomFSWithConfig(Config{EnableIPFS: true, IPFSAPI: unreachableAPI(), DataDir: t.TempDir()}); err == nil {
+		t.Fatal("opened an instance with an unreachable API")
+	}
+	reader, err := NewRandomFSWithConfig(Config{
+		EnableIPFS: true,
+		IPFSAPI:    unreachableAPI(),
+		GatewayURL: ipfs.GatewayURL() + "/ipfs/",
+		DataDir:    t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("NewRandomFSWithConfig with a gateway: %v", err)
+	}
+	defer reader.Close()
+	if !reader.IsReadOnly() {
+		t.Error("an instance without an API is not read-only")
+	}
+
+	got, _, err := reader.RetrieveFile(rdURL.RepHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile through the gateway: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("gateway retrieval returned different content")
+	}
+	if stats := reader.GetStats(); stats.GatewayFetches == 0 || stats.IPFSCatTotal != 0 {
+		t.Errorf("expected gateway fetches and no API calls, got %+v", stats)
+	}
+	if _, err := reader.StoreFile("new.txt", []byte("new"), ""); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("StoreFile without an API returned %v", err)
+	}
+
+	// Gateways are untrusted, so altered content is refused
+	ipfs.Corrupt(true)
+	fresh, err := NewRandomFSWithConfig(Config{EnableIPFS: true, IPFSAPI: unreachableAPI(), GatewayURL: ipfs.GatewayURL(), DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewRandomFSWithConfig with a gateway: %v", err)
+	}
+	defer fresh.Close()
+	if _, _, err := fresh.RetrieveFile(rdURL.RepHash); !errors.Is(err, ErrBlockMismatch) {
+		t.Errorf("retrieving corrupted content returned %v", err)
+	}
+}
+
+func TestGatewayFallbackWhenCatFails(t *testing.T) {
+	ipfs := ipfstest.NewServer(t)
+	open := func() *RandomFS {
+		rfs, err := NewRandomFSWithConfig(Config{EnableIPFS: true, IPFSAPI: ipfs.APIURL(), GatewayURL: ipfs.GatewayURL(), DataDir: t.TempDir()})
+		if err != nil {
+			t.Fatalf("NewRandomFSWithConfig: %v", err)
+		}
+		t.Cleanup(func() { rfs.Close() })
+		rfs.IPFSRetry = RetryPolicy{}
+		return rfs
+	}
+	writer := open()
+	if writer.IsReadOnly() {
+		t.Fatal("an instance with a reachable API is read-only")
+	}
+	data := []byte("served by the gateway while the API is failing")
+	rdURL, err := writer.StoreFile("fallback.txt", data, "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+
+	rfs := open()
+	ipfs.FailCats(true)
+	got, _, err := rfs.RetrieveFile(rdURL.RepHash)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("RetrieveFile with failing cats returned %q: %v", got, err)
+	}
+	if stats := rfs.GetStats(); stats.GatewayFetches == 0 || stats.IPFSCatErrors == 0 {
+		t.Errorf("expected failed cats served by the gateway, got %+v", stats)
+	}
+
+	// Content of several chunks is read node by node
+	large := make([]byte, 600*1024)
+	rand.Read(large)
+	hash, err := rfs.addToIPFS(context.Background(), large, false)
+	if err != nil {
+		t.Fatalf("addToIPFS: %v", err)
+	}
+	if got, err := rfs.catFromGateway(context.Background(), hash); err != nil || !bytes.Equal(got, large) {
+		t.Errorf("catFromGateway of a DAG returned %d bytes: %v", len(got), err)
+	}
+
+	if _, err := NewRandomFSWithConfig(Config{GatewayURL: ipfs.GatewayURL(), DataDir: t.TempDir()}); err == nil {
+		t.Error("accepted a gateway without IPFS")
+	}
+}
@@ -0,0 +1,121 @@
+package randomfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// pendingBlock is a randomized block of a file being stored, waiting to be
+// hashed and written
+type pendingBlock struct {
+	// sparse is set instead of the other fields for a constant block,
+	// which is not stored
+	sparse string
+
+	block []byte
+	// randomizer is set when a fresh randomizer was generated and must be
+	// stored; a reused randomizer only has its hash
+	randomizer     []byte
+	randomizerHash string
+	// randomizerSeed is the hex seed a fresh randomizer was expanded from
+	randomizerSeed string
+	// second is the second randomizer of a block stored with
+	// TwoRandomizers, set like randomizer
+	second     []byte
+	secondHash string
+
+	// Local keys, set by hashPendingBlocks
+	blockDigest      string
+	randomizerDigest string
+	secondDigest     string
+}
+
+// blockDigest returns the hex SHA-256 of data, its local storage key
+func blockDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// randomizeBatch reads and randomizes up to n blocks from src, numbering
+// them from start. With SparseBlocks, constant blocks are marked sparse
+// instead. It returns an empty batch once src is exhausted.
+func (rfs *RandomFS) randomizeBatch(src blockSource, policy RandomizerPolicy, rctx RandomizerContext, start, n int) ([]*pendingBlock, error) {
+	var batch []*pendingBlock
+	for len(batch) < n {
+		data, err := src.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		rctx.BlockIndex = start + len(batch)
+		if rfs.SparseBlocks {
+			// The length of the last block of a stream of unknown size is
+			// corrected once the stream ends
+			length := rctx.BlockSize
+			if rctx.FileSize != UnknownSize {
+				length = int(min(int64(length), rctx.FileSize-int64(rctx.BlockIndex)*int64(rctx.BlockSize)))
+			}
+			if fill, ok := constantBlock(data[:length]); ok {
+				batch = append(batch, &pendingBlock{sparse: sparseRef(fill, length)})
+				continue
+			}
+		}
+		rctx.Entropy = src.entropy()
+		pending, err := rfs.randomizeBlock(data, policy, rctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to randomize block %d: %v", rctx.BlockIndex, err)
+		}
+		batch = append(batch, pending)
+	}
+	return batch, nil
+}
+
+// hashPendingBlocks computes the local keys of the blocks and fresh
+// randomizers of batch under the hash function code on up to workers
+// goroutines. Each key depends only on its own block, so the result is
+// the same for any worker count.
+func hashPendingBlocks(batch []*pendingBlock, workers int, code uint64) {
+	if workers <= 1 || len(batch) == 1 {
+		for _, pending := range batch {
+			pending.hash(code)
+		}
+		return
+	}
+
+	work := make(chan *pendingBlock)
+	var wg sync.WaitGroup
+	for i := 0; i < min(workers, len(batch)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pending := range work {
+				pending.hash(code)
+			}
+		}()
+	}
+	for _, pending := range batch {
+		work <- pending
+	}
+	close(work)
+	wg.Wait()
+}
+
+// hash sets the keys of the block and its fresh randomizers, if any
+func (p *pendingBlock) hash(code uint64) {
+	if p.sparse != "" {
+		return
+	}
+	p.blockDigest = blockKey(code, p.block)
+	if p.randomizer != nil {
+		p.randomizerDigest = blockKey(code, p.randomizer)
+	}
+	if p.second != nil {
+		p.secondDigest = blockKey(code, p.second)
+	}
+}
@@ -0,0 +1,121 @@
+package randomfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	mh "github.com/multiformats/go-multihash"
+)
+
+func TestParallelBlockHashesMatchSerial(t *testing.T) {
+	// newBatch returns copies of the same blocks, every other one with a
+	// fresh randomizer
+	blocks := make([][]byte, 37)
+	for i := range blocks {
+		blocks[i] = make([]byte, MiniBlockSize)
+		rand.Read(blocks[i])
+	}
+	newBatch := func() []*pendingBlock {
+		batch := make([]*pendingBlock, len(blocks))
+		for i, block := range blocks {
+			batch[i] = &pendingBlock{block: block}
+			if i%2 == 0 {
+				batch[i].randomizer = blocks[len(blocks)-1-i]
+			}
+		}
+		return batch
+	}
+
+	serial := newBatch()
+	hashPendingBlocks(serial, 1, mh.SHA2_256)
+	for _, workers := range []int{2, 8, 64} {
+		parallel := newBatch()
+		hashPendingBlocks(parallel, workers, mh.SHA2_256)
+		for i := range serial {
+			if parallel[i].blockDigest != serial[i].blockDigest || parallel[i].randomizerDigest != serial[i].randomizerDigest {
+				t.Fatalf("%d workers: digests of block %d differ from the serial result", workers, i)
+			}
+		}
+	}
+
+	for i, pending := range serial {
+		sum := sha256.Sum256(blocks[i])
+		if pending.blockDigest != hex.EncodeToString(sum[:]) {
+			t.Fatalf("digest of block %d is not its SHA-256", i)
+		}
+		if (i%2 == 0) != (pending.randomizerDigest != "") {
+			t.Fatalf("randomizer digest of block %d set for a reused randomizer or missing for a fresh one", i)
+		}
+	}
+}
+
+func TestParallelHashedStoreAddressesBlocks(t *testing.T) {
+	for _, workers := range []int{1, 3, 16} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			rfs := newTestRandomFS(t)
+			rfs.HashWorkers = workers
+
+			// An uneven block count leaves a partial final batch
+			data := make([]byte, 11*NanoBlockSize+100)
+			rand.Read(data)
+			rdURL, err := rfs.StoreFile("parallel.bin", data, "application/octet-stream")
+			if err != nil {
+				t.Fatalf("StoreFile: %v", err)
+			}
+
+			rep, err := rfs.loadRepresentation(rdURL.RepHash)
+			if err != nil {
+				t.Fatalf("loadRepresentation: %v", err)
+			}
+			for _, hash := range representationBlocks(rep) {
+				stored, err := os.ReadFile(filepath.Join(rfs.dataDir, "blocks", hash))
+				if err != nil {
+					t.Fatalf("read block %s: %v", hash, err)
+				}
+				sum := sha256.Sum256(stored)
+				if hex.EncodeToString(sum[:]) != hash {
+					t.Fatalf("block stored under %s does not hash to it", hash)
+				}
+			}
+
+			rfs.Cache().Clear()
+			got, _, err := rfs.RetrieveFile(rdURL.RepHash)
+			if err != nil {
+				t.Fatalf("RetrieveFile: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("retrieved file differs")
+			}
+		})
+	}
+}
+
+func BenchmarkStoreHashWorkers(b *testing.B) {
+	data := make([]byte, 32*BlockSize)
+	rand.Read(data)
+
+	for _, workers := range []int{1, DefaultHashWorkers, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			rfs, err := NewRandomFSWithoutIPFS(b.TempDir(), 16*1024*1024)
+			if err != nil {
+				b.Fatalf("NewRandomFSWithoutIPFS: %v", err)
+			}
+			defer rfs.Close()
+			rfs.HashWorkers = workers
+
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := rfs.StoreFile(fmt.Sprintf("bench-%d.bin", i), data, "application/octet-stream"); err != nil {
+					b.Fatalf("StoreFile: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package randomfs
+
+import "context"
+
+// States of the IPFS backend reported by CheckReadiness
+const (
+	IPFSDisabled    = "disabled"
+	IPFSReachable   = "ok"
+	IPFSUnreachable = "unreachable"
+)
+
+// Readiness is the result of CheckReadiness
+type Readiness struct {
+	// Ready is set when the instance can serve requests
+	Ready bool `json:"ready"`
+	// Degraded is set when the IPFS API is down but a gateway still
+	// serves reads
+	Degraded bool   `json:"degraded,omitempty"`
+	IPFS     string `json:"ipfs"`
+	Cache    bool   `json:"cache"`
+	// Reason explains why the instance is not ready or is degraded
+	Reason string `json:"reason,omitempty"`
+}
+
+// CheckReadiness reports whether the instance can serve requests. It
+// probes the IPFS API if IPFS is enabled; an unreachable API makes the
+// instance not ready unless a gateway is configured to read from, in
+// which case it is ready but degraded. A closed instance is never ready.
+func (rfs *RandomFS) CheckReadiness(ctx context.Context) Readiness {
+	readiness := Readiness{IPFS: IPFSDisabled, Cache: rfs.cache != nil}
+	select {
+	case <-rfs.done:
+		readiness.Reason = "instance is closed"
+		return readiness
+	default:
+	}
+	if !readiness.Cache {
+		readiness.Reason = "block cache is not initialized"
+		return readiness
+	}
+
+	readiness.Ready = true
+	if !rfs.useIPFS {
+		return readiness
+	}
+	err := rfs.testIPFSConnection(ctx)
+	rfs.noteBackendCall("ipfs version", err)
+	if err == nil {
+		readiness.IPFS = IPFSReachable
+		return readiness
+	}
+	readiness.IPFS = IPFSUnreachable
+	readiness.Reason = "IPFS API is unreachable: " + err.Error()
+	if rfs.gateway != nil {
+		readiness.Degraded = true
+	} else {
+		readiness.Ready = false
+	}
+	return readiness
+}
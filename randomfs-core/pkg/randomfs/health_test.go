@@ -0,0 +1,50 @@
+package randomfs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/TheEntropyCollective/randomfs-core/internal/ipfstest"
+)
+
+func TestCheckReadinessFollowsIPFS(t *testing.T) {
+	ipfs := ipfstest.NewServer(t)
+	rfs, err := NewRandomFSWithConfig(Config{EnableIPFS: true, IPFSAPI: ipfs.APIURL(), DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewRandomFSWithConfig: %v", err)
+	}
+	defer rfs.Close()
+
+	if readiness := rfs.CheckReadiness(context.Background()); !readiness.Ready || readiness.IPFS != IPFSReachable {
+		t.Fatalf("instance with IPFS up reported %+v", readiness)
+	}
+
+	ipfs.Close()
+	readiness := rfs.CheckReadiness(context.Background())
+	if readiness.Ready || readiness.IPFS != IPFSUnreachable || readiness.Reason == "" {
+		t.Fatalf("instance with IPFS down reported %+v", readiness)
+	}
+	if rfs.BackendHealth().ConsecutiveFailures != 1 {
+		t.Error("the failed probe was not recorded in the backend health")
+	}
+
+	// A gateway keeps the instance serving reads
+	rfs.gateway = NewGatewaySource(ipfs.GatewayURL())
+	if readiness := rfs.CheckReadiness(context.Background()); !readiness.Ready || !readiness.Degraded {
+		t.Errorf("instance with a gateway reported %+v", readiness)
+	}
+}
+
+func TestCheckReadinessWithoutIPFS(t *testing.T) {
+	rfs, err := NewRandomFSWithoutIPFS(t.TempDir(), 1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFSWithoutIPFS: %v", err)
+	}
+	if readiness := rfs.CheckReadiness(context.Background()); !readiness.Ready || readiness.IPFS != IPFSDisabled {
+		t.Fatalf("local instance reported %+v", readiness)
+	}
+	rfs.Close()
+	if readiness := rfs.CheckReadiness(context.Background()); readiness.Ready {
+		t.Error("closed instance reported ready")
+	}
+}
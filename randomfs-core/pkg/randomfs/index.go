@@ -0,0 +1,630 @@
+package randomfs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// indexFileName is the file in the data directory holding the file index
+const indexFileName = "index.json"
+
+// NamePolicy controls whether several indexed files may share a name
+type NamePolicy int
+
+// Duplicate-name policies applied by StoreFile and RenameFile
+const (
+	// NamesAllowDuplicates lets files share a name; lookups by name
+	// resolve to the most recently stored file
+	NamesAllowDuplicates NamePolicy = iota
+	// NamesRejectDuplicates refuses to store or rename a file onto a name
+	// already held by another indexed file
+	NamesRejectDuplicates
+)
+
+// String returns the name of the policy
+func (p NamePolicy) String() string {
+	switch p {
+	case NamesAllowDuplicates:
+		return "allow-duplicates"
+	case NamesRejectDuplicates:
+		return "reject-duplicates"
+	}
+	return fmt.Sprintf("NamePolicy(%d)", int(p))
+}
+
+// Errors returned by name-based index operations
+var (
+	ErrFileNotFound       = errors.New("file not found")
+	ErrDuplicateName      = errors.New("a file with that name already exists")
+	ErrGracePeriodElapsed = errors.New("delete grace period has elapsed")
+)
+
+// IndexEntry records a stored file and the blocks it references
+type IndexEntry struct {
+	RepHash     string    `json:"rep_hash"`
+	FileName    string    `json:"filename"`
+	FileSize    int64     `json:"filesize"`
+	ContentType string    `json:"content_type"`
+	StoredAt    time.Time `json:"stored_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	DeletedAt   time.Time `json:"deleted_at"`
+	BlockSize   int       `json:"block_size,omitempty"`
+	Blocks      []string  `json:"blocks"`
+}
+
+// blockSize returns the block size the file was stored with. Entries
+// indexed before it was recorded used the tier for their size.
+func (e *IndexEntry) blockSize() int {
+	if e.BlockSize > 0 {
+		return e.BlockSize
+	}
+	return tierBlockSize(e.FileSize)
+}
+
+// Expired reports whether the entry has an expiry that is not after now
+func (e *IndexEntry) Expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && !e.ExpiresAt.After(now)
+}
+
+// Deleted reports whether the entry has been soft-deleted
+func (e *IndexEntry) Deleted() bool {
+	return !e.DeletedAt.IsZero()
+}
+
+// FileInfo describes a stored file as returned by ListFiles
+type FileInfo struct {
+	RepHash     string        `json:"rep_hash"`
+	FileName    string        `json:"filename"`
+	FileSize    int64         `json:"filesize"`
+	ContentType string        `json:"content_type"`
+	StoredAt    time.Time     `json:"stored_at"`
+	ExpiresAt   time.Time     `json:"expires_at"`
+	TTL         time.Duration `json:"ttl,omitempty"`
+}
+
+// fileIndex is the persistent index of files stored through this instance
+type fileIndex struct {
+	path    string
+	entries map[string]*IndexEntry
+	// refs counts the entries referencing each block by its BlockAddress.
+	// It is derived from the entries, so it persists with them.
+	refs  map[string]int
+	mutex sync.RWMutex
+}
+
+// loadFileIndex reads the index from dataDir, starting empty if none exists
+func loadFileIndex(dataDir string) (*fileIndex, error) {
+	idx := &fileIndex{
+		path:    filepath.Join(dataDir, indexFileName),
+		entries: make(map[string]*IndexEntry),
+		refs:    make(map[string]int),
+	}
+
+	data, err := os.ReadFile(idx.path)
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index: %v", err)
+	}
+
+	var entries []*IndexEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse index: %v", err)
+	}
+	for _, entry := range entries {
+		idx.entries[entry.RepHash] = entry
+		idx.addRefs(entry)
+	}
+	return idx, nil
+}
+
+// put adds or replaces an entry and persists the index
+func (idx *fileIndex) put(entry *IndexEntry) error {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	if old, exists := idx.entries[entry.RepHash]; exists {
+		idx.dropRefs(old)
+	}
+	idx.entries[entry.RepHash] = entry
+	idx.addRefs(entry)
+	return idx.save()
+}
+
+// remove deletes an entry and persists the index
+func (idx *fileIndex) remove(repHash string) error {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	if entry, exists := idx.entries[repHash]; exists {
+		idx.dropRefs(entry)
+		delete(idx.entries, repHash)
+	}
+	return idx.save()
+}
+
+// addRefs counts the blocks of entry; callers hold the write lock
+func (idx *fileIndex) addRefs(entry *IndexEntry) {
+	for _, address := range blockAddresses(entry) {
+		idx.refs[address]++
+	}
+}
+
+// dropRefs uncounts the blocks of entry, forgetting blocks no entry
+// references any more; callers hold the write lock
+func (idx *fileIndex) dropRefs(entry *IndexEntry) {
+	for _, address := range blockAddresses(entry) {
+		if idx.refs[address]--; idx.refs[address] <= 0 {
+			delete(idx.refs, address)
+		}
+	}
+}
+
+// blockAddresses returns the distinct blocks of entry by address, so a
+// block is counted once whichever form each file refers to it by
+func blockAddresses(entry *IndexEntry) []string {
+	addresses := make([]string, len(entry.Blocks))
+	for i, hash := range entry.Blocks {
+		addresses[i] = canonicalRef(hash)
+	}
+	return uniqueHashes(addresses)
+}
+
+// get returns the entry for repHash
+func (idx *fileIndex) get(repHash string) (*IndexEntry, bool) {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	entry, exists := idx.entries[repHash]
+	return entry, exists
+}
+
+// list returns all entries ordered by store time
+func (idx *fileIndex) list() []*IndexEntry {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	entries := make([]*IndexEntry, 0, len(idx.entries))
+	for _, entry := range idx.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].StoredAt.Equal(entries[j].StoredAt) {
+			return entries[i].RepHash < entries[j].RepHash
+		}
+		return entries[i].StoredAt.Before(entries[j].StoredAt)
+	})
+	return entries
+}
+
+// findByName returns the live entries named name, most recently stored
+// first
+func (idx *fileIndex) findByName(name string) []*IndexEntry {
+	var matches []*IndexEntry
+	for _, entry := range idx.list() {
+		if entry.FileName == name && !entry.Deleted() {
+			matches = append([]*IndexEntry{entry}, matches...)
+		}
+	}
+	return matches
+}
+
+// references counts the entries, soft-deleted ones included, that
+// reference a block hash
+func (idx *fileIndex) references(hash string) int {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	return idx.refs[canonicalRef(hash)]
+}
+
+// blockTotals returns the number of distinct blocks the entries reference
+// and the number of references to them
+func (idx *fileIndex) blockTotals() (unique, referenced int64) {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	for _, count := range idx.refs {
+		unique++
+		referenced += int64(count)
+	}
+	return unique, referenced
+}
+
+// save writes the index atomically; callers hold the write lock
+func (idx *fileIndex) save() error {
+	entries := make([]*IndexEntry, 0, len(idx.entries))
+	for _, entry := range idx.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].RepHash < entries[j].RepHash })
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal index: %v", err)
+	}
+
+	tmp := idx.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write index: %v", err)
+	}
+	if err := os.Rename(tmp, idx.path); err != nil {
+		return fmt.Errorf("failed to write index: %v", err)
+	}
+	return nil
+}
+
+// PruneResult reports the files removed by PruneOlderThan
+type PruneResult struct {
+	// Pruned lists the representation hashes of the pruned files
+	Pruned []string `json:"pruned"`
+	// BytesReclaimed counts the block bytes released. Files soft-deleted
+	// under a DeleteGracePeriod release theirs when they are purged.
+	BytesReclaimed int64 `json:"bytes_reclaimed"`
+}
+
+// ListFiles returns the files stored through this instance, including the
+// remaining time to live of files stored with an expiry
+func (rfs *RandomFS) ListFiles() []FileInfo {
+	now := time.Now()
+	entries := rfs.index.list()
+
+	files := make([]FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Deleted() {
+			continue
+		}
+		info := FileInfo{
+			RepHash:     entry.RepHash,
+			FileName:    entry.FileName,
+			FileSize:    entry.FileSize,
+			ContentType: entry.ContentType,
+			StoredAt:    entry.StoredAt,
+			ExpiresAt:   entry.ExpiresAt,
+		}
+		if !entry.ExpiresAt.IsZero() {
+			info.TTL = entry.ExpiresAt.Sub(now)
+			if info.TTL < 0 {
+				info.TTL = 0
+			}
+		}
+		files = append(files, info)
+	}
+	return files
+}
+
+// ListFilesOlderThan returns the files stored before cutoff, oldest first
+func (rfs *RandomFS) ListFilesOlderThan(cutoff time.Time) []FileInfo {
+	var older []FileInfo
+	for _, file := range rfs.ListFiles() {
+		if file.StoredAt.Before(cutoff) {
+			older = append(older, file)
+		}
+	}
+	return older
+}
+
+// PruneOlderThan deletes every file stored before cutoff like DeleteFile,
+// so blocks a newer file still references are kept and, with a
+// DeleteGracePeriod, files are only soft-deleted
+func (rfs *RandomFS) PruneOlderThan(cutoff time.Time) (*PruneResult, error) {
+	if rfs.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	rfs.mutex.Lock()
+	defer rfs.mutex.Unlock()
+
+	result := &PruneResult{}
+	for _, entry := range rfs.index.list() {
+		if entry.Deleted() || !entry.StoredAt.Before(cutoff) {
+			continue
+		}
+
+		var err error
+		if rfs.DeleteGracePeriod > 0 {
+			err = rfs.softDeleteFile(entry)
+		} else {
+			released := rfs.exclusiveBlocks(entry)
+			if err = rfs.deleteFile(entry.RepHash); err == nil {
+				result.BytesReclaimed += int64(released) * int64(entry.blockSize())
+			}
+		}
+		if err != nil {
+			return result, fmt.Errorf("failed to prune %s: %v", entry.RepHash, err)
+		}
+		result.Pruned = append(result.Pruned, entry.RepHash)
+	}
+
+	rfs.log().Info("Pruned files", "files", len(result.Pruned), "before", cutoff, "bytes", result.BytesReclaimed)
+	return result, nil
+}
+
+// BlockRefCount returns the number of indexed files, soft-deleted ones
+// included, that reference a block. Deleting a file releases only the
+// blocks whose count drops to zero, so randomizers shared with other files
+// are kept.
+func (rfs *RandomFS) BlockRefCount(hash string) int {
+	return rfs.index.references(hash)
+}
+
+// exclusiveBlocks counts the distinct blocks of entry that no other indexed
+// file references, which deleting it would release
+func (rfs *RandomFS) exclusiveBlocks(entry *IndexEntry) int {
+	count := 0
+	for _, hash := range uniqueHashes(entry.Blocks) {
+		if rfs.index.references(hash) == 1 {
+			count++
+		}
+	}
+	return count
+}
+
+// DeleteFile removes a file from the index and releases its representation
+// and any blocks no longer referenced by another indexed file. With a
+// DeleteGracePeriod, an indexed file is only marked deleted; RestoreFile
+// can undo that until PurgeDeleted releases it once the period has passed.
+func (rfs *RandomFS) DeleteFile(repHash string) error {
+	if rfs.readOnly {
+		return ErrReadOnly
+	}
+
+	rfs.mutex.Lock()
+	defer rfs.mutex.Unlock()
+
+	entry, exists := rfs.index.get(repHash)
+	if exists && entry.Deleted() {
+		return fmt.Errorf("%w: %s", ErrFileNotFound, repHash)
+	}
+	rfs.parsedReps.remove(repHash)
+	if !exists || rfs.DeleteGracePeriod <= 0 {
+		return rfs.deleteFile(repHash)
+	}
+	return rfs.softDeleteFile(entry)
+}
+
+// softDeleteFile marks an indexed file deleted, keeping its blocks for the
+// grace period; callers hold the write lock
+func (rfs *RandomFS) softDeleteFile(entry *IndexEntry) error {
+	deleted := *entry
+	deleted.DeletedAt = time.Now()
+	if err := rfs.index.put(&deleted); err != nil {
+		return err
+	}
+
+	rfs.log().Info("Soft-deleted file", "rep_hash", entry.RepHash, "grace_period", rfs.DeleteGracePeriod)
+	return nil
+}
+
+// RestoreFile undoes the soft deletion of a file whose grace period has not
+// yet passed
+func (rfs *RandomFS) RestoreFile(repHash string) error {
+	if rfs.readOnly {
+		return ErrReadOnly
+	}
+
+	rfs.mutex.Lock()
+	defer rfs.mutex.Unlock()
+
+	entry, exists := rfs.index.get(repHash)
+	if !exists || !entry.Deleted() {
+		return fmt.Errorf("%w: no deleted file %s", ErrFileNotFound, repHash)
+	}
+	if !time.Now().Before(entry.DeletedAt.Add(rfs.DeleteGracePeriod)) {
+		return fmt.Errorf("%w: %s was deleted at %s", ErrGracePeriodElapsed, repHash, entry.DeletedAt.Format(time.RFC3339))
+	}
+	if err := rfs.checkNameAvailable(entry.FileName, repHash); err != nil {
+		return err
+	}
+
+	restored := *entry
+	restored.DeletedAt = time.Time{}
+	if err := rfs.index.put(&restored); err != nil {
+		return err
+	}
+
+	rfs.log().Info("Restored file", "rep_hash", repHash)
+	return nil
+}
+
+// PurgeDeleted releases every soft-deleted file whose grace period has
+// passed and returns the number of files purged
+func (rfs *RandomFS) PurgeDeleted() (int, error) {
+	if rfs.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	rfs.mutex.Lock()
+	defer rfs.mutex.Unlock()
+
+	now := time.Now()
+	purged := 0
+	for _, entry := range rfs.index.list() {
+		if !entry.Deleted() || now.Before(entry.DeletedAt.Add(rfs.DeleteGracePeriod)) {
+			continue
+		}
+		if err := rfs.deleteFile(entry.RepHash); err != nil {
+			return purged, fmt.Errorf("failed to purge %s: %v", entry.RepHash, err)
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// deleteFile implements DeleteFile; callers hold the write lock
+func (rfs *RandomFS) deleteFile(repHash string) error {
+	entry, exists := rfs.index.get(repHash)
+	if !exists {
+		rep, err := rfs.loadRepresentation(repHash)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrFileNotFound, repHash, err)
+		}
+		entry = &IndexEntry{RepHash: repHash, Blocks: representationBlocks(rep)}
+	}
+
+	if err := rfs.index.remove(repHash); err != nil {
+		return err
+	}
+
+	var released []string
+	for _, hash := range uniqueHashes(entry.Blocks) {
+		if rfs.index.references(hash) == 0 {
+			released = append(released, hash)
+		}
+	}
+
+	if err := rfs.releaseBlocks(append(released, repHash)); err != nil {
+		return fmt.Errorf("failed to release blocks: %v", err)
+	}
+
+	rfs.log().Info("Deleted file", "rep_hash", repHash, "blocks", len(released))
+	return nil
+}
+
+// RenameFile changes the indexed name of a stored file. Blocks and the
+// representation are left untouched.
+func (rfs *RandomFS) RenameFile(repHash, newName string) error {
+	if rfs.readOnly {
+		return ErrReadOnly
+	}
+
+	newName, err := rfs.applyFilenamePolicy(newName)
+	if err != nil {
+		return err
+	}
+
+	rfs.mutex.Lock()
+	defer rfs.mutex.Unlock()
+
+	newName = filepath.Base(newName)
+	if newName == "." || newName == string(filepath.Separator) {
+		return fmt.Errorf("invalid file name %q", newName)
+	}
+
+	entry, exists := rfs.index.get(repHash)
+	if !exists || entry.Deleted() {
+		return fmt.Errorf("%w: %s", ErrFileNotFound, repHash)
+	}
+	if err := rfs.checkNameAvailable(newName, repHash); err != nil {
+		return err
+	}
+
+	renamed := *entry
+	renamed.FileName = newName
+	if err := rfs.index.put(&renamed); err != nil {
+		return err
+	}
+
+	rfs.log().Info("Renamed file", "rep_hash", repHash, "from", entry.FileName, "to", newName)
+	return nil
+}
+
+// RetrieveByName reconstructs the most recently stored file with the given
+// indexed name. The returned representation carries the indexed name.
+func (rfs *RandomFS) RetrieveByName(name string) ([]byte, *FileRepresentation, error) {
+	matches := rfs.index.findByName(name)
+	if len(matches) == 0 {
+		return nil, nil, fmt.Errorf("%w: %s", ErrFileNotFound, name)
+	}
+
+	data, rep, err := rfs.RetrieveFile(matches[0].RepHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	rep.FileName = matches[0].FileName
+	return data, rep, nil
+}
+
+// checkNameAvailable applies the duplicate-name policy to name for the
+// file repHash; callers hold the write lock
+func (rfs *RandomFS) checkNameAvailable(name, repHash string) error {
+	if rfs.NamePolicy != NamesRejectDuplicates {
+		return nil
+	}
+	for _, entry := range rfs.index.findByName(name) {
+		if entry.RepHash != repHash {
+			return fmt.Errorf("%w: %s", ErrDuplicateName, name)
+		}
+	}
+	return nil
+}
+
+// ReapExpired deletes every indexed file whose expiry has passed and
+// returns the number of files removed
+func (rfs *RandomFS) ReapExpired() (int, error) {
+	if rfs.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	rfs.mutex.Lock()
+	defer rfs.mutex.Unlock()
+
+	now := time.Now()
+	reaped := 0
+	for _, entry := range rfs.index.list() {
+		if !entry.Expired(now) || entry.Deleted() {
+			continue
+		}
+		if err := rfs.deleteFile(entry.RepHash); err != nil {
+			return reaped, fmt.Errorf("failed to reap %s: %v", entry.RepHash, err)
+		}
+		reaped++
+	}
+	return reaped, nil
+}
+
+// StartExpiryReaper runs ReapExpired and PurgeDeleted every interval until
+// Close is called
+func (rfs *RandomFS) StartExpiryReaper(interval time.Duration) {
+	rfs.background.Add(1)
+	go func() {
+		defer rfs.background.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-rfs.done:
+				return
+			case <-ticker.C:
+				if _, err := rfs.ReapExpired(); err != nil {
+					rfs.log().Error("Expiry reaper failed", "error", err)
+				}
+				if _, err := rfs.PurgeDeleted(); err != nil {
+					rfs.log().Error("Expiry reaper failed", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// representationBlocks returns every block hash a representation
+// references. Sparse blocks and their empty randomizers are stored nowhere
+// and left out.
+func representationBlocks(rep *FileRepresentation) []string {
+	blocks := make([]string, 0, len(rep.BlockHashes)+len(rep.RandomizerHashes)+len(rep.SecondRandomizerHashes))
+	var randomizers, seconds []string
+	for i, hash := range rep.BlockHashes {
+		if isSparseRef(hash) {
+			continue
+		}
+		blocks = append(blocks, hash)
+		if i < len(rep.RandomizerHashes) {
+			randomizers = append(randomizers, rep.RandomizerHashes[i])
+		}
+		if i < len(rep.SecondRandomizerHashes) {
+			seconds = append(seconds, rep.SecondRandomizerHashes[i])
+		}
+	}
+	if len(rep.RandomizerHashes) > len(rep.BlockHashes) {
+		randomizers = append(randomizers, rep.RandomizerHashes[len(rep.BlockHashes):]...)
+	}
+	return append(append(blocks, randomizers...), seconds...)
+}
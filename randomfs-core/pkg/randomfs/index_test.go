@@ -0,0 +1,563 @@
+package randomfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// storeSharingRandomizer stores data as a new indexed file whose first block
+// reuses the first randomizer of an existing file
+func storeSharingRandomizer(t *testing.T, rfs *RandomFS, shared *FileRepresentation, data []byte, expiresAt time.Time) (string, *FileRepresentation) {
+	t.Helper()
+	randomizer, err := rfs.retrieveBlock(shared.RandomizerHashes[0], shared.BlockSize)
+	if err != nil {
+		t.Fatalf("retrieveBlock: %v", err)
+	}
+
+	block := make([]byte, shared.BlockSize)
+	copy(block, randomizer)
+	for i, b := range data {
+		block[i] ^= b
+	}
+	blockHash, err := rfs.storeBlock(block)
+	if err != nil {
+		t.Fatalf("storeBlock: %v", err)
+	}
+
+	rep := &FileRepresentation{
+		FileName:         "scratch.txt",
+		FileSize:         int64(len(data)),
+		BlockHashes:      []string{blockHash},
+		RandomizerHashes: []string{shared.RandomizerHashes[0]},
+		BlockSize:        shared.BlockSize,
+		Timestamp:        time.Now().Unix(),
+		ContentType:      "text/plain",
+		Version:          RepresentationVersion,
+	}
+	repData, err := json.Marshal(rep)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	repHash, err := rfs.storeRepresentation(context.Background(), repData)
+	if err != nil {
+		t.Fatalf("storeRepresentation: %v", err)
+	}
+	if err := rfs.index.put(&IndexEntry{
+		RepHash:   repHash,
+		FileName:  rep.FileName,
+		FileSize:  rep.FileSize,
+		StoredAt:  time.Now(),
+		ExpiresAt: expiresAt,
+		Blocks:    representationBlocks(rep),
+	}); err != nil {
+		t.Fatalf("index put: %v", err)
+	}
+	return repHash, rep
+}
+
+func TestExpiredFileIsReapedWhileSharedBlocksSurvive(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	defer rfs.Close()
+
+	keepURL, err := rfs.StoreFile("keep.txt", []byte("kept forever"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	_, keepRep, err := rfs.RetrieveFile(keepURL.RepHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+
+	scratchHash, scratchRep := storeSharingRandomizer(t, rfs, keepRep, []byte("temporary"), time.Now().Add(50*time.Millisecond))
+	if data, _, err := rfs.RetrieveFile(scratchHash); err != nil || string(data) != "temporary" {
+		t.Fatalf("scratch file not retrievable before expiry: %q, %v", data, err)
+	}
+
+	files := rfs.ListFiles()
+	if len(files) != 2 {
+		t.Fatalf("expected 2 listed files, got %d", len(files))
+	}
+	for _, f := range files {
+		switch f.RepHash {
+		case keepURL.RepHash:
+			if f.TTL != 0 {
+				t.Errorf("file without expiry has TTL %v", f.TTL)
+			}
+		case scratchHash:
+			if f.TTL <= 0 || f.TTL > 50*time.Millisecond {
+				t.Errorf("unexpected TTL %v for expiring file", f.TTL)
+			}
+		}
+	}
+
+	rfs.StartExpiryReaper(10 * time.Millisecond)
+	deadline := time.Now().Add(2 * time.Second)
+	for len(rfs.ListFiles()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expired file was not reaped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if files := rfs.ListFiles(); files[0].RepHash != keepURL.RepHash {
+		t.Fatalf("wrong file reaped, remaining %s", files[0].RepHash)
+	}
+	if _, err := rfs.retrieveLocal(scratchRep.BlockHashes[0]); err == nil {
+		t.Error("block only referenced by the expired file was not released")
+	}
+
+	rfs.cache.Clear()
+	data, _, err := rfs.RetrieveFile(keepURL.RepHash)
+	if err != nil {
+		t.Fatalf("file sharing a randomizer with the reaped file is gone: %v", err)
+	}
+	if string(data) != "kept forever" {
+		t.Fatalf("unexpected data %q", data)
+	}
+}
+
+func TestStoreFileWithExpiryRecordsExpiry(t *testing.T) {
+	rfs := newTestRandomFS(t)
+
+	expiresAt := time.Now().Add(time.Hour)
+	url, err := rfs.StoreFileWithExpiry("temp.bin", []byte("data"), "application/octet-stream", expiresAt)
+	if err != nil {
+		t.Fatalf("StoreFileWithExpiry: %v", err)
+	}
+
+	rfs.Close()
+	reopened, err := NewRandomFSWithoutIPFS(rfs.dataDir, 1024)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	files := reopened.ListFiles()
+	if len(files) != 1 || files[0].RepHash != url.RepHash {
+		t.Fatalf("index not persisted: %+v", files)
+	}
+	if !files[0].ExpiresAt.Equal(expiresAt) {
+		t.Fatalf("expected expiry %v, got %v", expiresAt, files[0].ExpiresAt)
+	}
+	if files[0].TTL < 59*time.Minute {
+		t.Fatalf("unexpected TTL %v", files[0].TTL)
+	}
+}
+
+func TestRenameFile(t *testing.T) {
+	rfs := newTestRandomFS(t)
+
+	url, err := rfs.StoreFile("draft.txt", []byte("final contents"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	before, _ := rfs.index.get(url.RepHash)
+
+	if err := rfs.RenameFile(url.RepHash, "final.txt"); err != nil {
+		t.Fatalf("RenameFile: %v", err)
+	}
+
+	data, rep, err := rfs.RetrieveByName("final.txt")
+	if err != nil {
+		t.Fatalf("RetrieveByName new name: %v", err)
+	}
+	if string(data) != "final contents" || rep.FileName != "final.txt" {
+		t.Fatalf("unexpected retrieval %q as %s", data, rep.FileName)
+	}
+	if _, _, err := rfs.RetrieveByName("draft.txt"); !errors.Is(err, ErrFileNotFound) {
+		t.Fatalf("expected old name to be gone, got %v", err)
+	}
+
+	after, _ := rfs.index.get(url.RepHash)
+	if !reflect.DeepEqual(before.Blocks, after.Blocks) {
+		t.Fatal("rename changed the referenced blocks")
+	}
+	for _, hash := range after.Blocks {
+		if _, err := rfs.retrieveLocal(hash); err != nil {
+			t.Fatalf("block %s missing after rename: %v", hash, err)
+		}
+	}
+}
+
+func TestRenameFileHonorsDuplicateNamePolicy(t *testing.T) {
+	rfs := newTestRandomFS(t)
+
+	first, err := rfs.StoreFile("a.txt", []byte("first"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	second, err := rfs.StoreFile("b.txt", []byte("second"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+
+	rfs.NamePolicy = NamesRejectDuplicates
+	if err := rfs.RenameFile(second.RepHash, "a.txt"); !errors.Is(err, ErrDuplicateName) {
+		t.Fatalf("expected ErrDuplicateName on rename, got %v", err)
+	}
+	if _, err := rfs.StoreFile("a.txt", []byte("third"), "text/plain"); !errors.Is(err, ErrDuplicateName) {
+		t.Fatalf("expected ErrDuplicateName on store, got %v", err)
+	}
+	if err := rfs.RenameFile(first.RepHash, "a.txt"); err != nil {
+		t.Fatalf("renaming a file to its own name: %v", err)
+	}
+
+	rfs.NamePolicy = NamesAllowDuplicates
+	if err := rfs.RenameFile(second.RepHash, "a.txt"); err != nil {
+		t.Fatalf("RenameFile with duplicates allowed: %v", err)
+	}
+	if _, err := rfs.StoreFile("a.txt", []byte("third"), "text/plain"); err != nil {
+		t.Fatalf("StoreFile with duplicates allowed: %v", err)
+	}
+	data, _, err := rfs.RetrieveByName("a.txt")
+	if err != nil {
+		t.Fatalf("RetrieveByName: %v", err)
+	}
+	if string(data) != "third" {
+		t.Fatalf("expected the most recently stored file, got %q", data)
+	}
+}
+
+func TestSoftDeletedFileIsRestorableWithinGracePeriod(t *testing.T) {
+	mock, rfs := newMockIPFSRandomFS(t)
+	rfs.DeleteGracePeriod = time.Hour
+
+	rdURL, err := rfs.StoreFile("mistake.txt", []byte("deleted by mistake"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	entry, _ := rfs.index.get(rdURL.RepHash)
+	hashes := append([]string{rdURL.RepHash}, entry.Blocks...)
+
+	if err := rfs.DeleteFile(rdURL.RepHash); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	if files := rfs.ListFiles(); len(files) != 0 {
+		t.Fatalf("expected the soft-deleted file to be hidden, got %d files", len(files))
+	}
+	if _, _, err := rfs.RetrieveByName("mistake.txt"); !errors.Is(err, ErrFileNotFound) {
+		t.Fatalf("expected ErrFileNotFound by name, got %v", err)
+	}
+	if err := rfs.DeleteFile(rdURL.RepHash); !errors.Is(err, ErrFileNotFound) {
+		t.Fatalf("expected a second delete to fail with ErrFileNotFound, got %v", err)
+	}
+
+	if purged, err := rfs.PurgeDeleted(); err != nil || purged != 0 {
+		t.Fatalf("expected nothing purged within the grace period, got %d, %v", purged, err)
+	}
+	for _, hash := range hashes {
+		if !mock.isPinned(hash) {
+			t.Fatalf("%s was unpinned within the grace period", hash)
+		}
+	}
+
+	if err := rfs.RestoreFile(rdURL.RepHash); err != nil {
+		t.Fatalf("RestoreFile: %v", err)
+	}
+	data, _, err := rfs.RetrieveByName("mistake.txt")
+	if err != nil || string(data) != "deleted by mistake" {
+		t.Fatalf("RetrieveByName after restore: %q, %v", data, err)
+	}
+	if err := rfs.RestoreFile(rdURL.RepHash); !errors.Is(err, ErrFileNotFound) {
+		t.Fatalf("expected restoring a live file to fail, got %v", err)
+	}
+}
+
+func TestSoftDeletedBlocksAreReleasedAfterGracePeriod(t *testing.T) {
+	mock, rfs := newMockIPFSRandomFS(t)
+	rfs.DeleteGracePeriod = 50 * time.Millisecond
+
+	rdURL, err := rfs.StoreFile("temp.txt", []byte("short lived"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	entry, _ := rfs.index.get(rdURL.RepHash)
+	hashes := append([]string{rdURL.RepHash}, entry.Blocks...)
+
+	if err := rfs.DeleteFile(rdURL.RepHash); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+
+	if err := rfs.RestoreFile(rdURL.RepHash); !errors.Is(err, ErrGracePeriodElapsed) {
+		t.Fatalf("expected ErrGracePeriodElapsed, got %v", err)
+	}
+	for _, hash := range hashes {
+		if !mock.isPinned(hash) {
+			t.Fatalf("%s was unpinned before the purge", hash)
+		}
+	}
+
+	if purged, err := rfs.PurgeDeleted(); err != nil || purged != 1 {
+		t.Fatalf("expected one file purged, got %d, %v", purged, err)
+	}
+	for _, hash := range hashes {
+		if mock.isPinned(hash) {
+			t.Fatalf("%s is still pinned after the purge", hash)
+		}
+	}
+	if _, exists := rfs.index.get(rdURL.RepHash); exists {
+		t.Fatal("purged file is still indexed")
+	}
+}
+
+func TestSoftDeleteSurvivesReopen(t *testing.T) {
+	dataDir := t.TempDir()
+	rfs, err := NewRandomFSWithoutIPFS(dataDir, 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFSWithoutIPFS: %v", err)
+	}
+	rfs.DeleteGracePeriod = time.Hour
+	rdURL, err := rfs.StoreFile("keep.txt", []byte("keep"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	if err := rfs.DeleteFile(rdURL.RepHash); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	rfs.Close()
+
+	rfs, err = NewRandomFSWithoutIPFS(dataDir, 16*1024*1024)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer rfs.Close()
+	rfs.DeleteGracePeriod = time.Hour
+
+	if err := rfs.RestoreFile(rdURL.RepHash); err != nil {
+		t.Fatalf("RestoreFile after reopen: %v", err)
+	}
+	if files := rfs.ListFiles(); len(files) != 1 {
+		t.Fatalf("expected the restored file to be listed, got %d files", len(files))
+	}
+}
+
+// backdate rewrites the stored time of an indexed file
+func backdate(t *testing.T, rfs *RandomFS, repHash string, storedAt time.Time) {
+	t.Helper()
+	entry, exists := rfs.index.get(repHash)
+	if !exists {
+		t.Fatalf("%s is not indexed", repHash)
+	}
+	backdated := *entry
+	backdated.StoredAt = storedAt
+	if err := rfs.index.put(&backdated); err != nil {
+		t.Fatalf("index put: %v", err)
+	}
+}
+
+func TestPruneOlderThanKeepsNewerFilesAndSharedBlocks(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	cutoff := time.Now().Add(-24 * time.Hour)
+
+	old, err := rfs.StoreFile("old.txt", []byte("stale contents"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	oldRep, _ := rfs.loadRepresentation(old.RepHash)
+	backdate(t, rfs, old.RepHash, cutoff.Add(-time.Hour))
+
+	alsoOld, err := rfs.StoreFile("also-old.txt", []byte("more stale contents"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	backdate(t, rfs, alsoOld.RepHash, cutoff.Add(-2*time.Hour))
+
+	newer, _ := storeSharingRandomizer(t, rfs, oldRep, []byte("fresh contents"), time.Time{})
+
+	listed := rfs.ListFilesOlderThan(cutoff)
+	if len(listed) != 2 || listed[0].RepHash != alsoOld.RepHash || listed[1].RepHash != old.RepHash {
+		t.Fatalf("expected the two old files oldest first, got %+v", listed)
+	}
+
+	result, err := rfs.PruneOlderThan(cutoff)
+	if err != nil {
+		t.Fatalf("PruneOlderThan: %v", err)
+	}
+	if len(result.Pruned) != 2 {
+		t.Fatalf("expected 2 pruned files, got %v", result.Pruned)
+	}
+	// Two blocks each, less the randomizer the newer file still uses
+	if want := int64(3 * NanoBlockSize); result.BytesReclaimed != want {
+		t.Fatalf("expected %d bytes reclaimed, got %d", want, result.BytesReclaimed)
+	}
+
+	files := rfs.ListFiles()
+	if len(files) != 1 || files[0].RepHash != newer {
+		t.Fatalf("expected only the newer file to remain, got %+v", files)
+	}
+	data, _, err := rfs.RetrieveFile(newer)
+	if err != nil {
+		t.Fatalf("newer file lost its shared randomizer: %v", err)
+	}
+	if string(data) != "fresh contents" {
+		t.Fatalf("unexpected contents %q", data)
+	}
+	if _, _, err := rfs.RetrieveFile(old.RepHash); err == nil {
+		t.Fatal("expected the pruned file to be gone")
+	}
+}
+
+func TestPruneOlderThanSoftDeletesWithGracePeriod(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	rfs.DeleteGracePeriod = time.Hour
+
+	rdURL, err := rfs.StoreFile("old.txt", []byte("stale contents"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	backdate(t, rfs, rdURL.RepHash, time.Now().Add(-48*time.Hour))
+
+	result, err := rfs.PruneOlderThan(time.Now().Add(-24 * time.Hour))
+	if err != nil {
+		t.Fatalf("PruneOlderThan: %v", err)
+	}
+	if len(result.Pruned) != 1 || result.BytesReclaimed != 0 {
+		t.Fatalf("expected one soft-deleted file and nothing reclaimed, got %+v", result)
+	}
+	if len(rfs.ListFiles()) != 0 {
+		t.Fatal("expected the pruned file to be hidden")
+	}
+	if err := rfs.RestoreFile(rdURL.RepHash); err != nil {
+		t.Fatalf("RestoreFile: %v", err)
+	}
+}
+
+func TestDeleteFileKeepsRandomizersSharedWithOtherFiles(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	defer rfs.Close()
+
+	first, err := rfs.StoreFile("first.bin", bytes.Repeat([]byte("first "), 1000), "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	secondData := bytes.Repeat([]byte("second "), 1000)
+	second, err := rfs.StoreFileWithRandomizers("second.bin", secondData, "application/octet-stream", 1)
+	if err != nil {
+		t.Fatalf("StoreFileWithRandomizers: %v", err)
+	}
+	firstRep, err := rfs.loadRepresentation(first.RepHash)
+	if err != nil {
+		t.Fatalf("loadRepresentation: %v", err)
+	}
+	secondRep, err := rfs.loadRepresentation(second.RepHash)
+	if err != nil {
+		t.Fatalf("loadRepresentation: %v", err)
+	}
+	kept := make(map[string]bool)
+	for _, hash := range representationBlocks(secondRep) {
+		kept[hash] = true
+	}
+	shared := 0
+	for _, hash := range representationBlocks(firstRep) {
+		if kept[hash] {
+			shared++
+		}
+	}
+	if shared == 0 {
+		t.Fatal("the files share no blocks")
+	}
+
+	if err := rfs.DeleteFile(first.RepHash); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	for _, hash := range representationBlocks(firstRep) {
+		_, err := rfs.retrieveLocal(hash)
+		if kept[hash] && err != nil {
+			t.Fatalf("shared block %s was released", hash)
+		}
+		if !kept[hash] && err == nil {
+			t.Errorf("block %s only the deleted file used was kept", hash)
+		}
+	}
+
+	rfs.Cache().Clear()
+	if data, _, err := rfs.RetrieveFile(second.RepHash); err != nil || !bytes.Equal(data, secondData) {
+		t.Fatalf("file sharing randomizers with the deleted file: %v", err)
+	}
+	if err := rfs.DeleteFile(first.RepHash); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("deleting twice returned %v, want ErrFileNotFound", err)
+	}
+}
+
+func TestBlockRefCountTracksSharing(t *testing.T) {
+	dataDir := t.TempDir()
+	rfs, err := NewRandomFSWithoutIPFS(dataDir, 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFSWithoutIPFS: %v", err)
+	}
+
+	first, err := rfs.StoreFile("first.bin", bytes.Repeat([]byte("first "), 1000), "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	stats := rfs.GetStats()
+	if stats.UniqueBlocks == 0 || stats.UniqueBlocks != stats.BlockReferences {
+		t.Fatalf("one file has %d unique blocks and %d references", stats.UniqueBlocks, stats.BlockReferences)
+	}
+	second, err := rfs.StoreFileWithRandomizers("second.bin", bytes.Repeat([]byte("second "), 1000), "application/octet-stream", 1)
+	if err != nil {
+		t.Fatalf("StoreFileWithRandomizers: %v", err)
+	}
+
+	firstRep, err := rfs.loadRepresentation(first.RepHash)
+	if err != nil {
+		t.Fatalf("loadRepresentation: %v", err)
+	}
+	secondRep, err := rfs.loadRepresentation(second.RepHash)
+	if err != nil {
+		t.Fatalf("loadRepresentation: %v", err)
+	}
+	inSecond := make(map[string]bool)
+	for _, hash := range representationBlocks(secondRep) {
+		inSecond[hash] = true
+	}
+	var shared []string
+	for _, hash := range uniqueHashes(representationBlocks(firstRep)) {
+		want := 1
+		if inSecond[hash] {
+			want = 2
+			shared = append(shared, hash)
+		}
+		if got := rfs.BlockRefCount(hash); got != want {
+			t.Errorf("block %s has %d references, want %d", hash, got, want)
+		}
+	}
+	if len(shared) == 0 {
+		t.Fatal("the files share no blocks")
+	}
+	stats = rfs.GetStats()
+	if saved := stats.BlockReferences - stats.UniqueBlocks; saved != int64(len(shared)) {
+		t.Errorf("stats show %d shared references, want %d", saved, len(shared))
+	}
+
+	// The counts persist with the index
+	rfs.Close()
+	rfs, err = NewRandomFSWithoutIPFS(dataDir, 16*1024*1024)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer rfs.Close()
+	if got := rfs.BlockRefCount(shared[0]); got != 2 {
+		t.Fatalf("reopened index counts %d references, want 2", got)
+	}
+
+	if err := rfs.DeleteFile(first.RepHash); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	if got := rfs.BlockRefCount(shared[0]); got != 1 {
+		t.Errorf("shared block has %d references after one delete, want 1", got)
+	}
+	if err := rfs.DeleteFile(second.RepHash); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	if got := rfs.BlockRefCount(shared[0]); got != 0 {
+		t.Errorf("shared block has %d references after both deletes", got)
+	}
+	if stats := rfs.GetStats(); stats.UniqueBlocks != 0 || stats.BlockReferences != 0 {
+		t.Errorf("empty index reports %d unique blocks, %d references", stats.UniqueBlocks, stats.BlockReferences)
+	}
+}
@@ -0,0 +1,149 @@
+package randomfs
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// journalDirName is the directory in the data directory holding the
+// journals of stores in progress
+const journalDirName = "journal"
+
+// storeJournal records every block a store writes, one hash per line, so
+// a failed or interrupted store can release them instead of leaving
+// orphans. A nil journal records nothing.
+type storeJournal struct {
+	path string
+	file *os.File
+
+	// mutex guards hashes and file, as blocks are stored concurrently
+	mutex  sync.Mutex
+	hashes []string
+}
+
+// beginStore opens a journal for a new store, or returns nil when stores
+// are not transactional
+func (rfs *RandomFS) beginStore() (*storeJournal, error) {
+	if !rfs.Transactional {
+		return nil, nil
+	}
+
+	dir := filepath.Join(rfs.dataDir, journalDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory: %v", err)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate journal id: %v", err)
+	}
+	path := filepath.Join(dir, hex.EncodeToString(id)+".log")
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create journal: %v", err)
+	}
+	return &storeJournal{path: path, file: file}, nil
+}
+
+// record appends a written block to the journal
+func (j *storeJournal) record(hash string) error {
+	if j == nil {
+		return nil
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.hashes = append(j.hashes, hash)
+	if _, err := fmt.Fprintln(j.file, hash); err != nil {
+		return fmt.Errorf("failed to write journal: %v", err)
+	}
+	return nil
+}
+
+// commit discards the journal of a store that completed
+func (j *storeJournal) commit() error {
+	if j == nil {
+		return nil
+	}
+	j.file.Close()
+	if err := os.Remove(j.path); err != nil {
+		return fmt.Errorf("failed to remove journal: %v", err)
+	}
+	return nil
+}
+
+// rollbackStore releases the blocks recorded in j that no indexed file
+// references and discards the journal. If releasing fails the journal is
+// kept so the next open can retry.
+func (rfs *RandomFS) rollbackStore(j *storeJournal) error {
+	if j == nil {
+		return nil
+	}
+	j.file.Close()
+
+	var orphans []string
+	for _, hash := range uniqueHashes(j.hashes) {
+		if _, indexed := rfs.index.get(hash); indexed || rfs.index.references(hash) > 0 {
+			continue
+		}
+		orphans = append(orphans, hash)
+	}
+
+	if err := rfs.releaseBlocks(orphans); err != nil {
+		return fmt.Errorf("failed to release blocks of failed store: %v", err)
+	}
+	if err := os.Remove(j.path); err != nil {
+		return fmt.Errorf("failed to remove journal: %v", err)
+	}
+
+	rfs.log().Info("Rolled back failed store", "blocks", len(orphans))
+	return nil
+}
+
+// recoverJournals rolls back the stores that were interrupted before they
+// committed, for example by a crash
+func (rfs *RandomFS) recoverJournals() error {
+	paths, err := filepath.Glob(filepath.Join(rfs.dataDir, journalDirName, "*.log"))
+	if err != nil {
+		return fmt.Errorf("failed to list journals: %v", err)
+	}
+
+	for _, path := range paths {
+		j, err := readJournal(path)
+		if err != nil {
+			return err
+		}
+		if err := rfs.rollbackStore(j); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readJournal loads the hashes recorded in the journal at path
+func readJournal(path string) (*storeJournal, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %v", err)
+	}
+
+	j := &storeJournal{path: path, file: file}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if hash := strings.TrimSpace(scanner.Text()); hash != "" {
+			j.hashes = append(j.hashes, hash)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read journal %s: %v", path, err)
+	}
+	return j, nil
+}
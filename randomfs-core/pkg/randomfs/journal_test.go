@@ -0,0 +1,184 @@
+package randomfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// failingReaderAt serves reads from data until failAfter reads have been
+// made, then fails every read
+type failingReaderAt struct {
+	data      []byte
+	reads     int
+	failAfter int
+}
+
+func (r *failingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.reads++
+	if r.reads > r.failAfter {
+		return 0, errors.New("source went away")
+	}
+	return bytes.NewReader(r.data).ReadAt(p, off)
+}
+
+// blockFiles returns the names of the blocks stored in dataDir
+func blockFiles(t *testing.T, dataDir string) map[string]bool {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Join(dataDir, "blocks"))
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	names := make(map[string]bool)
+	for _, entry := range entries {
+		names[entry.Name()] = true
+	}
+	return names
+}
+
+// journalFiles returns the journals left in dataDir
+func journalFiles(t *testing.T, dataDir string) []string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dataDir, journalDirName, "*.log"))
+	if err != nil {
+		t.Fatalf("Glob: %v", err)
+	}
+	return paths
+}
+
+func TestFailedRepresentationStoreLeavesNoPinnedBlocks(t *testing.T) {
+	mock, server := newCountingIPFS(t)
+	dataDir := t.TempDir()
+	rfs, err := NewRandomFS(server.URL, dataDir, 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFS: %v", err)
+	}
+	defer rfs.Close()
+
+	mock.mutex.Lock()
+	mock.failRepresentations = true
+	mock.mutex.Unlock()
+
+	data := make([]byte, 20*NanoBlockSize)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("rand: %v", err)
+	}
+	if _, err := rfs.StoreFile("doomed.bin", data, "application/octet-stream"); err == nil {
+		t.Fatal("expected the store to fail")
+	}
+
+	mock.mutex.Lock()
+	added, pinned := len(mock.blocks), len(mock.pinned)
+	mock.mutex.Unlock()
+	if added != 40 {
+		t.Fatalf("expected 40 blocks added before the failure, got %d", added)
+	}
+	if pinned != 0 {
+		t.Fatalf("expected no pinned blocks after rollback, got %d", pinned)
+	}
+	if files := rfs.ListFiles(); len(files) != 0 {
+		t.Fatalf("expected nothing indexed, got %d files", len(files))
+	}
+	if journals := journalFiles(t, dataDir); len(journals) != 0 {
+		t.Fatalf("expected the journal to be discarded, got %v", journals)
+	}
+}
+
+func TestFailedBlockStoreKeepsOtherFilesBlocks(t *testing.T) {
+	rfs := newTestRandomFS(t)
+
+	kept, err := rfs.StoreFile("kept.txt", []byte("kept"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	before := blockFiles(t, rfs.dataDir)
+
+	// The hashing scan, the first batch and three more blocks read fine,
+	// so a batch is stored before the failure
+	data := make([]byte, 20*NanoBlockSize)
+	rand.Read(data)
+	source := &failingReaderAt{data: data, failAfter: max(rfs.HashWorkers, rfs.StoreWorkers) + 4}
+	if _, err := rfs.StoreReaderAt("partial.bin", source, int64(len(data)), "application/octet-stream"); err == nil {
+		t.Fatal("expected the store to fail")
+	}
+
+	after := blockFiles(t, rfs.dataDir)
+	if len(after) != len(before) {
+		t.Fatalf("expected %d blocks after rollback, got %d", len(before), len(after))
+	}
+	for name := range before {
+		if !after[name] {
+			t.Fatalf("rollback removed block %s of another file", name)
+		}
+	}
+	if _, _, err := rfs.RetrieveFile(kept.RepHash); err != nil {
+		t.Fatalf("RetrieveFile of the other file: %v", err)
+	}
+}
+
+func TestNonTransactionalStoreLeavesOrphans(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	rfs.Transactional = false
+
+	data := make([]byte, 20*NanoBlockSize)
+	rand.Read(data)
+	source := &failingReaderAt{data: data, failAfter: max(rfs.HashWorkers, rfs.StoreWorkers) + 4}
+	if _, err := rfs.StoreReaderAt("partial.bin", source, int64(len(data)), "application/octet-stream"); err == nil {
+		t.Fatal("expected the store to fail")
+	}
+	if blocks := blockFiles(t, rfs.dataDir); len(blocks) == 0 {
+		t.Fatal("expected orphaned blocks without a journal")
+	}
+}
+
+func TestOpenRollsBackInterruptedStore(t *testing.T) {
+	dataDir := t.TempDir()
+	rfs, err := NewRandomFSWithoutIPFS(dataDir, 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFSWithoutIPFS: %v", err)
+	}
+
+	kept, err := rfs.StoreFile("kept.txt", []byte("kept"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	entry, _ := rfs.index.get(kept.RepHash)
+
+	// Simulate a crash midway through a store that wrote one new block and
+	// shares another with the indexed file
+	journal, err := rfs.beginStore()
+	if err != nil {
+		t.Fatalf("beginStore: %v", err)
+	}
+	orphan, err := rfs.storeBlock(bytes.Repeat([]byte{1}, NanoBlockSize))
+	if err != nil {
+		t.Fatalf("storeBlock: %v", err)
+	}
+	journal.record(orphan)
+	journal.record(entry.Blocks[0])
+	journal.file.Close()
+	rfs.Close()
+
+	rfs, err = NewRandomFSWithoutIPFS(dataDir, 16*1024*1024)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer rfs.Close()
+
+	blocks := blockFiles(t, dataDir)
+	if blocks[orphan] {
+		t.Fatal("the interrupted store's block was not released")
+	}
+	if !blocks[entry.Blocks[0]] {
+		t.Fatal("a block of an indexed file was released")
+	}
+	if journals := journalFiles(t, dataDir); len(journals) != 0 {
+		t.Fatalf("expected the journal to be discarded, got %v", journals)
+	}
+	if _, _, err := rfs.RetrieveFile(kept.RepHash); err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+}
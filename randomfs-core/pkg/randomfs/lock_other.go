@@ -0,0 +1,10 @@
+//go:build !unix
+
+package randomfs
+
+import "io"
+
+// lockDataDir is a no-op on platforms without flock
+func lockDataDir(dataDir string, exclusive bool) (io.Closer, error) {
+	return io.NopCloser(nil), nil
+}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package randomfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// lockDataDir takes an advisory lock on dataDir: exclusive for writers and
+// shared for read-only replicas. Closing the returned file releases it.
+func lockDataDir(dataDir string, exclusive bool) (io.Closer, error) {
+	dir, err := os.Open(dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open data directory: %v", err)
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(dir.Fd()), how|syscall.LOCK_NB); err != nil {
+		dir.Close()
+		return nil, fmt.Errorf("data directory %s is locked by another instance: %v", dataDir, err)
+	}
+	return dir, nil
+}
@@ -0,0 +1,397 @@
+package randomfs
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// GCResult reports what a garbage collection pass removed
+type GCResult struct {
+	Scanned    int   `json:"scanned"`
+	Removed    int   `json:"removed"`
+	FreedBytes int64 `json:"freed_bytes"`
+}
+
+// VerifyFailure describes a stored file that failed verification
+type VerifyFailure struct {
+	RepHash  string `json:"rep_hash"`
+	FileName string `json:"filename"`
+	Error    string `json:"error"`
+}
+
+// VerifyReport summarizes a VerifyAll pass
+type VerifyReport struct {
+	Files   int             `json:"files"`
+	Healthy int             `json:"healthy"`
+	Damaged []VerifyFailure `json:"damaged"`
+}
+
+// Flush drops every cached block and representation and writes the index to disk, returning
+// the number of cached bytes released
+func (rfs *RandomFS) Flush() (int64, error) {
+	rfs.mutex.Lock()
+	defer rfs.mutex.Unlock()
+
+	dropped := rfs.cache.Size()
+	rfs.cache.Clear()
+	if rfs.repCache != nil {
+		dropped += rfs.repCache.Size()
+		rfs.repCache.Clear()
+	}
+	rfs.parsedReps.clear()
+
+	if !rfs.readOnly {
+		rfs.index.mutex.Lock()
+		err := rfs.index.save()
+		rfs.index.mutex.Unlock()
+		if err != nil {
+			return dropped, err
+		}
+	}
+	return dropped, nil
+}
+
+// CollectGarbage removes orphaned blocks: with a local or in-memory block
+// store, every block not referenced by an indexed file; with IPFS, whatever the daemon's
+// repo GC reclaims once deleted files have been unpinned
+func (rfs *RandomFS) CollectGarbage() (*GCResult, error) {
+	if rfs.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	rfs.mutex.Lock()
+	defer rfs.mutex.Unlock()
+
+	if rfs.useIPFS {
+		return rfs.ipfsRepoGC()
+	}
+	lister, ok := rfs.blocks.(blockLister)
+	if !ok {
+		return nil, fmt.Errorf("garbage collection is not supported by %T", rfs.blocks)
+	}
+
+	// Blocks are listed by backend key, whatever form entries use
+	referenced := make(map[string]bool)
+	for _, entry := range rfs.index.list() {
+		referenced[entry.RepHash] = true
+		for _, hash := range entry.Blocks {
+			if key, err := rfs.backendKey(hash); err == nil {
+				referenced[key] = true
+			}
+		}
+	}
+
+	sizes, err := lister.blockSizes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blocks: %v", err)
+	}
+
+	result := &GCResult{Scanned: len(sizes)}
+	for hash, size := range sizes {
+		if referenced[hash] {
+			continue
+		}
+		if err := rfs.blocks.Delete(hash); err != nil {
+			return result, fmt.Errorf("failed to remove block %s: %v", hash, err)
+		}
+		rfs.cache.Delete(hash)
+		rfs.randomizers.remove(hash)
+		result.Removed++
+		result.FreedBytes += size
+	}
+
+	rfs.log().Info("Garbage collection finished", "removed", result.Removed, "scanned", result.Scanned, "bytes", result.FreedBytes)
+	return result, nil
+}
+
+// VerifyFile fetches every block of a stored file from the backend,
+// bypassing the cache, and checks the reconstructed file against its hash
+func (rfs *RandomFS) VerifyFile(repHash string) error {
+	rfs.mutex.RLock()
+	defer rfs.mutex.RUnlock()
+
+	rep, err := rfs.loadRepresentation(repHash)
+	if err != nil {
+		return err
+	}
+
+	var hasher io.Writer = io.Discard
+	var sum func() []byte
+	if rep.FileHash != "" {
+		h, err := newFileHasher(rep.HashAlgorithm)
+		if err != nil {
+			return err
+		}
+		hasher, sum = h, func() []byte { return h.Sum(nil) }
+	}
+
+	for i := range rep.BlockHashes {
+		if data, ok, err := expandSparseBlock(rep, i); ok {
+			if err != nil {
+				return err
+			}
+			hasher.Write(data)
+			continue
+		}
+
+		block, err := rfs.fetchVerifiedBlock(rep.BlockHashes[i], rep.BlockSize)
+		if err != nil {
+			return fmt.Errorf("block %d: %w", i, err)
+		}
+		var randomizers [][]byte
+		for _, ref := range randomizerRefs(rep, i) {
+			randomizer, err := rfs.fetchVerifiedBlock(ref, rep.BlockSize)
+			if err != nil {
+				return fmt.Errorf("randomizer %d: %w", i, err)
+			}
+			randomizers = append(randomizers, randomizer)
+		}
+
+		hasher.Write(rfs.deRandomizeBlock(block, blockDataSize(rep, i), randomizers...))
+	}
+
+	if sum != nil {
+		return verifyFileHash(rep, hex.EncodeToString(sum()))
+	}
+	return nil
+}
+
+// VerifyAll runs VerifyFile on every indexed file
+func (rfs *RandomFS) VerifyAll() *VerifyReport {
+	report := &VerifyReport{Damaged: []VerifyFailure{}}
+	for _, entry := range rfs.index.list() {
+		report.Files++
+		if err := rfs.VerifyFile(entry.RepHash); err != nil {
+			report.Damaged = append(report.Damaged, VerifyFailure{
+				RepHash:  entry.RepHash,
+				FileName: entry.FileName,
+				Error:    err.Error(),
+			})
+			continue
+		}
+		report.Healthy++
+	}
+	return report
+}
+
+// fetchVerifiedBlock reads a block from the backend and verifies it
+// regardless of the VerifyBlocks setting
+func (rfs *RandomFS) fetchVerifiedBlock(hash string, size int) ([]byte, error) {
+	data, err := rfs.fetchBlock(context.Background(), hash)
+	if err != nil {
+		return nil, err
+	}
+	if err := rfs.verifyBlock(hash, data, size); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// ipfsRepoGC asks the IPFS daemon to garbage collect unpinned blocks
+func (rfs *RandomFS) ipfsRepoGC() (*GCResult, error) {
+	resp, err := rfs.ipfsPost(context.Background(), "/api/v0/repo/gc", "", nil)
+	if err != nil {
+		return nil, fmt.Errorf("IPFS repo/gc failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("IPFS repo/gc returned %d: %s", resp.StatusCode, string(msg))
+	}
+
+	result := &GCResult{}
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var removed struct {
+			Key   map[string]string `json:"Key"`
+			Error string            `json:"Error"`
+		}
+		if err := decoder.Decode(&removed); err == io.EOF {
+			break
+		} else if err != nil {
+			return result, fmt.Errorf("failed to decode IPFS repo/gc response: %v", err)
+		}
+		if removed.Error != "" {
+			return result, fmt.Errorf("IPFS repo/gc: %s", removed.Error)
+		}
+		result.Scanned++
+		result.Removed++
+	}
+	return result, nil
+}
+
+// DefaultMaintenanceInterval is how often StartMaintenance runs a pass
+// unless configured otherwise
+const DefaultMaintenanceInterval = time.Hour
+
+// MaintenanceConfig selects what the background maintenance loop does
+type MaintenanceConfig struct {
+	// Interval is the time between passes, DefaultMaintenanceInterval if
+	// zero
+	Interval time.Duration
+	// Repin pins every indexed file again as far as the PinPolicy asks, so
+	// pins removed from the daemon are restored
+	Repin bool
+	// ProbeIPFS checks that the IPFS API answers, updating BackendHealth
+	ProbeIPFS bool
+	// RefreshPopular recomputes the popular block pool
+	RefreshPopular bool
+	// PruneCache drops cached blocks no indexed file references
+	PruneCache bool
+}
+
+// DefaultMaintenanceConfig returns a configuration running every task
+// each DefaultMaintenanceInterval
+func DefaultMaintenanceConfig() MaintenanceConfig {
+	return MaintenanceConfig{
+		Interval:       DefaultMaintenanceInterval,
+		Repin:          true,
+		ProbeIPFS:      true,
+		RefreshPopular: true,
+		PruneCache:     true,
+	}
+}
+
+// MaintenanceReport summarizes one maintenance pass
+type MaintenanceReport struct {
+	FilesRepinned int `json:"files_repinned"`
+	// IPFSHealthy is set when the IPFS API answered the probe
+	IPFSHealthy  bool `json:"ipfs_healthy"`
+	BlocksPruned int  `json:"blocks_pruned"`
+}
+
+// Maintain runs one maintenance pass with the tasks config selects. A
+// failing task does not stop the others; their errors are joined. Tasks
+// that do not apply, such as re-pinning with local storage or on a
+// read-only instance, are skipped.
+func (rfs *RandomFS) Maintain(ctx context.Context, config MaintenanceConfig) (*MaintenanceReport, error) {
+	report := &MaintenanceReport{}
+	var errs []error
+
+	if config.Repin {
+		files, err := rfs.repinFiles(ctx)
+		report.FilesRepinned = files
+		errs = append(errs, err)
+	}
+	if config.ProbeIPFS && rfs.useIPFS && ctx.Err() == nil {
+		err := rfs.testIPFSConnection(ctx)
+		rfs.noteBackendCall("ipfs version", err)
+		report.IPFSHealthy = err == nil
+		if err != nil {
+			errs = append(errs, fmt.Errorf("IPFS probe failed: %v", err))
+		}
+	}
+	if config.RefreshPopular && ctx.Err() == nil {
+		rfs.popular.Refresh()
+	}
+	if config.PruneCache && ctx.Err() == nil {
+		report.BlocksPruned = rfs.pruneCache()
+	}
+	return report, errors.Join(append(errs, ctx.Err())...)
+}
+
+// repinFiles pins the indexed files again as far as the PinPolicy asks and
+// returns the number of files pinned
+func (rfs *RandomFS) repinFiles(ctx context.Context) (int, error) {
+	if rfs.readOnly || !rfs.pinsRepresentations() {
+		return 0, nil
+	}
+
+	rfs.mutex.RLock()
+	defer rfs.mutex.RUnlock()
+
+	var hashes []string
+	var errs []error
+	files := 0
+	for _, entry := range rfs.index.list() {
+		if entry.Deleted() {
+			continue
+		}
+		hashes = append(hashes, entry.RepHash)
+		if rfs.pinsBlocks() {
+			blocks := entry.Blocks
+			// Entries indexed before their blocks were recorded
+			if len(blocks) == 0 {
+				rep, err := rfs.loadRepresentation(entry.RepHash)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("failed to re-pin %s: %v", entry.RepHash, err))
+					continue
+				}
+				blocks = representationBlocks(rep)
+			}
+			hashes = append(hashes, blocks...)
+		}
+		files++
+	}
+	if err := rfs.pinBatches(ctx, "add", uniqueHashes(hashes)); err != nil {
+		return 0, fmt.Errorf("failed to re-pin files: %w", err)
+	}
+	return files, errors.Join(errs...)
+}
+
+// pruneCache drops the cached blocks no indexed file references and
+// returns how many it dropped. A cache shared with other instances may
+// hold their blocks and is left alone.
+func (rfs *RandomFS) pruneCache() int {
+	if rfs.sharedCache {
+		return 0
+	}
+
+	// Stores cache their blocks before indexing the file
+	rfs.mutex.Lock()
+	defer rfs.mutex.Unlock()
+
+	pruned := 0
+	for _, hash := range rfs.cache.hashes() {
+		if rfs.index.references(hash) == 0 {
+			rfs.cache.Delete(hash)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+// StartMaintenance runs Maintain every config.Interval until Close is
+// called. Close cancels a pass in progress and waits for it to return.
+func (rfs *RandomFS) StartMaintenance(config MaintenanceConfig) {
+	interval := config.Interval
+	if interval <= 0 {
+		interval = DefaultMaintenanceInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-rfs.done:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+
+	rfs.background.Add(1)
+	go func() {
+		defer rfs.background.Done()
+		defer cancel()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-rfs.done:
+				return
+			case <-ticker.C:
+			}
+			report, err := rfs.Maintain(ctx, config)
+			if err != nil {
+				rfs.log().Error("Maintenance failed", "error", err)
+			}
+			rfs.log().Info("Maintenance finished", "files_repinned", report.FilesRepinned, "blocks_pruned", report.BlocksPruned)
+		}
+	}()
+}
@@ -0,0 +1,245 @@
+package randomfs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCollectGarbageRemovesOnlyOrphans(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	url, err := rfs.StoreFile("kept.txt", []byte("kept"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+
+	orphan, err := rfs.storeLocal([]byte("left behind by an interrupted store"))
+	if err != nil {
+		t.Fatalf("storeLocal: %v", err)
+	}
+
+	result, err := rfs.CollectGarbage()
+	if err != nil {
+		t.Fatalf("CollectGarbage: %v", err)
+	}
+	if result.Removed != 1 || result.Scanned != 4 {
+		t.Fatalf("expected 1 of 4 blocks removed, got %+v", result)
+	}
+	if _, err := os.Stat(filepath.Join(rfs.dataDir, "blocks", orphan)); !os.IsNotExist(err) {
+		t.Fatal("orphaned block still present")
+	}
+
+	rfs.cache.Clear()
+	if data, _, err := rfs.RetrieveFile(url.RepHash); err != nil || string(data) != "kept" {
+		t.Fatalf("indexed file damaged by GC: %q, %v", data, err)
+	}
+}
+
+func TestVerifyAllReportsDamagedFiles(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	healthy, err := rfs.StoreFile("healthy.txt", []byte("healthy"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	damaged, err := rfs.StoreFile("damaged.txt", []byte("damaged"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+
+	if report := rfs.VerifyAll(); report.Files != 2 || report.Healthy != 2 {
+		t.Fatalf("expected 2 healthy files, got %+v", report)
+	}
+
+	_, rep, err := rfs.RetrieveFile(damaged.RepHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+	if err := os.Remove(filepath.Join(rfs.dataDir, "blocks", rep.BlockHashes[0])); err != nil {
+		t.Fatalf("remove block: %v", err)
+	}
+
+	// The block is still cached, so verification must go to the backend
+	report := rfs.VerifyAll()
+	if report.Healthy != 1 || len(report.Damaged) != 1 {
+		t.Fatalf("expected one damaged file, got %+v", report)
+	}
+	if report.Damaged[0].RepHash != damaged.RepHash || !strings.Contains(report.Damaged[0].Error, "block 0") {
+		t.Fatalf("unexpected failure %+v", report.Damaged[0])
+	}
+	if err := rfs.VerifyFile(healthy.RepHash); err != nil {
+		t.Fatalf("VerifyFile healthy: %v", err)
+	}
+}
+
+func TestFlushDropsCache(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	if _, err := rfs.StoreFile("a.txt", []byte("a"), "text/plain"); err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+
+	dropped, err := rfs.Flush()
+	if err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if dropped != 2*NanoBlockSize {
+		t.Fatalf("expected %d cached bytes dropped, got %d", 2*NanoBlockSize, dropped)
+	}
+	if rfs.cache.Size() != 0 {
+		t.Fatal("cache not empty after Flush")
+	}
+}
+
+func TestVerifyFileBlocksReportsEachBlock(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	data, repHash := storeRandomFile(t, rfs, 4*NanoBlockSize)
+	_, rep, err := rfs.RetrieveFile(repHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+
+	report, err := rfs.VerifyFileBlocks(repHash)
+	if err != nil {
+		t.Fatalf("VerifyFileBlocks: %v", err)
+	}
+	if !report.Healthy() || report.Checked != 8 || report.OK != 8 || len(report.Blocks) != 8 {
+		t.Fatalf("healthy file reported as %+v", report)
+	}
+	for _, block := range report.Blocks {
+		if !block.Cached {
+			t.Errorf("block %s was fetched although cached", block.Hash)
+		}
+	}
+
+	// Lose the randomizer of block 1 and corrupt data block 2
+	rfs.Cache().Clear()
+	blocksDir := filepath.Join(rfs.dataDir, "blocks")
+	if err := os.Remove(filepath.Join(blocksDir, rep.RandomizerHashes[1])); err != nil {
+		t.Fatalf("remove randomizer: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(blocksDir, rep.BlockHashes[2]), data[:NanoBlockSize], 0644); err != nil {
+		t.Fatalf("corrupt block: %v", err)
+	}
+	fetchesBefore := rfs.GetStats().FilesRetrieved
+
+	report, err = rfs.VerifyFileBlocks(repHash)
+	if err != nil {
+		t.Fatalf("VerifyFileBlocks: %v", err)
+	}
+	if report.Healthy() || report.OK != 6 || report.Missing != 1 || report.Corrupt != 1 {
+		t.Fatalf("damaged file reported as %+v", report)
+	}
+	for _, block := range report.Blocks {
+		want := BlockOK
+		switch {
+		case block.Kind == blockKindRandomizer && block.Index == 1:
+			want = BlockMissing
+		case block.Kind == blockKindData && block.Index == 2:
+			want = BlockCorrupt
+		}
+		if block.Status != want || (want != BlockOK) != (block.Error != "") {
+			t.Errorf("%s %d reported %s (%s), want %s", block.Kind, block.Index, block.Status, block.Error, want)
+		}
+	}
+	if rfs.GetStats().FilesRetrieved != fetchesBefore || rfs.Cache().Size() != 0 {
+		t.Error("verification reconstructed the file or cached its blocks")
+	}
+
+	if _, err := rfs.VerifyFileBlocks("QmMissing"); err == nil {
+		t.Error("VerifyFileBlocks of an unknown representation succeeded")
+	}
+}
+
+func TestMaintainRepinsFilesAndProbesIPFS(t *testing.T) {
+	mock, rfs, rep, repHash := newPinTestRandomFS(t)
+	deleted, err := rfs.StoreFile("deleted.txt", []byte("deleted"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	if err := rfs.DeleteFile(deleted.RepHash); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	mock.resetPins()
+
+	report, err := rfs.Maintain(context.Background(), MaintenanceConfig{Repin: true, ProbeIPFS: true})
+	if err != nil {
+		t.Fatalf("Maintain: %v", err)
+	}
+	if report.FilesRepinned != 1 || !report.IPFSHealthy {
+		t.Errorf("maintenance reported %+v", report)
+	}
+	for _, hash := range append([]string{repHash}, representationBlocks(rep)...) {
+		if !mock.isPinned(hash) {
+			t.Fatalf("%s was not re-pinned", hash)
+		}
+	}
+	if mock.isPinned(deleted.RepHash) {
+		t.Error("a deleted file was re-pinned")
+	}
+
+	// Without block pins only representations are pinned again
+	mock.resetPins()
+	rfs.PinPolicy = PinRepresentationOnly
+	if _, err := rfs.Maintain(context.Background(), MaintenanceConfig{Repin: true}); err != nil {
+		t.Fatalf("Maintain: %v", err)
+	}
+	if !mock.isPinned(repHash) || mock.isPinned(rep.BlockHashes[0]) {
+		t.Error("representation-only policy re-pinned the wrong hashes")
+	}
+}
+
+func TestMaintainPrunesUnreferencedCacheEntries(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	url, err := rfs.StoreFile("kept.txt", []byte("kept"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	rep, err := rfs.GetRepresentation(url.RepHash)
+	if err != nil {
+		t.Fatalf("GetRepresentation: %v", err)
+	}
+	rfs.cache.Put("orphan", make([]byte, NanoBlockSize))
+
+	report, err := rfs.Maintain(context.Background(), MaintenanceConfig{PruneCache: true, RefreshPopular: true})
+	if err != nil {
+		t.Fatalf("Maintain: %v", err)
+	}
+	if report.BlocksPruned != 1 || rfs.cache.Contains("orphan") {
+		t.Errorf("pruned %d blocks, orphan cached: %v", report.BlocksPruned, rfs.cache.Contains("orphan"))
+	}
+	for _, hash := range representationBlocks(rep) {
+		if !rfs.cache.Contains(hash) {
+			t.Errorf("referenced block %s was pruned", hash)
+		}
+	}
+}
+
+func TestStartMaintenanceStopsOnClose(t *testing.T) {
+	rfs, err := NewRandomFSWithoutIPFS(t.TempDir(), 1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFSWithoutIPFS: %v", err)
+	}
+	rfs.cache.Put("orphan", make([]byte, NanoBlockSize))
+	rfs.StartMaintenance(MaintenanceConfig{Interval: 10 * time.Millisecond, PruneCache: true})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for rfs.cache.Contains("orphan") {
+		if time.Now().After(deadline) {
+			t.Fatal("maintenance never pruned the cache")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	closed := make(chan error)
+	go func() { closed <- rfs.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not stop the maintenance loop")
+	}
+}
@@ -0,0 +1,39 @@
+package randomfs
+
+import "time"
+
+// Operations reported to a MetricsObserver
+const (
+	OpIPFSAdd  = "add"
+	OpIPFSCat  = "cat"
+	OpStore    = "store"
+	OpRetrieve = "retrieve"
+)
+
+// MetricsObserver receives the latency of IPFS calls and of whole stores
+// and retrievals, for export to a metrics system. Counts such as the files
+// stored are kept in Stats. Observers are called from many goroutines at
+// once.
+type MetricsObserver interface {
+	// ObserveIPFSCall reports an IPFS add or cat, including any retries
+	ObserveIPFSCall(op string, duration time.Duration, err error)
+	// ObserveOperation reports a store or retrieval of a file from start
+	// to finish. A streamed retrieval finishes when its stream is closed.
+	ObserveOperation(op string, duration time.Duration, err error)
+}
+
+// observeIPFSCall reports an IPFS call started at start to the Metrics
+// observer, if set
+func (rfs *RandomFS) observeIPFSCall(op string, start time.Time, err error) {
+	if rfs.Metrics != nil {
+		rfs.Metrics.ObserveIPFSCall(op, time.Since(start), err)
+	}
+}
+
+// observeOperation reports a store or retrieval started at start to the
+// Metrics observer, if set
+func (rfs *RandomFS) observeOperation(op string, start time.Time, err error) {
+	if rfs.Metrics != nil {
+		rfs.Metrics.ObserveOperation(op, time.Since(start), err)
+	}
+}
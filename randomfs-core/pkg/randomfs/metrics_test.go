@@ -0,0 +1,103 @@
+package randomfs
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TheEntropyCollective/randomfs-core/internal/ipfstest"
+)
+
+// observation is a call recorded by recordingObserver
+type observation struct {
+	op       string
+	duration time.Duration
+	failed   bool
+}
+
+// recordingObserver records the observations it receives
+type recordingObserver struct {
+	mutex      sync.Mutex
+	ipfsCalls  []observation
+	operations []observation
+}
+
+func (o *recordingObserver) ObserveIPFSCall(op string, duration time.Duration, err error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.ipfsCalls = append(o.ipfsCalls, observation{op, duration, err != nil})
+}
+
+func (o *recordingObserver) ObserveOperation(op string, duration time.Duration, err error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.operations = append(o.operations, observation{op, duration, err != nil})
+}
+
+// countObserved returns the observations in list of op that failed as given
+func countObserved(list []observation, op string, failed bool) int {
+	n := 0
+	for _, o := range list {
+		if o.op == op && o.failed == failed {
+			n++
+		}
+	}
+	return n
+}
+
+func TestMetricsObserverReceivesLatencies(t *testing.T) {
+	ipfs := ipfstest.NewServer(t)
+	ipfs.SetCatDelay(5 * time.Millisecond)
+	rfs, err := NewRandomFS(ipfs.APIURL(), t.TempDir(), 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFS: %v", err)
+	}
+	defer rfs.Close()
+	rfs.IPFSRetry = RetryPolicy{}
+	observer := &recordingObserver{}
+	rfs.Metrics = observer
+
+	rdURL, err := rfs.StoreFile("observed.txt", []byte("observed by metrics"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	rfs.Cache().Clear()
+	if _, _, err := rfs.RetrieveFile(rdURL.RepHash); err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+	stream, _, err := rfs.RetrieveFileStream(rdURL.RepHash)
+	if err != nil {
+		t.Fatalf("RetrieveFileStream: %v", err)
+	}
+	if _, err := io.ReadAll(stream); err != nil {
+		t.Fatalf("reading stream: %v", err)
+	}
+	stream.Close()
+	stream.Close()
+	rfs.Cache().Clear()
+	ipfs.FailCats(true)
+	if _, _, err := rfs.RetrieveFile(rdURL.RepHash); err == nil {
+		t.Fatal("RetrieveFile succeeded with cats failing")
+	}
+
+	observer.mutex.Lock()
+	defer observer.mutex.Unlock()
+	stats := rfs.GetStats()
+	if n := countObserved(observer.ipfsCalls, OpIPFSAdd, false); int64(n) != stats.IPFSAddTotal {
+		t.Errorf("observed %d adds, stats count %d", n, stats.IPFSAddTotal)
+	}
+	if countObserved(observer.ipfsCalls, OpIPFSCat, false) == 0 || countObserved(observer.ipfsCalls, OpIPFSCat, true) == 0 {
+		t.Errorf("cats not observed by outcome: %+v", observer.ipfsCalls)
+	}
+	for _, o := range observer.ipfsCalls {
+		if o.op == OpIPFSCat && !o.failed && o.duration < 5*time.Millisecond {
+			t.Errorf("cat observed taking %v, less than the daemon's delay", o.duration)
+		}
+	}
+	if countObserved(observer.operations, OpStore, false) != 1 ||
+		countObserved(observer.operations, OpRetrieve, false) != 2 ||
+		countObserved(observer.operations, OpRetrieve, true) != 1 {
+		t.Errorf("operations observed: %+v", observer.operations)
+	}
+}
@@ -0,0 +1,153 @@
+package randomfs
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// EncryptionChaCha20Poly1305 is the Encryption of files stored with a
+// password: each block is sealed with ChaCha20-Poly1305 under a key
+// derived from the password with Argon2id
+const EncryptionChaCha20Poly1305 = "chacha20-poly1305"
+
+// Argon2id parameters of the password key, the second recommended option
+// of RFC 9106
+const (
+	passwordKeyTime    = 1
+	passwordKeyMemory  = 64 * 1024
+	passwordKeyThreads = 4
+	passwordSaltSize   = 16
+)
+
+// ErrPasswordRequired is returned when a file stored with a password is
+// retrieved without one
+var ErrPasswordRequired = errors.New("file is encrypted with a password")
+
+// ErrWrongPassword is returned when the blocks of a file do not decrypt
+// with the password given
+var ErrWrongPassword = errors.New("file does not decrypt with the password")
+
+// encrypted reports whether the blocks of rep hold data sealed with a
+// password
+func (rep *FileRepresentation) encrypted() bool {
+	return rep.Encryption != ""
+}
+
+// checkNoPassword rejects a file whose blocks can only be read with a
+// password, for the retrieval paths that take none
+func checkNoPassword(rep *FileRepresentation) error {
+	if rep.encrypted() {
+		return fmt.Errorf("%w: %s", ErrPasswordRequired, rep.FileName)
+	}
+	return nil
+}
+
+// passwordAEAD returns the cipher blocks are sealed with for password
+// and salt
+func passwordAEAD(password string, salt []byte) (cipher.AEAD, error) {
+	key := argon2.IDKey([]byte(password), salt, passwordKeyTime, passwordKeyMemory, passwordKeyThreads, chacha20poly1305.KeySize)
+	return chacha20poly1305.New(key)
+}
+
+// positionNonce returns the nonce of block i. Each block of a file is
+// sealed under its own position, so blocks cannot be reordered.
+func positionNonce(i int) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[chacha20poly1305.NonceSize-8:], uint64(i))
+	return nonce
+}
+
+// positionData returns the additional data of a block, which marks the
+// last one so the file cannot be cut short at a block boundary
+func positionData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// sealBlocks encrypts data for blocks of blockSize bytes: every blockSize
+// less the AEAD overhead bytes of data are sealed into exactly one block.
+// Empty data still yields one sealed block, so a wrong password is caught
+// for empty files too. It returns the sealed data and the random salt the
+// key was derived with.
+func sealBlocks(data []byte, password string, blockSize int) ([]byte, []byte, error) {
+	salt := make([]byte, passwordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate salt: %v", err)
+	}
+	aead, err := passwordAEAD(password, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	chunk := blockSize - aead.Overhead()
+	if chunk <= 0 {
+		return nil, nil, fmt.Errorf("block size %d is too small to encrypt", blockSize)
+	}
+
+	blocks := max((len(data)+chunk-1)/chunk, 1)
+	sealed := make([]byte, 0, len(data)+blocks*aead.Overhead())
+	for i := 0; i < blocks; i++ {
+		plain := data[i*chunk : min((i+1)*chunk, len(data))]
+		sealed = aead.Seal(sealed, positionNonce(i), plain, positionData(i == blocks-1))
+	}
+	return sealed, salt, nil
+}
+
+// openBlocks decrypts the reconstructed data of a file stored with a
+// password
+func openBlocks(rep *FileRepresentation, sealed []byte, password string) ([]byte, error) {
+	if rep.Encryption != EncryptionChaCha20Poly1305 {
+		return nil, fmt.Errorf("unknown encryption %q for %s", rep.Encryption, rep.FileName)
+	}
+	salt, err := hex.DecodeString(rep.PasswordSalt)
+	if err != nil || len(salt) != passwordSaltSize {
+		return nil, fmt.Errorf("invalid password salt for %s", rep.FileName)
+	}
+	aead, err := passwordAEAD(password, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := max((len(sealed)+rep.BlockSize-1)/rep.BlockSize, 1)
+	if len(sealed) < blocks*aead.Overhead() {
+		return nil, fmt.Errorf("%w: %s is truncated", ErrWrongPassword, rep.FileName)
+	}
+	data := make([]byte, 0, len(sealed)-blocks*aead.Overhead())
+	for i := 0; i < blocks; i++ {
+		block := sealed[i*rep.BlockSize : min((i+1)*rep.BlockSize, len(sealed))]
+		if data, err = aead.Open(data, positionNonce(i), block, positionData(i == blocks-1)); err != nil {
+			return nil, fmt.Errorf("%w: block %d of %s", ErrWrongPassword, i, rep.FileName)
+		}
+	}
+	return data, nil
+}
+
+// StoreFileWithPassword stores a file encrypted with password. Each block
+// is sealed with ChaCha20-Poly1305 before it is anonymized, under a key
+// derived from the password and a random salt and a nonce taken from the
+// block's position, so the reconstructed blocks are useless without the
+// password. Such files are only read with RetrieveFileWithPassword, and
+// are never deduplicated against other stores.
+func (rfs *RandomFS) StoreFileWithPassword(filename string, data []byte, contentType, password string) (*RandomURL, error) {
+	if password == "" {
+		return nil, errors.New("password must not be empty")
+	}
+	return rfs.storeBytes(context.Background(), filename, data, contentType, storeOptions{password: password})
+}
+
+// RetrieveFileWithPassword reconstructs a file stored with
+// StoreFileWithPassword, failing with ErrWrongPassword if password is not
+// the one it was stored with. Files stored without a password are
+// returned as by RetrieveFile.
+func (rfs *RandomFS) RetrieveFileWithPassword(repHash, password string) ([]byte, *FileRepresentation, error) {
+	return rfs.retrieveFile(context.Background(), repHash, password)
+}
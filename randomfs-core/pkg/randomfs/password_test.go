@@ -0,0 +1,90 @@
+package randomfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestStoreFileWithPassword(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	data := make([]byte, 3*NanoBlockSize+100)
+	rand.Read(data)
+
+	rdURL, err := rfs.StoreFileWithPassword("secret.bin", data, "application/octet-stream", "correct horse")
+	if err != nil {
+		t.Fatalf("StoreFileWithPassword: %v", err)
+	}
+	rep, err := rfs.GetRepresentation(rdURL.RepHash)
+	if err != nil {
+		t.Fatalf("GetRepresentation: %v", err)
+	}
+	if rep.Encryption != EncryptionChaCha20Poly1305 || rep.PasswordSalt == "" || rep.FileSize != int64(len(data)) {
+		t.Fatalf("representation records encryption %q, salt %q, size %d", rep.Encryption, rep.PasswordSalt, rep.FileSize)
+	}
+
+	rfs.Cache().Clear()
+	got, _, err := rfs.RetrieveFileWithPassword(rdURL.RepHash, "correct horse")
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("RetrieveFileWithPassword returned %d bytes: %v", len(got), err)
+	}
+
+	if _, _, err := rfs.RetrieveFileWithPassword(rdURL.RepHash, "battery staple"); !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("retrieving with the wrong password returned %v", err)
+	}
+	if _, _, err := rfs.RetrieveFile(rdURL.RepHash); !errors.Is(err, ErrPasswordRequired) {
+		t.Errorf("RetrieveFile of an encrypted file returned %v", err)
+	}
+	if _, err := rfs.OpenFileStream(rdURL.RepHash); !errors.Is(err, ErrPasswordRequired) {
+		t.Errorf("OpenFileStream of an encrypted file returned %v", err)
+	}
+
+	// Without the password the reconstructed blocks are not the file
+	var sealed bytes.Buffer
+	if err := rfs.writeBlocks(context.Background(), rep, 0, &sealed); err != nil {
+		t.Fatalf("writeBlocks: %v", err)
+	}
+	if sealed.Len() != int(rep.StoredSize) || bytes.Contains(sealed.Bytes(), data[:64]) {
+		t.Errorf("reconstructed %d bytes containing the plaintext", sealed.Len())
+	}
+}
+
+func TestPasswordFilesAreNotDeduplicated(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	data := []byte("the same text twice")
+
+	plain, err := rfs.StoreFile("plain.txt", data, "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	first, err := rfs.StoreFileWithPassword("secret.txt", data, "text/plain", "one")
+	if err != nil {
+		t.Fatalf("StoreFileWithPassword: %v", err)
+	}
+	second, err := rfs.StoreFileWithPassword("secret.txt", data, "text/plain", "two")
+	if err != nil {
+		t.Fatalf("StoreFileWithPassword: %v", err)
+	}
+	if first.RepHash == plain.RepHash || first.RepHash == second.RepHash {
+		t.Fatal("an encrypted file shares its representation with another store")
+	}
+	for password, repHash := range map[string]string{"one": first.RepHash, "two": second.RepHash} {
+		if got, _, err := rfs.RetrieveFileWithPassword(repHash, password); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("RetrieveFileWithPassword(%q) returned %q: %v", password, got, err)
+		}
+	}
+
+	// An empty file still checks its password
+	empty, err := rfs.StoreFileWithPassword("empty.txt", nil, "text/plain", "one")
+	if err != nil {
+		t.Fatalf("StoreFileWithPassword: %v", err)
+	}
+	if _, _, err := rfs.RetrieveFileWithPassword(empty.RepHash, "two"); !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("retrieving an empty file with the wrong password returned %v", err)
+	}
+	if _, err := rfs.StoreFileWithPassword("none.txt", data, "text/plain", ""); err == nil {
+		t.Error("accepted an empty password")
+	}
+}
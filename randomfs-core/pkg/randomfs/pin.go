@@ -0,0 +1,167 @@
+package randomfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// PinPolicy selects what stores pin with IPFS, keeping it from being
+// reclaimed by the garbage collection of the daemon
+type PinPolicy int
+
+// Pin policies applied when storing to IPFS
+const (
+	// PinAll pins the representation and every block of each stored file
+	PinAll PinPolicy = iota
+	// PinRepresentationOnly pins only representations. Representations do
+	// not link their blocks, so blocks survive garbage collection only
+	// while pinned by another file or by PinFile.
+	PinRepresentationOnly
+	// PinNone pins nothing, leaving files to PinFile or to the daemon
+	PinNone
+)
+
+// String returns the name of the policy
+func (p PinPolicy) String() string {
+	switch p {
+	case PinAll:
+		return "all"
+	case PinRepresentationOnly:
+		return "representation-only"
+	case PinNone:
+		return "none"
+	}
+	return fmt.Sprintf("PinPolicy(%d)", int(p))
+}
+
+// ParsePinPolicy returns the policy named name, as returned by String
+func ParsePinPolicy(name string) (PinPolicy, error) {
+	for _, policy := range []PinPolicy{PinAll, PinRepresentationOnly, PinNone} {
+		if policy.String() == name {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown pin policy %q", name)
+}
+
+// pinsRepresentations reports whether stores pin representations
+func (rfs *RandomFS) pinsRepresentations() bool {
+	return rfs.useIPFS && rfs.PinPolicy != PinNone
+}
+
+// pinsBlocks reports whether stores pin blocks
+func (rfs *RandomFS) pinsBlocks() bool {
+	return rfs.useIPFS && rfs.PinPolicy == PinAll
+}
+
+// errNotPinned is returned by doIPFSPin when pin/rm names a hash that is
+// not pinned
+var errNotPinned = errors.New("not pinned")
+
+// PinFile pins a stored file's representation and all of its blocks in
+// batches of PinBatchSize hashes, running up to PinConcurrency calls at
+// once, whatever the PinPolicy. Pinning is idempotent, so it also re-pins
+// files stored under a narrower policy or whose pins were removed. It is a
+// no-op with local storage.
+func (rfs *RandomFS) PinFile(repHash string) error {
+	if !rfs.useIPFS {
+		return nil
+	}
+
+	rfs.mutex.RLock()
+	defer rfs.mutex.RUnlock()
+
+	rep, err := rfs.loadRepresentation(repHash)
+	if err != nil {
+		return err
+	}
+
+	hashes := uniqueHashes(append([]string{repHash}, representationBlocks(rep)...))
+	return rfs.pinBatches(context.Background(), "add", hashes)
+}
+
+// UnpinFile removes the pins on a stored file's representation and on the
+// blocks no other indexed file references, so the IPFS daemon may reclaim
+// them. The file stays indexed. It is a no-op with local storage.
+func (rfs *RandomFS) UnpinFile(repHash string) error {
+	if rfs.readOnly {
+		return ErrReadOnly
+	}
+	if !rfs.useIPFS {
+		return nil
+	}
+
+	rfs.mutex.Lock()
+	defer rfs.mutex.Unlock()
+
+	rep, err := rfs.loadRepresentation(repHash)
+	if err != nil {
+		return err
+	}
+
+	// Blocks referenced by any indexed file other than this one stay pinned
+	own := 0
+	if _, indexed := rfs.index.get(repHash); indexed {
+		own = 1
+	}
+
+	hashes := []string{repHash}
+	for _, hash := range uniqueHashes(representationBlocks(rep)) {
+		if rfs.index.references(hash) > own {
+			continue
+		}
+		hashes = append(hashes, hash)
+	}
+	return rfs.pinBatches(context.Background(), "rm", hashes)
+}
+
+// pinBatches runs pin/add or pin/rm over hashes in batches of PinBatchSize,
+// with up to PinConcurrency batches in flight
+func (rfs *RandomFS) pinBatches(ctx context.Context, op string, hashes []string) error {
+	batchSize := rfs.PinBatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultPinBatchSize
+	}
+
+	var group errgroup.Group
+	if rfs.PinConcurrency > 0 {
+		group.SetLimit(rfs.PinConcurrency)
+	}
+
+	for start := 0; start < len(hashes); start += batchSize {
+		batch := hashes[start:min(start+batchSize, len(hashes))]
+		group.Go(func() error {
+			err := rfs.ipfsPin(ctx, op, batch)
+			if !errors.Is(err, errNotPinned) || len(batch) == 1 {
+				return err
+			}
+			// pin/rm rejects the whole batch if any hash is not pinned;
+			// fall back to one call per hash, which ignores those
+			for _, hash := range batch {
+				if err := rfs.unpinFromIPFS(ctx, hash); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return group.Wait()
+}
+
+// uniqueHashes returns hashes without duplicates, keeping the first
+// occurrence of each
+func uniqueHashes(hashes []string) []string {
+	seen := make(map[string]bool, len(hashes))
+	unique := make([]string, 0, len(hashes))
+	for _, hash := range hashes {
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		unique = append(unique, hash)
+	}
+	return unique
+}
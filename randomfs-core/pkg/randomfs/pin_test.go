@@ -0,0 +1,227 @@
+package randomfs
+
+import (
+	"fmt"
+	"testing"
+)
+
+// newPinTestRandomFS stores a many-block file against a counting IPFS mock
+// and returns it with its pins cleared
+func newPinTestRandomFS(tb testing.TB) (*countingIPFS, *RandomFS, *FileRepresentation, string) {
+	tb.Helper()
+	mock, server := newCountingIPFS(tb)
+	rfs, err := NewRandomFS(server.URL, tb.TempDir(), 16*1024*1024)
+	if err != nil {
+		tb.Fatalf("NewRandomFS: %v", err)
+	}
+	tb.Cleanup(func() { rfs.Close() })
+
+	_, repHash := storeRandomFile(tb, rfs, 90*1024+17)
+	rep, err := rfs.loadRepresentation(repHash)
+	if err != nil {
+		tb.Fatalf("loadRepresentation: %v", err)
+	}
+	mock.resetPins()
+	return mock, rfs, rep, repHash
+}
+
+func TestPinFilePinsEveryHashInBatches(t *testing.T) {
+	mock, rfs, rep, repHash := newPinTestRandomFS(t)
+	rfs.PinBatchSize = 50
+	before := rfs.GetStats().IPFSPinTotal
+
+	if err := rfs.PinFile(repHash); err != nil {
+		t.Fatalf("PinFile: %v", err)
+	}
+
+	expected := append([]string{repHash}, representationBlocks(rep)...)
+	for _, hash := range expected {
+		if !mock.isPinned(hash) {
+			t.Fatalf("%s was not pinned", hash)
+		}
+	}
+
+	unique := len(uniqueHashes(expected))
+	if want := (unique + 49) / 50; mock.pinCalls != want {
+		t.Fatalf("expected %d pin calls for %d hashes, got %d", want, unique, mock.pinCalls)
+	}
+	if total := rfs.GetStats().IPFSPinTotal - before; total != int64(mock.pinCalls) {
+		t.Fatalf("expected IPFSPinTotal %d, got %d", mock.pinCalls, total)
+	}
+}
+
+func TestUnpinFileRemovesPinsInBatches(t *testing.T) {
+	mock, rfs, rep, repHash := newPinTestRandomFS(t)
+	if err := rfs.PinFile(repHash); err != nil {
+		t.Fatalf("PinFile: %v", err)
+	}
+
+	// A hash that is already unpinned must not fail its batch
+	mock.mutex.Lock()
+	delete(mock.pinned, rep.BlockHashes[3])
+	mock.pinCalls = 0
+	mock.mutex.Unlock()
+	errorsBefore := rfs.GetStats().IPFSPinErrors
+
+	if err := rfs.UnpinFile(repHash); err != nil {
+		t.Fatalf("UnpinFile: %v", err)
+	}
+	for _, hash := range append([]string{repHash}, representationBlocks(rep)...) {
+		if mock.isPinned(hash) {
+			t.Fatalf("%s is still pinned", hash)
+		}
+	}
+	if errors := rfs.GetStats().IPFSPinErrors - errorsBefore; errors != 1 {
+		t.Fatalf("expected the rejected batch to count one pin error, got %d", errors)
+	}
+
+	if _, _, err := rfs.RetrieveFile(repHash); err != nil {
+		t.Fatalf("file should stay retrievable until the daemon collects it: %v", err)
+	}
+}
+
+func TestUnpinFileKeepsSharedBlocksPinned(t *testing.T) {
+	mock, server := newCountingIPFS(t)
+	rfs, err := NewRandomFS(server.URL, t.TempDir(), 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFS: %v", err)
+	}
+	defer rfs.Close()
+	rfs.RandomizerPolicy = AlwaysReusePolicy
+
+	first, err := rfs.StoreFile("first.txt", []byte("first file"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	second, err := rfs.StoreFile("second.txt", []byte("second file"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	rep, err := rfs.loadRepresentation(second.RepHash)
+	if err != nil {
+		t.Fatalf("loadRepresentation: %v", err)
+	}
+
+	if err := rfs.UnpinFile(first.RepHash); err != nil {
+		t.Fatalf("UnpinFile: %v", err)
+	}
+	for _, hash := range representationBlocks(rep) {
+		if !mock.isPinned(hash) {
+			t.Fatalf("block %s of another file was unpinned", hash)
+		}
+	}
+}
+
+func TestDeleteFileUnpinsInBatches(t *testing.T) {
+	mock, rfs, rep, repHash := newPinTestRandomFS(t)
+	if err := rfs.PinFile(repHash); err != nil {
+		t.Fatalf("PinFile: %v", err)
+	}
+	mock.mutex.Lock()
+	mock.pinCalls = 0
+	mock.mutex.Unlock()
+
+	if err := rfs.DeleteFile(repHash); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	for _, hash := range append([]string{repHash}, representationBlocks(rep)...) {
+		if mock.isPinned(hash) {
+			t.Fatalf("%s is still pinned after delete", hash)
+		}
+	}
+	if mock.pinCalls != 2 {
+		t.Fatalf("expected 2 pin/rm calls for %d hashes, got %d", len(representationBlocks(rep))+1, mock.pinCalls)
+	}
+}
+
+func TestPinPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy             PinPolicy
+		wantRep, wantBlock bool
+	}{
+		{PinAll, true, true},
+		{PinRepresentationOnly, true, false},
+		{PinNone, false, false},
+	} {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			mock, server := newCountingIPFS(t)
+			rfs, err := NewRandomFSWithConfig(Config{
+				EnableIPFS: true,
+				IPFSAPI:    server.URL,
+				DataDir:    t.TempDir(),
+				PinPolicy:  tc.policy,
+			})
+			if err != nil {
+				t.Fatalf("NewRandomFSWithConfig: %v", err)
+			}
+			defer rfs.Close()
+
+			_, repHash := storeRandomFile(t, rfs, 3*NanoBlockSize+5)
+			rep, err := rfs.loadRepresentation(repHash)
+			if err != nil {
+				t.Fatalf("loadRepresentation: %v", err)
+			}
+			if mock.isPinned(repHash) != tc.wantRep {
+				t.Errorf("representation pinned: %v, want %v", mock.isPinned(repHash), tc.wantRep)
+			}
+			for _, hash := range representationBlocks(rep) {
+				if mock.isPinned(hash) != tc.wantBlock {
+					t.Fatalf("block %s pinned: %v, want %v", hash, mock.isPinned(hash), tc.wantBlock)
+				}
+			}
+
+			root := writeTree(t, 3)
+			dir, err := rfs.StoreDirectory(root)
+			if err != nil {
+				t.Fatalf("StoreDirectory: %v", err)
+			}
+			if mock.isPinned(dir.RepHash) != tc.wantRep {
+				t.Errorf("directory manifest pinned: %v, want %v", mock.isPinned(dir.RepHash), tc.wantRep)
+			}
+			manifest, err := rfs.GetDirectoryManifest(dir.RepHash)
+			if err != nil {
+				t.Fatalf("GetDirectoryManifest: %v", err)
+			}
+			for _, entry := range manifest.Entries {
+				if mock.isPinned(entry.RepHash) != tc.wantRep {
+					t.Errorf("directory file %s pinned: %v, want %v", entry.Path, mock.isPinned(entry.RepHash), tc.wantRep)
+				}
+			}
+
+			// PinFile pins whatever the policy left out
+			if err := rfs.PinFile(repHash); err != nil {
+				t.Fatalf("PinFile: %v", err)
+			}
+			for _, hash := range append([]string{repHash}, representationBlocks(rep)...) {
+				if !mock.isPinned(hash) {
+					t.Fatalf("%s not pinned by PinFile", hash)
+				}
+			}
+		})
+	}
+
+	if policy, err := ParsePinPolicy("representation-only"); err != nil || policy != PinRepresentationOnly {
+		t.Errorf("ParsePinPolicy returned %v, %v", policy, err)
+	}
+	if _, err := ParsePinPolicy("some"); err == nil {
+		t.Error("parsed an unknown pin policy")
+	}
+	if _, err := NewRandomFSWithConfig(Config{DataDir: t.TempDir(), PinPolicy: PinNone + 1}); err == nil {
+		t.Error("opened an instance with an invalid pin policy")
+	}
+}
+
+func BenchmarkPinFile(b *testing.B) {
+	for _, batchSize := range []int{1, DefaultPinBatchSize} {
+		b.Run(fmt.Sprintf("batch-%d", batchSize), func(b *testing.B) {
+			_, rfs, _, repHash := newPinTestRandomFS(b)
+			rfs.PinBatchSize = batchSize
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := rfs.PinFile(repHash); err != nil {
+					b.Fatalf("PinFile: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,274 @@
+package randomfs
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math"
+	mrand "math/rand"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// randomizerPoolSize bounds the reusable randomizers kept per block size
+const randomizerPoolSize = 256
+
+// RandomizerContext describes the block a randomizer is being chosen for
+type RandomizerContext struct {
+	FileName string
+	// FileSize is UnknownSize for a stream stored without a size
+	FileSize   int64
+	BlockIndex int
+	BlockSize  int
+	// Entropy is the Shannon entropy of the whole file in bits per byte.
+	// Files stored with StoreReader cannot be scanned ahead, so theirs
+	// covers only the data read so far.
+	Entropy float64
+
+	// dryRun is set by EstimateStore, for which randomizers are chosen
+	// but neither fetched nor generated
+	dryRun bool
+	// second is set while choosing the second randomizer of a block
+	second bool
+}
+
+// RandomizerPolicy chooses a randomizer for one block. Candidates are the
+// hashes of reusable randomizers of the right size, most used first. It
+// returns the candidate to reuse, or false to generate a fresh randomizer.
+type RandomizerPolicy func(ctx RandomizerContext, candidates []string) (string, bool)
+
+// AlwaysFreshPolicy generates a new randomizer for every block, maximizing
+// privacy at the cost of storing twice the file size
+func AlwaysFreshPolicy(ctx RandomizerContext, candidates []string) (string, bool) {
+	return "", false
+}
+
+// AlwaysReusePolicy reuses the most used candidate whenever one exists,
+// maximizing storage efficiency
+func AlwaysReusePolicy(ctx RandomizerContext, candidates []string) (string, bool) {
+	if len(candidates) == 0 {
+		return "", false
+	}
+	return candidates[0], true
+}
+
+// ProbabilisticPolicy reuses a random candidate with probability p
+func ProbabilisticPolicy(p float64) RandomizerPolicy {
+	return func(ctx RandomizerContext, candidates []string) (string, bool) {
+		if len(candidates) == 0 || mrand.Float64() >= p {
+			return "", false
+		}
+		return candidates[mrand.Intn(len(candidates))], true
+	}
+}
+
+// MinReusePolicy reuses a random candidate whenever at least minReuse
+// candidates are available, and generates a fresh randomizer otherwise
+func MinReusePolicy(minReuse int) RandomizerPolicy {
+	return func(ctx RandomizerContext, candidates []string) (string, bool) {
+		if len(candidates) == 0 || len(candidates) < minReuse {
+			return "", false
+		}
+		return candidates[mrand.Intn(len(candidates))], true
+	}
+}
+
+// randomizerPool tracks stored randomizers that later stores may reuse
+type randomizerPool struct {
+	uses  map[int]map[string]int
+	mutex sync.Mutex
+}
+
+// newRandomizerPool creates an empty pool
+func newRandomizerPool() *randomizerPool {
+	return &randomizerPool{uses: make(map[int]map[string]int)}
+}
+
+// add makes a stored randomizer available for reuse
+func (rp *randomizerPool) add(hash string, blockSize int) {
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+
+	tier, exists := rp.uses[blockSize]
+	if !exists {
+		tier = make(map[string]int)
+		rp.uses[blockSize] = tier
+	}
+	if _, exists := tier[hash]; exists {
+		return
+	}
+	if len(tier) >= randomizerPoolSize {
+		rp.evictLeastUsed(tier)
+	}
+	tier[hash] = 0
+}
+
+// adopt adds hashes to the pool until it is full, never evicting, and
+// returns the number of randomizers pooled for blockSize
+func (rp *randomizerPool) adopt(hashes []string, blockSize int) int {
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+
+	tier, exists := rp.uses[blockSize]
+	if !exists {
+		tier = make(map[string]int)
+		rp.uses[blockSize] = tier
+	}
+	for _, hash := range hashes {
+		if len(tier) >= randomizerPoolSize {
+			break
+		}
+		if _, exists := tier[hash]; !exists {
+			tier[hash] = 0
+		}
+	}
+	return len(tier)
+}
+
+// markUsed records a reuse of hash
+func (rp *randomizerPool) markUsed(hash string, blockSize int) {
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+
+	if tier, exists := rp.uses[blockSize]; exists {
+		if _, exists := tier[hash]; exists {
+			tier[hash]++
+		}
+	}
+}
+
+// remove drops hash from the pool, for example once its block is released
+func (rp *randomizerPool) remove(hash string) {
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+
+	for _, tier := range rp.uses {
+		delete(tier, hash)
+	}
+}
+
+// candidates returns the pooled randomizers of blockSize, most used first
+func (rp *randomizerPool) candidates(blockSize int) []string {
+	rp.mutex.Lock()
+	defer rp.mutex.Unlock()
+
+	tier := rp.uses[blockSize]
+	hashes := make([]string, 0, len(tier))
+	for hash := range tier {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		if tier[hashes[i]] != tier[hashes[j]] {
+			return tier[hashes[i]] > tier[hashes[j]]
+		}
+		return hashes[i] < hashes[j]
+	})
+	return hashes
+}
+
+// evictLeastUsed removes the least used randomizer from tier
+func (rp *randomizerPool) evictLeastUsed(tier map[string]int) {
+	victim := ""
+	for hash, uses := range tier {
+		if victim == "" || uses < tier[victim] {
+			victim = hash
+		}
+	}
+	delete(tier, victim)
+}
+
+// adoptRandomizers adds existing blocks of blockSize to the pool: blocks
+// in the block cache, then blocks of indexed files stored with that block
+// size. Every stored block is randomized data, so any of them may serve
+// as a randomizer. It returns the number of candidates now pooled.
+func (rfs *RandomFS) adoptRandomizers(blockSize int) int {
+	candidates := rfs.cache.hashesOfSize(blockSize)
+	for _, entry := range rfs.index.list() {
+		if entry.Deleted() || entry.blockSize() != blockSize {
+			continue
+		}
+		candidates = append(candidates, entry.Blocks...)
+	}
+
+	return rfs.randomizers.adopt(uniqueHashes(candidates), blockSize)
+}
+
+// chooseRandomizer asks policy for a randomizer and returns its bytes and,
+// when an existing randomizer is reused, its hash, or when a fresh one is
+// expanded from a well-known seed, the hex seed. The randomizer exclude
+// is never offered, as a block XORed twice with one randomizer is not
+// anonymized at all. A dry run leaves the pool untouched, assumes a
+// pooled randomizer is still stored and returns zeros for its bytes.
+func (rfs *RandomFS) chooseRandomizer(policy RandomizerPolicy, ctx RandomizerContext, exclude string) (randomizer []byte, hash, seed string, err error) {
+	candidates := rfs.randomizers.candidates(ctx.BlockSize)
+	if exclude != "" {
+		candidates = slices.DeleteFunc(candidates, func(hash string) bool { return hash == exclude })
+	}
+	hash, reuse := policy(ctx, candidates)
+	reuse = reuse && hash != exclude
+	if ctx.dryRun {
+		if !reuse {
+			hash = ""
+		}
+		return make([]byte, ctx.BlockSize), hash, "", nil
+	}
+	if reuse {
+		randomizer, err := rfs.retrieveBlock(hash, ctx.BlockSize)
+		if err == nil {
+			rfs.randomizers.markUsed(hash, ctx.BlockSize)
+			return randomizer, hash, "", nil
+		}
+		// The block is gone from the backend; stop offering it
+		rfs.randomizers.remove(hash)
+	}
+
+	if randomizer, seed, ok := rfs.seededRandomizer(ctx, candidates); ok {
+		return randomizer, "", seed, nil
+	}
+	randomizer = make([]byte, ctx.BlockSize)
+	if _, err := rand.Read(randomizer); err != nil {
+		return nil, "", "", fmt.Errorf("failed to generate randomizer: %v", err)
+	}
+	return randomizer, "", "", nil
+}
+
+// shannonEntropy returns the entropy of data in bits per byte
+func shannonEntropy(data []byte) float64 {
+	var histogram byteHistogram
+	histogram.Write(data)
+	return histogram.entropy()
+}
+
+// byteHistogram counts the byte values written to it, so the entropy of a
+// file can be measured while it is read
+type byteHistogram struct {
+	counts [256]int64
+	total  int64
+}
+
+// Write implements io.Writer
+func (h *byteHistogram) Write(p []byte) (int, error) {
+	for _, b := range p {
+		h.counts[b]++
+	}
+	h.total += int64(len(p))
+	return len(p), nil
+}
+
+// entropy returns the entropy of the bytes written so far in bits per byte
+func (h *byteHistogram) entropy() float64 {
+	if h.total == 0 {
+		return 0
+	}
+
+	entropy := 0.0
+	total := float64(h.total)
+	for _, count := range h.counts {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / total
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
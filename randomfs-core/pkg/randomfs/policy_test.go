@@ -0,0 +1,254 @@
+package randomfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"math"
+	"testing"
+)
+
+// storeWithPolicy stores data under policy and returns its representation
+func storeWithPolicy(t *testing.T, rfs *RandomFS, name string, data []byte, policy RandomizerPolicy) *FileRepresentation {
+	t.Helper()
+	url, err := rfs.StoreFileWithPolicy(name, data, "application/octet-stream", policy)
+	if err != nil {
+		t.Fatalf("StoreFileWithPolicy: %v", err)
+	}
+	got, rep, err := rfs.RetrieveFile(url.RepHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("%s did not round-trip", name)
+	}
+	return rep
+}
+
+func TestAlwaysFreshPolicyUploadsNewRandomizers(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	shared := bytes.Repeat([]byte("shared content "), 500)
+
+	first := storeWithPolicy(t, rfs, "first.txt", shared, AlwaysFreshPolicy)
+	generated := rfs.GetStats().BlocksGenerated
+	second := storeWithPolicy(t, rfs, "second.txt", shared, AlwaysFreshPolicy)
+
+	seen := make(map[string]bool)
+	for _, hash := range first.RandomizerHashes {
+		seen[hash] = true
+	}
+	for _, hash := range second.RandomizerHashes {
+		if seen[hash] {
+			t.Fatalf("always-fresh policy reused randomizer %s", hash)
+		}
+	}
+	if added := rfs.GetStats().BlocksGenerated - generated; added != int64(2*len(second.BlockHashes)) {
+		t.Fatalf("expected %d new blocks, got %d", 2*len(second.BlockHashes), added)
+	}
+}
+
+func TestAlwaysReusePolicyMaximizesReuse(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	shared := bytes.Repeat([]byte("shared content "), 500)
+
+	first := storeWithPolicy(t, rfs, "first.txt", shared, AlwaysFreshPolicy)
+	generated := rfs.GetStats().BlocksGenerated
+	second := storeWithPolicy(t, rfs, "second.txt", shared, AlwaysReusePolicy)
+
+	pooled := make(map[string]bool)
+	for _, hash := range first.RandomizerHashes {
+		pooled[hash] = true
+	}
+	for i, hash := range second.RandomizerHashes {
+		if !pooled[hash] {
+			t.Fatalf("randomizer %d was generated although candidates were available", i)
+		}
+	}
+	if added := rfs.GetStats().BlocksGenerated - generated; added != int64(len(second.BlockHashes)) {
+		t.Fatalf("expected only %d anonymized blocks to be new, got %d", len(second.BlockHashes), added)
+	}
+}
+
+func TestProbabilisticPolicyBounds(t *testing.T) {
+	candidates := []string{"a", "b"}
+	ctx := RandomizerContext{BlockSize: NanoBlockSize}
+
+	if _, reuse := ProbabilisticPolicy(0)(ctx, candidates); reuse {
+		t.Fatal("probability 0 reused a randomizer")
+	}
+	if hash, reuse := ProbabilisticPolicy(1)(ctx, candidates); !reuse || (hash != "a" && hash != "b") {
+		t.Fatalf("probability 1 did not reuse a candidate: %q %v", hash, reuse)
+	}
+	if _, reuse := ProbabilisticPolicy(1)(ctx, nil); reuse {
+		t.Fatal("reused without candidates")
+	}
+}
+
+func TestShannonEntropy(t *testing.T) {
+	if e := shannonEntropy(bytes.Repeat([]byte{7}, 100)); e != 0 {
+		t.Fatalf("constant data has entropy %f", e)
+	}
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	if e := shannonEntropy(all); math.Abs(e-8) > 1e-9 {
+		t.Fatalf("uniform bytes have entropy %f, expected 8", e)
+	}
+}
+
+func TestTwoRandomizersReuseThePool(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	rfs.TwoRandomizers = true
+	seed := bytes.Repeat([]byte("seed content "), 500)
+	data := bytes.Repeat([]byte("other content "), 500)
+
+	// The first file has an empty pool and generates both randomizers of
+	// each block; the second reuses them
+	first := storeWithPolicy(t, rfs, "first.txt", seed, nil)
+	if len(first.SecondRandomizerHashes) != len(first.BlockHashes) {
+		t.Fatalf("%d second randomizers for %d blocks", len(first.SecondRandomizerHashes), len(first.BlockHashes))
+	}
+	generated := rfs.GetStats().BlocksGenerated
+	second := storeWithPolicy(t, rfs, "second.txt", data, nil)
+
+	pooled := make(map[string]bool)
+	for _, hash := range append(first.RandomizerHashes, first.SecondRandomizerHashes...) {
+		pooled[hash] = true
+	}
+	for i := range second.BlockHashes {
+		a, b := second.RandomizerHashes[i], second.SecondRandomizerHashes[i]
+		if a == b {
+			t.Fatalf("block %d randomized twice with %s", i, a)
+		}
+		if !pooled[a] || !pooled[b] {
+			t.Fatalf("block %d did not reuse pooled randomizers", i)
+		}
+	}
+	if added := rfs.GetStats().BlocksGenerated - generated; added != int64(len(second.BlockHashes)) {
+		t.Fatalf("expected only %d anonymized blocks to be new, got %d", len(second.BlockHashes), added)
+	}
+	if err := rfs.VerifyFile(rfs.ListFiles()[0].RepHash); err != nil {
+		t.Fatalf("VerifyFile: %v", err)
+	}
+}
+
+func TestTwoRandomizersNeverPairARandomizerWithItself(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	rfs.TwoRandomizers = true
+	storeWithPolicy(t, rfs, "seed.txt", []byte("seed"), AlwaysFreshPolicy)
+
+	// Two pooled nano randomizers; a policy that always picks the same
+	// candidate must not be given the first randomizer again
+	sameFirst := func(ctx RandomizerContext, candidates []string) (string, bool) {
+		if len(candidates) == 0 {
+			return "", false
+		}
+		return candidates[len(candidates)-1], true
+	}
+	data := []byte("a block XORed twice with one randomizer is plaintext")
+	rep := storeWithPolicy(t, rfs, "data.txt", data, sameFirst)
+	if rep.RandomizerHashes[0] == rep.SecondRandomizerHashes[0] {
+		t.Fatal("block randomized twice with the same randomizer")
+	}
+	block, err := rfs.retrieveBlock(rep.BlockHashes[0], rep.BlockSize)
+	if err != nil {
+		t.Fatalf("retrieveBlock: %v", err)
+	}
+	if bytes.Contains(block, data) {
+		t.Fatal("stored block contains plain file data")
+	}
+}
+
+func TestMinReusePolicy(t *testing.T) {
+	ctx := RandomizerContext{BlockSize: NanoBlockSize}
+	if _, reuse := MinReusePolicy(3)(ctx, []string{"a", "b"}); reuse {
+		t.Fatal("reused with fewer candidates than the minimum")
+	}
+	if hash, reuse := MinReusePolicy(2)(ctx, []string{"a", "b"}); !reuse || (hash != "a" && hash != "b") {
+		t.Fatalf("did not reuse a candidate: %q %v", hash, reuse)
+	}
+	if _, reuse := MinReusePolicy(0)(ctx, nil); reuse {
+		t.Fatal("reused without candidates")
+	}
+}
+
+func TestStoreFileWithRandomizersReusesExistingBlocks(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	existing := make([]byte, 4*MiniBlockSize)
+	rand.Read(existing)
+	if _, err := rfs.StoreFile("existing.bin", existing, "application/octet-stream"); err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+
+	// Four anonymized blocks and four randomizers are available
+	data := make([]byte, 3*MiniBlockSize+100)
+	rand.Read(data)
+	before := rfs.GetStats()
+	url, err := rfs.StoreFileWithRandomizers("data.bin", data, "application/octet-stream", 8)
+	if err != nil {
+		t.Fatalf("StoreFileWithRandomizers: %v", err)
+	}
+	after := rfs.GetStats()
+	if reused := after.RandomizersReused - before.RandomizersReused; reused != 4 {
+		t.Errorf("reused %d randomizers, want 4", reused)
+	}
+	if generated := after.BlocksGenerated - before.BlocksGenerated; generated != 4 {
+		t.Errorf("generated %d blocks, want only the 4 anonymized ones", generated)
+	}
+
+	rfs.Cache().Clear()
+	got, _, err := rfs.RetrieveFile(url.RepHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("file stored with reused randomizers did not round-trip")
+	}
+
+	// Too few candidates for the minimum: everything is fresh
+	before = rfs.GetStats()
+	if _, err := rfs.StoreFileWithRandomizers("fresh.bin", data[:MiniBlockSize+1], "application/octet-stream", 1000); err != nil {
+		t.Fatalf("StoreFileWithRandomizers: %v", err)
+	}
+	if reused := rfs.GetStats().RandomizersReused - before.RandomizersReused; reused != 0 {
+		t.Errorf("reused %d randomizers below the minimum", reused)
+	}
+	if _, err := rfs.StoreFileWithRandomizers("bad.bin", data, "application/octet-stream", 0); err == nil {
+		t.Error("accepted a minimum reuse of 0")
+	}
+}
+
+func TestStoreFileWithRandomizersAdoptsIndexedBlocks(t *testing.T) {
+	dataDir := t.TempDir()
+	rfs, err := NewRandomFSWithoutIPFS(dataDir, 1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFSWithoutIPFS: %v", err)
+	}
+	existing := make([]byte, 2*MiniBlockSize)
+	rand.Read(existing)
+	if _, err := rfs.StoreFile("existing.bin", existing, "application/octet-stream"); err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	rfs.Close()
+
+	// A new instance has an empty pool and cache; the blocks it finds are
+	// those of the indexed file
+	rfs, err = NewRandomFSWithoutIPFS(dataDir, 1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFSWithoutIPFS: %v", err)
+	}
+	defer rfs.Close()
+	data := make([]byte, 2*MiniBlockSize)
+	rand.Read(data)
+	url, err := rfs.StoreFileWithRandomizers("data.bin", data, "application/octet-stream", 4)
+	if err != nil {
+		t.Fatalf("StoreFileWithRandomizers: %v", err)
+	}
+	if reused := rfs.GetStats().RandomizersReused; reused != 2 {
+		t.Errorf("reused %d randomizers, want 2", reused)
+	}
+	got, _, err := rfs.RetrieveFile(url.RepHash)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+}
@@ -0,0 +1,325 @@
+package randomfs
+
+import (
+	"context"
+	"fmt"
+	"math"
+	mrand "math/rand"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultPopularPoolSize is the number of most referenced blocks a
+// PopularBlockPool keeps per block size
+const DefaultPopularPoolSize = 100
+
+// DefaultPopularPoolRefresh is how long a PopularBlockPool serves its
+// blocks before recomputing them from the file index
+const DefaultPopularPoolRefresh = time.Minute
+
+// PopularBlockPool holds the blocks referenced by the most indexed files,
+// per block size, so stores can bias their randomizers towards blocks that
+// are already widely shared. The pool is recomputed from the reference
+// counts of the file index once it is older than its refresh interval,
+// each reference decayed with the age of its file when the instance has a
+// PopularityHalfLife.
+type PopularBlockPool struct {
+	rfs     *RandomFS
+	limit   int
+	refresh time.Duration
+
+	// blocks holds the pool per block size, most popular first, and
+	// popularity the decayed reference counts it was ranked by
+	blocks     map[int][]string
+	popularity map[string]float64
+	computedAt time.Time
+
+	// Randomizer slots filled from the pool and left to fresh blocks
+	hits   int64
+	misses int64
+	mutex  sync.Mutex
+}
+
+// newPopularBlockPool creates an empty pool over the index of rfs
+func newPopularBlockPool(rfs *RandomFS, limit int, refresh time.Duration) *PopularBlockPool {
+	return &PopularBlockPool{
+		rfs:        rfs,
+		limit:      limit,
+		refresh:    refresh,
+		blocks:     make(map[int][]string),
+		popularity: make(map[string]float64),
+	}
+}
+
+// PopularBlocks returns the popular block pool of the instance
+func (rfs *RandomFS) PopularBlocks() *PopularBlockPool {
+	return rfs.popular
+}
+
+// Refresh recomputes the pool from the file index now
+func (pp *PopularBlockPool) Refresh() {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	pp.recompute()
+}
+
+// recompute rebuilds the pool; callers hold the lock
+func (pp *PopularBlockPool) recompute() {
+	pp.computedAt = time.Now()
+	pp.blocks, pp.popularity = pp.rfs.index.popularBlocks(pp.limit, pp.rfs.PopularityHalfLife, pp.computedAt)
+}
+
+// Blocks returns the pooled blocks of blockSize, most popular first,
+// recomputing the pool if it is due
+func (pp *PopularBlockPool) Blocks(blockSize int) []string {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	pp.recomputeIfDue()
+	return append([]string(nil), pp.blocks[blockSize]...)
+}
+
+// recomputeIfDue recomputes the pool once it is older than its refresh
+// interval; callers hold the lock
+func (pp *PopularBlockPool) recomputeIfDue() {
+	if time.Since(pp.computedAt) >= pp.refresh {
+		pp.recompute()
+	}
+}
+
+// contains reports whether hash is pooled, recomputing the pool if it is
+// due
+func (pp *PopularBlockPool) contains(hash string) bool {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	pp.recomputeIfDue()
+	_, pooled := pp.popularity[hash]
+	return pooled
+}
+
+// remove drops hash from the pool, for example once its block is released
+func (pp *PopularBlockPool) remove(hash string) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	for size, hashes := range pp.blocks {
+		for i, pooled := range hashes {
+			if pooled == hash {
+				pp.blocks[size] = append(hashes[:i:i], hashes[i+1:]...)
+				delete(pp.popularity, hash)
+				break
+			}
+		}
+	}
+}
+
+// usage returns the number of pooled blocks over all block sizes and the
+// fraction of randomizer slots the pool has filled
+func (pp *PopularBlockPool) usage() (size int64, hitRate float64) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	for _, hashes := range pp.blocks {
+		size += int64(len(hashes))
+	}
+	if total := pp.hits + pp.misses; total > 0 {
+		hitRate = float64(pp.hits) / float64(total)
+	}
+	return size, hitRate
+}
+
+// selectRandomizerBlocks chooses randomizers for count blocks of
+// blockSize: distinct pooled blocks, most referenced first, while the
+// pool lasts, then "" for each block that needs a fresh randomizer. With
+// a PrivacyEpsilon each block is chosen by selectBlockWithDP instead.
+func (pp *PopularBlockPool) selectRandomizerBlocks(count, blockSize int) []string {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	pp.recomputeIfDue()
+	pooled := slices.Clone(pp.blocks[blockSize])
+	selected := make([]string, count)
+	hits := 0
+	for i := range selected {
+		if len(pooled) == 0 {
+			break
+		}
+		choice := 0
+		if epsilon := pp.rfs.PrivacyEpsilon; epsilon > 0 {
+			choice = pp.selectBlockWithDP(pooled, epsilon)
+		}
+		selected[i] = pooled[choice]
+		pooled = slices.Delete(pooled, choice, choice+1)
+		hits++
+	}
+	pp.hits += int64(hits)
+	pp.misses += int64(count - hits)
+	return selected
+}
+
+// selectBlockWithDP returns the index of the candidate with the highest
+// popularity after adding Laplace noise of scale 1/epsilon to each, the
+// report-noisy-max mechanism. One file more or less referencing a block
+// changes its popularity by at most one, so the choice is
+// epsilon-differentially private with respect to any single stored file.
+// Callers hold the lock.
+func (pp *PopularBlockPool) selectBlockWithDP(candidates []string, epsilon float64) int {
+	best, bestScore := 0, math.Inf(-1)
+	for i, hash := range candidates {
+		score := pp.popularity[hash] + laplaceNoise(1/epsilon)
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// laplaceNoise samples the Laplace distribution centred on zero with the
+// given scale
+func laplaceNoise(scale float64) float64 {
+	u := mrand.Float64() - 0.5
+	if u < 0 {
+		return scale * math.Log(1+2*u)
+	}
+	return -scale * math.Log(1-2*u)
+}
+
+// presetPolicy reuses the randomizer selected in advance for each block,
+// generating a fresh one for blocks without
+func presetPolicy(selected []string) RandomizerPolicy {
+	return func(ctx RandomizerContext, candidates []string) (string, bool) {
+		if ctx.BlockIndex >= len(selected) || selected[ctx.BlockIndex] == "" {
+			return "", false
+		}
+		return selected[ctx.BlockIndex], true
+	}
+}
+
+// StoreFileWithPopularRandomizers stores a file reusing the most
+// referenced blocks of its block size as randomizers, so the blocks it
+// shares with other files are the ones already shared most. Blocks left
+// over once the PopularBlockPool runs out get fresh randomizers. With a
+// PrivacyEpsilon the ranking is noisy, so the randomizers of a file are
+// not a function of what was stored before it.
+func (rfs *RandomFS) StoreFileWithPopularRandomizers(filename string, data []byte, contentType string) (*RandomURL, error) {
+	if rfs.readOnly {
+		return nil, ErrReadOnly
+	}
+	blockSize := rfs.selectBlockSize(int64(len(data)))
+	count := (len(data) + blockSize - 1) / blockSize
+	selected := rfs.popular.selectRandomizerBlocks(count, blockSize)
+	return rfs.storeBytes(context.Background(), filename, data, contentType, storeOptions{policy: presetPolicy(selected), blockSize: blockSize})
+}
+
+// popularBlocks returns up to limit blocks of each block size with the
+// highest popularity among those of live entries, most popular first, and
+// their popularity: the number of entries referencing them or, with a
+// positive halfLife, the references of live entries decayed with their
+// age at now
+func (idx *fileIndex) popularBlocks(limit int, halfLife time.Duration, now time.Time) (map[int][]string, map[string]float64) {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	var decayed map[string]float64
+	if halfLife > 0 {
+		decayed = idx.decayedReferences(halfLife, now)
+	}
+	popularity := make(map[string]float64)
+	bySize := make(map[int][]string)
+	for _, entry := range idx.entries {
+		if entry.Deleted() {
+			continue
+		}
+		size := entry.blockSize()
+		for _, hash := range entry.Blocks {
+			if _, seen := popularity[hash]; !seen {
+				if decayed != nil {
+					popularity[hash] = decayed[canonicalRef(hash)]
+				} else {
+					popularity[hash] = float64(idx.refs[canonicalRef(hash)])
+				}
+				bySize[size] = append(bySize[size], hash)
+			}
+		}
+	}
+
+	popular := make(map[string]float64)
+	for size, hashes := range bySize {
+		sort.Slice(hashes, func(i, j int) bool {
+			if popularity[hashes[i]] != popularity[hashes[j]] {
+				return popularity[hashes[i]] > popularity[hashes[j]]
+			}
+			return hashes[i] < hashes[j]
+		})
+		hashes = hashes[:min(len(hashes), limit)]
+		for _, hash := range hashes {
+			popular[hash] = popularity[hash]
+		}
+		bySize[size] = hashes
+	}
+	return bySize, popular
+}
+
+// decayedReferences returns the references of the live entries to each
+// block by its BlockAddress, each weighted by popularityWeight for the age
+// of its entry at now; callers hold the lock
+func (idx *fileIndex) decayedReferences(halfLife time.Duration, now time.Time) map[string]float64 {
+	references := make(map[string]float64)
+	for _, entry := range idx.entries {
+		if entry.Deleted() {
+			continue
+		}
+		weight := popularityWeight(now.Sub(entry.StoredAt), halfLife)
+		seen := make(map[string]bool, len(entry.Blocks))
+		for _, hash := range entry.Blocks {
+			if address := canonicalRef(hash); !seen[address] {
+				seen[address] = true
+				references[address] += weight
+			}
+		}
+	}
+	return references
+}
+
+// popularityWeight returns the weight of a reference age old: one for a
+// new reference, halving every halfLife
+func popularityWeight(age, halfLife time.Duration) float64 {
+	if age <= 0 {
+		return 1
+	}
+	return math.Exp2(-age.Seconds() / halfLife.Seconds())
+}
+
+// BlockInfo describes a stored block as returned by GetBlockInfo
+type BlockInfo struct {
+	Hash string `json:"hash"`
+	// References is the number of indexed files referencing the block
+	References int `json:"references"`
+	// Popularity is the references the PopularBlockPool ranks the block
+	// by, decayed with PopularityHalfLife
+	Popularity float64 `json:"popularity"`
+	// Popular is set when the block is in the PopularBlockPool
+	Popular bool `json:"popular"`
+}
+
+// GetBlockInfo returns the references to a block and its current
+// popularity, failing with ErrBlockNotFound for a block no indexed file
+// references
+func (rfs *RandomFS) GetBlockInfo(hash string) (*BlockInfo, error) {
+	references := rfs.index.references(hash)
+	if references == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrBlockNotFound, hash)
+	}
+	info := &BlockInfo{Hash: hash, References: references, Popularity: float64(references)}
+	if halfLife := rfs.PopularityHalfLife; halfLife > 0 {
+		rfs.index.mutex.RLock()
+		info.Popularity = rfs.index.decayedReferences(halfLife, time.Now())[canonicalRef(hash)]
+		rfs.index.mutex.RUnlock()
+	}
+	info.Popular = rfs.popular.contains(hash)
+	return info, nil
+}
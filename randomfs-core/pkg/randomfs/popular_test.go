@@ -0,0 +1,252 @@
+package randomfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"math"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPopularBlockPoolRanksBlocksByReferences(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	defer rfs.Close()
+	storeRandomFile(t, rfs, 4*NanoBlockSize)
+	// Reusing the most used randomizer makes it the most referenced block
+	for i := 0; i < 3; i++ {
+		data := make([]byte, 2*NanoBlockSize)
+		rand.Read(data)
+		if _, err := rfs.StoreFileWithPolicy("shared", data, "application/octet-stream", AlwaysReusePolicy); err != nil {
+			t.Fatalf("StoreFileWithPolicy: %v", err)
+		}
+	}
+
+	pool := newPopularBlockPool(rfs, 3, time.Hour)
+	pool.Refresh()
+	blocks := pool.Blocks(NanoBlockSize)
+	if len(blocks) != 3 {
+		t.Fatalf("pool holds %d blocks, want its limit of 3", len(blocks))
+	}
+	if refs := rfs.BlockRefCount(blocks[0]); refs != 4 {
+		t.Errorf("most popular block has %d references, want 4", refs)
+	}
+	for i := 1; i < len(blocks); i++ {
+		if rfs.BlockRefCount(blocks[i]) > rfs.BlockRefCount(blocks[i-1]) {
+			t.Errorf("block %d is more referenced than the one before it", i)
+		}
+	}
+	if got := pool.Blocks(BlockSize); len(got) != 0 {
+		t.Errorf("pool offers %d blocks of a size no file uses", len(got))
+	}
+}
+
+func TestPopularBlockPoolRecomputesPeriodically(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	defer rfs.Close()
+	pool := newPopularBlockPool(rfs, DefaultPopularPoolSize, 50*time.Millisecond)
+	if blocks := pool.Blocks(NanoBlockSize); len(blocks) != 0 {
+		t.Fatalf("empty instance pooled %d blocks", len(blocks))
+	}
+
+	storeRandomFile(t, rfs, NanoBlockSize)
+	if blocks := pool.Blocks(NanoBlockSize); len(blocks) != 0 {
+		t.Fatal("pool was recomputed before its refresh interval")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if blocks := pool.Blocks(NanoBlockSize); len(blocks) != 2 {
+		t.Fatalf("pool holds %d blocks after the refresh, want the file's 2", len(blocks))
+	}
+
+	// Released blocks leave the pool at once
+	blocks := pool.Blocks(NanoBlockSize)
+	pool.remove(blocks[0])
+	if slices.Contains(pool.Blocks(NanoBlockSize), blocks[0]) {
+		t.Error("removed block is still pooled")
+	}
+}
+
+func TestStoreFileWithPopularRandomizers(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	defer rfs.Close()
+	for i := 0; i < 2; i++ {
+		storeRandomFile(t, rfs, 2*NanoBlockSize)
+	}
+	rfs.PopularBlocks().Refresh()
+	pooled := rfs.PopularBlocks().Blocks(NanoBlockSize)
+	if len(pooled) != 8 {
+		t.Fatalf("pool holds %d blocks, want the 8 of two files", len(pooled))
+	}
+
+	data := make([]byte, 3*NanoBlockSize)
+	rand.Read(data)
+	before := rfs.GetStats()
+	url, err := rfs.StoreFileWithPopularRandomizers("popular.bin", data, "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreFileWithPopularRandomizers: %v", err)
+	}
+	rep, err := rfs.GetRepresentation(url.RepHash)
+	if err != nil {
+		t.Fatalf("GetRepresentation: %v", err)
+	}
+	for i, hash := range rep.RandomizerHashes {
+		if !slices.Contains(pooled, hash) {
+			t.Errorf("randomizer %d is not a pooled block", i)
+		}
+		if slices.Index(rep.RandomizerHashes, hash) != i {
+			t.Errorf("randomizer %d is shared with another block of the file", i)
+		}
+	}
+	stats := rfs.GetStats()
+	if reused := stats.RandomizersReused - before.RandomizersReused; reused != 3 {
+		t.Errorf("%d randomizers reused, want 3", reused)
+	}
+	if stats.PopularPoolSize != 8 || stats.PopularPoolHitRate != 1 {
+		t.Errorf("stats report a pool of %d with hit rate %v, want 8 and 1", stats.PopularPoolSize, stats.PopularPoolHitRate)
+	}
+	got, _, err := rfs.RetrieveFile(url.RepHash)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+
+	// Blocks beyond the pool fall back to fresh randomizers
+	large := make([]byte, 10*NanoBlockSize)
+	rand.Read(large)
+	if _, err := rfs.StoreFileWithPopularRandomizers("large.bin", large, "application/octet-stream"); err != nil {
+		t.Fatalf("StoreFileWithPopularRandomizers: %v", err)
+	}
+	stats = rfs.GetStats()
+	if reused := stats.RandomizersReused - before.RandomizersReused; reused != 11 {
+		t.Errorf("%d randomizers reused, want the 3 and 8 the pool held", reused)
+	}
+	if want := 11.0 / 13.0; stats.PopularPoolHitRate != want {
+		t.Errorf("hit rate %v, want %v", stats.PopularPoolHitRate, want)
+	}
+}
+
+func TestPrivacyEpsilonFlattensRandomizerSelection(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	defer rfs.Close()
+	for i := 0; i < 4; i++ {
+		storeRandomFile(t, rfs, NanoBlockSize)
+	}
+	rfs.popular = newPopularBlockPool(rfs, DefaultPopularPoolSize, time.Hour)
+	rfs.popular.Refresh()
+	pooled := rfs.popular.Blocks(NanoBlockSize)
+	if len(pooled) != 8 {
+		t.Fatalf("pool holds %d blocks, want 8", len(pooled))
+	}
+	// Rank the blocks by distinct reference counts, 8 down to 1
+	for i, hash := range pooled {
+		rfs.popular.popularity[hash] = float64(len(pooled) - i)
+	}
+
+	// Without noise identical content always gets the same randomizers
+	data := make([]byte, 2*NanoBlockSize)
+	rand.Read(data)
+	randomizers := func() string {
+		url, err := rfs.StoreFileWithPopularRandomizers("same.bin", data, "application/octet-stream")
+		if err != nil {
+			t.Fatalf("StoreFileWithPopularRandomizers: %v", err)
+		}
+		rep, err := rfs.GetRepresentation(url.RepHash)
+		if err != nil {
+			t.Fatalf("GetRepresentation: %v", err)
+		}
+		return rep.RandomizerHashes[0] + rep.RandomizerHashes[1]
+	}
+	if first := randomizers(); randomizers() != first {
+		t.Fatal("identical stores without noise chose different randomizers")
+	}
+	rfs.PrivacyEpsilon = 0.05
+	seen := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		seen[randomizers()] = true
+	}
+	if len(seen) < 3 {
+		t.Errorf("10 noisy stores of identical content chose only %d randomizer pairs", len(seen))
+	}
+
+	// The most referenced block is chosen less often as epsilon drops,
+	// down to nearly the 1/8 of a uniform choice
+	topShare := func(epsilon float64) float64 {
+		rfs.PrivacyEpsilon = epsilon
+		top := 0
+		for i := 0; i < 2000; i++ {
+			if rfs.popular.selectRandomizerBlocks(1, NanoBlockSize)[0] == pooled[0] {
+				top++
+			}
+		}
+		return float64(top) / 2000
+	}
+	previous := topShare(0)
+	if previous != 1 {
+		t.Fatalf("noiseless selection chose the top block %v of the time", previous)
+	}
+	for _, epsilon := range []float64{2, 0.2, 0.02} {
+		share := topShare(epsilon)
+		if share >= previous {
+			t.Errorf("epsilon %v chose the top block %v of the time, not less than %v", epsilon, share, previous)
+		}
+		previous = share
+	}
+	if previous > 0.25 {
+		t.Errorf("epsilon 0.02 still chose the top block %v of the time", previous)
+	}
+}
+
+func TestPopularityDecaysWithHalfLife(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	defer rfs.Close()
+	storeRandomFile(t, rfs, NanoBlockSize)
+	for i := 0; i < 3; i++ {
+		data := make([]byte, NanoBlockSize)
+		rand.Read(data)
+		if _, err := rfs.StoreFileWithPolicy("shared", data, "application/octet-stream", AlwaysReusePolicy); err != nil {
+			t.Fatalf("StoreFileWithPolicy: %v", err)
+		}
+	}
+	pool := newPopularBlockPool(rfs, 1, time.Hour)
+	pool.Refresh()
+	shared := pool.Blocks(NanoBlockSize)[0]
+	if refs := rfs.BlockRefCount(shared); refs != 4 {
+		t.Fatalf("shared block has %d references, want 4", refs)
+	}
+
+	// Files stored four half-lives ago count a sixteenth each
+	rfs.PopularityHalfLife = time.Hour
+	rfs.index.mutex.Lock()
+	for _, entry := range rfs.index.entries {
+		entry.StoredAt = entry.StoredAt.Add(-4 * time.Hour)
+	}
+	rfs.index.mutex.Unlock()
+	_, repHash := storeRandomFile(t, rfs, NanoBlockSize)
+	pool.Refresh()
+	if got := pool.Blocks(NanoBlockSize)[0]; got == shared {
+		t.Error("block referenced by old files still ranks above those of a new one")
+	}
+
+	info, err := rfs.GetBlockInfo(shared)
+	if err != nil {
+		t.Fatalf("GetBlockInfo: %v", err)
+	}
+	if info.References != 4 || math.Abs(info.Popularity-0.25) > 0.01 {
+		t.Errorf("shared block has %d references and popularity %v, want 4 and 0.25", info.References, info.Popularity)
+	}
+	rep, err := rfs.GetRepresentation(repHash)
+	if err != nil {
+		t.Fatalf("GetRepresentation: %v", err)
+	}
+	info, err = rfs.GetBlockInfo(rep.BlockHashes[0])
+	if err != nil {
+		t.Fatalf("GetBlockInfo: %v", err)
+	}
+	if info.References != 1 || math.Abs(info.Popularity-1) > 0.01 || !info.Popular {
+		t.Errorf("new block has %d references, popularity %v, popular %v, want 1, 1 and true", info.References, info.Popularity, info.Popular)
+	}
+
+	if _, err := rfs.GetBlockInfo("missing"); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("GetBlockInfo of an unknown block: %v, want ErrBlockNotFound", err)
+	}
+}
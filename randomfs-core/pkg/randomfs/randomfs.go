@@ -0,0 +1,1835 @@
+package randomfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	mh "github.com/multiformats/go-multihash"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
+)
+
+// Block size tiers used for anonymization
+const (
+	NanoBlockSize = 1024        // 1KB blocks for small files
+	MiniBlockSize = 64 * 1024   // 64KB blocks for medium files
+	BlockSize     = 1024 * 1024 // 1MB blocks for large files
+
+	nanoThreshold = 100 * 1024       // files up to 100KB use nano blocks
+	miniThreshold = 64 * 1024 * 1024 // files up to 64MB use mini blocks
+
+	// RepresentationVersion is the current file representation format
+	RepresentationVersion = "v4"
+
+	// Default limits applied to representations fetched for retrieval
+	DefaultMaxRepresentationSize   = 64 * 1024 * 1024 // 64MB of manifest JSON
+	DefaultMaxRepresentationBlocks = 1 << 20          // 1TB of data at 1MB blocks
+
+	// DefaultOutputBufferSize is the default write buffer for streaming retrieval
+	DefaultOutputBufferSize = 256 * 1024
+
+	// Defaults for batched pin and unpin calls to the IPFS API
+	DefaultPinBatchSize   = 100
+	DefaultPinConcurrency = 4
+
+	// DefaultMaxInFlightBlocks is the default number of blocks StoreReader
+	// reads ahead of the upload
+	DefaultMaxInFlightBlocks = 4
+
+	// DefaultHashWorkers is the default number of blocks hashed at once
+	// when storing to local storage
+	DefaultHashWorkers = 4
+
+	// DefaultStoreWorkers is the default number of blocks stored at once
+	DefaultStoreWorkers = 8
+
+	// DefaultRetrieveWorkers is the default number of blocks fetched at
+	// once when retrieving a file
+	DefaultRetrieveWorkers = 8
+
+	// Defaults for background stores queued with StoreAsync
+	DefaultAsyncWorkers      = 2
+	DefaultAsyncMaxAttempts  = 3
+	DefaultAsyncRetryBackoff = time.Second
+)
+
+// Content dispositions a file can request when it is served over HTTP
+const (
+	DispositionInline     = "inline"
+	DispositionAttachment = "attachment"
+)
+
+// ErrRepresentationTooLarge is returned when a fetched representation exceeds
+// the configured size or block count limits
+var ErrRepresentationTooLarge = errors.New("representation exceeds configured limits")
+
+// ErrBlockOrder is returned when a representation's block list does not
+// match the ordering checksum recorded when it was stored
+var ErrBlockOrder = errors.New("block order does not match the representation checksum")
+
+// ErrUnknownRepresentationField is returned in strict mode for a
+// representation with fields this version does not understand, usually one
+// written by a newer RandomFS
+var ErrUnknownRepresentationField = errors.New("representation has unknown fields")
+
+// ErrInvalidBlockSize is returned for a requested block size that is not a
+// power of two from NanoBlockSize to BlockSize
+var ErrInvalidBlockSize = errors.New("invalid block size")
+
+// ErrReadOnly is returned by write operations on a read-only instance
+var ErrReadOnly = errors.New("randomfs instance is read-only")
+
+// ErrFileTooLarge is returned when a file being stored exceeds MaxFileSize
+var ErrFileTooLarge = errors.New("file exceeds the maximum file size")
+
+// RandomFS is an Owner Free File System backed by IPFS
+type RandomFS struct {
+	// MaxRepresentationSize limits the size in bytes of a fetched
+	// representation. Zero disables the limit.
+	MaxRepresentationSize int64
+	// MaxRepresentationBlocks limits the number of blocks a fetched
+	// representation may reference. Zero disables the limit.
+	MaxRepresentationBlocks int
+	// MaxFileSize limits the size in bytes of a file being stored, before
+	// compression. Larger files fail with ErrFileTooLarge before any block
+	// is stored. Zero disables the limit.
+	MaxFileSize int64
+	// StrictRepresentations rejects representations carrying fields this
+	// version does not know with ErrUnknownRepresentationField. By default
+	// unknown fields are ignored.
+	StrictRepresentations bool
+	// OutputBufferSize is the size of the buffer used to coalesce block
+	// writes in RetrieveFileTo and FileStream.WriteTo. Zero disables it.
+	OutputBufferSize int
+	// NamePolicy decides whether indexed files may share a name
+	NamePolicy NamePolicy
+	// DeleteGracePeriod makes DeleteFile soft-delete indexed files, keeping
+	// their blocks for this long so the delete can be undone. Zero deletes
+	// immediately.
+	DeleteGracePeriod time.Duration
+	// FilenamePolicy, if set, rewrites or rejects the names of files being
+	// stored or renamed
+	FilenamePolicy FilenamePolicy
+	// RandomizerPolicy decides whether stores reuse pooled randomizers or
+	// generate fresh ones. Nil means AlwaysFreshPolicy, or AlwaysReusePolicy
+	// with TwoRandomizers.
+	RandomizerPolicy RandomizerPolicy
+	// PrivacyEpsilon, if positive, adds Laplace noise of scale
+	// 1/PrivacyEpsilon to the reference counts the PopularBlockPool ranks
+	// randomizers by, so the randomizers a file gets are not determined by
+	// the blocks stored before it. Lower values choose more uniformly, at
+	// the cost of reusing less popular blocks. Zero ranks exactly.
+	PrivacyEpsilon float64
+	// PopularityHalfLife, if positive, decays the references the
+	// PopularBlockPool ranks blocks by with the age of the referencing
+	// file: a file stored PopularityHalfLife ago counts half, one stored
+	// twice as long ago a quarter. The pool then follows the blocks reused
+	// lately rather than those once popular. Zero counts every reference
+	// fully.
+	PopularityHalfLife time.Duration
+	// TwoRandomizers anonymizes each block of new files against two
+	// distinct randomizers instead of one. Neither alone reveals anything
+	// about the block, so both can be reused pooled randomizers rather than
+	// a private pad.
+	TwoRandomizers bool
+	// ContentStrategies choose the randomizer policy of files by content
+	// type; the first matching rule wins. Files no rule matches use
+	// RandomizerPolicy.
+	ContentStrategies []ContentStrategyRule
+	// FileHashAlgorithm is the algorithm used to record the whole-file
+	// hash of new files: HashSHA256, HashSHA512 or HashBLAKE3
+	FileHashAlgorithm string
+	// VerifyBlocks checks that every block fetched from the backend has the
+	// expected length and hashes to its address
+	VerifyBlocks bool
+	// VerifyFileHash checks retrieved files against the whole-file hash
+	// of their representation, failing with ErrFileHashMismatch. Turning
+	// it off saves hashing every file read; VerifyFile always checks.
+	VerifyFileHash bool
+	// FallbackSources are tried in order for blocks the backend fails to
+	// return
+	FallbackSources []BlockSource
+	// SeededRandomizers, if positive, tops up the randomizer pool from
+	// well-known seeds: while fewer than SeededRandomizers randomizers of
+	// the block size are pooled, the fresh first randomizer of block i of
+	// a file, for i below SeededRandomizers, is expanded from seed i
+	// instead of generated at random. Every instance expands a seed to
+	// the same block, so independent instances converge on the same
+	// randomizers and IPFS stores them once. Anyone can expand the seeds,
+	// so a seeded randomizer hides nothing on its own; combine it with
+	// TwoRandomizers, whose second randomizer is never seeded.
+	SeededRandomizers int
+
+	// SparseBlocks records blocks of one repeated byte, such as the zero
+	// regions of disk images, as sparse markers in the representation
+	// instead of storing them. The representation then reveals which
+	// blocks are constant.
+	SparseBlocks bool
+	// ReadRepair stores blocks served by a fallback source back to the
+	// backend, pinning them with IPFS
+	ReadRepair bool
+	// SelfDescribingRefs makes new representations refer to blocks by
+	// their BlockAddress with local storage too, as IPFS does, so they
+	// resolve against any backend
+	SelfDescribingRefs bool
+	// Transactional journals the blocks each store writes and releases them
+	// if the store fails, so failed stores leave no orphaned blocks
+	Transactional bool
+	// PinPolicy selects what stores pin with IPFS, PinAll by default
+	PinPolicy PinPolicy
+	// PinBatchSize is the number of hashes sent in one pin/add or pin/rm
+	// call by PinFile and UnpinFile
+	PinBatchSize int
+	// PinConcurrency bounds the pin calls PinFile and UnpinFile run at once
+	PinConcurrency int
+	// MaxInFlightBlocks bounds the blocks StoreReader reads ahead of the
+	// upload. Once that many are waiting, reading stops until the backend
+	// catches up. Values below one read one block ahead.
+	MaxInFlightBlocks int
+	// HashWorkers is the number of blocks hashed in parallel when storing
+	// to local storage. Values below two hash serially. With IPFS the
+	// daemon addresses blocks, so it has no effect.
+	HashWorkers int
+	// StoreWorkers is the number of blocks of a file stored at once.
+	// Values below two store blocks one after another.
+	StoreWorkers int
+	// RetrieveWorkers is the number of blocks of a file fetched at once.
+	// Blocks are still written out in order, so at most this many are
+	// held in memory. Values below two fetch blocks one after another.
+	RetrieveWorkers int
+	// AsyncWorkers is the number of workers running StoreAsync stores. It
+	// is read when the first async store is queued.
+	AsyncWorkers int
+	// AsyncMaxAttempts bounds the attempts of an async store; stores still
+	// failing after that many move to the dead-letter list
+	AsyncMaxAttempts int
+	// AsyncRetryBackoff is the delay before the first retry of a failed
+	// async store. Each further retry waits twice as long.
+	AsyncRetryBackoff time.Duration
+	// IPFSRetry retries IPFS add and cat calls that fail with connection
+	// errors or 5xx responses, so a store survives a daemon restart
+	IPFSRetry RetryPolicy
+	// RepresentationKey, if set, encrypts the representations of new files
+	// with AES-256-GCM, hiding their names, sizes and block lists from
+	// anyone fetching them from the backend. It must be
+	// RepresentationKeySize bytes, and is needed to retrieve those files.
+	RepresentationKey []byte
+	// FixedBlockSize, if set, stores every new file with blocks of this
+	// size instead of choosing a tier by file size. It must be a power of
+	// two from NanoBlockSize to BlockSize.
+	FixedBlockSize int
+	// Compression compresses files stored from byte slices with
+	// CompressionGzip or CompressionZstd before they are anonymized. Files
+	// it would not shrink are stored uncompressed. Empty or
+	// CompressionNone disables it.
+	Compression string
+	// TracerProvider, if set, receives spans covering stores and retrievals
+	// and the backend calls they make. Nil disables tracing.
+	TracerProvider trace.TracerProvider
+	// Metrics, if set, receives the latency of IPFS calls, stores and
+	// retrievals
+	Metrics MetricsObserver
+	// Logger receives the log records of the instance, slog.Default() if
+	// nil. Per-block records are logged at the debug level.
+	Logger *slog.Logger
+
+	// blocks is the backend blocks and representations are kept in
+	blocks BlockStore
+	// blockHash is the multihash code of the function new data blocks and
+	// randomizers are addressed with
+	blockHash uint64
+	dataDir   string
+	useIPFS   bool
+	cache     *BlockCache
+	index     *fileIndex
+	// manifests maps file content to representations for deduplication
+	manifests *manifestRegistry
+
+	// sharedCache is set when cache was supplied by UseBlockCache and may
+	// be in use by other instances, so Close leaves it alone
+	sharedCache bool
+	// repCache, if set, holds fetched representations by hash
+	repCache *BlockCache
+	// parsedReps holds recently loaded representations, decoded
+	parsedReps *parsedRepCache
+
+	tokens  *tokenAuthority
+	mutex   sync.RWMutex
+	stats   Stats
+
+	// statsMutex guards stats, which is only updated through updateStats
+	statsMutex sync.Mutex
+
+	// randomizers pools previously stored randomizers for reuse
+	randomizers *randomizerPool
+	// popular holds the most referenced blocks for reuse as randomizers
+	popular *PopularBlockPool
+
+	// readOnly instances serve files but refuse every write
+	readOnly bool
+	lock     io.Closer
+
+	// gateway, if set, serves reads the IPFS API fails. gatewayOnly is set
+	// when the API was unreachable at startup, so reads go straight to it.
+	gateway     *GatewaySource
+	gatewayOnly bool
+
+	// done is closed by Close to stop background workers, and Close waits
+	// for the workers tracked by background to return
+	done       chan struct{}
+	closeOnce  sync.Once
+	background sync.WaitGroup
+
+	// fetches deduplicates concurrent backend fetches of the same block
+	fetches singleflight.Group
+
+	// async tracks stores queued with StoreAsync
+	async asyncStores
+
+	// diagnostics records recent errors, retrievals and backend health
+	diagnostics diagnostics
+}
+
+// Stats tracks usage statistics for a RandomFS instance
+type Stats struct {
+	FilesStored     int64 `json:"files_stored"`
+	FilesRetrieved  int64 `json:"files_retrieved"`
+	BlocksGenerated int64 `json:"blocks_generated"`
+	TotalSize       int64 `json:"total_size"`
+	CacheHits       int64 `json:"cache_hits"`
+	CacheMisses     int64 `json:"cache_misses"`
+
+	// IPFS API calls by operation
+	IPFSAddTotal  int64 `json:"ipfs_add_total"`
+	IPFSAddErrors int64 `json:"ipfs_add_errors"`
+	IPFSCatTotal  int64 `json:"ipfs_cat_total"`
+	IPFSCatErrors int64 `json:"ipfs_cat_errors"`
+	IPFSPinTotal  int64 `json:"ipfs_pin_total"`
+	IPFSPinErrors int64 `json:"ipfs_pin_errors"`
+	// IPFSRetries counts add and cat attempts repeated under IPFSRetry
+	IPFSRetries int64 `json:"ipfs_retries"`
+
+	// Blocks served by fallback sources and stored back to the backend
+	FallbackFetches int64 `json:"fallback_fetches"`
+	BlocksRepaired  int64 `json:"blocks_repaired"`
+	// GatewayFetches counts blocks and representations read from the
+	// gateway instead of the IPFS API
+	GatewayFetches int64 `json:"gateway_fetches"`
+
+	// Constant blocks recorded as sparse markers instead of being stored
+	SparseBlocks int64 `json:"sparse_blocks"`
+
+	// Existing blocks used as randomizers instead of fresh ones
+	RandomizersReused int64 `json:"randomizers_reused"`
+
+	// Stores of content already stored, which wrote no blocks
+	FilesDeduplicated int64 `json:"files_deduplicated"`
+
+	// Blocks in the PopularBlockPool, and the fraction of randomizers it
+	// was asked for that it supplied
+	PopularPoolSize    int64   `json:"popular_pool_size"`
+	PopularPoolHitRate float64 `json:"popular_pool_hit_rate"`
+
+	// Representation loads served from and missing the parsed
+	// representation cache
+	ParsedRepresentationHits   int64 `json:"parsed_representation_hits"`
+	ParsedRepresentationMisses int64 `json:"parsed_representation_misses"`
+
+	// Distinct blocks referenced by indexed files, and the references to
+	// them; the difference is the blocks sharing saved
+	UniqueBlocks    int64 `json:"unique_blocks"`
+	BlockReferences int64 `json:"block_references"`
+
+	// Size of the files stored with Compression before and after they
+	// were compressed
+	UncompressedBytes int64 `json:"uncompressed_bytes"`
+	CompressedBytes   int64 `json:"compressed_bytes"`
+}
+
+// FileRepresentation describes how to reconstruct a stored file
+type FileRepresentation struct {
+	FileName         string   `json:"filename"`
+	FileSize         int64    `json:"filesize"`
+	BlockHashes      []string `json:"block_hashes"`
+	RandomizerHashes []string `json:"randomizer_hashes"`
+	BlockSize        int      `json:"block_size"`
+	Timestamp        int64    `json:"timestamp"`
+	ContentType      string   `json:"content_type"`
+	Disposition      string   `json:"disposition,omitempty"`
+	FileHash         string   `json:"file_hash,omitempty"`
+	HashAlgorithm    string   `json:"hash_algorithm,omitempty"`
+	OrderHash        string   `json:"order_hash,omitempty"`
+	Version          string   `json:"version"`
+
+	// SecondRandomizerHashes are set for files stored with TwoRandomizers
+	SecondRandomizerHashes []string `json:"second_randomizer_hashes,omitempty"`
+
+	// RandomizerSeeds holds, for each block whose randomizer was expanded
+	// from a well-known seed, the hex seed, and is empty when no block's
+	// was. A lost seeded randomizer can be generated again.
+	RandomizerSeeds []string `json:"randomizer_seeds,omitempty"`
+
+	// Compression names the codec the file was compressed with before it
+	// was split into blocks. The blocks then hold StoredSize bytes, which
+	// FileHash covers, and decompress to FileSize bytes.
+	Compression string `json:"compression,omitempty"`
+	StoredSize  int64  `json:"stored_size,omitempty"`
+
+	// BlockHashFunc names the function the data blocks are addressed
+	// with, SHA-256 if empty
+	BlockHashFunc string `json:"block_hash_func,omitempty"`
+
+	// Encryption names the cipher a file stored with a password was
+	// sealed with, block by block, after any compression. The blocks then
+	// hold StoredSize bytes, and PasswordSalt is the hex salt of the key.
+	Encryption   string `json:"encryption,omitempty"`
+	PasswordSalt string `json:"password_salt,omitempty"`
+}
+
+// PreferredDisposition returns the stored disposition, falling back to
+// inline for content browsers can render and attachment otherwise
+func (rep *FileRepresentation) PreferredDisposition() string {
+	if rep.Disposition != "" {
+		return rep.Disposition
+	}
+
+	contentType := strings.ToLower(rep.ContentType)
+	for _, prefix := range []string{"image/", "video/", "audio/", "text/", "application/pdf"} {
+		if strings.HasPrefix(contentType, prefix) {
+			return DispositionInline
+		}
+	}
+	return DispositionAttachment
+}
+
+// representationOrderHash returns a checksum over the ordered block and
+// randomizer hashes, so a reordered manifest is caught before any block
+// is fetched
+func representationOrderHash(rep *FileRepresentation) string {
+	h := sha256.New()
+	for i, hash := range rep.BlockHashes {
+		randomizer := ""
+		if i < len(rep.RandomizerHashes) {
+			randomizer = rep.RandomizerHashes[i]
+		}
+		if i < len(rep.SecondRandomizerHashes) {
+			randomizer += ":" + rep.SecondRandomizerHashes[i]
+		}
+		fmt.Fprintf(h, "%d:%s:%s\n", i, hash, randomizer)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// storeOptions holds per-file options for the store path
+type storeOptions struct {
+	disposition string
+	expiresAt   time.Time
+	policy      RandomizerPolicy
+	// blockSize, if set, overrides the block size chosen for the file
+	blockSize int
+	// compression names the codec the stored data was compressed with,
+	// and fileSize is then the size of the original file
+	compression string
+	fileSize    int64
+	// password, if set, encrypts the stored data, which is then sealed
+	// with encryption under a key derived with passwordSalt
+	password     string
+	encryption   string
+	passwordSalt string
+	// deferPins leaves pinning to the caller, which pins many files at once
+	deferPins bool
+	// contentHash, if set, is the SHA-256 of the file content, looked up
+	// in and added to the manifest registry
+	contentHash string
+	// result, if set, receives the blocks written by the store
+	result *StoreResult
+}
+
+// NewRandomFS creates a new RandomFS instance backed by the IPFS HTTP API
+func NewRandomFS(ipfsAPI string, dataDir string, cacheSize int64) (*RandomFS, error) {
+	return NewRandomFSWithConfig(Config{IPFSAPI: ipfsAPI, EnableIPFS: true, DataDir: dataDir, CacheSize: cacheSize})
+}
+
+// NewRandomFSWithoutIPFS creates a RandomFS instance that stores blocks as
+// files in the blocks directory of dataDir, using a LocalBlockStore
+func NewRandomFSWithoutIPFS(dataDir string, cacheSize int64) (*RandomFS, error) {
+	return NewRandomFSWithConfig(Config{DataDir: dataDir, CacheSize: cacheSize})
+}
+
+// NewReadOnlyRandomFS opens an existing data directory for serving files
+// only. Stores and other writes fail with ErrReadOnly, and the data
+// directory is locked shared so several replicas can open it at once. An
+// empty ipfsAPI reads blocks from the data directory.
+func NewReadOnlyRandomFS(ipfsAPI string, dataDir string, cacheSize int64) (*RandomFS, error) {
+	return NewRandomFSWithConfig(Config{IPFSAPI: ipfsAPI, EnableIPFS: ipfsAPI != "", DataDir: dataDir, CacheSize: cacheSize, ReadOnly: true})
+}
+
+// openDataDir locks the data directory and loads its persistent state
+func (rfs *RandomFS) openDataDir() error {
+	lock, err := lockDataDir(rfs.dataDir, !rfs.readOnly)
+	if err != nil {
+		return err
+	}
+	rfs.lock = lock
+
+	index, err := loadFileIndex(rfs.dataDir)
+	if err != nil {
+		rfs.lock.Close()
+		return err
+	}
+	rfs.index = index
+
+	manifests, err := loadManifestRegistry(rfs.dataDir)
+	if err != nil {
+		rfs.lock.Close()
+		return err
+	}
+	rfs.manifests = manifests
+
+	tokens, err := loadTokenAuthority(rfs.dataDir, rfs.readOnly)
+	if err != nil {
+		rfs.lock.Close()
+		return err
+	}
+	rfs.tokens = tokens
+	return nil
+}
+
+// IsReadOnly reports whether the instance was opened read-only, or fell
+// back to reading from a gateway without an IPFS API to store through
+func (rfs *RandomFS) IsReadOnly() bool {
+	return rfs.readOnly
+}
+
+// DataDir returns the data directory of the instance, where front ends
+// may keep state of their own in subdirectories
+func (rfs *RandomFS) DataDir() string {
+	return rfs.dataDir
+}
+
+// StoreFile anonymizes data into randomized blocks and returns its rd:// URL.
+// An empty contentType is detected with DetectContentType, here and in the
+// other store methods.
+func (rfs *RandomFS) StoreFile(filename string, data []byte, contentType string) (*RandomURL, error) {
+	return rfs.StoreFileContext(context.Background(), filename, data, contentType)
+}
+
+// StoreFileContext stores a file like StoreFile, giving up when ctx is
+// done. Block transfers in flight are cancelled, and with Transactional
+// the blocks already written are released.
+func (rfs *RandomFS) StoreFileContext(ctx context.Context, filename string, data []byte, contentType string) (*RandomURL, error) {
+	return rfs.storeBytes(ctx, filename, data, contentType, storeOptions{})
+}
+
+// storeBytes stores data through storeFile, compressing it first with the
+// configured Compression. Content already stored is deduplicated against
+// the manifest registry.
+func (rfs *RandomFS) storeBytes(ctx context.Context, filename string, data []byte, contentType string, opts storeOptions) (*RandomURL, error) {
+	src, size, contentType, opts, err := rfs.prepareBytes(filename, data, contentType, opts)
+	if err != nil {
+		return nil, err
+	}
+	return rfs.storeFile(ctx, filename, src, size, contentType, opts)
+}
+
+// prepareBytes returns the source, size, content type and options data is
+// stored with
+func (rfs *RandomFS) prepareBytes(filename string, data []byte, contentType string, opts storeOptions) (blockSource, int64, string, storeOptions, error) {
+	if err := rfs.checkFileSize(int64(len(data))); err != nil {
+		return nil, 0, "", opts, err
+	}
+	if contentType == "" {
+		contentType = DetectContentType(filename, data)
+	}
+	stored, codec, err := rfs.compressForStore(data)
+	if err != nil {
+		return nil, 0, "", opts, fmt.Errorf("failed to compress %s: %w", filename, err)
+	}
+	if codec != "" {
+		opts.compression, opts.fileSize = codec, int64(len(data))
+	}
+	if opts.password == "" {
+		opts.contentHash = blockDigest(data)
+		return &readerAtSource{r: bytes.NewReader(stored)}, int64(len(stored)), contentType, opts, nil
+	}
+
+	// Sealed blocks must line up with the blocks they are stored in
+	if opts.blockSize == 0 {
+		opts.blockSize = rfs.selectBlockSize(int64(len(stored)))
+	}
+	stored, salt, err := sealBlocks(stored, opts.password, opts.blockSize)
+	if err != nil {
+		return nil, 0, "", opts, fmt.Errorf("failed to encrypt %s: %w", filename, err)
+	}
+	opts.encryption, opts.passwordSalt, opts.fileSize = EncryptionChaCha20Poly1305, hex.EncodeToString(salt), int64(len(data))
+	return &readerAtSource{r: bytes.NewReader(stored)}, int64(len(stored)), contentType, opts, nil
+}
+
+// StoreFileWithDisposition stores a file that should be served with the
+// given content disposition (DispositionInline or DispositionAttachment)
+func (rfs *RandomFS) StoreFileWithDisposition(filename string, data []byte, contentType, disposition string) (*RandomURL, error) {
+	if disposition != DispositionInline && disposition != DispositionAttachment {
+		return nil, fmt.Errorf("invalid disposition %q, expected %q or %q", disposition, DispositionInline, DispositionAttachment)
+	}
+	return rfs.storeBytes(context.Background(), filename, data, contentType, storeOptions{disposition: disposition})
+}
+
+// StoreResult counts the blocks written by one store. Sparse blocks are
+// never stored and are not counted.
+type StoreResult struct {
+	// BlocksTotal is the number of blocks the file references, data blocks
+	// and randomizers, of which BlocksNew were written by the store and
+	// BlocksReused were already stored
+	BlocksTotal  int64 `json:"blocks_total"`
+	BlocksNew    int64 `json:"blocks_new"`
+	BlocksReused int64 `json:"blocks_reused"`
+	// BytesStored is the size of the blocks written
+	BytesStored int64 `json:"bytes_stored"`
+}
+
+// StoreFileWithResult stores a file like StoreFile and also returns how
+// many of its blocks were new. A non-empty disposition is stored as with
+// StoreFileWithDisposition.
+func (rfs *RandomFS) StoreFileWithResult(filename string, data []byte, contentType, disposition string) (*RandomURL, StoreResult, error) {
+	var result StoreResult
+	if disposition != "" && disposition != DispositionInline && disposition != DispositionAttachment {
+		return nil, result, fmt.Errorf("invalid disposition %q, expected %q or %q", disposition, DispositionInline, DispositionAttachment)
+	}
+	rdURL, err := rfs.storeBytes(context.Background(), filename, data, contentType, storeOptions{disposition: disposition, result: &result})
+	return rdURL, result, err
+}
+
+// StoreFileWithPolicy stores a file choosing randomizers with policy
+// instead of the instance-wide RandomizerPolicy
+func (rfs *RandomFS) StoreFileWithPolicy(filename string, data []byte, contentType string, policy RandomizerPolicy) (*RandomURL, error) {
+	return rfs.storeBytes(context.Background(), filename, data, contentType, storeOptions{policy: policy})
+}
+
+// StoreFileWithRandomizers stores a file reusing existing blocks as
+// randomizers: pooled randomizers, blocks in the block cache and blocks of
+// files already in the backend. Fresh randomizers are only generated when
+// fewer than minReuse candidates are found. Stats.RandomizersReused counts
+// the randomizers reused.
+func (rfs *RandomFS) StoreFileWithRandomizers(filename string, data []byte, contentType string, minReuse int) (*RandomURL, error) {
+	if minReuse < 1 {
+		return nil, fmt.Errorf("invalid minimum reuse %d", minReuse)
+	}
+	if !rfs.readOnly {
+		rfs.adoptRandomizers(rfs.selectBlockSize(int64(len(data))))
+	}
+	return rfs.storeBytes(context.Background(), filename, data, contentType, storeOptions{policy: MinReusePolicy(minReuse)})
+}
+
+// StoreFileWithBlockSize stores a file split into blocks of blockSize
+// bytes instead of the size chosen from the file size. blockSize must be a
+// power of two from NanoBlockSize to BlockSize.
+func (rfs *RandomFS) StoreFileWithBlockSize(filename string, data []byte, contentType string, blockSize int) (*RandomURL, error) {
+	if err := checkBlockSize(blockSize); err != nil {
+		return nil, err
+	}
+	return rfs.storeBytes(context.Background(), filename, data, contentType, storeOptions{blockSize: blockSize})
+}
+
+// StoreFileWithExpiry stores a file that is deleted by the expiry reaper
+// once expiresAt has passed
+func (rfs *RandomFS) StoreFileWithExpiry(filename string, data []byte, contentType string, expiresAt time.Time) (*RandomURL, error) {
+	if expiresAt.IsZero() {
+		return nil, fmt.Errorf("expiry time is required")
+	}
+	return rfs.storeBytes(context.Background(), filename, data, contentType, storeOptions{expiresAt: expiresAt})
+}
+
+// StoreReaderAt stores size bytes read from r. Each block is read at its
+// own offset, so large on-disk or memory-mapped sources are never held in
+// memory as a whole; r is scanned once beforehand to hash the file.
+func (rfs *RandomFS) StoreReaderAt(filename string, r io.ReaderAt, size int64, contentType string) (*RandomURL, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("invalid size %d", size)
+	}
+	if contentType == "" {
+		contentType = detectReaderAtContentType(filename, r, size)
+	}
+	return rfs.storeFile(context.Background(), filename, &readerAtSource{r: r}, size, contentType, storeOptions{})
+}
+
+// storeFile implements StoreFile and its variants, reading size bytes of
+// the file from src and giving up when ctx is done
+func (rfs *RandomFS) storeFile(ctx context.Context, filename string, src blockSource, size int64, contentType string, opts storeOptions) (rdURL *RandomURL, err error) {
+	start := time.Now()
+	ctx, span := rfs.startSpan(ctx, "randomfs.StoreFile",
+		attribute.String("randomfs.file.name", filename),
+		attribute.Int64("randomfs.file.size", size))
+	defer func() {
+		rfs.noteError("store "+filename, err)
+		rfs.observeOperation(OpStore, start, err)
+		endSpan(span, err)
+	}()
+
+	if rfs.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	filename, err = rfs.applyFilenamePolicy(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	rfs.mutex.Lock()
+	defer rfs.mutex.Unlock()
+
+	if err := rfs.checkNameAvailable(filepath.Base(filename), ""); err != nil {
+		return nil, err
+	}
+
+	rdURL, err = rfs.storeJournaled(ctx, filename, src, size, contentType, opts)
+	if err == nil {
+		span.SetAttributes(attribute.String("randomfs.rep_hash", rdURL.RepHash))
+	}
+	return rdURL, err
+}
+
+// storeJournaled runs writeFile under a store journal, rolling back what
+// it wrote if it fails; callers hold the write lock
+func (rfs *RandomFS) storeJournaled(ctx context.Context, filename string, src blockSource, size int64, contentType string, opts storeOptions) (*RandomURL, error) {
+	fileSize := size
+	if opts.compression != "" || opts.encryption != "" {
+		fileSize = opts.fileSize
+	}
+	if err := rfs.checkFileSize(fileSize); err != nil {
+		return nil, err
+	}
+
+	journal, err := rfs.beginStore()
+	if err != nil {
+		return nil, err
+	}
+
+	rdURL, err := rfs.writeFile(ctx, journal, filename, src, size, contentType, opts)
+	if err != nil {
+		if rollbackErr := rfs.rollbackStore(journal); rollbackErr != nil {
+			rfs.log().Error("Failed to roll back store", "file", filename, "error", rollbackErr)
+		}
+		return nil, err
+	}
+
+	// The file is indexed, so a leftover journal would release nothing
+	if err := journal.commit(); err != nil {
+		rfs.log().Error("Failed to commit store", "file", filename, "error", err)
+	}
+	return rdURL, nil
+}
+
+// writeFile stores the blocks and representation of a file, pins them
+// unless opts.deferPins is set, and indexes the file. Everything it writes
+// is recorded in journal. Callers hold the write lock; concurrent calls
+// under one lock are safe.
+func (rfs *RandomFS) writeFile(ctx context.Context, journal *storeJournal, filename string, src blockSource, size int64, contentType string, opts storeOptions) (*RandomURL, error) {
+	start := time.Now()
+	if rfs.RepresentationKey != nil {
+		// Reject a bad key before any block is stored
+		if _, err := rfs.representationAEAD(); err != nil {
+			return nil, err
+		}
+	}
+	if rdURL, ok, err := rfs.writeDuplicate(ctx, journal, filename, contentType, opts); ok {
+		return rdURL, err
+	}
+	hasher, err := newFileHasher(rfs.FileHashAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	blockSize := opts.blockSize
+	if blockSize == 0 {
+		blockSize = rfs.selectBlockSize(size)
+	}
+
+	// The whole-file hash is fed in order by src. Blocks are randomized a
+	// batch at a time and each batch is stored on up to StoreWorkers
+	// goroutines; without IPFS their digests are computed in parallel
+	// first, as IPFS computes its own block addresses.
+	workers := max(rfs.StoreWorkers, 1)
+	if !rfs.useIPFS {
+		workers = max(workers, rfs.HashWorkers)
+	}
+	batchSize := max(src.batch(workers), 1)
+
+	_, chunkSpan := rfs.startSpan(ctx, "randomfs.chunk",
+		attribute.Int("randomfs.block.size", blockSize),
+		attribute.Int64("randomfs.block.count", (size+int64(blockSize)-1)/int64(blockSize)))
+	err = src.open(hasher, size, blockSize)
+	endSpan(chunkSpan, err)
+	if err != nil {
+		return nil, err
+	}
+	defer src.close()
+
+	policy := rfs.storePolicy(contentType, opts)
+
+	rctx := RandomizerContext{
+		FileName:  filepath.Base(filename),
+		FileSize:  size,
+		BlockSize: blockSize,
+	}
+
+	var blockHashes, randomizerHashes, seeds, secondHashes, fresh []string
+	seeded := false
+	var sparse, reused int
+
+	for {
+		// Stop between batches once the caller gives up
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		batch, err := rfs.randomizeBatch(src, policy, rctx, len(blockHashes), batchSize)
+		if err != nil {
+			return nil, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		if !rfs.useIPFS {
+			hashPendingBlocks(batch, max(rfs.HashWorkers, 1), rfs.blockHash)
+		}
+
+		stored, err := rfs.storeBatch(ctx, journal, batch, len(blockHashes))
+		if err != nil {
+			return nil, err
+		}
+		for _, block := range stored {
+			blockHashes = append(blockHashes, block.hash)
+			randomizerHashes = append(randomizerHashes, block.randomizerHash)
+			seeds = append(seeds, block.randomizerSeed)
+			seeded = seeded || block.randomizerSeed != ""
+			if rfs.TwoRandomizers {
+				secondHashes = append(secondHashes, block.secondHash)
+			}
+			if block.sparse {
+				sparse++
+			}
+			// Fresh randomizers join the pool once the file is stored, so
+			// no two blocks of one file share a randomizer
+			fresh = append(fresh, block.fresh...)
+			reused += block.reused
+		}
+	}
+	digest := hex.EncodeToString(hasher.Sum(nil))
+	if size == UnknownSize {
+		size = src.length()
+		// A sparse last block was recorded as a whole block
+		if last := len(blockHashes) - 1; last >= 0 {
+			if fill, _, ok := parseSparseRef(blockHashes[last]); ok {
+				blockHashes[last] = sparseRef(fill, int(size-int64(last)*int64(blockSize)))
+			}
+		}
+	}
+
+	storedAt := time.Now()
+	timestamp := storedAt.Unix()
+	rep := &FileRepresentation{
+		FileName:         filepath.Base(filename),
+		FileSize:         size,
+		BlockHashes:      blockHashes,
+		RandomizerHashes: randomizerHashes,
+		BlockSize:        blockSize,
+		Timestamp:        timestamp,
+		ContentType:      contentType,
+		Disposition:      opts.disposition,
+		FileHash:         digest,
+		HashAlgorithm:    rfs.FileHashAlgorithm,
+		Version:          RepresentationVersion,
+
+		SecondRandomizerHashes: secondHashes,
+	}
+	if seeded {
+		rep.RandomizerSeeds = seeds
+	}
+	if opts.compression != "" {
+		rep.Compression, rep.StoredSize, rep.FileSize = opts.compression, size, opts.fileSize
+	}
+	if opts.encryption != "" {
+		rep.Encryption, rep.PasswordSalt, rep.StoredSize, rep.FileSize = opts.encryption, opts.passwordSalt, size, opts.fileSize
+	}
+	if rfs.blockHash != mh.SHA2_256 {
+		rep.BlockHashFunc = blockHashName(rfs.blockHash)
+	}
+	rep.OrderHash = representationOrderHash(rep)
+
+	repHash, encrypted, err := rfs.commitRepresentation(ctx, journal, rep, storedAt, opts)
+	if err != nil {
+		return nil, err
+	}
+	rfs.registerContent(opts.contentHash, repHash)
+	for _, hash := range fresh {
+		rfs.randomizers.add(hash, blockSize)
+	}
+
+	generated := int64(len(blockHashes) - sparse + len(fresh))
+	rfs.updateStats(func(s *Stats) {
+		s.FilesStored++
+		s.BlocksGenerated += generated
+		s.SparseBlocks += int64(sparse)
+		s.RandomizersReused += int64(reused)
+		s.TotalSize += rep.FileSize
+		if rep.compressed() {
+			s.UncompressedBytes += rep.FileSize
+			s.CompressedBytes += size
+		}
+	})
+
+	rfs.log().Info("Stored file", "file", rep.FileName, "bytes", rep.FileSize, "blocks", len(blockHashes), "rep_hash", repHash, "duration", time.Since(start))
+	if opts.result != nil {
+		*opts.result = StoreResult{
+			BlocksTotal:  int64(len(representationBlocks(rep))),
+			BlocksNew:    generated,
+			BlocksReused: int64(reused),
+			BytesStored:  generated * int64(blockSize),
+		}
+	}
+
+	return &RandomURL{
+		Scheme:    "rd",
+		Host:      "randomfs",
+		Version:   RepresentationVersion,
+		FileName:  rep.FileName,
+		FileSize:  rep.FileSize,
+		Timestamp: timestamp,
+		RepHash:   repHash,
+		Encrypted: encrypted,
+	}, nil
+}
+
+// commitRepresentation pins the blocks of rep unless opts.deferPins is
+// set, stores rep, sealed with the RepresentationKey if there is one, and
+// pins and indexes it, as far as the PinPolicy asks. It returns the representation hash and whether it
+// is encrypted. Callers hold the write lock.
+func (rfs *RandomFS) commitRepresentation(ctx context.Context, journal *storeJournal, rep *FileRepresentation, storedAt time.Time, opts storeOptions) (string, bool, error) {
+	// Pin the blocks before the representation referencing them exists
+	if rfs.pinsBlocks() && !opts.deferPins {
+		if err := rfs.pinBatches(ctx, "add", uniqueHashes(representationBlocks(rep))); err != nil {
+			return "", false, fmt.Errorf("failed to pin blocks: %w", err)
+		}
+	}
+
+	repData, err := json.Marshal(rep)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to marshal representation: %v", err)
+	}
+	encrypted := rfs.RepresentationKey != nil
+	if encrypted {
+		if repData, err = rfs.sealRepresentation(repData); err != nil {
+			return "", false, fmt.Errorf("failed to encrypt representation: %v", err)
+		}
+	}
+
+	_, repSpan := rfs.startSpan(ctx, "randomfs.storeRepresentation",
+		attribute.Int("randomfs.representation.bytes", len(repData)))
+	repHash, err := rfs.storeRepresentation(ctx, repData)
+	endSpan(repSpan, err)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to store representation: %w", err)
+	}
+	if err := journal.record(repHash); err != nil {
+		return "", false, err
+	}
+	if rfs.pinsRepresentations() && !opts.deferPins {
+		if err := rfs.ipfsPin(ctx, "add", []string{repHash}); err != nil {
+			return "", false, fmt.Errorf("failed to pin representation: %w", err)
+		}
+	}
+
+	if err := rfs.index.put(&IndexEntry{
+		RepHash:     repHash,
+		FileName:    rep.FileName,
+		FileSize:    rep.FileSize,
+		ContentType: rep.ContentType,
+		StoredAt:    storedAt,
+		ExpiresAt:   opts.expiresAt,
+		BlockSize:   rep.BlockSize,
+		Blocks:      representationBlocks(rep),
+	}); err != nil {
+		return "", false, fmt.Errorf("failed to index file: %v", err)
+	}
+	return repHash, encrypted, nil
+}
+
+// RetrieveFile reconstructs a file from its representation hash
+func (rfs *RandomFS) RetrieveFile(repHash string) ([]byte, *FileRepresentation, error) {
+	return rfs.RetrieveFileContext(context.Background(), repHash)
+}
+
+// RetrieveFileContext retrieves a file like RetrieveFile, giving up when
+// ctx is done and cancelling block transfers in flight
+func (rfs *RandomFS) RetrieveFileContext(ctx context.Context, repHash string) ([]byte, *FileRepresentation, error) {
+	return rfs.retrieveFile(ctx, repHash, "")
+}
+
+// retrieveFile reconstructs a file, decrypting it with password if it was
+// stored with one
+func (rfs *RandomFS) retrieveFile(ctx context.Context, repHash, password string) (data []byte, rep *FileRepresentation, err error) {
+	start := time.Now()
+	ctx, span := rfs.startSpan(ctx, "randomfs.RetrieveFile",
+		attribute.String("randomfs.rep_hash", repHash))
+	defer func() {
+		rfs.noteRetrieval(repHash, err)
+		rfs.observeOperation(OpRetrieve, start, err)
+		endSpan(span, err)
+	}()
+
+	rfs.mutex.RLock()
+	defer rfs.mutex.RUnlock()
+
+	rep, err = rfs.loadRepresentationTraced(ctx, repHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	span.SetAttributes(
+		attribute.Int64("randomfs.file.size", rep.FileSize),
+		attribute.Int("randomfs.block.count", len(rep.BlockHashes)))
+
+	var result bytes.Buffer
+	result.Grow(int(rep.dataSize()))
+	if err := rfs.writeBlocks(ctx, rep, 0, &result); err != nil {
+		return nil, nil, err
+	}
+
+	if rep.FileHash != "" && rfs.VerifyFileHash {
+		digest, err := fileHash(rep.HashAlgorithm, result.Bytes())
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := verifyFileHash(rep, digest); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if rep.encrypted() {
+		if password == "" {
+			return nil, nil, checkNoPassword(rep)
+		}
+		opened, err := openBlocks(rep, result.Bytes(), password)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !rep.compressed() && int64(len(opened)) != rep.FileSize {
+			return nil, nil, fmt.Errorf("failed to decrypt %s: got %d bytes, expected %d", rep.FileName, len(opened), rep.FileSize)
+		}
+		result = *bytes.NewBuffer(opened)
+	}
+
+	if rep.compressed() {
+		var file bytes.Buffer
+		file.Grow(int(rep.FileSize))
+		if err := decompressFile(rep, &result, &file); err != nil {
+			return nil, nil, err
+		}
+		result = file
+	}
+
+	rfs.updateStats(func(s *Stats) { s.FilesRetrieved++ })
+	rfs.log().Debug("Retrieved file", "file", rep.FileName, "bytes", result.Len(), "rep_hash", repHash, "duration", time.Since(start))
+
+	return result.Bytes(), rep, nil
+}
+
+// GetRepresentation loads the representation of a stored file without
+// fetching any of its blocks
+func (rfs *RandomFS) GetRepresentation(repHash string) (*FileRepresentation, error) {
+	rfs.mutex.RLock()
+	defer rfs.mutex.RUnlock()
+
+	return rfs.loadRepresentation(repHash)
+}
+
+// loadRepresentation fetches and parses a representation, rejecting
+// manifests over the configured limits before any block is fetched
+func (rfs *RandomFS) loadRepresentation(repHash string) (*FileRepresentation, error) {
+	return rfs.loadRepresentationContext(context.Background(), repHash)
+}
+
+// loadRepresentationContext loads a representation like
+// loadRepresentation, giving up when ctx is done
+func (rfs *RandomFS) loadRepresentationContext(ctx context.Context, repHash string) (*FileRepresentation, error) {
+	if rep, ok := rfs.parsedReps.get(repHash); ok {
+		return rep, nil
+	}
+
+	repData, err := rfs.retrieveRepresentation(ctx, repHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve representation: %w", err)
+	}
+
+	if rfs.MaxRepresentationSize > 0 && int64(len(repData)) > rfs.MaxRepresentationSize {
+		return nil, fmt.Errorf("%w: %d bytes exceeds limit of %d", ErrRepresentationTooLarge, len(repData), rfs.MaxRepresentationSize)
+	}
+
+	rep, err := rfs.parseRepresentation(repData)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := len(rep.BlockHashes) + len(rep.RandomizerHashes) + len(rep.SecondRandomizerHashes)
+	if rfs.MaxRepresentationBlocks > 0 && blocks > rfs.MaxRepresentationBlocks {
+		return nil, fmt.Errorf("%w: %d blocks exceeds limit of %d", ErrRepresentationTooLarge, blocks, rfs.MaxRepresentationBlocks)
+	}
+
+	if err := checkRandomizerCounts(rep); err != nil {
+		return nil, err
+	}
+
+	switch rep.Compression {
+	case "", CompressionNone, CompressionGzip, CompressionZstd:
+	default:
+		return nil, fmt.Errorf("%w %q in representation %s", ErrUnknownCompression, rep.Compression, repHash)
+	}
+
+	if rep.OrderHash != "" && rep.OrderHash != representationOrderHash(rep) {
+		return nil, fmt.Errorf("%w: representation %s", ErrBlockOrder, repHash)
+	}
+
+	for _, ref := range representationBlocks(rep) {
+		if !rfs.supportsRef(ref) {
+			return nil, fmt.Errorf("%w: representation %s refers to %q", ErrUnsupportedRef, repHash, ref)
+		}
+	}
+	if err := checkBlockHashFunc(rep); err != nil {
+		return nil, fmt.Errorf("representation %s: %w", repHash, err)
+	}
+
+	rfs.parsedReps.put(repHash, rep)
+	return rep, nil
+}
+
+// parseRepresentation decrypts and decodes a marshaled representation.
+// With StrictRepresentations, fields the struct does not declare are an
+// error rather than silently dropped.
+func (rfs *RandomFS) parseRepresentation(repData []byte) (*FileRepresentation, error) {
+	repData, err := rfs.openRepresentation(repData)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(repData))
+	if rfs.StrictRepresentations {
+		decoder.DisallowUnknownFields()
+	}
+
+	var rep FileRepresentation
+	if err := decoder.Decode(&rep); err != nil {
+		if rfs.StrictRepresentations && strings.HasPrefix(err.Error(), "json: unknown field") {
+			return nil, fmt.Errorf("%w: %v", ErrUnknownRepresentationField, err)
+		}
+		return nil, fmt.Errorf("failed to parse representation: %v", err)
+	}
+	return &rep, nil
+}
+
+// GetStats returns a consistent snapshot of the usage statistics
+func (rfs *RandomFS) GetStats() Stats {
+	rfs.statsMutex.Lock()
+	stats := rfs.stats
+	rfs.statsMutex.Unlock()
+
+	stats.UniqueBlocks, stats.BlockReferences = rfs.index.blockTotals()
+	stats.PopularPoolSize, stats.PopularPoolHitRate = rfs.popular.usage()
+	stats.ParsedRepresentationHits, stats.ParsedRepresentationMisses = rfs.parsedReps.counts()
+	return stats
+}
+
+// updateStats applies update to the statistics. Counters updated together
+// are seen together by GetStats.
+func (rfs *RandomFS) updateStats(update func(stats *Stats)) {
+	rfs.statsMutex.Lock()
+	defer rfs.statsMutex.Unlock()
+
+	update(&rfs.stats)
+}
+
+// Close releases resources held by the RandomFS instance
+func (rfs *RandomFS) Close() error {
+	return rfs.CloseContext(context.Background())
+}
+
+// CloseContext stops the background workers, waiting for async stores and
+// maintenance passes in progress, writes the state held in memory to the
+// data directory and releases the instance. Workers still running when
+// ctx is done are abandoned and the state is written without them.
+func (rfs *RandomFS) CloseContext(ctx context.Context) error {
+	var err error
+	rfs.closeOnce.Do(func() {
+		close(rfs.done)
+		stopped := make(chan struct{})
+		go func() {
+			rfs.background.Wait()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			err = fmt.Errorf("failed to stop background workers: %w", ctx.Err())
+		}
+
+		err = errors.Join(err, rfs.persistState())
+		if rfs.lock != nil {
+			err = errors.Join(err, rfs.lock.Close())
+		}
+	})
+	if !rfs.sharedCache {
+		rfs.cache.clearMemory()
+	}
+	return err
+}
+
+// persistState writes the index and, with a persistent cache, the blocks
+// cached only in memory, so they are there after a restart
+func (rfs *RandomFS) persistState() error {
+	if !rfs.sharedCache {
+		rfs.cache.persistMemory()
+	}
+	if rfs.readOnly {
+		return nil
+	}
+	rfs.index.mutex.Lock()
+	defer rfs.index.mutex.Unlock()
+
+	if err := rfs.index.save(); err != nil {
+		return fmt.Errorf("failed to save index: %v", err)
+	}
+	return nil
+}
+
+// storedBlock is a block of a batch once it has been stored
+type storedBlock struct {
+	hash           string
+	randomizerHash string
+	randomizerSeed string
+	secondHash     string
+	sparse         bool
+	// fresh holds the randomizers generated for the block, and reused
+	// counts those taken from the pool
+	fresh  []string
+	reused int
+}
+
+// storeBatch stores the blocks of batch, numbered from start, and their
+// fresh randomizers on up to StoreWorkers goroutines, returning them in
+// block order. The first failure cancels the stores still running, and
+// every block stored is recorded in journal for the rollback.
+func (rfs *RandomFS) storeBatch(ctx context.Context, journal *storeJournal, batch []*pendingBlock, start int) ([]storedBlock, error) {
+	stored := make([]storedBlock, len(batch))
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(max(rfs.StoreWorkers, 1))
+	for i, pending := range batch {
+		if pending.sparse != "" {
+			stored[i] = storedBlock{hash: pending.sparse, sparse: true}
+			continue
+		}
+		group.Go(func() (err error) {
+			stored[i], err = rfs.storePendingBlock(ctx, journal, pending, start+i)
+			return err
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// storePendingBlock stores block index and its fresh randomizers
+func (rfs *RandomFS) storePendingBlock(ctx context.Context, journal *storeJournal, pending *pendingBlock, index int) (storedBlock, error) {
+	var block storedBlock
+
+	// storeRandomizer stores a fresh randomizer and returns its hash, or
+	// returns the hash of a reused one
+	storeRandomizer := func(randomizer []byte, hash, digest string) (string, error) {
+		if hash != "" {
+			block.reused++
+			return hash, nil
+		}
+		hash, err := rfs.storeBlockTraced(ctx, blockKindRandomizer, randomizer, digest)
+		if err != nil {
+			return "", fmt.Errorf("failed to randomize block %d: failed to store randomizer: %w", index, err)
+		}
+		if err := journal.record(hash); err != nil {
+			return "", err
+		}
+		block.fresh = append(block.fresh, hash)
+		return hash, nil
+	}
+
+	var err error
+	block.randomizerSeed = pending.randomizerSeed
+	if block.randomizerHash, err = storeRandomizer(pending.randomizer, pending.randomizerHash, pending.randomizerDigest); err != nil {
+		return block, err
+	}
+	if rfs.TwoRandomizers {
+		if block.secondHash, err = storeRandomizer(pending.second, pending.secondHash, pending.secondDigest); err != nil {
+			return block, err
+		}
+	}
+
+	hash, err := rfs.storeBlockTraced(ctx, blockKindData, pending.block, pending.blockDigest)
+	if err != nil {
+		return block, fmt.Errorf("failed to store block %d: %w", index, err)
+	}
+	if err := journal.record(hash); err != nil {
+		return block, err
+	}
+	block.hash = hash
+	return block, nil
+}
+
+// checkFileSize returns ErrFileTooLarge for a file of size bytes over
+// MaxFileSize. Streams of unknown size are limited as they are read.
+func (rfs *RandomFS) checkFileSize(size int64) error {
+	if rfs.MaxFileSize > 0 && size > rfs.MaxFileSize {
+		return fmt.Errorf("%w: %d bytes exceeds limit of %d", ErrFileTooLarge, size, rfs.MaxFileSize)
+	}
+	return nil
+}
+
+// selectBlockSize picks a block size tier based on file size, unless
+// FixedBlockSize is set
+func (rfs *RandomFS) selectBlockSize(fileSize int64) int {
+	if rfs.FixedBlockSize > 0 {
+		return rfs.FixedBlockSize
+	}
+	return tierBlockSize(fileSize)
+}
+
+// checkBlockSize returns ErrInvalidBlockSize unless size is a power of two
+// from NanoBlockSize to BlockSize
+func checkBlockSize(size int) error {
+	if size < NanoBlockSize || size > BlockSize || size&(size-1) != 0 {
+		return fmt.Errorf("%w %d: must be a power of two from %d to %d bytes", ErrInvalidBlockSize, size, NanoBlockSize, BlockSize)
+	}
+	return nil
+}
+
+// tierBlockSize returns the block size tier for a file of fileSize bytes
+func tierBlockSize(fileSize int64) int {
+	if fileSize <= nanoThreshold {
+		return NanoBlockSize
+	}
+	if fileSize <= miniThreshold {
+		return MiniBlockSize
+	}
+	return BlockSize
+}
+
+// randomizeBlock XORs a zero-padded block of file data in place with a
+// randomizer chosen by policy, either a reused one from the pool or a fresh
+// random block, which the caller stores. With TwoRandomizers it is XORed
+// with a second, distinct randomizer chosen the same way.
+func (rfs *RandomFS) randomizeBlock(block []byte, policy RandomizerPolicy, rctx RandomizerContext) (*pendingBlock, error) {
+	randomizer, randomizerHash, seed, err := rfs.chooseRandomizer(policy, rctx, "")
+	if err != nil {
+		return nil, err
+	}
+	xorBlock(block, randomizer)
+	pending := &pendingBlock{block: block, randomizerHash: randomizerHash, randomizerSeed: seed}
+	if randomizerHash == "" {
+		pending.randomizer = randomizer
+	}
+	if !rfs.TwoRandomizers {
+		return pending, nil
+	}
+
+	// A fresh first randomizer cannot be in the pool, so only a reused
+	// one needs excluding
+	rctx.second = true
+	second, secondHash, _, err := rfs.chooseRandomizer(policy, rctx, randomizerHash)
+	if err != nil {
+		return nil, err
+	}
+	xorBlock(block, second)
+	pending.secondHash = secondHash
+	if secondHash == "" {
+		pending.second = second
+	}
+	return pending, nil
+}
+
+// xorBlock XORs randomizer into block in place
+func xorBlock(block, randomizer []byte) {
+	for i := range block {
+		block[i] ^= randomizer[i]
+	}
+}
+
+// deRandomizeBlock reverses the XOR randomization of a block, given all of
+// its randomizers
+func (rfs *RandomFS) deRandomizeBlock(block []byte, dataSize int, randomizers ...[]byte) []byte {
+	if dataSize > len(block) {
+		dataSize = len(block)
+	}
+
+	result := make([]byte, dataSize)
+	copy(result, block)
+	for _, randomizer := range randomizers {
+		xorBlock(result, randomizer)
+	}
+	return result
+}
+
+// randomizerRefs returns the randomizers of block i of rep, in the order
+// they were applied
+func randomizerRefs(rep *FileRepresentation, i int) []string {
+	refs := []string{rep.RandomizerHashes[i]}
+	if i < len(rep.SecondRandomizerHashes) {
+		refs = append(refs, rep.SecondRandomizerHashes[i])
+	}
+	return refs
+}
+
+// checkRandomizerCounts rejects a representation without exactly one
+// randomizer, or with TwoRandomizers two, per block
+func checkRandomizerCounts(rep *FileRepresentation) error {
+	if len(rep.RandomizerHashes) != len(rep.BlockHashes) {
+		return fmt.Errorf("representation has %d blocks but %d randomizers", len(rep.BlockHashes), len(rep.RandomizerHashes))
+	}
+	if second := len(rep.SecondRandomizerHashes); second != 0 && second != len(rep.BlockHashes) {
+		return fmt.Errorf("representation has %d blocks but %d second randomizers", len(rep.BlockHashes), second)
+	}
+	if seeds := len(rep.RandomizerSeeds); seeds != 0 && seeds != len(rep.BlockHashes) {
+		return fmt.Errorf("representation has %d blocks but %d randomizer seeds", len(rep.BlockHashes), seeds)
+	}
+	return nil
+}
+
+// storeBlock stores a block in IPFS (or locally) and caches it
+func (rfs *RandomFS) storeBlock(block []byte) (string, error) {
+	return rfs.storeBlockDigest(context.Background(), block, "")
+}
+
+// storeBlockDigest stores a block like storeBlock. A non-empty key is the
+// precomputed local key of the block under the configured hash function,
+// which the local store uses instead of hashing it again.
+func (rfs *RandomFS) storeBlockDigest(ctx context.Context, block []byte, key string) (string, error) {
+	var hash string
+	var err error
+
+	if key == "" {
+		key = blockKey(rfs.blockHash, block)
+	}
+	if rfs.useIPFS {
+		hash, err = rfs.putBlock(ctx, block, key)
+		if err != nil {
+			return "", err
+		}
+		// The daemon must address the block as local storage would, or
+		// the same block would have two identities
+		if address := canonicalRef(key); canonicalRef(hash) != address {
+			return "", fmt.Errorf("%w: IPFS added block %s as %s", ErrBlockMismatch, address, hash)
+		}
+		rfs.log().Debug("Stored block via IPFS", "block", hash)
+	} else {
+		hash, err = rfs.storeLocalDigest(block, key)
+		if err != nil {
+			return "", err
+		}
+		if rfs.SelfDescribingRefs {
+			hash = canonicalRef(hash)
+		}
+	}
+
+	if _, exists := rfs.cache.Get(hash); exists {
+		rfs.updateStats(func(s *Stats) { s.CacheHits++ })
+	} else {
+		rfs.updateStats(func(s *Stats) { s.CacheMisses++ })
+	}
+	rfs.cache.Put(hash, block)
+
+	return hash, nil
+}
+
+// retrieveBlock fetches a block from the cache, IPFS, or local storage.
+// Concurrent misses for the same hash share a single backend fetch.
+// A positive size is the exact length the block must have.
+func (rfs *RandomFS) retrieveBlock(hash string, size int) ([]byte, error) {
+	return rfs.retrieveBlockContext(context.Background(), hash, size)
+}
+
+// retrieveBlockContext fetches a block like retrieveBlock, giving up when
+// ctx is done. A fetch shared with other callers is abandoned only once
+// the caller that started it is done.
+func (rfs *RandomFS) retrieveBlockContext(ctx context.Context, hash string, size int) ([]byte, error) {
+	if data, exists := rfs.cache.Get(hash); exists {
+		rfs.updateStats(func(s *Stats) { s.CacheHits++ })
+		return data, nil
+	}
+	rfs.updateStats(func(s *Stats) { s.CacheMisses++ })
+
+	for {
+		data, err := rfs.sharedFetch(ctx, hash, size)
+		// A fetch abandoned by the caller that started it is retried by
+		// callers still waiting
+		if err != nil && ctx.Err() == nil && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+			continue
+		}
+		return data, err
+	}
+}
+
+// sharedFetch fetches a block from the backend once for all concurrent
+// callers
+func (rfs *RandomFS) sharedFetch(ctx context.Context, hash string, size int) ([]byte, error) {
+	results := rfs.fetches.DoChan(hash, func() (interface{}, error) {
+		// A fetch that finished just before this one started may already
+		// have populated the cache
+		if data, exists := rfs.cache.Get(hash); exists {
+			return data, nil
+		}
+
+		data, err := rfs.fetchWithFallback(ctx, hash, size)
+		if err != nil {
+			return nil, err
+		}
+		if rfs.VerifyBlocks {
+			if err := rfs.verifyBlock(hash, data, size); err != nil {
+				return nil, err
+			}
+		}
+		rfs.cache.Put(hash, data)
+		return data, nil
+	})
+
+	select {
+	case result := <-results:
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		return result.Val.([]byte), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fetchBlock reads a block from the backend, bypassing the cache
+func (rfs *RandomFS) fetchBlock(ctx context.Context, hash string) ([]byte, error) {
+	if rfs.useIPFS {
+		return rfs.catFromIPFS(ctx, hash)
+	}
+	return rfs.retrieveLocal(hash)
+}
+
+// releaseBlocks drops blocks from the cache and the backend. Blocks in
+// IPFS are unpinned in batches so the daemon can garbage collect them.
+func (rfs *RandomFS) releaseBlocks(hashes []string) error {
+	for _, hash := range hashes {
+		rfs.cache.Delete(hash)
+		if rfs.repCache != nil {
+			rfs.repCache.Delete(hash)
+		}
+		rfs.parsedReps.remove(hash)
+		rfs.randomizers.remove(hash)
+		rfs.popular.remove(hash)
+	}
+
+	if rfs.useIPFS {
+		return rfs.pinBatches(context.Background(), "rm", hashes)
+	}
+
+	for _, hash := range hashes {
+		key, err := rfs.backendKey(hash)
+		if err != nil {
+			return err
+		}
+		if err := rfs.blocks.Delete(key); err != nil {
+			return fmt.Errorf("failed to release block %s: %v", hash, err)
+		}
+	}
+	return nil
+}
+
+// storeRepresentation stores a marshaled file representation and adds it
+// to the representation cache, if any
+func (rfs *RandomFS) storeRepresentation(ctx context.Context, repData []byte) (string, error) {
+	var repHash string
+	var err error
+	if rfs.useIPFS {
+		repHash, err = rfs.addToIPFS(ctx, repData, false)
+	} else {
+		repHash, err = rfs.storeLocal(repData)
+	}
+	if err == nil && rfs.repCache != nil {
+		rfs.repCache.Put(repHash, repData)
+	}
+	return repHash, err
+}
+
+// retrieveRepresentation fetches a marshaled file representation, from
+// the representation cache if one is set and holds it
+func (rfs *RandomFS) retrieveRepresentation(ctx context.Context, repHash string) ([]byte, error) {
+	if rfs.repCache != nil {
+		if repData, exists := rfs.repCache.Get(repHash); exists {
+			return repData, nil
+		}
+	}
+
+	var repData []byte
+	var err error
+	if rfs.useIPFS {
+		repData, err = rfs.catFromIPFS(ctx, repHash)
+	} else {
+		repData, err = rfs.retrieveLocal(repHash)
+	}
+	if err == nil && rfs.repCache != nil {
+		rfs.repCache.Put(repHash, repData)
+	}
+	return repData, err
+}
+
+// storeLocal writes data to the block store of an instance without IPFS,
+// keyed by its SHA-256
+func (rfs *RandomFS) storeLocal(data []byte) (string, error) {
+	return rfs.storeLocalDigest(data, blockDigest(data))
+}
+
+// storeLocalDigest writes data like storeLocal under hash, its
+// precomputed local key
+func (rfs *RandomFS) storeLocalDigest(data []byte, hash string) (string, error) {
+	stored, err := rfs.putBlock(context.Background(), data, hash)
+	if err != nil {
+		return "", err
+	}
+	if stored != hash {
+		return "", fmt.Errorf("%w: block store stored %s as %s", ErrBlockMismatch, hash, stored)
+	}
+	return stored, nil
+}
+
+// retrieveLocal reads data from the block store of an instance without
+// IPFS
+func (rfs *RandomFS) retrieveLocal(hash string) ([]byte, error) {
+	key, err := rfs.backendKey(hash)
+	if err != nil {
+		return nil, err
+	}
+	data, err := rfs.blocks.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve block %s: %w", hash, err)
+	}
+	return data, nil
+}
+
+// addToIPFS adds data to IPFS via the HTTP API and returns its hash. Raw
+// adds store data as a single raw block whose CID hashes exactly its bytes.
+func (rfs *RandomFS) addToIPFS(ctx context.Context, data []byte, raw bool) (string, error) {
+	if raw {
+		return rfs.addBlockToIPFS(ctx, data, mh.SHA2_256)
+	}
+	return rfs.ipfsAdd(ctx, data, "/api/v0/add?pin=false")
+}
+
+// addBlockToIPFS adds data as a single raw block whose CID carries the
+// multihash code of its bytes
+func (rfs *RandomFS) addBlockToIPFS(ctx context.Context, data []byte, code uint64) (string, error) {
+	endpoint := fmt.Sprintf("/api/v0/add?pin=false&cid-version=1&raw-leaves=true&chunker=size-%d", BlockSize)
+	if code != mh.SHA2_256 {
+		endpoint += "&hash=" + blockHashName(code)
+	}
+	return rfs.ipfsAdd(ctx, data, endpoint)
+}
+
+// ipfsAdd posts data to the add endpoint, which carries the add options
+func (rfs *RandomFS) ipfsAdd(ctx context.Context, data []byte, endpoint string) (string, error) {
+	rfs.updateStats(func(s *Stats) { s.IPFSAddTotal++ })
+	start := time.Now()
+	var hash string
+	err := rfs.withRetry(ctx, "add", func() (err error) {
+		hash, err = rfs.doIPFSAdd(ctx, data, endpoint)
+		return err
+	})
+	rfs.noteBackendCall("ipfs add", err)
+	rfs.observeIPFSCall(OpIPFSAdd, start, err)
+	if err != nil {
+		rfs.updateStats(func(s *Stats) { s.IPFSAddErrors++ })
+	}
+	return hash, err
+}
+
+// doIPFSAdd performs the add request for ipfsAdd
+func (rfs *RandomFS) doIPFSAdd(ctx context.Context, data []byte, endpoint string) (string, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("file", "block")
+	if err != nil {
+		return "", err
+	}
+	if _, err := part.Write(data); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	resp, err := rfs.ipfsPost(ctx, endpoint, writer.FormDataContentType(), &body)
+	if err != nil {
+		return "", fmt.Errorf("IPFS add failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return "", &ipfsStatusError{op: "add", status: resp.StatusCode, msg: string(msg)}
+	}
+
+	var result struct {
+		Hash string `json:"Hash"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode IPFS add response: %v", err)
+	}
+
+	return result.Hash, nil
+}
+
+// catFromIPFS retrieves data from IPFS via the HTTP API or, when that
+// fails and a gateway is configured, from the gateway
+func (rfs *RandomFS) catFromIPFS(ctx context.Context, hash string) ([]byte, error) {
+	if rfs.gatewayOnly {
+		return rfs.catFromGateway(ctx, hash)
+	}
+	data, err := rfs.catFromAPI(ctx, hash)
+	if err != nil && rfs.gateway != nil && ctx.Err() == nil {
+		gatewayData, gatewayErr := rfs.catFromGateway(ctx, hash)
+		if gatewayErr == nil {
+			return gatewayData, nil
+		}
+		rfs.log().Warn("Gateway fallback failed", "block", hash, "error", gatewayErr)
+	}
+	return data, err
+}
+
+// catFromAPI retrieves data through the IPFS HTTP API
+func (rfs *RandomFS) catFromAPI(ctx context.Context, hash string) ([]byte, error) {
+	rfs.updateStats(func(s *Stats) { s.IPFSCatTotal++ })
+	start := time.Now()
+	var data []byte
+	err := rfs.withRetry(ctx, "cat", func() (err error) {
+		data, err = rfs.doIPFSCat(ctx, hash)
+		return err
+	})
+	rfs.noteBackendCall("ipfs cat "+hash, err)
+	rfs.observeIPFSCall(OpIPFSCat, start, err)
+	if err != nil {
+		rfs.updateStats(func(s *Stats) { s.IPFSCatErrors++ })
+	}
+	return data, err
+}
+
+// doIPFSCat performs the cat request for catFromAPI
+func (rfs *RandomFS) doIPFSCat(ctx context.Context, hash string) ([]byte, error) {
+	key, err := rfs.backendKey(hash)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := rfs.ipfsPost(ctx, "/api/v0/cat?arg="+key, "", nil)
+	if err != nil {
+		return nil, fmt.Errorf("IPFS cat failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return nil, &ipfsStatusError{op: "cat", status: resp.StatusCode, msg: string(msg)}
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// unpinFromIPFS removes the pin on hash. Blocks that were never pinned are
+// not an error.
+func (rfs *RandomFS) unpinFromIPFS(ctx context.Context, hash string) error {
+	return rfs.ipfsPin(ctx, "rm", []string{hash})
+}
+
+// ipfsPin runs pin/add or pin/rm for all hashes in a single API call.
+// Removing the pin of a single hash that is not pinned is not an error.
+func (rfs *RandomFS) ipfsPin(ctx context.Context, op string, hashes []string) error {
+	rfs.updateStats(func(s *Stats) { s.IPFSPinTotal++ })
+	err := rfs.doIPFSPin(ctx, op, hashes)
+	if errors.Is(err, errNotPinned) && len(hashes) == 1 {
+		err = nil
+	}
+	rfs.noteBackendCall("ipfs pin/"+op, err)
+	if err != nil {
+		rfs.updateStats(func(s *Stats) { s.IPFSPinErrors++ })
+		return err
+	}
+	return nil
+}
+
+// doIPFSPin performs the pin request for ipfsPin
+func (rfs *RandomFS) doIPFSPin(ctx context.Context, op string, hashes []string) error {
+	query := url.Values{}
+	for _, hash := range hashes {
+		key, err := rfs.backendKey(hash)
+		if err != nil {
+			return err
+		}
+		query.Add("arg", key)
+	}
+
+	resp, err := rfs.ipfsPost(ctx, "/api/v0/pin/"+op+"?"+query.Encode(), "", nil)
+	if err != nil {
+		return fmt.Errorf("IPFS pin/%s failed: %w", op, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		if op == "rm" && strings.Contains(string(msg), "not pinned") {
+			return fmt.Errorf("IPFS pin/rm: %w", errNotPinned)
+		}
+		return fmt.Errorf("IPFS pin/%s returned %d: %s", op, resp.StatusCode, string(msg))
+	}
+	return nil
+}
+
+// ipfsPost sends a POST request to path on the IPFS API, abandoning it
+// when ctx is done
+func (rfs *RandomFS) ipfsPost(ctx context.Context, path, contentType string, body io.Reader) (*http.Response, error) {
+	store, ok := rfs.blocks.(*IPFSBlockStore)
+	if !ok {
+		return nil, errors.New("IPFS is not enabled")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, store.api+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// testIPFSConnection checks that the IPFS API is reachable
+func (rfs *RandomFS) testIPFSConnection(ctx context.Context) error {
+	resp, err := rfs.ipfsPost(ctx, "/api/v0/version", "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("IPFS version returned %d", resp.StatusCode)
+	}
+	return nil
+}
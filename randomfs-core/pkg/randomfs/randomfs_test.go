@@ -0,0 +1,1054 @@
+package randomfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TheEntropyCollective/randomfs-core/internal/ipfstest"
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// newTestRandomFS creates a RandomFS backed by a temporary directory
+func newTestRandomFS(t *testing.T) *RandomFS {
+	t.Helper()
+	rfs, err := NewRandomFSWithoutIPFS(t.TempDir(), 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFSWithoutIPFS: %v", err)
+	}
+	return rfs
+}
+
+// storeCraftedRepresentation stores rep directly, bypassing StoreFile
+func storeCraftedRepresentation(t *testing.T, rfs *RandomFS, rep *FileRepresentation) string {
+	t.Helper()
+	repData, err := json.Marshal(rep)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	repHash, err := rfs.storeRepresentation(context.Background(), repData)
+	if err != nil {
+		t.Fatalf("storeRepresentation: %v", err)
+	}
+	return repHash
+}
+
+func TestRetrieveFileRejectsOversizedRepresentation(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	rfs.MaxRepresentationBlocks = 1000
+
+	const blockCount = 5000
+	rep := &FileRepresentation{
+		FileName:    "bomb.bin",
+		FileSize:    int64(blockCount) * NanoBlockSize,
+		BlockSize:   NanoBlockSize,
+		Version:     RepresentationVersion,
+		BlockHashes: make([]string, blockCount),
+	}
+	rep.RandomizerHashes = make([]string, blockCount)
+	for i := range rep.BlockHashes {
+		rep.BlockHashes[i] = fmt.Sprintf("missing-block-%d", i)
+		rep.RandomizerHashes[i] = fmt.Sprintf("missing-randomizer-%d", i)
+	}
+	repHash := storeCraftedRepresentation(t, rfs, rep)
+
+	_, _, err := rfs.RetrieveFile(repHash)
+	if !errors.Is(err, ErrRepresentationTooLarge) {
+		t.Fatalf("expected ErrRepresentationTooLarge, got %v", err)
+	}
+	if misses := rfs.GetStats().CacheMisses; misses != 0 {
+		t.Fatalf("expected no block fetches before rejection, got %d cache misses", misses)
+	}
+}
+
+func TestRetrieveFileRejectsRepresentationOverByteLimit(t *testing.T) {
+	rfs := newTestRandomFS(t)
+
+	url, err := rfs.StoreFile("small.txt", []byte("hello"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+
+	rfs.MaxRepresentationSize = 16
+	if _, _, err := rfs.RetrieveFile(url.RepHash); !errors.Is(err, ErrRepresentationTooLarge) {
+		t.Fatalf("expected ErrRepresentationTooLarge, got %v", err)
+	}
+
+	rfs.MaxRepresentationSize = 0
+	data, _, err := rfs.RetrieveFile(url.RepHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile with limit disabled: %v", err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("unexpected data %q", data)
+	}
+}
+
+// countingIPFS is a minimal IPFS API mock that counts cat calls per hash.
+// Adds requesting raw leaves with a large enough chunker get a raw CIDv1;
+// anything else is treated like a chunked file and gets a dag-pb CID.
+type countingIPFS struct {
+	mutex    sync.Mutex
+	blocks   map[string][]byte
+	cats     map[string]int
+	pinned   map[string]bool
+	pinCalls int
+	catDelay time.Duration
+	corrupt  bool
+	failAdd  bool
+	addDelay time.Duration
+	// failAddAfter fails every add after that many have succeeded
+	failAddAfter int
+	adds         int
+	// failRepresentations fails adds that are not raw blocks
+	failRepresentations bool
+}
+
+func newCountingIPFS(tb testing.TB) (*countingIPFS, *httptest.Server) {
+	tb.Helper()
+	mock := &countingIPFS{
+		blocks: make(map[string][]byte),
+		cats:   make(map[string]int),
+		pinned: make(map[string]bool),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v0/version", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Version":"mock"}`))
+	})
+	mux.HandleFunc("/api/v0/add", func(w http.ResponseWriter, r *http.Request) {
+		mock.mutex.Lock()
+		fail := mock.failAdd || mock.failRepresentations && r.URL.Query().Get("raw-leaves") != "true"
+		delay := mock.addDelay
+		mock.adds++
+		if mock.failAddAfter > 0 && mock.adds > mock.failAddAfter {
+			fail = true
+		}
+		mock.mutex.Unlock()
+
+		time.Sleep(delay)
+		if fail {
+			http.Error(w, "add failed", http.StatusInternalServerError)
+			return
+		}
+
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, _ := io.ReadAll(file)
+		digest, _ := mh.Sum(data, mh.SHA2_256, -1)
+		hash := cid.NewCidV0(digest).String()
+
+		query := r.URL.Query()
+		var chunkSize int
+		fmt.Sscanf(query.Get("chunker"), "size-%d", &chunkSize)
+		if query.Get("raw-leaves") == "true" && len(data) <= chunkSize {
+			hash = cid.NewCidV1(cid.Raw, digest).String()
+		}
+
+		mock.mutex.Lock()
+		mock.blocks[hash] = data
+		if query.Get("pin") != "false" {
+			mock.pinned[hash] = true
+		}
+		mock.mutex.Unlock()
+		fmt.Fprintf(w, `{"Hash":%q}`, hash)
+	})
+	mux.HandleFunc("/api/v0/cat", func(w http.ResponseWriter, r *http.Request) {
+		hash := r.URL.Query().Get("arg")
+
+		mock.mutex.Lock()
+		mock.cats[hash]++
+		data, ok := mock.blocks[hash]
+		delay := mock.catDelay
+		corrupt := mock.corrupt
+		mock.mutex.Unlock()
+
+		time.Sleep(delay)
+		if !ok {
+			http.Error(w, "not found", http.StatusInternalServerError)
+			return
+		}
+		if corrupt && len(data) > 0 {
+			data = append([]byte{data[0] ^ 0xff}, data[1:]...)
+		}
+		w.Write(data)
+	})
+	mux.HandleFunc("/api/v0/pin/add", func(w http.ResponseWriter, r *http.Request) {
+		mock.mutex.Lock()
+		defer mock.mutex.Unlock()
+		mock.pinCalls++
+
+		hashes := r.URL.Query()["arg"]
+		for _, hash := range hashes {
+			if _, ok := mock.blocks[hash]; !ok {
+				http.Error(w, "block not found: "+hash, http.StatusInternalServerError)
+				return
+			}
+		}
+		for _, hash := range hashes {
+			mock.pinned[hash] = true
+		}
+		json.NewEncoder(w).Encode(map[string][]string{"Pins": hashes})
+	})
+	mux.HandleFunc("/api/v0/pin/rm", func(w http.ResponseWriter, r *http.Request) {
+		mock.mutex.Lock()
+		defer mock.mutex.Unlock()
+		mock.pinCalls++
+
+		hashes := r.URL.Query()["arg"]
+		for _, hash := range hashes {
+			if !mock.pinned[hash] {
+				http.Error(w, hash+" is not pinned", http.StatusInternalServerError)
+				return
+			}
+		}
+		for _, hash := range hashes {
+			delete(mock.pinned, hash)
+		}
+		json.NewEncoder(w).Encode(map[string][]string{"Pins": hashes})
+	})
+
+	server := httptest.NewServer(mux)
+	tb.Cleanup(server.Close)
+	return mock, server
+}
+
+func (m *countingIPFS) catCount(hash string) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.cats[hash]
+}
+
+func (m *countingIPFS) isPinned(hash string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.pinned[hash]
+}
+
+// resetPins unpins everything and zeroes the pin call count
+func (m *countingIPFS) resetPins() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.pinned = make(map[string]bool)
+	m.pinCalls = 0
+}
+
+func TestConcurrentRetrievalsShareBlockFetch(t *testing.T) {
+	mock, server := newCountingIPFS(t)
+	rfs, err := NewRandomFS(server.URL, t.TempDir(), 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFS: %v", err)
+	}
+
+	data := []byte("a popular file that everyone wants at once")
+	url, err := rfs.StoreFile("popular.txt", data, "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	_, rep, err := rfs.RetrieveFile(url.RepHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+
+	rfs.cache.Clear()
+	mock.mutex.Lock()
+	mock.cats = make(map[string]int)
+	mock.catDelay = 50 * time.Millisecond
+	mock.mutex.Unlock()
+
+	const retrievals = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, retrievals)
+	for i := 0; i < retrievals; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, _, err := rfs.RetrieveFile(url.RepHash)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if string(got) != string(data) {
+				errs <- fmt.Errorf("retrieved %q", got)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	for _, hash := range append(rep.BlockHashes, rep.RandomizerHashes...) {
+		if n := mock.catCount(hash); n != 1 {
+			t.Errorf("block %s fetched %d times, expected 1", hash, n)
+		}
+	}
+}
+
+func TestMaxSizeBlockRoundTripsAsSingleRawObject(t *testing.T) {
+	mock, server := newCountingIPFS(t)
+	rfs, err := NewRandomFS(server.URL, t.TempDir(), 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFS: %v", err)
+	}
+
+	block := make([]byte, BlockSize)
+	if _, err := rand.Read(block); err != nil {
+		t.Fatalf("rand: %v", err)
+	}
+	hash, err := rfs.storeBlock(block)
+	if err != nil {
+		t.Fatalf("storeBlock: %v", err)
+	}
+
+	c, err := cid.Decode(hash)
+	if err != nil {
+		t.Fatalf("stored hash %s is not a CID: %v", hash, err)
+	}
+	if c.Prefix().Codec != cid.Raw {
+		t.Fatalf("1MB block was not stored as a single raw object: %s", hash)
+	}
+
+	rfs.cache.Clear()
+	got, err := rfs.retrieveBlock(hash, BlockSize)
+	if err != nil {
+		t.Fatalf("retrieveBlock: %v", err)
+	}
+	if string(got) != string(block) {
+		t.Fatal("retrieved block differs from the stored block")
+	}
+
+	rfs.cache.Clear()
+	mock.mutex.Lock()
+	mock.corrupt = true
+	mock.mutex.Unlock()
+	if _, err := rfs.retrieveBlock(hash, BlockSize); !errors.Is(err, ErrBlockMismatch) {
+		t.Fatalf("expected ErrBlockMismatch for altered content, got %v", err)
+	}
+}
+
+func TestRetrieveBlockRejectsChunkedAndTruncatedBlocks(t *testing.T) {
+	_, server := newCountingIPFS(t)
+	rfs, err := NewRandomFS(server.URL, t.TempDir(), 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFS: %v", err)
+	}
+
+	// A block added without raw options comes back as a DAG root
+	dagHash, err := rfs.addToIPFS(context.Background(), make([]byte, NanoBlockSize), false)
+	if err != nil {
+		t.Fatalf("addToIPFS: %v", err)
+	}
+	if _, err := rfs.retrieveBlock(dagHash, NanoBlockSize); !errors.Is(err, ErrBlockMismatch) {
+		t.Fatalf("expected ErrBlockMismatch for a dag-pb block, got %v", err)
+	}
+
+	rawHash, err := rfs.addToIPFS(context.Background(), make([]byte, NanoBlockSize), true)
+	if err != nil {
+		t.Fatalf("addToIPFS: %v", err)
+	}
+	if _, err := rfs.retrieveBlock(rawHash, MiniBlockSize); !errors.Is(err, ErrBlockMismatch) {
+		t.Fatalf("expected ErrBlockMismatch for a length mismatch, got %v", err)
+	}
+
+	rfs.VerifyBlocks = false
+	if _, err := rfs.retrieveBlock(dagHash, NanoBlockSize); err != nil {
+		t.Fatalf("verification disabled but block rejected: %v", err)
+	}
+}
+
+func TestFailedAddIncrementsOnlyAddErrors(t *testing.T) {
+	mock, server := newCountingIPFS(t)
+	rfs, err := NewRandomFS(server.URL, t.TempDir(), 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFS: %v", err)
+	}
+
+	url, err := rfs.StoreFile("ok.txt", []byte("stored fine"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	rfs.cache.Clear()
+	if _, _, err := rfs.RetrieveFile(url.RepHash); err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+	before := rfs.GetStats()
+	if before.IPFSAddTotal != 3 || before.IPFSCatTotal != 3 {
+		t.Fatalf("expected 3 adds and 3 cats, got %d and %d", before.IPFSAddTotal, before.IPFSCatTotal)
+	}
+
+	mock.mutex.Lock()
+	mock.failAdd = true
+	mock.mutex.Unlock()
+	if _, err := rfs.StoreFile("fail.txt", []byte("will fail"), "text/plain"); err == nil {
+		t.Fatal("expected StoreFile to fail")
+	}
+
+	after := rfs.GetStats()
+	if after.IPFSAddErrors != 1 {
+		t.Fatalf("expected 1 add error, got %d", after.IPFSAddErrors)
+	}
+	if after.IPFSAddTotal != before.IPFSAddTotal+1 {
+		t.Fatalf("expected one more add, got %d -> %d", before.IPFSAddTotal, after.IPFSAddTotal)
+	}
+	if after.IPFSCatErrors != 0 || after.IPFSPinErrors != 0 {
+		t.Fatalf("unrelated error counters changed: cat %d, pin %d", after.IPFSCatErrors, after.IPFSPinErrors)
+	}
+	if after.IPFSCatTotal != before.IPFSCatTotal || after.IPFSPinTotal != before.IPFSPinTotal {
+		t.Fatal("failed add changed cat or pin totals")
+	}
+}
+
+func TestRetrieveFileRejectsReorderedBlocks(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	data := make([]byte, 3*NanoBlockSize+10)
+	for i := range data {
+		data[i] = byte(i / NanoBlockSize)
+	}
+	url, err := rfs.StoreFile("ordered.bin", data, "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	_, rep, err := rfs.RetrieveFile(url.RepHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+	if rep.OrderHash == "" {
+		t.Fatal("representation has no ordering checksum")
+	}
+
+	// Swap whole block/randomizer pairs so every block still decodes
+	rep.BlockHashes[0], rep.BlockHashes[1] = rep.BlockHashes[1], rep.BlockHashes[0]
+	rep.RandomizerHashes[0], rep.RandomizerHashes[1] = rep.RandomizerHashes[1], rep.RandomizerHashes[0]
+	rep.FileHash = ""
+	swapped := storeCraftedRepresentation(t, rfs, rep)
+
+	before := rfs.GetStats()
+	if _, _, err := rfs.RetrieveFile(swapped); !errors.Is(err, ErrBlockOrder) {
+		t.Fatalf("expected ErrBlockOrder, got %v", err)
+	}
+	if after := rfs.GetStats(); after.CacheHits != before.CacheHits || after.CacheMisses != before.CacheMisses {
+		t.Fatal("blocks were fetched before the ordering check")
+	}
+
+	rep.OrderHash = ""
+	legacy := storeCraftedRepresentation(t, rfs, rep)
+	if _, _, err := rfs.RetrieveFile(legacy); err != nil {
+		t.Fatalf("representation without an ordering checksum rejected: %v", err)
+	}
+}
+
+// offsetReaderAt records the offsets a ReaderAt source is read at
+type offsetReaderAt struct {
+	data    []byte
+	mutex   sync.Mutex
+	offsets []int64
+}
+
+func (r *offsetReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mutex.Lock()
+	r.offsets = append(r.offsets, off)
+	r.mutex.Unlock()
+	return bytes.NewReader(r.data).ReadAt(p, off)
+}
+
+func TestStoreReaderAtMatchesStoreFile(t *testing.T) {
+	rfs := newTestRandomFS(t)
+
+	// Seed the pool with a single nano randomizer so both stores reuse it
+	// and produce the same blocks
+	if _, err := rfs.StoreFile("seed.txt", []byte("seed"), "text/plain"); err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	rfs.RandomizerPolicy = AlwaysReusePolicy
+
+	data := make([]byte, 10*NanoBlockSize+3)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("rand: %v", err)
+	}
+
+	fromBytes, err := rfs.StoreFile("asset.bin", data, "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	source := &offsetReaderAt{data: data}
+	fromReader, err := rfs.StoreReaderAt("asset.bin", source, int64(len(data)), "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreReaderAt: %v", err)
+	}
+
+	want, err := rfs.loadRepresentation(fromBytes.RepHash)
+	if err != nil {
+		t.Fatalf("loadRepresentation: %v", err)
+	}
+	got, err := rfs.loadRepresentation(fromReader.RepHash)
+	if err != nil {
+		t.Fatalf("loadRepresentation: %v", err)
+	}
+	if fmt.Sprint(got.BlockHashes) != fmt.Sprint(want.BlockHashes) {
+		t.Fatalf("block hashes differ:\n%v\n%v", got.BlockHashes, want.BlockHashes)
+	}
+	if fmt.Sprint(got.RandomizerHashes) != fmt.Sprint(want.RandomizerHashes) {
+		t.Fatalf("randomizer hashes differ")
+	}
+	if got.FileHash != want.FileHash || got.FileSize != want.FileSize || got.BlockSize != want.BlockSize {
+		t.Fatalf("representations differ: %+v vs %+v", got, want)
+	}
+
+	// After the hashing scan, every block is read at its own offset
+	blockOffsets := source.offsets[len(source.offsets)-len(got.BlockHashes):]
+	for i, off := range blockOffsets {
+		if off != int64(i*NanoBlockSize) {
+			t.Fatalf("block %d read at offset %d", i, off)
+		}
+	}
+
+	retrieved, _, err := rfs.RetrieveFile(fromReader.RepHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+	if !bytes.Equal(retrieved, data) {
+		t.Fatal("retrieved data does not match the source")
+	}
+}
+
+func TestStoreReaderAtFromFile(t *testing.T) {
+	rfs := newTestRandomFS(t)
+
+	data := make([]byte, 7*MiniBlockSize/2)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("rand: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "asset.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer file.Close()
+
+	url, err := rfs.StoreReaderAt("asset.bin", file, int64(len(data)), "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreReaderAt: %v", err)
+	}
+	retrieved, _, err := rfs.RetrieveFile(url.RepHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+	if !bytes.Equal(retrieved, data) {
+		t.Fatal("retrieved data does not match the file")
+	}
+}
+
+func TestStoreReaderAtRejectsShortSource(t *testing.T) {
+	rfs := newTestRandomFS(t)
+
+	source := bytes.NewReader([]byte("too short"))
+	if _, err := rfs.StoreReaderAt("short.txt", source, 100, "text/plain"); err == nil {
+		t.Fatal("expected an error for a source shorter than size")
+	}
+	if files := rfs.ListFiles(); len(files) != 0 {
+		t.Fatalf("expected nothing indexed, got %d files", len(files))
+	}
+}
+
+// storeRepresentationWithExtraField re-stores the representation of a file
+// with a field this version does not know, as a newer writer might
+func storeRepresentationWithExtraField(t *testing.T, rfs *RandomFS, repHash string) string {
+	t.Helper()
+	repData, err := rfs.retrieveRepresentation(context.Background(), repHash)
+	if err != nil {
+		t.Fatalf("retrieveRepresentation: %v", err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(repData, &fields); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	fields["codec"] = "zstd"
+	extended, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	extendedHash, err := rfs.storeRepresentation(context.Background(), extended)
+	if err != nil {
+		t.Fatalf("storeRepresentation: %v", err)
+	}
+	return extendedHash
+}
+
+func TestLenientRepresentationsIgnoreUnknownFields(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	data, repHash := storeRandomFile(t, rfs, 2*NanoBlockSize)
+	extendedHash := storeRepresentationWithExtraField(t, rfs, repHash)
+
+	got, _, err := rfs.RetrieveFile(extendedHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("retrieved data differs")
+	}
+}
+
+func TestStrictRepresentationsRejectUnknownFields(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	rfs.StrictRepresentations = true
+	_, repHash := storeRandomFile(t, rfs, 2*NanoBlockSize)
+	extendedHash := storeRepresentationWithExtraField(t, rfs, repHash)
+
+	_, _, err := rfs.RetrieveFile(extendedHash)
+	if !errors.Is(err, ErrUnknownRepresentationField) {
+		t.Fatalf("expected ErrUnknownRepresentationField, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "codec") {
+		t.Fatalf("expected the error to name the field, got %v", err)
+	}
+
+	// Representations this version wrote itself still load
+	if _, _, err := rfs.RetrieveFile(repHash); err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+}
+
+func TestStoreRetrieveReversesRandomization(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		size int
+	}{
+		{"single partial block", 100},
+		{"partial last block", 3*MiniBlockSize + 1234},
+		{"exact multiple of block size", 4 * MiniBlockSize},
+		{"exact multiple of large blocks", 2 * BlockSize},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rfs := newTestRandomFS(t)
+			data := make([]byte, tc.size)
+			rand.Read(data)
+
+			url, err := rfs.StoreFile("data.bin", data, "application/octet-stream")
+			if err != nil {
+				t.Fatalf("StoreFile: %v", err)
+			}
+			rep, err := rfs.loadRepresentation(url.RepHash)
+			if err != nil {
+				t.Fatalf("loadRepresentation: %v", err)
+			}
+			if want := (tc.size + rep.BlockSize - 1) / rep.BlockSize; len(rep.BlockHashes) != want || len(rep.RandomizerHashes) != want {
+				t.Fatalf("%d blocks and %d randomizers, want %d", len(rep.BlockHashes), len(rep.RandomizerHashes), want)
+			}
+
+			// The stored blocks are anonymized, not the file data
+			block, err := rfs.retrieveBlock(rep.BlockHashes[0], rep.BlockSize)
+			if err != nil {
+				t.Fatalf("retrieveBlock: %v", err)
+			}
+			if bytes.Contains(block, data[:min(len(data), 64)]) {
+				t.Fatal("stored block contains plain file data")
+			}
+
+			rfs.Cache().Clear()
+			got, _, err := rfs.RetrieveFile(url.RepHash)
+			if err != nil {
+				t.Fatalf("RetrieveFile: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("retrieved %d bytes differing from the %d stored", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestStatsConsistentUnderConcurrentUse(t *testing.T) {
+	rfs, err := NewRandomFSWithoutIPFS(t.TempDir(), 1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFSWithoutIPFS: %v", err)
+	}
+	defer rfs.Close()
+
+	const workers, files, size = 4, 10, 3000
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < files; i++ {
+				data := make([]byte, size)
+				rand.Read(data)
+				url, err := rfs.StoreFile(fmt.Sprintf("f-%d-%d", w, i), data, "application/octet-stream")
+				if err != nil {
+					t.Errorf("StoreFile: %v", err)
+					return
+				}
+				if _, _, err := rfs.RetrieveFile(url.RepHash); err != nil {
+					t.Errorf("RetrieveFile: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	// Counters a store updates together are never seen apart
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		stats := rfs.GetStats()
+		if stats.TotalSize != stats.FilesStored*size {
+			t.Fatalf("snapshot has %d files stored but %d bytes", stats.FilesStored, stats.TotalSize)
+		}
+	}
+
+	stats := rfs.GetStats()
+	if stats.FilesStored != workers*files || stats.FilesRetrieved != workers*files {
+		t.Fatalf("stored %d and retrieved %d files, want %d", stats.FilesStored, stats.FilesRetrieved, workers*files)
+	}
+}
+
+func TestStoreFileWithBlockSize(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	// 200KB would be stored in mini blocks by size
+	data := make([]byte, 200*1024)
+	rand.Read(data)
+
+	for _, blockSize := range []int{NanoBlockSize, 4096, BlockSize} {
+		rdURL, err := rfs.StoreFileWithBlockSize("sized.bin", data, "application/octet-stream", blockSize)
+		if err != nil {
+			t.Fatalf("StoreFileWithBlockSize(%d): %v", blockSize, err)
+		}
+		got, rep, err := rfs.RetrieveFile(rdURL.RepHash)
+		if err != nil {
+			t.Fatalf("RetrieveFile of %d-byte blocks: %v", blockSize, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("file stored in %d-byte blocks differs", blockSize)
+		}
+		wantBlocks := (len(data) + blockSize - 1) / blockSize
+		if rep.BlockSize != blockSize || len(rep.BlockHashes) != wantBlocks {
+			t.Errorf("stored %d blocks of %d bytes, want %d of %d", len(rep.BlockHashes), rep.BlockSize, wantBlocks, blockSize)
+		}
+	}
+
+	for _, blockSize := range []int{0, -1, 512, 3000, 2 * BlockSize} {
+		_, err := rfs.StoreFileWithBlockSize("absurd.bin", data, "application/octet-stream", blockSize)
+		if !errors.Is(err, ErrInvalidBlockSize) {
+			t.Errorf("StoreFileWithBlockSize(%d) returned %v, want ErrInvalidBlockSize", blockSize, err)
+		}
+	}
+}
+
+// newConcurrencyTrackingRandomFS returns an instance whose IPFS calls to
+// path, adds or cats, take delay and fail, if failFrom is set, from the
+// failFrom'th on. It reports the calls made and the most that ran at once.
+func newConcurrencyTrackingRandomFS(t *testing.T, path string, delay time.Duration, failFrom int64) (rfs *RandomFS, calls, maxConcurrent *atomic.Int64) {
+	t.Helper()
+	ipfs := ipfstest.NewServer(t)
+	if path == "/api/v0/cat" {
+		ipfs.SetCatDelay(delay)
+	} else {
+		ipfs.SetAddDelay(delay)
+	}
+	calls, maxConcurrent = new(atomic.Int64), new(atomic.Int64)
+	var running atomic.Int64
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == path {
+			if n := calls.Add(1); failFrom > 0 && n >= failFrom {
+				http.Error(w, "rejected", http.StatusBadRequest)
+				return
+			}
+			now := running.Add(1)
+			defer running.Add(-1)
+			for old := maxConcurrent.Load(); now > old && !maxConcurrent.CompareAndSwap(old, now); old = maxConcurrent.Load() {
+			}
+		}
+		ipfs.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(tracker.Close)
+
+	rfs, err := NewRandomFS(tracker.URL, t.TempDir(), 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFS: %v", err)
+	}
+	t.Cleanup(func() { rfs.Close() })
+	return rfs, calls, maxConcurrent
+}
+
+func TestStoreFileStoresBlocksInParallel(t *testing.T) {
+	rfs, adds, maxConcurrent := newConcurrencyTrackingRandomFS(t, "/api/v0/add", 20*time.Millisecond, 0)
+	rfs.StoreWorkers = 8
+	data := make([]byte, 64*NanoBlockSize)
+	rand.Read(data)
+
+	start := time.Now()
+	rdURL, err := rfs.StoreFile("parallel.bin", data, "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	elapsed := time.Since(start)
+
+	// 64 blocks and 64 randomizers one after another would take 2.5s
+	if elapsed > 1500*time.Millisecond {
+		t.Errorf("storing %d adds took %v", adds.Load(), elapsed)
+	}
+	if n := maxConcurrent.Load(); n < 2 || n > 8 {
+		t.Errorf("%d adds ran at once, want 2 to StoreWorkers = 8", n)
+	}
+
+	got, rep, err := rfs.RetrieveFile(rdURL.RepHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("blocks stored in parallel were reassembled out of order")
+	}
+	if len(rep.BlockHashes) != 64 {
+		t.Errorf("representation lists %d blocks, want 64", len(rep.BlockHashes))
+	}
+}
+
+func TestParallelStoreFailureCancelsRemainingBlocks(t *testing.T) {
+	const failFrom = 10
+	rfs, adds, _ := newConcurrencyTrackingRandomFS(t, "/api/v0/add", 50*time.Millisecond, failFrom)
+	rfs.StoreWorkers = 8
+	data := make([]byte, 64*NanoBlockSize)
+	rand.Read(data)
+	http.DefaultClient.CloseIdleConnections()
+	baseline := runtime.NumGoroutine()
+
+	start := time.Now()
+	_, err := rfs.StoreFile("doomed.bin", data, "application/octet-stream")
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Fatalf("StoreFile returned %v, want the failed add", err)
+	}
+	// The failing batch is abandoned rather than waited out, and no
+	// further batch starts
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("failed store took %v to return", elapsed)
+	}
+	if n := adds.Load(); n >= failFrom+16 {
+		t.Errorf("%d adds made, expected the failure to stop the store", n)
+	}
+	if files := rfs.ListFiles(); len(files) != 0 {
+		t.Errorf("failed store was indexed: %+v", files)
+	}
+	goroutinesSettle(t, baseline)
+}
+
+// timedRetrieve clears the cache and retrieves repHash with workers
+func timedRetrieve(t *testing.T, rfs *RandomFS, repHash string, workers int) ([]byte, time.Duration) {
+	t.Helper()
+	rfs.RetrieveWorkers = workers
+	rfs.Cache().Clear()
+	start := time.Now()
+	got, _, err := rfs.RetrieveFile(repHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile with %d workers: %v", workers, err)
+	}
+	return got, time.Since(start)
+}
+
+func TestRetrieveFileFetchesBlocksInParallel(t *testing.T) {
+	rfs, cats, maxConcurrent := newConcurrencyTrackingRandomFS(t, "/api/v0/cat", 10*time.Millisecond, 0)
+	// The last block is partial so its trimming is covered too
+	data := make([]byte, 50*NanoBlockSize-100)
+	rand.Read(data)
+	rdURL, err := rfs.StoreFile("parallel.bin", data, "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+
+	serial, serialTime := timedRetrieve(t, rfs, rdURL.RepHash, 1)
+	if n := maxConcurrent.Load(); n != 1 {
+		t.Errorf("%d cats ran at once with one worker", n)
+	}
+	serialCats := cats.Load()
+	maxConcurrent.Store(0)
+	parallel, parallelTime := timedRetrieve(t, rfs, rdURL.RepHash, 8)
+	t.Logf("50 blocks: %v with 1 worker, %v with 8 (%.1fx)", serialTime, parallelTime, float64(serialTime)/float64(parallelTime))
+
+	if !bytes.Equal(serial, data) || !bytes.Equal(parallel, data) {
+		t.Fatal("blocks fetched in parallel were reassembled out of order")
+	}
+	if n := maxConcurrent.Load(); n < 2 || n > 8 {
+		t.Errorf("%d cats ran at once, want 2 to RetrieveWorkers = 8", n)
+	}
+	// Only the serial retrieval fetched the representation
+	if n := cats.Load() - serialCats; n != serialCats-1 {
+		t.Errorf("parallel retrieval made %d cats, serial %d", n, serialCats)
+	}
+	if parallelTime*3 > serialTime {
+		t.Errorf("8 workers took %v, 1 worker %v", parallelTime, serialTime)
+	}
+
+	var out bytes.Buffer
+	if _, err := rfs.RetrieveFileTo(rdURL.RepHash, &out); err != nil || !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("RetrieveFileTo with 8 workers: %v", err)
+	}
+}
+
+func TestParallelRetrieveFailureCancelsRemainingBlocks(t *testing.T) {
+	rfs, cats, _ := newConcurrencyTrackingRandomFS(t, "/api/v0/cat", 50*time.Millisecond, 0)
+	rfs.RetrieveWorkers = 8
+	data := make([]byte, 64*NanoBlockSize)
+	rand.Read(data)
+	rdURL, err := rfs.StoreFile("doomed.bin", data, "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	rep, err := rfs.loadRepresentation(rdURL.RepHash)
+	if err != nil {
+		t.Fatalf("loadRepresentation: %v", err)
+	}
+	rfs.Cache().Clear()
+	http.DefaultClient.CloseIdleConnections()
+	baseline := runtime.NumGoroutine()
+
+	// Fail a block in the first window; the blocks after it must not be
+	// fetched and the blocks before it must not be written
+	var out bytes.Buffer
+	start := time.Now()
+	err = rfs.writeBlocks(context.Background(), &FileRepresentation{
+		FileSize:         rep.FileSize,
+		BlockSize:        rep.BlockSize,
+		BlockHashes:      append(append(append([]string{}, rep.BlockHashes[:3]...), "QmMissing"), rep.BlockHashes[4:]...),
+		RandomizerHashes: rep.RandomizerHashes,
+	}, 0, &out)
+	if err == nil || !strings.Contains(err.Error(), "block 3") {
+		t.Fatalf("writeBlocks returned %v, want the missing block", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("failed retrieval took %v to return", elapsed)
+	}
+	if n := cats.Load(); n > 24 {
+		t.Errorf("%d cats made, expected the failure to stop the retrieval", n)
+	}
+	if out.Len() > 3*rep.BlockSize {
+		t.Errorf("%d bytes written past the failed block", out.Len())
+	}
+	goroutinesSettle(t, baseline)
+}
+
+func TestStoreReportsNewAndReusedBlocks(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	data := make([]byte, 3*BlockSize+100)
+	rand.Read(data)
+
+	first, result, err := rfs.StoreFileWithResult("result.bin", data, "application/octet-stream", "")
+	if err != nil {
+		t.Fatalf("StoreFileWithResult: %v", err)
+	}
+	rep, err := rfs.GetRepresentation(first.RepHash)
+	if err != nil {
+		t.Fatalf("GetRepresentation: %v", err)
+	}
+	blocks := int64(2 * len(rep.BlockHashes))
+	want := StoreResult{BlocksTotal: blocks, BlocksNew: blocks, BytesStored: blocks * int64(rep.BlockSize)}
+	if result != want {
+		t.Errorf("first store reported %+v, want %+v", result, want)
+	}
+	generated := result.BlocksNew
+
+	// Storing the content again writes nothing
+	for _, name := range []string{"result.bin", "renamed.bin"} {
+		_, result, err = rfs.StoreFileWithResult(name, data, "application/octet-stream", "")
+		if err != nil {
+			t.Fatalf("StoreFileWithResult: %v", err)
+		}
+		if want := (StoreResult{BlocksTotal: blocks, BlocksReused: blocks}); result != want {
+			t.Errorf("duplicate store as %s reported %+v, want %+v", name, result, want)
+		}
+	}
+
+	// Reused randomizers are counted apart from the blocks written
+	other := make([]byte, len(data))
+	rand.Read(other)
+	rfs.RandomizerPolicy = MinReusePolicy(1)
+	_, result, err = rfs.StoreFileWithResult("other.bin", other, "application/octet-stream", DispositionAttachment)
+	if err != nil {
+		t.Fatalf("StoreFileWithResult: %v", err)
+	}
+	if result.BlocksReused == 0 || result.BlocksNew+result.BlocksReused != result.BlocksTotal || result.BlocksTotal != blocks {
+		t.Errorf("reusing store reported %+v for a file of %d blocks", result, blocks)
+	}
+	if result.BytesStored != result.BlocksNew*int64(rep.BlockSize) {
+		t.Errorf("reusing store wrote %d blocks but reported %d bytes", result.BlocksNew, result.BytesStored)
+	}
+	if stats := rfs.GetStats(); stats.BlocksGenerated != generated+result.BlocksNew {
+		t.Errorf("stats count %d blocks generated, stores reported %d", stats.BlocksGenerated, generated+result.BlocksNew)
+	}
+
+	if _, _, err := rfs.StoreFileWithResult("bad.bin", data, "", "sideways"); err == nil {
+		t.Error("accepted an invalid disposition")
+	}
+}
+
+func TestStoreRejectsFilesOverMaxFileSize(t *testing.T) {
+	rfs, err := NewRandomFSWithConfig(Config{BlockStore: NewMemoryBlockStore(), DataDir: t.TempDir(), MaxFileSize: 2 * NanoBlockSize})
+	if err != nil {
+		t.Fatalf("NewRandomFSWithConfig: %v", err)
+	}
+	defer rfs.Close()
+	store := rfs.BlockStore().(*MemoryBlockStore)
+
+	data := make([]byte, 2*NanoBlockSize+1)
+	rand.Read(data)
+	if _, err := rfs.StoreFile("big.bin", data, ""); !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("StoreFile over the limit returned %v", err)
+	}
+	if _, err := rfs.StoreReader("big.bin", bytes.NewReader(data), int64(len(data)), ""); !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("StoreReader over the limit returned %v", err)
+	}
+
+	// A stream of unknown size fails once it is read past the limit
+	rfs.MaxFileSize = BlockSize
+	stream := make([]byte, BlockSize+NanoBlockSize)
+	rand.Read(stream)
+	if _, err := rfs.StoreReader("stream.bin", bytes.NewReader(stream), UnknownSize, ""); !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("StoreReader of a stream over the limit returned %v", err)
+	}
+	if store.Len() != 0 {
+		t.Fatalf("rejected stores left %d blocks", store.Len())
+	}
+
+	// Files at the limit are stored, and compressing a file does not let
+	// it past the limit
+	rfs.MaxFileSize = int64(len(data)) - 1
+	if _, err := rfs.StoreFile("exact.bin", data[:rfs.MaxFileSize], ""); err != nil {
+		t.Errorf("StoreFile at the limit: %v", err)
+	}
+	rfs.Compression = CompressionGzip
+	if _, err := rfs.StoreFile("zeros.bin", make([]byte, len(data)), ""); !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("StoreFile of a compressible file over the limit returned %v", err)
+	}
+	rfs.MaxFileSize = 0
+	if _, err := rfs.StoreFile("big.bin", data, ""); err != nil {
+		t.Errorf("StoreFile with the limit disabled: %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package randomfs
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReadOnlyReplicasShareDataDir(t *testing.T) {
+	dataDir := t.TempDir()
+	writer, err := NewRandomFSWithoutIPFS(dataDir, 1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFSWithoutIPFS: %v", err)
+	}
+	url, err := writer.StoreFile("served.txt", []byte("served by replicas"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+
+	if _, err := NewReadOnlyRandomFS("", dataDir, 1024*1024); err == nil {
+		t.Fatal("read-only replica opened a directory held by a writer")
+	}
+	writer.Close()
+
+	first, err := NewReadOnlyRandomFS("", dataDir, 1024*1024)
+	if err != nil {
+		t.Fatalf("first replica: %v", err)
+	}
+	defer first.Close()
+	second, err := NewReadOnlyRandomFS("", dataDir, 1024*1024)
+	if err != nil {
+		t.Fatalf("second replica: %v", err)
+	}
+	defer second.Close()
+
+	for _, replica := range []*RandomFS{first, second} {
+		data, _, err := replica.RetrieveFile(url.RepHash)
+		if err != nil {
+			t.Fatalf("RetrieveFile: %v", err)
+		}
+		if string(data) != "served by replicas" {
+			t.Fatalf("unexpected data %q", data)
+		}
+		if _, _, err := replica.RetrieveByName("served.txt"); err != nil {
+			t.Fatalf("RetrieveByName: %v", err)
+		}
+	}
+
+	if _, err := first.StoreFile("new.txt", []byte("new"), "text/plain"); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly from StoreFile, got %v", err)
+	}
+	if err := first.DeleteFile(url.RepHash); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly from DeleteFile, got %v", err)
+	}
+	if err := first.RenameFile(url.RepHash, "renamed.txt"); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly from RenameFile, got %v", err)
+	}
+	if _, _, err := NewSuperlinearGrowthManager(first).EnhancedSelectRandomizerBlocks(1, NanoBlockSize); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected ErrReadOnly from randomizer selection, got %v", err)
+	}
+
+	if _, err := NewRandomFSWithoutIPFS(dataDir, 1024); err == nil {
+		t.Fatal("writer opened a directory held by read-only replicas")
+	}
+}
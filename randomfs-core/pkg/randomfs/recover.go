@@ -0,0 +1,100 @@
+package randomfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// ErrMissingBlocks is returned by ReconstructFromBlocks when the supplied
+// blocks do not cover the representation
+var ErrMissingBlocks = errors.New("blocks are missing")
+
+// ReconstructFromBlocks assembles the file described by rep from blocks
+// recovered outside the backend, keyed by hash in any order. A block may
+// be keyed by its SHA-256 hex digest or by its raw CID, whichever form rep
+// uses. Blocks are verified against their hashes, so a damaged copy counts
+// as missing. If any block is missing, no data is returned and the error
+// wraps ErrMissingBlocks; the missing references are returned either way.
+func (rfs *RandomFS) ReconstructFromBlocks(blocks map[string][]byte, rep *FileRepresentation) ([]byte, []string, error) {
+	if err := checkRandomizerCounts(rep); err != nil {
+		return nil, nil, err
+	}
+	if err := checkNoPassword(rep); err != nil {
+		return nil, nil, err
+	}
+	if rep.OrderHash != "" && rep.OrderHash != representationOrderHash(rep) {
+		return nil, nil, fmt.Errorf("%w: supplied representation", ErrBlockOrder)
+	}
+
+	found := make(map[string][]byte)
+	var missing []string
+	for _, ref := range uniqueHashes(representationBlocks(rep)) {
+		if data, ok := rfs.recoveredBlock(blocks, ref, rep.BlockSize); ok {
+			found[ref] = data
+		} else {
+			missing = append(missing, ref)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, missing, fmt.Errorf("%w: %d of %d blocks", ErrMissingBlocks, len(missing), len(found)+len(missing))
+	}
+
+	var result bytes.Buffer
+	result.Grow(int(rep.dataSize()))
+	for i := range rep.BlockHashes {
+		data, ok, err := expandSparseBlock(rep, i)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !ok {
+			var randomizers [][]byte
+			for _, ref := range randomizerRefs(rep, i) {
+				randomizers = append(randomizers, found[ref])
+			}
+			data = rfs.deRandomizeBlock(found[rep.BlockHashes[i]], blockDataSize(rep, i), randomizers...)
+		}
+		result.Write(data)
+	}
+
+	if rep.FileHash != "" {
+		digest, err := fileHash(rep.HashAlgorithm, result.Bytes())
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := verifyFileHash(rep, digest); err != nil {
+			return nil, nil, err
+		}
+	}
+	if rep.compressed() {
+		var file bytes.Buffer
+		if err := decompressFile(rep, &result, &file); err != nil {
+			return nil, nil, err
+		}
+		return file.Bytes(), nil, nil
+	}
+	return result.Bytes(), nil, nil
+}
+
+// recoveredBlock looks ref up in blocks under each of its equivalent forms
+// and returns the first copy that verifies
+func (rfs *RandomFS) recoveredBlock(blocks map[string][]byte, ref string, size int) ([]byte, bool) {
+	keys := []string{ref}
+	if hexRef, err := sha256HexRef(ref); err == nil && hexRef != ref {
+		keys = append(keys, hexRef)
+	}
+	if cidRef, err := SelfDescribingRef(ref); err == nil && cidRef != ref {
+		keys = append(keys, cidRef)
+	}
+
+	for _, key := range keys {
+		data, ok := blocks[key]
+		if !ok {
+			continue
+		}
+		if rfs.verifyBlock(ref, data, size) == nil {
+			return data, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,95 @@
+package randomfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	mrand "math/rand"
+	"testing"
+)
+
+// recoverBlocks copies every block of rep out of rfs, inserting them into
+// a fresh map in shuffled order
+func recoverBlocks(t *testing.T, rfs *RandomFS, rep *FileRepresentation) map[string][]byte {
+	t.Helper()
+	refs := uniqueHashes(representationBlocks(rep))
+	mrand.Shuffle(len(refs), func(i, j int) { refs[i], refs[j] = refs[j], refs[i] })
+
+	blocks := make(map[string][]byte, len(refs))
+	for _, ref := range refs {
+		data, err := rfs.fetchBlock(context.Background(), ref)
+		if err != nil {
+			t.Fatalf("fetchBlock: %v", err)
+		}
+		blocks[ref] = data
+	}
+	return blocks
+}
+
+func TestReconstructFromShuffledBlocks(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	data, repHash := storeRandomFile(t, rfs, 4*NanoBlockSize+17)
+	rep, _ := rfs.loadRepresentation(repHash)
+	blocks := recoverBlocks(t, rfs, rep)
+
+	// The data directory is gone; only the recovered blocks remain
+	rfs.Close()
+	recovered := newTestRandomFS(t)
+
+	got, missing, err := recovered.ReconstructFromBlocks(blocks, rep)
+	if err != nil {
+		t.Fatalf("ReconstructFromBlocks: %v", err)
+	}
+	if len(missing) != 0 {
+		t.Fatalf("expected no missing blocks, got %v", missing)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("reconstructed data differs")
+	}
+}
+
+func TestReconstructReportsMissingAndDamagedBlocks(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	_, repHash := storeRandomFile(t, rfs, 3*NanoBlockSize)
+	rep, _ := rfs.loadRepresentation(repHash)
+	blocks := recoverBlocks(t, rfs, rep)
+
+	lost := rep.BlockHashes[1]
+	damaged := rep.RandomizerHashes[2]
+	delete(blocks, lost)
+	blocks[damaged] = append([]byte{blocks[damaged][0] ^ 1}, blocks[damaged][1:]...)
+
+	got, missing, err := rfs.ReconstructFromBlocks(blocks, rep)
+	if !errors.Is(err, ErrMissingBlocks) {
+		t.Fatalf("expected ErrMissingBlocks, got %v", err)
+	}
+	if got != nil {
+		t.Fatal("expected no data for an incomplete block set")
+	}
+	if len(missing) != 2 || missing[0] != lost || missing[1] != damaged {
+		t.Fatalf("expected %s and %s missing, got %v", lost, damaged, missing)
+	}
+}
+
+func TestReconstructAcceptsBlocksKeyedByRawCID(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	data, repHash := storeRandomFile(t, rfs, 2*NanoBlockSize)
+	rep, _ := rfs.loadRepresentation(repHash)
+
+	blocks := make(map[string][]byte)
+	for ref, block := range recoverBlocks(t, rfs, rep) {
+		cidRef, err := SelfDescribingRef(ref)
+		if err != nil {
+			t.Fatalf("SelfDescribingRef: %v", err)
+		}
+		blocks[cidRef] = block
+	}
+
+	got, _, err := rfs.ReconstructFromBlocks(blocks, rep)
+	if err != nil {
+		t.Fatalf("ReconstructFromBlocks: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("reconstructed data differs")
+	}
+}
@@ -0,0 +1,125 @@
+package randomfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// BlockSource is a secondary place blocks can be fetched from when the
+// backend does not have them, such as an IPFS gateway or a backup
+type BlockSource interface {
+	FetchBlock(ref string) ([]byte, error)
+}
+
+// BlockSourceFunc adapts a function to a BlockSource
+type BlockSourceFunc func(ref string) ([]byte, error)
+
+// FetchBlock implements BlockSource
+func (f BlockSourceFunc) FetchBlock(ref string) ([]byte, error) {
+	return f(ref)
+}
+
+// GatewaySource fetches raw blocks from an IPFS HTTP gateway
+type GatewaySource struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewGatewaySource creates a source for the gateway at url, for example
+// https://ipfs.io or https://ipfs.io/ipfs/
+func NewGatewaySource(url string) *GatewaySource {
+	url = strings.TrimSuffix(strings.TrimSuffix(url, "/"), "/ipfs")
+	return &GatewaySource{URL: url, Client: http.DefaultClient}
+}
+
+// FetchBlock implements BlockSource
+func (g *GatewaySource) FetchBlock(ref string) ([]byte, error) {
+	if classifyRef(ref) == RefFormSHA256Hex {
+		var err error
+		if ref, err = SelfDescribingRef(ref); err != nil {
+			return nil, err
+		}
+	}
+	return g.fetchRaw(context.Background(), ref)
+}
+
+// fetchRaw fetches the block ref names from the gateway as stored, without
+// decoding any DAG it roots
+func (g *GatewaySource) fetchRaw(ctx context.Context, ref string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.URL+"/ipfs/"+ref+"?format=raw", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.ipld.raw")
+
+	resp, err := g.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("gateway fetch failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("gateway returned %d for %s", resp.StatusCode, ref)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// fetchWithFallback reads a block from the backend or, failing that, from
+// the first fallback source with a copy that verifies. With ReadRepair the
+// copy is stored back to the backend.
+func (rfs *RandomFS) fetchWithFallback(ctx context.Context, hash string, size int) ([]byte, error) {
+	data, err := rfs.fetchBlock(ctx, hash)
+	if err == nil || len(rfs.FallbackSources) == 0 {
+		return data, err
+	}
+
+	for _, source := range rfs.FallbackSources {
+		fallback, fetchErr := source.FetchBlock(hash)
+		if fetchErr != nil {
+			continue
+		}
+		// Fallback sources are untrusted, so always verify what they return
+		if verifyErr := rfs.verifyBlock(hash, fallback, size); verifyErr != nil {
+			rfs.log().Warn("Ignoring block from fallback source", "block", hash, "error", verifyErr)
+			continue
+		}
+		rfs.updateStats(func(s *Stats) { s.FallbackFetches++ })
+
+		if rfs.ReadRepair && !rfs.readOnly {
+			if repairErr := rfs.repairBlock(ctx, hash, fallback); repairErr != nil {
+				rfs.log().Warn("Failed to repair block", "block", hash, "error", repairErr)
+			}
+		}
+		return fallback, nil
+	}
+	return nil, err
+}
+
+// repairBlock stores, and with IPFS pins, a verified copy of a block the
+// backend lost
+func (rfs *RandomFS) repairBlock(ctx context.Context, hash string, data []byte) error {
+	key, err := rfs.backendKey(hash)
+	if err != nil {
+		return err
+	}
+
+	stored, err := rfs.putBlock(ctx, data, refBlockKey(key, data))
+	if err != nil {
+		return err
+	}
+	if rfs.useIPFS {
+		if err := rfs.ipfsPin(ctx, "add", []string{stored}); err != nil {
+			return err
+		}
+	}
+	if stored != key {
+		return fmt.Errorf("backend stored the block as %s, expected %s", stored, key)
+	}
+
+	rfs.updateStats(func(s *Stats) { s.BlocksRepaired++ })
+	rfs.log().Info("Repaired block from a fallback source", "block", hash)
+	return nil
+}
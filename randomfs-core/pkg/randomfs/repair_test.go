@@ -0,0 +1,178 @@
+package randomfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// backupSource snapshots every block of rep from rfs into a map-backed
+// fallback source
+func backupSource(t *testing.T, rfs *RandomFS, rep *FileRepresentation) (map[string][]byte, BlockSource) {
+	t.Helper()
+	backup := make(map[string][]byte)
+	for _, ref := range representationBlocks(rep) {
+		data, err := rfs.fetchBlock(context.Background(), ref)
+		if err != nil {
+			t.Fatalf("fetchBlock: %v", err)
+		}
+		backup[ref] = data
+	}
+	return backup, BlockSourceFunc(func(ref string) ([]byte, error) {
+		if data, ok := backup[ref]; ok {
+			return data, nil
+		}
+		return nil, fmt.Errorf("%s not in backup", ref)
+	})
+}
+
+func TestReadRepairRestoresLocalBlock(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	data, repHash := storeRandomFile(t, rfs, 3*NanoBlockSize)
+	rep, _ := rfs.loadRepresentation(repHash)
+	_, source := backupSource(t, rfs, rep)
+
+	rfs.FallbackSources = []BlockSource{source}
+	rfs.ReadRepair = true
+
+	lost := filepath.Join(rfs.dataDir, "blocks", rep.BlockHashes[1])
+	if err := os.Remove(lost); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	rfs.cache.Clear()
+
+	retrieved, _, err := rfs.RetrieveFile(repHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+	if !bytes.Equal(retrieved, data) {
+		t.Fatal("retrieved data differs")
+	}
+	if _, err := os.Stat(lost); err != nil {
+		t.Fatalf("lost block was not re-stored: %v", err)
+	}
+	stats := rfs.GetStats()
+	if stats.FallbackFetches != 1 || stats.BlocksRepaired != 1 {
+		t.Fatalf("expected 1 fallback fetch and 1 repair, got %d and %d", stats.FallbackFetches, stats.BlocksRepaired)
+	}
+}
+
+func TestReadRepairRestoresAndPinsIPFSBlock(t *testing.T) {
+	mock, rfs := newMockIPFSRandomFS(t)
+	data, repHash := storeRandomFile(t, rfs, 3*NanoBlockSize)
+	rep, _ := rfs.loadRepresentation(repHash)
+	_, source := backupSource(t, rfs, rep)
+
+	rfs.FallbackSources = []BlockSource{source}
+	rfs.ReadRepair = true
+
+	lost := rep.RandomizerHashes[2]
+	mock.mutex.Lock()
+	delete(mock.blocks, lost)
+	delete(mock.pinned, lost)
+	mock.mutex.Unlock()
+	rfs.cache.Clear()
+
+	retrieved, _, err := rfs.RetrieveFile(repHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+	if !bytes.Equal(retrieved, data) {
+		t.Fatal("retrieved data differs")
+	}
+
+	mock.mutex.Lock()
+	_, restored := mock.blocks[lost]
+	mock.mutex.Unlock()
+	if !restored || !mock.isPinned(lost) {
+		t.Fatalf("lost block was not re-added and pinned (added %v)", restored)
+	}
+	if repaired := rfs.GetStats().BlocksRepaired; repaired != 1 {
+		t.Fatalf("expected 1 repaired block, got %d", repaired)
+	}
+}
+
+func TestFallbackWithoutReadRepairLeavesBackendAlone(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	_, repHash := storeRandomFile(t, rfs, 2*NanoBlockSize)
+	rep, _ := rfs.loadRepresentation(repHash)
+	_, source := backupSource(t, rfs, rep)
+	rfs.FallbackSources = []BlockSource{source}
+
+	lost := filepath.Join(rfs.dataDir, "blocks", rep.BlockHashes[0])
+	os.Remove(lost)
+	rfs.cache.Clear()
+
+	if _, _, err := rfs.RetrieveFile(repHash); err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+	if _, err := os.Stat(lost); !os.IsNotExist(err) {
+		t.Fatal("block was re-stored without ReadRepair")
+	}
+	if stats := rfs.GetStats(); stats.FallbackFetches != 1 || stats.BlocksRepaired != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestCorruptFallbackBlockIsRejected(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	_, repHash := storeRandomFile(t, rfs, 2*NanoBlockSize)
+	rep, _ := rfs.loadRepresentation(repHash)
+	backup, source := backupSource(t, rfs, rep)
+	rfs.FallbackSources = []BlockSource{source}
+	rfs.ReadRepair = true
+
+	lost := rep.BlockHashes[0]
+	backup[lost][0] ^= 0xff
+	os.Remove(filepath.Join(rfs.dataDir, "blocks", lost))
+	rfs.cache.Clear()
+
+	if _, _, err := rfs.RetrieveFile(repHash); err == nil {
+		t.Fatal("expected retrieval to fail with only a corrupt copy available")
+	}
+	if repaired := rfs.GetStats().BlocksRepaired; repaired != 0 {
+		t.Fatalf("corrupt block was repaired %d times", repaired)
+	}
+}
+
+func TestGatewaySourceFetchesRawBlocks(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	rfs.SelfDescribingRefs = true
+	_, repHash := storeRandomFile(t, rfs, NanoBlockSize)
+	rep, _ := rfs.loadRepresentation(repHash)
+	ref := rep.BlockHashes[0]
+	block, _ := rfs.fetchBlock(context.Background(), ref)
+
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ipfs/"+ref || r.URL.Query().Get("format") != "raw" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(block)
+	}))
+	defer gateway.Close()
+
+	source := NewGatewaySource(gateway.URL + "/")
+	got, err := source.FetchBlock(ref)
+	if err != nil {
+		t.Fatalf("FetchBlock: %v", err)
+	}
+	if !bytes.Equal(got, block) {
+		t.Fatal("gateway returned different data")
+	}
+
+	// Hex references are asked for by their raw CID
+	key, _ := rfs.backendKey(ref)
+	if _, err := source.FetchBlock(key); err != nil {
+		t.Fatalf("FetchBlock by hex: %v", err)
+	}
+	if _, err := source.FetchBlock(strings.Repeat("0", 64)); err == nil {
+		t.Fatal("expected a missing block to fail")
+	}
+}
@@ -0,0 +1,139 @@
+package randomfs
+
+import (
+	"container/list"
+	"slices"
+	"sync"
+)
+
+// DefaultParsedRepresentationCacheSize is the number of parsed
+// representations an instance keeps in memory by default
+const DefaultParsedRepresentationCacheSize = 256
+
+// parsedRepCache is a least recently used cache of parsed representations
+// by hash, so files read repeatedly skip fetching, decrypting and decoding
+// their representation. Unlike the representation BlockCache it holds
+// decoded structs, and it is bounded by entries rather than bytes.
+type parsedRepCache struct {
+	limit int
+	// order holds the cached hashes, most recently used first
+	order   *list.List
+	entries map[string]*list.Element
+
+	hits   int64
+	misses int64
+	mutex  sync.Mutex
+}
+
+// parsedRepEntry is an element of parsedRepCache.order
+type parsedRepEntry struct {
+	hash string
+	rep  *FileRepresentation
+}
+
+// newParsedRepCache creates a cache of up to limit representations; a
+// limit of zero disables it
+func newParsedRepCache(limit int) *parsedRepCache {
+	return &parsedRepCache{
+		limit:   limit,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns a copy of the representation cached for hash
+func (c *parsedRepCache) get(hash string) (*FileRepresentation, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.limit <= 0 {
+		return nil, false
+	}
+	element, exists := c.entries[hash]
+	if !exists {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(element)
+	return element.Value.(*parsedRepEntry).rep.clone(), true
+}
+
+// put caches a copy of rep as hash, evicting the least recently used
+// representations beyond the limit
+func (c *parsedRepCache) put(hash string, rep *FileRepresentation) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.limit <= 0 {
+		return
+	}
+	if element, exists := c.entries[hash]; exists {
+		element.Value.(*parsedRepEntry).rep = rep.clone()
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[hash] = c.order.PushFront(&parsedRepEntry{hash: hash, rep: rep.clone()})
+	c.evict()
+}
+
+// evict drops representations beyond the limit; callers hold the lock
+func (c *parsedRepCache) evict() {
+	for c.order.Len() > max(c.limit, 0) {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*parsedRepEntry).hash)
+	}
+}
+
+// remove drops the representation cached for hash
+func (c *parsedRepCache) remove(hash string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, exists := c.entries[hash]; exists {
+		c.order.Remove(element)
+		delete(c.entries, hash)
+	}
+}
+
+// clear drops every cached representation
+func (c *parsedRepCache) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.order.Init()
+	clear(c.entries)
+}
+
+// resize changes the limit, evicting representations beyond it
+func (c *parsedRepCache) resize(limit int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.limit = limit
+	c.evict()
+}
+
+// counts returns the number of lookups that hit and missed the cache
+func (c *parsedRepCache) counts() (hits, misses int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.hits, c.misses
+}
+
+// SetParsedRepresentationCacheSize changes the number of parsed
+// representations kept in memory; zero disables the cache
+func (rfs *RandomFS) SetParsedRepresentationCacheSize(entries int) {
+	rfs.parsedReps.resize(entries)
+}
+
+// clone returns a copy of rep that shares no slices with it, so callers
+// may modify representations handed out of a cache
+func (rep *FileRepresentation) clone() *FileRepresentation {
+	copied := *rep
+	copied.BlockHashes = slices.Clone(rep.BlockHashes)
+	copied.RandomizerHashes = slices.Clone(rep.RandomizerHashes)
+	copied.SecondRandomizerHashes = slices.Clone(rep.SecondRandomizerHashes)
+	return &copied
+}
@@ -0,0 +1,93 @@
+package randomfs
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParsedRepresentationCacheServesRepeatedRetrievals(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	defer rfs.Close()
+	_, repHash := storeRandomFile(t, rfs, 2*NanoBlockSize)
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := rfs.RetrieveFile(repHash); err != nil {
+			t.Fatalf("RetrieveFile: %v", err)
+		}
+	}
+	stats := rfs.GetStats()
+	if stats.ParsedRepresentationHits != 2 || stats.ParsedRepresentationMisses != 1 {
+		t.Fatalf("got %d hits and %d misses, want 2 and 1", stats.ParsedRepresentationHits, stats.ParsedRepresentationMisses)
+	}
+
+	// Callers get copies they may change
+	rep, err := rfs.GetRepresentation(repHash)
+	if err != nil {
+		t.Fatalf("GetRepresentation: %v", err)
+	}
+	rep.FileName = "changed"
+	rep.BlockHashes[0] = "changed"
+	again, _ := rfs.GetRepresentation(repHash)
+	if again.FileName == "changed" || again.BlockHashes[0] == "changed" {
+		t.Fatal("changing a returned representation changed the cached one")
+	}
+
+	if err := rfs.DeleteFile(repHash); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	if _, err := rfs.GetRepresentation(repHash); err == nil {
+		t.Fatal("deleted representation was still served from the cache")
+	}
+}
+
+func TestParsedRepresentationCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newParsedRepCache(2)
+	for i := 0; i < 3; i++ {
+		cache.put(fmt.Sprint(i), &FileRepresentation{FileSize: int64(i)})
+		if i == 1 {
+			// Using the first keeps it over the second
+			cache.get("0")
+		}
+	}
+	for hash, want := range map[string]bool{"0": true, "1": false, "2": true} {
+		if _, ok := cache.get(hash); ok != want {
+			t.Errorf("cached %s: %v, want %v", hash, ok, want)
+		}
+	}
+
+	cache.resize(0)
+	if _, ok := cache.get("2"); ok {
+		t.Error("disabled cache still served a representation")
+	}
+	cache.put("3", &FileRepresentation{})
+	if len(cache.entries) != 0 {
+		t.Errorf("disabled cache holds %d representations", len(cache.entries))
+	}
+}
+
+func TestParsedRepresentationCacheDropsSoftDeletedFiles(t *testing.T) {
+	rfs, err := NewRandomFSWithConfig(Config{DataDir: t.TempDir(), CacheSize: 1024 * 1024, ParsedRepresentationCacheSize: -1})
+	if err != nil {
+		t.Fatalf("NewRandomFSWithConfig: %v", err)
+	}
+	defer rfs.Close()
+	_, repHash := storeRandomFile(t, rfs, NanoBlockSize)
+	rfs.RetrieveFile(repHash)
+	if stats := rfs.GetStats(); stats.ParsedRepresentationHits+stats.ParsedRepresentationMisses != 0 {
+		t.Fatalf("disabled cache counted %+v", stats)
+	}
+
+	rfs.SetParsedRepresentationCacheSize(DefaultParsedRepresentationCacheSize)
+	rfs.DeleteGracePeriod = time.Hour
+	rfs.RetrieveFile(repHash)
+	if _, ok := rfs.parsedReps.entries[repHash]; !ok {
+		t.Fatal("retrieved representation was not cached")
+	}
+	if err := rfs.DeleteFile(repHash); err != nil {
+		t.Fatalf("DeleteFile: %v", err)
+	}
+	if _, ok := rfs.parsedReps.entries[repHash]; ok {
+		t.Error("soft-deleted file is still cached")
+	}
+}
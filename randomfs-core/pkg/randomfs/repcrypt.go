@@ -0,0 +1,89 @@
+package randomfs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// RepresentationKeySize is the length of a RepresentationKey, for AES-256
+const RepresentationKeySize = 32
+
+// encryptedRepresentationMagic prefixes encrypted representations, ahead
+// of the GCM nonce and the sealed JSON. It is also the additional data
+// the seal authenticates.
+var encryptedRepresentationMagic = []byte("rfs-aes256gcm-v1\n")
+
+// ErrRepresentationEncrypted is returned when a representation is
+// encrypted and no RepresentationKey is configured
+var ErrRepresentationEncrypted = errors.New("representation is encrypted and no key is configured")
+
+// ErrRepresentationKey is returned when an encrypted representation does
+// not decrypt with the configured RepresentationKey, usually because the
+// key is wrong
+var ErrRepresentationKey = errors.New("representation does not decrypt with the configured key")
+
+// isEncryptedRepresentation reports whether repData was sealed by
+// sealRepresentation
+func isEncryptedRepresentation(repData []byte) bool {
+	return bytes.HasPrefix(repData, encryptedRepresentationMagic)
+}
+
+// representationAEAD returns the AES-256-GCM cipher for RepresentationKey
+func (rfs *RandomFS) representationAEAD() (cipher.AEAD, error) {
+	if len(rfs.RepresentationKey) != RepresentationKeySize {
+		return nil, fmt.Errorf("representation key must be %d bytes, got %d", RepresentationKeySize, len(rfs.RepresentationKey))
+	}
+	block, err := aes.NewCipher(rfs.RepresentationKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create representation cipher: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealRepresentation encrypts a marshaled representation with
+// RepresentationKey under a fresh random nonce
+func (rfs *RandomFS) sealRepresentation(repData []byte) ([]byte, error) {
+	aead, err := rfs.representationAEAD()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	sealed := make([]byte, 0, len(encryptedRepresentationMagic)+len(nonce)+len(repData)+aead.Overhead())
+	sealed = append(sealed, encryptedRepresentationMagic...)
+	sealed = append(sealed, nonce...)
+	return aead.Seal(sealed, nonce, repData, encryptedRepresentationMagic), nil
+}
+
+// openRepresentation decrypts a representation sealed by
+// sealRepresentation; plaintext representations are returned unchanged
+func (rfs *RandomFS) openRepresentation(repData []byte) ([]byte, error) {
+	if !isEncryptedRepresentation(repData) {
+		return repData, nil
+	}
+	if rfs.RepresentationKey == nil {
+		return nil, ErrRepresentationEncrypted
+	}
+	aead, err := rfs.representationAEAD()
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := repData[len(encryptedRepresentationMagic):]
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w: truncated representation", ErrRepresentationKey)
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, encryptedRepresentationMagic)
+	if err != nil {
+		return nil, ErrRepresentationKey
+	}
+	return plain, nil
+}
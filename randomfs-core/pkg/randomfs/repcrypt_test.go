@@ -0,0 +1,93 @@
+package randomfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestEncryptedRepresentationRoundTrip(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	rfs.RepresentationKey = bytes.Repeat([]byte{7}, RepresentationKeySize)
+	data := bytes.Repeat([]byte("secret content "), 300)
+
+	url, err := rfs.StoreFile("secret-plans.txt", data, "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	if !url.Encrypted {
+		t.Error("URL of an encrypted representation is not marked encrypted")
+	}
+
+	raw, err := rfs.retrieveRepresentation(context.Background(), url.RepHash)
+	if err != nil {
+		t.Fatalf("retrieveRepresentation: %v", err)
+	}
+	if !isEncryptedRepresentation(raw) || bytes.Contains(raw, []byte("secret-plans")) || bytes.Contains(raw, []byte("text/plain")) {
+		t.Fatalf("stored representation is readable: %q", raw)
+	}
+
+	got, rep, err := rfs.RetrieveFile(url.RepHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+	if !bytes.Equal(got, data) || rep.FileName != "secret-plans.txt" {
+		t.Fatalf("retrieved %q (%d bytes)", rep.FileName, len(got))
+	}
+	if err := rfs.VerifyFile(url.RepHash); err != nil {
+		t.Errorf("VerifyFile: %v", err)
+	}
+}
+
+func TestEncryptedRepresentationWrongKey(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	rfs.RepresentationKey = bytes.Repeat([]byte{1}, RepresentationKeySize)
+	url, err := rfs.StoreFile("a.txt", []byte("hello"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+
+	rfs.RepresentationKey = bytes.Repeat([]byte{2}, RepresentationKeySize)
+	if _, _, err := rfs.RetrieveFile(url.RepHash); !errors.Is(err, ErrRepresentationKey) {
+		t.Errorf("wrong key: got %v, want ErrRepresentationKey", err)
+	}
+	rfs.RepresentationKey = nil
+	if _, _, err := rfs.RetrieveFile(url.RepHash); !errors.Is(err, ErrRepresentationEncrypted) {
+		t.Errorf("no key: got %v, want ErrRepresentationEncrypted", err)
+	}
+
+	// Plaintext representations still load with a key configured
+	plain, err := rfs.StoreFile("b.txt", []byte("plain"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	if plain.Encrypted {
+		t.Error("URL of a plaintext representation is marked encrypted")
+	}
+	rfs.RepresentationKey = bytes.Repeat([]byte{2}, RepresentationKeySize)
+	if _, _, err := rfs.RetrieveFile(plain.RepHash); err != nil {
+		t.Errorf("plaintext representation with a key configured: %v", err)
+	}
+
+	rfs.RepresentationKey = []byte("short")
+	if _, err := rfs.StoreFile("c.txt", []byte("x"), "text/plain"); err == nil {
+		t.Error("stored with a key of the wrong size")
+	}
+}
+
+func TestEncryptedRandomURL(t *testing.T) {
+	url := &RandomURL{Scheme: "rd", Host: "randomfs", Version: RepresentationVersion, FileName: "a.txt", FileSize: 5, Timestamp: 42, RepHash: "QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG", Encrypted: true}
+	parsed, err := ParseRandomURL(url.String())
+	if err != nil {
+		t.Fatalf("ParseRandomURL(%q): %v", url.String(), err)
+	}
+	if *parsed != *url {
+		t.Fatalf("round trip gave %+v, want %+v", parsed, url)
+	}
+
+	url.Encrypted = false
+	if parsed, err := ParseRandomURL(url.String()); err != nil || parsed.Encrypted || parsed.RepHash != url.RepHash {
+		t.Fatalf("plain URL parsed as %+v, %v", parsed, err)
+	}
+}
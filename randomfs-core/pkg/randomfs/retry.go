@@ -0,0 +1,104 @@
+package randomfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"net/url"
+	"time"
+)
+
+// Defaults for retrying IPFS add and cat calls
+const (
+	DefaultIPFSRetryAttempts = 3
+	DefaultIPFSRetryBackoff  = 100 * time.Millisecond
+	DefaultIPFSRetryMaxDelay = 2 * time.Second
+)
+
+// DefaultRetryPolicy is the IPFSRetry policy of new instances
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: DefaultIPFSRetryAttempts,
+	Backoff:     DefaultIPFSRetryBackoff,
+	MaxDelay:    DefaultIPFSRetryMaxDelay,
+	Jitter:      0.5,
+}
+
+// RetryPolicy decides how often and how fast a failed backend call is
+// retried. Only connection errors and 5xx responses are retried; 4xx
+// responses and cancelled contexts fail at once.
+type RetryPolicy struct {
+	// MaxAttempts bounds the attempts of one call, including the first.
+	// Values below two disable retries.
+	MaxAttempts int
+	// Backoff is the delay before the first retry. Each further retry
+	// waits twice as long, up to MaxDelay if it is set.
+	Backoff  time.Duration
+	MaxDelay time.Duration
+	// Jitter shortens each delay by a random fraction of up to Jitter, so
+	// concurrent calls do not retry in lockstep
+	Jitter float64
+}
+
+// delay returns the wait before the given retry, counting from one
+func (p RetryPolicy) delay(retry int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < retry && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		delay -= time.Duration(mrand.Float64() * min(p.Jitter, 1) * float64(delay))
+	}
+	return delay
+}
+
+// ipfsStatusError is a non-200 response from the IPFS API
+type ipfsStatusError struct {
+	op     string
+	status int
+	msg    string
+}
+
+func (e *ipfsStatusError) Error() string {
+	return fmt.Sprintf("IPFS %s returned %d: %s", e.op, e.status, e.msg)
+}
+
+// retryable reports whether a failed backend call may succeed if repeated:
+// the daemon could not be reached or failed with a server error
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var statusErr *ipfsStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.status >= 500
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// withRetry runs call under the IPFSRetry policy until it succeeds, fails
+// with an error that is not retryable, or runs out of attempts
+func (rfs *RandomFS) withRetry(ctx context.Context, op string, call func() error) error {
+	policy := rfs.IPFSRetry
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil || attempt >= policy.MaxAttempts || !retryable(err) {
+			return err
+		}
+
+		delay := policy.delay(attempt)
+		rfs.log().Warn("IPFS call failed, retrying", "op", op, "attempt", attempt, "delay", delay, "error", err)
+		rfs.updateStats(func(s *Stats) { s.IPFSRetries++ })
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w (last attempt: %v)", ctx.Err(), err)
+		}
+	}
+}
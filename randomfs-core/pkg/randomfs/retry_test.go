@@ -0,0 +1,167 @@
+package randomfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/TheEntropyCollective/randomfs-core/internal/ipfstest"
+)
+
+// newHiccupRandomFS returns an instance whose IPFS API handles calls to
+// path with fail for calls first to last, counting from one, and behaves
+// normally otherwise. calls counts the requests to path.
+func newHiccupRandomFS(t *testing.T, path string, first, last int64, fail http.HandlerFunc) (*RandomFS, *atomic.Int64) {
+	t.Helper()
+	ipfs := ipfstest.NewServer(t)
+	calls := new(atomic.Int64)
+	hiccup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == path {
+			if n := calls.Add(1); n >= first && n <= last {
+				fail(w, r)
+				return
+			}
+		}
+		ipfs.Config.Handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(hiccup.Close)
+
+	rfs, err := NewRandomFS(hiccup.URL, t.TempDir(), 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFS: %v", err)
+	}
+	rfs.IPFSRetry = RetryPolicy{MaxAttempts: 5, Backoff: time.Millisecond, MaxDelay: 10 * time.Millisecond, Jitter: 0.5}
+	t.Cleanup(func() { rfs.Close() })
+	return rfs, calls
+}
+
+// dropConnection closes the connection without responding, as a daemon
+// going down does
+func dropConnection(w http.ResponseWriter, r *http.Request) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		panic(err)
+	}
+	conn.Close()
+}
+
+func unavailable(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "daemon restarting", http.StatusServiceUnavailable)
+}
+
+func TestStoreSurvivesDaemonHiccup(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		fail http.HandlerFunc
+	}{
+		{"connection errors", dropConnection},
+		{"server errors", unavailable},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// Three calls fail in the middle of a store of many blocks
+			rfs, adds := newHiccupRandomFS(t, "/api/v0/add", 40, 42, tc.fail)
+			data := make([]byte, 90*NanoBlockSize)
+			rand.Read(data)
+
+			rdURL, err := rfs.StoreFile("hiccup.bin", data, "application/octet-stream")
+			if err != nil {
+				t.Fatalf("StoreFile through a hiccup: %v", err)
+			}
+			if adds.Load() < 43 {
+				t.Fatalf("store made %d add calls, expected the hiccup to be hit", adds.Load())
+			}
+			stats := rfs.GetStats()
+			if stats.IPFSRetries != 3 {
+				t.Errorf("IPFSRetries = %d, want 3", stats.IPFSRetries)
+			}
+			if stats.IPFSAddErrors != 0 {
+				t.Errorf("IPFSAddErrors = %d, want 0 for calls that succeeded on retry", stats.IPFSAddErrors)
+			}
+
+			got, _, err := rfs.RetrieveFile(rdURL.RepHash)
+			if err != nil {
+				t.Fatalf("RetrieveFile: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("file stored through a hiccup differs")
+			}
+		})
+	}
+}
+
+func TestRetrieveRetriesCats(t *testing.T) {
+	rfs, cats := newHiccupRandomFS(t, "/api/v0/cat", 1, 2, dropConnection)
+	data := []byte("retrieved through a restart")
+	rdURL, err := rfs.StoreFile("cat.txt", data, "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	rfs.Cache().Clear()
+
+	got, _, err := rfs.RetrieveFile(rdURL.RepHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile through a hiccup: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("file retrieved through a hiccup differs")
+	}
+	if cats.Load() < 3 {
+		t.Errorf("retrieval made %d cat calls, expected the failed ones to be repeated", cats.Load())
+	}
+}
+
+func TestClientErrorsAreNotRetried(t *testing.T) {
+	rfs, adds := newHiccupRandomFS(t, "/api/v0/add", 1, 1<<30, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+	})
+
+	_, err := rfs.StoreFile("rejected.txt", []byte("rejected"), "text/plain")
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Fatalf("StoreFile returned %v, want the 400 response", err)
+	}
+	if adds.Load() != 1 {
+		t.Errorf("a 400 response was retried: %d add calls", adds.Load())
+	}
+	if retries := rfs.GetStats().IPFSRetries; retries != 0 {
+		t.Errorf("IPFSRetries = %d, want 0", retries)
+	}
+}
+
+func TestRetriesGiveUpAfterMaxAttempts(t *testing.T) {
+	rfs, adds := newHiccupRandomFS(t, "/api/v0/add", 1, 1<<30, unavailable)
+	rfs.IPFSRetry.MaxAttempts = 3
+
+	if _, err := rfs.StoreFile("down.txt", []byte("daemon down"), "text/plain"); err == nil {
+		t.Fatal("StoreFile succeeded with the daemon down")
+	}
+	if adds.Load() != 3 {
+		t.Errorf("made %d add calls, want MaxAttempts = 3", adds.Load())
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{Backoff: 100 * time.Millisecond, MaxDelay: time.Second}
+	for retry, want := range map[int]time.Duration{
+		1:  100 * time.Millisecond,
+		2:  200 * time.Millisecond,
+		4:  800 * time.Millisecond,
+		5:  time.Second,
+		60: time.Second,
+	} {
+		if got := policy.delay(retry); got != want {
+			t.Errorf("delay(%d) = %v, want %v", retry, got, want)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := policy.delay(2); got < 100*time.Millisecond || got > 200*time.Millisecond {
+			t.Fatalf("jittered delay(2) = %v, want 100ms to 200ms", got)
+		}
+	}
+}
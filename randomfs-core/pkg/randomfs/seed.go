@@ -0,0 +1,71 @@
+package randomfs
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"slices"
+)
+
+// randomizerSeedDomain prefixes the input of the well-known seeds
+const randomizerSeedDomain = "randomfs randomizer seed"
+
+// expandSeedToBlock expands seed into blockSize bytes with SHA-256 in
+// counter mode: each 32 bytes are the SHA-256 of the seed followed by the
+// big-endian number of the 32 bytes. The same seed always yields the same
+// block.
+func expandSeedToBlock(seed [32]byte, blockSize int) []byte {
+	block := make([]byte, 0, blockSize+sha256.Size)
+	var input [len(seed) + 8]byte
+	copy(input[:], seed[:])
+	for counter := uint64(0); len(block) < blockSize; counter++ {
+		binary.BigEndian.PutUint64(input[len(seed):], counter)
+		sum := sha256.Sum256(input[:])
+		block = append(block, sum[:]...)
+	}
+	return block[:blockSize]
+}
+
+// wellKnownSeed returns the nth of the seeds every instance tops up its
+// randomizers from
+func wellKnownSeed(n int) [32]byte {
+	input := binary.BigEndian.AppendUint64([]byte(randomizerSeedDomain), uint64(n))
+	return sha256.Sum256(input)
+}
+
+// seededRandomizer returns a randomizer expanded from a well-known seed
+// and the hex seed, following SeededRandomizers: block i of a file takes
+// seed i while fewer than SeededRandomizers candidates are pooled. It
+// returns false for the second randomizer of a block, for blocks past the
+// seeds and for a seed whose block is already a candidate, which the
+// policy could reuse for another block of the file.
+func (rfs *RandomFS) seededRandomizer(ctx RandomizerContext, candidates []string) ([]byte, string, bool) {
+	if ctx.second || ctx.BlockIndex >= rfs.SeededRandomizers || len(candidates) >= rfs.SeededRandomizers {
+		return nil, "", false
+	}
+	seed := wellKnownSeed(ctx.BlockIndex)
+	randomizer := expandSeedToBlock(seed, ctx.BlockSize)
+	address := canonicalRef(blockKey(rfs.blockHash, randomizer))
+	if slices.ContainsFunc(candidates, func(hash string) bool { return canonicalRef(hash) == address }) {
+		return nil, "", false
+	}
+	return randomizer, hex.EncodeToString(seed[:]), true
+}
+
+// regenerateRandomizer expands the seed recorded for the randomizer ref
+// of block i of rep, for a randomizer the backend no longer has
+func (rfs *RandomFS) regenerateRandomizer(rep *FileRepresentation, i int, ref string) ([]byte, error) {
+	if i >= len(rep.RandomizerSeeds) || rep.RandomizerSeeds[i] == "" || rep.RandomizerHashes[i] != ref {
+		return nil, fmt.Errorf("no seed recorded for randomizer %d", i)
+	}
+	var seed [32]byte
+	if n, err := hex.Decode(seed[:], []byte(rep.RandomizerSeeds[i])); err != nil || n != len(seed) {
+		return nil, fmt.Errorf("invalid seed for randomizer %d", i)
+	}
+	randomizer := expandSeedToBlock(seed, rep.BlockSize)
+	if err := rfs.verifyBlock(ref, randomizer, rep.BlockSize); err != nil {
+		return nil, err
+	}
+	return randomizer, nil
+}
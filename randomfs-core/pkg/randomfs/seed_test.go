@@ -0,0 +1,93 @@
+package randomfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"testing"
+)
+
+func TestExpandSeedToBlock(t *testing.T) {
+	seed := wellKnownSeed(0)
+	block := expandSeedToBlock(seed, 100)
+	if len(block) != 100 {
+		t.Fatalf("expanded to %d bytes, want 100", len(block))
+	}
+	first := sha256.Sum256(append(seed[:], 0, 0, 0, 0, 0, 0, 0, 0))
+	if !bytes.Equal(block[:32], first[:]) {
+		t.Error("first 32 bytes are not the SHA-256 of the seed and counter 0")
+	}
+	if !bytes.Equal(expandSeedToBlock(seed, 100), block) {
+		t.Error("one seed expanded to different blocks")
+	}
+	if bytes.Equal(expandSeedToBlock(wellKnownSeed(1), 100), block) {
+		t.Error("two seeds expanded to the same block")
+	}
+}
+
+// newSeededRandomFS opens an instance keeping blocks in store that tops up
+// its randomizers from n seeds
+func newSeededRandomFS(t *testing.T, store *MemoryBlockStore, n int) *RandomFS {
+	t.Helper()
+	rfs, err := NewRandomFSWithConfig(Config{BlockStore: store, DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewRandomFSWithConfig: %v", err)
+	}
+	t.Cleanup(func() { rfs.Close() })
+	rfs.SeededRandomizers = n
+	return rfs
+}
+
+// storeRandomRep stores blocks blocks of random data and returns the data,
+// its representation hash and the representation
+func storeRandomRep(t *testing.T, rfs *RandomFS, name string, blocks int) ([]byte, string, *FileRepresentation) {
+	t.Helper()
+	data := make([]byte, blocks*NanoBlockSize)
+	rand.Read(data)
+	url, err := rfs.StoreFile(name, data, "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	rep, err := rfs.GetRepresentation(url.RepHash)
+	if err != nil {
+		t.Fatalf("GetRepresentation: %v", err)
+	}
+	return data, url.RepHash, rep
+}
+
+func TestSeededRandomizersConvergeAcrossInstances(t *testing.T) {
+	first := newSeededRandomFS(t, NewMemoryBlockStore(), 4)
+	second := newSeededRandomFS(t, NewMemoryBlockStore(), 4)
+	_, _, a := storeRandomRep(t, first, "a.bin", 5)
+	_, _, b := storeRandomRep(t, second, "b.bin", 5)
+
+	for i := 0; i < 4; i++ {
+		if a.RandomizerHashes[i] != b.RandomizerHashes[i] || a.RandomizerSeeds[i] == "" {
+			t.Errorf("randomizer %d is %s with seed %q and %s elsewhere", i, a.RandomizerHashes[i], a.RandomizerSeeds[i], b.RandomizerHashes[i])
+		}
+	}
+	if a.RandomizerHashes[4] == b.RandomizerHashes[4] || a.RandomizerSeeds[4] != "" {
+		t.Error("the block past the seeds was given a seeded randomizer")
+	}
+
+	// The pool now holds enough randomizers
+	_, _, c := storeRandomRep(t, first, "c.bin", 2)
+	if len(c.RandomizerSeeds) != 0 {
+		t.Errorf("seeds used with a full pool: %v", c.RandomizerSeeds)
+	}
+}
+
+func TestSeededRandomizerIsRegenerated(t *testing.T) {
+	store := NewMemoryBlockStore()
+	rfs := newSeededRandomFS(t, store, 2)
+	data, repHash, rep := storeRandomRep(t, rfs, "file.bin", 2)
+
+	if err := store.Delete(rep.RandomizerHashes[0]); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	rfs.cache.Clear()
+	got, _, err := rfs.RetrieveFile(repHash)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("RetrieveFile without the seeded randomizer returned %d bytes: %v", len(got), err)
+	}
+}
@@ -0,0 +1,226 @@
+package randomfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"sync"
+)
+
+// UnknownSize is passed to StoreReader for a stream whose length is only
+// known once it ends
+const UnknownSize = -1
+
+// blockSource supplies the contents of a file being stored one block at a
+// time
+type blockSource interface {
+	// batch returns how many blocks, at most workers, may be read and
+	// stored at once. It is called before open.
+	batch(workers int) int
+	// open prepares to read size bytes, or up to EOF for UnknownSize, in
+	// blocks of blockSize, writing every byte read to hasher
+	open(hasher hash.Hash, size int64, blockSize int) error
+	// next returns the next block, zero padded to the block size, or
+	// io.EOF once the whole file has been read
+	next() ([]byte, error)
+	// entropy returns the Shannon entropy in bits per byte of the file
+	entropy() float64
+	// length returns the size of the file once next has returned io.EOF
+	length() int64
+	// close stops any reading still in progress
+	close()
+}
+
+// readerAtSource reads blocks at their offsets in an io.ReaderAt, which it
+// scans once on open to hash the file and measure its entropy
+type readerAtSource struct {
+	r         io.ReaderAt
+	size      int64
+	blockSize int
+	offset    int64
+	histogram byteHistogram
+}
+
+func (s *readerAtSource) batch(workers int) int {
+	return workers
+}
+
+func (s *readerAtSource) open(hasher hash.Hash, size int64, blockSize int) error {
+	s.size = size
+	s.blockSize = blockSize
+	if n, err := io.Copy(io.MultiWriter(hasher, &s.histogram), io.NewSectionReader(s.r, 0, size)); err != nil {
+		return fmt.Errorf("failed to read file: %v", err)
+	} else if n != size {
+		return fmt.Errorf("failed to read file: got %d of %d bytes", n, size)
+	}
+	return nil
+}
+
+func (s *readerAtSource) next() ([]byte, error) {
+	if s.offset >= s.size {
+		return nil, io.EOF
+	}
+	length := min(int64(s.blockSize), s.size-s.offset)
+
+	block := make([]byte, s.blockSize)
+	if n, err := s.r.ReadAt(block[:length], s.offset); int64(n) < length {
+		return nil, fmt.Errorf("failed to read %d bytes at offset %d: %v", length, s.offset, err)
+	}
+	s.offset += length
+	return block, nil
+}
+
+func (s *readerAtSource) entropy() float64 {
+	return s.histogram.entropy()
+}
+
+func (s *readerAtSource) length() int64 {
+	return s.size
+}
+
+func (s *readerAtSource) close() {}
+
+// streamSource reads an io.Reader in a goroutine that runs at most
+// maxInFlight blocks ahead of the consumer, counting the blocks of the
+// batch being stored. When the consumer falls behind, the goroutine
+// blocks, and with it the producer feeding the reader.
+type streamSource struct {
+	r           io.Reader
+	maxInFlight int
+	batchSize   int
+	// limit, if positive, fails the read past that many bytes
+	limit int64
+
+	blocks  chan []byte
+	stopped chan struct{}
+	// err and total are set before blocks is closed
+	err   error
+	total int64
+
+	mutex     sync.Mutex
+	histogram byteHistogram
+}
+
+func (s *streamSource) batch(workers int) int {
+	s.batchSize = min(workers, max(s.maxInFlight, 1))
+	return s.batchSize
+}
+
+func (s *streamSource) open(hasher hash.Hash, size int64, blockSize int) error {
+	// The reading goroutine holds one block while it waits to send it,
+	// and the batch being stored holds the others in flight
+	s.blocks = make(chan []byte, max(s.maxInFlight, 1)-max(s.batchSize, 1))
+	s.stopped = make(chan struct{})
+	go s.read(hasher, size, blockSize)
+	return nil
+}
+
+// read splits the stream into blocks and sends them to the consumer
+func (s *streamSource) read(hasher hash.Hash, size int64, blockSize int) {
+	defer close(s.blocks)
+
+	for remaining := size; remaining > 0 || size == UnknownSize; {
+		length := int64(blockSize)
+		if size != UnknownSize {
+			length = min(length, remaining)
+		}
+		block := make([]byte, blockSize)
+		n, err := io.ReadFull(s.r, block[:length])
+		if size == UnknownSize && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+			// A short block ends a stream of unknown size
+			if n == 0 {
+				return
+			}
+			length, remaining = int64(n), int64(n)
+		} else if err != nil {
+			s.err = fmt.Errorf("failed to read file: got %d of %d bytes: %v", s.total, size, err)
+			return
+		}
+		if s.limit > 0 && s.total+length > s.limit {
+			s.err = fmt.Errorf("%w: more than %d bytes", ErrFileTooLarge, s.limit)
+			return
+		}
+		remaining -= length
+		s.total += length
+
+		hasher.Write(block[:length])
+		s.mutex.Lock()
+		s.histogram.Write(block[:length])
+		s.mutex.Unlock()
+
+		select {
+		case s.blocks <- block:
+		case <-s.stopped:
+			return
+		}
+	}
+
+	if size == UnknownSize {
+		return
+	}
+	// Storing a prefix of a longer stream would silently truncate it
+	var extra [1]byte
+	if n, _ := io.ReadFull(s.r, extra[:]); n > 0 {
+		s.err = fmt.Errorf("failed to read file: reader has more than %d bytes", size)
+	}
+}
+
+func (s *streamSource) next() ([]byte, error) {
+	block, ok := <-s.blocks
+	if !ok {
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, io.EOF
+	}
+	return block, nil
+}
+
+func (s *streamSource) entropy() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.histogram.entropy()
+}
+
+func (s *streamSource) length() int64 {
+	return s.total
+}
+
+func (s *streamSource) close() {
+	close(s.stopped)
+}
+
+// StoreReader stores exactly size bytes read sequentially from r. Reading
+// runs at most MaxInFlightBlocks blocks ahead of the upload, so a fast
+// reader feeding a slow backend is held back instead of buffering the file
+// in memory. No more than MaxInFlightBlocks blocks are stored at once. A reader with fewer or more than size bytes fails the store.
+//
+// With UnknownSize, r is stored up to EOF. Streams of up to BlockSize bytes
+// are buffered to choose their block size like any other file; longer ones
+// are stored in blocks of the largest size, one block in memory at a time.
+func (rfs *RandomFS) StoreReader(filename string, r io.Reader, size int64, contentType string) (*RandomURL, error) {
+	if contentType == "" {
+		contentType, r = detectReaderContentType(filename, r)
+	}
+	var opts storeOptions
+	if size == UnknownSize {
+		prefix := make([]byte, BlockSize)
+		n, err := io.ReadFull(r, prefix)
+		switch err {
+		case io.EOF, io.ErrUnexpectedEOF:
+			r, size = bytes.NewReader(prefix[:n]), int64(n)
+		case nil:
+			r = io.MultiReader(bytes.NewReader(prefix), r)
+			opts.blockSize = rfs.selectBlockSize(math.MaxInt64)
+		default:
+			return nil, fmt.Errorf("failed to read file: %v", err)
+		}
+	}
+	if size < 0 && size != UnknownSize {
+		return nil, fmt.Errorf("invalid size %d", size)
+	}
+	return rfs.storeFile(context.Background(), filename, &streamSource{r: r, maxInFlight: rfs.MaxInFlightBlocks, limit: rfs.MaxFileSize}, size, contentType, opts)
+}
@@ -0,0 +1,183 @@
+package randomfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// leadTrackingReader produces size bytes as fast as it is read and records
+// the most blocks it ever got ahead of the blocks the backend was asked to
+// store
+type leadTrackingReader struct {
+	mock      *countingIPFS
+	size      int64
+	blockSize int64
+	read      int64
+
+	mutex   sync.Mutex
+	maxLead int64
+}
+
+func (r *leadTrackingReader) Read(p []byte) (int, error) {
+	if r.read >= r.size {
+		return 0, io.EOF
+	}
+	n := int(min(int64(len(p)), r.size-r.read))
+	for i := range p[:n] {
+		p[i] = byte(r.read + int64(i))
+	}
+	r.read += int64(n)
+
+	r.mock.mutex.Lock()
+	// Every block is stored as a randomizer add followed by a block add
+	uploaded := int64(r.mock.adds / 2)
+	r.mock.mutex.Unlock()
+
+	blocksRead := (r.read + r.blockSize - 1) / r.blockSize
+	r.mutex.Lock()
+	r.maxLead = max(r.maxLead, blocksRead-uploaded)
+	r.mutex.Unlock()
+	return n, nil
+}
+
+// storeFromFastReader streams a file of blocks blocks into a deliberately
+// slow backend and returns how far ahead the reader got
+func storeFromFastReader(t *testing.T, maxInFlight, blocks int) int64 {
+	t.Helper()
+	mock, rfs := newMockIPFSRandomFS(t)
+	mock.addDelay = 2 * time.Millisecond
+	rfs.MaxInFlightBlocks = maxInFlight
+
+	reader := &leadTrackingReader{mock: mock, size: int64(blocks) * NanoBlockSize, blockSize: NanoBlockSize}
+	if _, err := rfs.StoreReader("stream.bin", reader, reader.size, "application/octet-stream"); err != nil {
+		t.Fatalf("StoreReader: %v", err)
+	}
+	return reader.maxLead
+}
+
+func TestStoreReaderAppliesBackpressure(t *testing.T) {
+	const maxInFlight = 3
+	// Besides the queued blocks, one is being uploaded and one being read
+	if lead := storeFromFastReader(t, maxInFlight, 64); lead > maxInFlight+2 {
+		t.Fatalf("reader got %d blocks ahead of the backend, limit is %d", lead, maxInFlight+2)
+	}
+
+	// Without a meaningful bound the same reader races ahead, so the
+	// measurement above is not vacuous
+	if lead := storeFromFastReader(t, 1000, 64); lead <= maxInFlight+2 {
+		t.Fatalf("expected an unbounded reader to get far ahead, got %d blocks", lead)
+	}
+}
+
+func TestStoreReaderRoundTrip(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	rfs.MaxInFlightBlocks = 2
+
+	data := make([]byte, 5*NanoBlockSize+123)
+	rand.Read(data)
+	rdURL, err := rfs.StoreReader("stream.bin", bytes.NewReader(data), int64(len(data)), "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreReader: %v", err)
+	}
+
+	got, rep, err := rfs.RetrieveFile(rdURL.RepHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("retrieved data differs")
+	}
+
+	digest, _ := fileHash(rep.HashAlgorithm, data)
+	if rep.FileHash != digest {
+		t.Fatalf("expected file hash %s, got %s", digest, rep.FileHash)
+	}
+}
+
+func TestStoreReaderRejectsWrongSize(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	before := blockFiles(t, rfs.dataDir)
+
+	data := bytes.Repeat([]byte{7}, 3*NanoBlockSize)
+	if _, err := rfs.StoreReader("short.bin", bytes.NewReader(data), int64(len(data))+1, "text/plain"); err == nil {
+		t.Fatal("expected a short reader to fail the store")
+	}
+	_, err := rfs.StoreReader("long.bin", bytes.NewReader(data), int64(len(data))-1, "text/plain")
+	if err == nil || !strings.Contains(err.Error(), "more than") {
+		t.Fatalf("expected a long reader to fail the store, got %v", err)
+	}
+
+	if after := blockFiles(t, rfs.dataDir); len(after) != len(before) {
+		t.Fatalf("failed streamed stores left %d blocks behind", len(after)-len(before))
+	}
+	if files := rfs.ListFiles(); len(files) != 0 {
+		t.Fatalf("expected no indexed files, got %d", len(files))
+	}
+}
+
+func TestStoreReaderEmptyFile(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	rdURL, err := rfs.StoreReader("empty.txt", strings.NewReader(""), 0, "text/plain")
+	if err != nil {
+		t.Fatalf("StoreReader: %v", err)
+	}
+	if got, _, err := rfs.RetrieveFile(rdURL.RepHash); err != nil || len(got) != 0 {
+		t.Fatalf("expected an empty file, got %d bytes and %v", len(got), err)
+	}
+}
+
+func TestStoreReaderUnknownSize(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	defer rfs.Close()
+	roundTrip := func(name string, data []byte) *FileRepresentation {
+		t.Helper()
+		// Hide the length of the data behind a plain io.Reader
+		rdURL, err := rfs.StoreReader(name, io.MultiReader(bytes.NewReader(data)), UnknownSize, "application/octet-stream")
+		if err != nil {
+			t.Fatalf("StoreReader(%s): %v", name, err)
+		}
+		if rdURL.FileSize != int64(len(data)) {
+			t.Errorf("%s: URL reports %d bytes, want %d", name, rdURL.FileSize, len(data))
+		}
+		got, rep, err := rfs.RetrieveFile(rdURL.RepHash)
+		if err != nil {
+			t.Fatalf("RetrieveFile(%s): %v", name, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%s did not round-trip", name)
+		}
+		return rep
+	}
+
+	small := make([]byte, 3000)
+	rand.Read(small)
+	if rep := roundTrip("small.bin", small); rep.BlockSize != NanoBlockSize {
+		t.Errorf("short stream stored in %d byte blocks, want the tier of its size", rep.BlockSize)
+	}
+
+	large := make([]byte, 2*BlockSize+12345)
+	rand.Read(large)
+	rep := roundTrip("large.tar", large)
+	if rep.BlockSize != BlockSize || len(rep.BlockHashes) != 3 {
+		t.Errorf("long stream stored as %d blocks of %d bytes, want 3 of %d", len(rep.BlockHashes), rep.BlockSize, BlockSize)
+	}
+
+	// The last block of a sparse stream gets its real length
+	rfs.SparseBlocks = true
+	rep = roundTrip("zeros.bin", make([]byte, BlockSize+100))
+	if _, length, ok := parseSparseRef(rep.BlockHashes[1]); !ok || length != 100 {
+		t.Errorf("last sparse block recorded as %q", rep.BlockHashes[1])
+	}
+
+	if _, err := rfs.StoreReader("empty.bin", strings.NewReader(""), UnknownSize, "text/plain"); err != nil {
+		t.Errorf("empty stream of unknown size: %v", err)
+	}
+	if _, err := rfs.StoreReader("bad.bin", strings.NewReader("x"), -2, "text/plain"); err == nil {
+		t.Error("accepted a negative size other than UnknownSize")
+	}
+}
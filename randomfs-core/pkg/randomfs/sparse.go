@@ -0,0 +1,83 @@
+package randomfs
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// sparseRefPrefix starts the block reference of a sparse block: a block of
+// one repeated byte that is stored nowhere and rebuilt on retrieval. The
+// reference is "sparse:<byte in hex>:<length>", and the randomizer
+// reference of a sparse block is empty.
+const sparseRefPrefix = "sparse:"
+
+// sparseRef returns the reference of a sparse block of length bytes of fill
+func sparseRef(fill byte, length int) string {
+	return fmt.Sprintf("%s%02x:%d", sparseRefPrefix, fill, length)
+}
+
+// parseSparseRef returns the fill byte and length of a sparse block
+// reference; ok is false for any other reference
+func parseSparseRef(ref string) (fill byte, length int, ok bool) {
+	rest, found := strings.CutPrefix(ref, sparseRefPrefix)
+	if !found {
+		return 0, 0, false
+	}
+	fillHex, lengthText, found := strings.Cut(rest, ":")
+	if !found || len(fillHex) != 2 {
+		return 0, 0, false
+	}
+	value, err := strconv.ParseUint(fillHex, 16, 8)
+	if err != nil {
+		return 0, 0, false
+	}
+	length, err = strconv.Atoi(lengthText)
+	if err != nil || length <= 0 {
+		return 0, 0, false
+	}
+	return byte(value), length, true
+}
+
+// isSparseRef reports whether ref is a well-formed sparse block reference
+func isSparseRef(ref string) bool {
+	_, _, ok := parseSparseRef(ref)
+	return ok
+}
+
+// constantBlock reports whether data is one byte repeated, and which
+func constantBlock(data []byte) (byte, bool) {
+	if len(data) == 0 {
+		return 0, false
+	}
+	fill := data[0]
+	for _, b := range data[1:] {
+		if b != fill {
+			return 0, false
+		}
+	}
+	return fill, true
+}
+
+// blockDataSize returns the number of data bytes in block i of rep, which
+// is less than the block size only for the last block
+func blockDataSize(rep *FileRepresentation, i int) int {
+	if i == len(rep.BlockHashes)-1 {
+		return int(rep.dataSize() - int64(i)*int64(rep.BlockSize))
+	}
+	return rep.BlockSize
+}
+
+// expandSparseBlock returns the contents of block i of rep if it is
+// sparse. ok is false for blocks stored in the backend.
+func expandSparseBlock(rep *FileRepresentation, i int) (data []byte, ok bool, err error) {
+	fill, length, ok := parseSparseRef(rep.BlockHashes[i])
+	if !ok {
+		return nil, false, nil
+	}
+	if want := blockDataSize(rep, i); length != want {
+		return nil, true, fmt.Errorf("sparse block %d has length %d, want %d", i, length, want)
+	}
+	return bytes.Repeat([]byte{fill}, length), true, nil
+}
@@ -0,0 +1,161 @@
+package randomfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sparseImage returns a disk-image-like file of mini blocks: zero regions
+// ending and starting mid-block around some random data, and a final
+// partial block of 0xff
+func sparseImage() []byte {
+	data := make([]byte, 31*MiniBlockSize+5000)
+	rand.Read(data[10*MiniBlockSize+100 : 12*MiniBlockSize])
+	for i := 30*MiniBlockSize + 7; i < len(data); i++ {
+		data[i] = 0xff
+	}
+	return data
+}
+
+func TestSparseBlocksStoreNothing(t *testing.T) {
+	data := sparseImage()
+
+	dense := newTestRandomFS(t)
+	if _, err := dense.StoreFile("disk.img", data, "application/octet-stream"); err != nil {
+		t.Fatalf("dense StoreFile: %v", err)
+	}
+
+	rfs := newTestRandomFS(t)
+	rfs.SparseBlocks = true
+	rdURL, err := rfs.StoreFile("disk.img", data, "application/octet-stream")
+	if err != nil {
+		t.Fatalf("sparse StoreFile: %v", err)
+	}
+
+	// Blocks 0-9, 12-29 and the final partial block are constant; blocks
+	// 10, 11 and 30 are stored with their randomizers
+	if got := rfs.GetStats().SparseBlocks; got != 29 {
+		t.Errorf("%d sparse blocks, want 29", got)
+	}
+	stored, denseStored := len(blockFiles(t, rfs.dataDir)), len(blockFiles(t, dense.dataDir))
+	if stored != 3*2+1 {
+		t.Errorf("sparse store wrote %d blocks, want 7", stored)
+	}
+	if stored*5 > denseStored {
+		t.Errorf("sparse store wrote %d blocks, dense store %d", stored, denseStored)
+	}
+
+	rep, err := rfs.loadRepresentation(rdURL.RepHash)
+	if err != nil {
+		t.Fatalf("loadRepresentation: %v", err)
+	}
+	if last := rep.BlockHashes[len(rep.BlockHashes)-1]; last != sparseRef(0xff, 5000) {
+		t.Errorf("final block recorded as %q", last)
+	}
+	if refs := representationBlocks(rep); len(refs) != 6 {
+		t.Errorf("representation references %d stored blocks, want 6", len(refs))
+	}
+
+	rfs.Cache().Clear()
+	got, _, err := rfs.RetrieveFile(rdURL.RepHash)
+	if err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("sparse file reconstructed incorrectly")
+	}
+	if err := rfs.VerifyFile(rdURL.RepHash); err != nil {
+		t.Errorf("VerifyFile: %v", err)
+	}
+}
+
+func TestSparseBlocksPartialReads(t *testing.T) {
+	data := sparseImage()
+	rfs := newTestRandomFS(t)
+	rfs.SparseBlocks = true
+	rdURL, err := rfs.StoreFile("disk.img", data, "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+
+	stream, err := rfs.OpenFileStream(rdURL.RepHash)
+	if err != nil {
+		t.Fatalf("OpenFileStream: %v", err)
+	}
+	defer stream.Close()
+
+	// Ranges crossing from sparse into stored blocks and back, and into
+	// the partial final block
+	for _, r := range []struct{ offset, length int }{
+		{10*MiniBlockSize - 50, 200},
+		{12*MiniBlockSize - 10, 20},
+		{30*MiniBlockSize - 3, 20},
+		{31*MiniBlockSize - 100, 5100},
+		{len(data) - 1, 1},
+	} {
+		if _, err := stream.Seek(int64(r.offset), io.SeekStart); err != nil {
+			t.Fatalf("Seek %d: %v", r.offset, err)
+		}
+		buf := make([]byte, r.length)
+		if _, err := io.ReadFull(stream, buf); err != nil {
+			t.Fatalf("read %d bytes at %d: %v", r.length, r.offset, err)
+		}
+		if !bytes.Equal(buf, data[r.offset:r.offset+r.length]) {
+			t.Errorf("%d bytes at %d differ", r.length, r.offset)
+		}
+	}
+}
+
+func TestSparseBlocksRecoverFromBlocks(t *testing.T) {
+	data := sparseImage()
+	rfs := newTestRandomFS(t)
+	rfs.SparseBlocks = true
+	rdURL, err := rfs.StoreFile("disk.img", data, "application/octet-stream")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	rep, err := rfs.loadRepresentation(rdURL.RepHash)
+	if err != nil {
+		t.Fatalf("loadRepresentation: %v", err)
+	}
+
+	blocks := make(map[string][]byte)
+	for _, hash := range representationBlocks(rep) {
+		block, err := os.ReadFile(filepath.Join(rfs.dataDir, "blocks", hash))
+		if err != nil {
+			t.Fatalf("read block: %v", err)
+		}
+		blocks[hash] = block
+	}
+	got, missing, err := rfs.ReconstructFromBlocks(blocks, rep)
+	if err != nil || len(missing) != 0 {
+		t.Fatalf("ReconstructFromBlocks: %v (missing %v)", err, missing)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("recovered sparse file differs")
+	}
+}
+
+func TestParseSparseRef(t *testing.T) {
+	if fill, length, ok := parseSparseRef(sparseRef(0xab, 4096)); !ok || fill != 0xab || length != 4096 {
+		t.Fatalf("round trip gave %x, %d, %v", fill, length, ok)
+	}
+	for _, ref := range []string{
+		"sparse:", "sparse:00", "sparse:0:10", "sparse:zz:10", "sparse:00:0",
+		"sparse:00:-1", "sparse:00:ten", "bafkreihy2ftbnddnvx6h3jj5jlf5v47qztkmqvvcy4ys6r3y6da7dzpc2i",
+	} {
+		if _, _, ok := parseSparseRef(ref); ok {
+			t.Errorf("parsed malformed sparse reference %q", ref)
+		}
+	}
+
+	// A marker whose length disagrees with the file layout is rejected
+	rep := &FileRepresentation{BlockHashes: []string{sparseRef(0, 10), sparseRef(0, 10)}, BlockSize: 10, FileSize: 15}
+	if _, _, err := expandSparseBlock(rep, 1); err == nil {
+		t.Error("sparse block with the wrong length expanded")
+	}
+}
@@ -0,0 +1,85 @@
+package randomfs
+
+import (
+	"mime"
+	"path"
+	"strings"
+)
+
+// ContentStrategy is how files of some content types are stored
+type ContentStrategy struct {
+	// Name identifies the strategy
+	Name string
+	// Policy chooses the randomizers of the files' blocks
+	Policy RandomizerPolicy
+}
+
+// Built-in strategies
+var (
+	// DedupStrategy reuses popular randomizers whenever possible, so files
+	// that are widely stored, such as media, share most of their blocks
+	DedupStrategy = ContentStrategy{Name: "dedup", Policy: AlwaysReusePolicy}
+	// PrivacyStrategy gives every block a fresh randomizer, so sensitive
+	// files share no blocks with anything stored before them
+	PrivacyStrategy = ContentStrategy{Name: "privacy", Policy: AlwaysFreshPolicy}
+)
+
+// ContentStrategyRule applies Strategy to files whose content type matches
+// Pattern. Patterns are media types without parameters and may use the
+// wildcards of path.Match, such as "video/*". Matching ignores case.
+type ContentStrategyRule struct {
+	Pattern  string
+	Strategy ContentStrategy
+}
+
+// DefaultContentStrategies stores media with DedupStrategy and documents
+// with PrivacyStrategy
+func DefaultContentStrategies() []ContentStrategyRule {
+	return []ContentStrategyRule{
+		{Pattern: "video/*", Strategy: DedupStrategy},
+		{Pattern: "audio/*", Strategy: DedupStrategy},
+		{Pattern: "image/*", Strategy: DedupStrategy},
+		{Pattern: "application/pdf", Strategy: PrivacyStrategy},
+		{Pattern: "application/msword", Strategy: PrivacyStrategy},
+		{Pattern: "application/vnd.openxmlformats-officedocument.*", Strategy: PrivacyStrategy},
+		{Pattern: "application/vnd.oasis.opendocument.*", Strategy: PrivacyStrategy},
+		{Pattern: "text/*", Strategy: PrivacyStrategy},
+	}
+}
+
+// contentStrategy returns the strategy of the first rule matching
+// contentType, or false if none does
+func (rfs *RandomFS) contentStrategy(contentType string) (ContentStrategy, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.TrimSpace(contentType)
+	}
+	mediaType = strings.ToLower(mediaType)
+
+	for _, rule := range rfs.ContentStrategies {
+		if matched, _ := path.Match(strings.ToLower(rule.Pattern), mediaType); matched {
+			return rule.Strategy, true
+		}
+	}
+	return ContentStrategy{}, false
+}
+
+// storePolicy returns the randomizer policy for a file being stored: the
+// policy given for the store, then that of the file's content strategy,
+// then the instance-wide RandomizerPolicy, then AlwaysFreshPolicy or, with
+// TwoRandomizers, AlwaysReusePolicy
+func (rfs *RandomFS) storePolicy(contentType string, opts storeOptions) RandomizerPolicy {
+	if opts.policy != nil {
+		return opts.policy
+	}
+	if strategy, ok := rfs.contentStrategy(contentType); ok && strategy.Policy != nil {
+		return strategy.Policy
+	}
+	if rfs.RandomizerPolicy != nil {
+		return rfs.RandomizerPolicy
+	}
+	if rfs.TwoRandomizers {
+		return AlwaysReusePolicy
+	}
+	return AlwaysFreshPolicy
+}
@@ -0,0 +1,97 @@
+package randomfs
+
+import (
+	"bytes"
+	"testing"
+)
+
+// storeTyped stores data with contentType and returns its representation
+func storeTyped(t *testing.T, rfs *RandomFS, name string, data []byte, contentType string) *FileRepresentation {
+	t.Helper()
+	rdURL, err := rfs.StoreFile(name, data, contentType)
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	rep, err := rfs.loadRepresentation(rdURL.RepHash)
+	if err != nil {
+		t.Fatalf("loadRepresentation: %v", err)
+	}
+	return rep
+}
+
+// reusedRandomizers counts the randomizers of rep found in pooled
+func reusedRandomizers(rep *FileRepresentation, pooled *FileRepresentation) int {
+	seen := make(map[string]bool)
+	for _, hash := range pooled.RandomizerHashes {
+		seen[hash] = true
+	}
+	reused := 0
+	for _, hash := range rep.RandomizerHashes {
+		if seen[hash] {
+			reused++
+		}
+	}
+	return reused
+}
+
+func TestContentStrategiesChoosePolicyByType(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	rfs.ContentStrategies = DefaultContentStrategies()
+	data := bytes.Repeat([]byte("frame "), 700)
+
+	// Seed the randomizer pool with a type no rule matches
+	seed := storeTyped(t, rfs, "seed.bin", data, "application/octet-stream")
+
+	video := storeTyped(t, rfs, "clip.mp4", data, "video/mp4")
+	if reused := reusedRandomizers(video, seed); reused != len(video.RandomizerHashes) {
+		t.Fatalf("expected the video to reuse all %d randomizers, reused %d", len(video.RandomizerHashes), reused)
+	}
+
+	document := storeTyped(t, rfs, "report.pdf", data, "application/pdf")
+	if reused := reusedRandomizers(document, seed) + reusedRandomizers(document, video); reused != 0 {
+		t.Fatalf("expected the document to use only fresh randomizers, reused %d", reused)
+	}
+}
+
+func TestContentStrategyMatching(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	rfs.ContentStrategies = []ContentStrategyRule{
+		{Pattern: "video/*", Strategy: DedupStrategy},
+		{Pattern: "text/plain", Strategy: PrivacyStrategy},
+		{Pattern: "*/*", Strategy: ContentStrategy{Name: "fallback", Policy: ProbabilisticPolicy(0.5)}},
+	}
+
+	cases := map[string]string{
+		"video/webm":                "dedup",
+		"VIDEO/MP4":                 "dedup",
+		"text/plain; charset=utf-8": "privacy",
+		"text/html":                 "fallback",
+		"application/pdf":           "fallback",
+	}
+	for contentType, want := range cases {
+		strategy, ok := rfs.contentStrategy(contentType)
+		if !ok || strategy.Name != want {
+			t.Errorf("%s: expected strategy %s, got %q (matched %v)", contentType, want, strategy.Name, ok)
+		}
+	}
+
+	rfs.ContentStrategies = rfs.ContentStrategies[:2]
+	if _, ok := rfs.contentStrategy("application/pdf"); ok {
+		t.Error("expected no strategy for an unmatched type")
+	}
+}
+
+func TestExplicitPolicyOverridesContentStrategy(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	rfs.ContentStrategies = []ContentStrategyRule{{Pattern: "video/*", Strategy: DedupStrategy}}
+	data := bytes.Repeat([]byte("frame "), 700)
+	seed := storeTyped(t, rfs, "seed.bin", data, "application/octet-stream")
+	rdURL, err := rfs.StoreFileWithPolicy("clip.mp4", data, "video/mp4", AlwaysFreshPolicy)
+	if err != nil {
+		t.Fatalf("StoreFileWithPolicy: %v", err)
+	}
+	rep, _ := rfs.loadRepresentation(rdURL.RepHash)
+	if reused := reusedRandomizers(rep, seed); reused != 0 {
+		t.Fatalf("expected the explicit policy to win, reused %d randomizers", reused)
+	}
+}
@@ -0,0 +1,543 @@
+package randomfs
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/errgroup"
+)
+
+// RetrieveFileTo reconstructs a file and writes it to w one block at a time,
+// without holding the whole file in memory. The file hash is checked once
+// everything has been written.
+func (rfs *RandomFS) RetrieveFileTo(repHash string, w io.Writer) (*FileRepresentation, error) {
+	return rfs.retrieveTo(context.Background(), "randomfs.RetrieveFileTo", repHash, func(*FileRepresentation) (io.Writer, func() error) {
+		return rfs.bufferOutput(w)
+	})
+}
+
+// RetrieveFileFunc reconstructs a file and calls fn with each of its
+// blocks in order, index counting from zero; every block but the last
+// holds BlockSize bytes of the file. Blocks are fetched ahead in parallel
+// as by RetrieveFileTo, but fn is called for one block at a time, in file
+// order, and must not keep data once it returns. An error from fn stops
+// the retrieval and is returned as is. The file hash is checked once
+// every block has been passed to fn.
+func (rfs *RandomFS) RetrieveFileFunc(repHash string, fn func(index int, data []byte) error) (*FileRepresentation, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var blocks *blockFuncWriter
+	rep, err := rfs.retrieveTo(ctx, "randomfs.RetrieveFileFunc", repHash, func(rep *FileRepresentation) (io.Writer, func() error) {
+		blocks = &blockFuncWriter{fn: fn, size: rep.BlockSize, cancel: cancel}
+		return blocks, blocks.flush
+	})
+	if blocks != nil && blocks.err != nil {
+		return nil, blocks.err
+	}
+	return rep, err
+}
+
+// retrieveTo reconstructs a file into the writer output returns for its
+// representation, calling the flush function returned with it once every
+// block has been written
+func (rfs *RandomFS) retrieveTo(ctx context.Context, name, repHash string, output func(rep *FileRepresentation) (io.Writer, func() error)) (rep *FileRepresentation, err error) {
+	start := time.Now()
+	ctx, span := rfs.startSpan(ctx, name,
+		attribute.String("randomfs.rep_hash", repHash))
+	defer func() {
+		rfs.noteRetrieval(repHash, err)
+		rfs.observeOperation(OpRetrieve, start, err)
+		endSpan(span, err)
+	}()
+
+	rfs.mutex.RLock()
+	defer rfs.mutex.RUnlock()
+
+	rep, err = rfs.loadRepresentationTraced(ctx, repHash)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkNoPassword(rep); err != nil {
+		return nil, err
+	}
+	span.SetAttributes(
+		attribute.Int64("randomfs.file.size", rep.FileSize),
+		attribute.Int("randomfs.block.count", len(rep.BlockHashes)))
+
+	var hasher hash.Hash
+	if rep.FileHash != "" && rfs.VerifyFileHash {
+		if hasher, err = newFileHasher(rep.HashAlgorithm); err != nil {
+			return nil, err
+		}
+	}
+
+	out, flush := output(rep)
+	var decompressErr error
+	if rep.compressed() {
+		decompressErr, err = rfs.writeDecompressed(ctx, rep, hasher, out)
+	} else {
+		if hasher != nil {
+			out = io.MultiWriter(out, hasher)
+		}
+		err = rfs.writeBlocks(ctx, rep, 0, out)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, fmt.Errorf("failed to flush output: %v", err)
+	}
+
+	// The data has been written by now; a mismatch tells the caller to
+	// discard it
+	if hasher != nil {
+		if err := verifyFileHash(rep, hex.EncodeToString(hasher.Sum(nil))); err != nil {
+			return nil, err
+		}
+	}
+	if decompressErr != nil {
+		return nil, decompressErr
+	}
+
+	rfs.updateStats(func(s *Stats) { s.FilesRetrieved++ })
+
+	return rep, nil
+}
+
+// FileStream reads a stored file block by block. It implements
+// io.ReadSeeker so it can back range requests; only the blocks covering
+// the bytes actually read are fetched.
+type FileStream struct {
+	rfs        *RandomFS
+	rep        *FileRepresentation
+	pos        int64
+	block      []byte
+	blockIndex int
+
+	// decoder decompresses the stored data of a compressed file, and
+	// decoded counts the file bytes it has returned. Seeking back restarts
+	// it; seeking forward skips what lies in between.
+	decoder io.ReadCloser
+	decoded int64
+
+	// opened and failure, the first error reading the file, are reported
+	// to the Metrics observer as a retrieval when the stream is closed
+	opened  time.Time
+	failure error
+	closed  bool
+}
+
+// OpenFileStream returns a reader over the file stored as repHash. Blocks
+// are fetched lazily as the stream is read.
+func (rfs *RandomFS) OpenFileStream(repHash string) (*FileStream, error) {
+	rfs.mutex.RLock()
+	defer rfs.mutex.RUnlock()
+
+	rep, err := rfs.loadRepresentation(repHash)
+	if err == nil {
+		err = checkNoPassword(rep)
+	}
+	rfs.noteRetrieval(repHash, err)
+	if err != nil {
+		return nil, err
+	}
+
+	rfs.updateStats(func(s *Stats) { s.FilesRetrieved++ })
+
+	return &FileStream{rfs: rfs, rep: rep, blockIndex: -1, opened: time.Now()}, nil
+}
+
+// RetrieveFileStream returns a reader over the file stored as repHash and
+// its representation. Blocks are fetched and de-randomized as the reader
+// is consumed, so memory use does not grow with the file size.
+func (rfs *RandomFS) RetrieveFileStream(repHash string) (io.ReadCloser, *FileRepresentation, error) {
+	stream, err := rfs.OpenFileStream(repHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	return stream, stream.Representation(), nil
+}
+
+// ErrInvalidRange is returned by RetrieveFileRange for a range that does
+// not overlap the file
+var ErrInvalidRange = errors.New("invalid byte range")
+
+// RetrieveFileRange returns a reader over bytes start to end, exclusive, of
+// the file stored as repHash. Only the blocks covering the range are
+// fetched. An end past the end of the file is clamped to the file size.
+func (rfs *RandomFS) RetrieveFileRange(repHash string, start, end int64) (io.ReadCloser, *FileRepresentation, error) {
+	if start < 0 || end < start {
+		return nil, nil, fmt.Errorf("%w: %d-%d", ErrInvalidRange, start, end)
+	}
+
+	stream, err := rfs.OpenFileStream(repHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	rep := stream.Representation()
+	if start > rep.FileSize || (start == rep.FileSize && end > start) {
+		return nil, nil, fmt.Errorf("%w: %d-%d of a %d byte file", ErrInvalidRange, start, end, rep.FileSize)
+	}
+	end = min(end, rep.FileSize)
+
+	if _, err := stream.Seek(start, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	return &rangeReader{Reader: io.LimitReader(stream, end-start), Closer: stream}, rep, nil
+}
+
+// rangeReader limits a FileStream to a byte range
+type rangeReader struct {
+	io.Reader
+	io.Closer
+}
+
+// Representation returns the representation of the streamed file
+func (fs *FileStream) Representation() *FileRepresentation {
+	return fs.rep
+}
+
+// Read implements io.Reader
+func (fs *FileStream) Read(p []byte) (n int, err error) {
+	defer func() { fs.noteFailure(err) }()
+	if fs.rep.compressed() {
+		return fs.readDecompressed(p)
+	}
+	n, err = fs.readStored(p, fs.pos)
+	fs.pos += int64(n)
+	return n, err
+}
+
+// noteFailure records err, other than the end of the file, as the
+// outcome of the retrieval if it is the first
+func (fs *FileStream) noteFailure(err error) {
+	if err != nil && err != io.EOF && fs.failure == nil {
+		fs.failure = err
+	}
+}
+
+// readDecompressed reads file bytes of a compressed file at the position
+func (fs *FileStream) readDecompressed(p []byte) (int, error) {
+	if fs.pos >= fs.rep.FileSize {
+		return 0, io.EOF
+	}
+	if fs.decoder == nil || fs.decoded > fs.pos {
+		if fs.decoder != nil {
+			fs.decoder.Close()
+		}
+		decoder, err := newDecompressor(fs.rep.Compression, &storedReader{fs: fs})
+		if err != nil {
+			fs.decoder = nil
+			return 0, fmt.Errorf("failed to decompress %s: %w", fs.rep.FileName, err)
+		}
+		fs.decoder, fs.decoded = decoder, 0
+	}
+	if skip := fs.pos - fs.decoded; skip > 0 {
+		n, err := io.CopyN(io.Discard, fs.decoder, skip)
+		fs.decoded += n
+		if err != nil {
+			return 0, fmt.Errorf("failed to decompress %s: %w", fs.rep.FileName, noEOF(err))
+		}
+	}
+
+	n, err := fs.decoder.Read(p[:min(int64(len(p)), fs.rep.FileSize-fs.pos)])
+	fs.decoded += int64(n)
+	fs.pos += int64(n)
+	if err == io.EOF && fs.pos < fs.rep.FileSize {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.EOF {
+		return n, fmt.Errorf("failed to decompress %s: %w", fs.rep.FileName, err)
+	}
+	return n, err
+}
+
+// noEOF turns the EOF of a stream that ended early into ErrUnexpectedEOF
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// storedReader reads the stored data of a compressed file from the start
+type storedReader struct {
+	fs  *FileStream
+	pos int64
+}
+
+func (r *storedReader) Read(p []byte) (int, error) {
+	n, err := r.fs.readStored(p, r.pos)
+	r.pos += int64(n)
+	return n, err
+}
+
+// readStored copies stored data at pos into p, fetching the block it falls
+// in unless that block is the one last fetched
+func (fs *FileStream) readStored(p []byte, pos int64) (int, error) {
+	if pos >= fs.rep.dataSize() {
+		return 0, io.EOF
+	}
+
+	index := int(pos / int64(fs.rep.BlockSize))
+	if index != fs.blockIndex {
+		fs.rfs.mutex.RLock()
+		block, err := fs.rfs.reconstructBlock(context.Background(), fs.rep, index)
+		fs.rfs.mutex.RUnlock()
+		if err != nil {
+			return 0, err
+		}
+		fs.block = block
+		fs.blockIndex = index
+	}
+
+	offset := int(pos - int64(index)*int64(fs.rep.BlockSize))
+	return copy(p, fs.block[offset:]), nil
+}
+
+// Seek implements io.Seeker
+func (fs *FileStream) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = fs.pos + offset
+	case io.SeekEnd:
+		pos = fs.rep.FileSize + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return 0, fmt.Errorf("negative position %d", pos)
+	}
+	fs.pos = pos
+	return pos, nil
+}
+
+// WriteTo implements io.WriterTo, writing the rest of the stream to w
+// through the configured output buffer
+func (fs *FileStream) WriteTo(w io.Writer) (int64, error) {
+	if fs.pos >= fs.rep.FileSize {
+		return 0, nil
+	}
+
+	out, flush := fs.rfs.bufferOutput(w)
+	counter := &countingWriter{w: out}
+
+	// Compressed data is decompressed in order, so blocks cannot be
+	// written out directly
+	if fs.rep.compressed() {
+		if _, err := io.Copy(counter, struct{ io.Reader }{fs}); err != nil {
+			return counter.n, err
+		}
+		if err := flush(); err != nil {
+			return counter.n, fmt.Errorf("failed to flush output: %v", err)
+		}
+		return counter.n, nil
+	}
+
+	// Finish the block the position falls in, then stream whole blocks
+	next := int(fs.pos / int64(fs.rep.BlockSize))
+	if fs.pos%int64(fs.rep.BlockSize) != 0 {
+		buf := make([]byte, fs.rep.BlockSize)
+		n, err := fs.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := counter.Write(buf[:n]); err != nil {
+			return counter.n, err
+		}
+		next++
+	}
+
+	fs.rfs.mutex.RLock()
+	err := fs.rfs.writeBlocks(context.Background(), fs.rep, next, counter)
+	fs.rfs.mutex.RUnlock()
+	fs.pos = fs.rep.FileSize
+	if err != nil {
+		fs.noteFailure(err)
+		return counter.n, err
+	}
+
+	if err := flush(); err != nil {
+		return counter.n, fmt.Errorf("failed to flush output: %v", err)
+	}
+	return counter.n, nil
+}
+
+// Close releases the stream
+func (fs *FileStream) Close() error {
+	if !fs.closed {
+		fs.closed = true
+		fs.rfs.observeOperation(OpRetrieve, fs.opened, fs.failure)
+	}
+	fs.block = nil
+	fs.blockIndex = -1
+	if fs.decoder != nil {
+		fs.decoder.Close()
+		fs.decoder = nil
+	}
+	return nil
+}
+
+// writeBlocks reconstructs the blocks of rep starting at block first and
+// writes them to w in order; callers hold the read lock. Up to
+// RetrieveWorkers blocks are fetched ahead of the one being written, and
+// the first failure cancels the fetches still running.
+func (rfs *RandomFS) writeBlocks(ctx context.Context, rep *FileRepresentation, first int, w io.Writer) error {
+	type fetched struct {
+		block []byte
+		err   error
+	}
+	workers := max(rfs.RetrieveWorkers, 1)
+	group, ctx := errgroup.WithContext(ctx)
+	ctx, cancel := context.WithCancel(ctx)
+	defer group.Wait()
+	defer cancel()
+
+	// pending holds the results of the blocks fetched ahead, in file order
+	var pending []chan fetched
+	next := first
+	for i := first; i < len(rep.BlockHashes); i++ {
+		for ; next < len(rep.BlockHashes) && next-i < workers; next++ {
+			result := make(chan fetched, 1)
+			pending = append(pending, result)
+			index := next
+			group.Go(func() error {
+				block, err := rfs.reconstructBlock(ctx, rep, index)
+				result <- fetched{block, err}
+				return err
+			})
+		}
+
+		result := <-pending[0]
+		pending = pending[1:]
+		if result.err != nil || ctx.Err() != nil {
+			// Report the failure that cancelled the other fetches
+			// rather than the cancellation it caused
+			if err := group.Wait(); err != nil {
+				return err
+			}
+			return ctx.Err()
+		}
+		if _, err := w.Write(result.block); err != nil {
+			return fmt.Errorf("failed to write block %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// reconstructBlock fetches block i of rep and its randomizers and returns
+// the original data, trimmed to the file size for the last block
+func (rfs *RandomFS) reconstructBlock(ctx context.Context, rep *FileRepresentation, i int) ([]byte, error) {
+	if data, ok, err := expandSparseBlock(rep, i); ok {
+		return data, err
+	}
+
+	block, err := rfs.retrieveBlockTraced(ctx, blockKindData, rep.BlockHashes[i], rep.BlockSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve block %d: %w", i, err)
+	}
+
+	var randomizers [][]byte
+	for _, ref := range randomizerRefs(rep, i) {
+		randomizer, err := rfs.retrieveBlockTraced(ctx, blockKindRandomizer, ref, rep.BlockSize)
+		if err != nil && len(rep.RandomizerSeeds) > 0 && ctx.Err() == nil {
+			if seeded, seedErr := rfs.regenerateRandomizer(rep, i, ref); seedErr == nil {
+				randomizer, err = seeded, nil
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve randomizer %d: %w", i, err)
+		}
+		randomizers = append(randomizers, randomizer)
+	}
+
+	return rfs.deRandomizeBlock(block, blockDataSize(rep, i), randomizers...), nil
+}
+
+// bufferOutput wraps w in a write buffer of OutputBufferSize bytes and
+// returns the writer to use and a function that flushes it
+func (rfs *RandomFS) bufferOutput(w io.Writer) (io.Writer, func() error) {
+	if rfs.OutputBufferSize <= 0 {
+		return w, func() error { return nil }
+	}
+	buffered := bufio.NewWriterSize(w, rfs.OutputBufferSize)
+	return buffered, buffered.Flush
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// blockFuncWriter passes the data written to it to fn in blocks of size
+// bytes. The first error from fn cancels the retrieval and fails every
+// later write.
+type blockFuncWriter struct {
+	fn     func(index int, data []byte) error
+	size   int
+	cancel context.CancelFunc
+
+	buf   []byte
+	index int
+	err   error
+}
+
+func (bw *blockFuncWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 && bw.err == nil {
+		// Whole blocks, as written by writeBlocks, go straight through
+		if len(bw.buf) == 0 && len(p) >= bw.size {
+			bw.call(p[:bw.size])
+			p = p[bw.size:]
+			continue
+		}
+		n := min(bw.size-len(bw.buf), len(p))
+		bw.buf = append(bw.buf, p[:n]...)
+		p = p[n:]
+		if len(bw.buf) == bw.size {
+			bw.call(bw.buf)
+			bw.buf = bw.buf[:0]
+		}
+	}
+	if bw.err != nil {
+		return 0, bw.err
+	}
+	return written, nil
+}
+
+// flush passes the last, short block to fn
+func (bw *blockFuncWriter) flush() error {
+	if len(bw.buf) > 0 && bw.err == nil {
+		bw.call(bw.buf)
+		bw.buf = bw.buf[:0]
+	}
+	return bw.err
+}
+
+// call passes one block to fn
+func (bw *blockFuncWriter) call(block []byte) {
+	if err := bw.fn(bw.index, block); err != nil {
+		bw.err = err
+		bw.cancel()
+		return
+	}
+	bw.index++
+}
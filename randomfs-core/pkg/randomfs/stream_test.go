@@ -0,0 +1,358 @@
+package randomfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/TheEntropyCollective/randomfs-core/internal/ipfstest"
+)
+
+// slowWriter simulates a destination where every write has a fixed cost
+type slowWriter struct {
+	buf    bytes.Buffer
+	writes int
+	delay  time.Duration
+}
+
+func (sw *slowWriter) Write(p []byte) (int, error) {
+	sw.writes++
+	time.Sleep(sw.delay)
+	return sw.buf.Write(p)
+}
+
+// storeRandomFile stores size random bytes and returns them with the hash
+func storeRandomFile(tb testing.TB, rfs *RandomFS, size int) ([]byte, string) {
+	tb.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		tb.Fatalf("rand: %v", err)
+	}
+	url, err := rfs.StoreFile("random.bin", data, "application/octet-stream")
+	if err != nil {
+		tb.Fatalf("StoreFile: %v", err)
+	}
+	return data, url.RepHash
+}
+
+func TestRetrieveFileToCoalescesWrites(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	data, repHash := storeRandomFile(t, rfs, 90*1024+17)
+
+	unbuffered := &slowWriter{}
+	rfs.OutputBufferSize = 0
+	if _, err := rfs.RetrieveFileTo(repHash, unbuffered); err != nil {
+		t.Fatalf("RetrieveFileTo: %v", err)
+	}
+	if !bytes.Equal(unbuffered.buf.Bytes(), data) {
+		t.Fatal("unbuffered output does not match stored data")
+	}
+	if unbuffered.writes != 91 {
+		t.Fatalf("expected one write per block, got %d", unbuffered.writes)
+	}
+
+	buffered := &slowWriter{}
+	rfs.OutputBufferSize = 32 * 1024
+	rep, err := rfs.RetrieveFileTo(repHash, buffered)
+	if err != nil {
+		t.Fatalf("RetrieveFileTo: %v", err)
+	}
+	if !bytes.Equal(buffered.buf.Bytes(), data) {
+		t.Fatal("buffered output does not match stored data")
+	}
+	if buffered.writes > 3 {
+		t.Fatalf("expected writes to be coalesced, got %d", buffered.writes)
+	}
+	if rep.FileSize != int64(len(data)) {
+		t.Fatalf("unexpected representation size %d", rep.FileSize)
+	}
+}
+
+func TestFileStreamReadAndWriteTo(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	data, repHash := storeRandomFile(t, rfs, 10*1024+5)
+
+	stream, err := rfs.OpenFileStream(repHash)
+	if err != nil {
+		t.Fatalf("OpenFileStream: %v", err)
+	}
+	head := make([]byte, 1500)
+	if _, err := io.ReadFull(stream, head); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+
+	out := &slowWriter{}
+	n, err := stream.WriteTo(out)
+	if err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if n != int64(len(data)-len(head)) {
+		t.Fatalf("WriteTo wrote %d bytes, expected %d", n, len(data)-len(head))
+	}
+	if got := append(head, out.buf.Bytes()...); !bytes.Equal(got, data) {
+		t.Fatal("streamed output does not match stored data")
+	}
+	if out.writes != 1 {
+		t.Fatalf("expected a single coalesced write, got %d", out.writes)
+	}
+	if _, err := stream.Read(head); err != io.EOF {
+		t.Fatalf("expected EOF after WriteTo, got %v", err)
+	}
+}
+
+func benchmarkRetrieveToSlowWriter(b *testing.B, bufferSize int) {
+	rfs, err := NewRandomFSWithoutIPFS(b.TempDir(), 64*1024*1024)
+	if err != nil {
+		b.Fatalf("NewRandomFSWithoutIPFS: %v", err)
+	}
+	rfs.OutputBufferSize = bufferSize
+	data, repHash := storeRandomFile(b, rfs, 100*1024)
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		out := &slowWriter{delay: 20 * time.Microsecond}
+		if _, err := rfs.RetrieveFileTo(repHash, out); err != nil {
+			b.Fatalf("RetrieveFileTo: %v", err)
+		}
+		if !bytes.Equal(out.buf.Bytes(), data) {
+			b.Fatal("output does not match stored data")
+		}
+	}
+}
+
+func BenchmarkRetrieveFileToSlowWriterUnbuffered(b *testing.B) {
+	benchmarkRetrieveToSlowWriter(b, 0)
+}
+
+func BenchmarkRetrieveFileToSlowWriterBuffered(b *testing.B) {
+	benchmarkRetrieveToSlowWriter(b, DefaultOutputBufferSize)
+}
+
+func TestFileStreamSeek(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	data, repHash := storeRandomFile(t, rfs, 5*1024+100)
+
+	stream, err := rfs.OpenFileStream(repHash)
+	if err != nil {
+		t.Fatalf("OpenFileStream: %v", err)
+	}
+	defer stream.Close()
+
+	size, err := stream.Seek(0, io.SeekEnd)
+	if err != nil || size != int64(len(data)) {
+		t.Fatalf("Seek end returned %d, %v", size, err)
+	}
+
+	for _, start := range []int64{0, 1023, 1024, 3000, int64(len(data)) - 1} {
+		if _, err := stream.Seek(start, io.SeekStart); err != nil {
+			t.Fatalf("Seek %d: %v", start, err)
+		}
+		got, err := io.ReadAll(io.LimitReader(stream, 2000))
+		if err != nil {
+			t.Fatalf("read at %d: %v", start, err)
+		}
+		end := start + 2000
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		if !bytes.Equal(got, data[start:end]) {
+			t.Fatalf("data at offset %d does not match", start)
+		}
+	}
+}
+
+// newIPFSBackedRandomFS returns an instance over a fake IPFS daemon, whose
+// cat counts show which blocks a retrieval fetched
+func newIPFSBackedRandomFS(t *testing.T) (*RandomFS, *ipfstest.Server) {
+	t.Helper()
+	ipfs := ipfstest.NewServer(t)
+	rfs, err := NewRandomFS(ipfs.APIURL(), t.TempDir(), 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFS: %v", err)
+	}
+	t.Cleanup(func() { rfs.Close() })
+	return rfs, ipfs
+}
+
+func TestRetrieveFileStreamIsLazy(t *testing.T) {
+	rfs, ipfs := newIPFSBackedRandomFS(t)
+	data, repHash := storeRandomFile(t, rfs, 20*1024+100)
+	rfs.Cache().Clear()
+
+	reader, rep, err := rfs.RetrieveFileStream(repHash)
+	if err != nil {
+		t.Fatalf("RetrieveFileStream: %v", err)
+	}
+	defer reader.Close()
+	if rep.FileSize != int64(len(data)) {
+		t.Fatalf("representation has size %d, want %d", rep.FileSize, len(data))
+	}
+
+	opened := ipfs.TotalCats()
+	first := make([]byte, 10)
+	if _, err := io.ReadFull(reader, first); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if fetched := ipfs.TotalCats() - opened; fetched > 2 {
+		t.Errorf("reading the first bytes fetched %d blocks", fetched)
+	}
+
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if !bytes.Equal(append(first, rest...), data) {
+		t.Fatal("streamed file differs")
+	}
+}
+
+func TestRetrieveFileRange(t *testing.T) {
+	rfs, ipfs := newIPFSBackedRandomFS(t)
+	data, repHash := storeRandomFile(t, rfs, 20*1024+100)
+	rep, err := rfs.loadRepresentation(repHash)
+	if err != nil {
+		t.Fatalf("loadRepresentation: %v", err)
+	}
+	bs, size := int64(rep.BlockSize), int64(len(data))
+
+	for _, r := range []struct {
+		name       string
+		start, end int64
+		blocks     int
+	}{
+		{"within a block", 10, 20, 1},
+		{"across a block boundary", bs - 10, bs + 10, 2},
+		{"across several blocks", bs - 1, 3*bs + 1, 4},
+		{"past the end", size - 50, size + 1000, 1},
+		{"whole file", 0, size, len(rep.BlockHashes)},
+		{"empty", 30, 30, 0},
+		{"empty at the end", size, size, 0},
+	} {
+		rfs.Cache().Clear()
+		reader, got, err := rfs.RetrieveFileRange(repHash, r.start, r.end)
+		if err != nil {
+			t.Fatalf("%s: RetrieveFileRange: %v", r.name, err)
+		}
+		if got.FileSize != size {
+			t.Errorf("%s: representation has size %d", r.name, got.FileSize)
+		}
+		opened := ipfs.TotalCats()
+		content, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatalf("%s: read: %v", r.name, err)
+		}
+		if want := data[r.start:min(r.end, size)]; !bytes.Equal(content, want) {
+			t.Errorf("%s: got %d bytes, want %d", r.name, len(content), len(want))
+		}
+		// Each block costs at most itself and its randomizer
+		if fetched := ipfs.TotalCats() - opened; fetched > 2*r.blocks {
+			t.Errorf("%s: fetched %d blocks for a range over %d", r.name, fetched, r.blocks)
+		}
+	}
+
+	for _, r := range [][2]int64{{-1, 10}, {20, 10}, {size, size + 1}, {size + 1, size + 10}} {
+		if _, _, err := rfs.RetrieveFileRange(repHash, r[0], r[1]); !errors.Is(err, ErrInvalidRange) {
+			t.Errorf("range %d-%d returned %v, want ErrInvalidRange", r[0], r[1], err)
+		}
+	}
+}
+
+func TestGetRepresentationFetchesNoBlocks(t *testing.T) {
+	rfs, ipfs := newIPFSBackedRandomFS(t)
+	data, repHash := storeRandomFile(t, rfs, 20*1024+100)
+	rfs.Cache().Clear()
+
+	before := ipfs.TotalCats()
+	rep, err := rfs.GetRepresentation(repHash)
+	if err != nil {
+		t.Fatalf("GetRepresentation: %v", err)
+	}
+	if rep.FileSize != int64(len(data)) || rep.FileName != "random.bin" {
+		t.Errorf("representation of %q, %d bytes", rep.FileName, rep.FileSize)
+	}
+	if fetched := ipfs.TotalCats() - before; fetched > 1 {
+		t.Errorf("fetched %d objects for the representation alone", fetched)
+	}
+}
+
+// collectBlocks retrieves repHash with RetrieveFileFunc, checking the
+// blocks arrive in order and are full but for the last
+func collectBlocks(t *testing.T, rfs *RandomFS, repHash string) []byte {
+	t.Helper()
+	var got bytes.Buffer
+	var short bool
+	rep, err := rfs.RetrieveFileFunc(repHash, func(index int, data []byte) error {
+		if short {
+			t.Fatalf("block %d follows a short block", index)
+		}
+		if index != got.Len()/NanoBlockSize || got.Len()%NanoBlockSize != 0 {
+			t.Fatalf("block %d passed after %d bytes", index, got.Len())
+		}
+		short = len(data) < NanoBlockSize
+		got.Write(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("RetrieveFileFunc: %v", err)
+	}
+	if rep.BlockSize != NanoBlockSize {
+		t.Fatalf("file stored in %d byte blocks", rep.BlockSize)
+	}
+	return got.Bytes()
+}
+
+func TestRetrieveFileFuncPassesBlocksInOrder(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	rfs.RetrieveWorkers = 8
+	data, repHash := storeRandomFile(t, rfs, 20*NanoBlockSize+100)
+	rfs.cache.Clear()
+	if got := collectBlocks(t, rfs, repHash); !bytes.Equal(got, data) {
+		t.Fatalf("blocks hold %d bytes that differ from the file", len(got))
+	}
+
+	// Compressed files pass their decompressed data in blocks of the same
+	// size
+	rfs.Compression = CompressionGzip
+	text := logLines(10 * NanoBlockSize)
+	url, err := rfs.StoreFile("log.txt", text, "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	if got := collectBlocks(t, rfs, url.RepHash); !bytes.Equal(got, text) {
+		t.Fatalf("blocks hold %d bytes that differ from the compressed file", len(got))
+	}
+}
+
+func TestRetrieveFileFuncStopsOnError(t *testing.T) {
+	ipfs := ipfstest.NewServer(t)
+	rfs, err := NewRandomFS(ipfs.APIURL(), t.TempDir(), 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFS: %v", err)
+	}
+	defer rfs.Close()
+	rfs.RetrieveWorkers = 2
+	_, repHash := storeRandomFile(t, rfs, 50*NanoBlockSize)
+	rfs.cache.Clear()
+
+	stop := errors.New("stop")
+	calls := 0
+	cats := ipfs.TotalCats()
+	_, err = rfs.RetrieveFileFunc(repHash, func(index int, data []byte) error {
+		calls++
+		if index == 1 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || calls != 2 {
+		t.Fatalf("RetrieveFileFunc returned %v after %d calls, want the error of fn after 2", err, calls)
+	}
+	if fetched := ipfs.TotalCats() - cats; fetched > 20 {
+		t.Errorf("fetched %d blocks for a retrieval stopped at the second block", fetched)
+	}
+}
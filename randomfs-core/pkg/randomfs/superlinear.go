@@ -0,0 +1,267 @@
+package randomfs
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math"
+	mrand "math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// candidatePoolSize bounds the number of randomizer blocks the growth
+// manager tracks
+const candidatePoolSize = 4096
+
+// popularityFileName is the file in the data directory holding the state
+// of the superlinear growth manager
+const popularityFileName = "popularity.json"
+
+// SuperlinearGrowthManager biases randomizer selection towards popular blocks
+// so that block reuse grows faster than the number of participants. A
+// block's popularity is the number of times the manager selected it plus
+// the number of indexed files referencing it, and the selection counts are
+// persisted in the data directory by Save, so popular blocks stay popular
+// across sessions.
+type SuperlinearGrowthManager struct {
+	rfs        *RandomFS
+	path       string
+	blocks     map[string]*trackedBlock
+	selections int64
+	reused     int64
+	mutex      sync.Mutex
+}
+
+// trackedBlock is a randomizer block the growth manager has selected
+type trackedBlock struct {
+	Hash string `json:"hash"`
+	Size int    `json:"size"`
+	Uses int64  `json:"uses"`
+}
+
+// growthState is the persisted form of a SuperlinearGrowthManager
+type growthState struct {
+	Selections int64           `json:"selections"`
+	Reused     int64           `json:"reused"`
+	Blocks     []*trackedBlock `json:"blocks"`
+}
+
+// NewSuperlinearGrowthManager creates a growth manager for a RandomFS
+// instance, resuming the popularity counts saved in its data directory.
+// Unreadable saved state is logged and the manager starts afresh.
+func NewSuperlinearGrowthManager(rfs *RandomFS) *SuperlinearGrowthManager {
+	sgm := &SuperlinearGrowthManager{
+		rfs:    rfs,
+		path:   filepath.Join(rfs.dataDir, popularityFileName),
+		blocks: make(map[string]*trackedBlock),
+	}
+	if err := sgm.load(); err != nil {
+		rfs.log().Warn("Starting with no block popularity", "error", err)
+	}
+	return sgm
+}
+
+// load reads the saved state, if any
+func (sgm *SuperlinearGrowthManager) load() error {
+	data, err := os.ReadFile(sgm.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read block popularity: %v", err)
+	}
+
+	var state growthState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to parse block popularity: %v", err)
+	}
+	sgm.selections = state.Selections
+	sgm.reused = state.Reused
+	for _, block := range state.Blocks {
+		if block != nil && block.Hash != "" && block.Size > 0 {
+			sgm.blocks[block.Hash] = block
+		}
+	}
+	return nil
+}
+
+// Save persists the popularity counts to the data directory, so a manager
+// created later for the same directory continues from them
+func (sgm *SuperlinearGrowthManager) Save() error {
+	if sgm.rfs.readOnly {
+		return ErrReadOnly
+	}
+
+	sgm.mutex.Lock()
+	defer sgm.mutex.Unlock()
+
+	state := growthState{Selections: sgm.selections, Reused: sgm.reused}
+	for _, block := range sgm.blocks {
+		state.Blocks = append(state.Blocks, block)
+	}
+	sort.Slice(state.Blocks, func(i, j int) bool { return state.Blocks[i].Hash < state.Blocks[j].Hash })
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal block popularity: %v", err)
+	}
+	tmp := sgm.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write block popularity: %v", err)
+	}
+	if err := os.Rename(tmp, sgm.path); err != nil {
+		return fmt.Errorf("failed to write block popularity: %v", err)
+	}
+	return nil
+}
+
+// EnhancedSelectRandomizerBlocks selects count distinct randomizer blocks of
+// blockSize. Stored blocks are reused most popular first, with a probability
+// that grows with the number of candidates, and the rest are fresh random
+// blocks stored so later selections can reuse them. It returns the blocks
+// and how many of them were reused; the others were freshly generated.
+func (sgm *SuperlinearGrowthManager) EnhancedSelectRandomizerBlocks(count, blockSize int) ([][]byte, int, error) {
+	if count <= 0 {
+		return nil, 0, fmt.Errorf("count must be positive")
+	}
+	if sgm.rfs.readOnly {
+		return nil, 0, ErrReadOnly
+	}
+
+	sgm.mutex.Lock()
+	defer sgm.mutex.Unlock()
+
+	popular := sgm.popularCandidates(blockSize)
+	// Rich get richer: reuse becomes more likely as the pool grows
+	reuseProbability := 1.0 - 1.0/math.Log2(float64(len(popular))+2)
+
+	blocks := make([][]byte, 0, count)
+	reused := 0
+	for len(blocks) < count {
+		if len(popular) > 0 && mrand.Float64() < reuseProbability {
+			hash := popular[0]
+			popular = popular[1:]
+			data, err := sgm.rfs.retrieveBlock(hash, blockSize)
+			if err != nil {
+				// The block is gone from the backend; stop offering it
+				delete(sgm.blocks, hash)
+				continue
+			}
+			sgm.track(hash, blockSize).Uses++
+			blocks = append(blocks, data)
+			reused++
+			continue
+		}
+
+		block := make([]byte, blockSize)
+		if _, err := rand.Read(block); err != nil {
+			return nil, reused, fmt.Errorf("failed to generate randomizer: %v", err)
+		}
+		hash, err := sgm.rfs.storeBlock(block)
+		if err != nil {
+			return nil, reused, fmt.Errorf("failed to store randomizer: %v", err)
+		}
+		sgm.track(hash, blockSize).Uses++
+		blocks = append(blocks, block)
+	}
+
+	sgm.selections += int64(count)
+	sgm.reused += int64(reused)
+
+	return blocks, reused, nil
+}
+
+// track returns the tracked block for hash, tracking it if needed and
+// evicting the least popular block when over candidatePoolSize; callers
+// hold the lock
+func (sgm *SuperlinearGrowthManager) track(hash string, blockSize int) *trackedBlock {
+	if block, exists := sgm.blocks[hash]; exists {
+		return block
+	}
+	if len(sgm.blocks) >= candidatePoolSize {
+		victim := ""
+		for candidate, block := range sgm.blocks {
+			if victim == "" || block.Uses < sgm.blocks[victim].Uses {
+				victim = candidate
+			}
+		}
+		delete(sgm.blocks, victim)
+	}
+	block := &trackedBlock{Hash: hash, Size: blockSize}
+	sgm.blocks[hash] = block
+	return block
+}
+
+// popularity returns the selections of hash plus the indexed files
+// referencing it; callers hold the lock
+func (sgm *SuperlinearGrowthManager) popularity(hash string) int64 {
+	popularity := int64(sgm.rfs.BlockRefCount(hash))
+	if block, exists := sgm.blocks[hash]; exists {
+		popularity += block.Uses
+	}
+	return popularity
+}
+
+// GetSuperlinearMetrics reports the reuse accumulated across sessions. The
+// efficiency multiplier is the number of randomizer selections served per
+// block generated, so 1 means nothing was reused.
+func (sgm *SuperlinearGrowthManager) GetSuperlinearMetrics() map[string]interface{} {
+	sgm.mutex.Lock()
+	defer sgm.mutex.Unlock()
+
+	reuseRate := 0.0
+	if sgm.selections > 0 {
+		reuseRate = float64(sgm.reused) / float64(sgm.selections)
+	}
+	fresh := sgm.selections - sgm.reused
+	multiplier := 1.0
+	if fresh > 0 {
+		multiplier = float64(sgm.selections) / float64(fresh)
+	}
+
+	return map[string]interface{}{
+		"tracked_blocks":        len(sgm.blocks),
+		"total_selections":      sgm.selections,
+		"reused_selections":     sgm.reused,
+		"fresh_selections":      fresh,
+		"reuse_rate":            reuseRate,
+		"efficiency_multiplier": multiplier,
+	}
+}
+
+// popularCandidates returns the stored blocks of blockSize that may serve
+// as randomizers, most popular first: blocks the manager has selected,
+// blocks in the block cache and blocks of indexed files. Every stored block
+// is randomized data, so any of them may serve. Callers hold the lock.
+func (sgm *SuperlinearGrowthManager) popularCandidates(blockSize int) []string {
+	hashes := sgm.rfs.cache.hashesOfSize(blockSize)
+	for hash, block := range sgm.blocks {
+		if block.Size == blockSize {
+			hashes = append(hashes, hash)
+		}
+	}
+	for _, entry := range sgm.rfs.index.list() {
+		if !entry.Deleted() && entry.blockSize() == blockSize {
+			hashes = append(hashes, entry.Blocks...)
+		}
+	}
+	hashes = uniqueHashes(hashes)
+
+	popularity := make(map[string]int64, len(hashes))
+	for _, hash := range hashes {
+		popularity[hash] = sgm.popularity(hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		if popularity[hashes[i]] != popularity[hashes[j]] {
+			return popularity[hashes[i]] > popularity[hashes[j]]
+		}
+		return hashes[i] < hashes[j]
+	})
+	if len(hashes) > candidatePoolSize {
+		hashes = hashes[:candidatePoolSize]
+	}
+	return hashes
+}
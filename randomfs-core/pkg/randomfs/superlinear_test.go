@@ -0,0 +1,124 @@
+package randomfs
+
+import (
+	"bytes"
+	"testing"
+)
+
+// selectRandomizers runs count selections of one block of blockSize and
+// returns how many were reused
+func selectRandomizers(t *testing.T, sgm *SuperlinearGrowthManager, calls, count, blockSize int) int {
+	t.Helper()
+	reused := 0
+	for i := 0; i < calls; i++ {
+		blocks, n, err := sgm.EnhancedSelectRandomizerBlocks(count, blockSize)
+		if err != nil {
+			t.Fatalf("EnhancedSelectRandomizerBlocks: %v", err)
+		}
+		if len(blocks) != count {
+			t.Fatalf("selected %d blocks, want %d", len(blocks), count)
+		}
+		for j, block := range blocks {
+			for _, other := range blocks[:j] {
+				if bytes.Equal(block, other) {
+					t.Fatal("one selection returned the same randomizer twice")
+				}
+			}
+		}
+		reused += n
+	}
+	return reused
+}
+
+func TestSuperlinearPopularityPersistsAcrossSessions(t *testing.T) {
+	dataDir := t.TempDir()
+	rfs, err := NewRandomFSWithoutIPFS(dataDir, 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFSWithoutIPFS: %v", err)
+	}
+	sgm := NewSuperlinearGrowthManager(rfs)
+	reused := selectRandomizers(t, sgm, 50, 4, NanoBlockSize)
+	if reused == 0 {
+		t.Fatal("no randomizer was reused in 200 selections")
+	}
+	before := sgm.GetSuperlinearMetrics()
+	fresh := before["fresh_selections"].(int64)
+	if before["reused_selections"].(int64) != int64(reused) || fresh != 200-int64(reused) {
+		t.Fatalf("metrics %v disagree with %d reused selections", before, reused)
+	}
+	if want := 200 / float64(fresh); before["efficiency_multiplier"].(float64) != want {
+		t.Errorf("efficiency multiplier %v, want %v selections per generated block", before["efficiency_multiplier"], want)
+	}
+	if err := sgm.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	rfs.Close()
+
+	// The restarted instance has an empty block cache, so it can only
+	// reuse blocks through the saved popularity
+	rfs, err = NewRandomFSWithoutIPFS(dataDir, 16*1024*1024)
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	defer rfs.Close()
+	sgm = NewSuperlinearGrowthManager(rfs)
+	after := sgm.GetSuperlinearMetrics()
+	for _, key := range []string{"tracked_blocks", "total_selections", "reused_selections"} {
+		if after[key] != before[key] {
+			t.Errorf("%s is %v after the restart, was %v", key, after[key], before[key])
+		}
+	}
+	if candidates := sgm.popularCandidates(NanoBlockSize); len(candidates) != int(fresh) {
+		t.Errorf("%d candidates after the restart, want the %d generated blocks", len(candidates), fresh)
+	}
+	if selectRandomizers(t, sgm, 20, 4, NanoBlockSize) == 0 {
+		t.Error("no saved block was reused after the restart")
+	}
+}
+
+func TestSuperlinearPrefersPopularBlocks(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	defer rfs.Close()
+	sgm := NewSuperlinearGrowthManager(rfs)
+	selectRandomizers(t, sgm, 10, 4, NanoBlockSize)
+
+	// Blocks of stored files are candidates, popular by their references
+	_, repHash := storeRandomFile(t, rfs, NanoBlockSize)
+	rep, err := rfs.GetRepresentation(repHash)
+	if err != nil {
+		t.Fatalf("GetRepresentation: %v", err)
+	}
+	stored := rep.BlockHashes[0]
+	sgm.mutex.Lock()
+	popularity := sgm.popularity(stored)
+	sgm.mutex.Unlock()
+	if popularity != 1 {
+		t.Fatalf("block of one stored file has popularity %d", popularity)
+	}
+
+	// Selections make a block the favourite
+	candidates := sgm.popularCandidates(NanoBlockSize)
+	favourite := candidates[len(candidates)-1]
+	sgm.track(favourite, NanoBlockSize).Uses = 1000
+	if sgm.popularCandidates(NanoBlockSize)[0] != favourite {
+		t.Fatal("most selected block is not the most popular candidate")
+	}
+	want, err := rfs.retrieveBlock(favourite, NanoBlockSize)
+	if err != nil {
+		t.Fatalf("retrieveBlock: %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		blocks, reused, err := sgm.EnhancedSelectRandomizerBlocks(1, NanoBlockSize)
+		if err != nil {
+			t.Fatalf("EnhancedSelectRandomizerBlocks: %v", err)
+		}
+		if reused == 1 {
+			if !bytes.Equal(blocks[0], want) {
+				t.Fatal("reused a block other than the most popular one")
+			}
+			return
+		}
+	}
+	t.Fatal("no block was reused in 100 selections")
+}
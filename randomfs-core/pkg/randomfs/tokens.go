@@ -0,0 +1,221 @@
+package randomfs
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Files in the data directory backing capability tokens
+const (
+	tokenKeyFileName      = "token.key"
+	revokedTokensFileName = "revoked_tokens.json"
+)
+
+// Permission is a set of operations a capability token grants
+type Permission uint32
+
+// Permissions that can be granted by a capability token
+const (
+	PermissionRead Permission = 1 << iota
+	PermissionDelete
+)
+
+// Errors returned when a capability token does not authorize a request
+var (
+	ErrTokenInvalid   = errors.New("invalid capability token")
+	ErrTokenExpired   = errors.New("capability token expired")
+	ErrTokenRevoked   = errors.New("capability token revoked")
+	ErrTokenForbidden = errors.New("capability token does not grant access")
+)
+
+// CapabilityToken is the signed payload of a capability token
+type CapabilityToken struct {
+	ID          string     `json:"id"`
+	RepHash     string     `json:"rep"`
+	Permissions Permission `json:"perm"`
+	ExpiresAt   int64      `json:"exp"`
+}
+
+// tokenAuthority signs tokens and tracks revocations for a data directory
+type tokenAuthority struct {
+	key         []byte
+	revokedPath string
+	revoked     map[string]bool
+	mutex       sync.RWMutex
+}
+
+// loadTokenAuthority loads the signing key and revocation list from
+// dataDir, generating a key on first use. A read-only instance without a
+// key uses an ephemeral one, so no stored token verifies.
+func loadTokenAuthority(dataDir string, readOnly bool) (*tokenAuthority, error) {
+	keyPath := filepath.Join(dataDir, tokenKeyFileName)
+	key, err := os.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate token key: %v", err)
+		}
+		if !readOnly {
+			if err := os.WriteFile(keyPath, key, 0600); err != nil {
+				return nil, fmt.Errorf("failed to write token key: %v", err)
+			}
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read token key: %v", err)
+	}
+
+	ta := &tokenAuthority{
+		key:         key,
+		revokedPath: filepath.Join(dataDir, revokedTokensFileName),
+		revoked:     make(map[string]bool),
+	}
+
+	data, err := os.ReadFile(ta.revokedPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read revoked tokens: %v", err)
+	}
+	if err == nil {
+		var ids []string
+		if err := json.Unmarshal(data, &ids); err != nil {
+			return nil, fmt.Errorf("failed to parse revoked tokens: %v", err)
+		}
+		for _, id := range ids {
+			ta.revoked[id] = true
+		}
+	}
+	return ta, nil
+}
+
+// sign returns the HMAC of payload
+func (ta *tokenAuthority) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, ta.key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// IssueToken returns an opaque signed token granting permissions on
+// repHash until expiresAt. A zero expiresAt issues a token that never expires.
+func (rfs *RandomFS) IssueToken(repHash string, permissions Permission, expiresAt time.Time) (string, error) {
+	if repHash == "" {
+		return "", fmt.Errorf("representation hash is required")
+	}
+	if permissions == 0 {
+		return "", fmt.Errorf("at least one permission is required")
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to generate token id: %v", err)
+	}
+
+	claims := CapabilityToken{
+		ID:          hex.EncodeToString(id),
+		RepHash:     repHash,
+		Permissions: permissions,
+	}
+	if !expiresAt.IsZero() {
+		claims.ExpiresAt = expiresAt.Unix()
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal token: %v", err)
+	}
+
+	encoding := base64.RawURLEncoding
+	return encoding.EncodeToString(payload) + "." + encoding.EncodeToString(rfs.tokens.sign(payload)), nil
+}
+
+// VerifyToken checks that token is authentic, unexpired, unrevoked and
+// grants the required permissions on repHash
+func (rfs *RandomFS) VerifyToken(token, repHash string, required Permission) (*CapabilityToken, error) {
+	claims, err := rfs.parseToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.ExpiresAt != 0 && time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrTokenExpired
+	}
+
+	rfs.tokens.mutex.RLock()
+	revoked := rfs.tokens.revoked[claims.ID]
+	rfs.tokens.mutex.RUnlock()
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+
+	if claims.RepHash != repHash || claims.Permissions&required != required {
+		return nil, ErrTokenForbidden
+	}
+	return claims, nil
+}
+
+// RevokeToken adds token to the persistent revocation list
+func (rfs *RandomFS) RevokeToken(token string) error {
+	if rfs.readOnly {
+		return ErrReadOnly
+	}
+
+	claims, err := rfs.parseToken(token)
+	if err != nil {
+		return err
+	}
+
+	ta := rfs.tokens
+	ta.mutex.Lock()
+	defer ta.mutex.Unlock()
+
+	ta.revoked[claims.ID] = true
+
+	ids := make([]string, 0, len(ta.revoked))
+	for id := range ta.revoked {
+		ids = append(ids, id)
+	}
+	data, err := json.Marshal(ids)
+	if err != nil {
+		return fmt.Errorf("failed to marshal revoked tokens: %v", err)
+	}
+	if err := os.WriteFile(ta.revokedPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write revoked tokens: %v", err)
+	}
+	return nil
+}
+
+// parseToken checks the signature of token and decodes its claims
+func (rfs *RandomFS) parseToken(token string) (*CapabilityToken, error) {
+	encodedPayload, encodedSig, found := strings.Cut(token, ".")
+	if !found {
+		return nil, ErrTokenInvalid
+	}
+
+	encoding := base64.RawURLEncoding
+	payload, err := encoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	sig, err := encoding.DecodeString(encodedSig)
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	if !hmac.Equal(sig, rfs.tokens.sign(payload)) {
+		return nil, ErrTokenInvalid
+	}
+
+	var claims CapabilityToken
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrTokenInvalid
+	}
+	return &claims, nil
+}
@@ -0,0 +1,56 @@
+package randomfs
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCapabilityTokens(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	url, err := rfs.StoreFile("shared.txt", []byte("shared"), "text/plain")
+	if err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+
+	token, err := rfs.IssueToken(url.RepHash, PermissionRead, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("IssueToken: %v", err)
+	}
+	if _, err := rfs.VerifyToken(token, url.RepHash, PermissionRead); err != nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+	if _, err := rfs.VerifyToken(token, url.RepHash, PermissionDelete); !errors.Is(err, ErrTokenForbidden) {
+		t.Fatalf("expected ErrTokenForbidden for missing permission, got %v", err)
+	}
+	if _, err := rfs.VerifyToken(token, "other", PermissionRead); !errors.Is(err, ErrTokenForbidden) {
+		t.Fatalf("expected ErrTokenForbidden for another file, got %v", err)
+	}
+	if _, err := rfs.VerifyToken(token+"x", url.RepHash, PermissionRead); !errors.Is(err, ErrTokenInvalid) {
+		t.Fatalf("expected ErrTokenInvalid for a tampered token, got %v", err)
+	}
+
+	expired, err := rfs.IssueToken(url.RepHash, PermissionRead, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatalf("IssueToken: %v", err)
+	}
+	if _, err := rfs.VerifyToken(expired, url.RepHash, PermissionRead); !errors.Is(err, ErrTokenExpired) {
+		t.Fatalf("expected ErrTokenExpired, got %v", err)
+	}
+
+	if err := rfs.RevokeToken(token); err != nil {
+		t.Fatalf("RevokeToken: %v", err)
+	}
+	if _, err := rfs.VerifyToken(token, url.RepHash, PermissionRead); !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("expected ErrTokenRevoked, got %v", err)
+	}
+
+	rfs.Close()
+	reopened, err := NewRandomFSWithoutIPFS(rfs.dataDir, 1024)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if _, err := reopened.VerifyToken(token, url.RepHash, PermissionRead); !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("revocation not persisted, got %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package randomfs
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracerName is the instrumentation scope of the spans RandomFS emits
+const tracerName = "github.com/TheEntropyCollective/randomfs-core/pkg/randomfs"
+
+// Block kinds recorded on block spans
+const (
+	blockKindData       = "data"
+	blockKindRandomizer = "randomizer"
+)
+
+// tracer returns the tracer of the configured TracerProvider, or a no-op
+// tracer if none is set
+func (rfs *RandomFS) tracer() trace.Tracer {
+	provider := rfs.TracerProvider
+	if provider == nil {
+		provider = noop.NewTracerProvider()
+	}
+	return provider.Tracer(tracerName)
+}
+
+// startSpan starts a span named name as a child of any span in ctx
+func (rfs *RandomFS) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return rfs.tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err, if any, on span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// storeBlockTraced stores a block like storeBlockDigest inside a child span
+func (rfs *RandomFS) storeBlockTraced(ctx context.Context, kind string, block []byte, digest string) (string, error) {
+	_, span := rfs.startSpan(ctx, "randomfs.storeBlock",
+		attribute.String("randomfs.block.kind", kind),
+		attribute.Int("randomfs.block.bytes", len(block)))
+	hash, err := rfs.storeBlockDigest(ctx, block, digest)
+	span.SetAttributes(attribute.String("randomfs.block.hash", hash))
+	endSpan(span, err)
+	return hash, err
+}
+
+// retrieveBlockTraced fetches a block like retrieveBlock inside a child span
+func (rfs *RandomFS) retrieveBlockTraced(ctx context.Context, kind, hash string, size int) ([]byte, error) {
+	_, span := rfs.startSpan(ctx, "randomfs.fetchBlock",
+		attribute.String("randomfs.block.kind", kind),
+		attribute.String("randomfs.block.hash", hash))
+	data, err := rfs.retrieveBlockContext(ctx, hash, size)
+	span.SetAttributes(attribute.Int("randomfs.block.bytes", len(data)))
+	endSpan(span, err)
+	return data, err
+}
+
+// loadRepresentationTraced loads a representation like loadRepresentation
+// inside a child span
+func (rfs *RandomFS) loadRepresentationTraced(ctx context.Context, repHash string) (*FileRepresentation, error) {
+	_, span := rfs.startSpan(ctx, "randomfs.fetchRepresentation",
+		attribute.String("randomfs.rep_hash", repHash))
+	rep, err := rfs.loadRepresentationContext(ctx, repHash)
+	if err == nil {
+		span.SetAttributes(attribute.Int("randomfs.block.count", len(rep.BlockHashes)))
+	}
+	endSpan(span, err)
+	return rep, err
+}
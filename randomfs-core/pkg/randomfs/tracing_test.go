@@ -0,0 +1,139 @@
+package randomfs
+
+import (
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// newTracedRandomFS returns a local instance exporting its spans to an
+// in-memory exporter
+func newTracedRandomFS(t *testing.T) (*RandomFS, *tracetest.InMemoryExporter) {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	rfs := newTestRandomFS(t)
+	rfs.TracerProvider = sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	return rfs, exporter
+}
+
+// spanTree indexes exported spans by name and counts the children of each
+// parent span by name
+type spanTree struct {
+	byName   map[string][]tracetest.SpanStub
+	children map[string]map[string]int
+}
+
+func newSpanTree(spans tracetest.SpanStubs) *spanTree {
+	tree := &spanTree{byName: map[string][]tracetest.SpanStub{}, children: map[string]map[string]int{}}
+	for _, span := range spans {
+		tree.byName[span.Name] = append(tree.byName[span.Name], span)
+		parent := span.Parent.SpanID().String()
+		if tree.children[parent] == nil {
+			tree.children[parent] = map[string]int{}
+		}
+		tree.children[parent][span.Name]++
+	}
+	return tree
+}
+
+// root returns the only span named name, which must have no parent
+func (tree *spanTree) root(t *testing.T, name string) tracetest.SpanStub {
+	t.Helper()
+	spans := tree.byName[name]
+	if len(spans) != 1 {
+		t.Fatalf("expected one %s span, got %d", name, len(spans))
+	}
+	if spans[0].Parent.IsValid() {
+		t.Fatalf("%s span has a parent", name)
+	}
+	return spans[0]
+}
+
+func spanAttribute(span tracetest.SpanStub, key string) (int64, bool) {
+	for _, attr := range span.Attributes {
+		if string(attr.Key) == key {
+			return attr.Value.AsInt64(), true
+		}
+	}
+	return 0, false
+}
+
+func TestStoreFileSpanHierarchy(t *testing.T) {
+	rfs, exporter := newTracedRandomFS(t)
+	storeRandomFile(t, rfs, 3*NanoBlockSize)
+
+	tree := newSpanTree(exporter.GetSpans())
+	root := tree.root(t, "randomfs.StoreFile")
+
+	children := tree.children[root.SpanContext.SpanID().String()]
+	want := map[string]int{
+		"randomfs.chunk":               1,
+		"randomfs.storeBlock":          6, // three blocks and three randomizers
+		"randomfs.storeRepresentation": 1,
+	}
+	for name, count := range want {
+		if children[name] != count {
+			t.Errorf("expected %d %s children, got %d", count, name, children[name])
+		}
+	}
+	if len(children) != len(want) {
+		t.Errorf("unexpected children %v", children)
+	}
+
+	if size, _ := spanAttribute(root, "randomfs.file.size"); size != 3*NanoBlockSize {
+		t.Errorf("expected file size attribute %d, got %d", 3*NanoBlockSize, size)
+	}
+	if count, _ := spanAttribute(tree.byName["randomfs.chunk"][0], "randomfs.block.count"); count != 3 {
+		t.Errorf("expected block count attribute 3, got %d", count)
+	}
+	for _, span := range tree.byName["randomfs.storeBlock"] {
+		if bytes, _ := spanAttribute(span, "randomfs.block.bytes"); bytes != NanoBlockSize {
+			t.Errorf("expected block bytes attribute %d, got %d", NanoBlockSize, bytes)
+		}
+	}
+}
+
+func TestRetrieveFileSpanHierarchy(t *testing.T) {
+	rfs, exporter := newTracedRandomFS(t)
+	_, repHash := storeRandomFile(t, rfs, 2*NanoBlockSize)
+	exporter.Reset()
+
+	if _, _, err := rfs.RetrieveFile(repHash); err != nil {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+
+	tree := newSpanTree(exporter.GetSpans())
+	root := tree.root(t, "randomfs.RetrieveFile")
+	children := tree.children[root.SpanContext.SpanID().String()]
+	if children["randomfs.fetchRepresentation"] != 1 || children["randomfs.fetchBlock"] != 4 {
+		t.Fatalf("unexpected children %v", children)
+	}
+	if count, _ := spanAttribute(root, "randomfs.block.count"); count != 2 {
+		t.Errorf("expected block count attribute 2, got %d", count)
+	}
+}
+
+func TestFailedRetrieveRecordsError(t *testing.T) {
+	rfs, exporter := newTracedRandomFS(t)
+	if _, _, err := rfs.RetrieveFile("0000000000000000000000000000000000000000000000000000000000000000"); err == nil {
+		t.Fatal("expected retrieval of a missing file to fail")
+	}
+
+	tree := newSpanTree(exporter.GetSpans())
+	root := tree.root(t, "randomfs.RetrieveFile")
+	if root.Status.Code.String() != "Error" || len(root.Events) == 0 {
+		t.Fatalf("expected an error status and event, got %v with %d events", root.Status, len(root.Events))
+	}
+}
+
+func TestTracingDisabledByDefault(t *testing.T) {
+	rfs := newTestRandomFS(t)
+	if rfs.TracerProvider != nil {
+		t.Fatal("expected no tracer provider by default")
+	}
+	data, repHash := storeRandomFile(t, rfs, NanoBlockSize)
+	if got, _, err := rfs.RetrieveFile(repHash); err != nil || len(got) != len(data) {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package randomfs
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ErrInvalidURL is returned by ParseRandomURL for a malformed rd:// URL
+var ErrInvalidURL = errors.New("invalid rd:// URL")
+
+// RandomURL is a parsed rd:// URL pointing at a stored file
+type RandomURL struct {
+	Scheme    string
+	Host      string
+	Version   string
+	FileName  string
+	FileSize  int64
+	Timestamp int64
+	RepHash   string
+	// Encrypted is set when the representation is encrypted, so retrieving
+	// the file needs the RepresentationKey it was stored with
+	Encrypted bool
+	// Deduplicated is set by a store that found the content already stored
+	// and wrote no blocks. It is not part of the URL.
+	Deduplicated bool
+}
+
+// encryptedURLSuffix ends the URL of a file with an encrypted
+// representation
+const encryptedURLSuffix = "encrypted"
+
+// String formats the URL as rd://host/version/size/filename/timestamp/hash,
+// followed by /encrypted for an encrypted representation. The filename is
+// percent-encoded, so names with slashes, spaces or other reserved
+// characters survive ParseRandomURL.
+func (ru *RandomURL) String() string {
+	s := fmt.Sprintf("%s://%s/%s/%d/%s/%d/%s",
+		ru.Scheme, ru.Host, ru.Version, ru.FileSize, url.PathEscape(ru.FileName), ru.Timestamp, ru.RepHash)
+	if ru.Encrypted {
+		s += "/" + encryptedURLSuffix
+	}
+	return s
+}
+
+// ParseRandomURL parses an rd:// URL of the form String produces. The
+// filename is percent-decoded and the representation hash must be a CID
+// or a hex SHA-256; errors wrap ErrInvalidURL and name the field at fault.
+func ParseRandomURL(rawURL string) (*RandomURL, error) {
+	rest, ok := strings.CutPrefix(rawURL, "rd://")
+	if !ok {
+		return nil, fmt.Errorf("%w: expected the rd:// scheme in %q", ErrInvalidURL, rawURL)
+	}
+
+	host, path, _ := strings.Cut(rest, "/")
+	if host == "" {
+		return nil, fmt.Errorf("%w: missing host", ErrInvalidURL)
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) < 5 || len(parts) > 6 {
+		return nil, fmt.Errorf("%w: expected rd://host/version/size/filename/timestamp/hash, got %d path segments", ErrInvalidURL, len(parts))
+	}
+	if len(parts) == 6 && parts[5] != encryptedURLSuffix {
+		return nil, fmt.Errorf("%w: unexpected segment %q after the representation hash", ErrInvalidURL, parts[5])
+	}
+
+	if parts[0] == "" {
+		return nil, fmt.Errorf("%w: missing version", ErrInvalidURL)
+	}
+
+	fileSize, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || fileSize < 0 {
+		return nil, fmt.Errorf("%w: invalid file size %q", ErrInvalidURL, parts[1])
+	}
+
+	fileName, err := url.PathUnescape(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid filename encoding %q: %v", ErrInvalidURL, parts[2], err)
+	}
+	if fileName == "" {
+		return nil, fmt.Errorf("%w: missing filename", ErrInvalidURL)
+	}
+
+	timestamp, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil || timestamp < 0 {
+		return nil, fmt.Errorf("%w: invalid timestamp %q", ErrInvalidURL, parts[3])
+	}
+
+	repHash := parts[4]
+	if repHash == "" {
+		return nil, fmt.Errorf("%w: missing representation hash", ErrInvalidURL)
+	}
+	if classifyRef(repHash) == "" {
+		return nil, fmt.Errorf("%w: representation hash %q is not a CID or SHA-256 hash", ErrInvalidURL, repHash)
+	}
+
+	return &RandomURL{
+		Scheme:    "rd",
+		Host:      host,
+		Version:   parts[0],
+		FileSize:  fileSize,
+		FileName:  fileName,
+		Timestamp: timestamp,
+		RepHash:   repHash,
+		Encrypted: len(parts) == 6,
+	}, nil
+}
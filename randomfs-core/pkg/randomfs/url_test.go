@@ -0,0 +1,65 @@
+package randomfs
+
+import (
+	"testing"
+	"testing/quick"
+)
+
+// roundTrips reports whether a URL naming filename parses back from its
+// string form unchanged
+func roundTrips(t *testing.T, filename string, encrypted bool) bool {
+	t.Helper()
+	ru := RandomURL{
+		Scheme:    "rd",
+		Host:      "randomfs",
+		Version:   RepresentationVersion,
+		FileName:  filename,
+		FileSize:  12345,
+		Timestamp: 1700000000,
+		RepHash:   "QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG",
+		Encrypted: encrypted,
+	}
+	parsed, err := ParseRandomURL(ru.String())
+	if err != nil {
+		t.Errorf("ParseRandomURL(%q): %v", ru.String(), err)
+		return false
+	}
+	if *parsed != ru {
+		t.Errorf("%q parsed as %+v, want %+v", ru.String(), *parsed, ru)
+		return false
+	}
+	return true
+}
+
+func FuzzRandomURLRoundTrip(f *testing.F) {
+	for _, name := range []string{
+		"report.pdf",
+		"my/report (v2).pdf",
+		"../../etc/passwd",
+		"a%2Fb?c#d&e=f;g",
+		"日記 été.txt",
+		"encrypted",
+		"..",
+		"tab\tnew\nline",
+		"\xff\xfe invalid utf-8",
+	} {
+		f.Add(name, false)
+		f.Add(name, true)
+	}
+	f.Fuzz(func(t *testing.T, filename string, encrypted bool) {
+		// Every URL names a file
+		if filename == "" {
+			t.Skip()
+		}
+		roundTrips(t, filename, encrypted)
+	})
+}
+
+func TestRandomURLRoundTripsArbitraryFilenames(t *testing.T) {
+	property := func(filename string, encrypted bool) bool {
+		return filename == "" || roundTrips(t, filename, encrypted)
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Error(err)
+	}
+}
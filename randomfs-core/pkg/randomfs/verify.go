@@ -0,0 +1,184 @@
+package randomfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+	"golang.org/x/sync/errgroup"
+)
+
+// ErrBlockMismatch is returned when a fetched block does not match the
+// address it was stored under
+var ErrBlockMismatch = errors.New("block does not match its address")
+
+// verifyBlock checks that data is exactly the block referenced by hash.
+// CID references must be raw single-block CIDs; a DAG root means IPFS
+// re-chunked the block and cat output can no longer be tied to the address.
+func (rfs *RandomFS) verifyBlock(hash string, data []byte, size int) error {
+	if size > 0 && len(data) != size {
+		return fmt.Errorf("%w: block %s is %d bytes, expected %d", ErrBlockMismatch, hash, len(data), size)
+	}
+
+	if classifyRef(hash) == RefFormSHA256Hex {
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != hash {
+			return fmt.Errorf("%w: block %s content hash differs", ErrBlockMismatch, hash)
+		}
+		return nil
+	}
+
+	c, err := cid.Decode(hash)
+	if err != nil {
+		return fmt.Errorf("%w: %s is not a CID: %v", ErrBlockMismatch, hash, err)
+	}
+	prefix := c.Prefix()
+	if prefix.Codec != cid.Raw {
+		return fmt.Errorf("%w: block %s was stored as a %s node instead of a raw block", ErrBlockMismatch, hash, codecName(prefix.Codec))
+	}
+
+	sum, err := mh.Sum(data, prefix.MhType, prefix.MhLength)
+	if err != nil {
+		return fmt.Errorf("%w: cannot hash block %s: %v", ErrBlockMismatch, hash, err)
+	}
+	if !bytes.Equal(sum, c.Hash()) {
+		return fmt.Errorf("%w: block %s content hash differs", ErrBlockMismatch, hash)
+	}
+	return nil
+}
+
+// codecName describes a CID codec for error messages
+func codecName(codec uint64) string {
+	switch codec {
+	case cid.DagProtobuf:
+		return "dag-pb"
+	case cid.DagCBOR:
+		return "dag-cbor"
+	}
+	return fmt.Sprintf("codec 0x%x", codec)
+}
+
+// Block statuses in a FileVerifyReport
+const (
+	BlockOK      = "ok"
+	BlockMissing = "missing"
+	BlockCorrupt = "corrupt"
+)
+
+// BlockVerifyStatus is the state of one block a file references
+type BlockVerifyStatus struct {
+	// Index is the position in the file of the block it belongs to, and
+	// Kind whether it is that data block or one of its randomizers
+	Index  int    `json:"index"`
+	Kind   string `json:"kind"`
+	Hash   string `json:"hash"`
+	Status string `json:"status"`
+	// Cached is set if the block was found in the cache rather than
+	// fetched from the backend
+	Cached bool   `json:"cached,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// FileVerifyReport is the per-block result of VerifyFileBlocks
+type FileVerifyReport struct {
+	RepHash  string `json:"rep_hash"`
+	FileName string `json:"filename"`
+	// Counts of the block references checked, by status. A block
+	// referenced twice, such as a shared randomizer, counts twice.
+	Checked int                 `json:"checked"`
+	OK      int                 `json:"ok"`
+	Missing int                 `json:"missing"`
+	Corrupt int                 `json:"corrupt"`
+	Blocks  []BlockVerifyStatus `json:"blocks"`
+}
+
+// Healthy reports whether every block of the file is present and intact
+func (r *FileVerifyReport) Healthy() bool {
+	return r.OK == r.Checked
+}
+
+// VerifyFileBlocks checks that every data block and randomizer of a stored
+// file can be found, in the cache or the backend, and hashes to its
+// address, without reconstructing the file. Unlike VerifyFile it reports
+// every block rather than stopping at the first failure, so a missing
+// randomizer can be told from a damaged data block. The error is only set
+// if the representation cannot be loaded.
+func (rfs *RandomFS) VerifyFileBlocks(repHash string) (*FileVerifyReport, error) {
+	rfs.mutex.RLock()
+	defer rfs.mutex.RUnlock()
+
+	rep, err := rfs.loadRepresentation(repHash)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &FileVerifyReport{RepHash: repHash, FileName: rep.FileName, Blocks: []BlockVerifyStatus{}}
+	for i, hash := range rep.BlockHashes {
+		// Sparse blocks are recorded in the representation, not stored
+		if _, _, ok := parseSparseRef(hash); ok {
+			continue
+		}
+		report.Blocks = append(report.Blocks, BlockVerifyStatus{Index: i, Kind: blockKindData, Hash: hash})
+		for _, ref := range randomizerRefs(rep, i) {
+			report.Blocks = append(report.Blocks, BlockVerifyStatus{Index: i, Kind: blockKindRandomizer, Hash: ref})
+		}
+	}
+
+	// Each distinct block is checked once, on up to RetrieveWorkers
+	// goroutines
+	checked := make(map[string]*BlockVerifyStatus)
+	for i := range report.Blocks {
+		if _, ok := checked[report.Blocks[i].Hash]; !ok {
+			checked[report.Blocks[i].Hash] = &BlockVerifyStatus{Hash: report.Blocks[i].Hash}
+		}
+	}
+	var group errgroup.Group
+	group.SetLimit(max(rfs.RetrieveWorkers, 1))
+	for _, status := range checked {
+		group.Go(func() error {
+			rfs.checkBlock(status, rep.BlockSize)
+			return nil
+		})
+	}
+	group.Wait()
+
+	for i := range report.Blocks {
+		status := &report.Blocks[i]
+		result := checked[status.Hash]
+		status.Status, status.Cached, status.Error = result.Status, result.Cached, result.Error
+		report.Checked++
+		switch status.Status {
+		case BlockOK:
+			report.OK++
+		case BlockMissing:
+			report.Missing++
+		case BlockCorrupt:
+			report.Corrupt++
+		}
+	}
+	return report, nil
+}
+
+// checkBlock fills in the status of the block status.Hash, which should
+// be size bytes. Blocks fetched from the backend are not cached.
+func (rfs *RandomFS) checkBlock(status *BlockVerifyStatus, size int) {
+	data, cached := rfs.cache.Get(status.Hash)
+	if !cached {
+		var err error
+		if data, err = rfs.fetchBlock(context.Background(), status.Hash); err != nil {
+			status.Status, status.Error = BlockMissing, err.Error()
+			return
+		}
+	}
+	status.Cached = cached
+	if err := rfs.verifyBlock(status.Hash, data, size); err != nil {
+		status.Status, status.Error = BlockCorrupt, err.Error()
+		return
+	}
+	status.Status = BlockOK
+}
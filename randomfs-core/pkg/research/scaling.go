@@ -0,0 +1,166 @@
+// Package research contains analytical models of RandomFS block reuse
+package research
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ErrInvalidAnalysis is returned for a ScalingAnalysis or input outside
+// the range the model is defined on; errors wrap it and name the value at
+// fault
+var ErrInvalidAnalysis = errors.New("invalid scaling analysis")
+
+// ScalingAnalysis models how well-known block conventions improve reuse as a
+// network grows
+type ScalingAnalysis struct {
+	Conventions         int     // number of well-known randomizer conventions
+	BlocksPerConvention int     // blocks published under each convention
+	NodeUptime          float64 // average fraction of time a node is online
+	BaseReuseRate       float64 // reuse achieved without any conventions
+
+	// Adoption gives the fraction of users following the conventions at
+	// each step of a projection; DefaultAdoption if nil
+	Adoption AdoptionFunc
+}
+
+// AdoptionFunc returns the fraction of users following the conventions at
+// step of a projection, when the network has users users
+type AdoptionFunc func(step, users int) float64
+
+// LinearAdoption returns an AdoptionFunc starting at perStep and rising by
+// perStep each step, up to 1
+func LinearAdoption(perStep float64) AdoptionFunc {
+	return func(step, users int) float64 {
+		return math.Min(float64(step+1)*perStep, 1.0)
+	}
+}
+
+// DefaultAdoption is the adoption curve of AnalyzeConventionEvolution:
+// adoption rises by a tenth each step
+var DefaultAdoption = LinearAdoption(0.1)
+
+// EffectivenessResult is the modelled outcome for a given network size
+type EffectivenessResult struct {
+	TotalUsers      int     `json:"total_users"`
+	AdoptingUsers   int     `json:"adopting_users"`
+	ReuseRate       float64 `json:"reuse_rate"`
+	Efficiency      float64 `json:"efficiency"`
+	ShareableBlocks int     `json:"shareable_blocks"`
+}
+
+// EvolutionStep is one step of a modelled adoption curve
+type EvolutionStep struct {
+	Step     int                 `json:"step"`
+	Users    int                 `json:"users"`
+	Adoption float64             `json:"adoption"`
+	Result   EffectivenessResult `json:"result"`
+}
+
+// NewScalingAnalysis returns a ScalingAnalysis with the default parameters
+func NewScalingAnalysis() ScalingAnalysis {
+	return ScalingAnalysis{
+		Conventions:         16,
+		BlocksPerConvention: 1024,
+		NodeUptime:          0.6,
+		BaseReuseRate:       0.15,
+	}
+}
+
+// Validate checks that the parameters of sa are in range
+func (sa ScalingAnalysis) Validate() error {
+	if sa.Conventions <= 0 {
+		return fmt.Errorf("%w: %d conventions", ErrInvalidAnalysis, sa.Conventions)
+	}
+	if sa.BlocksPerConvention <= 0 {
+		return fmt.Errorf("%w: %d blocks per convention", ErrInvalidAnalysis, sa.BlocksPerConvention)
+	}
+	if !isFraction(sa.NodeUptime) {
+		return fmt.Errorf("%w: node uptime %v outside [0, 1]", ErrInvalidAnalysis, sa.NodeUptime)
+	}
+	if !isFraction(sa.BaseReuseRate) {
+		return fmt.Errorf("%w: base reuse rate %v outside [0, 1]", ErrInvalidAnalysis, sa.BaseReuseRate)
+	}
+	return nil
+}
+
+// isFraction reports whether f is in [0, 1]
+func isFraction(f float64) bool {
+	return f >= 0 && f <= 1
+}
+
+// CalculateEffectiveness estimates reuse and storage efficiency when a
+// fraction adoption of totalUsers follows the block conventions. It fails
+// with ErrInvalidAnalysis if sa does not validate, totalUsers is negative
+// or adoption is outside [0, 1].
+func (sa ScalingAnalysis) CalculateEffectiveness(totalUsers int, adoption float64) (EffectivenessResult, error) {
+	if err := sa.Validate(); err != nil {
+		return EffectivenessResult{}, err
+	}
+	if totalUsers < 0 {
+		return EffectivenessResult{}, fmt.Errorf("%w: %d users", ErrInvalidAnalysis, totalUsers)
+	}
+	if !isFraction(adoption) {
+		return EffectivenessResult{}, fmt.Errorf("%w: adoption %v outside [0, 1]", ErrInvalidAnalysis, adoption)
+	}
+
+	adopting := int(float64(totalUsers) * adoption)
+	shareable := sa.Conventions * sa.BlocksPerConvention
+
+	// Each adopting user makes convention blocks more likely to be online
+	availability := 1.0 - math.Pow(1.0-sa.NodeUptime, float64(adopting))
+	conventionReuse := adoption * availability
+
+	reuseRate := sa.BaseReuseRate + (1.0-sa.BaseReuseRate)*conventionReuse
+
+	// Storing a block costs the block plus two randomizers; reuse removes
+	// the randomizer overhead
+	efficiency := 1.0 / (1.0 + 2.0*(1.0-reuseRate))
+
+	return EffectivenessResult{
+		TotalUsers:      totalUsers,
+		AdoptingUsers:   adopting,
+		ReuseRate:       reuseRate,
+		Efficiency:      efficiency,
+		ShareableBlocks: shareable,
+	}, nil
+}
+
+// AnalyzeConventionEvolution models a network that doubles in size each step
+// while convention adoption follows sa.Adoption
+func (sa ScalingAnalysis) AnalyzeConventionEvolution(startUsers, steps int) ([]EvolutionStep, error) {
+	userGrowth := make([]int, 0, steps)
+	users := startUsers
+	for step := 0; step < steps; step++ {
+		userGrowth = append(userGrowth, users)
+		users *= 2
+	}
+	return sa.ProjectOverTime(userGrowth)
+}
+
+// ProjectOverTime applies CalculateEffectiveness at each user count of
+// userGrowth, with the adoption sa.Adoption gives for that step. It fails
+// at the first step CalculateEffectiveness rejects.
+func (sa ScalingAnalysis) ProjectOverTime(userGrowth []int) ([]EvolutionStep, error) {
+	adoptionAt := sa.Adoption
+	if adoptionAt == nil {
+		adoptionAt = DefaultAdoption
+	}
+
+	evolution := make([]EvolutionStep, 0, len(userGrowth))
+	for step, users := range userGrowth {
+		adoption := adoptionAt(step, users)
+		result, err := sa.CalculateEffectiveness(users, adoption)
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %w", step, err)
+		}
+		evolution = append(evolution, EvolutionStep{
+			Step:     step,
+			Users:    users,
+			Adoption: adoption,
+			Result:   result,
+		})
+	}
+	return evolution, nil
+}
@@ -0,0 +1,109 @@
+package research
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestProjectOverTimeFollowsSuppliedCurve(t *testing.T) {
+	sa := NewScalingAnalysis()
+	// A slow ramp that jumps to full adoption once the network is large
+	sa.Adoption = func(step, users int) float64 {
+		if users >= 1000 {
+			return 1.0
+		}
+		return 0.05
+	}
+	growth := []int{10, 50, 200, 1000, 5000}
+
+	projection, err := sa.ProjectOverTime(growth)
+	if err != nil {
+		t.Fatalf("ProjectOverTime: %v", err)
+	}
+	if len(projection) != len(growth) {
+		t.Fatalf("projected %d steps for %d user counts", len(projection), len(growth))
+	}
+	for i, step := range projection {
+		want, err := sa.CalculateEffectiveness(growth[i], step.Adoption)
+		if err != nil {
+			t.Fatalf("CalculateEffectiveness: %v", err)
+		}
+		if step.Step != i || step.Users != growth[i] || step.Result != want {
+			t.Errorf("step %d is %+v, want %d users with %+v", i, step, growth[i], want)
+		}
+	}
+	if projection[2].Adoption != 0.05 || projection[3].Adoption != 1.0 {
+		t.Errorf("adoption %v and %v did not follow the curve", projection[2].Adoption, projection[3].Adoption)
+	}
+	if projection[4].Result.ReuseRate <= projection[0].Result.ReuseRate {
+		t.Error("reuse did not grow with adoption")
+	}
+	if steps, err := sa.ProjectOverTime(nil); err != nil || len(steps) != 0 {
+		t.Errorf("projecting no user counts returned %d steps: %v", len(steps), err)
+	}
+
+	// A curve leaving [0, 1] is caught at the step it does
+	sa.Adoption = func(step, users int) float64 { return float64(step) * 0.6 }
+	if _, err := sa.ProjectOverTime(growth); !errors.Is(err, ErrInvalidAnalysis) {
+		t.Errorf("projecting adoption over 1 returned %v", err)
+	}
+}
+
+func TestAnalyzeConventionEvolutionDoublesUsers(t *testing.T) {
+	evolution, err := NewScalingAnalysis().AnalyzeConventionEvolution(100, 12)
+	if err != nil {
+		t.Fatalf("AnalyzeConventionEvolution: %v", err)
+	}
+	for i, step := range evolution {
+		if step.Users != 100<<i {
+			t.Errorf("step %d has %d users, want %d", i, step.Users, 100<<i)
+		}
+		if want := math.Min(float64(i+1)*0.1, 1.0); step.Adoption != want {
+			t.Errorf("step %d has adoption %v, want %v", i, step.Adoption, want)
+		}
+	}
+}
+
+func TestCalculateEffectivenessBoundaries(t *testing.T) {
+	sa := NewScalingAnalysis()
+
+	none, err := sa.CalculateEffectiveness(1000, 0)
+	if err != nil {
+		t.Fatalf("adoption 0: %v", err)
+	}
+	if none.AdoptingUsers != 0 || none.ReuseRate != sa.BaseReuseRate {
+		t.Errorf("adoption 0 gave %+v, want only the base reuse rate", none)
+	}
+
+	full, err := sa.CalculateEffectiveness(1000, 1)
+	if err != nil {
+		t.Fatalf("adoption 1: %v", err)
+	}
+	if full.AdoptingUsers != 1000 || full.ReuseRate > 1 || full.Efficiency > 1 {
+		t.Errorf("adoption 1 gave %+v", full)
+	}
+
+	for name, tc := range map[string]struct {
+		modify   func(*ScalingAnalysis)
+		users    int
+		adoption float64
+	}{
+		"adoption over 1":            {nil, 1000, 1.4},
+		"negative adoption":          {nil, 1000, -0.1},
+		"NaN adoption":               {nil, 1000, math.NaN()},
+		"negative users":             {nil, -1, 0.5},
+		"zero conventions":           {func(sa *ScalingAnalysis) { sa.Conventions = 0 }, 1000, 0.5},
+		"zero blocks per convention": {func(sa *ScalingAnalysis) { sa.BlocksPerConvention = 0 }, 1000, 0.5},
+		"negative uptime":            {func(sa *ScalingAnalysis) { sa.NodeUptime = -0.2 }, 1000, 0.5},
+		"base reuse over 1":          {func(sa *ScalingAnalysis) { sa.BaseReuseRate = 1.5 }, 1000, 0.5},
+	} {
+		analysis := NewScalingAnalysis()
+		if tc.modify != nil {
+			tc.modify(&analysis)
+		}
+		if _, err := analysis.CalculateEffectiveness(tc.users, tc.adoption); !errors.Is(err, ErrInvalidAnalysis) {
+			t.Errorf("%s returned %v, want ErrInvalidAnalysis", name, err)
+		}
+	}
+}
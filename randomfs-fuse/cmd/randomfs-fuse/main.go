@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/TheEntropyCollective/randomfs-core/pkg/randomfs"
+	"github.com/TheEntropyCollective/randomfs-fuse/pkg/fusefs"
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+func main() {
+	mountPoint := flag.String("mount", "", "Directory to mount RandomFS on")
+	dataDir := flag.String("data", randomfs.DefaultDataDir, "Data directory")
+	ipfsAPI := flag.String("ipfs", randomfs.DefaultIPFSAPI, "IPFS API endpoint")
+	noIPFS := flag.Bool("no-ipfs", false, "Run without IPFS, storing blocks locally")
+	cacheSize := flag.Int64("cache", randomfs.DefaultCacheSize, "Block cache size in bytes")
+	debug := flag.Bool("debug", false, "Enable FUSE debug output")
+	logLevel := slog.LevelInfo
+	flag.TextVar(&logLevel, "log-level", slog.LevelInfo, "Lowest level logged: debug, info, warn or error")
+	logJSON := flag.Bool("log-json", false, "Log records as JSON lines instead of text")
+	flag.Parse()
+
+	logger := newLogger(logLevel, *logJSON)
+	slog.SetDefault(logger)
+
+	if *mountPoint == "" {
+		fatal("Mount point is required (-mount)")
+	}
+
+	rfs, err := randomfs.NewRandomFSWithConfig(randomfs.Config{
+		EnableIPFS: !*noIPFS,
+		IPFSAPI:    *ipfsAPI,
+		DataDir:    *dataDir,
+		CacheSize:  *cacheSize,
+		Logger:     logger,
+	})
+	if err != nil {
+		fatal("Failed to initialize RandomFS", "error", err)
+	}
+	defer rfs.Close()
+
+	server, err := fs.Mount(*mountPoint, fusefs.NewRoot(rfs), &fs.Options{})
+	if err != nil {
+		fatal("Failed to mount", "error", err)
+	}
+	server.SetDebug(*debug)
+	slog.Info("RandomFS mounted", "path", *mountPoint)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		slog.Info("Unmounting", "path", *mountPoint)
+		server.Unmount()
+	}()
+
+	server.Wait()
+}
+
+// newLogger returns a logger writing records of level and above to
+// stderr, as JSON lines if json is set
+func newLogger(level slog.Level, json bool) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if json {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
+}
+
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,289 @@
+package fusefs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/TheEntropyCollective/randomfs-core/pkg/randomfs"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// URLXattr is the extended attribute holding the rd:// URL of a stored file
+const URLXattr = "user.randomfs.url"
+
+// fileNode is a file in the root directory. A stored file is read through
+// RandomFS a range at a time; a file opened for writing is buffered in
+// memory and stored again when it is flushed.
+type fileNode struct {
+	fs.Inode
+	rfs  *randomfs.RandomFS
+	name string
+
+	mutex sync.Mutex
+	// url addresses the stored contents; nil until the file is stored
+	url   *randomfs.RandomURL
+	size  int64
+	mtime time.Time
+	// sized is set once size has been read from the stored representation
+	sized bool
+	// buffered is set while data holds the contents, and dirty while they
+	// differ from the stored file
+	buffered bool
+	dirty    bool
+	data     []byte
+}
+
+var _ = (fs.NodeOpener)((*fileNode)(nil))
+var _ = (fs.NodeReader)((*fileNode)(nil))
+var _ = (fs.NodeWriter)((*fileNode)(nil))
+var _ = (fs.NodeFlusher)((*fileNode)(nil))
+var _ = (fs.NodeGetattrer)((*fileNode)(nil))
+var _ = (fs.NodeSetattrer)((*fileNode)(nil))
+var _ = (fs.NodeGetxattrer)((*fileNode)(nil))
+var _ = (fs.NodeListxattrer)((*fileNode)(nil))
+
+// newFileNode returns an empty file that is stored on its first flush
+func newFileNode(rfs *randomfs.RandomFS, name string) *fileNode {
+	return &fileNode{rfs: rfs, name: name, mtime: time.Now(), buffered: true, dirty: true}
+}
+
+// newStoredFileNode returns the file for an indexed file
+func newStoredFileNode(rfs *randomfs.RandomFS, info randomfs.FileInfo) *fileNode {
+	return &fileNode{
+		rfs:  rfs,
+		name: info.FileName,
+		url: &randomfs.RandomURL{
+			Scheme:    "rd",
+			Host:      "randomfs",
+			Version:   randomfs.RepresentationVersion,
+			FileName:  info.FileName,
+			FileSize:  info.FileSize,
+			Timestamp: info.StoredAt.Unix(),
+			RepHash:   info.RepHash,
+		},
+		size:  info.FileSize,
+		mtime: info.StoredAt,
+	}
+}
+
+// unsaved reports whether the file has contents that are not stored yet
+func (n *fileNode) unsaved() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.dirty
+}
+
+// fillAttr reports the file attributes in out
+func (n *fileNode) fillAttr(out *fuse.Attr) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.loadSize()
+	out.Mode = fuse.S_IFREG | 0644
+	out.Size = uint64(n.size)
+	out.SetTimes(nil, &n.mtime, nil)
+}
+
+// loadSize takes the size of a stored file from its representation rather
+// than the index, keeping the indexed size if the representation cannot be
+// loaded; callers hold the mutex
+func (n *fileNode) loadSize() {
+	if n.sized || n.buffered || n.url == nil {
+		return
+	}
+	rep, err := n.rfs.GetRepresentation(n.url.RepHash)
+	if err != nil {
+		slog.Error("Failed to load the representation", "file", n.name, "error", err)
+		return
+	}
+	n.size = rep.FileSize
+	n.sized = true
+}
+
+// buffer loads the stored contents into memory for writing; callers hold
+// the mutex
+func (n *fileNode) buffer() syscall.Errno {
+	if n.buffered {
+		return 0
+	}
+	if n.url != nil {
+		data, _, err := n.rfs.RetrieveFile(n.url.RepHash)
+		if err != nil {
+			slog.Error("Failed to load file for writing", "file", n.name, "error", err)
+			return syscall.EIO
+		}
+		n.data = data
+	}
+	n.buffered = true
+	return 0
+}
+
+// resize sets the length of the buffered contents; callers hold the mutex
+func (n *fileNode) resize(size int64) {
+	if size <= int64(cap(n.data)) {
+		n.data = n.data[:size]
+	} else {
+		n.data = append(n.data, make([]byte, size-int64(len(n.data)))...)
+	}
+	n.size = size
+	n.dirty = true
+	n.mtime = time.Now()
+}
+
+// Open opens the file, buffering its contents when it is opened for writing
+func (n *fileNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) == 0 {
+		return nil, 0, 0
+	}
+	if n.rfs.IsReadOnly() {
+		return nil, 0, syscall.EROFS
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if flags&syscall.O_TRUNC != 0 {
+		n.buffered = true
+		n.resize(0)
+		return nil, fuse.FOPEN_DIRECT_IO, 0
+	}
+	return nil, fuse.FOPEN_DIRECT_IO, n.buffer()
+}
+
+// Read returns a slice of the file, fetching only the blocks it covers
+func (n *fileNode) Read(ctx context.Context, f fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	n.mutex.Lock()
+	if n.buffered {
+		defer n.mutex.Unlock()
+		if off >= int64(len(n.data)) {
+			return fuse.ReadResultData(nil), 0
+		}
+		end := min(off+int64(len(dest)), int64(len(n.data)))
+		return fuse.ReadResultData(append([]byte(nil), n.data[off:end]...)), 0
+	}
+	n.loadSize()
+	url, size := n.url, n.size
+	n.mutex.Unlock()
+
+	if url == nil || off >= size {
+		return fuse.ReadResultData(nil), 0
+	}
+	reader, _, err := n.rfs.RetrieveFileRange(url.RepHash, off, off+int64(len(dest)))
+	if err != nil {
+		slog.Error("Failed to read file", "file", n.name, "error", err)
+		return nil, syscall.EIO
+	}
+	defer reader.Close()
+
+	read, err := io.ReadFull(reader, dest)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		slog.Error("Failed to read file", "file", n.name, "error", err)
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:read]), 0
+}
+
+// Write copies data into the buffered contents at off
+func (n *fileNode) Write(ctx context.Context, f fs.FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if errno := n.buffer(); errno != 0 {
+		return 0, errno
+	}
+	if end := off + int64(len(data)); end > int64(len(n.data)) {
+		n.resize(end)
+	}
+	copy(n.data[off:], data)
+	n.dirty = true
+	n.mtime = time.Now()
+	return uint32(len(data)), 0
+}
+
+// Flush stores the buffered contents if they changed, so that close
+// reports a failed store
+func (n *fileNode) Flush(ctx context.Context, f fs.FileHandle) syscall.Errno {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if !n.dirty {
+		return 0
+	}
+	// The content type is detected from the name and data
+	url, err := n.rfs.StoreFileContext(ctx, n.name, n.data, "")
+	if err != nil {
+		slog.Error("Failed to store file", "file", n.name, "error", err)
+		return syscall.EIO
+	}
+
+	n.url = url
+	n.size, n.sized = url.FileSize, true
+	n.mtime = time.Unix(url.Timestamp, 0)
+	n.buffered, n.dirty, n.data = false, false, nil
+	return 0
+}
+
+// Getattr reports the file attributes
+func (n *fileNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	n.fillAttr(&out.Attr)
+	return 0
+}
+
+// Setattr truncates or extends the file; other attributes are fixed
+func (n *fileNode) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	if size, ok := in.GetSize(); ok {
+		if n.rfs.IsReadOnly() {
+			return syscall.EROFS
+		}
+		n.mutex.Lock()
+		errno := n.buffer()
+		if errno == 0 {
+			n.resize(int64(size))
+		}
+		n.mutex.Unlock()
+		if errno != 0 {
+			return errno
+		}
+	}
+	n.fillAttr(&out.Attr)
+	return 0
+}
+
+// Getxattr returns the rd:// URL of a stored file under URLXattr
+func (n *fileNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	n.mutex.Lock()
+	url := n.url
+	n.mutex.Unlock()
+
+	if attr != URLXattr || url == nil {
+		return 0, syscall.ENODATA
+	}
+	return xattrValue(url.String(), dest)
+}
+
+// Listxattr lists URLXattr once the file is stored
+func (n *fileNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	n.mutex.Lock()
+	stored := n.url != nil
+	n.mutex.Unlock()
+
+	if !stored {
+		return 0, 0
+	}
+	return xattrValue(URLXattr+"\x00", dest)
+}
+
+// xattrValue copies value to dest, or reports the size dest needs
+func xattrValue(value string, dest []byte) (uint32, syscall.Errno) {
+	if len(dest) < len(value) {
+		return uint32(len(value)), syscall.ERANGE
+	}
+	return uint32(copy(dest, value)), 0
+}
@@ -0,0 +1,325 @@
+package fusefs
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"syscall"
+	"testing"
+
+	"github.com/TheEntropyCollective/randomfs-core/pkg/randomfs"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// newTestRoot returns a root node wired into a node filesystem, so its
+// methods can be called without mounting it
+func newTestRoot(t *testing.T, rfs *randomfs.RandomFS) *RandomFSNode {
+	t.Helper()
+	root := NewRoot(rfs)
+	fs.NewNodeFS(root, &fs.Options{})
+	return root
+}
+
+func newTestRandomFS(t *testing.T, dataDir string) *randomfs.RandomFS {
+	t.Helper()
+	rfs, err := randomfs.NewRandomFSWithoutIPFS(dataDir, 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFSWithoutIPFS: %v", err)
+	}
+	return rfs
+}
+
+// lookupFile resolves name in root and returns its file node
+func lookupFile(t *testing.T, root *RandomFSNode, name string) *fileNode {
+	t.Helper()
+	var out fuse.EntryOut
+	inode, errno := root.Lookup(context.Background(), name, &out)
+	if errno != 0 {
+		t.Fatalf("Lookup %s: %v", name, errno)
+	}
+	return inode.Operations().(*fileNode)
+}
+
+// readAt reads length bytes of file at off
+func readAt(t *testing.T, file *fileNode, off int64, length int) []byte {
+	t.Helper()
+	result, errno := file.Read(context.Background(), nil, make([]byte, length), off)
+	if errno != 0 {
+		t.Fatalf("Read at %d: %v", off, errno)
+	}
+	data, status := result.Bytes(nil)
+	if !status.Ok() {
+		t.Fatalf("read result: %v", status)
+	}
+	return data
+}
+
+// urlOf returns the rd:// URL extended attribute of file
+func urlOf(t *testing.T, file *fileNode) *randomfs.RandomURL {
+	t.Helper()
+	ctx := context.Background()
+	size, errno := file.Getxattr(ctx, URLXattr, nil)
+	if errno != syscall.ERANGE {
+		t.Fatalf("Getxattr size probe: %d, %v", size, errno)
+	}
+	dest := make([]byte, size)
+	if _, errno := file.Getxattr(ctx, URLXattr, dest); errno != 0 {
+		t.Fatalf("Getxattr: %v", errno)
+	}
+	url, err := randomfs.ParseRandomURL(string(dest))
+	if err != nil {
+		t.Fatalf("xattr %q is not an rd:// URL: %v", dest, err)
+	}
+	return url
+}
+
+func TestCreateWriteFlushStoresFile(t *testing.T) {
+	dataDir := t.TempDir()
+	rfs := newTestRandomFS(t, dataDir)
+	root := newTestRoot(t, rfs)
+	ctx := context.Background()
+
+	data := bytes.Repeat([]byte("frame data "), 20000)
+	var out fuse.EntryOut
+	inode, fh, _, errno := root.Create(ctx, "movie.mp4", syscall.O_WRONLY|syscall.O_CREAT, 0644, &out)
+	if errno != 0 {
+		t.Fatalf("Create: %v", errno)
+	}
+	file := inode.Operations().(*fileNode)
+
+	// Written out of order, as the kernel may
+	half := int64(len(data) / 2)
+	if n, errno := file.Write(ctx, fh, data[half:], half); errno != 0 || int(n) != len(data)-int(half) {
+		t.Fatalf("Write: %d, %v", n, errno)
+	}
+	if _, errno := file.Write(ctx, fh, data[:half], 0); errno != 0 {
+		t.Fatalf("Write: %v", errno)
+	}
+	if _, errno := file.Getxattr(ctx, URLXattr, make([]byte, 1024)); errno != syscall.ENODATA {
+		t.Errorf("unstored file has a URL (%v)", errno)
+	}
+	if len(rfs.ListFiles()) != 0 {
+		t.Fatal("file stored before it was flushed")
+	}
+
+	if errno := file.Flush(ctx, fh); errno != 0 {
+		t.Fatalf("Flush: %v", errno)
+	}
+	files := rfs.ListFiles()
+	if len(files) != 1 || files[0].FileName != "movie.mp4" || files[0].ContentType != "video/mp4" {
+		t.Fatalf("indexed files %+v", files)
+	}
+	url := urlOf(t, file)
+	got, _, err := rfs.RetrieveFile(url.RepHash)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("RetrieveFile of the xattr URL: %v", err)
+	}
+
+	// A second flush with nothing written stores nothing more
+	if errno := file.Flush(ctx, fh); errno != 0 || len(rfs.ListFiles()) != 1 {
+		t.Fatalf("second Flush: %v, %d files", errno, len(rfs.ListFiles()))
+	}
+
+	// The name survives a remount over the same data directory
+	if err := rfs.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	rfs = newTestRandomFS(t, dataDir)
+	defer rfs.Close()
+	root = newTestRoot(t, rfs)
+
+	stream, errno := root.Readdir(ctx)
+	if errno != 0 {
+		t.Fatalf("Readdir: %v", errno)
+	}
+	var names []string
+	for stream.HasNext() {
+		entry, _ := stream.Next()
+		names = append(names, entry.Name)
+	}
+	if len(names) != 2 || names[1] != "movie.mp4" {
+		t.Fatalf("root lists %v", names)
+	}
+
+	stored := lookupFile(t, root, "movie.mp4")
+	if stored.size != int64(len(data)) || urlOf(t, stored).RepHash != url.RepHash {
+		t.Fatalf("remounted file has size %d", stored.size)
+	}
+	if got := readAt(t, stored, 5000, 3000); !bytes.Equal(got, data[5000:8000]) {
+		t.Error("read across blocks differs")
+	}
+	if got := readAt(t, stored, int64(len(data))-10, 100); !bytes.Equal(got, data[len(data)-10:]) {
+		t.Error("read past the end differs")
+	}
+}
+
+func TestRewriteExistingFile(t *testing.T) {
+	rfs := newTestRandomFS(t, t.TempDir())
+	defer rfs.Close()
+	if _, err := rfs.StoreFile("notes.txt", []byte("first draft"), "text/plain"); err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	root := newTestRoot(t, rfs)
+	ctx := context.Background()
+
+	// Appending keeps the stored contents
+	file := lookupFile(t, root, "notes.txt")
+	if _, _, errno := file.Open(ctx, syscall.O_WRONLY); errno != 0 {
+		t.Fatalf("Open: %v", errno)
+	}
+	if _, errno := file.Write(ctx, nil, []byte(", revised"), int64(len("first draft"))); errno != 0 {
+		t.Fatalf("Write: %v", errno)
+	}
+	if errno := file.Flush(ctx, nil); errno != 0 {
+		t.Fatalf("Flush: %v", errno)
+	}
+	if got := readAt(t, lookupFile(t, root, "notes.txt"), 0, 100); string(got) != "first draft, revised" {
+		t.Fatalf("appended file reads %q", got)
+	}
+
+	// Truncating replaces them
+	file = lookupFile(t, root, "notes.txt")
+	if _, _, errno := file.Open(ctx, syscall.O_WRONLY|syscall.O_TRUNC); errno != 0 {
+		t.Fatalf("Open: %v", errno)
+	}
+	file.Write(ctx, nil, []byte("final"), 0)
+	if errno := file.Flush(ctx, nil); errno != 0 {
+		t.Fatalf("Flush: %v", errno)
+	}
+	if got := readAt(t, lookupFile(t, root, "notes.txt"), 0, 100); string(got) != "final" {
+		t.Fatalf("rewritten file reads %q", got)
+	}
+}
+
+func TestCreateRejectsReservedNames(t *testing.T) {
+	rfs := newTestRandomFS(t, t.TempDir())
+	defer rfs.Close()
+	root := newTestRoot(t, rfs)
+
+	var out fuse.EntryOut
+	if _, _, _, errno := root.Create(context.Background(), infoFileName, syscall.O_WRONLY, 0644, &out); errno == 0 {
+		t.Fatal("created a file over the info file")
+	}
+}
+
+func TestCopyIntoMount(t *testing.T) {
+	rfs := newTestRandomFS(t, t.TempDir())
+	defer rfs.Close()
+	mountPoint := t.TempDir()
+	server, err := fs.Mount(mountPoint, NewRoot(rfs), &fs.Options{MountOptions: fuse.MountOptions{DirectMount: true}})
+	if err != nil {
+		t.Skipf("cannot mount FUSE here: %v", err)
+	}
+	defer server.Unmount()
+
+	data := bytes.Repeat([]byte{1, 2, 3, 5, 8}, 30000)
+	path := filepath.Join(mountPoint, "clip.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("copy into mount: %v", err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read back: %v", err)
+	}
+
+	dest := make([]byte, 1024)
+	n, err := syscall.Getxattr(path, URLXattr, dest)
+	if err != nil {
+		t.Fatalf("getxattr: %v", err)
+	}
+	url, err := randomfs.ParseRandomURL(string(dest[:n]))
+	if err != nil {
+		t.Fatalf("xattr is not an rd:// URL: %v", err)
+	}
+	if stored, _, err := rfs.RetrieveFile(url.RepHash); err != nil || !bytes.Equal(stored, data) {
+		t.Fatalf("RetrieveFile: %v", err)
+	}
+}
+
+func TestGetattrReportsRepresentationSize(t *testing.T) {
+	dataDir := t.TempDir()
+	rfs := newTestRandomFS(t, dataDir)
+	data := bytes.Repeat([]byte("x"), 12345)
+	if _, err := rfs.StoreFile("sized.bin", data, "application/octet-stream"); err != nil {
+		t.Fatalf("StoreFile: %v", err)
+	}
+	rfs.Close()
+
+	// An index whose recorded size is wrong
+	indexPath := filepath.Join(dataDir, "index.json")
+	index, err := os.ReadFile(indexPath)
+	if err != nil {
+		t.Fatalf("read index: %v", err)
+	}
+	index = regexp.MustCompile(`"filesize": \d+`).ReplaceAll(index, []byte(`"filesize": 1`))
+	if err := os.WriteFile(indexPath, index, 0644); err != nil {
+		t.Fatalf("write index: %v", err)
+	}
+
+	rfs = newTestRandomFS(t, dataDir)
+	defer rfs.Close()
+	root := newTestRoot(t, rfs)
+
+	var out fuse.EntryOut
+	inode, errno := root.Lookup(context.Background(), "sized.bin", &out)
+	if errno != 0 {
+		t.Fatalf("Lookup: %v", errno)
+	}
+	if out.Size != uint64(len(data)) {
+		t.Errorf("Lookup reports %d bytes, want %d", out.Size, len(data))
+	}
+	var attr fuse.AttrOut
+	inode.Operations().(*fileNode).Getattr(context.Background(), nil, &attr)
+	if attr.Size != uint64(len(data)) {
+		t.Errorf("Getattr reports %d bytes, want %d", attr.Size, len(data))
+	}
+	if got := readAt(t, inode.Operations().(*fileNode), 0, 20000); !bytes.Equal(got, data) {
+		t.Errorf("read %d bytes, want %d", len(got), len(data))
+	}
+}
+
+func TestListAndCatStoredFilesThroughMount(t *testing.T) {
+	rfs := newTestRandomFS(t, t.TempDir())
+	defer rfs.Close()
+	files := map[string][]byte{
+		"a.txt": []byte("alpha"),
+		"b.bin": bytes.Repeat([]byte{0xbe, 0xef}, 70000),
+	}
+	for name, data := range files {
+		if _, err := rfs.StoreFile(name, data, "application/octet-stream"); err != nil {
+			t.Fatalf("StoreFile %s: %v", name, err)
+		}
+	}
+
+	mountPoint := t.TempDir()
+	server, err := fs.Mount(mountPoint, NewRoot(rfs), &fs.Options{MountOptions: fuse.MountOptions{DirectMount: true}})
+	if err != nil {
+		t.Skipf("cannot mount FUSE here: %v", err)
+	}
+	defer server.Unmount()
+
+	entries, err := os.ReadDir(mountPoint)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if len(names) != 3 || names[0] != infoFileName || names[1] != "a.txt" || names[2] != "b.bin" {
+		t.Fatalf("mount lists %v", names)
+	}
+	for _, name := range []string{"a.txt", "b.bin"} {
+		info, err := os.Stat(filepath.Join(mountPoint, name))
+		if err != nil || info.Size() != int64(len(files[name])) {
+			t.Fatalf("stat %s: %v", name, err)
+		}
+		got, err := os.ReadFile(filepath.Join(mountPoint, name))
+		if err != nil || !bytes.Equal(got, files[name]) {
+			t.Fatalf("cat %s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Package fusefs exposes a RandomFS instance as a FUSE filesystem
+package fusefs
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"syscall"
+
+	"github.com/TheEntropyCollective/randomfs-core/pkg/randomfs"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// infoFileName is the pseudo-file reporting RandomFS statistics
+const infoFileName = ".randomfs-info"
+
+// RandomFSNode is the root directory of a RandomFS mount. It lists the
+// files in the RandomFS index by name, and files copied into it are stored
+// when they are closed. The index persists the name of each stored file,
+// so files written through the mount are listed again on the next mount.
+type RandomFSNode struct {
+	fs.Inode
+	rfs *randomfs.RandomFS
+}
+
+// NewRoot creates the root node for a RandomFS mount
+func NewRoot(rfs *randomfs.RandomFS) *RandomFSNode {
+	return &RandomFSNode{rfs: rfs}
+}
+
+var _ = (fs.NodeReaddirer)((*RandomFSNode)(nil))
+var _ = (fs.NodeLookuper)((*RandomFSNode)(nil))
+var _ = (fs.NodeGetattrer)((*RandomFSNode)(nil))
+var _ = (fs.NodeCreater)((*RandomFSNode)(nil))
+
+// Readdir lists the root directory
+func (n *RandomFSNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	entries := []fuse.DirEntry{
+		{Name: infoFileName, Mode: fuse.S_IFREG},
+	}
+	seen := map[string]bool{infoFileName: true}
+	for _, file := range n.rfs.ListFiles() {
+		if validName(file.FileName) && !seen[file.FileName] {
+			seen[file.FileName] = true
+			entries = append(entries, fuse.DirEntry{Name: file.FileName, Mode: fuse.S_IFREG})
+		}
+	}
+	// Files created through the mount that are not stored yet
+	for name := range n.Children() {
+		if !seen[name] {
+			seen[name] = true
+			entries = append(entries, fuse.DirEntry{Name: name, Mode: fuse.S_IFREG})
+		}
+	}
+	return fs.NewListDirStream(entries), 0
+}
+
+// Lookup resolves a name in the root directory
+func (n *RandomFSNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if name == infoFileName {
+		info := &infoNode{rfs: n.rfs}
+		out.Mode = fuse.S_IFREG | 0444
+		out.Size = uint64(len(info.content()))
+		return n.NewInode(ctx, info, fs.StableAttr{Mode: fuse.S_IFREG}), 0
+	}
+
+	// A file being written is served from its buffer until it is stored
+	if child := n.GetChild(name); child != nil {
+		if file, ok := child.Operations().(*fileNode); ok && file.unsaved() {
+			file.fillAttr(&out.Attr)
+			return child, 0
+		}
+	}
+
+	info, ok := n.latest(name)
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	file := newStoredFileNode(n.rfs, info)
+	file.fillAttr(&out.Attr)
+	return n.NewInode(ctx, file, fs.StableAttr{Mode: fuse.S_IFREG}), 0
+}
+
+// Create starts a new file, which is stored when it is closed
+func (n *RandomFSNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	if n.rfs.IsReadOnly() {
+		return nil, nil, 0, syscall.EROFS
+	}
+	if !validName(name) {
+		return nil, nil, 0, syscall.EPERM
+	}
+
+	file := newFileNode(n.rfs, name)
+	file.fillAttr(&out.Attr)
+	return n.NewInode(ctx, file, fs.StableAttr{Mode: fuse.S_IFREG}), nil, 0, 0
+}
+
+// latest returns the most recently stored indexed file named name
+func (n *RandomFSNode) latest(name string) (randomfs.FileInfo, bool) {
+	var latest randomfs.FileInfo
+	found := false
+	for _, file := range n.rfs.ListFiles() {
+		if file.FileName == name {
+			latest, found = file, true
+		}
+	}
+	return latest, found
+}
+
+// validName reports whether an indexed name can appear in the root
+// directory
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && name != infoFileName && !strings.Contains(name, "/")
+}
+
+// Getattr reports the root directory attributes
+func (n *RandomFSNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = fuse.S_IFDIR | 0755
+	return 0
+}
+
+// infoNode is a read-only file containing RandomFS statistics as JSON
+type infoNode struct {
+	fs.Inode
+	rfs *randomfs.RandomFS
+}
+
+var _ = (fs.NodeOpener)((*infoNode)(nil))
+var _ = (fs.NodeReader)((*infoNode)(nil))
+var _ = (fs.NodeGetattrer)((*infoNode)(nil))
+
+// content renders the current statistics
+func (n *infoNode) content() []byte {
+	data, _ := json.MarshalIndent(n.rfs.GetStats(), "", "  ")
+	return append(data, '\n')
+}
+
+// Open allows read-only access to the info file
+func (n *infoNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	return nil, fuse.FOPEN_DIRECT_IO, 0
+}
+
+// Read returns a slice of the info file
+func (n *infoNode) Read(ctx context.Context, f fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	data := n.content()
+	if off >= int64(len(data)) {
+		return fuse.ReadResultData(nil), 0
+	}
+	end := off + int64(len(dest))
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	return fuse.ReadResultData(data[off:end]), 0
+}
+
+// Getattr reports the info file attributes
+func (n *infoNode) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = fuse.S_IFREG | 0444
+	out.Size = uint64(len(n.content()))
+	return 0
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/TheEntropyCollective/randomfs-core/pkg/randomfs"
+	"github.com/TheEntropyCollective/randomfs-grpc/pkg/grpcserver"
+	"google.golang.org/grpc"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:9090", "Address to serve gRPC on")
+	dataDir := flag.String("data", randomfs.DefaultDataDir, "Data directory")
+	ipfsAPI := flag.String("ipfs", randomfs.DefaultIPFSAPI, "IPFS API endpoint")
+	noIPFS := flag.Bool("no-ipfs", false, "Run without IPFS, storing blocks locally")
+	cacheSize := flag.Int64("cache", randomfs.DefaultCacheSize, "Block cache size in bytes")
+	readOnly := flag.Bool("read-only", false, "Serve files from an existing data directory without accepting stores")
+	logLevel := slog.LevelInfo
+	flag.TextVar(&logLevel, "log-level", slog.LevelInfo, "Lowest level logged: debug, info, warn or error")
+	logJSON := flag.Bool("log-json", false, "Log records as JSON lines instead of text")
+	flag.Parse()
+
+	logger := newLogger(logLevel, *logJSON)
+	slog.SetDefault(logger)
+
+	rfs, err := randomfs.NewRandomFSWithConfig(randomfs.Config{
+		EnableIPFS: !*noIPFS,
+		IPFSAPI:    *ipfsAPI,
+		DataDir:    *dataDir,
+		CacheSize:  *cacheSize,
+		ReadOnly:   *readOnly,
+		Logger:     logger,
+	})
+	if err != nil {
+		fatal("Failed to initialize RandomFS", "error", err)
+	}
+	defer rfs.Close()
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fatal("Failed to listen", "error", err)
+	}
+	server := grpc.NewServer()
+	grpcserver.NewServer(rfs).Register(server)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		slog.Info("Shutting down")
+		server.GracefulStop()
+	}()
+
+	slog.Info("RandomFS gRPC server listening", "addr", listener.Addr())
+	if err := server.Serve(listener); err != nil {
+		fatal("Server failed", "error", err)
+	}
+}
+
+// newLogger returns a logger writing records of level and above to
+// stderr, as JSON lines if json is set
+func newLogger(level slog.Level, json bool) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if json {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
+}
+
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,225 @@
+// Package grpcserver serves a RandomFS instance over gRPC
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/TheEntropyCollective/randomfs-core/pkg/randomfs"
+	"github.com/TheEntropyCollective/randomfs-grpc/pkg/randomfspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ChunkSize is the most content a Retrieve message carries, well below
+// the default gRPC message size limit
+const ChunkSize = 256 * 1024
+
+// Server implements the RandomFS gRPC service over a RandomFS instance
+type Server struct {
+	randomfspb.UnimplementedRandomFSServer
+	rfs *randomfs.RandomFS
+}
+
+// NewServer creates a gRPC service for rfs
+func NewServer(rfs *randomfs.RandomFS) *Server {
+	return &Server{rfs: rfs}
+}
+
+// Register registers the service with a gRPC server
+func (s *Server) Register(registrar grpc.ServiceRegistrar) {
+	randomfspb.RegisterRandomFSServer(registrar, s)
+}
+
+// Store stores the file sent on the stream as it arrives
+func (s *Server) Store(stream grpc.ClientStreamingServer[randomfspb.StoreRequest, randomfspb.StoreResponse]) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "failed to receive store header: %v", err)
+	}
+	header := first.GetHeader()
+	if header == nil {
+		return status.Error(codes.InvalidArgument, "the first store message must carry the header")
+	}
+	if header.GetFileName() == "" {
+		return status.Error(codes.InvalidArgument, "file name is required")
+	}
+	size := int64(randomfs.UnknownSize)
+	if header.Size != nil {
+		if size = header.GetSize(); size < 0 {
+			return status.Errorf(codes.InvalidArgument, "invalid size %d", size)
+		}
+	}
+
+	r := &chunkReader{stream: stream}
+	rdURL, err := s.rfs.StoreReader(header.GetFileName(), r, size, header.GetContentType())
+	if r.err != nil {
+		return r.err
+	}
+	if err != nil {
+		return storeError(err)
+	}
+	return stream.SendAndClose(&randomfspb.StoreResponse{
+		Url:          rdURL.String(),
+		CompactUrl:   rdURL.Compact(),
+		RepHash:      rdURL.RepHash,
+		Size:         rdURL.FileSize,
+		Deduplicated: rdURL.Deduplicated,
+	})
+}
+
+// chunkReader reads the chunks of a Store stream. err records a failure
+// of the stream itself, so it is not reported as a failed store.
+type chunkReader struct {
+	stream grpc.ClientStreamingServer[randomfspb.StoreRequest, randomfspb.StoreResponse]
+	chunk  []byte
+	err    error
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		req, err := r.stream.Recv()
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		if err != nil {
+			r.err = err
+			return 0, err
+		}
+		if req.GetHeader() != nil {
+			r.err = status.Error(codes.InvalidArgument, "only the first store message may carry a header")
+			return 0, r.err
+		}
+		r.chunk = req.GetChunk()
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+// storeError converts an error storing a file to a gRPC status
+func storeError(err error) error {
+	switch {
+	case errors.Is(err, randomfs.ErrReadOnly):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, randomfs.ErrFilenameRejected):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, randomfs.ErrDuplicateName):
+		return status.Error(codes.AlreadyExists, err.Error())
+	}
+	return status.Errorf(codes.Internal, "failed to store file: %v", err)
+}
+
+// Retrieve streams a file or a range of it, fetching blocks as the
+// content is sent
+func (s *Server) Retrieve(req *randomfspb.RetrieveRequest, stream grpc.ServerStreamingServer[randomfspb.RetrieveResponse]) error {
+	if req.GetOffset() < 0 || req.GetLength() < 0 {
+		return status.Errorf(codes.InvalidArgument, "invalid range %d+%d", req.GetOffset(), req.GetLength())
+	}
+
+	var r io.ReadCloser
+	var rep *randomfs.FileRepresentation
+	var err error
+	if req.GetOffset() == 0 && req.GetLength() == 0 {
+		r, rep, err = s.rfs.RetrieveFileStream(req.GetRepHash())
+	} else {
+		// The end is clamped to the file size, so no length reads to it
+		end := int64(math.MaxInt64)
+		if req.GetLength() > 0 && req.GetOffset() <= math.MaxInt64-req.GetLength() {
+			end = req.GetOffset() + req.GetLength()
+		}
+		r, rep, err = s.rfs.RetrieveFileRange(req.GetRepHash(), req.GetOffset(), end)
+	}
+	if errors.Is(err, randomfs.ErrInvalidRange) {
+		return status.Error(codes.OutOfRange, err.Error())
+	}
+	if err != nil {
+		return status.Errorf(codes.NotFound, "failed to retrieve file: %v", err)
+	}
+	defer r.Close()
+
+	info := representationInfo(req.GetRepHash(), rep)
+	if err := stream.Send(&randomfspb.RetrieveResponse{Data: &randomfspb.RetrieveResponse_Info{Info: info}}); err != nil {
+		return err
+	}
+	buf := make([]byte, ChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			chunk := &randomfspb.RetrieveResponse_Chunk{Chunk: buf[:n]}
+			if err := stream.Send(&randomfspb.RetrieveResponse{Data: chunk}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return status.Errorf(codes.DataLoss, "failed to retrieve file: %v", err)
+		}
+	}
+}
+
+// Stat describes a file from its representation
+func (s *Server) Stat(ctx context.Context, req *randomfspb.StatRequest) (*randomfspb.FileInfo, error) {
+	rep, err := s.rfs.GetRepresentation(req.GetRepHash())
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "failed to load file: %v", err)
+	}
+	return representationInfo(req.GetRepHash(), rep), nil
+}
+
+// representationInfo describes the file stored as repHash
+func representationInfo(repHash string, rep *randomfs.FileRepresentation) *randomfspb.FileInfo {
+	return &randomfspb.FileInfo{
+		RepHash:     repHash,
+		FileName:    rep.FileName,
+		FileSize:    rep.FileSize,
+		ContentType: rep.ContentType,
+		StoredAt:    &timestamppb.Timestamp{Seconds: rep.Timestamp},
+	}
+}
+
+// Delete deletes a file from the index, releasing its blocks
+func (s *Server) Delete(ctx context.Context, req *randomfspb.DeleteRequest) (*randomfspb.DeleteResponse, error) {
+	err := s.rfs.DeleteFile(req.GetRepHash())
+	switch {
+	case errors.Is(err, randomfs.ErrFileNotFound):
+		return nil, status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, randomfs.ErrReadOnly):
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	case err != nil:
+		return nil, status.Errorf(codes.Internal, "failed to delete file: %v", err)
+	}
+	return &randomfspb.DeleteResponse{}, nil
+}
+
+// List lists the indexed files, oldest first
+func (s *Server) List(ctx context.Context, req *randomfspb.ListRequest) (*randomfspb.ListResponse, error) {
+	resp := &randomfspb.ListResponse{}
+	for _, file := range s.rfs.ListFiles() {
+		if !strings.HasPrefix(file.FileName, req.GetPrefix()) {
+			continue
+		}
+		info := &randomfspb.FileInfo{
+			RepHash:     file.RepHash,
+			FileName:    file.FileName,
+			FileSize:    file.FileSize,
+			ContentType: file.ContentType,
+			StoredAt:    timestamppb.New(file.StoredAt),
+		}
+		if !file.ExpiresAt.IsZero() {
+			info.ExpiresAt = timestamppb.New(file.ExpiresAt)
+		}
+		resp.Files = append(resp.Files, info)
+	}
+	return resp, nil
+}
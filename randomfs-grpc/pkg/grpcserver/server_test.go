@@ -0,0 +1,201 @@
+package grpcserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/TheEntropyCollective/randomfs-core/pkg/randomfs"
+	"github.com/TheEntropyCollective/randomfs-grpc/pkg/randomfspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+// newTestClient serves a RandomFS without IPFS over an in-memory
+// connection and returns a client for it
+func newTestClient(t *testing.T) randomfspb.RandomFSClient {
+	t.Helper()
+	rfs, err := randomfs.NewRandomFSWithoutIPFS(t.TempDir(), 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFSWithoutIPFS: %v", err)
+	}
+	t.Cleanup(func() { rfs.Close() })
+
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	NewServer(rfs).Register(server)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return randomfspb.NewRandomFSClient(conn)
+}
+
+// storeChunks stores data sent in chunks of chunkSize bytes
+func storeChunks(t *testing.T, client randomfspb.RandomFSClient, header *randomfspb.StoreHeader, data []byte, chunkSize int) (*randomfspb.StoreResponse, error) {
+	t.Helper()
+	stream, err := client.Store(context.Background())
+	if err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if err := stream.Send(&randomfspb.StoreRequest{Data: &randomfspb.StoreRequest_Header{Header: header}}); err != nil {
+		t.Fatalf("sending header: %v", err)
+	}
+	for len(data) > 0 {
+		n := min(chunkSize, len(data))
+		if err := stream.Send(&randomfspb.StoreRequest{Data: &randomfspb.StoreRequest_Chunk{Chunk: data[:n]}}); err != nil {
+			break
+		}
+		data = data[n:]
+	}
+	return stream.CloseAndRecv()
+}
+
+// retrieve reads a file back, returning its description and content
+func retrieve(t *testing.T, client randomfspb.RandomFSClient, req *randomfspb.RetrieveRequest) (*randomfspb.FileInfo, []byte, error) {
+	t.Helper()
+	stream, err := client.Retrieve(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Retrieve: %v", err)
+	}
+	var info *randomfspb.FileInfo
+	var data bytes.Buffer
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return info, data.Bytes(), nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.GetInfo() != nil {
+			info = resp.GetInfo()
+		}
+		data.Write(resp.GetChunk())
+	}
+}
+
+func TestRoundTripLargeFile(t *testing.T) {
+	client := newTestClient(t)
+	data := make([]byte, 5*1024*1024+123)
+	rand.Read(data)
+
+	stored, err := storeChunks(t, client, &randomfspb.StoreHeader{FileName: "large.bin", Size: proto.Int64(int64(len(data)))}, data, 100*1024)
+	if err != nil {
+		t.Fatalf("storing: %v", err)
+	}
+	if stored.GetSize() != int64(len(data)) || stored.GetRepHash() == "" || stored.GetUrl() == "" {
+		t.Fatalf("stored %+v", stored)
+	}
+
+	info, got, err := retrieve(t, client, &randomfspb.RetrieveRequest{RepHash: stored.GetRepHash()})
+	if err != nil {
+		t.Fatalf("retrieving: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("retrieved %d bytes differing from the %d stored", len(got), len(data))
+	}
+	if info.GetFileName() != "large.bin" || info.GetFileSize() != int64(len(data)) || info.GetContentType() != "application/octet-stream" {
+		t.Errorf("retrieved info %+v", info)
+	}
+
+	offset := int64(3*1024*1024 - 7)
+	_, got, err = retrieve(t, client, &randomfspb.RetrieveRequest{RepHash: stored.GetRepHash(), Offset: offset, Length: 4096})
+	if err != nil || !bytes.Equal(got, data[offset:offset+4096]) {
+		t.Fatalf("range retrieved %d bytes: %v", len(got), err)
+	}
+	_, got, err = retrieve(t, client, &randomfspb.RetrieveRequest{RepHash: stored.GetRepHash(), Offset: offset})
+	if err != nil || !bytes.Equal(got, data[offset:]) {
+		t.Fatalf("retrieved %d bytes from an offset: %v", len(got), err)
+	}
+
+	// A file streamed without its size is stored too
+	unsized, err := storeChunks(t, client, &randomfspb.StoreHeader{FileName: "unsized.bin"}, data[:2*1024*1024], 64*1024)
+	if err != nil || unsized.GetSize() != 2*1024*1024 {
+		t.Fatalf("storing without a size returned %+v: %v", unsized, err)
+	}
+	_, got, err = retrieve(t, client, &randomfspb.RetrieveRequest{RepHash: unsized.GetRepHash()})
+	if err != nil || !bytes.Equal(got, data[:2*1024*1024]) {
+		t.Fatalf("retrieving a file stored without a size: %v", err)
+	}
+}
+
+func TestStatListDelete(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+	report, err := storeChunks(t, client, &randomfspb.StoreHeader{FileName: "report.txt", ContentType: "text/plain"}, []byte("quarterly report"), 4)
+	if err != nil {
+		t.Fatalf("storing: %v", err)
+	}
+	if _, err := storeChunks(t, client, &randomfspb.StoreHeader{FileName: "photo.jpg"}, []byte("jpeg"), 4); err != nil {
+		t.Fatalf("storing: %v", err)
+	}
+
+	info, err := client.Stat(ctx, &randomfspb.StatRequest{RepHash: report.GetRepHash()})
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.GetFileName() != "report.txt" || info.GetFileSize() != 16 || info.GetContentType() != "text/plain" || info.GetStoredAt().GetSeconds() == 0 {
+		t.Errorf("Stat returned %+v", info)
+	}
+
+	all, err := client.List(ctx, &randomfspb.ListRequest{})
+	if err != nil || len(all.GetFiles()) != 2 {
+		t.Fatalf("List returned %v: %v", all, err)
+	}
+	reports, err := client.List(ctx, &randomfspb.ListRequest{Prefix: "rep"})
+	if err != nil || len(reports.GetFiles()) != 1 || reports.GetFiles()[0].GetRepHash() != report.GetRepHash() {
+		t.Fatalf("List with a prefix returned %v: %v", reports, err)
+	}
+
+	if _, err := client.Delete(ctx, &randomfspb.DeleteRequest{RepHash: report.GetRepHash()}); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := client.Delete(ctx, &randomfspb.DeleteRequest{RepHash: report.GetRepHash()}); status.Code(err) != codes.NotFound {
+		t.Errorf("second Delete returned %v, want NotFound", err)
+	}
+	if left, _ := client.List(ctx, &randomfspb.ListRequest{}); len(left.GetFiles()) != 1 {
+		t.Errorf("%d files listed after Delete", len(left.GetFiles()))
+	}
+	if _, err := client.Stat(ctx, &randomfspb.StatRequest{RepHash: "missing"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Stat of a missing file returned %v", err)
+	}
+}
+
+func TestStoreRejectsMalformedStreams(t *testing.T) {
+	client := newTestClient(t)
+
+	stream, err := client.Store(context.Background())
+	if err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	stream.Send(&randomfspb.StoreRequest{Data: &randomfspb.StoreRequest_Chunk{Chunk: []byte("data")}})
+	if _, err := stream.CloseAndRecv(); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("store without a header returned %v", err)
+	}
+
+	if _, err := storeChunks(t, client, &randomfspb.StoreHeader{FileName: "short.bin", Size: proto.Int64(100)}, []byte("short"), 5); err == nil {
+		t.Error("stored fewer bytes than the declared size")
+	}
+	if _, err := storeChunks(t, client, &randomfspb.StoreHeader{}, []byte("data"), 4); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("store without a file name returned %v", err)
+	}
+	if _, _, err := retrieve(t, client, &randomfspb.RetrieveRequest{RepHash: "missing"}); status.Code(err) != codes.NotFound {
+		t.Errorf("retrieving a missing file returned %v", err)
+	}
+}
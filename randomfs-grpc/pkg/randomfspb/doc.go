@@ -0,0 +1,5 @@
+// Package randomfspb holds the protobuf messages of the RandomFS gRPC
+// service and its generated client and server stubs.
+package randomfspb
+
+//go:generate protoc -I ../../proto --go_out=. --go_opt=module=github.com/TheEntropyCollective/randomfs-grpc/pkg/randomfspb --go-grpc_out=. --go-grpc_opt=module=github.com/TheEntropyCollective/randomfs-grpc/pkg/randomfspb randomfs/v1/randomfs.proto
@@ -0,0 +1,286 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: randomfs/v1/randomfs.proto
+
+package randomfspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	RandomFS_Store_FullMethodName    = "/randomfs.v1.RandomFS/Store"
+	RandomFS_Retrieve_FullMethodName = "/randomfs.v1.RandomFS/Retrieve"
+	RandomFS_Stat_FullMethodName     = "/randomfs.v1.RandomFS/Stat"
+	RandomFS_Delete_FullMethodName   = "/randomfs.v1.RandomFS/Delete"
+	RandomFS_List_FullMethodName     = "/randomfs.v1.RandomFS/List"
+)
+
+// RandomFSClient is the client API for RandomFS service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// RandomFS stores and retrieves files as randomized blocks. Files move in
+// chunks, so neither side holds a whole file in memory.
+type RandomFSClient interface {
+	// Store stores a file sent as a header followed by chunks of content
+	Store(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[StoreRequest, StoreResponse], error)
+	// Retrieve streams a stored file: its description, then its content
+	Retrieve(ctx context.Context, in *RetrieveRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[RetrieveResponse], error)
+	// Stat describes a stored file without fetching any of its blocks
+	Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*FileInfo, error)
+	// Delete deletes a stored file
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	// List lists the files stored through the server
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error)
+}
+
+type randomFSClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRandomFSClient(cc grpc.ClientConnInterface) RandomFSClient {
+	return &randomFSClient{cc}
+}
+
+func (c *randomFSClient) Store(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[StoreRequest, StoreResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &RandomFS_ServiceDesc.Streams[0], RandomFS_Store_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[StoreRequest, StoreResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type RandomFS_StoreClient = grpc.ClientStreamingClient[StoreRequest, StoreResponse]
+
+func (c *randomFSClient) Retrieve(ctx context.Context, in *RetrieveRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[RetrieveResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &RandomFS_ServiceDesc.Streams[1], RandomFS_Retrieve_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[RetrieveRequest, RetrieveResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type RandomFS_RetrieveClient = grpc.ServerStreamingClient[RetrieveResponse]
+
+func (c *randomFSClient) Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*FileInfo, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(FileInfo)
+	err := c.cc.Invoke(ctx, RandomFS_Stat_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *randomFSClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, RandomFS_Delete_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *randomFSClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListResponse)
+	err := c.cc.Invoke(ctx, RandomFS_List_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RandomFSServer is the server API for RandomFS service.
+// All implementations must embed UnimplementedRandomFSServer
+// for forward compatibility.
+//
+// RandomFS stores and retrieves files as randomized blocks. Files move in
+// chunks, so neither side holds a whole file in memory.
+type RandomFSServer interface {
+	// Store stores a file sent as a header followed by chunks of content
+	Store(grpc.ClientStreamingServer[StoreRequest, StoreResponse]) error
+	// Retrieve streams a stored file: its description, then its content
+	Retrieve(*RetrieveRequest, grpc.ServerStreamingServer[RetrieveResponse]) error
+	// Stat describes a stored file without fetching any of its blocks
+	Stat(context.Context, *StatRequest) (*FileInfo, error)
+	// Delete deletes a stored file
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	// List lists the files stored through the server
+	List(context.Context, *ListRequest) (*ListResponse, error)
+	mustEmbedUnimplementedRandomFSServer()
+}
+
+// UnimplementedRandomFSServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedRandomFSServer struct{}
+
+func (UnimplementedRandomFSServer) Store(grpc.ClientStreamingServer[StoreRequest, StoreResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method Store not implemented")
+}
+func (UnimplementedRandomFSServer) Retrieve(*RetrieveRequest, grpc.ServerStreamingServer[RetrieveResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method Retrieve not implemented")
+}
+func (UnimplementedRandomFSServer) Stat(context.Context, *StatRequest) (*FileInfo, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stat not implemented")
+}
+func (UnimplementedRandomFSServer) Delete(context.Context, *DeleteRequest) (*DeleteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedRandomFSServer) List(context.Context, *ListRequest) (*ListResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedRandomFSServer) mustEmbedUnimplementedRandomFSServer() {}
+func (UnimplementedRandomFSServer) testEmbeddedByValue()                  {}
+
+// UnsafeRandomFSServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RandomFSServer will
+// result in compilation errors.
+type UnsafeRandomFSServer interface {
+	mustEmbedUnimplementedRandomFSServer()
+}
+
+func RegisterRandomFSServer(s grpc.ServiceRegistrar, srv RandomFSServer) {
+	// If the following call pancis, it indicates UnimplementedRandomFSServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&RandomFS_ServiceDesc, srv)
+}
+
+func _RandomFS_Store_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(RandomFSServer).Store(&grpc.GenericServerStream[StoreRequest, StoreResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type RandomFS_StoreServer = grpc.ClientStreamingServer[StoreRequest, StoreResponse]
+
+func _RandomFS_Retrieve_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(RetrieveRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(RandomFSServer).Retrieve(m, &grpc.GenericServerStream[RetrieveRequest, RetrieveResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type RandomFS_RetrieveServer = grpc.ServerStreamingServer[RetrieveResponse]
+
+func _RandomFS_Stat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RandomFSServer).Stat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RandomFS_Stat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RandomFSServer).Stat(ctx, req.(*StatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RandomFS_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RandomFSServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RandomFS_Delete_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RandomFSServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _RandomFS_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RandomFSServer).List(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: RandomFS_List_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RandomFSServer).List(ctx, req.(*ListRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// RandomFS_ServiceDesc is the grpc.ServiceDesc for RandomFS service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var RandomFS_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "randomfs.v1.RandomFS",
+	HandlerType: (*RandomFSServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Stat",
+			Handler:    _RandomFS_Stat_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _RandomFS_Delete_Handler,
+		},
+		{
+			MethodName: "List",
+			Handler:    _RandomFS_List_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Store",
+			Handler:       _RandomFS_Store_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Retrieve",
+			Handler:       _RandomFS_Retrieve_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "randomfs/v1/randomfs.proto",
+}
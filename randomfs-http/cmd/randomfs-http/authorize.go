@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/TheEntropyCollective/randomfs-core/pkg/randomfs"
+)
+
+// Operation names what a request asks an Authorizer for
+type Operation string
+
+// Operations the API authorizes
+const (
+	OperationStore    Operation = "store"
+	OperationRetrieve Operation = "retrieve"
+	OperationDelete   Operation = "delete"
+	OperationList     Operation = "list"
+)
+
+// Authorizer decides whether a request may perform an operation. repHash
+// is the file being retrieved or deleted and empty for stores and
+// listings. Integrators implement
+// it to check API keys, JWTs, client addresses and the like.
+type Authorizer interface {
+	Authorize(r *http.Request, op Operation, repHash string) bool
+}
+
+// AuthorizerFunc adapts a function to the Authorizer interface
+type AuthorizerFunc func(r *http.Request, op Operation, repHash string) bool
+
+// Authorize calls f
+func (f AuthorizerFunc) Authorize(r *http.Request, op Operation, repHash string) bool {
+	return f(r, op, repHash)
+}
+
+// AllowAll is the default Authorizer, which permits every request
+var AllowAll Authorizer = AuthorizerFunc(func(*http.Request, Operation, string) bool { return true })
+
+// APIKeyAuthorizer permits requests carrying one of its keys as a bearer
+// token in the Authorization header and denies all others, except for the
+// operations made public with AllowPublic
+type APIKeyAuthorizer struct {
+	keys   [][]byte
+	public map[Operation]bool
+}
+
+// NewAPIKeyAuthorizer creates an authorizer accepting the given keys.
+// Empty keys are ignored, so with none every request is denied.
+func NewAPIKeyAuthorizer(keys ...string) *APIKeyAuthorizer {
+	a := &APIKeyAuthorizer{}
+	for _, key := range keys {
+		if key != "" {
+			a.keys = append(a.keys, []byte(key))
+		}
+	}
+	return a
+}
+
+// AllowPublic lets requests for ops through without a key, such as
+// OperationRetrieve to keep downloads open while stores need a key
+func (a *APIKeyAuthorizer) AllowPublic(ops ...Operation) *APIKeyAuthorizer {
+	if a.public == nil {
+		a.public = make(map[Operation]bool)
+	}
+	for _, op := range ops {
+		a.public[op] = true
+	}
+	return a
+}
+
+// Authorize reports whether op is public or r carries an accepted key
+func (a *APIKeyAuthorizer) Authorize(r *http.Request, op Operation, repHash string) bool {
+	if a.public[op] {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return false
+	}
+	for _, key := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(token), key) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// ApplyConfig applies the front-end settings of cfg: its API keys, which
+// then authorize every operation but retrievals with PublicRetrieval, and
+// its rate limit. It must be called before the server starts.
+func (s *Server) ApplyConfig(cfg randomfs.Config) {
+	if len(cfg.APIKeys) > 0 {
+		authorizer := NewAPIKeyAuthorizer(cfg.APIKeys...)
+		if cfg.PublicRetrieval {
+			authorizer.AllowPublic(OperationRetrieve)
+		}
+		s.SetAuthorizer(authorizer)
+	}
+	s.SetRateLimit(cfg.RateLimit, cfg.RateBurst)
+}
+
+// SetAuthorizer replaces the authorizer consulted before every API
+// operation. Nil restores AllowAll.
+func (s *Server) SetAuthorizer(authorizer Authorizer) {
+	if authorizer == nil {
+		authorizer = AllowAll
+	}
+	s.authorizer = authorizer
+}
+
+// authorize asks the authorizer whether r may perform op, answering the
+// request with 403 Forbidden if not
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, op Operation, repHash string) bool {
+	if s.authorizer.Authorize(r, op, repHash) {
+		return true
+	}
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return false
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/TheEntropyCollective/randomfs-core/pkg/randomfs"
+)
+
+func TestAPIKeyAuthorizerDeniesByDefault(t *testing.T) {
+	s := newTestServer(t)
+	s.SetAuthorizer(NewAPIKeyAuthorizer("good-key"))
+
+	// send serves req with the given bearer token, if any
+	send := func(req *http.Request, token string) *httptest.ResponseRecorder {
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	data := []byte("only for key holders")
+	for _, token := range []string{"", "bad-key"} {
+		rec := send(newUploadRequest(t, "secret.txt", "text/plain", data, nil), token)
+		if rec.Code != http.StatusForbidden {
+			t.Fatalf("store with token %q returned %d, want 403", token, rec.Code)
+		}
+	}
+	if files := s.rfs.ListFiles(); len(files) != 0 {
+		t.Fatalf("denied store indexed %d files", len(files))
+	}
+
+	rec := send(newUploadRequest(t, "secret.txt", "text/plain", data, nil), "good-key")
+	url, hash := storeResponse(t, rec)
+
+	if rec := send(httptest.NewRequest(http.MethodGet, "/api/v1/retrieve/"+hash, nil), ""); rec.Code != http.StatusForbidden {
+		t.Errorf("retrieve without key returned %d, want 403", rec.Code)
+	}
+	rdPath := "/rd/" + url[len("rd://"):]
+	if rec := send(httptest.NewRequest(http.MethodGet, rdPath, nil), "bad-key"); rec.Code != http.StatusForbidden {
+		t.Errorf("rd:// retrieve with a bad key returned %d, want 403", rec.Code)
+	}
+	rec = send(httptest.NewRequest(http.MethodGet, "/api/v1/retrieve/"+hash, nil), "good-key")
+	if rec.Code != http.StatusOK || rec.Body.String() != string(data) {
+		t.Errorf("retrieve with key returned %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAuthorizerSeesOperationAndHash(t *testing.T) {
+	s := newTestServer(t)
+	_, hash := storeResponse(t, uploadFile(t, s, "open.txt", "text/plain", []byte("open"), nil))
+
+	var gotOp Operation
+	var gotHash string
+	s.SetAuthorizer(AuthorizerFunc(func(r *http.Request, op Operation, repHash string) bool {
+		gotOp, gotHash = op, repHash
+		return op == OperationRetrieve
+	}))
+
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/retrieve/"+hash, nil))
+	if rec.Code != http.StatusOK || gotOp != OperationRetrieve || gotHash != hash {
+		t.Errorf("retrieve returned %d and asked about %s %q", rec.Code, gotOp, gotHash)
+	}
+	if rec := uploadFile(t, s, "closed.txt", "text/plain", []byte("closed"), nil); rec.Code != http.StatusForbidden || gotOp != OperationStore {
+		t.Errorf("store returned %d and asked about %s", rec.Code, gotOp)
+	}
+
+	// Clearing the authorizer restores the open default
+	s.SetAuthorizer(nil)
+	storeResponse(t, uploadFile(t, s, "reopened.txt", "text/plain", []byte("reopened"), nil))
+}
+
+func TestApplyConfigKeepsRetrievalPublic(t *testing.T) {
+	s := newTestServer(t)
+	s.ApplyConfig(randomfs.Config{APIKeys: []string{"good-key"}, PublicRetrieval: true})
+
+	req := newUploadRequest(t, "public.txt", "text/plain", []byte("public"), nil)
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("store without key returned %d, want 403", rec.Code)
+	}
+	req = newUploadRequest(t, "public.txt", "text/plain", []byte("public"), nil)
+	req.Header.Set("Authorization", "Bearer good-key")
+	rec = httptest.NewRecorder()
+	s.router.ServeHTTP(rec, req)
+	_, hash := storeResponse(t, rec)
+
+	rec = httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/retrieve/"+hash, nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "public" {
+		t.Errorf("public retrieve returned %d %q", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/api/v1/files/"+hash, nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("delete without key returned %d, want 403", rec.Code)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/TheEntropyCollective/randomfs-core/pkg/randomfs"
+)
+
+func main() {
+	port := flag.Int("port", randomfs.DefaultHTTPPort, "HTTP port to listen on")
+	dataDir := flag.String("data", randomfs.DefaultDataDir, "Data directory")
+	ipfsAPI := flag.String("ipfs", randomfs.DefaultIPFSAPI, "IPFS API endpoint")
+	noIPFS := flag.Bool("no-ipfs", false, "Run without IPFS, storing blocks locally")
+	gateway := flag.String("gateway", "", "IPFS gateway to read from when the API is unreachable, such as https://ipfs.io")
+	webDir := flag.String("web", "", "Directory of web interface files to serve")
+	cacheSize := flag.Int64("cache", randomfs.DefaultCacheSize, "Block cache size in bytes")
+	persistentCache := flag.Bool("persistent-cache", false, "Keep cached blocks in the data directory so the cache is warm after a restart")
+	partitionCache := flag.Bool("partition-cache", false, "Give each block size tier its own share of the block cache")
+	readOnly := flag.Bool("read-only", false, "Serve files from an existing data directory without accepting uploads")
+	requireTokens := flag.Bool("require-token", false, "Require a capability token for every retrieval")
+	adminToken := flag.String("admin-token", "", "Bearer token for the /admin maintenance endpoints (disabled when empty)")
+	apiKeys := flag.String("api-keys", "", "Comma-separated API keys required as bearer tokens to store and retrieve (open when empty)")
+	publicRetrieval := flag.Bool("public-retrieval", false, "Let files be retrieved without an API key when -api-keys is set")
+	rateLimit := flag.Float64("rate-limit", 0, "Requests per second accepted from each client IP (unlimited when 0)")
+	rateBurst := flag.Int("rate-burst", 0, "Requests a client IP may make at once under -rate-limit (the rate rounded up when 0)")
+	pinPolicy := flag.String("pin", randomfs.PinAll.String(), "What stores pin with IPFS: all, representation-only or none")
+	s3Port := flag.Int("s3-port", 0, "Port to serve the S3-compatible API on (disabled when 0)")
+	s3Bucket := flag.String("s3-bucket", DefaultS3Bucket, "Bucket name the S3-compatible API serves the files as")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "How long to wait for requests and background work to finish on shutdown")
+	maxFileSize := flag.Int64("max-file-size", 0, "Largest file in bytes accepted for storing (unlimited when 0)")
+	halfLife := flag.Duration("popularity-half-life", 0, "Age at which a file's references count half towards block popularity (no decay when 0)")
+	logLevel := slog.LevelInfo
+	flag.TextVar(&logLevel, "log-level", slog.LevelInfo, "Lowest level logged: debug, info, warn or error")
+	logJSON := flag.Bool("log-json", false, "Log records as JSON lines instead of text")
+	maintenance := flag.Duration("maintenance", randomfs.DefaultMaintenanceInterval, "How often to re-pin files, probe IPFS and prune the cache (disabled when 0)")
+	flag.Parse()
+
+	logger := newLogger(logLevel, *logJSON)
+	slog.SetDefault(logger)
+
+	pin, err := randomfs.ParsePinPolicy(*pinPolicy)
+	if err != nil {
+		fatal("Invalid -pin", "error", err)
+	}
+	cfg := randomfs.Config{
+		EnableIPFS:         !*noIPFS,
+		IPFSAPI:            *ipfsAPI,
+		GatewayURL:         *gateway,
+		DataDir:            *dataDir,
+		CacheSize:          *cacheSize,
+		PersistentCache:    *persistentCache,
+		HTTPPort:           *port,
+		ReadOnly:           *readOnly,
+		PinPolicy:          pin,
+		MaxFileSize:        *maxFileSize,
+		PopularityHalfLife: *halfLife,
+		PublicRetrieval:    *publicRetrieval,
+		RateLimit:          *rateLimit,
+		RateBurst:          *rateBurst,
+		Logger:             logger,
+	}
+	if *apiKeys != "" {
+		cfg.APIKeys = strings.Split(*apiKeys, ",")
+	}
+	rfs, err := randomfs.NewRandomFSWithConfig(cfg)
+	if err != nil {
+		fatal("Failed to initialize RandomFS", "error", err)
+	}
+	if *partitionCache {
+		rfs.Cache().SetPartitions(randomfs.DefaultCachePartitions(*cacheSize))
+	}
+	if *maintenance > 0 {
+		maintenanceConfig := randomfs.DefaultMaintenanceConfig()
+		maintenanceConfig.Interval = *maintenance
+		rfs.StartMaintenance(maintenanceConfig)
+	}
+
+	server := NewServer(rfs, cfg.HTTPPort, *webDir)
+	server.requireTokens = *requireTokens
+	server.adminToken = *adminToken
+	server.ApplyConfig(cfg.WithDefaults())
+	var s3Server *http.Server
+	if *s3Port != 0 {
+		s3Server = &http.Server{Addr: fmt.Sprintf(":%d", *s3Port), Handler: server.S3Handler(*s3Bucket)}
+		go func() {
+			slog.Info("RandomFS S3 gateway listening", "bucket", *s3Bucket, "addr", s3Server.Addr)
+			if err := s3Server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fatal("S3 gateway failed", "error", err)
+			}
+		}()
+	}
+
+	// On a signal, finish the requests in progress, then flush and close
+	// the instance before exiting
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		slog.Info("Shutting down")
+
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if s3Server != nil {
+			if err := s3Server.Shutdown(ctx); err != nil {
+				slog.Error("Failed to shut down S3 gateway", "error", err)
+			}
+		}
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Error("Failed to shut down server", "error", err)
+		}
+		if err := rfs.CloseContext(ctx); err != nil {
+			slog.Error("Failed to close RandomFS", "error", err)
+		}
+	}()
+
+	if err := server.Start(); err != nil {
+		fatal("Server failed", "error", err)
+	}
+	<-stopped
+}
+
+// newLogger returns a logger writing records of level and above to
+// stderr, as JSON lines if json is set
+func newLogger(level slog.Level, json bool) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if json {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
+}
+
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/TheEntropyCollective/randomfs-core/pkg/randomfs"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// gaugeStats are the statistics that can go down; the others only count up
+var gaugeStats = map[string]bool{
+	"total_size":            true,
+	"unique_blocks":         true,
+	"block_references":      true,
+	"popular_pool_size":     true,
+	"popular_pool_hit_rate": true,
+}
+
+// serverMetrics exports the statistics of a RandomFS instance and the
+// latencies it observes to Prometheus. It is the Metrics observer of the
+// instance.
+type serverMetrics struct {
+	registry          *prometheus.Registry
+	ipfsDuration      *prometheus.HistogramVec
+	operationDuration *prometheus.HistogramVec
+}
+
+// newServerMetrics creates the metrics of rfs and registers them with a
+// new registry
+func newServerMetrics(rfs *randomfs.RandomFS) *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		ipfsDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "randomfs_ipfs_request_duration_seconds",
+			Help:    "Latency of IPFS add and cat calls, including retries",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"op", "result"}),
+		operationDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "randomfs_operation_duration_seconds",
+			Help:    "Duration of file stores and retrievals from start to finish",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+		}, []string{"op", "result"}),
+	}
+	m.registry.MustRegister(
+		statsCollector{rfs},
+		m.ipfsDuration,
+		m.operationDuration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// handler serves the metrics in the Prometheus exposition format
+func (m *serverMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// ObserveIPFSCall records the latency of an IPFS call
+func (m *serverMetrics) ObserveIPFSCall(op string, duration time.Duration, err error) {
+	m.ipfsDuration.WithLabelValues(op, result(err)).Observe(duration.Seconds())
+}
+
+// ObserveOperation records the duration of a store or retrieval
+func (m *serverMetrics) ObserveOperation(op string, duration time.Duration, err error) {
+	m.operationDuration.WithLabelValues(op, result(err)).Observe(duration.Seconds())
+}
+
+// result returns the result label of a call that returned err
+func result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// statsCollector exports the fields of GetStats as randomfs_<field>
+// metrics, named as in /api/v1/stats
+type statsCollector struct {
+	rfs *randomfs.RandomFS
+}
+
+// Describe implements prometheus.Collector
+func (c statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+// Collect implements prometheus.Collector
+func (c statsCollector) Collect(ch chan<- prometheus.Metric) {
+	data, err := json.Marshal(c.rfs.GetStats())
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(prometheus.NewDesc("randomfs_stats", "RandomFS statistics", nil, nil), err)
+		return
+	}
+	var stats map[string]float64
+	if err := json.Unmarshal(data, &stats); err != nil {
+		ch <- prometheus.NewInvalidMetric(prometheus.NewDesc("randomfs_stats", "RandomFS statistics", nil, nil), err)
+		return
+	}
+
+	for name, value := range stats {
+		valueType := prometheus.CounterValue
+		if gaugeStats[name] {
+			valueType = prometheus.GaugeValue
+		}
+		desc := prometheus.NewDesc("randomfs_"+name, "RandomFS "+strings.ReplaceAll(name, "_", " "), nil, nil)
+		ch <- prometheus.MustNewConstMetric(desc, valueType, value)
+	}
+}
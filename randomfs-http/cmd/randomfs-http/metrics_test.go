@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TheEntropyCollective/randomfs-core/pkg/randomfs"
+)
+
+func TestMetricsExposeLatencyHistograms(t *testing.T) {
+	s := newTestServer(t)
+	_, hash := storeResponse(t, uploadFile(t, s, "a.txt", "text/plain", []byte("measured"), nil))
+	for _, path := range []string{"/api/v1/retrieve/" + hash, "/api/v1/retrieve/missing"} {
+		s.router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	// The test instance runs without IPFS, so report its calls directly
+	s.metrics.ObserveIPFSCall(randomfs.OpIPFSCat, 20*time.Millisecond, nil)
+	s.metrics.ObserveIPFSCall(randomfs.OpIPFSAdd, 3*time.Second, errors.New("timeout"))
+
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("metrics returned %d", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE randomfs_files_stored counter\n",
+		"# TYPE randomfs_total_size gauge\n",
+		"randomfs_files_retrieved 1\n",
+		"randomfs_cache_hits ",
+		"randomfs_cache_misses ",
+		"# TYPE randomfs_popular_pool_hit_rate gauge\n",
+		`randomfs_operation_duration_seconds_count{op="store",result="success"} 1` + "\n",
+		`randomfs_operation_duration_seconds_count{op="retrieve",result="success"} 1` + "\n",
+		`randomfs_ipfs_request_duration_seconds_bucket{op="cat",result="success",le="0.025"} 1` + "\n",
+		`randomfs_ipfs_request_duration_seconds_bucket{op="add",result="failure",le="2.5"} 0` + "\n",
+		`randomfs_ipfs_request_duration_seconds_count{op="add",result="failure"} 1` + "\n",
+		"go_goroutines ",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("metrics missing %q:\n%s", line, body)
+		}
+	}
+}
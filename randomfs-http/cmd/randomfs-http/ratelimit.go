@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitPruneSize is the number of clients tracked before buckets that
+// have refilled are dropped
+const rateLimitPruneSize = 4096
+
+// rateLimiter keeps a token bucket per client address. Each request takes
+// a token; buckets refill at rate tokens per second up to burst.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// tokenBucket holds the tokens a client had left at last
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(max(burst, 1)),
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from the bucket of client. If none is left it
+// returns false and how long until one is.
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	bucket, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= rateLimitPruneSize {
+			l.prune(now)
+		}
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = bucket
+	}
+	bucket.tokens = min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// prune drops the buckets that have refilled, which a new bucket would
+// start out the same as
+func (l *rateLimiter) prune(now time.Time) {
+	for client, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// SetRateLimit limits each client address to rate requests per second,
+// with bursts of up to burst requests, answering requests over the limit
+// with 429 Too Many Requests. A rate of zero removes the limit. It must
+// be called before the server starts.
+func (s *Server) SetRateLimit(rate float64, burst int) {
+	if rate <= 0 {
+		s.limiter = nil
+		return
+	}
+	s.limiter = newRateLimiter(rate, burst)
+}
+
+// rateLimitMiddleware refuses requests from clients over the rate limit
+func (s *Server) rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.limiter != nil {
+			if ok, wait := s.limiter.allow(clientAddress(r)); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientAddress returns the IP address a request came from. Forwarding
+// headers are not trusted, so behind a proxy every client shares its
+// address.
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitPerClientAddress(t *testing.T) {
+	s := newTestServer(t)
+	s.SetRateLimit(1, 2)
+	now := time.Unix(1000, 0)
+	s.limiter.now = func() time.Time { return now }
+
+	// stats requests /api/v1/stats from addr
+	stats := func(addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/stats", nil)
+		req.RemoteAddr = addr + ":40000"
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := stats("192.0.2.1"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d within the burst returned %d", i, rec.Code)
+		}
+	}
+	rec := stats("192.0.2.1")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("request over the burst returned %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := stats("192.0.2.2"); rec.Code != http.StatusOK {
+		t.Errorf("another client was limited with %d", rec.Code)
+	}
+
+	now = now.Add(time.Second)
+	if rec := stats("192.0.2.1"); rec.Code != http.StatusOK {
+		t.Errorf("request after a token refilled returned %d", rec.Code)
+	}
+	if rec := stats("192.0.2.1"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("second request after one token refilled returned %d", rec.Code)
+	}
+
+	s.SetRateLimit(0, 0)
+	if rec := stats("192.0.2.1"); rec.Code != http.StatusOK {
+		t.Errorf("request with the limit removed returned %d", rec.Code)
+	}
+}
+
+func TestRateLimiterForgetsIdleClients(t *testing.T) {
+	limiter := newRateLimiter(10, 1)
+	now := time.Unix(1000, 0)
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < rateLimitPruneSize; i++ {
+		limiter.allow(fmt.Sprintf("client-%d", i))
+	}
+	limiter.allow("client-0")
+	now = now.Add(time.Second)
+	if ok, _ := limiter.allow("newcomer"); !ok {
+		t.Fatal("a new client was limited")
+	}
+	if len(limiter.buckets) != 1 {
+		t.Errorf("%d buckets kept after every old client refilled", len(limiter.buckets))
+	}
+}
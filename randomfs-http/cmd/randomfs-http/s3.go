@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TheEntropyCollective/randomfs-core/pkg/randomfs"
+)
+
+// DefaultS3Bucket is the bucket the S3 gateway serves by default
+const DefaultS3Bucket = "randomfs"
+
+// s3Namespace is the XML namespace of S3 responses
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// s3MaxKeys is the most objects a listing returns per page
+const s3MaxKeys = 1000
+
+// S3Handler serves the file index as a single bucket through a minimal
+// path-style S3 API: listing buckets and objects, and putting, getting
+// and deleting objects. Object keys are stored as filenames, so a key
+// names the most recently stored file of that name, and putting a key
+// replaces the files stored under it. Slashes in keys are escaped, since
+// the index is flat.
+//
+// Requests are authorized with the server's Authorizer, the access key ID
+// of a signed request standing in for a bearer token. Signatures are not
+// verified, so keys are only as secret as the network they travel over.
+func (s *Server) S3Handler(bucket string) http.Handler {
+	return s.rateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		switch {
+		case name == "":
+			if r.Method != http.MethodGet {
+				writeS3Error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "Method not allowed")
+				return
+			}
+			s.handleS3ListBuckets(w, r, bucket)
+		case name != bucket:
+			writeS3Error(w, r, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		case key == "":
+			s.handleS3Bucket(w, r, bucket)
+		default:
+			s.handleS3Object(w, r, key)
+		}
+	}))
+}
+
+// s3Names maps object keys to filenames and s3Keys maps them back
+var (
+	s3Names = strings.NewReplacer("%", "%25", "/", "%2F")
+	s3Keys  = strings.NewReplacer("%2F", "/", "%25", "%")
+)
+
+// handleS3Bucket answers requests for the bucket itself
+func (s *Server) handleS3Bucket(w http.ResponseWriter, r *http.Request, bucket string) {
+	switch r.Method {
+	case http.MethodGet:
+		s.handleS3ListObjects(w, r, bucket)
+	case http.MethodHead, http.MethodPut:
+		// The bucket always exists, so creating it succeeds
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeS3Error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "Method not allowed")
+	}
+}
+
+// handleS3Object answers requests for an object
+func (s *Server) handleS3Object(w http.ResponseWriter, r *http.Request, key string) {
+	query := r.URL.Query()
+	if query.Has("uploads") || query.Has("uploadId") || r.Header.Get("X-Amz-Copy-Source") != "" {
+		writeS3Error(w, r, http.StatusNotImplemented, "NotImplemented", "Multipart uploads and copies are not supported")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.handleS3GetObject(w, r, key)
+	case http.MethodPut:
+		s.handleS3PutObject(w, r, key)
+	case http.MethodDelete:
+		s.handleS3DeleteObject(w, r, key)
+	default:
+		writeS3Error(w, r, http.StatusMethodNotAllowed, "MethodNotAllowed", "Method not allowed")
+	}
+}
+
+// s3Objects returns the most recently stored file of each name by key
+func (s *Server) s3Objects() map[string]randomfs.FileInfo {
+	objects := make(map[string]randomfs.FileInfo)
+	for _, file := range s.rfs.ListFiles() {
+		key := s3Keys.Replace(file.FileName)
+		if current, exists := objects[key]; !exists || !file.StoredAt.Before(current.StoredAt) {
+			objects[key] = file
+		}
+	}
+	return objects
+}
+
+// s3Object returns the file a key names
+func (s *Server) s3Object(key string) (randomfs.FileInfo, bool) {
+	var latest randomfs.FileInfo
+	found := false
+	name := s3Names.Replace(key)
+	for _, file := range s.rfs.ListFiles() {
+		if file.FileName == name && (!found || !file.StoredAt.Before(latest.StoredAt)) {
+			latest, found = file, true
+		}
+	}
+	return latest, found
+}
+
+// handleS3GetObject streams an object, answering range and conditional
+// requests without reconstructing the blocks that are not sent
+func (s *Server) handleS3GetObject(w http.ResponseWriter, r *http.Request, key string) {
+	file, exists := s.s3Object(key)
+	if !s.authorizeS3(w, r, OperationRetrieve, file.RepHash) {
+		return
+	}
+	if !exists {
+		writeS3Error(w, r, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+		return
+	}
+
+	stream, err := s.rfs.OpenFileStream(file.RepHash)
+	if err != nil {
+		writeS3Error(w, r, http.StatusInternalServerError, "InternalError", fmt.Sprintf("Failed to retrieve object: %v", err))
+		return
+	}
+	defer stream.Close()
+
+	w.Header().Set("Content-Type", stream.Representation().ContentType)
+	w.Header().Set("ETag", fmt.Sprintf("%q", file.RepHash))
+	w.Header().Set("Accept-Ranges", "bytes")
+	http.ServeContent(w, r, "", file.StoredAt, stream)
+}
+
+// handleS3PutObject stores an object, replacing the files stored under
+// its key. Like the ETag of every object, the one returned is the quoted
+// representation hash rather than an MD5 of the content; a Content-MD5
+// header is still checked.
+func (s *Server) handleS3PutObject(w http.ResponseWriter, r *http.Request, key string) {
+	if !s.authorizeS3(w, r, OperationStore, "") {
+		return
+	}
+
+	body := io.Reader(r.Body)
+	if strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		body = newAWSChunkedReader(r.Body)
+	}
+	if limit := s.rfs.MaxFileSize; limit > 0 {
+		// Read one byte past the limit to tell a file at it from a larger one
+		body = io.LimitReader(body, limit+1)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		writeS3Error(w, r, http.StatusBadRequest, "IncompleteBody", fmt.Sprintf("Failed to read object: %v", err))
+		return
+	}
+	if limit := s.rfs.MaxFileSize; limit > 0 && int64(len(data)) > limit {
+		writeS3Error(w, r, http.StatusRequestEntityTooLarge, "EntityTooLarge", fmt.Sprintf("Object exceeds the maximum size of %d bytes", limit))
+		return
+	}
+	if want := r.Header.Get("Content-MD5"); want != "" {
+		digest := md5.Sum(data)
+		if base64.StdEncoding.EncodeToString(digest[:]) != want {
+			writeS3Error(w, r, http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what was received")
+			return
+		}
+	}
+
+	name := s3Names.Replace(key)
+	randomURL, err := s.rfs.StoreFile(name, data, r.Header.Get("Content-Type"))
+	if err == nil {
+		err = s.removeS3Files(name, randomURL.RepHash)
+	}
+	switch {
+	case errors.Is(err, randomfs.ErrReadOnly):
+		writeS3Error(w, r, http.StatusForbidden, "AccessDenied", "Server is read-only")
+	case errors.Is(err, randomfs.ErrFileTooLarge):
+		writeS3Error(w, r, http.StatusRequestEntityTooLarge, "EntityTooLarge", err.Error())
+	case errors.Is(err, randomfs.ErrFilenameRejected), errors.Is(err, randomfs.ErrDuplicateName):
+		writeS3Error(w, r, http.StatusBadRequest, "InvalidArgument", err.Error())
+	case err != nil:
+		writeS3Error(w, r, http.StatusInternalServerError, "InternalError", fmt.Sprintf("Failed to store object: %v", err))
+	default:
+		w.Header().Set("ETag", fmt.Sprintf("%q", randomURL.RepHash))
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// removeS3Files deletes the files named name other than keep
+func (s *Server) removeS3Files(name, keep string) error {
+	for _, file := range s.rfs.ListFiles() {
+		if file.FileName != name || file.RepHash == keep {
+			continue
+		}
+		if err := s.rfs.DeleteFile(file.RepHash); err != nil && !errors.Is(err, randomfs.ErrFileNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleS3DeleteObject deletes every file stored under a key. Deleting a
+// key that does not exist succeeds, as in S3.
+func (s *Server) handleS3DeleteObject(w http.ResponseWriter, r *http.Request, key string) {
+	file, _ := s.s3Object(key)
+	if !s.authorizeS3(w, r, OperationDelete, file.RepHash) {
+		return
+	}
+
+	err := s.removeS3Files(s3Names.Replace(key), "")
+	if errors.Is(err, randomfs.ErrReadOnly) {
+		writeS3Error(w, r, http.StatusForbidden, "AccessDenied", "Server is read-only")
+		return
+	}
+	if err != nil {
+		writeS3Error(w, r, http.StatusInternalServerError, "InternalError", fmt.Sprintf("Failed to delete object: %v", err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// s3Bucket describes a bucket in a bucket listing
+type s3Bucket struct {
+	Name         string
+	CreationDate string
+}
+
+// s3ListAllMyBucketsResult is the response to a bucket listing
+type s3ListAllMyBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+// s3Owner is the owner of the bucket
+type s3Owner struct {
+	ID          string
+	DisplayName string
+}
+
+// handleS3ListBuckets lists the one bucket
+func (s *Server) handleS3ListBuckets(w http.ResponseWriter, r *http.Request, bucket string) {
+	if !s.authorizeS3(w, r, OperationList, "") {
+		return
+	}
+	writeXML(w, http.StatusOK, s3ListAllMyBucketsResult{
+		Xmlns:   s3Namespace,
+		Owner:   s3Owner{ID: "randomfs", DisplayName: "randomfs"},
+		Buckets: []s3Bucket{{Name: bucket, CreationDate: formatS3Time(time.Unix(0, 0))}},
+	})
+}
+
+// s3Contents describes an object in an object listing
+type s3Contents struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+// s3CommonPrefix is a group of keys rolled up by the delimiter
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+// s3ListBucketResult is the response to ListObjects and ListObjectsV2
+type s3ListBucketResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	MaxKeys               int
+	IsTruncated           bool
+	Marker                *string `xml:",omitempty"`
+	NextMarker            string  `xml:",omitempty"`
+	KeyCount              *int    `xml:",omitempty"`
+	ContinuationToken     string  `xml:",omitempty"`
+	NextContinuationToken string  `xml:",omitempty"`
+	StartAfter            string  `xml:",omitempty"`
+	Contents              []s3Contents
+	CommonPrefixes        []s3CommonPrefix
+}
+
+// handleS3ListObjects lists the objects of the bucket in key order,
+// answering both ListObjects and ListObjectsV2 (list-type=2)
+func (s *Server) handleS3ListObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	if !s.authorizeS3(w, r, OperationList, "") {
+		return
+	}
+
+	query := r.URL.Query()
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	maxKeys := s3MaxKeys
+	if value := query.Get("max-keys"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeS3Error(w, r, http.StatusBadRequest, "InvalidArgument", fmt.Sprintf("Invalid max-keys %q", value))
+			return
+		}
+		maxKeys = min(n, s3MaxKeys)
+	}
+	v2 := query.Get("list-type") == "2"
+	after := query.Get("marker")
+	if v2 {
+		after = max(query.Get("start-after"), query.Get("continuation-token"))
+	}
+
+	objects := s.s3Objects()
+	keys := make([]string, 0, len(objects))
+	for key := range objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := s3ListBucketResult{
+		Xmlns:     s3Namespace,
+		Name:      bucket,
+		Prefix:    prefix,
+		Delimiter: delimiter,
+		MaxKeys:   maxKeys,
+	}
+	seen := make(map[string]bool)
+	last := ""
+	for _, key := range keys {
+		prefixed := ""
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				prefixed = key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		// Keys rolled into a prefix already listed count no further
+		if prefixed != "" && seen[prefixed] {
+			continue
+		}
+		if len(result.Contents)+len(result.CommonPrefixes) == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		if prefixed != "" {
+			seen[prefixed] = true
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: prefixed})
+			// Resume after every key under the prefix
+			last = prefixed + "\U0010FFFF"
+			continue
+		}
+		file := objects[key]
+		result.Contents = append(result.Contents, s3Contents{
+			Key:          key,
+			LastModified: formatS3Time(file.StoredAt),
+			ETag:         fmt.Sprintf("%q", file.RepHash),
+			Size:         file.FileSize,
+			StorageClass: "STANDARD",
+		})
+		last = key
+	}
+
+	if v2 {
+		count := len(result.Contents) + len(result.CommonPrefixes)
+		result.KeyCount = &count
+		result.ContinuationToken = query.Get("continuation-token")
+		result.StartAfter = query.Get("start-after")
+		if result.IsTruncated {
+			result.NextContinuationToken = last
+		}
+	} else {
+		marker := query.Get("marker")
+		result.Marker = &marker
+		if result.IsTruncated {
+			result.NextMarker = last
+		}
+	}
+	writeXML(w, http.StatusOK, result)
+}
+
+// formatS3Time formats a time as S3 listings do
+func formatS3Time(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// authorizeS3 asks the authorizer whether r may perform op, presenting
+// the access key ID of a signed request as a bearer token, and answers
+// the request with an AccessDenied error if not
+func (s *Server) authorizeS3(w http.ResponseWriter, r *http.Request, op Operation, repHash string) bool {
+	authorized := r
+	if accessKey := s3AccessKey(r); accessKey != "" {
+		authorized = r.Clone(r.Context())
+		authorized.Header.Set("Authorization", "Bearer "+accessKey)
+	}
+	if s.authorizer.Authorize(authorized, op, repHash) {
+		return true
+	}
+	writeS3Error(w, r, http.StatusForbidden, "AccessDenied", "Access Denied")
+	return false
+}
+
+// s3AccessKey returns the access key ID a request is signed with, from a
+// Signature Version 4 or 2 Authorization header or a presigned URL
+func s3AccessKey(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if rest, ok := strings.CutPrefix(auth, "AWS4-HMAC-SHA256 "); ok {
+		for _, field := range strings.Split(rest, ",") {
+			if credential, ok := strings.CutPrefix(strings.TrimSpace(field), "Credential="); ok {
+				accessKey, _, _ := strings.Cut(credential, "/")
+				return accessKey
+			}
+		}
+	}
+	if rest, ok := strings.CutPrefix(auth, "AWS "); ok {
+		accessKey, _, _ := strings.Cut(rest, ":")
+		return accessKey
+	}
+	if credential := r.URL.Query().Get("X-Amz-Credential"); credential != "" {
+		accessKey, _, _ := strings.Cut(credential, "/")
+		return accessKey
+	}
+	return r.URL.Query().Get("AWSAccessKeyId")
+}
+
+// s3Error is the body of an S3 error response
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string
+	Message  string
+	Resource string
+}
+
+// writeS3Error answers a request with an S3 error
+func writeS3Error(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+	writeXML(w, status, s3Error{Code: code, Message: message, Resource: r.URL.Path})
+}
+
+// writeXML writes v as an XML response
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	var body bytes.Buffer
+	body.WriteString(xml.Header)
+	if err := xml.NewEncoder(&body).Encode(v); err != nil {
+		slog.Error("Failed to encode response", "error", err)
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
+
+// awsChunkedReader decodes a body sent with the aws-chunked content
+// encoding, which S3 clients use to sign or checksum uploads as they
+// stream. Chunk signatures and trailing checksums are not checked.
+type awsChunkedReader struct {
+	r         *bufio.Reader
+	remaining int64
+	done      bool
+}
+
+func newAWSChunkedReader(r io.Reader) *awsChunkedReader {
+	return &awsChunkedReader{r: bufio.NewReader(r)}
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := c.r.Read(p[:min(int64(len(p)), c.remaining)])
+	c.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// nextChunk reads the header of the next chunk, and the line ending of
+// the chunk before it
+func (c *awsChunkedReader) nextChunk() error {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read chunk header: %v", err)
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		// The line ending after the data of the previous chunk
+		return nil
+	}
+	sizeField, _, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(sizeField, 16, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("invalid chunk header %q", line)
+	}
+	c.remaining = size
+	// The last chunk is empty; trailers after it are ignored
+	c.done = size == 0
+	return nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// s3Request sends a request to the S3 gateway of s serving the backup bucket
+func s3Request(s *Server, method, target, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rec := httptest.NewRecorder()
+	s.S3Handler("backup").ServeHTTP(rec, req)
+	return rec
+}
+
+// listS3 lists the backup bucket with query
+func listS3(t *testing.T, s *Server, query string) s3ListBucketResult {
+	t.Helper()
+	rec := s3Request(s, http.MethodGet, "/backup?"+query, "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("list %q returned %d: %s", query, rec.Code, rec.Body.String())
+	}
+	var result s3ListBucketResult
+	if err := xml.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatalf("decode list %q: %v", query, err)
+	}
+	return result
+}
+
+// s3ErrorCode decodes the code of an S3 error response
+func s3ErrorCode(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	var resp s3Error
+	if err := xml.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode error %q: %v", rec.Body.String(), err)
+	}
+	return resp.Code
+}
+
+func TestS3ObjectLifecycle(t *testing.T) {
+	s := newTestServer(t)
+	content := strings.Repeat("backup data ", 500)
+
+	rec := s3Request(s, http.MethodPut, "/backup/snapshots/2024/a.tar", content, map[string]string{"Content-Type": "application/x-tar"})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT returned %d: %s", rec.Code, rec.Body.String())
+	}
+	files := s.rfs.ListFiles()
+	if len(files) != 1 || rec.Header().Get("ETag") != fmt.Sprintf("%q", files[0].RepHash) {
+		t.Fatalf("PUT returned ETag %s and indexed %+v", rec.Header().Get("ETag"), files)
+	}
+
+	rec = s3Request(s, http.MethodGet, "/backup/snapshots/2024/a.tar", "", nil)
+	if rec.Code != http.StatusOK || rec.Body.String() != content {
+		t.Fatalf("GET returned %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/x-tar" {
+		t.Errorf("GET served content type %q", got)
+	}
+	rec = s3Request(s, http.MethodGet, "/backup/snapshots/2024/a.tar", "", map[string]string{"Range": "bytes=12-22"})
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "backup data" {
+		t.Fatalf("range GET returned %d: %q", rec.Code, rec.Body.String())
+	}
+	rec = s3Request(s, http.MethodHead, "/backup/snapshots/2024/a.tar", "", nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Length") != fmt.Sprint(len(content)) {
+		t.Errorf("HEAD returned %d with length %s", rec.Code, rec.Header().Get("Content-Length"))
+	}
+
+	// Putting a key again replaces its object
+	if rec := s3Request(s, http.MethodPut, "/backup/snapshots/2024/a.tar", "replaced", nil); rec.Code != http.StatusOK {
+		t.Fatalf("overwrite returned %d", rec.Code)
+	}
+	if files := s.rfs.ListFiles(); len(files) != 1 || files[0].FileSize != 8 {
+		t.Fatalf("overwrite left %+v", files)
+	}
+	if rec := s3Request(s, http.MethodGet, "/backup/snapshots/2024/a.tar", "", nil); rec.Body.String() != "replaced" {
+		t.Errorf("GET after overwrite returned %q", rec.Body.String())
+	}
+
+	if rec := s3Request(s, http.MethodDelete, "/backup/snapshots/2024/a.tar", "", nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE returned %d", rec.Code)
+	}
+	if files := s.rfs.ListFiles(); len(files) != 0 {
+		t.Fatalf("DELETE left %+v", files)
+	}
+	rec = s3Request(s, http.MethodGet, "/backup/snapshots/2024/a.tar", "", nil)
+	if rec.Code != http.StatusNotFound || s3ErrorCode(t, rec) != "NoSuchKey" {
+		t.Errorf("GET of a deleted key returned %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := s3Request(s, http.MethodDelete, "/backup/snapshots/2024/a.tar", "", nil); rec.Code != http.StatusNoContent {
+		t.Errorf("deleting a missing key returned %d", rec.Code)
+	}
+
+	rec = s3Request(s, http.MethodGet, "/other/key", "", nil)
+	if rec.Code != http.StatusNotFound || s3ErrorCode(t, rec) != "NoSuchBucket" {
+		t.Errorf("GET from another bucket returned %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := s3Request(s, http.MethodPost, "/backup/big.bin?uploads", "", nil); rec.Code != http.StatusNotImplemented {
+		t.Errorf("multipart upload returned %d", rec.Code)
+	}
+}
+
+func TestS3ListObjects(t *testing.T) {
+	s := newTestServer(t)
+	for _, key := range []string{"data/ab/1", "data/ab/2", "data/cd/3", "index/4", "config"} {
+		if rec := s3Request(s, http.MethodPut, "/backup/"+key, key, nil); rec.Code != http.StatusOK {
+			t.Fatalf("PUT %s returned %d", key, rec.Code)
+		}
+	}
+	keys := func(result s3ListBucketResult) string {
+		var keys []string
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+		for _, prefix := range result.CommonPrefixes {
+			keys = append(keys, prefix.Prefix)
+		}
+		return strings.Join(keys, " ")
+	}
+
+	all := listS3(t, s, "list-type=2")
+	if got := keys(all); got != "config data/ab/1 data/ab/2 data/cd/3 index/4" || all.IsTruncated {
+		t.Fatalf("listed %q", got)
+	}
+	if object := all.Contents[1]; object.Size != 9 || object.ETag == "" || object.LastModified == "" {
+		t.Errorf("listed %+v", object)
+	}
+	if got := keys(listS3(t, s, "list-type=2&prefix=data/")); got != "data/ab/1 data/ab/2 data/cd/3" {
+		t.Errorf("prefix listed %q", got)
+	}
+	if got := keys(listS3(t, s, "list-type=2&delimiter=/")); got != "config data/ index/" {
+		t.Errorf("delimiter listed %q", got)
+	}
+	if got := keys(listS3(t, s, "list-type=2&prefix=data/&delimiter=/")); got != "data/ab/ data/cd/" {
+		t.Errorf("prefix and delimiter listed %q", got)
+	}
+
+	// Pages resume after the prefix or key that ended the last one
+	var pages []string
+	query := "list-type=2&delimiter=/&max-keys=2"
+	for {
+		page := listS3(t, s, query)
+		pages = append(pages, keys(page))
+		if !page.IsTruncated {
+			break
+		}
+		query = "list-type=2&delimiter=/&max-keys=2&continuation-token=" + page.NextContinuationToken
+	}
+	if got := strings.Join(pages, " | "); got != "config data/ | index/" {
+		t.Errorf("paged through %q", got)
+	}
+	v1 := listS3(t, s, "max-keys=2")
+	if got := keys(v1); got != "config data/ab/1" || !v1.IsTruncated || v1.NextMarker != "data/ab/1" {
+		t.Errorf("ListObjects listed %q, next marker %q", got, v1.NextMarker)
+	}
+	if got := keys(listS3(t, s, "marker="+v1.NextMarker)); got != "data/ab/2 data/cd/3 index/4" {
+		t.Errorf("ListObjects after the marker listed %q", got)
+	}
+
+	rec := s3Request(s, http.MethodGet, "/", "", nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "<Name>backup</Name>") {
+		t.Errorf("bucket listing returned %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestS3PutChecksAndDecodesUploads(t *testing.T) {
+	s := newTestServer(t)
+
+	rec := s3Request(s, http.MethodPut, "/backup/file", "content", map[string]string{"Content-MD5": "AAAAAAAAAAAAAAAAAAAAAA=="})
+	if rec.Code != http.StatusBadRequest || s3ErrorCode(t, rec) != "BadDigest" {
+		t.Fatalf("PUT with a wrong Content-MD5 returned %d: %s", rec.Code, rec.Body.String())
+	}
+	digest := md5.Sum([]byte("content"))
+	rec = s3Request(s, http.MethodPut, "/backup/file", "content", map[string]string{"Content-MD5": base64.StdEncoding.EncodeToString(digest[:])})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT with a matching Content-MD5 returned %d: %s", rec.Code, rec.Body.String())
+	}
+
+	chunked := "5;chunk-signature=abc\r\nhello\r\n6;chunk-signature=def\r\n world\r\n0;chunk-signature=0\r\nx-amz-checksum-crc32:AAAAAA==\r\n\r\n"
+	rec = s3Request(s, http.MethodPut, "/backup/chunked", chunked, map[string]string{
+		"X-Amz-Content-Sha256": "STREAMING-UNSIGNED-PAYLOAD-TRAILER",
+		"Content-Encoding":     "aws-chunked",
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("aws-chunked PUT returned %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := s3Request(s, http.MethodGet, "/backup/chunked", "", nil); rec.Body.String() != "hello world" {
+		t.Errorf("aws-chunked upload stored %q", rec.Body.String())
+	}
+}
+
+func TestS3PutRejectsObjectsOverMaxFileSize(t *testing.T) {
+	s := newTestServer(t)
+	s.rfs.MaxFileSize = 5
+
+	if rec := s3Request(s, http.MethodPut, "/backup/small", "12345", nil); rec.Code != http.StatusOK {
+		t.Fatalf("PUT at the limit returned %d: %s", rec.Code, rec.Body.String())
+	}
+	rec := s3Request(s, http.MethodPut, "/backup/large", "123456", nil)
+	if rec.Code != http.StatusRequestEntityTooLarge || s3ErrorCode(t, rec) != "EntityTooLarge" {
+		t.Errorf("PUT over the limit returned %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestS3AuthorizesAccessKey(t *testing.T) {
+	s := newTestServer(t)
+	s.SetAuthorizer(NewAPIKeyAuthorizer("backup-key"))
+	signed := func(accessKey string) map[string]string {
+		return map[string]string{"Authorization": "AWS4-HMAC-SHA256 Credential=" + accessKey +
+			"/20240101/us-east-1/s3/aws4_request, SignedHeaders=host, Signature=0123"}
+	}
+
+	if rec := s3Request(s, http.MethodPut, "/backup/file", "data", signed("backup-key")); rec.Code != http.StatusOK {
+		t.Fatalf("PUT with the access key returned %d: %s", rec.Code, rec.Body.String())
+	}
+	for name, headers := range map[string]map[string]string{
+		"another key": signed("other-key"),
+		"no key":      nil,
+	} {
+		rec := s3Request(s, http.MethodGet, "/backup/file", "", headers)
+		if rec.Code != http.StatusForbidden || s3ErrorCode(t, rec) != "AccessDenied" {
+			t.Errorf("GET with %s returned %d", name, rec.Code)
+		}
+	}
+	if rec := s3Request(s, http.MethodGet, "/backup/file?X-Amz-Credential=backup-key%2F20240101%2Fus-east-1%2Fs3%2Faws4_request", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("presigned GET returned %d", rec.Code)
+	}
+}
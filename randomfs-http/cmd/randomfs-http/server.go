@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TheEntropyCollective/randomfs-core/pkg/randomfs"
+	"github.com/gorilla/mux"
+)
+
+// Server exposes a RandomFS instance over a REST API
+type Server struct {
+	rfs    *randomfs.RandomFS
+	router *mux.Router
+	port   int
+	webDir string
+
+	// requireTokens rejects retrievals that do not carry a capability token
+	requireTokens bool
+	// adminToken authorizes the /admin endpoints; empty disables them
+	adminToken string
+	// authorizer decides whether stores and retrievals are allowed
+	authorizer Authorizer
+	// limiter, if set, limits the requests of each client to the API
+	limiter *rateLimiter
+	// metrics is served on /metrics
+	metrics *serverMetrics
+	// uploads tracks the resumable uploads being received
+	uploads *uploadSessions
+	// httpServer serves the router from Start until Shutdown
+	httpServer *http.Server
+}
+
+// readinessTimeout bounds the IPFS probe of a readiness check
+const readinessTimeout = 5 * time.Second
+
+// tokenHeader is the request header carrying a capability token
+const tokenHeader = "X-RandomFS-Token"
+
+// NewServer creates an HTTP server for rfs
+func NewServer(rfs *randomfs.RandomFS, port int, webDir string) *Server {
+	s := &Server{
+		rfs:        rfs,
+		router:     mux.NewRouter(),
+		port:       port,
+		webDir:     webDir,
+		authorizer: AllowAll,
+		metrics:    newServerMetrics(rfs),
+		uploads:    newUploadSessions(filepath.Join(rfs.DataDir(), uploadDirName)),
+	}
+	rfs.Metrics = s.metrics
+	s.setupRoutes()
+	s.httpServer = &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: s.router}
+	return s
+}
+
+// setupRoutes registers the API routes
+func (s *Server) setupRoutes() {
+	s.router.Use(corsMiddleware)
+
+	api := s.router.PathPrefix("/api/v1").Subrouter()
+	api.Use(s.rateLimitMiddleware)
+	api.HandleFunc("/store", s.handleStore).Methods("POST")
+	api.HandleFunc("/retrieve/{hash}", s.handleRetrieve).Methods("GET", "HEAD")
+	api.HandleFunc("/verify/{hash}", s.handleVerify).Methods("GET")
+	api.HandleFunc("/files", s.handleListFiles).Methods("GET")
+	api.HandleFunc("/files/{hash}", s.handleDelete).Methods("DELETE")
+	api.HandleFunc("/stats", s.handleStats).Methods("GET")
+	api.HandleFunc("/blocks/{hash}", s.handleBlockInfo).Methods("GET")
+	api.HandleFunc("/uploads", s.handleCreateUpload).Methods("POST")
+	api.HandleFunc("/uploads/{id}", s.handleUploadStatus).Methods("GET", "HEAD")
+	api.HandleFunc("/uploads/{id}", s.handleAbortUpload).Methods("DELETE")
+	api.HandleFunc("/uploads/{id}/complete", s.handleCompleteUpload).Methods("POST")
+	api.HandleFunc("/uploads/{id}/{offset:[0-9]+}", s.handleUploadChunk).Methods("PUT")
+
+	admin := s.router.PathPrefix("/admin").Subrouter()
+	admin.Use(s.adminMiddleware)
+	admin.HandleFunc("/flush", s.handleAdminFlush).Methods("POST")
+	admin.HandleFunc("/gc", s.handleAdminGC).Methods("POST")
+	admin.HandleFunc("/verify", s.handleAdminVerify).Methods("POST")
+
+	s.router.Handle("/metrics", s.metrics.handler()).Methods("GET")
+	s.router.HandleFunc("/healthz", s.handleHealth).Methods("GET", "HEAD")
+	s.router.HandleFunc("/readyz", s.handleReady).Methods("GET", "HEAD")
+	s.router.PathPrefix("/rd/").Handler(s.rateLimitMiddleware(http.HandlerFunc(s.handleRandomURL))).Methods("GET", "HEAD")
+
+	if s.webDir != "" {
+		s.router.PathPrefix("/").Handler(http.FileServer(http.Dir(s.webDir)))
+	}
+}
+
+// Start listens on the configured port and serves requests until Shutdown
+// is called, returning nil once it is
+func (s *Server) Start() error {
+	slog.Info("RandomFS HTTP server listening", "addr", s.httpServer.Addr)
+	if err := s.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops accepting requests and waits for those in progress to
+// finish or for ctx to be done. The RandomFS instance is left open.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
+// handleStore stores an uploaded file
+func (s *Server) handleStore(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(w, r, OperationStore, "") {
+		return
+	}
+	if limit := s.rfs.MaxFileSize; limit > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, limit+maxFormOverhead)
+	}
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		if tooLarge := new(http.MaxBytesError); errors.As(err, &tooLarge) {
+			writeFileTooLarge(w, s.rfs.MaxFileSize)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to parse form: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get file: %v", err), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	if limit := s.rfs.MaxFileSize; limit > 0 && header.Size > limit {
+		writeFileTooLarge(w, limit)
+		return
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read file: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// Without a content type the library detects one from the data
+	contentType := header.Header.Get("Content-Type")
+
+	disposition := r.FormValue("disposition")
+	if disposition != "" && disposition != randomfs.DispositionInline && disposition != randomfs.DispositionAttachment {
+		http.Error(w, fmt.Sprintf("Invalid disposition %q", disposition), http.StatusBadRequest)
+		return
+	}
+	randomURL, result, err := s.rfs.StoreFileWithResult(header.Filename, data, contentType, disposition)
+	writeStoreResult(w, randomURL, &result, err)
+}
+
+// maxFormOverhead is how far a store request may exceed MaxFileSize, for
+// the multipart framing and form fields around the file
+const maxFormOverhead = 64 * 1024
+
+// writeFileTooLarge answers an upload over the maximum file size
+func writeFileTooLarge(w http.ResponseWriter, limit int64) {
+	http.Error(w, fmt.Sprintf("File exceeds the maximum size of %d bytes", limit), http.StatusRequestEntityTooLarge)
+}
+
+// writeStoreResult writes the response to a store that returned randomURL
+// and err. The blocks the store wrote are reported if result is known.
+func writeStoreResult(w http.ResponseWriter, randomURL *randomfs.RandomURL, result *randomfs.StoreResult, err error) {
+	if errors.Is(err, randomfs.ErrReadOnly) {
+		http.Error(w, "Server is read-only", http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, randomfs.ErrFileTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if errors.Is(err, randomfs.ErrFilenameRejected) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to store file: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"success":      true,
+		"url":          randomURL.String(),
+		"compact_url":  randomURL.Compact(),
+		"hash":         randomURL.RepHash,
+		"size":         randomURL.FileSize,
+		"deduplicated": randomURL.Deduplicated,
+	}
+	if result != nil {
+		response["blocks_total"] = result.BlocksTotal
+		response["blocks_new"] = result.BlocksNew
+		response["blocks_reused"] = result.BlocksReused
+		response["bytes_stored"] = result.BytesStored
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handleRetrieve downloads a file by representation hash
+func (s *Server) handleRetrieve(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+	if !s.authorize(w, r, OperationRetrieve, hash) || !s.authorizeRetrieval(w, r, hash) {
+		return
+	}
+
+	s.serveFile(w, r, hash)
+}
+
+// handleVerify reports whether every block of a file can still be
+// fetched intact, without reconstructing it. Damaged files are reported
+// with 200 like healthy ones; the report tells them apart.
+func (s *Server) handleVerify(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+	if !s.authorize(w, r, OperationRetrieve, hash) || !s.authorizeRetrieval(w, r, hash) {
+		return
+	}
+
+	report, err := s.rfs.VerifyFileBlocks(hash)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to verify file: %v", err), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// handleListFiles lists the files stored through this node, oldest first.
+// The prefix parameter keeps files whose name starts with it, and since
+// keeps files stored at or after a time given in RFC 3339 or Unix seconds.
+func (s *Server) handleListFiles(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(w, r, OperationList, "") {
+		return
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+	var since time.Time
+	if value := r.URL.Query().Get("since"); value != "" {
+		var err error
+		if since, err = parseTime(value); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid since %q: %v", value, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	files := []randomfs.FileInfo{}
+	for _, file := range s.rfs.ListFiles() {
+		if strings.HasPrefix(file.FileName, prefix) && !file.StoredAt.Before(since) {
+			files = append(files, file)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"files": files,
+		"count": len(files),
+	})
+}
+
+// parseTime parses an RFC 3339 time or a number of Unix seconds
+func parseTime(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// handleDelete deletes a stored file, releasing the blocks no other
+// indexed file references
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+	if !s.authorize(w, r, OperationDelete, hash) {
+		return
+	}
+
+	err := s.rfs.DeleteFile(hash)
+	if errors.Is(err, randomfs.ErrReadOnly) {
+		http.Error(w, "Server is read-only", http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, randomfs.ErrFileNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to delete file: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"hash":    hash,
+	})
+}
+
+// handleRandomURL serves a file addressed by an rd:// URL path
+func (s *Server) handleRandomURL(w http.ResponseWriter, r *http.Request) {
+	// The escaped path keeps the filename encoded as ParseRandomURL expects
+	rawURL := "rd://" + strings.TrimPrefix(r.URL.EscapedPath(), "/rd/")
+
+	randomURL, err := randomfs.ParseRandomURL(rawURL)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid rd:// URL: %v", err), http.StatusBadRequest)
+		return
+	}
+	if !s.authorize(w, r, OperationRetrieve, randomURL.RepHash) || !s.authorizeRetrieval(w, r, randomURL.RepHash) {
+		return
+	}
+
+	s.serveFile(w, r, randomURL.RepHash)
+}
+
+// serveFile streams a stored file like a static file server. The
+// representation hash is a strong ETag since the content never changes,
+// and conditional and range requests are answered without reconstructing
+// the blocks that are not sent.
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, repHash string) {
+	stream, err := s.rfs.OpenFileStream(repHash)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to retrieve file: %v", err), http.StatusNotFound)
+		return
+	}
+	defer stream.Close()
+
+	rep := stream.Representation()
+	w.Header().Set("Content-Type", rep.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=%q", rep.PreferredDisposition(), rep.FileName))
+	w.Header().Set("ETag", fmt.Sprintf("%q", repHash))
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+
+	http.ServeContent(w, r, rep.FileName, time.Unix(rep.Timestamp, 0), stream)
+}
+
+// authorizeRetrieval checks the capability token supplied in the
+// X-RandomFS-Token header or token query parameter. Requests without a
+// token are allowed unless the server requires tokens.
+func (s *Server) authorizeRetrieval(w http.ResponseWriter, r *http.Request, repHash string) bool {
+	token := r.Header.Get(tokenHeader)
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+
+	if token == "" {
+		if s.requireTokens {
+			http.Error(w, "Capability token required", http.StatusUnauthorized)
+			return false
+		}
+		return true
+	}
+
+	if _, err := s.rfs.VerifyToken(token, repHash, randomfs.PermissionRead); err != nil {
+		status := http.StatusUnauthorized
+		if errors.Is(err, randomfs.ErrTokenForbidden) {
+			status = http.StatusForbidden
+		}
+		http.Error(w, fmt.Sprintf("Unauthorized: %v", err), status)
+		return false
+	}
+	return true
+}
+
+// handleStats returns usage statistics
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.rfs.GetStats())
+}
+
+// handleBlockInfo returns the references to a block and its popularity,
+// decayed with the popularity half-life of the instance
+func (s *Server) handleBlockInfo(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(w, r, OperationList, "") {
+		return
+	}
+
+	info, err := s.rfs.GetBlockInfo(mux.Vars(r)["hash"])
+	if errors.Is(err, randomfs.ErrBlockNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get block info: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// handleHealth reports that the process is alive and serving requests
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReady reports whether the instance can serve requests, answering
+// 503 Service Unavailable when it cannot, so a load balancer stops routing
+// to a node whose IPFS backend is down
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	readiness := s.rfs.CheckReadiness(ctx)
+	status := http.StatusOK
+	if !readiness.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, readiness)
+}
+
+// adminMiddleware requires the admin token as a bearer token
+func (s *Server) adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if s.adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="randomfs-admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleAdminFlush drops the block cache and persists the index
+func (s *Server) handleAdminFlush(w http.ResponseWriter, r *http.Request) {
+	dropped, err := s.rfs.Flush()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Flush failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":       true,
+		"dropped_bytes": dropped,
+	})
+}
+
+// handleAdminGC removes blocks no longer referenced by any stored file
+func (s *Server) handleAdminGC(w http.ResponseWriter, r *http.Request) {
+	result, err := s.rfs.CollectGarbage()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Garbage collection failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleAdminVerify checks every stored file against the backend
+func (s *Server) handleAdminVerify(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.rfs.VerifyAll())
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed to encode response", "error", err)
+	}
+}
+
+// corsMiddleware allows the web interface to call the API from another origin
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Range, If-None-Match, If-Modified-Since, If-Range, "+tokenHeader)
+		w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Range, ETag")
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,751 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TheEntropyCollective/randomfs-core/pkg/randomfs"
+)
+
+// newTestServer creates a server backed by a RandomFS without IPFS
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	rfs, err := randomfs.NewRandomFSWithoutIPFS(t.TempDir(), 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFSWithoutIPFS: %v", err)
+	}
+	return NewServer(rfs, 0, "")
+}
+
+// uploadFile posts a multipart upload to /api/v1/store with extra form fields
+func uploadFile(t *testing.T, s *Server, filename, contentType string, data []byte, fields map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, newUploadRequest(t, filename, contentType, data, fields))
+	return rec
+}
+
+// newUploadRequest builds a multipart upload request for /api/v1/store
+func newUploadRequest(t *testing.T, filename, contentType string, data []byte, fields map[string]string) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for name, value := range fields {
+		writer.WriteField(name, value)
+	}
+	header := make(map[string][]string)
+	header["Content-Disposition"] = []string{`form-data; name="file"; filename="` + filename + `"`}
+	if contentType != "" {
+		header["Content-Type"] = []string{contentType}
+	}
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		t.Fatalf("CreatePart: %v", err)
+	}
+	part.Write(data)
+	writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/store", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+// storeResponse decodes the JSON body returned by /api/v1/store
+func storeResponse(t *testing.T, rec *httptest.ResponseRecorder) (url, hash string) {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("store returned %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		URL  string `json:"url"`
+		Hash string `json:"hash"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode store response: %v", err)
+	}
+	return resp.URL, resp.Hash
+}
+
+func TestRetrieveHonorsStoredInlineDisposition(t *testing.T) {
+	s := newTestServer(t)
+	data := []byte("PK\x03\x04 not something a browser would render")
+
+	rec := uploadFile(t, s, "archive.zip", "application/zip", data, map[string]string{"disposition": "inline"})
+	_, hash := storeResponse(t, rec)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/retrieve/"+hash, nil)
+	rec = httptest.NewRecorder()
+	s.router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("retrieve returned %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Disposition"); !strings.HasPrefix(got, "inline;") {
+		t.Fatalf("expected inline disposition, got %q", got)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	if !bytes.Equal(body, data) {
+		t.Fatalf("retrieved body does not match upload")
+	}
+}
+
+func TestDispositionFallsBackToContentType(t *testing.T) {
+	s := newTestServer(t)
+
+	_, imageHash := storeResponse(t, uploadFile(t, s, "photo.png", "image/png", []byte("png"), nil))
+	randomURL, zipHash := storeResponse(t, uploadFile(t, s, "data.zip", "application/zip", []byte("zip"), nil))
+
+	cases := []struct {
+		path string
+		want string
+	}{
+		{"/api/v1/retrieve/" + imageHash, "inline;"},
+		{"/api/v1/retrieve/" + zipHash, "attachment;"},
+		{"/rd/" + strings.TrimPrefix(randomURL, "rd://"), "attachment;"},
+	}
+	for _, tc := range cases {
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if got := rec.Header().Get("Content-Disposition"); !strings.HasPrefix(got, tc.want) {
+			t.Errorf("%s: expected %s disposition, got %q", tc.path, tc.want, got)
+		}
+	}
+}
+
+func TestStoreRejectsInvalidDisposition(t *testing.T) {
+	s := newTestServer(t)
+	rec := uploadFile(t, s, "a.txt", "text/plain", []byte("a"), map[string]string{"disposition": "sideways"})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+}
+
+func TestStoreRejectsFilesOverMaxFileSize(t *testing.T) {
+	s := newTestServer(t)
+	s.rfs.MaxFileSize = 1024
+
+	if rec := uploadFile(t, s, "fits.bin", "", make([]byte, 1024), nil); rec.Code != http.StatusOK {
+		t.Fatalf("upload at the limit returned %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := uploadFile(t, s, "over.bin", "", make([]byte, 1025), nil); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("upload over the limit returned %d: %s", rec.Code, rec.Body.String())
+	}
+	// A body far over the limit is cut off before it is read
+	if rec := uploadFile(t, s, "huge.bin", "", make([]byte, 1024+2*maxFormOverhead), nil); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("upload far over the limit returned %d: %s", rec.Code, rec.Body.String())
+	}
+	if files := s.rfs.ListFiles(); len(files) != 1 {
+		t.Errorf("%d files stored, expected only the one at the limit", len(files))
+	}
+}
+
+func TestStoreRejectsFilenameRefusedByPolicy(t *testing.T) {
+	s := newTestServer(t)
+	s.rfs.FilenamePolicy = func(name string) (string, error) {
+		if strings.HasSuffix(name, ".exe") {
+			return "", fmt.Errorf("executables are not accepted")
+		}
+		return name, nil
+	}
+
+	if rec := uploadFile(t, s, "setup.exe", "", []byte("MZ"), nil); rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := uploadFile(t, s, "readme.txt", "", []byte("hi"), nil); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRetrieveWithCapabilityToken(t *testing.T) {
+	s := newTestServer(t)
+	s.requireTokens = true
+	randomURL, hash := storeResponse(t, uploadFile(t, s, "secret.txt", "text/plain", []byte("secret"), nil))
+
+	valid, err := s.rfs.IssueToken(hash, randomfs.PermissionRead, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("IssueToken: %v", err)
+	}
+	expired, err := s.rfs.IssueToken(hash, randomfs.PermissionRead, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("IssueToken: %v", err)
+	}
+	revoked, err := s.rfs.IssueToken(hash, randomfs.PermissionRead, time.Time{})
+	if err != nil {
+		t.Fatalf("IssueToken: %v", err)
+	}
+	if err := s.rfs.RevokeToken(revoked); err != nil {
+		t.Fatalf("RevokeToken: %v", err)
+	}
+
+	retrieve := func(path, headerToken string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if headerToken != "" {
+			req.Header.Set(tokenHeader, headerToken)
+		}
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	cases := []struct {
+		name  string
+		path  string
+		token string
+		want  int
+	}{
+		{"valid header", "/api/v1/retrieve/" + hash, valid, http.StatusOK},
+		{"valid query", "/api/v1/retrieve/" + hash + "?token=" + valid, "", http.StatusOK},
+		{"valid rd url", "/rd/" + strings.TrimPrefix(randomURL, "rd://"), valid, http.StatusOK},
+		{"missing", "/api/v1/retrieve/" + hash, "", http.StatusUnauthorized},
+		{"expired", "/api/v1/retrieve/" + hash, expired, http.StatusUnauthorized},
+		{"revoked", "/api/v1/retrieve/" + hash, revoked, http.StatusUnauthorized},
+		{"garbage", "/api/v1/retrieve/" + hash, "not-a-token", http.StatusUnauthorized},
+	}
+	for _, tc := range cases {
+		if got := retrieve(tc.path, tc.token); got != tc.want {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.want, got)
+		}
+	}
+
+	_, otherHash := storeResponse(t, uploadFile(t, s, "other.txt", "text/plain", []byte("other"), nil))
+	if got := retrieve("/api/v1/retrieve/"+otherHash, valid); got != http.StatusForbidden {
+		t.Errorf("token for another file: expected 403, got %d", got)
+	}
+}
+
+func TestMetricsExposesIPFSCounters(t *testing.T) {
+	s := newTestServer(t)
+	storeResponse(t, uploadFile(t, s, "a.txt", "text/plain", []byte("a"), nil))
+
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("metrics returned %d", rec.Code)
+	}
+	body := rec.Body.String()
+	for _, line := range []string{
+		"randomfs_files_stored 1\n",
+		"randomfs_ipfs_add_total 0\n",
+		"randomfs_ipfs_add_errors 0\n",
+		"randomfs_ipfs_cat_total 0\n",
+		"randomfs_ipfs_cat_errors 0\n",
+		"randomfs_ipfs_pin_total 0\n",
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("metrics missing %q:\n%s", line, body)
+		}
+	}
+}
+
+func TestConditionalAndRangeRequests(t *testing.T) {
+	s := newTestServer(t)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 300)
+	randomURL, hash := storeResponse(t, uploadFile(t, s, "video.mp4", "video/mp4", data, nil))
+	etag := `"` + hash + `"`
+
+	cases := []struct {
+		name    string
+		path    string
+		headers map[string]string
+		status  int
+		body    []byte
+	}{
+		{"full", "/api/v1/retrieve/" + hash, nil, http.StatusOK, data},
+		{"matching etag", "/api/v1/retrieve/" + hash, map[string]string{"If-None-Match": etag}, http.StatusNotModified, nil},
+		{"other etag", "/api/v1/retrieve/" + hash, map[string]string{"If-None-Match": `"other"`}, http.StatusOK, data},
+		{"range", "/api/v1/retrieve/" + hash, map[string]string{"Range": "bytes=1000-2099"}, http.StatusPartialContent, data[1000:2100]},
+		{"suffix range", "/api/v1/retrieve/" + hash, map[string]string{"Range": "bytes=-10"}, http.StatusPartialContent, data[len(data)-10:]},
+		{"if-range match", "/api/v1/retrieve/" + hash, map[string]string{"Range": "bytes=0-9", "If-Range": etag}, http.StatusPartialContent, data[:10]},
+		{"if-range stale", "/api/v1/retrieve/" + hash, map[string]string{"Range": "bytes=0-9", "If-Range": `"stale"`}, http.StatusOK, data},
+		{"unsatisfiable", "/api/v1/retrieve/" + hash, map[string]string{"Range": "bytes=999999-"}, http.StatusRequestedRangeNotSatisfiable, nil},
+		{"etag beats range", "/api/v1/retrieve/" + hash, map[string]string{"Range": "bytes=0-9", "If-None-Match": etag}, http.StatusNotModified, nil},
+		{"rd url range", "/rd/" + strings.TrimPrefix(randomURL, "rd://"), map[string]string{"Range": "bytes=16-31"}, http.StatusPartialContent, data[16:32]},
+		{"rd url etag", "/rd/" + strings.TrimPrefix(randomURL, "rd://"), map[string]string{"If-None-Match": etag}, http.StatusNotModified, nil},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		for name, value := range tc.headers {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, req)
+
+		if rec.Code != tc.status {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.status, rec.Code)
+			continue
+		}
+		if tc.body != nil && !bytes.Equal(rec.Body.Bytes(), tc.body) {
+			t.Errorf("%s: body does not match (%d bytes)", tc.name, rec.Body.Len())
+		}
+		if tc.status == http.StatusOK || tc.status == http.StatusPartialContent {
+			if got := rec.Header().Get("ETag"); got != etag {
+				t.Errorf("%s: expected ETag %s, got %s", tc.name, etag, got)
+			}
+			if got := rec.Header().Get("Accept-Ranges"); got != "bytes" {
+				t.Errorf("%s: expected Accept-Ranges bytes, got %q", tc.name, got)
+			}
+		}
+	}
+}
+
+func TestRangeRequestsForMediaSeeking(t *testing.T) {
+	s := newTestServer(t)
+	data := make([]byte, 40*randomfs.NanoBlockSize+123)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	_, hash := storeResponse(t, uploadFile(t, s, "clip.webm", "video/webm", data, nil))
+	size := len(data)
+	bs := randomfs.NanoBlockSize
+
+	cases := []struct {
+		name         string
+		rangeHeader  string
+		start, end   int // inclusive, as in Content-Range
+		blocksCopied int
+	}{
+		{"across a block boundary", fmt.Sprintf("bytes=%d-%d", bs-5, bs+4), bs - 5, bs + 4, 2},
+		{"open ended", fmt.Sprintf("bytes=%d-", size-200), size - 200, size - 1, 2},
+		{"end past the file", fmt.Sprintf("bytes=%d-%d", size-10, size+5000), size - 10, size - 1, 1},
+		{"first byte", "bytes=0-0", 0, 0, 1},
+	}
+	for _, tc := range cases {
+		s.rfs.Cache().Clear()
+		before := s.rfs.GetStats().CacheMisses
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/retrieve/"+hash, nil)
+		req.Header.Set("Range", tc.rangeHeader)
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusPartialContent {
+			t.Errorf("%s: expected 206, got %d", tc.name, rec.Code)
+			continue
+		}
+		if !bytes.Equal(rec.Body.Bytes(), data[tc.start:tc.end+1]) {
+			t.Errorf("%s: body does not match (%d bytes)", tc.name, rec.Body.Len())
+		}
+		if got, want := rec.Header().Get("Content-Range"), fmt.Sprintf("bytes %d-%d/%d", tc.start, tc.end, size); got != want {
+			t.Errorf("%s: Content-Range %q, want %q", tc.name, got, want)
+		}
+		if got, want := rec.Header().Get("Content-Length"), fmt.Sprint(tc.end-tc.start+1); got != want {
+			t.Errorf("%s: Content-Length %s, want %s", tc.name, got, want)
+		}
+		if got := rec.Header().Get("Accept-Ranges"); got != "bytes" {
+			t.Errorf("%s: Accept-Ranges %q", tc.name, got)
+		}
+		// Each block covered costs itself and its randomizer, plus the
+		// representation; the other blocks are never reconstructed
+		if fetched := s.rfs.GetStats().CacheMisses - before; fetched > int64(2*tc.blocksCopied+1) {
+			t.Errorf("%s: fetched %d blocks for a range over %d", tc.name, fetched, tc.blocksCopied)
+		}
+	}
+
+	// Several ranges are answered as multipart/byteranges
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/retrieve/"+hash, nil)
+	req.Header.Set("Range", "bytes=0-9,5000-5009")
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusPartialContent || !strings.HasPrefix(rec.Header().Get("Content-Type"), "multipart/byteranges") {
+		t.Fatalf("multi-range: got %d, %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	body := rec.Body.Bytes()
+	if !bytes.Contains(body, data[:10]) || !bytes.Contains(body, data[5000:5010]) {
+		t.Error("multi-range response lacks a requested part")
+	}
+}
+
+func TestDeleteFile(t *testing.T) {
+	s := newTestServer(t)
+	_, keepHash := storeResponse(t, uploadFile(t, s, "keep.txt", "text/plain", []byte("kept"), nil))
+	_, hash := storeResponse(t, uploadFile(t, s, "gone.txt", "text/plain", []byte("deleted"), nil))
+
+	var gotOp Operation
+	s.SetAuthorizer(AuthorizerFunc(func(r *http.Request, op Operation, repHash string) bool {
+		gotOp = op
+		return op != OperationDelete || repHash == hash
+	}))
+	del := func(hash string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/api/v1/files/"+hash, nil))
+		return rec
+	}
+
+	if rec := del(keepHash); rec.Code != http.StatusForbidden || gotOp != OperationDelete {
+		t.Fatalf("unauthorized delete returned %d, asked about %s", rec.Code, gotOp)
+	}
+	if rec := del(hash); rec.Code != http.StatusOK {
+		t.Fatalf("delete returned %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := del(hash); rec.Code != http.StatusNotFound {
+		t.Errorf("second delete returned %d, want 404", rec.Code)
+	}
+
+	for h, want := range map[string]int{hash: http.StatusNotFound, keepHash: http.StatusOK} {
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/retrieve/"+h, nil))
+		if rec.Code != want {
+			t.Errorf("retrieve %s after delete returned %d, want %d", h, rec.Code, want)
+		}
+	}
+	if files := s.rfs.ListFiles(); len(files) != 1 || files[0].RepHash != keepHash {
+		t.Errorf("index after delete: %+v", files)
+	}
+}
+
+func TestListFiles(t *testing.T) {
+	s := newTestServer(t)
+	_, reportHash := storeResponse(t, uploadFile(t, s, "report-2024.pdf", "application/pdf", []byte("old report"), nil))
+	time.Sleep(10 * time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	_, newReportHash := storeResponse(t, uploadFile(t, s, "report-2025.pdf", "application/pdf", []byte("new report"), nil))
+	_, photoHash := storeResponse(t, uploadFile(t, s, "photo.jpg", "image/jpeg", []byte("jpeg"), nil))
+
+	list := func(query string) []randomfs.FileInfo {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/files"+query, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("list %q returned %d: %s", query, rec.Code, rec.Body.String())
+		}
+		var resp struct {
+			Files []randomfs.FileInfo `json:"files"`
+			Count int                 `json:"count"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode list: %v", err)
+		}
+		if resp.Count != len(resp.Files) {
+			t.Errorf("list %q counts %d of %d files", query, resp.Count, len(resp.Files))
+		}
+		return resp.Files
+	}
+	hashes := func(files []randomfs.FileInfo) []string {
+		var hashes []string
+		for _, file := range files {
+			hashes = append(hashes, file.RepHash)
+		}
+		return hashes
+	}
+
+	all := list("")
+	if got := hashes(all); fmt.Sprint(got) != fmt.Sprint([]string{reportHash, newReportHash, photoHash}) {
+		t.Fatalf("listed %v", got)
+	}
+	if all[2].FileName != "photo.jpg" || all[2].FileSize != 4 || all[2].ContentType != "image/jpeg" || all[2].StoredAt.IsZero() {
+		t.Errorf("listed %+v", all[2])
+	}
+	if got := hashes(list("?prefix=report-")); fmt.Sprint(got) != fmt.Sprint([]string{reportHash, newReportHash}) {
+		t.Errorf("prefix listed %v", got)
+	}
+	since := "?since=" + cutoff.Format(time.RFC3339Nano)
+	if got := hashes(list(since)); fmt.Sprint(got) != fmt.Sprint([]string{newReportHash, photoHash}) {
+		t.Errorf("since listed %v", got)
+	}
+	if got := hashes(list(since + "&prefix=report-")); fmt.Sprint(got) != fmt.Sprint([]string{newReportHash}) {
+		t.Errorf("since and prefix listed %v", got)
+	}
+	if got := list(fmt.Sprintf("?since=%d", time.Now().Add(time.Hour).Unix())); len(got) != 0 {
+		t.Errorf("future since listed %d files", len(got))
+	}
+
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/files?since=yesterday", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid since returned %d, want 400", rec.Code)
+	}
+
+	s.SetAuthorizer(AuthorizerFunc(func(r *http.Request, op Operation, repHash string) bool {
+		return op != OperationList
+	}))
+	rec = httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/files", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("unauthorized list returned %d, want 403", rec.Code)
+	}
+}
+
+// adminRequest posts to an admin endpoint with an optional bearer token
+func adminRequest(s *Server, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminEndpoints(t *testing.T) {
+	dataDir := t.TempDir()
+	rfs, err := randomfs.NewRandomFSWithoutIPFS(dataDir, 16*1024*1024)
+	if err != nil {
+		t.Fatalf("NewRandomFSWithoutIPFS: %v", err)
+	}
+	s := NewServer(rfs, 0, "")
+	s.adminToken = "s3cret"
+
+	_, hash := storeResponse(t, uploadFile(t, s, "a.txt", "text/plain", []byte("admin"), nil))
+
+	for _, path := range []string{"/admin/flush", "/admin/gc", "/admin/verify"} {
+		if rec := adminRequest(s, path, ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s without token: expected 401, got %d", path, rec.Code)
+		}
+		if rec := adminRequest(s, path, "wrong"); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s with wrong token: expected 401, got %d", path, rec.Code)
+		}
+	}
+
+	rec := adminRequest(s, "/admin/flush", "s3cret")
+	var flush struct {
+		DroppedBytes int64 `json:"dropped_bytes"`
+	}
+	json.NewDecoder(rec.Body).Decode(&flush)
+	if rec.Code != http.StatusOK || flush.DroppedBytes == 0 {
+		t.Fatalf("flush: status %d, dropped %d", rec.Code, flush.DroppedBytes)
+	}
+
+	orphan := filepath.Join(dataDir, "blocks", "0000orphan")
+	if err := os.WriteFile(orphan, []byte("orphan"), 0644); err != nil {
+		t.Fatalf("write orphan: %v", err)
+	}
+	rec = adminRequest(s, "/admin/gc", "s3cret")
+	var gc randomfs.GCResult
+	json.NewDecoder(rec.Body).Decode(&gc)
+	if rec.Code != http.StatusOK || gc.Removed != 1 {
+		t.Fatalf("gc: status %d, result %+v", rec.Code, gc)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Fatal("gc left the orphaned block behind")
+	}
+
+	rec = adminRequest(s, "/admin/verify", "s3cret")
+	var report randomfs.VerifyReport
+	json.NewDecoder(rec.Body).Decode(&report)
+	if rec.Code != http.StatusOK || report.Files != 1 || report.Healthy != 1 {
+		t.Fatalf("verify: status %d, report %+v", rec.Code, report)
+	}
+	if report.Damaged == nil || len(report.Damaged) != 0 {
+		t.Fatalf("verify reported damage for %s: %+v", hash, report.Damaged)
+	}
+}
+
+func TestAdminEndpointsDisabledWithoutToken(t *testing.T) {
+	s := newTestServer(t)
+	if rec := adminRequest(s, "/admin/flush", ""); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 when no admin token is configured, got %d", rec.Code)
+	}
+}
+
+func TestVerifyReportsBlocks(t *testing.T) {
+	s := newTestServer(t)
+	_, hash := storeResponse(t, uploadFile(t, s, "kept.txt", "text/plain", bytes.Repeat([]byte("kept"), 1000), nil))
+
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/verify/"+hash, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("verify returned %d: %s", rec.Code, rec.Body.String())
+	}
+	var report randomfs.FileVerifyReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatalf("decode verify response: %v", err)
+	}
+	if report.RepHash != hash || report.FileName != "kept.txt" || !report.Healthy() || report.Checked == 0 || len(report.Blocks) != report.Checked {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	for _, block := range report.Blocks {
+		if block.Status != randomfs.BlockOK || block.Hash == "" {
+			t.Errorf("block %+v not reported healthy", block)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/verify/missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("verify of an unknown file returned %d, want 404", rec.Code)
+	}
+
+	s.requireTokens = true
+	rec = httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/verify/"+hash, nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("verify without a required token returned %d, want 401", rec.Code)
+	}
+}
+
+func TestBlockInfo(t *testing.T) {
+	s := newTestServer(t)
+	s.rfs.PopularityHalfLife = time.Hour
+	_, hash := storeResponse(t, uploadFile(t, s, "kept.txt", "text/plain", bytes.Repeat([]byte("kept"), 1000), nil))
+	rep, err := s.rfs.GetRepresentation(hash)
+	if err != nil {
+		t.Fatalf("GetRepresentation: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/blocks/"+rep.BlockHashes[0], nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("block info returned %d: %s", rec.Code, rec.Body.String())
+	}
+	var info randomfs.BlockInfo
+	if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+		t.Fatalf("decode block info: %v", err)
+	}
+	if info.Hash != rep.BlockHashes[0] || info.References != 1 || info.Popularity <= 0.99 || info.Popularity > 1 {
+		t.Fatalf("unexpected block info %+v", info)
+	}
+
+	rec = httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/blocks/missing", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("info of an unknown block returned %d, want 404", rec.Code)
+	}
+}
+
+func TestRandomURLWithEncodedFilename(t *testing.T) {
+	s := newTestServer(t)
+	randomURL, _ := storeResponse(t, uploadFile(t, s, "q3 report été.txt", "text/plain", []byte("quarterly"), nil))
+	if !strings.Contains(randomURL, "/q3%20report%20%C3%A9t%C3%A9.txt/") {
+		t.Fatalf("filename not escaped in %s", randomURL)
+	}
+
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/rd/"+strings.TrimPrefix(randomURL, "rd://"), nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "quarterly" {
+		t.Fatalf("rd url returned %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/rd/randomfs/v4/9/a.txt/1/QmNotAHash", nil))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "representation hash") {
+		t.Errorf("malformed rd url returned %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestStoreReturnsCompactURL(t *testing.T) {
+	s := newTestServer(t)
+	rec := uploadFile(t, s, "notes.txt", "text/plain", []byte("scan me"), nil)
+	var resp struct {
+		Hash       string `json:"hash"`
+		CompactURL string `json:"compact_url"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode store response: %v", err)
+	}
+	parsed, err := randomfs.ParseCompactRandomURL(resp.CompactURL)
+	if err != nil {
+		t.Fatalf("ParseCompactRandomURL(%q): %v", resp.CompactURL, err)
+	}
+	if parsed.RepHash != resp.Hash || parsed.FileName != "notes.txt" || parsed.FileSize != 7 {
+		t.Errorf("compact URL %q parsed as %+v", resp.CompactURL, parsed)
+	}
+}
+
+func TestStoreReportsDeduplication(t *testing.T) {
+	s := newTestServer(t)
+	type storeResult struct {
+		Deduplicated bool  `json:"deduplicated"`
+		BlocksTotal  int64 `json:"blocks_total"`
+		BlocksNew    int64 `json:"blocks_new"`
+		BlocksReused int64 `json:"blocks_reused"`
+		BytesStored  int64 `json:"bytes_stored"`
+	}
+	store := func(name string) storeResult {
+		rec := uploadFile(t, s, name, "text/plain", []byte("same content"), nil)
+		var resp storeResult
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("decode store response: %v", err)
+		}
+		return resp
+	}
+	first := store("first.txt")
+	if first.Deduplicated {
+		t.Fatal("first upload of the content was deduplicated")
+	}
+	if first.BlocksTotal == 0 || first.BlocksNew != first.BlocksTotal || first.BlocksReused != 0 || first.BytesStored == 0 {
+		t.Errorf("first upload reported %+v", first)
+	}
+	second := store("second.txt")
+	if !second.Deduplicated {
+		t.Error("second upload of the same content was not deduplicated")
+	}
+	if second.BlocksNew != 0 || second.BlocksReused != first.BlocksTotal || second.BytesStored != 0 {
+		t.Errorf("second upload reported %+v", second)
+	}
+}
+
+func TestRetrieveDetectsMissingContentType(t *testing.T) {
+	s := newTestServer(t)
+	data := []byte("GIF89a\x01\x00\x01\x00")
+	_, hash := storeResponse(t, uploadFile(t, s, "pixel", "", data, nil))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/retrieve/"+hash, nil)
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("retrieve returned %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Type"); got != "image/gif" {
+		t.Errorf("retrieved with content type %q, want the detected image/gif", got)
+	}
+}
+
+func TestStartReturnsAfterShutdown(t *testing.T) {
+	s := newTestServer(t)
+	started := make(chan error)
+	go func() { started <- s.Start() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Errorf("Start returned %v after Shutdown", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("Start did not return after Shutdown")
+	}
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	s := newTestServer(t)
+	for _, path := range []string{"/healthz", "/readyz"} {
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("%s returned %d", path, rec.Code)
+		}
+	}
+
+	s.rfs.Close()
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var readiness randomfs.Readiness
+	if err := json.Unmarshal(rec.Body.Bytes(), &readiness); err != nil {
+		t.Fatalf("decode readiness: %v", err)
+	}
+	if rec.Code != http.StatusServiceUnavailable || readiness.Ready {
+		t.Errorf("/readyz of a closed instance returned %d %+v", rec.Code, readiness)
+	}
+	rec = httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("/healthz of a closed instance returned %d", rec.Code)
+	}
+}
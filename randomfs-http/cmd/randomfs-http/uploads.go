@@ -0,0 +1,407 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/TheEntropyCollective/randomfs-core/pkg/randomfs"
+	"github.com/gorilla/mux"
+)
+
+// uploadDirName is the subdirectory of the data directory holding the
+// state of resumable uploads
+const uploadDirName = "uploads"
+
+// uploadExpiry is how long an upload may go without receiving data before
+// it is discarded
+const uploadExpiry = 24 * time.Hour
+
+// errUploadNotFound is returned for unknown or malformed upload IDs
+var errUploadNotFound = errors.New("upload not found")
+
+// uploadSession describes a resumable upload. It is kept as session.json
+// in the directory of the upload, next to the data received so far, so
+// uploads survive a restart of the server.
+type uploadSession struct {
+	ID       string `json:"id"`
+	FileName string `json:"filename"`
+	// Size is the declared size of the file, randomfs.UnknownSize if the
+	// client did not declare one
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// uploadSessions stores resumable uploads under dir. A session is used by
+// one request at a time.
+type uploadSessions struct {
+	dir   string
+	mutex sync.Mutex
+	busy  map[string]bool
+}
+
+func newUploadSessions(dir string) *uploadSessions {
+	return &uploadSessions{dir: dir, busy: make(map[string]bool)}
+}
+
+// create starts an upload, discarding expired ones first
+func (u *uploadSessions) create(fileName string, size int64, contentType string) (*uploadSession, error) {
+	u.sweep()
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	session := &uploadSession{
+		ID:          hex.EncodeToString(id),
+		FileName:    fileName,
+		Size:        size,
+		ContentType: contentType,
+		CreatedAt:   time.Now(),
+	}
+	dir := filepath.Join(u.dir, session.ID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "data"), nil, 0600); err != nil {
+		return nil, err
+	}
+	meta, err := json.Marshal(session)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "session.json"), meta, 0600); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return session, nil
+}
+
+// open loads the upload id
+func (u *uploadSessions) open(id string) (*uploadSession, error) {
+	if decoded, err := hex.DecodeString(id); err != nil || len(decoded) != 16 {
+		return nil, errUploadNotFound
+	}
+	meta, err := os.ReadFile(filepath.Join(u.dir, id, "session.json"))
+	if os.IsNotExist(err) {
+		return nil, errUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var session uploadSession
+	if err := json.Unmarshal(meta, &session); err != nil {
+		return nil, fmt.Errorf("failed to parse upload %s: %v", id, err)
+	}
+	return &session, nil
+}
+
+// acquire claims the upload id for a request, reporting false if another
+// request holds it
+func (u *uploadSessions) acquire(id string) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if u.busy[id] {
+		return false
+	}
+	u.busy[id] = true
+	return true
+}
+
+// release returns an upload claimed with acquire
+func (u *uploadSessions) release(id string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	delete(u.busy, id)
+}
+
+// dataPath returns the file holding the data received for the upload id
+func (u *uploadSessions) dataPath(id string) string {
+	return filepath.Join(u.dir, id, "data")
+}
+
+// offset returns the number of bytes received for the upload id
+func (u *uploadSessions) offset(id string) (int64, error) {
+	info, err := os.Stat(u.dataPath(id))
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// remove deletes the upload id and its data
+func (u *uploadSessions) remove(id string) error {
+	return os.RemoveAll(filepath.Join(u.dir, id))
+}
+
+// sweep removes uploads that received no data for uploadExpiry
+func (u *uploadSessions) sweep() {
+	entries, err := os.ReadDir(u.dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		id := entry.Name()
+		info, err := os.Stat(u.dataPath(id))
+		if err != nil {
+			// A session interrupted while it was created has no data
+			info, err = entry.Info()
+		}
+		if err != nil || time.Since(info.ModTime()) < uploadExpiry || !u.acquire(id) {
+			continue
+		}
+		slog.Info("Discarding idle upload", "id", id, "modified", info.ModTime())
+		if err := u.remove(id); err != nil {
+			slog.Error("Failed to discard upload", "id", id, "error", err)
+		}
+		u.release(id)
+	}
+}
+
+// handleCreateUpload starts a resumable upload of the file described by
+// the JSON body. Chunks are then sent with PUT /api/v1/uploads/{id}/{offset}
+// and the file is stored by POST /api/v1/uploads/{id}/complete.
+func (s *Server) handleCreateUpload(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(w, r, OperationStore, "") {
+		return
+	}
+	if s.rfs.IsReadOnly() {
+		http.Error(w, "Server is read-only", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		FileName    string `json:"filename"`
+		Size        *int64 `json:"size"`
+		ContentType string `json:"content_type"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid upload request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.FileName == "" {
+		http.Error(w, "filename is required", http.StatusBadRequest)
+		return
+	}
+	size := int64(randomfs.UnknownSize)
+	if req.Size != nil {
+		if size = *req.Size; size < 0 {
+			http.Error(w, fmt.Sprintf("Invalid size %d", size), http.StatusBadRequest)
+			return
+		}
+		if limit := s.rfs.MaxFileSize; limit > 0 && size > limit {
+			writeFileTooLarge(w, limit)
+			return
+		}
+	}
+
+	session, err := s.uploads.create(req.FileName, size, req.ContentType)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to start upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/api/v1/uploads/"+session.ID)
+	writeJSON(w, http.StatusCreated, uploadStatus(session, 0))
+}
+
+// uploadStatus is the JSON describing an upload that has received offset
+// bytes
+func uploadStatus(session *uploadSession, offset int64) map[string]interface{} {
+	status := map[string]interface{}{
+		"id":       session.ID,
+		"filename": session.FileName,
+		"offset":   offset,
+	}
+	if session.Size != randomfs.UnknownSize {
+		status["size"] = session.Size
+	}
+	return status
+}
+
+// openUpload loads the upload named in the request path, writing an error
+// response if it cannot be
+func (s *Server) openUpload(w http.ResponseWriter, r *http.Request) (*uploadSession, bool) {
+	session, err := s.uploads.open(mux.Vars(r)["id"])
+	if errors.Is(err, errUploadNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load upload: %v", err), http.StatusInternalServerError)
+		return nil, false
+	}
+	return session, true
+}
+
+// claimUpload loads the upload named in the request path and claims it
+// for the request; the caller releases it
+func (s *Server) claimUpload(w http.ResponseWriter, r *http.Request) (*uploadSession, bool) {
+	id := mux.Vars(r)["id"]
+	if !s.uploads.acquire(id) {
+		http.Error(w, "Upload is busy with another request", http.StatusConflict)
+		return nil, false
+	}
+	session, ok := s.openUpload(w, r)
+	if !ok {
+		s.uploads.release(id)
+	}
+	return session, ok
+}
+
+// handleUploadStatus reports how much of an upload has been received, so
+// an interrupted client knows where to resume
+func (s *Server) handleUploadStatus(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(w, r, OperationStore, "") {
+		return
+	}
+	session, ok := s.openUpload(w, r)
+	if !ok {
+		return
+	}
+	offset, err := s.uploads.offset(session.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, uploadStatus(session, offset))
+}
+
+// handleUploadChunk appends the request body to an upload. The offset in
+// the path must be the number of bytes received so far; anything else is
+// answered with 409 and the offset to resume from. The data of a chunk
+// cut short is kept, so the client resumes after what arrived.
+func (s *Server) handleUploadChunk(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(w, r, OperationStore, "") {
+		return
+	}
+	session, ok := s.claimUpload(w, r)
+	if !ok {
+		return
+	}
+	defer s.uploads.release(session.ID)
+
+	offset, err := strconv.ParseInt(mux.Vars(r)["offset"], 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid offset: %v", err), http.StatusBadRequest)
+		return
+	}
+	current, err := s.uploads.offset(session.ID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to load upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if offset != current {
+		status := uploadStatus(session, current)
+		status["error"] = fmt.Sprintf("chunk starts at %d, expected %d", offset, current)
+		writeJSON(w, http.StatusConflict, status)
+		return
+	}
+
+	file, err := os.OpenFile(s.uploads.dataPath(session.ID), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to open upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	body := io.Reader(r.Body)
+	if session.Size != randomfs.UnknownSize {
+		// Read one byte past the declared size to notice a chunk overrunning it
+		body = io.LimitReader(r.Body, session.Size-current+1)
+	} else if limit := s.rfs.MaxFileSize; limit > 0 {
+		body = io.LimitReader(r.Body, limit-current+1)
+	}
+	written, copyErr := io.Copy(file, body)
+	if session.Size != randomfs.UnknownSize && current+written > session.Size {
+		file.Truncate(current)
+		http.Error(w, fmt.Sprintf("Chunk extends past the declared size of %d bytes", session.Size), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if limit := s.rfs.MaxFileSize; limit > 0 && current+written > limit {
+		file.Truncate(current)
+		writeFileTooLarge(w, limit)
+		return
+	}
+	if err := file.Sync(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	if copyErr != nil {
+		http.Error(w, fmt.Sprintf("Failed to receive chunk after %d bytes: %v", written, copyErr), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, uploadStatus(session, current+written))
+}
+
+// handleCompleteUpload stores the data received for an upload and
+// discards the upload. An upload short of its declared size is answered
+// with 409 and the offset to resume from.
+func (s *Server) handleCompleteUpload(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(w, r, OperationStore, "") {
+		return
+	}
+	session, ok := s.claimUpload(w, r)
+	if !ok {
+		return
+	}
+	defer s.uploads.release(session.ID)
+
+	file, err := os.Open(s.uploads.dataPath(session.ID))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to open upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to open upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if session.Size != randomfs.UnknownSize && info.Size() != session.Size {
+		status := uploadStatus(session, info.Size())
+		status["error"] = fmt.Sprintf("received %d of %d bytes", info.Size(), session.Size)
+		writeJSON(w, http.StatusConflict, status)
+		return
+	}
+
+	randomURL, err := s.rfs.StoreReaderAt(session.FileName, file, info.Size(), session.ContentType)
+	if err == nil {
+		if removeErr := s.uploads.remove(session.ID); removeErr != nil {
+			slog.Error("Failed to remove completed upload", "id", session.ID, "error", removeErr)
+		}
+	}
+	writeStoreResult(w, randomURL, nil, err)
+}
+
+// handleAbortUpload discards an upload and the data received for it
+func (s *Server) handleAbortUpload(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(w, r, OperationStore, "") {
+		return
+	}
+	session, ok := s.claimUpload(w, r)
+	if !ok {
+		return
+	}
+	defer s.uploads.release(session.ID)
+
+	if err := s.uploads.remove(session.ID); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to discard upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"id":      session.ID,
+	})
+}
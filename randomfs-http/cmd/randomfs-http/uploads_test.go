@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// uploadRequest sends a request to the upload API of s and decodes the
+// JSON response into a map
+func uploadRequest(t *testing.T, s *Server, method, target string, body io.Reader) (int, map[string]interface{}) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(method, target, body))
+	resp := make(map[string]interface{})
+	if strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") {
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s %s returned invalid JSON: %v", method, target, err)
+		}
+	}
+	return rec.Code, resp
+}
+
+// startUpload creates an upload session and returns its ID
+func startUpload(t *testing.T, s *Server, request string) string {
+	t.Helper()
+	code, resp := uploadRequest(t, s, http.MethodPost, "/api/v1/uploads", strings.NewReader(request))
+	if code != http.StatusCreated {
+		t.Fatalf("creating upload returned %d: %v", code, resp)
+	}
+	return resp["id"].(string)
+}
+
+// droppedBody returns data and then fails, like a connection that drops
+// part way through a chunk
+type droppedBody struct {
+	data []byte
+}
+
+func (b *droppedBody) Read(p []byte) (int, error) {
+	if len(b.data) == 0 {
+		return 0, errors.New("connection reset")
+	}
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+	return n, nil
+}
+
+func TestResumableUpload(t *testing.T) {
+	s := newTestServer(t)
+	data := make([]byte, 3*1024*1024+11)
+	rand.Read(data)
+	id := startUpload(t, s, fmt.Sprintf(`{"filename":"backup.tar","size":%d,"content_type":"application/x-tar"}`, len(data)))
+	chunk := func(offset int, body io.Reader) (int, map[string]interface{}) {
+		return uploadRequest(t, s, http.MethodPut, fmt.Sprintf("/api/v1/uploads/%s/%d", id, offset), body)
+	}
+
+	if code, resp := chunk(0, bytes.NewReader(data[:1024*1024])); code != http.StatusOK || resp["offset"] != float64(1024*1024) {
+		t.Fatalf("first chunk returned %d: %v", code, resp)
+	}
+	// A dropped chunk keeps what arrived, and the client resumes from the
+	// offset the server reports
+	chunk(1024*1024, &droppedBody{data: data[1024*1024 : 1500*1024]})
+	code, resp := uploadRequest(t, s, http.MethodGet, "/api/v1/uploads/"+id, nil)
+	if code != http.StatusOK || resp["offset"] != float64(1500*1024) || resp["size"] != float64(len(data)) {
+		t.Fatalf("status returned %d: %v", code, resp)
+	}
+	if code, resp := chunk(1024*1024, bytes.NewReader(data[1024*1024:])); code != http.StatusConflict || resp["offset"] != float64(1500*1024) {
+		t.Fatalf("chunk at a stale offset returned %d: %v", code, resp)
+	}
+	if code, resp := uploadRequest(t, s, http.MethodPost, "/api/v1/uploads/"+id+"/complete", nil); code != http.StatusConflict {
+		t.Fatalf("completing a partial upload returned %d: %v", code, resp)
+	}
+
+	// The session is kept in the data directory, so a restarted server
+	// carries on with it
+	s = NewServer(s.rfs, 0, "")
+	if code, resp := chunk(1500*1024, bytes.NewReader(data[1500*1024:])); code != http.StatusOK || resp["offset"] != float64(len(data)) {
+		t.Fatalf("resumed chunk returned %d: %v", code, resp)
+	}
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/uploads/"+id+"/complete", nil))
+	_, hash := storeResponse(t, rec)
+
+	stored, rep, err := s.rfs.RetrieveFile(hash)
+	if err != nil || !bytes.Equal(stored, data) {
+		t.Fatalf("retrieving the upload returned %d bytes: %v", len(stored), err)
+	}
+	if rep.FileName != "backup.tar" || rep.ContentType != "application/x-tar" {
+		t.Errorf("stored as %s (%s)", rep.FileName, rep.ContentType)
+	}
+	if code, _ := uploadRequest(t, s, http.MethodGet, "/api/v1/uploads/"+id, nil); code != http.StatusNotFound {
+		t.Errorf("completed upload still reported with %d", code)
+	}
+}
+
+func TestUploadRejectsBadChunks(t *testing.T) {
+	s := newTestServer(t)
+	id := startUpload(t, s, `{"filename":"small.txt","size":10}`)
+
+	code, _ := uploadRequest(t, s, http.MethodPut, "/api/v1/uploads/"+id+"/0", strings.NewReader("more than ten bytes"))
+	if code != http.StatusRequestEntityTooLarge {
+		t.Errorf("overrunning chunk returned %d", code)
+	}
+	if _, resp := uploadRequest(t, s, http.MethodGet, "/api/v1/uploads/"+id, nil); resp["offset"] != float64(0) {
+		t.Errorf("overrunning chunk left offset %v", resp["offset"])
+	}
+
+	if code, _ := uploadRequest(t, s, http.MethodPost, "/api/v1/uploads", strings.NewReader(`{"size":10}`)); code != http.StatusBadRequest {
+		t.Errorf("upload without a filename returned %d", code)
+	}
+	for _, target := range []string{"/api/v1/uploads/unknown", "/api/v1/uploads/" + strings.Repeat("0", 32)} {
+		if code, _ := uploadRequest(t, s, http.MethodGet, target, nil); code != http.StatusNotFound {
+			t.Errorf("GET %s returned %d", target, code)
+		}
+	}
+
+	if code, _ := uploadRequest(t, s, http.MethodDelete, "/api/v1/uploads/"+id, nil); code != http.StatusOK {
+		t.Fatalf("abort returned %d", code)
+	}
+	if code, _ := uploadRequest(t, s, http.MethodPut, "/api/v1/uploads/"+id+"/0", strings.NewReader("x")); code != http.StatusNotFound {
+		t.Errorf("chunk for an aborted upload returned %d", code)
+	}
+}
+
+func TestUploadWithoutSizeAndExpiry(t *testing.T) {
+	s := newTestServer(t)
+	id := startUpload(t, s, `{"filename":"stream.log"}`)
+	for offset, part := range []string{"first ", "second"} {
+		target := fmt.Sprintf("/api/v1/uploads/%s/%d", id, offset*len("first "))
+		if code, resp := uploadRequest(t, s, http.MethodPut, target, strings.NewReader(part)); code != http.StatusOK {
+			t.Fatalf("chunk %d returned %d: %v", offset, code, resp)
+		}
+	}
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/v1/uploads/"+id+"/complete", nil))
+	if _, hash := storeResponse(t, rec); hash == "" {
+		t.Fatal("completed upload returned no hash")
+	}
+
+	// Uploads idle for longer than the expiry are discarded
+	stale := startUpload(t, s, `{"filename":"stale.bin"}`)
+	old := time.Now().Add(-2 * uploadExpiry)
+	os.Chtimes(filepath.Join(s.rfs.DataDir(), uploadDirName, stale, "data"), old, old)
+	startUpload(t, s, `{"filename":"fresh.bin"}`)
+	if code, _ := uploadRequest(t, s, http.MethodGet, "/api/v1/uploads/"+stale, nil); code != http.StatusNotFound {
+		t.Errorf("stale upload still reported with %d", code)
+	}
+}
+
+func TestUploadRejectsFilesOverMaxFileSize(t *testing.T) {
+	s := newTestServer(t)
+	s.rfs.MaxFileSize = 8
+
+	if code, resp := uploadRequest(t, s, http.MethodPost, "/api/v1/uploads", strings.NewReader(`{"filename":"big.bin","size":9}`)); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("declaring a size over the limit returned %d: %v", code, resp)
+	}
+
+	// Without a declared size, the chunk crossing the limit is refused
+	id := startUpload(t, s, `{"filename":"stream.log"}`)
+	if code, resp := uploadRequest(t, s, http.MethodPut, "/api/v1/uploads/"+id+"/0", strings.NewReader("12345")); code != http.StatusOK {
+		t.Fatalf("chunk under the limit returned %d: %v", code, resp)
+	}
+	if code, resp := uploadRequest(t, s, http.MethodPut, "/api/v1/uploads/"+id+"/5", strings.NewReader("6789")); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("chunk crossing the limit returned %d: %v", code, resp)
+	}
+	if code, resp := uploadRequest(t, s, http.MethodGet, "/api/v1/uploads/"+id, nil); code != http.StatusOK || resp["offset"] != float64(5) {
+		t.Errorf("upload after the refused chunk is at %v (%d)", resp["offset"], code)
+	}
+}